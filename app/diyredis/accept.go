@@ -0,0 +1,74 @@
+package diyredis
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Limits on new connections, so that a flood of them can't take the server down.
+type ConnLimits struct {
+	MaxPerIP     int // connected clients from a single address, 0 for no limit
+	MaxPerSecond int // connections accepted per second, from all addresses together, 0 for no limit
+}
+
+// Keeps count of connections for ConnLimits.
+type acceptGuard struct {
+	mutex    sync.Mutex
+	perIP    map[string]int // connected clients, by address
+	second   time.Time      // when the current one-second window started
+	accepted int            // in the current window
+	refused  int            // in the current window
+	rejected atomic.Int64   // refused since the start, for INFO stats
+}
+
+var (
+	errTooManyFromIP   = &UserError{"ERR", "max number of clients from your address reached"}
+	errTooManyAccepted = &UserError{"ERR", "too many new connections, try again later"}
+)
+
+// Count a new connection from ip, unless it goes over limits, in which case the error to
+// refuse it with is returned instead. first is true for the first connection refused in
+// a second, so that a flood doesn't flood the log too.
+func (g *acceptGuard) admit(ip string, limits ConnLimits, now time.Time) (uerr *UserError, first bool) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if now.Sub(g.second) >= time.Second {
+		g.second, g.accepted, g.refused = now, 0, 0
+	}
+	if limits.MaxPerSecond > 0 && g.accepted >= limits.MaxPerSecond {
+		uerr = errTooManyAccepted
+	} else if limits.MaxPerIP > 0 && g.perIP[ip] >= limits.MaxPerIP {
+		uerr = errTooManyFromIP
+	}
+	if uerr != nil {
+		g.refused++
+		g.rejected.Add(1)
+		return uerr, g.refused == 1
+	}
+	if g.perIP == nil {
+		g.perIP = map[string]int{}
+	}
+	g.accepted++
+	g.perIP[ip]++
+	return nil, false
+}
+
+// Forget about a connection from ip that admit let in, once it is closed.
+func (g *acceptGuard) release(ip string) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if g.perIP[ip]--; g.perIP[ip] <= 0 {
+		delete(g.perIP, ip)
+	}
+}
+
+// The address of the client at the other end of conn, without the port, which differs
+// from one connection to the next.
+func clientIP(conn net.Conn) string {
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP.String()
+	}
+	return conn.RemoteAddr().String()
+}
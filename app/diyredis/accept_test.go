@@ -0,0 +1,72 @@
+package diyredis
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAcceptGuard(t *testing.T) {
+	var g acceptGuard
+	now := time.Unix(1700000000, 0)
+	limits := ConnLimits{MaxPerIP: 2, MaxPerSecond: 3}
+
+	for i := range 2 {
+		if uerr, _ := g.admit("10.0.0.1", limits, now); uerr != nil {
+			t.Fatalf("connection %d: %v", i, uerr)
+		}
+	}
+	if uerr, first := g.admit("10.0.0.1", limits, now); uerr != errTooManyFromIP || !first {
+		t.Errorf("third from the same address: got %v, first %v", uerr, first)
+	}
+	if uerr, _ := g.admit("10.0.0.2", limits, now); uerr != nil {
+		t.Errorf("from another address: %v", uerr)
+	}
+	if uerr, first := g.admit("10.0.0.3", limits, now); uerr != errTooManyAccepted || first {
+		t.Errorf("fourth in a second: got %v, first %v", uerr, first)
+	}
+
+	// A second later, only the limit per address still applies
+	now = now.Add(time.Second)
+	if uerr, _ := g.admit("10.0.0.1", limits, now); uerr != errTooManyFromIP {
+		t.Errorf("third from the same address, a second later: got %v", uerr)
+	}
+	g.release("10.0.0.1")
+	if uerr, _ := g.admit("10.0.0.1", limits, now); uerr != nil {
+		t.Errorf("after one disconnected: %v", uerr)
+	}
+	if got := g.rejected.Load(); got != 3 {
+		t.Errorf("counted %d rejected connections, want 3", got)
+	}
+}
+
+func TestMaxClientsPerIP(t *testing.T) {
+	server := MakeServer()
+	server.ConnLimits.MaxPerIP = 1
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go server.serve(listener)
+
+	first, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	first.Write([]byte("*1\r\n$4\r\nPING\r\n"))
+	if reply, _ := bufio.NewReader(first).ReadString('\n'); reply != "+PONG\r\n" {
+		t.Fatalf("first client: got %q", reply)
+	}
+
+	second, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	if reply, _ := bufio.NewReader(second).ReadString('\n'); reply != string(errTooManyFromIP.RESP()) {
+		t.Errorf("second client: got %q", reply)
+	}
+}
@@ -0,0 +1,258 @@
+package diyredis
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Loading of append only files (AOF), as written by Redis 7 and up: a directory holding a
+// base file, that is either an RDB file or an AOF of its own, followed by any number of
+// incremental files with the commands executed since. A manifest file lists which of
+// the files in the directory make up the current dataset, and in which order.
+//
+// Older, single file AOFs (appendonly.aof, next to the RDB file) are loaded as well. Those
+// may start with an RDB preamble, followed by commands.
+
+const (
+	aofTypeBase    = "b"
+	aofTypeHistory = "h" // left over from before the last rewrite; not part of the dataset
+	aofTypeIncr    = "i"
+)
+
+type aofFile struct {
+	name     string
+	seq      int
+	fileType string
+}
+
+// Parse a manifest, returning the base file (if any) and the incremental files in the
+// order they should be loaded in.
+//
+// Every line describes a file as key value pairs, e.g.
+//
+//	file appendonly.aof.1.base.rdb seq 1 type b
+//	file appendonly.aof.1.incr.aof seq 1 type i
+//
+// File names with spaces (which Redis would quote) are not supported.
+func parseAofManifest(r io.Reader) (*aofFile, []aofFile, error) {
+	var base *aofFile
+	var incrs []aofFile
+
+	scanner := bufio.NewScanner(r)
+	for lineNr := 1; scanner.Scan(); lineNr++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields)%2 != 0 {
+			return nil, nil, fmt.Errorf("manifest line %d: invalid format", lineNr)
+		}
+
+		var file aofFile
+		var err error
+		for i := 0; i < len(fields); i += 2 {
+			switch fields[i] {
+			case "file":
+				file.name = fields[i+1]
+			case "seq":
+				file.seq, err = strconv.Atoi(fields[i+1])
+			case "type":
+				file.fileType = fields[i+1]
+			}
+			// Unknown keys are allowed, for forward compatibility
+		}
+		if err != nil || file.name == "" || file.fileType == "" {
+			return nil, nil, fmt.Errorf("manifest line %d: invalid format", lineNr)
+		}
+		if strings.ContainsRune(file.name, filepath.Separator) {
+			return nil, nil, fmt.Errorf("manifest line %d: file name may not contain a path", lineNr)
+		}
+
+		switch file.fileType {
+		case aofTypeBase:
+			if base != nil {
+				return nil, nil, fmt.Errorf("manifest line %d: more than one base file", lineNr)
+			}
+			base = &file
+		case aofTypeIncr:
+			incrs = append(incrs, file)
+		case aofTypeHistory:
+		default:
+			return nil, nil, fmt.Errorf("manifest line %d: unknown file type %q", lineNr, file.fileType)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	slices.SortFunc(incrs, func(a aofFile, b aofFile) int { return a.seq - b.seq })
+	return base, incrs, nil
+}
+
+// Load the dataset from the AOF if append only mode is enabled and there is one, from the
+// RDB file otherwise.
+func (s *Server) LoadData() error {
+	if s.AppendOnly {
+		loaded, err := s.LoadAof()
+		if err != nil || loaded {
+			return err
+		}
+	}
+	return s.LoadRdb()
+}
+
+// Load the dataset from the AOF, returning false if there is none to load.
+func (s *Server) LoadAof() (bool, error) {
+	if s.RdbDir == "" || s.AppendFilename == "" {
+		return false, nil
+	}
+
+	dir := filepath.Join(s.RdbDir, s.AppendDirname)
+	manifest, err := os.Open(filepath.Join(dir, s.AppendFilename+".manifest"))
+	if os.IsNotExist(err) {
+		return s.loadLegacyAof()
+	}
+	if err != nil {
+		return false, err
+	}
+	defer manifest.Close()
+
+	base, incrs, err := parseAofManifest(manifest)
+	if err != nil {
+		return false, err
+	}
+	files := incrs
+	if base != nil {
+		files = append([]aofFile{*base}, incrs...)
+	}
+	// Check the whole set is there before loading anything
+	for _, file := range files {
+		if _, err := os.Stat(filepath.Join(dir, file.name)); err != nil {
+			return false, fmt.Errorf("AOF file listed in manifest is missing: %w", err)
+		}
+	}
+
+	s.Log.Info("Loading AOF...", "dir", dir)
+	for i, file := range files {
+		err := s.loadAofFile(filepath.Join(dir, file.name), i == len(files)-1)
+		if err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// Load a pre-7.0 AOF, which is a single file next to the RDB file.
+func (s *Server) loadLegacyAof() (bool, error) {
+	fn := filepath.Join(s.RdbDir, s.AppendFilename)
+	if _, err := os.Stat(fn); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	s.Log.Info("Loading AOF...", "file", fn)
+	return true, s.loadAofFile(fn, true)
+}
+
+// Load a single AOF file, which may be an RDB file, a list of commands or an RDB
+// preamble followed by commands.
+//
+// Only the last file may be truncated, which happens when the server stops halfway
+// through appending a command. Everything up to the truncated command is loaded.
+func (s *Server) loadAofFile(fn string, last bool) error {
+	file, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+
+	if magic, _ := reader.Peek(5); string(magic) == "REDIS" {
+		if strings.HasSuffix(fn, ".rdb") {
+			if err := rdbPreFlight(fn, s.RdbChecksum, s.Log); err != nil {
+				return fmt.Errorf("%s: %w", fn, err)
+			}
+		}
+		// Wraps the same bufio.Reader, so that we can continue with the commands after
+		r := newRdbReader(reader)
+		if err := s.loadRdb(r, s.dbs); err != nil {
+			return fmt.Errorf("%s: %w", fn, err)
+		}
+		if _, err := r.readFull(8); err != nil { // checksum
+			return fmt.Errorf("%s: %w", fn, err)
+		}
+	}
+
+	session := &Session{server: s, conn: discardConn{}, db: s.db(0), log: s.Log}
+	for {
+		next, err := reader.Peek(1)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if next[0] == '#' {
+			// Annotation, e.g. a timestamp
+			if _, err := reader.ReadString('\n'); err != nil {
+				return s.aofTruncated(fn, last, err)
+			}
+			continue
+		}
+
+		cmd, err := ParseCommand(reader, s.ProtoLimits)
+		if err != nil {
+			return s.aofTruncated(fn, last, err)
+		}
+		if err := session.replay(cmd); err != nil {
+			return fmt.Errorf("%s: %w", fn, err)
+		}
+	}
+}
+
+func (s *Server) aofTruncated(fn string, last bool, err error) error {
+	if last && (errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)) {
+		s.Log.Warn("AOF is truncated, loaded up to the last complete command", "file", fn)
+		return nil
+	}
+	return fmt.Errorf("%s: bad file format: %w", fn, err)
+}
+
+// Execute a command read from the AOF, without replying to anyone.
+func (s *Session) replay(cmd []string) error {
+	if len(cmd) == 0 {
+		return errors.New("empty command")
+	}
+	name := strings.ToLower(cmd[0])
+	if name == "multi" || name == "exec" {
+		// Transactions were atomic when they were executed, and so is loading
+		return nil
+	}
+	spec, ok := commandTable[name]
+	if !ok {
+		return fmt.Errorf("unknown command %q", cmd[0])
+	}
+	if uerr := spec.handler(s, cmd); uerr != nil {
+		return fmt.Errorf("%s: %w", cmd[0], uerr)
+	}
+	return nil
+}
+
+// A connection that nobody is listening on.
+type discardConn struct {
+	net.Conn
+}
+
+func (discardConn) Write(b []byte) (int, error) {
+	return len(b), nil
+}
@@ -0,0 +1,178 @@
+package diyredis
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseAofManifest(t *testing.T) {
+	base, incrs, err := parseAofManifest(strings.NewReader(
+		"file appendonly.aof.2.base.rdb seq 2 type b\n" +
+			"file appendonly.aof.1.incr.aof seq 1 type h\n" +
+			"file appendonly.aof.3.incr.aof seq 3 type i\n" +
+			"file appendonly.aof.2.incr.aof seq 2 type i\n",
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if base == nil || base.name != "appendonly.aof.2.base.rdb" {
+		t.Errorf("got base %v", base)
+	}
+	if len(incrs) != 2 || incrs[0].seq != 2 || incrs[1].seq != 3 {
+		t.Errorf("got incremental files %v, want seq 2 and 3 in order", incrs)
+	}
+
+	for _, bad := range []string{
+		"file a seq 1 type b\nfile b seq 2 type b\n",
+		"file a seq x type i\n",
+		"file a seq 1\n",
+		"file ../a seq 1 type i\n",
+		"file a seq 1 type z\n",
+	} {
+		if _, _, err := parseAofManifest(strings.NewReader(bad)); err == nil {
+			t.Errorf("no error for %q", bad)
+		}
+	}
+}
+
+func respCommand(args ...string) string {
+	return string(makeRESPArr(args))
+}
+
+func TestLoadAof(t *testing.T) {
+	// Base file as RDB, written from another server
+	source := MakeServer()
+	source.dbs[0].engine.Set("base", "1")
+	source.dbs[0].engine.Set("overwritten", "old")
+	rdb := writeTestRdb(t, source)
+
+	dir := t.TempDir()
+	aofDir := filepath.Join(dir, "appendonlydir")
+	os.Mkdir(aofDir, 0o755)
+	files := map[string]string{
+		"appendonly.aof.manifest": "file appendonly.aof.1.base.rdb seq 1 type b\n" +
+			"file appendonly.aof.1.incr.aof seq 1 type i\n" +
+			"file appendonly.aof.2.incr.aof seq 2 type i\n",
+		"appendonly.aof.1.base.rdb": string(rdb),
+		"appendonly.aof.1.incr.aof": respCommand("SET", "overwritten", "new") +
+			"#TS:1700000000\r\n" + respCommand("SELECT", "2") + respCommand("SET", "db2", "2"),
+		// The last file is allowed to be cut off halfway through a command
+		"appendonly.aof.2.incr.aof": respCommand("SET", "incr", "3") + "*3\r\n$3\r\nSET\r\n$4\r\nlo",
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(aofDir, name), []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	server := MakeServer()
+	server.RdbDir = dir
+	server.AppendOnly = true
+	if err := server.LoadData(); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []struct {
+		db    int
+		key   string
+		value string
+	}{{0, "base", "1"}, {0, "overwritten", "new"}, {2, "db2", "2"}, {0, "incr", "3"}} {
+		if got, _ := loadString(server.dbs[want.db], want.key); got != want.value {
+			t.Errorf("db %d: got %v for %q, want %q", want.db, got, want.key, want.value)
+		}
+	}
+
+	// A truncated file that isn't the last one is an error
+	os.WriteFile(filepath.Join(aofDir, "appendonly.aof.1.incr.aof"), []byte("*3\r\n$3\r\nSET"), 0o644)
+	if err := MakeServer().loadAofFile(filepath.Join(aofDir, "appendonly.aof.1.incr.aof"), false); err == nil {
+		t.Errorf("no error for a truncated file")
+	}
+}
+
+func TestLoadLegacyAof(t *testing.T) {
+	source := MakeServer()
+	source.dbs[0].engine.Set("preamble", "1")
+	data := append(writeTestRdb(t, source), respCommand("SET", "command", "2")...)
+
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "appendonly.aof"), data, 0o644)
+
+	server := MakeServer()
+	server.RdbDir = dir
+	loaded, err := server.LoadAof()
+	if err != nil || !loaded {
+		t.Fatalf("got (%v, %v)", loaded, err)
+	}
+	for key, want := range map[string]string{"preamble": "1", "command": "2"} {
+		if got, _ := loadString(server.dbs[0], key); got != want {
+			t.Errorf("got %v for %q, want %q", got, key, want)
+		}
+	}
+}
+
+func TestCheckAof(t *testing.T) {
+	server := MakeServer()
+	dir := t.TempDir()
+	valid := respCommand("SET", "a", "1") + "#TS:1700000000\r\n" +
+		respCommand("MULTI") + respCommand("INCR", "a") + respCommand("EXEC") // 93 bytes
+	check := func(data string, fix bool) (string, error) {
+		fn := filepath.Join(dir, "appendonly.aof")
+		if err := os.WriteFile(fn, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		var out strings.Builder
+		err := server.CheckAof(fn, fix, &out)
+		return out.String(), err
+	}
+
+	if out, err := check(valid, false); err != nil || !strings.Contains(out, "AOF is valid\n") {
+		t.Errorf("valid AOF: got %v, %q", err, out)
+	}
+
+	for _, test := range []struct {
+		name string
+		data string
+		want string
+	}{
+		{"truncated", valid + "*3\r\n$3\r\nSET\r\n$1\r\nb", "command at offset 93"},
+		{"garbage", valid + "+OK\r\n", "command at offset 93"},
+		{"transaction not ended", valid + respCommand("MULTI") + respCommand("INCR", "a"), "MULTI at offset 93: the transaction doesn't end"},
+	} {
+		out, err := check(test.data, false)
+		if err == nil || !strings.Contains(out, "ok_up_to=93,") || !strings.Contains(out, test.want) {
+			t.Errorf("%s: got %v, %q", test.name, err, out)
+		}
+		if out, err := check(test.data, true); err != nil || !strings.Contains(out, "Successfully truncated AOF to 93 bytes") {
+			t.Errorf("%s, fixed: got %v, %q", test.name, err, out)
+		}
+		if data, _ := os.ReadFile(filepath.Join(dir, "appendonly.aof")); string(data) != valid {
+			t.Errorf("%s, fixed: got %q, want the valid commands only", test.name, data)
+		}
+	}
+
+	// Every file of a manifest is checked, though only the last one can be fixed
+	rdb := writeTestRdb(t, MakeServer())
+	files := map[string]string{
+		"appendonly.aof.manifest": "file appendonly.aof.1.base.rdb seq 1 type b\n" +
+			"file appendonly.aof.1.incr.aof seq 1 type i\n" +
+			"file appendonly.aof.2.incr.aof seq 2 type i\n",
+		"appendonly.aof.1.base.rdb": string(rdb),
+		"appendonly.aof.1.incr.aof": valid,
+		"appendonly.aof.2.incr.aof": valid + "*1\r\n",
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var out strings.Builder
+	if err := server.CheckAof(filepath.Join(dir, "appendonly.aof.manifest"), true, &out); err != nil || strings.Count(out.String(), "AOF is valid\n") != 2 {
+		t.Errorf("manifest: got %v, %q", err, out.String())
+	}
+	os.WriteFile(filepath.Join(dir, "appendonly.aof.1.incr.aof"), []byte(valid+"*1\r\n"), 0o644)
+	out.Reset()
+	if err := server.CheckAof(filepath.Join(dir, "appendonly.aof.manifest"), true, &out); err == nil || !strings.Contains(err.Error(), "only the last file") {
+		t.Errorf("manifest with a truncated file in the middle: got %v, %q", err, out.String())
+	}
+}
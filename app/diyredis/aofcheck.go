@@ -0,0 +1,159 @@
+package diyredis
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Check an AOF without loading it, like redis-check-aof: filename is either a manifest,
+// in which case every file it lists is checked, or a single file of a pre-7.0 AOF. Each
+// has to be made of complete commands, with the transactions in it ended, after an RDB
+// preamble if it has one. What was found is written to w, for each file its size and the
+// offset up to which it is valid. Returns an error if any of them isn't.
+//
+// With fix, the last file is truncated to the end of its last valid command, which is
+// how a server that stopped halfway through appending one is recovered from. Only the
+// last file can end that way, so the others are never truncated.
+func (s *Server) CheckAof(filename string, fix bool, w io.Writer) error {
+	files := []string{filename}
+	if strings.HasSuffix(filename, ".manifest") {
+		manifest, err := os.Open(filename)
+		if err != nil {
+			return err
+		}
+		base, incrs, err := parseAofManifest(manifest)
+		manifest.Close()
+		if err != nil {
+			return err
+		}
+		if base != nil {
+			incrs = append([]aofFile{*base}, incrs...)
+		}
+		files = files[:0]
+		for _, file := range incrs {
+			files = append(files, filepath.Join(filepath.Dir(filename), file.name))
+		}
+	}
+
+	for i, fn := range files {
+		fmt.Fprintf(w, "Checking AOF file %s\n", fn)
+		size, validUpTo, err := s.checkAofFile(fn)
+		if err != nil && validUpTo < 0 {
+			return err // couldn't even read it
+		}
+		fmt.Fprintf(w, "AOF analyzed: size=%d, ok_up_to=%d, diff=%d\n", size, validUpTo, size-validUpTo)
+		if err == nil {
+			fmt.Fprintln(w, "AOF is valid")
+			continue
+		}
+		fmt.Fprintf(w, "AOF is not valid: %v\n", err)
+		if !fix {
+			return err
+		}
+		if i != len(files)-1 {
+			return fmt.Errorf("%s: only the last file of an AOF can be fixed: %w", fn, err)
+		}
+		if err := os.Truncate(fn, validUpTo); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "Successfully truncated AOF to %d bytes\n", validUpTo)
+	}
+	return nil
+}
+
+// Check a single AOF file, returning its size and the offset up to which it's valid,
+// which is the size if there is nothing wrong with it, and -1 if it couldn't be read.
+func (s *Server) checkAofFile(fn string) (int64, int64, error) {
+	file, err := os.Open(fn)
+	if err != nil {
+		return 0, -1, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return 0, -1, err
+	}
+	size := info.Size()
+	counter := &countingReader{r: file}
+	reader := bufio.NewReader(counter)
+	offset := func() int64 { return counter.n - int64(reader.Buffered()) }
+
+	if magic, _ := reader.Peek(5); string(magic) == "REDIS" {
+		r := newRdbReader(reader)
+		_, err := s.readRdb(r, s.dbCount(), func(int, string, byte, any, int64) {})
+		if err == nil {
+			_, err = r.readFull(8) // checksum
+		}
+		if err != nil {
+			return size, 0, fmt.Errorf("RDB preamble: %w", err)
+		}
+	}
+
+	validUpTo := offset()
+	multi := int64(-1) // where the transaction that isn't ended yet starts
+	for {
+		next, err := reader.Peek(1)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return size, validUpTo, err
+		}
+		if next[0] == '#' {
+			// Annotation, e.g. a timestamp
+			if _, err := reader.ReadString('\n'); err != nil {
+				return size, validUpTo, fmt.Errorf("annotation at offset %d: %w", validUpTo, err)
+			}
+			validUpTo = offset()
+			continue
+		}
+
+		start := offset()
+		cmd, err := ParseCommand(reader, s.ProtoLimits)
+		if err == nil && len(cmd) == 0 {
+			err = errors.New("empty command")
+		}
+		if err != nil {
+			if multi >= 0 {
+				validUpTo = multi
+			}
+			return size, validUpTo, fmt.Errorf("command at offset %d: %w", start, err)
+		}
+		switch strings.ToLower(cmd[0]) {
+		case "multi":
+			if multi >= 0 {
+				return size, multi, fmt.Errorf("MULTI at offset %d: nested in the one at offset %d", start, multi)
+			}
+			multi = start
+		case "exec":
+			if multi < 0 {
+				return size, validUpTo, fmt.Errorf("EXEC at offset %d: without MULTI", start)
+			}
+			multi = -1
+		}
+		if multi < 0 {
+			validUpTo = offset()
+		}
+	}
+	if multi >= 0 {
+		return size, multi, fmt.Errorf("MULTI at offset %d: the transaction doesn't end", multi)
+	}
+	return size, validUpTo, nil
+}
+
+// Counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
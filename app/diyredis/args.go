@@ -0,0 +1,86 @@
+package diyredis
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Walks through the arguments of a command, for commands taking options. Tokens are
+// matched case-insensitively, and a missing argument is a syntax error, as in Redis, so
+// that every command reports them the same way.
+type argScanner struct {
+	cmds []string
+	pos  int // index of the next argument in cmds
+}
+
+// Scan cmds from cmds[pos] on, the ones before being the command name and whatever
+// arguments the command checked itself.
+func newArgScanner(cmds []string, pos int) *argScanner {
+	return &argScanner{cmds: cmds, pos: pos}
+}
+
+// Whether all the arguments have been consumed.
+func (a *argScanner) done() bool {
+	return a.pos >= len(a.cmds)
+}
+
+// The arguments that are left, without consuming them.
+func (a *argScanner) rest() []string {
+	return a.cmds[min(a.pos, len(a.cmds)):]
+}
+
+// Consume the next argument if it is one of tokens, which must be lower case, and
+// return it. Returns "" and consumes nothing otherwise.
+func (a *argScanner) acceptToken(tokens ...string) string {
+	if a.done() {
+		return ""
+	}
+	arg := strings.ToLower(a.cmds[a.pos])
+	for _, token := range tokens {
+		if arg == token {
+			a.pos++
+			return token
+		}
+	}
+	return ""
+}
+
+// Consume the next argument, which must be token.
+func (a *argScanner) expectToken(token string) *UserError {
+	if a.acceptToken(token) == "" {
+		return ErrSyntax()
+	}
+	return nil
+}
+
+// Consume the next argument, whatever it is.
+func (a *argScanner) read() (string, *UserError) {
+	if a.done() {
+		return "", ErrSyntax()
+	}
+	a.pos++
+	return a.cmds[a.pos-1], nil
+}
+
+// Consume the next argument as a 64-bit integer.
+func (a *argScanner) readInt() (int64, *UserError) {
+	arg, uerr := a.read()
+	if uerr != nil {
+		return 0, uerr
+	}
+	n, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil {
+		return 0, ErrNotInteger()
+	}
+	return n, nil
+}
+
+// Consume the next n arguments as a list of keys.
+func (a *argScanner) readKeyList(n int) ([]string, *UserError) {
+	if n < 0 || n > len(a.rest()) {
+		return nil, ErrSyntax()
+	}
+	keys := a.cmds[a.pos : a.pos+n]
+	a.pos += n
+	return keys, nil
+}
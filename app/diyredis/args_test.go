@@ -0,0 +1,51 @@
+package diyredis
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestArgScanner(t *testing.T) {
+	args := newArgScanner([]string{"XREAD", "Count", "5", "STREAMS", "a", "b", "0", "0"}, 1)
+	if got := args.acceptToken("block"); got != "" {
+		t.Errorf("accepted %q, want nothing", got)
+	}
+	if got := args.acceptToken("block", "count"); got != "count" {
+		t.Errorf("accepted %q, want count", got)
+	}
+	if n, uerr := args.readInt(); n != 5 || uerr != nil {
+		t.Errorf("readInt() = %v, %v", n, uerr)
+	}
+	if uerr := args.expectToken("streams"); uerr != nil {
+		t.Errorf("expectToken(streams) = %v", uerr)
+	}
+	if keys, uerr := args.readKeyList(2); !slices.Equal(keys, []string{"a", "b"}) || uerr != nil {
+		t.Errorf("readKeyList(2) = %v, %v", keys, uerr)
+	}
+	if _, uerr := args.readKeyList(3); uerr == nil {
+		t.Errorf("readKeyList(3) of 2 arguments: want a syntax error")
+	}
+	if got := args.rest(); !slices.Equal(got, []string{"0", "0"}) {
+		t.Errorf("rest() = %v", got)
+	}
+	if _, uerr := args.readInt(); uerr != nil {
+		t.Errorf("readInt() = %v", uerr)
+	}
+	if uerr := args.expectToken("0"); uerr != nil {
+		t.Errorf("expectToken(0) = %v", uerr)
+	}
+	if !args.done() {
+		t.Errorf("want done")
+	}
+	if _, uerr := args.read(); uerr == nil || uerr.msg != "syntax error" {
+		t.Errorf("read() past the end = %v, want a syntax error", uerr)
+	}
+	if _, uerr := args.readInt(); uerr == nil || uerr.msg != "syntax error" {
+		t.Errorf("readInt() past the end = %v, want a syntax error", uerr)
+	}
+
+	args = newArgScanner([]string{"SET", "k", "v", "EX", "soon"}, 4)
+	if _, uerr := args.readInt(); uerr == nil || uerr.msg != ErrNotInteger().msg {
+		t.Errorf("readInt() = %v, want not an integer", uerr)
+	}
+}
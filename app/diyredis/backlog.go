@@ -0,0 +1,46 @@
+package diyredis
+
+// Circular buffer of the most recently propagated commands, so that a replica that lost
+// its connection for a moment can be sent just what it missed.
+//
+// Positions in the backlog are replication offsets: the byte at offset o is the o-th
+// byte ever propagated.
+type replBacklog struct {
+	buf    []byte
+	end    int64 // offset right after the last byte written
+	length int   // number of bytes in buf that are part of the backlog
+}
+
+func newReplBacklog(size int, offset int64) *replBacklog {
+	return &replBacklog{buf: make([]byte, max(size, 1)), end: offset}
+}
+
+func (b *replBacklog) write(p []byte) {
+	for len(p) > 0 {
+		n := copy(b.buf[b.end%int64(len(b.buf)):], p)
+		p = p[n:]
+		b.end += int64(n)
+		b.length = min(b.length+n, len(b.buf))
+	}
+}
+
+// Offset of the first byte still in the backlog.
+func (b *replBacklog) start() int64 {
+	return b.end - int64(b.length)
+}
+
+// Return everything written from offset on, or false if part of it has been
+// overwritten already, or offset is past the end.
+func (b *replBacklog) since(offset int64) ([]byte, bool) {
+	if offset < b.start() || offset > b.end {
+		return nil, false
+	}
+	out := make([]byte, 0, b.end-offset)
+	from := int(offset % int64(len(b.buf)))
+	to := int(b.end % int64(len(b.buf)))
+	if from < to || offset == b.end {
+		return append(out, b.buf[from:to]...), true
+	}
+	out = append(out, b.buf[from:]...)
+	return append(out, b.buf[:to]...), true
+}
@@ -0,0 +1,41 @@
+package diyredis
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestReplBacklog(t *testing.T) {
+	b := newReplBacklog(8, 100)
+	if got, ok := b.since(100); !ok || len(got) != 0 {
+		t.Errorf("empty backlog: got %q %v, want nothing", got, ok)
+	}
+
+	b.write([]byte("abcde"))
+	b.write([]byte("fghij")) // wraps around, dropping "ab"
+	for _, tc := range []struct {
+		offset int64
+		want   string
+		ok     bool
+	}{
+		{101, "", false},
+		{102, "cdefghij", true},
+		{105, "fghij", true},
+		{108, "ij", true},
+		{110, "", true},
+		{111, "", false},
+	} {
+		got, ok := b.since(tc.offset)
+		if ok != tc.ok || !bytes.Equal(got, []byte(tc.want)) {
+			t.Errorf("since(%d): got %q %v, want %q %v", tc.offset, got, ok, tc.want, tc.ok)
+		}
+	}
+	if b.start() != 102 {
+		t.Errorf("start: got %d, want 102", b.start())
+	}
+
+	b.write([]byte("0123456789xyz")) // more than fits at once
+	if got, ok := b.since(b.start()); !ok || string(got) != "56789xyz" {
+		t.Errorf("after overflowing: got %q %v, want \"56789xyz\"", got, ok)
+	}
+}
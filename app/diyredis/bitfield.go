@@ -0,0 +1,262 @@
+package diyredis
+
+import (
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// An integer type of BITFIELD, e.g. i16 or u8: signed or unsigned, and 1 to 64 bits wide
+// (63 for unsigned ones, so that they fit in an int64 too).
+type bitfieldType struct {
+	signed bool
+	bits   uint
+}
+
+func parseBitfieldType(arg string) (bitfieldType, *UserError) {
+	var t bitfieldType
+	if len(arg) >= 2 {
+		bits, err := strconv.ParseUint(arg[1:], 10, 8)
+		t.bits = uint(bits)
+		switch {
+		case err != nil:
+		case arg[0] == 'i' || arg[0] == 'I':
+			if t.bits >= 1 && t.bits <= 64 {
+				t.signed = true
+				return t, nil
+			}
+		case arg[0] == 'u' || arg[0] == 'U':
+			if t.bits >= 1 && t.bits <= 63 {
+				return t, nil
+			}
+		}
+	}
+	return t, &UserError{"ERR", "Invalid bitfield type. Use something like i16 u8. Note that u64 is not supported but i64 is."}
+}
+
+// The smallest and largest values of the type.
+func (t bitfieldType) limits() (lo *big.Int, hi *big.Int) {
+	one := big.NewInt(1)
+	if t.signed {
+		hi = new(big.Int).Lsh(one, t.bits-1)
+		lo = new(big.Int).Neg(hi)
+		return lo, hi.Sub(hi, one)
+	}
+	hi = new(big.Int).Lsh(one, t.bits)
+	return big.NewInt(0), hi.Sub(hi, one)
+}
+
+// Make val fit in the type, as the overflow policy ("wrap", "sat" or "fail") says. ok is
+// false if it doesn't fit and the policy is "fail".
+func (t bitfieldType) fit(val *big.Int, overflow string) (result int64, ok bool) {
+	lo, hi := t.limits()
+	switch {
+	case val.Cmp(lo) >= 0 && val.Cmp(hi) <= 0:
+		return val.Int64(), true
+	case overflow == "fail":
+		return 0, false
+	case overflow == "sat":
+		if val.Sign() < 0 {
+			return lo.Int64(), true
+		}
+		return hi.Int64(), true
+	}
+	// Wrap around, keeping the lowest bits as two's complement does
+	mask := new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), t.bits), big.NewInt(1))
+	return t.fromBits(new(big.Int).And(val, mask).Uint64()), true
+}
+
+// Interpret the lowest bits of raw as a value of the type.
+func (t bitfieldType) fromBits(raw uint64) int64 {
+	if t.signed {
+		shift := 64 - t.bits
+		return int64(raw<<shift) >> shift
+	}
+	return int64(raw)
+}
+
+// Read the bits of buf from bit offset on, the most significant bit of each byte first.
+// Bits past the end of buf are zero.
+func getBits(buf []byte, offset uint64, bits uint) uint64 {
+	var raw uint64
+	for i := range uint64(bits) {
+		pos := offset + i
+		var bit uint64
+		if pos/8 < uint64(len(buf)) {
+			bit = uint64(buf[pos/8]>>(7-pos%8)) & 1
+		}
+		raw = raw<<1 | bit
+	}
+	return raw
+}
+
+// Overwrite the bits of buf from bit offset on with the lowest bits of raw. buf must be
+// long enough.
+func setBits(buf []byte, offset uint64, bits uint, raw uint64) {
+	for i := range uint64(bits) {
+		pos := offset + i
+		mask := byte(1) << (7 - pos%8)
+		if raw>>(uint64(bits)-1-i)&1 == 1 {
+			buf[pos/8] |= mask
+		} else {
+			buf[pos/8] &^= mask
+		}
+	}
+}
+
+// One GET, SET or INCRBY of BITFIELD.
+type bitfieldOp struct {
+	op       string
+	t        bitfieldType
+	offset   uint64 // in bits
+	value    int64  // to SET, or INCRBY
+	overflow string // in effect for this operation
+}
+
+// The offset of a BITFIELD operation: in bits, or in multiples of the type's width if
+// prefixed with "#".
+func (s *Session) parseBitfieldOffset(arg string, t bitfieldType) (uint64, *UserError) {
+	multiply := strings.HasPrefix(arg, "#")
+	offset, err := strconv.ParseUint(strings.TrimPrefix(arg, "#"), 10, 64)
+	if err == nil && multiply {
+		if offset > math.MaxUint64/uint64(t.bits) {
+			err = strconv.ErrRange // it would wrap around, to an offset in range
+		}
+		offset *= uint64(t.bits)
+	}
+	if err != nil || offset/8 >= uint64(s.server.ProtoLimits.MaxBulkLen) {
+		return 0, &UserError{"ERR", "bit offset is not an integer or out of range"}
+	}
+	return offset, nil
+}
+
+// BITFIELD key [GET encoding offset | [OVERFLOW WRAP|SAT|FAIL] SET encoding offset value
+// | INCRBY encoding offset increment ...]
+func (s *Session) doBITFIELD(cmds []string) *UserError {
+	if len(cmds) < 2 {
+		return &UserError{"ERR", "wrong number of arguments for BITFIELD command"}
+	}
+	var ops []bitfieldOp
+	write := false
+	overflow := "wrap"
+	args := newArgScanner(cmds, 2)
+	for !args.done() {
+		op := args.acceptToken("get", "set", "incrby", "overflow")
+		if op == "" {
+			return ErrSyntax()
+		}
+		if op == "overflow" {
+			arg, uerr := args.read()
+			if uerr != nil {
+				return uerr
+			}
+			overflow = strings.ToLower(arg)
+			if overflow != "wrap" && overflow != "sat" && overflow != "fail" {
+				return &UserError{"ERR", "Invalid OVERFLOW type specified"}
+			}
+			continue
+		}
+
+		typeArg, uerr := args.read()
+		if uerr != nil {
+			return uerr
+		}
+		t, uerr := parseBitfieldType(typeArg)
+		if uerr != nil {
+			return uerr
+		}
+		offsetArg, uerr := args.read()
+		if uerr != nil {
+			return uerr
+		}
+		offset, uerr := s.parseBitfieldOffset(offsetArg, t)
+		if uerr != nil {
+			return uerr
+		}
+		var value int64
+		if op != "get" {
+			if value, uerr = args.readInt(); uerr != nil {
+				return uerr
+			}
+			write = true
+		}
+		ops = append(ops, bitfieldOp{op, t, offset, value, overflow})
+	}
+
+	var results []int64
+	var failed []bool // for each result, whether it overflowed with OVERFLOW FAIL
+	if !write {
+		str, _, uerr := s.db.getString(cmds[1])
+		if uerr != nil {
+			return uerr
+		}
+		for _, op := range ops {
+			results = append(results, op.t.fromBits(getBits([]byte(str), op.offset, op.t.bits)))
+			failed = append(failed, false)
+		}
+	} else {
+		uerr := s.db.compute(cmds[1], true, func(value any, exists bool) (any, *UserError) {
+			var str string
+			if exists {
+				var ok bool
+				if str, ok = stringValue(value); !ok {
+					return nil, ErrWrongType()
+				}
+			}
+			// Grown up front to fit whatever is set, even if that overflows, as by Redis
+			size := len(str)
+			for _, op := range ops {
+				if op.op != "get" {
+					size = max(size, int((op.offset+uint64(op.t.bits)+7)/8))
+				}
+			}
+			buf := make([]byte, size)
+			copy(buf, str)
+
+			results, failed = results[:0], failed[:0]
+			for _, op := range ops {
+				old := op.t.fromBits(getBits(buf, op.offset, op.t.bits))
+				var val *big.Int
+				switch {
+				case op.op == "get":
+					results, failed = append(results, old), append(failed, false)
+					continue
+				case op.op == "incrby":
+					val = new(big.Int).Add(big.NewInt(old), big.NewInt(op.value))
+				case op.t.signed:
+					val = big.NewInt(op.value)
+				default:
+					// A negative value is as big an unsigned one as it gets, as by Redis
+					val = new(big.Int).SetUint64(uint64(op.value))
+				}
+				result, ok := op.t.fit(val, op.overflow)
+				if !ok {
+					results, failed = append(results, 0), append(failed, true)
+					continue
+				}
+				setBits(buf, op.offset, op.t.bits, uint64(result))
+				if op.op == "set" {
+					result = old
+				}
+				results, failed = append(results, result), append(failed, false)
+			}
+			return newStringValue(string(buf)), nil
+		})
+		if uerr != nil {
+			return uerr
+		}
+	}
+
+	encoder := s.encoder()
+	encoder.WriteArrHeader(len(results))
+	for i, result := range results {
+		if failed[i] {
+			encoder.WriteNull()
+		} else {
+			encoder.WriteIntFast(result)
+		}
+	}
+	s.conn.Write(encoder.Buf)
+	return nil
+}
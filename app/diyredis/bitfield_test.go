@@ -0,0 +1,54 @@
+package diyredis
+
+import "testing"
+
+func TestBitfield(t *testing.T) {
+	server := MakeServer()
+	session, conn := newTestSession(server)
+	run := func(cmd ...string) string {
+		conn.buf.Reset()
+		session.dispatch(cmd)
+		return conn.buf.String()
+	}
+
+	for _, tc := range []struct {
+		cmd  []string
+		want string
+	}{
+		// Missing keys read as zeros, and aren't created by GET
+		{[]string{"BITFIELD", "key", "GET", "u8", "0"}, "*1\r\n:0\r\n"},
+		{[]string{"EXISTS", "key"}, ":0\r\n"},
+		{[]string{"BITFIELD", "key", "SET", "u8", "0", "255", "GET", "u4", "0", "GET", "i4", "0"}, "*3\r\n:0\r\n:15\r\n:-1\r\n"},
+		{[]string{"GET", "key"}, "$1\r\n\xff\r\n"},
+		// Offsets in bits, or in multiples of the width with "#"
+		{[]string{"BITFIELD", "key", "SET", "u8", "#1", "65", "GET", "u8", "8", "GET", "u1", "9"}, "*3\r\n:0\r\n:65\r\n:1\r\n"},
+		{[]string{"GET", "key"}, "$2\r\n\xffA\r\n"},
+		{[]string{"BITFIELD", "key", "SET", "i64", "16", "-2", "GET", "i64", "16", "GET", "u63", "16"}, "*3\r\n:0\r\n:-2\r\n:9223372036854775807\r\n"},
+
+		// Overflow: wrapping around by default
+		{[]string{"DEL", "key"}, ":1\r\n"},
+		{[]string{"BITFIELD", "key", "INCRBY", "u2", "0", "5"}, "*1\r\n:1\r\n"},
+		{[]string{"BITFIELD", "key", "INCRBY", "i8", "8", "127", "INCRBY", "i8", "8", "1"}, "*2\r\n:127\r\n:-128\r\n"},
+		{[]string{"BITFIELD", "key", "OVERFLOW", "SAT", "INCRBY", "i8", "8", "-10", "INCRBY", "u2", "0", "100"}, "*2\r\n:-128\r\n:3\r\n"},
+		{[]string{"BITFIELD", "key", "OVERFLOW", "SAT", "SET", "u8", "16", "-1", "GET", "u8", "16"}, "*2\r\n:0\r\n:255\r\n"},
+		{[]string{"BITFIELD", "key", "OVERFLOW", "FAIL", "INCRBY", "u8", "16", "1", "OVERFLOW", "WRAP", "INCRBY", "u8", "16", "1"}, "*2\r\n$-1\r\n:0\r\n"},
+		{[]string{"BITFIELD", "key", "OVERFLOW", "FAIL", "INCRBY", "i64", "24", "9223372036854775807", "INCRBY", "i64", "24", "1"}, "*2\r\n:9223372036854775807\r\n$-1\r\n"},
+
+		{[]string{"BITFIELD", "key", "GET", "u64", "0"}, "-ERR Invalid bitfield type. Use something like i16 u8. Note that u64 is not supported but i64 is.\r\n"},
+		{[]string{"BITFIELD", "key", "GET", "i0", "0"}, "-ERR Invalid bitfield type. Use something like i16 u8. Note that u64 is not supported but i64 is.\r\n"},
+		{[]string{"BITFIELD", "key", "GET", "u8", "-1"}, "-ERR bit offset is not an integer or out of range\r\n"},
+		{[]string{"BITFIELD", "key", "GET", "u8", "4294967296"}, "-ERR bit offset is not an integer or out of range\r\n"},
+		{[]string{"BITFIELD", "key", "GET", "u8", "#2305843009213693952"}, "-ERR bit offset is not an integer or out of range\r\n"}, // 2^64 bits, wrapping around to 0
+		{[]string{"BITFIELD", "key", "OVERFLOW", "MAYBE", "GET", "u8", "0"}, "-ERR Invalid OVERFLOW type specified\r\n"},
+		{[]string{"BITFIELD", "key", "SET", "u8", "0"}, "-ERR syntax error\r\n"},
+		{[]string{"BITFIELD", "key", "SET", "u8", "0", "x"}, "-ERR value is not an integer or out of range\r\n"},
+		{[]string{"BITFIELD", "key", "FROB"}, "-ERR syntax error\r\n"},
+		{[]string{"RPUSH", "list", "a"}, ":1\r\n"},
+		{[]string{"BITFIELD", "list", "GET", "u8", "0"}, "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"},
+		{[]string{"BITFIELD", "list", "SET", "u8", "0", "1"}, "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"},
+	} {
+		if got := run(tc.cmd...); got != tc.want {
+			t.Errorf("%q: got %q, want %q", tc.cmd, got, tc.want)
+		}
+	}
+}
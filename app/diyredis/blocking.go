@@ -0,0 +1,161 @@
+package diyredis
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Blocking commands (XREAD BLOCK, ...) wait for one of their keys to change, after which
+// they try again. Rather than having every data type keep track of who's waiting on it,
+// waiting clients are registered here by key, and every write command wakes the clients
+// waiting on the keys it wrote to.
+//
+// Clients are served in the order in which they blocked. Serving a client means running
+// its `try` function, from the goroutine of whoever wrote the key, which is what makes
+// that order stick: a client popping from a list gets the element before any client that
+// blocked after it even gets to look. It's up to `try` to decide whether it was served,
+// e.g. it may find the list emptied by a client served before it.
+
+type blockingKey struct {
+	db  uint
+	key string
+}
+
+type blockedClient struct {
+	keys   []blockingKey
+	try    func() bool // returns true if the client was served
+	mutex  sync.Mutex  // held while trying, so that a client is only ever served once
+	done   bool        // served, or gave up waiting
+	served chan struct{}
+}
+
+type blockingState struct {
+	mutex   sync.Mutex
+	clients map[blockingKey][]*blockedClient // in the order in which they blocked
+	count   atomic.Int64                     // number of blocked clients, to skip the lookup when there are none
+}
+
+// Run try, until it reports that it served the client, every time one of keys changes.
+// Gives up after timeout, unless it is 0, or once the command is aborted (e.g. because
+// the client is disconnected). Returns true if try served the client.
+//
+// try may run on another goroutine, but never concurrently with itself, and not after
+// block returns.
+func (s *Session) block(keys []string, timeout time.Duration, try func() bool) bool {
+	client := &blockedClient{
+		keys:   make([]blockingKey, len(keys)),
+		try:    try,
+		served: make(chan struct{}),
+	}
+	for i, key := range keys {
+		client.keys[i] = blockingKey{s.db.id, key}
+	}
+
+	s.server.addBlockedClient(client)
+	defer s.server.removeBlockedClient(client)
+
+	// Changes made before we were registered didn't wake us, so look once ourselves
+	if client.attempt() {
+		return true
+	}
+
+	var timeoutCh <-chan time.Time
+	if timeout > 0 {
+		timeoutCh = s.server.Clock.After(timeout)
+	}
+	select {
+	case <-client.served:
+		return true
+	case <-timeoutCh:
+	case <-s.ctx.Done():
+	}
+
+	// We might have been served just now
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	if client.done {
+		return true
+	}
+	client.done = true
+	return false
+}
+
+// Run the client's try function, unless it was served already. Returns true if this
+// call served it.
+func (c *blockedClient) attempt() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.done || !c.try() {
+		return false
+	}
+	c.done = true
+	close(c.served)
+	return true
+}
+
+func (s *Server) addBlockedClient(client *blockedClient) {
+	s.blocking.mutex.Lock()
+	defer s.blocking.mutex.Unlock()
+	if s.blocking.clients == nil {
+		s.blocking.clients = make(map[blockingKey][]*blockedClient)
+	}
+	for _, key := range client.keys {
+		s.blocking.clients[key] = append(s.blocking.clients[key], client)
+	}
+	s.blocking.count.Add(1)
+}
+
+func (s *Server) removeBlockedClient(client *blockedClient) {
+	s.blocking.mutex.Lock()
+	defer s.blocking.mutex.Unlock()
+	for _, key := range client.keys {
+		clients := s.blocking.clients[key]
+		for i, c := range clients {
+			if c == client {
+				clients = append(clients[:i:i], clients[i+1:]...) // don't overwrite a slice someone may be iterating
+				break
+			}
+		}
+		if len(clients) == 0 {
+			delete(s.blocking.clients, key)
+		} else {
+			s.blocking.clients[key] = clients
+		}
+	}
+	s.blocking.count.Add(-1)
+}
+
+// Serve the clients blocked on any of keys in db, in the order in which they blocked.
+// Must be called after every change to those keys, outside of any locks.
+func (s *Server) signalKeysReady(db uint, keys []string) {
+	if s.blocking.count.Load() == 0 {
+		return
+	}
+	for _, key := range keys {
+		s.blocking.mutex.Lock()
+		clients := s.blocking.clients[blockingKey{db, key}]
+		s.blocking.mutex.Unlock()
+
+		for _, client := range clients {
+			client.attempt()
+		}
+	}
+}
+
+// Serve every blocked client, e.g. after the whole dataset was replaced.
+func (s *Server) signalAllBlocked() {
+	if s.blocking.count.Load() == 0 {
+		return
+	}
+	s.blocking.mutex.Lock()
+	keys := make(map[uint][]string)
+	for key := range s.blocking.clients {
+		keys[key.db] = append(keys[key.db], key.key)
+	}
+	s.blocking.mutex.Unlock()
+
+	for db, keys := range keys {
+		s.signalKeysReady(db, keys)
+	}
+}
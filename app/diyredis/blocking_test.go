@@ -0,0 +1,171 @@
+package diyredis
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBlockFIFO(t *testing.T) {
+	server := MakeServer()
+	available := 0 // e.g. list elements, handed out to whoever is served first
+	var mutex sync.Mutex
+	var served []int
+
+	var wg sync.WaitGroup
+	for i := range 3 {
+		session, _ := newTestSession(server)
+		session.ctx = context.Background()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			session.block([]string{"key"}, 0, func() bool {
+				mutex.Lock()
+				defer mutex.Unlock()
+				if available == 0 {
+					return false
+				}
+				available--
+				served = append(served, i)
+				return true
+			})
+		}()
+		// Make sure they block in order
+		for server.blocking.count.Load() != int64(i+1) {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	for range 3 {
+		mutex.Lock()
+		available++
+		mutex.Unlock()
+		server.signalKeysReady(0, []string{"key"})
+	}
+	wg.Wait()
+	if len(served) != 3 || served[0] != 0 || served[1] != 1 || served[2] != 2 {
+		t.Errorf("served in order %v, want [0 1 2]", served)
+	}
+	if len(server.blocking.clients) != 0 || server.blocking.count.Load() != 0 {
+		t.Errorf("blocked clients left behind: %v", server.blocking.clients)
+	}
+}
+
+func TestBlockTimeout(t *testing.T) {
+	server := MakeServer()
+	session, _ := newTestSession(server)
+	session.ctx = context.Background()
+	start := time.Now()
+	if session.block([]string{"key"}, 20*time.Millisecond, func() bool { return false }) {
+		t.Errorf("got served without anything to serve")
+	}
+	if time.Since(start) < 20*time.Millisecond {
+		t.Errorf("gave up after %v", time.Since(start))
+	}
+
+	// Aborted, e.g. by the connection being closed
+	ctx, cancel := context.WithCancel(context.Background())
+	session.ctx = ctx
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	if session.block([]string{"key"}, 0, func() bool { return false }) {
+		t.Errorf("got served without anything to serve")
+	}
+
+	// Keys in other databases don't count
+	session.ctx = context.Background()
+	tries := 0
+	session.block([]string{"key"}, 20*time.Millisecond, func() bool { tries++; return false })
+	server.signalKeysReady(1, []string{"key"})
+	if tries != 1 {
+		t.Errorf("tried %d times, want just the initial try", tries)
+	}
+}
+
+func TestXreadBlock(t *testing.T) {
+	server := MakeServer()
+	reader, readerConn := newTestSession(server)
+	writer, _ := newTestSession(server)
+	writer.dispatch([]string{"XADD", "s", "1-0", "a", "1"})
+
+	// Not blocking
+	reader.dispatch([]string{"XREAD", "STREAMS", "s", "0"})
+	if got := readerConn.buf.String(); !strings.Contains(got, "1-0") {
+		t.Errorf("got %q, want entry 1-0", got)
+	}
+	readerConn.buf.Reset()
+	reader.dispatch([]string{"XREAD", "STREAMS", "s", "missing", "1-0", "0"})
+	if got := readerConn.buf.String(); got != "*-1\r\n" {
+		t.Errorf("got %q, want a null reply", got)
+	}
+
+	// Timing out
+	readerConn.buf.Reset()
+	reader.dispatch([]string{"XREAD", "BLOCK", "10", "STREAMS", "s", "$"})
+	if got := readerConn.buf.String(); got != "*-1\r\n" {
+		t.Errorf("got %q, want a null reply", got)
+	}
+
+	// Woken up by XADD, on a stream that doesn't exist yet
+	readerConn.buf.Reset()
+	done := make(chan struct{})
+	go func() {
+		reader.dispatch([]string{"XREAD", "BLOCK", "0", "STREAMS", "s", "other", "$", "$"})
+		close(done)
+	}()
+	for server.blocking.count.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	writer.dispatch([]string{"XADD", "other", "5-0", "b", "2"})
+	<-done
+	if got := readerConn.buf.String(); !strings.HasPrefix(got, "*1\r\n*2\r\n$5\r\nother\r\n") || !strings.Contains(got, "5-0") {
+		t.Errorf("got %q, want entry 5-0 of other", got)
+	}
+}
+
+func TestXreadBlockDeleted(t *testing.T) {
+	server := MakeServer()
+	reader, readerConn := newTestSession(server)
+	writer, _ := newTestSession(server)
+
+	for _, tc := range []struct {
+		name   string
+		delete func()
+	}{
+		{"DEL", func() { writer.dispatch([]string{"DEL", "s"}) }},
+		{"SET", func() { writer.dispatch([]string{"SET", "s", "v"}) }},
+		{"expiry", func() {
+			expiry := time.Now().Add(10 * time.Millisecond).UnixMilli()
+			writer.dispatch([]string{"PEXPIREAT", "s", strconv.FormatInt(expiry, 10)})
+			time.Sleep(20 * time.Millisecond)
+			server.activeExpire()
+		}},
+	} {
+		writer.dispatch([]string{"DEL", "s"})
+		writer.dispatch([]string{"XADD", "s", "1-0", "a", "1"})
+		readerConn.buf.Reset()
+		done := make(chan struct{})
+		go func() {
+			reader.dispatch([]string{"XREAD", "BLOCK", "0", "STREAMS", "s", "$"})
+			close(done)
+		}()
+		for server.blocking.count.Load() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+
+		tc.delete()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("%s: XREAD still blocked after the stream was gone", tc.name)
+		}
+		if got := readerConn.buf.String(); got != "*-1\r\n" {
+			t.Errorf("%s: got %q, want a null reply", tc.name, got)
+		}
+	}
+}
@@ -0,0 +1,276 @@
+package diyredis
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Experimental, for large datasets that mostly stay the same: rather than writing all of
+// it whenever a save point is reached, a checkpoint only writes the keys that changed
+// since the last save, to a delta file next to the RDB file ("dump.rdb.1.delta", ...),
+// and loading the RDB file replays the delta files on top of it. Once there are
+// RdbIncrementalSegments of them, the next save writes the RDB file in full again, which
+// compacts them away.
+//
+// A delta file is a list of commands, like an AOF: a SELECT for every database, followed
+// by a RESTORE ... REPLACE ABSTTL for every key that was set, and a DEL for every key
+// that was deleted. The RDB file records the sequence number of the last delta file it
+// includes, in an aux field, so that only those written after it are replayed.
+type checkpointState struct {
+	dirty    dirtyKeys
+	seq      atomic.Int64 // of the last delta file written or found
+	segments atomic.Int64 // delta files on top of the RDB file
+}
+
+const (
+	DefaultRdbIncrementalSegments = 8
+
+	rdbAuxCheckpoint = "diy-checkpoint"
+)
+
+var errNoCheckpointBase = errors.New("no RDB file to checkpoint on top of, it has to be saved in full first")
+
+// The keys changed since the last save, as long as there is an RDB file to checkpoint
+// them on top of: one written or loaded while RdbIncremental was on, into the databases
+// as they are now.
+type dirtyKeys struct {
+	keys atomic.Pointer[sync.Map] // dirtyKey -> struct{}; nil while not tracking
+}
+
+type dirtyKey struct {
+	db  uint
+	key string
+}
+
+// Record a change to key. Called from within the change, so that whichever snapshot
+// swaps the keys out sees it either in the snapshot or after it.
+func (d *dirtyKeys) mark(db uint, key string) {
+	if keys := d.keys.Load(); keys != nil {
+		keys.Store(dirtyKey{db, key}, struct{}{})
+	}
+}
+
+// Start over, tracking keys from now on or not, and return those tracked so far: nil if
+// none were.
+func (d *dirtyKeys) swap(track bool) *sync.Map {
+	var keys *sync.Map
+	if track {
+		keys = &sync.Map{}
+	}
+	return d.keys.Swap(keys)
+}
+
+// Put back what swap returned, for a save that failed to write it. Saves don't overlap,
+// so nothing swaps the keys meanwhile.
+func (d *dirtyKeys) putBack(keys *sync.Map) {
+	if keys == nil {
+		d.keys.Store(nil) // what's on disk is no base to track changes on top of
+		return
+	}
+	if current := d.keys.Load(); current != nil {
+		keys.Range(func(key, _ any) bool {
+			current.Store(key, struct{}{})
+			return true
+		})
+	}
+}
+
+// Whether the next save should be a checkpoint, rather than a full one.
+func (s *Server) checkpointDue() bool {
+	return s.RdbIncremental.Load() && s.checkpoint.dirty.keys.Load() != nil &&
+		s.checkpoint.segments.Load() < s.RdbIncrementalSegments.Load()
+}
+
+// Write the keys changed since the last save to a new delta file, blocking until it has
+// been written.
+func (s *Server) CheckpointRdb() error {
+	if s.checkpoint.dirty.keys.Load() == nil {
+		return errNoCheckpointBase
+	}
+	if err := s.startSave(); err != nil {
+		return err
+	}
+	err := s.saveCheckpoint()
+	s.finishSave(err, 0)
+	return err
+}
+
+// Start writing the keys changed since the last save to a new delta file in the
+// background.
+func (s *Server) BgCheckpointRdb() error {
+	if s.checkpoint.dirty.keys.Load() == nil {
+		return errNoCheckpointBase
+	}
+	return s.bgsave(s.saveCheckpoint)
+}
+
+func (s *Server) saveCheckpoint() error {
+	dirty := s.save.dirty.Load()
+	var keys *sync.Map
+	var seq int64
+	s.startSnapshot(func() {
+		if s.checkpoint.dirty.keys.Load() != nil {
+			keys = s.checkpoint.dirty.swap(true)
+			seq = s.checkpoint.seq.Add(1)
+		}
+	})
+	defer s.endSnapshot()
+	if keys == nil {
+		return errNoCheckpointBase
+	}
+
+	byDB := make(map[uint][]string)
+	keys.Range(func(k, _ any) bool {
+		key := k.(dirtyKey)
+		byDB[key.db] = append(byDB[key.db], key.key)
+		return true
+	})
+	if len(byDB) > 0 {
+		if err := s.writeCheckpoint(byDB, seq); err != nil {
+			s.checkpoint.dirty.putBack(keys)
+			return err
+		}
+		s.checkpoint.segments.Add(1)
+	}
+	s.save.dirty.Add(-dirty)
+	return nil
+}
+
+// Write the state of keys in the snapshot to the delta file numbered seq, through a
+// temporary file, like saveRdb.
+func (s *Server) writeCheckpoint(keys map[uint][]string, seq int64) error {
+	tmp := filepath.Join(s.RdbDir, fmt.Sprintf("temp-%d.delta", os.Getpid()))
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp) // no-op once renamed
+
+	w := bufio.NewWriter(file)
+	for _, id := range slices.Sorted(maps.Keys(keys)) {
+		db := s.db(int(id))
+		w.Write(makeRESPArr([]string{"SELECT", strconv.FormatUint(uint64(id), 10)}))
+		slices.Sort(keys[id])
+		for _, key := range keys[id] {
+			w.Write(s.checkpointCommand(db, key))
+		}
+	}
+	err = w.Flush()
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.deltaFilename(seq))
+}
+
+// The command that brings key to the state it is in in the snapshot.
+func (s *Server) checkpointCommand(db RedisDB, key string) []byte {
+	value, expiry, exists := db.snapshotKey(key)
+	if exists && (expiry == 0 || expiry > db.nowMs()) {
+		payload, err := dumpValue(value)
+		if err == nil {
+			return makeRESPArr([]string{"RESTORE", key, strconv.FormatInt(expiry, 10), string(payload), "REPLACE", "ABSTTL"})
+		}
+		s.Log.Warn("Not saving key to RDB delta file", "key", key, "err", err)
+	}
+	return makeRESPArr([]string{"DEL", key})
+}
+
+func (s *Server) deltaFilename(seq int64) string {
+	return filepath.Join(s.RdbDir, s.RdbFilename+"."+strconv.FormatInt(seq, 10)+".delta")
+}
+
+// The delta files next to the RDB file, by sequence number.
+func (s *Server) deltaFiles() (map[int64]string, error) {
+	entries, err := os.ReadDir(s.RdbDir)
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[int64]string)
+	for _, entry := range entries {
+		seq, ok := strings.CutPrefix(entry.Name(), s.RdbFilename+".")
+		if !ok {
+			continue
+		}
+		if seq, ok = strings.CutSuffix(seq, ".delta"); !ok {
+			continue
+		}
+		if n, err := strconv.ParseInt(seq, 10, 64); err == nil && n > 0 {
+			files[n] = filepath.Join(s.RdbDir, entry.Name())
+		}
+	}
+	return files, nil
+}
+
+// Remove every delta file, once the RDB file was written in full.
+func (s *Server) removeDeltaFiles() {
+	files, err := s.deltaFiles()
+	if err != nil {
+		s.Log.Warn("Can't remove the RDB delta files", "err", err)
+	}
+	for _, fn := range files {
+		if err := os.Remove(fn); err != nil {
+			s.Log.Warn("Can't remove RDB delta file", "file", fn, "err", err)
+		}
+	}
+	s.checkpoint.segments.Store(0)
+}
+
+// Replay the delta files written after the RDB file that was just loaded, which had the
+// given aux fields, and start tracking changes on top of them if RdbIncremental is on.
+func (s *Server) loadCheckpoints(aux map[string]string) error {
+	files, err := s.deltaFiles()
+	if err != nil {
+		return err
+	}
+	seqs := slices.Sorted(maps.Keys(files))
+	if len(seqs) > 0 {
+		// Never to be written again, so that they can't be mixed up
+		s.checkpoint.seq.Store(max(s.checkpoint.seq.Load(), seqs[len(seqs)-1]))
+	}
+
+	base, err := strconv.ParseInt(aux[rdbAuxCheckpoint], 10, 64)
+	if err != nil {
+		if len(seqs) > 0 {
+			s.Log.Warn("Ignoring the RDB delta files, as the RDB file doesn't say which it includes")
+		}
+		return nil
+	}
+	s.checkpoint.seq.Store(max(s.checkpoint.seq.Load(), base))
+
+	var segments int64
+	for _, seq := range seqs {
+		if seq <= base {
+			continue // left over from before the RDB file was written in full
+		}
+		s.Log.Info("Loading RDB delta file...", "file", files[seq])
+		// Delta files are moved into place once complete, so none is ever truncated
+		if err := s.loadAofFile(files[seq], false); err != nil {
+			if s.RdbLoadPolicy == RdbLoadPartial {
+				s.Log.Warn("RDB delta file is corrupt, continuing with what could be loaded", "err", err)
+				return nil
+			}
+			return err
+		}
+		segments++
+	}
+	s.checkpoint.segments.Store(segments)
+	if s.RdbIncremental.Load() {
+		s.checkpoint.dirty.swap(true)
+	}
+	return nil
+}
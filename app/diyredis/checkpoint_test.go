@@ -0,0 +1,126 @@
+package diyredis
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckpointRdb(t *testing.T) {
+	dir := t.TempDir()
+	newServer := func() *Server {
+		server := MakeServer()
+		server.Log = discardLog
+		server.RdbDir, server.RdbFilename = dir, "dump.rdb"
+		server.RdbIncremental.Store(true)
+		return server
+	}
+	server := newServer()
+	session, conn := newTestSession(server)
+	run := func(cmd ...string) string {
+		conn.buf.Reset()
+		session.dispatch(cmd)
+		return conn.buf.String()
+	}
+	deltas := func() []string {
+		matches, _ := filepath.Glob(filepath.Join(dir, "dump.rdb.*.delta"))
+		for i := range matches {
+			matches[i] = filepath.Base(matches[i])
+		}
+		return matches
+	}
+
+	run("SET", "a", "1")
+	run("SET", "b", "2")
+	run("RPUSH", "list", "x")
+	if err := server.CheckpointRdb(); !errors.Is(err, errNoCheckpointBase) {
+		t.Errorf("checkpoint without an RDB file: got %v", err)
+	}
+	if err := server.SaveRdb(); err != nil {
+		t.Fatal(err)
+	}
+	base, err := os.ReadFile(filepath.Join(dir, "dump.rdb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	run("SET", "a", "changed")
+	run("DEL", "b")
+	run("SELECT", "2")
+	run("SET", "c", "3", "EX", "1000")
+	if err := server.CheckpointRdb(); err != nil {
+		t.Fatal(err)
+	}
+	run("SELECT", "0")
+	run("RPUSH", "list", "y")
+	if err := server.CheckpointRdb(); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.CheckpointRdb(); err != nil { // nothing changed since
+		t.Fatal(err)
+	}
+	if got := strings.Join(deltas(), " "); got != "dump.rdb.1.delta dump.rdb.2.delta" {
+		t.Errorf("got delta files %q", got)
+	}
+	if now, _ := os.ReadFile(filepath.Join(dir, "dump.rdb")); string(now) != string(base) {
+		t.Errorf("checkpoints rewrote the RDB file")
+	}
+	if got := run("INFO", "persistence"); !strings.Contains(got, "rdb_incremental:1\r\nrdb_delta_files:2\r\n") {
+		t.Errorf("INFO persistence: got %q", got)
+	}
+
+	// Loading replays the delta files on top of the RDB file
+	loaded := newServer()
+	if err := loaded.LoadRdb(); err != nil {
+		t.Fatal(err)
+	}
+	session, conn = newTestSession(loaded)
+	for _, tc := range []struct {
+		cmd  []string
+		want string
+	}{
+		{[]string{"MGET", "a", "b"}, "*2\r\n$7\r\nchanged\r\n$-1\r\n"},
+		{[]string{"LRANGE", "list", "0", "-1"}, "*2\r\n$1\r\nx\r\n$1\r\ny\r\n"},
+		{[]string{"SELECT", "2"}, "+OK\r\n"},
+		{[]string{"GET", "c"}, "$1\r\n3\r\n"},
+		{[]string{"TTL", "c"}, ":1000\r\n"},
+	} {
+		if got := run(tc.cmd...); got != tc.want {
+			t.Errorf("%q: got %q, want %q", tc.cmd, got, tc.want)
+		}
+	}
+	if loaded.checkpoint.segments.Load() != 2 {
+		t.Errorf("loaded %d delta files, want 2", loaded.checkpoint.segments.Load())
+	}
+
+	// Further checkpoints are numbered on from there, until a full save compacts them
+	run("SET", "d", "4")
+	if err := loaded.CheckpointRdb(); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(deltas(), " "); got != "dump.rdb.1.delta dump.rdb.2.delta dump.rdb.3.delta" {
+		t.Errorf("got delta files %q", got)
+	}
+	loaded.RdbIncrementalSegments.Store(3)
+	if loaded.checkpointDue() {
+		t.Errorf("checkpoint due with the maximum number of delta files")
+	}
+	if err := loaded.SaveRdb(); err != nil {
+		t.Fatal(err)
+	}
+	if got := deltas(); len(got) != 0 {
+		t.Errorf("delta files left after a full save: %q", got)
+	}
+	if !loaded.checkpointDue() {
+		t.Errorf("no checkpoint due after a full save")
+	}
+	reloaded := newServer()
+	if err := reloaded.LoadRdb(); err != nil {
+		t.Fatal(err)
+	}
+	if value, ok := loadString(reloaded.dbs[2], "d"); !ok || value != "4" {
+		t.Errorf("got (%v, %v) for d, want 4", value, ok)
+	}
+}
@@ -0,0 +1,431 @@
+package diyredis
+
+import (
+	"cmp"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	resp3 "github.com/codecrafters-io/redis-starter-go/app/diyredis/resp3"
+)
+
+// Server-wide pause of command processing, as requested through CLIENT PAUSE.
+type clientPause struct {
+	mutex      sync.Mutex
+	until      time.Time
+	writesOnly bool
+	ended      chan struct{} // closed when the pause is lifted before `until`
+}
+
+// Pause all commands, or only those that modify the keyspace, for duration d.
+// Pausing while already paused extends the pause, and ALL takes precedence over WRITE.
+func (p *clientPause) pause(d time.Duration, writesOnly bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	until := time.Now().Add(d)
+	if time.Now().Before(p.until) {
+		// Already paused; a pause can only ever get longer and stricter
+		writesOnly = writesOnly && p.writesOnly
+		until = maxTime(until, p.until)
+	} else {
+		p.ended = make(chan struct{})
+	}
+	p.until = until
+	p.writesOnly = writesOnly
+}
+
+// Lift the pause, if any, right away.
+func (p *clientPause) unpause() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if time.Now().Before(p.until) {
+		p.until = time.Time{}
+		close(p.ended)
+	}
+}
+
+// Block until the given command is no longer paused.
+func (p *clientPause) wait(spec *command) {
+	for {
+		p.mutex.Lock()
+		remaining := time.Until(p.until)
+		affected := spec.flags&flagWrite != 0 || !p.writesOnly
+		ended := p.ended
+		p.mutex.Unlock()
+
+		if remaining <= 0 || !affected {
+			return
+		}
+		select {
+		case <-time.After(remaining):
+		case <-ended:
+		}
+		// Loop around, the pause might have been extended in the meantime
+	}
+}
+
+func maxTime(a time.Time, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+// What CLIENT LIST and CLIENT INFO tell about a client, which other clients read.
+type clientInfo struct {
+	mutex   sync.Mutex
+	id      int64
+	addr    string
+	laddr   string
+	created time.Time
+	lastCmd string    // the name of the last command executed
+	lastAt  time.Time // when it was
+	db      int       // the selected database
+	resp    int       // the RESP version, 0 for 2
+	name    string    // as set with CLIENT SETNAME or HELLO SETNAME
+	libName string    // as set with CLIENT SETINFO
+	libVer  string
+}
+
+// Record that the client is executing the command called name.
+func (c *clientInfo) executing(name string) {
+	c.mutex.Lock()
+	c.lastCmd, c.lastAt = name, time.Now()
+	c.mutex.Unlock()
+}
+
+// The line describing the client in CLIENT LIST and CLIENT INFO, like Redis has it.
+func (s *Session) infoLine() string {
+	flags := "N"
+	if s.clientType() == "replica" {
+		flags = "S"
+	}
+	s.info.mutex.Lock()
+	defer s.info.mutex.Unlock()
+	now := time.Now()
+	return fmt.Sprintf("id=%d addr=%s laddr=%s name=%s age=%d idle=%d flags=%s db=%d resp=%d cmd=%s lib-name=%s lib-ver=%s",
+		s.info.id, s.info.addr, s.info.laddr, s.info.name, int(now.Sub(s.info.created).Seconds()),
+		int(now.Sub(s.info.lastAt).Seconds()), flags, s.info.db, max(s.info.resp, 2), s.info.lastCmd,
+		s.info.libName, s.info.libVer)
+}
+
+// The client type CLIENT LIST TYPE filters on. Our master's connection isn't a client,
+// so it's never "master".
+func (s *Session) clientType() string {
+	s.server.repl.mutex.Lock()
+	defer s.server.repl.mutex.Unlock()
+	if _, ok := s.server.repl.replicas[s]; ok {
+		return "replica"
+	}
+	return "normal"
+}
+
+// Whether name can be a client name, or the name or version of a library, which are
+// separated by spaces in CLIENT LIST.
+func validClientName(name string) bool {
+	for i := range len(name) {
+		if name[i] < '!' || name[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+var clientHelp = []string{
+	"GETNAME",
+	"    Return the name of the current connection.",
+	"ID",
+	"    Return the ID of the current connection.",
+	"INFO",
+	"    Return information about the current client connection.",
+	"LIST [TYPE (NORMAL|MASTER|REPLICA|PUBSUB)] [ID <id> [<id> ...]]",
+	"    Return information about client connections.",
+	"NO-EVICT (ON|OFF)",
+	"    Protect, or not, the current client from being disconnected for exceeding the output buffer limit.",
+	"PAUSE <timeout> [WRITE|ALL]",
+	"    Suspend all, or just write, clients for <timeout> milliseconds.",
+	"SETINFO (LIB-NAME|LIB-VER) <value>",
+	"    Set the name or version of the library the current connection is made with.",
+	"SETNAME <name>",
+	"    Assign the name <name> to the current connection.",
+	"TRACKING (ON|OFF) [BCAST] [PREFIX <prefix> [...]] [NOLOOP]",
+	"    Control server assisted client side caching.",
+	"UNPAUSE",
+	"    Stop the current client pause, resuming traffic.",
+}
+
+func (s *Session) doCLIENT(cmds []string) *UserError {
+	if len(cmds) < 2 {
+		return &UserError{"ERR", "wrong number of arguments for CLIENT command"}
+	}
+
+	switch strings.ToLower(cmds[1]) {
+	case "pause":
+		// CLIENT PAUSE timeout [WRITE | ALL]
+		if len(cmds) < 3 || len(cmds) > 4 {
+			return &UserError{"ERR", "wrong number of arguments for CLIENT PAUSE command"}
+		}
+		ms, err := strconv.ParseInt(cmds[2], 10, 64)
+		if err != nil || ms < 0 {
+			return &UserError{"ERR", "timeout is not an integer or out of range"}
+		}
+		writesOnly := false
+		if len(cmds) == 4 {
+			switch strings.ToLower(cmds[3]) {
+			case "write":
+				writesOnly = true
+			case "all":
+			default:
+				return ErrSyntax()
+			}
+		}
+		s.server.pause.pause(time.Duration(ms)*time.Millisecond, writesOnly)
+		s.conn.Write(resp3.OK)
+
+	case "unpause":
+		if len(cmds) != 2 {
+			return &UserError{"ERR", "wrong number of arguments for CLIENT UNPAUSE command"}
+		}
+		s.server.pause.unpause()
+		s.conn.Write(resp3.OK)
+
+	case "no-evict":
+		// CLIENT NO-EVICT ON | OFF
+		if len(cmds) != 3 {
+			return &UserError{"ERR", "wrong number of arguments for CLIENT NO-EVICT command"}
+		}
+		var noEvict bool
+		switch strings.ToLower(cmds[2]) {
+		case "on":
+			noEvict = true
+		case "off":
+		default:
+			return ErrSyntax()
+		}
+		if s.out != nil {
+			s.out.setNoEvict(noEvict)
+		}
+		s.conn.Write(resp3.OK)
+
+	case "tracking":
+		return s.clientTracking(cmds)
+
+	case "id":
+		if len(cmds) != 2 {
+			return &UserError{"ERR", "wrong number of arguments for CLIENT ID command"}
+		}
+		s.writeInt(s.info.id)
+
+	case "info":
+		if len(cmds) != 2 {
+			return &UserError{"ERR", "wrong number of arguments for CLIENT INFO command"}
+		}
+		encoder := s.encoder()
+		encoder.WriteBulkStr(s.infoLine() + "\n")
+		s.conn.Write(encoder.Buf)
+
+	case "list":
+		return s.clientList(cmds)
+
+	case "getname":
+		if len(cmds) != 2 {
+			return &UserError{"ERR", "wrong number of arguments for CLIENT GETNAME command"}
+		}
+		s.info.mutex.Lock()
+		name := s.info.name
+		s.info.mutex.Unlock()
+		encoder := s.encoder()
+		if name == "" {
+			encoder.WriteNull()
+		} else {
+			encoder.WriteBulkStr(name)
+		}
+		s.conn.Write(encoder.Buf)
+
+	case "setname":
+		if len(cmds) != 3 {
+			return &UserError{"ERR", "wrong number of arguments for CLIENT SETNAME command"}
+		}
+		if !validClientName(cmds[2]) {
+			return &UserError{"ERR", "Client names cannot contain spaces, newlines or special characters."}
+		}
+		s.info.mutex.Lock()
+		s.info.name = cmds[2]
+		s.info.mutex.Unlock()
+		s.conn.Write(resp3.OK)
+
+	case "setinfo":
+		// CLIENT SETINFO LIB-NAME libname | LIB-VER libver
+		if len(cmds) != 4 {
+			return &UserError{"ERR", "wrong number of arguments for CLIENT SETINFO command"}
+		}
+		attr := strings.ToLower(cmds[2])
+		if attr != "lib-name" && attr != "lib-ver" {
+			return &UserError{"ERR", "Unrecognized option '" + cmds[2] + "'"}
+		}
+		if !validClientName(cmds[3]) {
+			return &UserError{"ERR", attr + " cannot contain spaces, newlines or special characters."}
+		}
+		s.info.mutex.Lock()
+		if attr == "lib-name" {
+			s.info.libName = cmds[3]
+		} else {
+			s.info.libVer = cmds[3]
+		}
+		s.info.mutex.Unlock()
+		s.conn.Write(resp3.OK)
+
+	default:
+		return errUnknownSubcommand(cmds)
+	}
+	return nil
+}
+
+// CLIENT LIST [TYPE NORMAL | MASTER | REPLICA | PUBSUB] [ID client-id [client-id ...]]
+func (s *Session) clientList(cmds []string) *UserError {
+	var clientType string
+	var ids map[int64]bool
+	for i := 2; i < len(cmds); i++ {
+		switch {
+		case strings.ToLower(cmds[i]) == "type" && i+1 < len(cmds):
+			clientType = strings.ToLower(cmds[i+1])
+			if clientType == "slave" {
+				clientType = "replica"
+			}
+			if clientType != "normal" && clientType != "master" && clientType != "replica" && clientType != "pubsub" {
+				return &UserError{"ERR", "Unknown client type '" + cmds[i+1] + "'"}
+			}
+			i++
+		case strings.ToLower(cmds[i]) == "id" && i+1 < len(cmds):
+			ids = make(map[int64]bool)
+			for i++; i < len(cmds); i++ {
+				id, err := strconv.ParseInt(cmds[i], 10, 64)
+				if err != nil || id <= 0 {
+					return &UserError{"ERR", "Invalid client ID"}
+				}
+				ids[id] = true
+			}
+		default:
+			return ErrSyntax()
+		}
+	}
+
+	var sessions []*Session
+	s.server.clients.Range(func(key any, _ any) bool {
+		session := key.(*Session)
+		if (clientType == "" || session.clientType() == clientType) && (ids == nil || ids[session.info.id]) {
+			sessions = append(sessions, session)
+		}
+		return true
+	})
+	slices.SortFunc(sessions, func(a *Session, b *Session) int { return cmp.Compare(a.info.id, b.info.id) })
+	var b strings.Builder
+	for _, session := range sessions {
+		b.WriteString(session.infoLine() + "\n")
+	}
+	encoder := s.encoder()
+	encoder.WriteBulkStr(b.String())
+	s.conn.Write(encoder.Buf)
+	return nil
+}
+
+// The lines INFO clients reports.
+func (s *Server) infoClients() []string {
+	connected := 0
+	libs := make(map[string]int)
+	s.clients.Range(func(key any, _ any) bool {
+		session := key.(*Session)
+		connected++
+		session.info.mutex.Lock()
+		if lib := session.info.libName; lib != "" {
+			libs[lib]++
+		}
+		session.info.mutex.Unlock()
+		return true
+	})
+	var byLib []string
+	for _, lib := range slices.Sorted(maps.Keys(libs)) {
+		byLib = append(byLib, lib+"="+strconv.Itoa(libs[lib]))
+	}
+	return []string{
+		"connected_clients:" + strconv.Itoa(connected),
+		"blocked_clients:" + strconv.FormatInt(s.blocking.count.Load(), 10),
+		"clients_by_lib_name:" + strings.Join(byLib, ","),
+	}
+}
+
+// HELLO [protover [AUTH username password] [SETNAME clientname]]
+//
+// Switch the connection to the given RESP version, and reply with some information
+// about the server. There are no passwords, so the only user, "default", authenticates
+// with any password.
+func (s *Session) doHELLO(cmds []string) *UserError {
+	proto := max(s.proto, 2)
+	if len(cmds) >= 2 {
+		var err error
+		proto, err = strconv.Atoi(cmds[1])
+		if err != nil {
+			return &UserError{"ERR", "Protocol version is not an integer or out of range"}
+		}
+		if proto != 2 && proto != 3 {
+			return &UserError{"NOPROTO", "unsupported protocol version"}
+		}
+	}
+	var name string
+	for i := 2; i < len(cmds); i++ {
+		switch option := strings.ToLower(cmds[i]); {
+		case option == "auth" && i+2 < len(cmds):
+			if cmds[i+1] != "default" {
+				return &UserError{"WRONGPASS", "invalid username-password pair or user is disabled."}
+			}
+			i += 2
+		case option == "setname" && i+1 < len(cmds):
+			name = cmds[i+1]
+			if !validClientName(name) {
+				return &UserError{"ERR", "Client names cannot contain spaces, newlines or special characters."}
+			}
+			i++
+		default:
+			return &UserError{"ERR", "Syntax error in HELLO option '" + cmds[i] + "'"}
+		}
+	}
+	if name != "" {
+		s.info.mutex.Lock()
+		s.info.name = name
+		s.info.mutex.Unlock()
+	}
+
+	if proto != 3 {
+		s.server.tracking.disable(s) // RESP2 has no push messages to send invalidations with
+	}
+	s.proto = proto
+	s.info.mutex.Lock()
+	s.info.resp = proto
+	s.info.mutex.Unlock()
+
+	mode := "standalone"
+	if s.server.ClusterEnabled {
+		mode = "cluster"
+	}
+	encoder := s.encoder()
+	encoder.WriteMapHeader(6)
+	encoder.WriteBulkStr("server")
+	encoder.WriteBulkStr("redis")
+	encoder.WriteBulkStr("version")
+	encoder.WriteBulkStr(s.server.Version)
+	encoder.WriteBulkStr("proto")
+	encoder.WriteInt(max(s.proto, 2))
+	encoder.WriteBulkStr("mode")
+	encoder.WriteBulkStr(mode)
+	encoder.WriteBulkStr("role")
+	encoder.WriteBulkStr(s.server.role())
+	encoder.WriteBulkStr("modules")
+	encoder.WriteArrHeader(0)
+	s.conn.Write(encoder.Buf)
+	return nil
+}
@@ -0,0 +1,218 @@
+package diyredis
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClientPause(t *testing.T) {
+	server := MakeServer()
+	session, conn := newTestSession(server)
+
+	session.dispatch([]string{"CLIENT", "PAUSE", "100", "WRITE"})
+	if got := conn.buf.String(); got != "+OK\r\n" {
+		t.Fatalf("got %q, want +OK", got)
+	}
+
+	start := time.Now()
+	session.dispatch([]string{"GET", "foo"})
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("read command was paused for %v during a WRITE pause", elapsed)
+	}
+
+	start = time.Now()
+	session.dispatch([]string{"SET", "foo", "bar"})
+	if elapsed := time.Since(start); elapsed < 80*time.Millisecond {
+		t.Errorf("write command was only paused for %v, want ~100ms", elapsed)
+	}
+
+	// ALL takes precedence over an ongoing WRITE pause
+	session.dispatch([]string{"CLIENT", "PAUSE", "50", "WRITE"})
+	session.dispatch([]string{"CLIENT", "PAUSE", "50", "ALL"})
+	start = time.Now()
+	session.dispatch([]string{"GET", "foo"})
+	if elapsed := time.Since(start); elapsed < 30*time.Millisecond {
+		t.Errorf("read command was only paused for %v during an ALL pause", elapsed)
+	}
+}
+
+func TestClientUnpause(t *testing.T) {
+	server := MakeServer()
+	session, conn := newTestSession(server)
+
+	session.dispatch([]string{"CLIENT", "PAUSE", "10000", "ALL"})
+	session.dispatch([]string{"CLIENT", "UNPAUSE"})
+	if got := conn.buf.String(); got != "+OK\r\n+OK\r\n" {
+		t.Fatalf("got %q, want +OK twice", got)
+	}
+
+	start := time.Now()
+	session.dispatch([]string{"SET", "foo", "bar"})
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("write command was paused for %v after CLIENT UNPAUSE", elapsed)
+	}
+}
+
+func TestClientNoEvict(t *testing.T) {
+	session, conn := newTestSession(MakeServer())
+	session.dispatch([]string{"CLIENT", "NO-EVICT", "on"})
+	session.dispatch([]string{"CLIENT", "NO-EVICT", "maybe"})
+	if got := conn.buf.String(); got != "+OK\r\n-ERR syntax error\r\n" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestCommandTimeout(t *testing.T) {
+	server := MakeServer()
+	server.CommandTimeout = time.Nanosecond
+	session, conn := newTestSession(server)
+	for i := range 1000 {
+		server.dbs[0].engine.Set(strconv.Itoa(i), "val")
+	}
+
+	session.dispatch([]string{"KEYS", "*"})
+	if got := conn.buf.String(); got != string(errCommandTimeout.RESP()) {
+		t.Errorf("got %q, want a timeout error", got)
+	}
+}
+
+func TestHello(t *testing.T) {
+	server := MakeServer()
+	session, conn := newTestSession(server)
+	run := func(cmd ...string) string {
+		conn.buf.Reset()
+		session.dispatch(cmd)
+		return conn.buf.String()
+	}
+
+	nulls := []struct {
+		cmd   []string
+		resp2 string
+	}{
+		{[]string{"GET", "missing"}, "$-1\r\n"},
+		{[]string{"HGET", "missing", "f"}, "$-1\r\n"},
+		{[]string{"LPOP", "missing", "2"}, "*-1\r\n"},
+		{[]string{"MGET", "missing"}, "*1\r\n$-1\r\n"},
+		{[]string{"XREAD", "STREAMS", "missing", "0"}, "*-1\r\n"},
+	}
+	for _, tc := range nulls {
+		if got := run(tc.cmd...); got != tc.resp2 {
+			t.Errorf("RESP2 %v: got %q, want %q", tc.cmd, got, tc.resp2)
+		}
+	}
+
+	if got := run("HELLO", "4"); got != "-NOPROTO unsupported protocol version\r\n" {
+		t.Errorf("got %q, want a NOPROTO error", got)
+	}
+	if got := run("HELLO"); !strings.HasPrefix(got, "*12\r\n$6\r\nserver\r\n") || !strings.Contains(got, "$5\r\nproto\r\n:2\r\n") {
+		t.Errorf("got %q, want a RESP2 reply for protocol 2", got)
+	}
+	if got := run("HELLO", "3"); !strings.HasPrefix(got, "%6\r\n") || !strings.Contains(got, "$5\r\nproto\r\n:3\r\n") {
+		t.Errorf("got %q, want a RESP3 map for protocol 3", got)
+	}
+
+	for _, tc := range nulls {
+		want := strings.ReplaceAll(strings.ReplaceAll(tc.resp2, "$-1", "_"), "*-1", "_")
+		if got := run(tc.cmd...); got != want {
+			t.Errorf("RESP3 %v: got %q, want %q", tc.cmd, got, want)
+		}
+	}
+
+	run("HELLO", "2")
+	if got := run("GET", "missing"); got != "$-1\r\n" {
+		t.Errorf("got %q after switching back to RESP2", got)
+	}
+}
+
+func TestWriteAttributes(t *testing.T) {
+	server := MakeServer()
+	session, conn := newTestSession(server)
+	session.writeAttributes("popularity", "0.5")
+	if got := conn.buf.String(); got != "" {
+		t.Errorf("RESP2: got %q, want nothing", got)
+	}
+	session.proto = 3
+	session.writeAttributes("popularity", "0.5")
+	if got, want := conn.buf.String(), "|1\r\n$10\r\npopularity\r\n$3\r\n0.5\r\n"; got != want {
+		t.Errorf("RESP3: got %q, want %q", got, want)
+	}
+}
+
+func TestHelloAuth(t *testing.T) {
+	server := MakeServer()
+	session, conn := newTestSession(server)
+
+	session.dispatch([]string{"HELLO", "3", "AUTH", "someone", "secret"})
+	if got := conn.buf.String(); got != "-WRONGPASS invalid username-password pair or user is disabled.\r\n" {
+		t.Errorf("got %q, want WRONGPASS for an unknown user", got)
+	}
+	conn.buf.Reset()
+	session.dispatch([]string{"HELLO", "3", "AUTH", "default"})
+	if got := conn.buf.String(); got != "-ERR Syntax error in HELLO option 'AUTH'\r\n" {
+		t.Errorf("got %q, want a syntax error for a missing password", got)
+	}
+	conn.buf.Reset()
+	session.dispatch([]string{"HELLO", "3", "AUTH", "default", "anything"})
+	if got := conn.buf.String(); !strings.HasPrefix(got, "%6\r\n") {
+		t.Errorf("got %q, want a RESP3 reply for the default user", got)
+	}
+}
+
+func TestClientInfo(t *testing.T) {
+	server := MakeServer()
+	session, conn := newTestSession(server)
+	other, _ := newTestSession(server)
+	run := func(cmd ...string) string {
+		conn.buf.Reset()
+		session.dispatch(cmd)
+		return conn.buf.String()
+	}
+	for i, s := range []*Session{session, other} {
+		s.info.id = int64(i + 1)
+		s.info.addr, s.info.laddr = "127.0.0.1:5000"+strconv.Itoa(i), "127.0.0.1:6379"
+		s.info.created = time.Now()
+		server.clients.Store(s, struct{}{})
+	}
+
+	if got := run("HELLO", "3", "SETNAME", "worker"); !strings.HasPrefix(got, "%6\r\n") {
+		t.Fatalf("HELLO SETNAME: got %q", got)
+	}
+	run("CLIENT", "SETINFO", "LIB-NAME", "go-redis")
+	run("CLIENT", "SETINFO", "lib-ver", "9.0.5")
+	run("SELECT", "2")
+	other.dispatch([]string{"CLIENT", "SETINFO", "LIB-NAME", "go-redis"})
+
+	want := "id=1 addr=127.0.0.1:50000 laddr=127.0.0.1:6379 name=worker age=0 idle=0 flags=N db=2 resp=3 cmd=client lib-name=go-redis lib-ver=9.0.5\n"
+	if got := run("CLIENT", "INFO"); got != "$"+strconv.Itoa(len(want))+"\r\n"+want+"\r\n" {
+		t.Errorf("CLIENT INFO: got %q, want %q", got, want)
+	}
+	if got := run("CLIENT", "LIST"); !strings.Contains(got, want+"id=2 ") {
+		t.Errorf("CLIENT LIST: got %q", got)
+	}
+	if got := run("CLIENT", "LIST", "ID", "2"); strings.Contains(got, "id=1 ") || !strings.Contains(got, "id=2 ") {
+		t.Errorf("CLIENT LIST ID 2: got %q", got)
+	}
+	if got := run("CLIENT", "LIST", "TYPE", "replica"); got != "$0\r\n\r\n" {
+		t.Errorf("CLIENT LIST TYPE replica: got %q", got)
+	}
+	if got := run("CLIENT", "GETNAME"); got != "$6\r\nworker\r\n" {
+		t.Errorf("CLIENT GETNAME: got %q", got)
+	}
+	if got := run("INFO", "clients"); !strings.Contains(got, "connected_clients:2\r\n") || !strings.Contains(got, "clients_by_lib_name:go-redis=2\r\n") {
+		t.Errorf("INFO clients: got %q", got)
+	}
+
+	for _, cmd := range [][]string{
+		{"CLIENT", "SETINFO", "LIB-NAME", "go redis"},
+		{"CLIENT", "SETINFO", "LIB-COLOR", "blue"},
+		{"CLIENT", "SETNAME", "a\nb"},
+		{"CLIENT", "LIST", "TYPE", "admin"},
+		{"CLIENT", "LIST", "ID", "0"},
+	} {
+		if got := run(cmd...); !strings.HasPrefix(got, "-ERR ") {
+			t.Errorf("%q: got %q, want an error", cmd, got)
+		}
+	}
+}
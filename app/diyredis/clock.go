@@ -0,0 +1,39 @@
+package diyredis
+
+import (
+	"strconv"
+	"time"
+)
+
+// Clock tells the time to everything that works with the time of day rather than with
+// durations on the wire: expirations, stream IDs generated by XADD, LASTSAVE, blocking
+// commands timing out and TIME. Tests replace Server.Clock with one they control.
+type Clock interface {
+	Now() time.Time
+	// Like time.After
+	After(d time.Duration) <-chan time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                         { return time.Now() }
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// The current time, according to the server's clock.
+func (s *Server) now() time.Time {
+	return s.Clock.Now()
+}
+
+// TIME
+func (s *Session) doTIME(cmds []string) *UserError {
+	if len(cmds) != 1 {
+		return &UserError{"ERR", "wrong number of arguments for TIME command"}
+	}
+	now := s.server.now()
+	encoder := s.encoder()
+	encoder.WriteArrHeader(2)
+	encoder.WriteBulkStr(strconv.FormatInt(now.Unix(), 10))
+	encoder.WriteBulkStr(strconv.FormatInt(int64(now.Nanosecond()/1000), 10))
+	s.conn.Write(encoder.Buf)
+	return nil
+}
@@ -0,0 +1,137 @@
+package diyredis
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A clock that only moves when told to.
+type fakeClock struct {
+	mutex  sync.Mutex
+	now    time.Time
+	timers []fakeTimer
+}
+
+type fakeTimer struct {
+	at time.Time
+	ch chan time.Time
+}
+
+func newFakeClock(now time.Time) *fakeClock {
+	return &fakeClock{now: now}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	ch := make(chan time.Time, 1)
+	c.timers = append(c.timers, fakeTimer{c.now.Add(d), ch})
+	c.fire()
+	return ch
+}
+
+// Move the clock forward by d, firing the timers that are due by then.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = c.now.Add(d)
+	c.fire()
+}
+
+func (c *fakeClock) waiting() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.timers)
+}
+
+func (c *fakeClock) fire() {
+	pending := c.timers[:0]
+	for _, timer := range c.timers {
+		if timer.at.After(c.now) {
+			pending = append(pending, timer)
+		} else {
+			timer.ch <- c.now
+		}
+	}
+	c.timers = pending
+}
+
+func TestTime(t *testing.T) {
+	server := MakeServer()
+	server.Clock = newFakeClock(time.Unix(1700000000, 123456789))
+	session, conn := newTestSession(server)
+	session.dispatch([]string{"TIME"})
+	if got, want := conn.buf.String(), "*2\r\n$10\r\n1700000000\r\n$6\r\n123456\r\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestClockExpiry(t *testing.T) {
+	server := MakeServer()
+	clock := newFakeClock(time.Unix(1700000000, 0))
+	server.Clock = clock
+	session, conn := newTestSession(server)
+	run := func(cmd ...string) string {
+		conn.buf.Reset()
+		session.dispatch(cmd)
+		return conn.buf.String()
+	}
+
+	run("SET", "key", "value", "PX", "1000")
+	clock.Advance(999 * time.Millisecond)
+	if got := run("PTTL", "key"); got != ":1\r\n" {
+		t.Errorf("PTTL right before expiring: got %q", got)
+	}
+	if got := run("GET", "key"); got != "$5\r\nvalue\r\n" {
+		t.Errorf("GET right before expiring: got %q", got)
+	}
+	clock.Advance(time.Millisecond)
+	if got := run("GET", "key"); got != "$-1\r\n" {
+		t.Errorf("GET once expired: got %q", got)
+	}
+
+	// Auto-generated stream IDs come from the clock too
+	if got := run("XADD", "stream", "*", "field", "value"); got != "$15\r\n1700000001000-0\r\n" {
+		t.Errorf("XADD *: got %q", got)
+	}
+}
+
+func TestClockBlockTimeout(t *testing.T) {
+	server := MakeServer()
+	clock := newFakeClock(time.Unix(1700000000, 0))
+	server.Clock = clock
+	session, _ := newTestSession(server)
+	session.ctx = context.Background()
+
+	done := make(chan bool)
+	go func() {
+		done <- session.block([]string{"key"}, time.Second, func() bool { return false })
+	}()
+	for clock.waiting() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	clock.Advance(999 * time.Millisecond)
+	select {
+	case <-done:
+		t.Fatalf("gave up before the timeout")
+	case <-time.After(20 * time.Millisecond):
+	}
+	clock.Advance(time.Millisecond)
+	select {
+	case served := <-done:
+		if served {
+			t.Errorf("got served without anything to serve")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("didn't give up after the timeout")
+	}
+}
@@ -0,0 +1,276 @@
+package diyredis
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	crc16 "github.com/codecrafters-io/redis-starter-go/app/diyredis/crc16"
+	resp3 "github.com/codecrafters-io/redis-starter-go/app/diyredis/resp3"
+)
+
+const clusterSlots = 16384
+
+// A node in the cluster.
+type clusterNode struct {
+	id   string
+	addr string // "ip:port", empty for ourselves since we only know it once listening
+}
+
+// Our view of the cluster: the nodes in it, and which node serves which hash slot.
+type clusterState struct {
+	myself *clusterNode
+	nodes  map[string]*clusterNode
+	slots  [clusterSlots]*clusterNode // nil if the slot is not served by anyone
+	mutex  sync.RWMutex
+}
+
+// Create a single-node cluster, where we serve every slot ourselves.
+func newClusterState() *clusterState {
+	idBytes := make([]byte, 20)
+	rand.Read(idBytes)
+	myself := &clusterNode{id: hex.EncodeToString(idBytes)}
+
+	cluster := &clusterState{
+		myself: myself,
+		nodes:  map[string]*clusterNode{myself.id: myself},
+	}
+	cluster.assignSlots(myself, 0, clusterSlots-1)
+	return cluster
+}
+
+// Let `node` serve all slots between `from` and `to`, inclusively. A nil node leaves the
+// slots unserved.
+func (c *clusterState) assignSlots(node *clusterNode, from int, to int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for slot := from; slot <= to; slot++ {
+		c.slots[slot] = node
+	}
+}
+
+func (c *clusterState) slotOwner(slot int) *clusterNode {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.slots[slot]
+}
+
+// A contiguous range of slots served by the same node.
+type slotRange struct {
+	from int
+	to   int
+	node *clusterNode
+}
+
+// Return all ranges of served slots, in order.
+func (c *clusterState) slotRanges() []slotRange {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	var ranges []slotRange
+	for slot, node := range c.slots {
+		if node == nil {
+			continue
+		}
+		last := len(ranges) - 1
+		if last >= 0 && ranges[last].node == node && ranges[last].to == slot-1 {
+			ranges[last].to = slot
+		} else {
+			ranges = append(ranges, slotRange{from: slot, to: slot, node: node})
+		}
+	}
+	return ranges
+}
+
+// Return the hash slot that key belongs to.
+//
+// If the key contains a hash tag, e.g. "{user1000}.following", only the part between the
+// first "{" and the first "}" after it is hashed. This lets users force related keys into
+// the same slot. Empty tags ("{}") don't count.
+func keyHashSlot(key string) int {
+	return int(crc16.Checksum([]byte(hashTag(key))) & (clusterSlots - 1))
+}
+
+// Return the part of key that determines its hash slot.
+func hashTag(key string) string {
+	start := strings.IndexByte(key, '{')
+	if start == -1 {
+		return key
+	}
+	end := strings.IndexByte(key[start+1:], '}')
+	if end <= 0 { // no closing brace, or nothing in between
+		return key
+	}
+	return key[start+1 : start+1+end]
+}
+
+// The address clients can reach `node` on.
+func (s *Server) nodeAddr(node *clusterNode) (string, int) {
+	if node.addr != "" {
+		host, portStr, _ := net.SplitHostPort(node.addr)
+		port, _ := strconv.Atoi(portStr)
+		return host, port
+	}
+
+	ip, port := "127.0.0.1", 6379
+	if s.Listener != nil {
+		if addr, ok := s.Listener.Addr().(*net.TCPAddr); ok {
+			port = addr.Port
+			if !addr.IP.IsUnspecified() {
+				ip = addr.IP.String()
+			}
+		}
+	}
+	return ip, port
+}
+
+// Check whether we serve the keys of the command, and return the redirection to reply
+// with if we don't.
+func (s *Session) redirectIfNeeded(spec *command, cmds []string) *UserError {
+	keys := spec.keys(cmds)
+	if len(keys) == 0 {
+		return nil
+	}
+
+	slot := keyHashSlot(keys[0])
+	for _, key := range keys[1:] {
+		if keyHashSlot(key) != slot {
+			return &UserError{"CROSSSLOT", "Keys in request don't hash to the same slot"}
+		}
+	}
+
+	cluster := s.server.cluster
+	owner := cluster.slotOwner(slot)
+	if owner == nil {
+		return &UserError{"CLUSTERDOWN", "Hash slot not served"}
+	}
+	if owner != cluster.myself {
+		ip, port := s.server.nodeAddr(owner)
+		addr := net.JoinHostPort(ip, strconv.Itoa(port))
+		return &UserError{"MOVED", strconv.Itoa(slot) + " " + addr}
+	}
+	return nil
+}
+
+var clusterHelp = []string{
+	"INFO",
+	"    Return information about the cluster.",
+	"KEYSLOT <key>",
+	"    Return the hash slot for <key>.",
+	"MYID",
+	"    Return the node id.",
+	"SHARDS",
+	"    Return information about slot range mappings and the nodes serving them.",
+	"SLOTS",
+	"    Return information about slots range mappings.",
+}
+
+func (s *Session) doCLUSTER(cmds []string) *UserError {
+	if !s.server.ClusterEnabled {
+		return &UserError{"ERR", "This instance has cluster support disabled"}
+	}
+	if len(cmds) < 2 {
+		return &UserError{"ERR", "wrong number of arguments for CLUSTER command"}
+	}
+
+	cluster := s.server.cluster
+	encoder := resp3.Encoder{}
+	switch strings.ToLower(cmds[1]) {
+	case "info":
+		encoder.WriteBulkStr(cluster.info())
+
+	case "myid":
+		encoder.WriteBulkStr(cluster.myself.id)
+
+	case "keyslot":
+		if len(cmds) != 3 {
+			return &UserError{"ERR", "wrong number of arguments for CLUSTER KEYSLOT command"}
+		}
+		encoder.WriteInt(keyHashSlot(cmds[2]))
+
+	case "slots":
+		ranges := cluster.slotRanges()
+		encoder.WriteArrHeader(len(ranges))
+		for _, r := range ranges {
+			ip, port := s.server.nodeAddr(r.node)
+			encoder.WriteArrHeader(3)
+			encoder.WriteInt(r.from)
+			encoder.WriteInt(r.to)
+			encoder.WriteArrHeader(3)
+			encoder.WriteBulkStr(ip)
+			encoder.WriteInt(port)
+			encoder.WriteBulkStr(r.node.id)
+		}
+
+	case "shards":
+		// Every node is its own shard, since there are no replicas. Maps are encoded as
+		// arrays of keys and values, RESP2-style.
+		shards := map[*clusterNode][]slotRange{}
+		for _, r := range cluster.slotRanges() {
+			shards[r.node] = append(shards[r.node], r)
+		}
+		encoder.WriteArrHeader(len(shards))
+		for node, ranges := range shards {
+			ip, port := s.server.nodeAddr(node)
+			encoder.WriteArrHeader(4)
+			encoder.WriteBulkStr("slots")
+			encoder.WriteArrHeader(len(ranges) * 2)
+			for _, r := range ranges {
+				encoder.WriteInt(r.from)
+				encoder.WriteInt(r.to)
+			}
+			encoder.WriteBulkStr("nodes")
+			encoder.WriteArrHeader(1)
+			encoder.WriteArrHeader(14)
+			encoder.WriteBulkStr("id")
+			encoder.WriteBulkStr(node.id)
+			encoder.WriteBulkStr("port")
+			encoder.WriteInt(port)
+			encoder.WriteBulkStr("ip")
+			encoder.WriteBulkStr(ip)
+			encoder.WriteBulkStr("endpoint")
+			encoder.WriteBulkStr(ip)
+			encoder.WriteBulkStr("role")
+			encoder.WriteBulkStr("master")
+			encoder.WriteBulkStr("replication-offset")
+			encoder.WriteInt(0)
+			encoder.WriteBulkStr("health")
+			encoder.WriteBulkStr("online")
+		}
+
+	default:
+		return errUnknownSubcommand(cmds)
+	}
+
+	s.conn.Write(encoder.Buf)
+	return nil
+}
+
+// Return the reply to CLUSTER INFO.
+func (c *clusterState) info() string {
+	assigned := 0
+	for _, r := range c.slotRanges() {
+		assigned += r.to - r.from + 1
+	}
+	state := "ok"
+	if assigned < clusterSlots {
+		state = "fail"
+	}
+
+	fields := []string{
+		"cluster_enabled:1",
+		"cluster_state:" + state,
+		"cluster_slots_assigned:" + strconv.Itoa(assigned),
+		"cluster_slots_ok:" + strconv.Itoa(assigned),
+		"cluster_slots_pfail:0",
+		"cluster_slots_fail:0",
+		"cluster_known_nodes:" + strconv.Itoa(len(c.nodes)),
+		"cluster_size:1",
+		"cluster_current_epoch:0",
+		"cluster_my_epoch:0",
+	}
+	return strings.Join(fields, "\r\n") + "\r\n"
+}
@@ -0,0 +1,96 @@
+package diyredis
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestKeyHashSlot(t *testing.T) {
+	cases := map[string]int{"foo": 12182, "bar": 5061, "": 0, "123456789": 12739}
+	for key, want := range cases {
+		if got := keyHashSlot(key); got != want {
+			t.Errorf("got slot %d for key %q, want %d", got, key, want)
+		}
+	}
+}
+
+func TestClusterRedirect(t *testing.T) {
+	server := MakeServer()
+	server.ClusterEnabled = true
+	session, conn := newTestSession(server)
+
+	other := &clusterNode{id: strings.Repeat("a", 40), addr: "10.0.0.1:7000"}
+	server.cluster.nodes[other.id] = other
+	server.cluster.assignSlots(other, 12000, 12999)
+	server.cluster.assignSlots(nil, 5061, 5061)
+
+	session.dispatch([]string{"SET", "foo", "1"})
+	if got := conn.buf.String(); got != "-MOVED 12182 10.0.0.1:7000\r\n" {
+		t.Errorf("got %q, want a MOVED redirection", got)
+	}
+	if _, ok := server.dbs[0].engine.Get("foo"); ok {
+		t.Errorf("redirected command was executed anyway")
+	}
+
+	conn.buf.Reset()
+	session.dispatch([]string{"GET", "bar"})
+	if got := conn.buf.String(); got != "-CLUSTERDOWN Hash slot not served\r\n" {
+		t.Errorf("got %q, want a CLUSTERDOWN error", got)
+	}
+
+	conn.buf.Reset()
+	session.dispatch([]string{"SET", "baz", "1"})
+	if got := conn.buf.String(); got != "+OK\r\n" {
+		t.Errorf("got %q for a key in our own slot, want +OK", got)
+	}
+
+	conn.buf.Reset()
+	session.dispatch([]string{"CLUSTER", "INFO"})
+	if got := conn.buf.String(); !strings.Contains(got, "cluster_slots_assigned:16383") {
+		t.Errorf("got %q, want 16383 assigned slots", got)
+	}
+}
+
+func TestHashTags(t *testing.T) {
+	cases := map[string]string{
+		"{user1000}.following": "user1000",
+		"foo{}{bar}":           "foo{}{bar}",
+		"foo{{bar}}zap":        "{bar",
+		"foo{bar}{zap}":        "bar",
+		"{}":                   "{}",
+		"{":                    "{",
+		"no tags":              "no tags",
+	}
+	for key, want := range cases {
+		if got := hashTag(key); got != want {
+			t.Errorf("got hash tag %q for key %q, want %q", got, key, want)
+		}
+	}
+
+	if keyHashSlot("{user1000}.following") != keyHashSlot("{user1000}.followers") {
+		t.Errorf("keys with the same hash tag ended up in different slots")
+	}
+}
+
+func TestClusterCrossSlot(t *testing.T) {
+	server := MakeServer()
+	server.ClusterEnabled = true
+	session, conn := newTestSession(server)
+
+	session.dispatch([]string{"MSET", "foo", "1", "bar", "2"})
+	if got := conn.buf.String(); got != "-CROSSSLOT Keys in request don't hash to the same slot\r\n" {
+		t.Errorf("got %q, want a CROSSSLOT error", got)
+	}
+
+	conn.buf.Reset()
+	session.dispatch([]string{"MSET", "{x}foo", "1", "{x}bar", "2"})
+	if got := conn.buf.String(); got != "+OK\r\n" {
+		t.Errorf("got %q, want +OK", got)
+	}
+
+	conn.buf.Reset()
+	session.dispatch([]string{"MGET", "{x}foo", "{x}bar", "{x}nope"})
+	if got := conn.buf.String(); got != "*3\r\n$1\r\n1\r\n$1\r\n2\r\n$-1\r\n" {
+		t.Errorf("got %q", got)
+	}
+}
@@ -2,15 +2,19 @@ package diyredis
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"iter"
+	"log/slog"
+	"math"
 	"net"
-	"reflect"
+	"os"
+	"slices"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	resp3 "github.com/codecrafters-io/redis-starter-go/app/diyredis/resp3"
@@ -18,181 +22,585 @@ import (
 )
 
 type Session struct {
-	server   *Server
-	conn     net.Conn
-	valueDB  *sync.Map
-	expiryDB *sync.Map
-	log      *log.Logger
+	server  *Server
+	conn    net.Conn
+	dbIndex int     // selected with SELECT
+	db      RedisDB // the selected database, resolved through server for every command
+	log     *slog.Logger
+	ctx     context.Context // of the command currently being executed
+	proto   int             // RESP version, as set by HELLO. 0 until then, which means 2
+
+	connCtx   context.Context // canceled when the server closes the connection
+	closeConn context.CancelFunc
+	out       *clientOutput // nil if replies are written to conn directly, e.g. in tests
+
+	master      bool       // the connection of a replica to its master
+	replica     bool       // a replica connected to us, after PSYNC
+	replicaPort int        // the port a replica listens on, as told with REPLCONF
+	replicaEOF  bool       // the replica takes snapshots ending with a mark, as told with REPLCONF capa eof
+	rewrite     [][]string // to propagate instead of the command being executed, if rewritten
+	rewritten   bool
+	scratch     []byte // reused for replies that are written right away, see writeInt
+	quit        bool   // set by QUIT: close the connection once the reply is written
+	info        clientInfo
+}
+
+// Close the connection, aborting any command that is blocked.
+func (s *Session) close() {
+	if s.closeConn != nil {
+		s.closeConn()
+	}
+	s.conn.Close()
 }
 
+var errCommandTimeout = &UserError{"ERR", "command timed out"}
+
 func (s *Session) SwitchDB(id int) error {
-	if id > len(s.server.dbs) {
+	if id < 0 || id >= s.server.dbCount() {
 		return errors.New("database does not exist")
 	}
 
-	s.valueDB = s.server.dbs[id].valueDB
-	s.expiryDB = s.server.dbs[id].expiryDB
+	s.dbIndex = id
+	s.info.mutex.Lock()
+	s.info.db = id
+	s.info.mutex.Unlock()
+	s.db = s.server.db(id)
+	return nil
+}
+
+func (s *Session) doSELECT(cmds []string) *UserError {
+	if len(cmds) != 2 {
+		return &UserError{"ERR", "wrong number of arguments for SELECT command"}
+	}
+	id, err := strconv.Atoi(cmds[1])
+	if err != nil {
+		return &UserError{"ERR", "value is not an integer or out of range"}
+	}
+	if id < 0 || id >= s.server.dbCount() {
+		return &UserError{"ERR", "DB index is out of range"}
+	}
+	s.SwitchDB(id)
+	s.conn.Write(resp3.OK)
 	return nil
 }
 
 func (s *Session) HandleCommands() {
 	reader := bufio.NewReader(s.conn)
+	var cmd []string // being served, for the crash report
+	defer func() {
+		if r := recover(); r != nil {
+			s.server.reportCrash(r, s, cmd)
+			panic(r)
+		}
+	}()
 	for {
-		cmd, err := ParseCommand(reader)
+		s.flush() // before waiting for the next command
+		// Blocked clients (e.g. XREAD BLOCK) are never considered idle, since the
+		// deadline only applies while waiting for the next command.
+		if timeout := s.server.IdleTimeout; timeout > 0 && !s.replica {
+			s.conn.SetReadDeadline(time.Now().Add(timeout))
+		}
+
+		var err error
+		cmd, err = readClientCommand(reader, s.server.ProtoLimits)
 		if err != nil {
 			if errors.Is(err, io.EOF) {
 				return
 			}
-			s.log.Println("Error parsing RESP command: ", err.Error())
-			s.conn.Write([]byte("-ERR Cannot parse RESP command"))
-			continue
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				s.log.Info("Closing idle client")
+				return
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) {
+				return // closed, by us or the client, or otherwise broken
+			}
+			// There's no telling where the next command starts, so like Redis, give up
+			// on the connection rather than reading garbage from the middle of one
+			var protoErr *ProtocolError
+			if errors.As(err, &protoErr) {
+				s.log.Warn("Closing client that sent an invalid command", "err", err)
+				s.conn.Write((&UserError{"ERR", protoErr.Error()}).RESP())
+				return
+			}
+			s.log.Debug("Closing client that stopped halfway through a command", "err", err)
+			return
 		}
 
-		mainCmd := strings.ToLower(cmd[0])
-		var uerr *UserError
-		switch mainCmd {
-		case "ping":
-			uerr = s.doPING(cmd)
-		case "echo":
-			uerr = s.doECHO(cmd)
-		case "set":
-			uerr = s.doSET(cmd)
-		case "get":
-			uerr = s.doGET(cmd)
-		case "config":
-			uerr = s.doCONFIG(cmd)
-		case "keys":
-			uerr = s.doKEYS(cmd)
-		case "type":
-			uerr = s.doTYPE(cmd)
-		case "xadd":
-			uerr = s.doXADD(cmd)
-		case "xrange":
-			uerr = s.doXRANGE(cmd)
-		case "xread":
-			uerr = s.doXREAD(cmd)
-		default:
-			uerr = &UserError{"Command not known"}
+		if len(cmd) == 0 {
+			continue // "*0\r\n" and empty lines are ignored, as by Redis
+		}
+		s.dispatch(cmd)
+		if s.quit {
+			return
 		}
+	}
+}
 
-		if uerr != nil {
-			s.conn.Write(uerr.RESP())
+// QUIT
+func (s *Session) doQUIT(cmds []string) *UserError {
+	s.conn.Write(resp3.OK)
+	s.quit = true
+	return nil
+}
+
+// Look up the command and run its handler, provided the command is allowed to run.
+// Any error is replied to the client.
+func (s *Session) dispatch(cmd []string) {
+	uerr := s.execute(cmd)
+	if uerr != nil {
+		s.conn.Write(uerr.RESP())
+	}
+}
+
+func (s *Session) execute(cmd []string) *UserError {
+	if len(cmd) == 0 {
+		return &UserError{"ERR", "empty command"}
+	}
+	commands := s.server.commands
+	if s.master {
+		commands = commandTable // whatever we renamed, our master uses the original names
+	}
+	spec, ok := commands[strings.ToLower(cmd[0])]
+	if !ok {
+		return &UserError{"ERR", "Command not known"}
+	}
+	// Handlers, replicas and the AOF only know commands by their original names
+	cmd[0] = spec.name
+	s.info.executing(spec.name)
+	s.server.recent.record(s, cmd)
+	if s.server.Sentinel && spec.flags&flagSentinel == 0 {
+		return &UserError{"ERR", "Command not known"}
+	}
+	if isHelpRequest(spec, cmd) {
+		s.writeHelp(spec)
+		return nil
+	}
+
+	stats := s.server.commandStats[spec.name]
+	if s.server.ClusterEnabled {
+		if uerr := s.redirectIfNeeded(spec, cmd); uerr != nil {
+			stats.rejected.Add(1)
+			return uerr
 		}
 	}
+
+	if spec.flags&flagNoPause == 0 && !s.master {
+		s.server.pause.wait(spec)
+	}
+	// After the pause, which FAILOVER ends as a replica
+	if uerr := s.replicaRefuses(spec); uerr != nil {
+		stats.rejected.Add(1)
+		return uerr
+	}
+
+	s.db = s.server.db(s.dbIndex)
+
+	// Blocking commands have a timeout of their own
+	s.ctx = s.connCtx
+	if s.ctx == nil {
+		s.ctx = context.Background()
+	}
+	if s.server.CommandTimeout > 0 && spec.flags&flagBlocking == 0 {
+		var cancel context.CancelFunc
+		s.ctx, cancel = context.WithTimeout(s.ctx, s.server.CommandTimeout)
+		defer cancel()
+	}
+
+	journal := s.server.journal.Load()
+	var entry *JournalEntry
+	if journal != nil {
+		entry = journal.before(s.db, spec.keys(cmd))
+	}
+
+	// Writes hold the write lock throughout, so that a snapshot is taken in between two of
+	// them, and the order locks of their keys, so that they are propagated in the order
+	// they were made in. Those that wait on something else, e.g. another server, take them
+	// themselves around their changes only, propagating them too, rather than hold up
+	// every other write in the meantime
+	write := spec.flags&flagWrite != 0
+	locked := write && spec.flags&flagOwnLock == 0
+	var unlockOrder func()
+	if locked {
+		unlockOrder = s.server.repl.order.lockKeys(spec.keys(cmd), true)
+		s.server.repl.writes.RLock()
+	}
+	s.rewrite, s.rewritten = nil, false
+	start := time.Now()
+	uerr := spec.handler(s, cmd)
+	stats.record(time.Since(start), uerr != nil)
+	var changes [][]string
+	if write {
+		// A rewritten command may have changed the keyspace even if it failed
+		if s.rewritten {
+			changes = s.rewrite
+		} else if uerr == nil {
+			changes = [][]string{cmd}
+		}
+		if locked {
+			s.server.propagate(s.dbIndex, changes...)
+			s.server.repl.writes.RUnlock()
+			unlockOrder()
+		}
+	}
+	if journal != nil {
+		journal.after(s.db, entry, cmd, changes, uerr)
+	}
+	if uerr != nil {
+		return uerr
+	}
+	if write {
+		keys := spec.keys(cmd)
+		s.server.markDirty(max(len(keys), 1))
+		s.server.signalKeysReady(s.db.id, keys)
+		s.server.tracking.invalidate(s, keys)
+	} else {
+		s.server.tracking.read(s, spec.keys(cmd))
+	}
+	return nil
+}
+
+// Return true if the command currently being executed ran out of time, in which case
+// the handler should stop what it's doing and return errCommandTimeout.
+func (s *Session) timedOut() bool {
+	return s.ctx != nil && s.ctx.Err() != nil
+}
+
+// Limits on what clients may send us, so that a (malicious) client can't make us
+// allocate arbitrary amounts of memory.
+type ProtoLimits struct {
+	MaxBulkLen      int // the largest single argument, in bytes
+	MaxMultibulkLen int // the largest number of arguments in a single command
+}
+
+var DefaultProtoLimits = ProtoLimits{
+	MaxBulkLen:      512 * 1024 * 1024,
+	MaxMultibulkLen: 1024 * 1024,
+}
+
+// The client broke the protocol in a way that we can't, or won't, recover from. The
+// connection should be closed.
+type ProtocolError struct {
+	msg string
+}
+
+func (e *ProtocolError) Error() string {
+	return "Protocol error: " + e.msg
 }
 
 // RESP array of bulk strings -> Go array of strings
-func ParseCommand(reader *bufio.Reader) ([]string, error) {
-	unit, err := reader.ReadString('\n')
+func ParseCommand(reader *bufio.Reader, limits ProtoLimits) ([]string, error) {
+	arrayLength, err := readRESPHeader(reader, '*')
 	if err != nil {
 		return nil, err
 	}
-	if unit[0] != '*' {
-		return nil, fmt.Errorf("expected RESP array (*), got: %v", unit[0])
-	}
-	arrayLength, err := strconv.Atoi(unit[1 : len(unit)-2])
-	if err != nil {
-		return nil, err
+	if arrayLength < 0 || arrayLength > limits.MaxMultibulkLen {
+		return nil, &ProtocolError{"invalid multibulk length"}
 	}
 
-	command := make([]string, arrayLength)
-	for i := range arrayLength {
-		bulkStrHeader, err := reader.ReadString('\n')
+	// Don't preallocate for a huge number of arguments that may never arrive
+	command := make([]string, 0, min(arrayLength, 1024))
+	for range arrayLength {
+		bulkStrLen, err := readRESPHeader(reader, '$')
 		if err != nil {
 			return nil, err
 		}
-		if bulkStrHeader[0] != '$' {
-			return nil, fmt.Errorf("expected RESP bulk string ($), got: %v", bulkStrHeader[0])
+		if bulkStrLen < 0 || bulkStrLen > limits.MaxBulkLen {
+			return nil, &ProtocolError{"invalid bulk length"}
 		}
-		bulkStrLen, err := strconv.Atoi(bulkStrHeader[1 : len(bulkStrHeader)-2])
-		if err != nil {
-			return nil, err
+
+		var buf []byte
+		if bulkStrLen <= 64*1024 {
+			buf = make([]byte, bulkStrLen+2) // +2 is for the \r\n at the end of the bulk string
+			_, err = io.ReadFull(reader, buf)
+		} else {
+			// Large argument: let the buffer grow as the data actually comes in
+			var bigBuf bytes.Buffer
+			_, err = io.CopyN(&bigBuf, reader, int64(bulkStrLen+2))
+			buf = bigBuf.Bytes()
 		}
-		buf := make([]byte, bulkStrLen+2) // +2 is for the \r\n at the end of the bulk string
-		_, err = io.ReadFull(reader, buf)
 		if err != nil {
 			return nil, err
 		}
-		command[i] = string(buf[:len(buf)-2])
+		if buf[len(buf)-2] != '\r' || buf[len(buf)-1] != '\n' {
+			return nil, &ProtocolError{"bulk string not terminated by CRLF"}
+		}
+		command = append(command, string(buf[:len(buf)-2]))
 	}
 	return command, nil
+}
 
+// Read the next command from a client: a RESP array of bulk strings, or an inline
+// command, as typed into telnet or netcat.
+func readClientCommand(reader *bufio.Reader, limits ProtoLimits) ([]string, error) {
+	first, err := reader.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if first[0] == '*' {
+		return ParseCommand(reader, limits)
+	}
+	return parseInlineCommand(reader)
 }
 
-func (s *Session) doXADD(cmds []string) *UserError {
-	if len(cmds) < 5 {
-		// s.conn.Write([]byte("-ERR Wrong number of arguments for XADD command\r\n"))
-		// return
-		return &UserError{"wrong number of arguments for XADD command"}
+// The longest line of an inline command, as in Redis.
+const maxInlineLen = 64 * 1024
+
+// Inline command -> Go array of strings. Arguments are separated by spaces, and may be
+// quoted as in redis-cli: "double quotes" take escapes such as \n and \x41, 'single
+// quotes' only \'. An empty line is an empty command.
+func parseInlineCommand(reader *bufio.Reader) ([]string, error) {
+	var line []byte
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		if len(line)+len(chunk) > maxInlineLen {
+			return nil, &ProtocolError{"too big inline request"}
+		}
+		line = append(line, chunk...)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, bufio.ErrBufferFull) {
+			return nil, err
+		}
 	}
+	line = bytes.TrimSuffix(bytes.TrimSuffix(line, []byte("\n")), []byte("\r"))
 
-	streamKey := cmds[1]
-	value, ok := s.valueDB.Load(streamKey)
-	var stream *streams.Stream
-	if ok {
-		stream, ok = value.(*streams.Stream)
-		if !ok {
-			// s.conn.Write([]byte(
-			// 	"-ERR WRONGTYPE Operation against a key holding the wrong kind of value\r\n",
-			// ))
-			// return
-			return &UserError{"WRONGTYPE Operation against a key holding the wrong kind of value"}
+	args, ok := splitArgs(string(line))
+	if !ok {
+		return nil, &ProtocolError{"unbalanced quotes in request"}
+	}
+	return args, nil
+}
+
+// Split line into arguments the way redis-cli does, see parseInlineCommand. Returns false
+// if a quote isn't closed, or isn't followed by a space.
+func splitArgs(line string) ([]string, bool) {
+	var args []string
+	for i := 0; ; {
+		for i < len(line) && isSpace(line[i]) {
+			i++
 		}
-	} else {
-		stream = streams.NewStream()
-		s.valueDB.Store(streamKey, stream)
-		// Technically this causes empty streams to be created, if adding the first entry fails
+		if i == len(line) {
+			return args, true
+		}
+
+		var arg []byte
+		quote := byte(0)
+		for ; ; i++ {
+			if i == len(line) {
+				if quote != 0 {
+					return nil, false
+				}
+				break
+			}
+			c := line[i]
+			if quote == 0 {
+				if isSpace(c) {
+					break
+				}
+				if c == '"' || c == '\'' {
+					quote = c
+				} else {
+					arg = append(arg, c)
+				}
+				continue
+			}
+
+			if c == quote {
+				// The closing quote must end the argument
+				if i+1 < len(line) && !isSpace(line[i+1]) {
+					return nil, false
+				}
+				i++
+				break
+			}
+			if c != '\\' || i+1 == len(line) {
+				arg = append(arg, c)
+				continue
+			}
+			next := line[i+1]
+			switch {
+			case quote == '\'':
+				if next == '\'' {
+					c = next
+					i++
+				}
+			case next == 'x' && i+3 < len(line) && isHexDigit(line[i+2]) && isHexDigit(line[i+3]):
+				n, _ := strconv.ParseUint(line[i+2:i+4], 16, 8)
+				c = byte(n)
+				i += 3
+			default:
+				switch next {
+				case 'n':
+					c = '\n'
+				case 'r':
+					c = '\r'
+				case 't':
+					c = '\t'
+				case 'b':
+					c = '\b'
+				case 'a':
+					c = '\a'
+				default:
+					c = next
+				}
+				i++
+			}
+			arg = append(arg, c)
+		}
+		args = append(args, string(arg))
 	}
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\v' || c == '\f'
+}
 
-	streamEntryKey, err := streams.NewKey(cmds[2], stream)
+func isHexDigit(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+// Read a RESP header line such as "*3\r\n" or "$5\r\n", returning the number in it.
+func readRESPHeader(reader *bufio.Reader, prefix byte) (int, error) {
+	line, err := reader.ReadSlice('\n')
 	if err != nil {
-		// s.conn.Write([]byte(fmt.Sprintf(
-		// 	"could not parse given entry key: %s\r\n", err.Error(),
-		// )))
-		// return
-		return &UserError{fmt.Sprintf(
-			"could not parse given entry key: %s", err.Error(),
-		)}
+		if errors.Is(err, bufio.ErrBufferFull) {
+			return 0, &ProtocolError{"too big header"}
+		}
+		return 0, err
+	}
+	if line[0] != prefix {
+		return 0, &ProtocolError{fmt.Sprintf("expected '%c', got '%c'", prefix, line[0])}
+	}
+	var n int
+	if len(line) >= 3 && line[len(line)-2] == '\r' {
+		n, err = strconv.Atoi(string(line[1 : len(line)-2]))
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' || err != nil {
+		if prefix == '*' {
+			return 0, &ProtocolError{"invalid multibulk length"}
+		}
+		return 0, &ProtocolError{"invalid bulk length"}
 	}
+	return n, nil
+}
 
-	if streamEntryKey.LeftNr == 0 && streamEntryKey.RightNr == 0 {
-		// s.conn.Write([]byte(
-		// 	"-ERR The ID specified in XADD must be greater than 0-0\r\n",
-		// ))
-		// return
-		return &UserError{"the ID specified in XADD must be greater than 0-0"}
+// Append an entry to the stream at key, and trim it to maxLen entries unless maxLen is
+// negative. id may contain wildcards, as in XADD. If there is no stream yet, one is
+// created if create is true, only once the entry turned out to be valid; otherwise
+// false is returned. The ID is generated, checked and added through computeInPlace, so
+// that concurrent XADDs of the same stream each get their own.
+func (db RedisDB) xadd(key string, id string, fields StreamFields, maxLen int, create bool) (streams.Key, bool, *UserError) {
+	var streamEntryKey streams.Key
+	added := false
+	uerr := db.computeInPlace(key, func(value any, exists bool) (any, *UserError) {
+		added = false
+		stream := streams.NewStream()
+		if exists {
+			var ok bool
+			if stream, ok = value.(*streams.Stream); !ok {
+				return nil, ErrWrongType()
+			}
+		} else if !create {
+			return nil, nil
+		}
+
+		var err error
+		streamEntryKey, err = streams.NewKeyAt(id, stream, db.now())
+		if err != nil {
+			return nil, &UserError{"ERR", fmt.Sprintf(
+				"could not parse given entry key: %s", err.Error(),
+			)}
+		}
+		if streamEntryKey.LeftNr == 0 && streamEntryKey.RightNr == 0 {
+			return nil, &UserError{"ERR", "the ID specified in XADD must be greater than 0-0"}
+		}
+		errTooSmall := &UserError{"ERR", "the ID specified in XADD is equal or smaller than the target stream top item"}
+		if !streamEntryKey.GreaterThan(stream.MaxID()) {
+			return nil, errTooSmall
+		}
+		if err := stream.Put(streamEntryKey, fields.sharingNames(stream.Last().Val)); err != nil {
+			return nil, errTooSmall
+		}
+		if maxLen >= 0 {
+			stream.Trim(maxLen)
+		}
+		added = true
+		return stream, nil
+	})
+	if uerr != nil {
+		return streams.Key{}, false, uerr
 	}
+	return streamEntryKey, added, nil
+}
 
-	if !streamEntryKey.GreaterThan(stream.LastEntry.Key) {
-		// s.conn.Write([]byte(
-		// 	"-ERR The ID specified in XADD is equal or smaller than the target stream top item\r\n",
-		// ))
+// XADD key [NOMKSTREAM] [MAXLEN [=|~] threshold] id field value [field value ...]
+func (s *Session) doXADD(cmds []string) *UserError {
+	if len(cmds) < 5 {
+		// s.conn.Write([]byte("-ERR Wrong number of arguments for XADD command\r\n"))
 		// return
-		return &UserError{
-			"the ID specified in XADD is equal or smaller than the target stream top item",
+		return &UserError{"ERR", "wrong number of arguments for XADD command"}
+	}
+
+	// Trim the oldest entries as new ones come in. Approximate trimming (~) lets Redis
+	// get away with only trimming whole nodes; we always trim exactly, which is allowed.
+	maxLen := -1
+	noMkStream := false
+	args := newArgScanner(cmds, 2)
+options:
+	for {
+		switch args.acceptToken("nomkstream", "maxlen") {
+		case "nomkstream":
+			noMkStream = true
+		case "maxlen":
+			args.acceptToken("=", "~")
+			n, uerr := args.readInt()
+			if uerr != nil {
+				return uerr
+			}
+			if n < 0 {
+				return &UserError{"ERR", "The MAXLEN argument must be >= 0."}
+			}
+			maxLen = int(n)
+		default:
+			break options
 		}
 	}
+	idIdx := args.pos
+	if len(cmds) < idIdx+3 {
+		return &UserError{"ERR", "wrong number of arguments for XADD command"}
+	}
 
-	keyVals := cmds[3:]
+	keyVals := cmds[idIdx+1:]
 	if len(keyVals) < 2 {
 		// s.conn.Write([]byte(
 		// 	"-ERR A stream entry needs at least one key value pair\r\n",
 		// ))
 		// return
-		return &UserError{"a stream entry needs at least one key value pair"}
+		return &UserError{"ERR", "a stream entry needs at least one key value pair"}
 	} else if len(keyVals)%2 != 0 {
 		// s.conn.Write([]byte(
 		// 	"-ERR Received a key without a value\r\n",
 		// ))
 		// return
-		return &UserError{"received a key without a value"}
+		return &UserError{"ERR", "received a key without a value"}
 	}
 
-	streamEntryVal := make(map[string]string, len(keyVals)/2)
-	for i := 0; i < len(keyVals); i += 2 {
-		streamEntryVal[keyVals[i]] = keyVals[i+1] // this will never be out of bounds because of the modulo check above
+	streamEntryVal := newStreamFields(keyVals)
+	streamEntryKey, added, uerr := s.db.xadd(cmds[1], cmds[idIdx], streamEntryVal, maxLen, !noMkStream)
+	if uerr != nil {
+		return uerr
 	}
-	stream.Put(streamEntryKey, streamEntryVal)
+	if !added {
+		s.propagateAs() // nothing changed
+		s.writeNull()
+		return nil
+	}
+	// With the ID that was actually used, in case it was generated
+	rewrite := slices.Clone(cmds)
+	rewrite[idIdx] = streamEntryKey.String()
+	s.propagateAs(rewrite)
 
 	encoder := resp3.Encoder{}
 	encoder.WriteBulkStr(streamEntryKey.String())
@@ -200,69 +608,435 @@ func (s *Session) doXADD(cmds []string) *UserError {
 	return nil
 }
 
-func (s *Session) doTYPE(cmds []string) *UserError {
-	value, ok := s.valueDB.Load(cmds[1])
-	if ok {
-		expiry, ok := s.expiryDB.Load(cmds[1])
-		if !ok || expiry.(time.Time).After(time.Now()) {
-			_, ok := value.(*streams.Stream)
-			if ok {
-				s.conn.Write([]byte("+stream\r\n"))
-			} else {
-				s.conn.Write([]byte(
-					"+" + strings.ToLower(reflect.TypeOf(value).Name()) + "\r\n"),
-				)
+// XSETID key last-id [ENTRIESADDED entries-added] [MAXDELETEDID max-deleted-id]
+func (s *Session) doXSETID(cmds []string) *UserError {
+	if len(cmds) != 3 && len(cmds) != 5 && len(cmds) != 7 {
+		return &UserError{"ERR", "wrong number of arguments for XSETID command"}
+	}
+
+	value, _, ok := s.db.load(cmds[1])
+	if !ok {
+		return ErrNoSuchKey()
+	}
+	stream, ok := value.(*streams.Stream)
+	if !ok {
+		return ErrWrongType()
+	}
+	lastID, err := streams.ParseKey(cmds[2], streams.KeyStart)
+	if err != nil {
+		return &UserError{"ERR", "Invalid stream ID specified as stream command argument"}
+	}
+
+	// We don't keep track of how many entries were ever added or deleted, so those are
+	// only validated
+	for i := 3; i < len(cmds); i += 2 {
+		switch strings.ToLower(cmds[i]) {
+		case "entriesadded":
+			if added, err := strconv.Atoi(cmds[i+1]); err != nil || added < stream.Len() {
+				return &UserError{"ERR", "The entries_added specified in XSETID is smaller than the target stream length"}
 			}
-			return nil
+		case "maxdeletedid":
+			maxDeleted, err := streams.ParseKey(cmds[i+1], streams.KeyStart)
+			if err != nil {
+				return &UserError{"ERR", "Invalid stream ID specified as stream command argument"}
+			}
+			if lastID.LesserThan(maxDeleted) {
+				return &UserError{"ERR", "The ID specified in XSETID is smaller than the provided max_deleted_entry_id"}
+			}
+		default:
+			return ErrSyntax()
 		}
 	}
+
+	var setErr error
+	s.db.modify(cmds[1], func() { setErr = stream.SetLastID(lastID) })
+	if setErr != nil {
+		return &UserError{"ERR", "The ID specified in XSETID is smaller than the target stream top item"}
+	}
+	s.conn.Write(resp3.OK)
+	return nil
+}
+
+func (s *Session) doTYPE(cmds []string) *UserError {
+	if len(cmds) != 2 {
+		return &UserError{"ERR", "wrong number of arguments for TYPE command"}
+	}
+	value, _, ok := s.db.peek(cmds[1])
+	if ok {
+		s.conn.Write([]byte("+" + typeName(value) + "\r\n"))
+		return nil
+	}
 	s.conn.Write([]byte("+none\r\n"))
 	return nil
 }
 
+// EXISTS key [key ...]
+//
+// A key given more than once is counted as many times, like in Redis.
+func (s *Session) doEXISTS(cmds []string) *UserError {
+	if len(cmds) < 2 {
+		return &UserError{"ERR", "wrong number of arguments for EXISTS command"}
+	}
+	count := 0
+	for _, key := range cmds[1:] {
+		if _, _, ok := s.db.peek(key); ok {
+			count++
+		}
+	}
+	s.writeInt(int64(count))
+	return nil
+}
+
+// DEL key [key ...]
+func (s *Session) doDEL(cmds []string) *UserError {
+	return s.deleteKeys(cmds, s.server.LazyFreeLazyUserDel.Load())
+}
+
+// UNLINK key [key ...]
+func (s *Session) doUNLINK(cmds []string) *UserError {
+	return s.deleteKeys(cmds, true)
+}
+
+// Delete the keys of DEL or UNLINK, freeing their values in the background if lazy.
+func (s *Session) deleteKeys(cmds []string, lazy bool) *UserError {
+	if len(cmds) < 2 {
+		return &UserError{"ERR", "wrong number of arguments for " + strings.ToUpper(cmds[0]) + " command"}
+	}
+	unlock := s.db.locks.lockKeys(cmds[1:], true)
+	count := 0
+	for _, key := range cmds[1:] {
+		if value, _, ok := s.db.peekLocked(key); ok {
+			s.db.delete(key)
+			s.server.freeValue(value, lazy)
+			count++
+		}
+	}
+	unlock()
+	s.writeInt(int64(count))
+	return nil
+}
+
+// TTL key
+func (s *Session) doTTL(cmds []string) *UserError {
+	return s.replyTTL(cmds, time.Second)
+}
+
+// PTTL key
+func (s *Session) doPTTL(cmds []string) *UserError {
+	return s.replyTTL(cmds, time.Millisecond)
+}
+
+// EXPIREAT key unix-time-seconds [NX | XX | GT | LT], and PEXPIREAT with milliseconds
+func (s *Session) doEXPIREAT(cmds []string) *UserError {
+	if len(cmds) < 3 {
+		return &UserError{"ERR", "wrong number of arguments for " + strings.ToUpper(cmds[0]) + " command"}
+	}
+	unit := time.Second
+	if strings.ToLower(cmds[0]) == "pexpireat" {
+		unit = time.Millisecond
+	}
+	n, err := strconv.ParseInt(cmds[2], 10, 64)
+	if err != nil {
+		return &UserError{"ERR", "value is not an integer or out of range"}
+	}
+	var nx, xx, gt, lt bool
+	for _, option := range cmds[3:] {
+		switch strings.ToLower(option) {
+		case "nx":
+			nx = true
+		case "xx":
+			xx = true
+		case "gt":
+			gt = true
+		case "lt":
+			lt = true
+		default:
+			return &UserError{"ERR", "Unsupported option " + option}
+		}
+	}
+	if nx && (xx || gt || lt) {
+		return &UserError{"ERR", "NX and XX, GT or LT options at the same time are not compatible"}
+	}
+	if gt && lt {
+		return &UserError{"ERR", "GT and LT options at the same time are not compatible"}
+	}
+	expiry, ok := expiryMs(n, unit, true, 0)
+	if !ok {
+		return &UserError{"ERR", "invalid expire time in '" + strings.ToLower(cmds[0]) + "' command"}
+	}
+
+	// Under the key's lock, so that the expiry is for the value it was checked against
+	key := cmds[1]
+	lock := s.db.locks.lock(key)
+	_, current, exists := s.db.loadLocked(key)
+	// A key without an expiry counts as never expiring for GT and LT
+	skip := !exists || nx && current != 0 || xx && current == 0 ||
+		gt && (current == 0 || expiry <= current) || lt && current != 0 && expiry >= current
+	if skip {
+		lock.Unlock()
+		s.conn.Write(resp3.Zero)
+		return nil
+	}
+	if expiry <= s.db.nowMs() {
+		s.db.delete(key)
+		s.propagateAs([]string{"DEL", key})
+	} else {
+		s.db.storeExpiry(key, expiry)
+	}
+	lock.Unlock()
+	s.conn.Write(resp3.One)
+	return nil
+}
+
+// Reply with the time key has left to live, in units. -2 if it doesn't exist, -1 if it
+// doesn't expire.
+func (s *Session) replyTTL(cmds []string, unit time.Duration) *UserError {
+	if len(cmds) != 2 {
+		return &UserError{"ERR", "wrong number of arguments for " + strings.ToUpper(cmds[0]) + " command"}
+	}
+	ttl := int64(-2)
+	if _, expiry, ok := s.db.peek(cmds[1]); ok {
+		ttl = -1
+		if expiry != 0 {
+			unitMs := unit.Milliseconds()
+			ttl = (expiry - s.db.nowMs() + unitMs/2) / unitMs // rounded, like Redis does
+		}
+	}
+	s.writeInt(ttl)
+	return nil
+}
+
+// KEYS pattern [TYPE type]
+//
+// TYPE isn't in Redis' KEYS, only in SCAN, but it's just as handy here.
 func (s *Session) doKEYS(cmds []string) *UserError {
-	// only supports * right now
+	if len(cmds) != 2 && len(cmds) != 4 {
+		return &UserError{"ERR", "wrong number of arguments for KEYS command"}
+	}
+	pattern := cmds[1]
+	wantType := ""
+	if len(cmds) == 4 {
+		if strings.ToLower(cmds[2]) != "type" {
+			return ErrSyntax()
+		}
+		wantType = strings.ToLower(cmds[3])
+	}
+	matches := func(value any) bool {
+		return wantType == "" || typeName(value) == wantType
+	}
+
 	keys := make([]string, 0)
-	s.valueDB.Range(func(key any, value any) bool {
-		keys = append(keys, key.(string))
-		return true
+	if isLiteralPattern(pattern) {
+		if value, _, ok := s.db.peek(pattern); ok && matches(value) {
+			keys = append(keys, pattern)
+		}
+		s.conn.Write(makeRESPArr(keys))
+		return nil
+	}
+
+	// Keys that exist throughout are visited exactly once. Expired ones are skipped.
+	s.db.engine.Scan(func(key string, _ any) bool {
+		if !globMatch(pattern, key) {
+			return !s.timedOut()
+		}
+		if value, _, ok := s.db.peek(key); ok && matches(value) {
+			keys = append(keys, key)
+		}
+		return !s.timedOut()
 	})
+	if s.timedOut() {
+		return errCommandTimeout
+	}
 	s.conn.Write(makeRESPArr(keys))
 	return nil
 }
 
+// RANDOMKEY
+func (s *Session) doRANDOMKEY(cmds []string) *UserError {
+	if len(cmds) != 1 {
+		return &UserError{"ERR", "wrong number of arguments for RANDOMKEY command"}
+	}
+	// A key that turns out to have expired is deleted by looking at it, so this ends once
+	// the database is empty, at the latest
+	for {
+		keys := s.db.keys.sample(1)
+		if len(keys) == 0 {
+			s.writeNull()
+			return nil
+		}
+		if _, _, ok := s.db.peek(keys[0]); ok {
+			encoder := s.encoder()
+			encoder.WriteBulkStr(keys[0])
+			s.conn.Write(encoder.Buf)
+			return nil
+		}
+	}
+}
+
+// DBSIZE
+func (s *Session) doDBSIZE(cmds []string) *UserError {
+	if len(cmds) != 1 {
+		return &UserError{"ERR", "wrong number of arguments for DBSIZE command"}
+	}
+	keys, _, _ := s.db.size()
+	s.writeInt(int64(keys))
+	return nil
+}
+
+var configHelp = []string{
+	"GET <parameter>",
+	"    Return the value of the parameter, e.g. dir, dbfilename, loglevel or protected-mode.",
+	"SET loglevel <level>",
+	"    Set the log level to debug, info, warn or error.",
+	"SET logfile <filename>",
+	"    Log to the file, reopening it if it is the current one, or to stderr if empty.",
+	"SET protected-mode yes|no",
+	"    Refuse clients from other hosts, or not, while listening on every interface.",
+	"SET lazyfree-lazy-expire|lazyfree-lazy-user-del yes|no",
+	"    Free the values of expired keys, or of keys deleted with DEL, in the background or not.",
+	"SET lfu-log-factor|lfu-decay-time <n>",
+	"    Set how slowly access frequencies grow, or after how many minutes they decay.",
+	"SET rdb-incremental yes|no",
+	"    Write only the keys changed since the last save when a save point is reached, or not.",
+	"SET rdb-incremental-segments <n>",
+	"    Set how many checkpoints to write before writing the RDB file in full again.",
+	"SET tiered-threshold|tiered-hot-memory <bytes>",
+	"    Set how long strings must be to be spilled to disk, or how much of them to keep in memory.",
+	"RESETSTAT",
+	"    Reset the statistics reported by INFO stats and INFO commandstats.",
+}
+
+// CONFIG GET parameter | CONFIG SET parameter value | CONFIG RESETSTAT
 func (s *Session) doCONFIG(cmds []string) *UserError {
-	// only supports "config get" right now
-	if cmds[2] == "dir" {
-		s.conn.Write(makeRESPArr([]string{"dir", s.server.RdbDir}))
-	} else if cmds[2] == "dbfilename" {
-		s.conn.Write(makeRESPArr([]string{"dbfilename", s.server.RdbFilename}))
+	if len(cmds) == 2 && strings.ToLower(cmds[1]) == "resetstat" {
+		s.server.resetStats()
+		s.conn.Write(resp3.OK)
+		return nil
+	}
+	if len(cmds) < 3 {
+		return &UserError{"ERR", "wrong number of arguments for CONFIG command"}
+	}
+	switch strings.ToLower(cmds[1]) {
+	case "get":
+		switch cmds[2] {
+		case "dir":
+			s.conn.Write(makeRESPArr([]string{"dir", s.server.RdbDir}))
+		case "dbfilename":
+			s.conn.Write(makeRESPArr([]string{"dbfilename", s.server.RdbFilename}))
+		case "loglevel":
+			s.conn.Write(makeRESPArr([]string{"loglevel", strings.ToLower(s.server.LogLevel.Level().String())}))
+		case "databases":
+			s.conn.Write(makeRESPArr([]string{"databases", strconv.Itoa(s.server.dbCount())}))
+		case "storage-engine":
+			s.conn.Write(makeRESPArr([]string{"storage-engine", s.server.StorageEngine}))
+		case "logfile":
+			s.conn.Write(makeRESPArr([]string{"logfile", s.server.logOutput.name()}))
+		case "protected-mode":
+			s.conn.Write(makeRESPArr([]string{"protected-mode", yesNo(s.server.ProtectedMode.Load())}))
+		case "lazyfree-lazy-expire":
+			s.conn.Write(makeRESPArr([]string{"lazyfree-lazy-expire", yesNo(s.server.LazyFreeLazyExpire.Load())}))
+		case "lazyfree-lazy-user-del":
+			s.conn.Write(makeRESPArr([]string{"lazyfree-lazy-user-del", yesNo(s.server.LazyFreeLazyUserDel.Load())}))
+		case "lfu-log-factor":
+			s.conn.Write(makeRESPArr([]string{"lfu-log-factor", strconv.FormatInt(s.server.LFU.LogFactor.Load(), 10)}))
+		case "lfu-decay-time":
+			s.conn.Write(makeRESPArr([]string{"lfu-decay-time", strconv.FormatInt(s.server.LFU.DecayTime.Load(), 10)}))
+		case "rdb-incremental":
+			s.conn.Write(makeRESPArr([]string{"rdb-incremental", yesNo(s.server.RdbIncremental.Load())}))
+		case "rdb-incremental-segments":
+			s.conn.Write(makeRESPArr([]string{"rdb-incremental-segments", strconv.FormatInt(s.server.RdbIncrementalSegments.Load(), 10)}))
+		case "tiered-threshold":
+			s.conn.Write(makeRESPArr([]string{"tiered-threshold", strconv.FormatInt(s.server.Tiered.Threshold.Load(), 10)}))
+		case "tiered-hot-memory":
+			s.conn.Write(makeRESPArr([]string{"tiered-hot-memory", strconv.FormatInt(s.server.Tiered.HotMemory.Load(), 10)}))
+		default:
+			s.conn.Write(makeRESPArr([]string{}))
+		}
+	case "set":
+		if len(cmds) != 4 {
+			return &UserError{"ERR", "wrong number of arguments for CONFIG SET command"}
+		}
+		ok, uerr := s.server.setConfig(strings.ToLower(cmds[2]), cmds[3])
+		if !ok {
+			return &UserError{"ERR", "only CONFIG SET loglevel, logfile, protected-mode, lazyfree-lazy-expire, lazyfree-lazy-user-del, lfu-log-factor, lfu-decay-time, rdb-incremental, rdb-incremental-segments, tiered-threshold and tiered-hot-memory are supported"}
+		}
+		if uerr != nil {
+			return uerr
+		}
+		s.conn.Write(resp3.OK)
+	default:
+		return errUnknownSubcommand(cmds)
 	}
 	return nil
 }
 
+// Return the string at key. ok is false if the key doesn't exist.
+func (db RedisDB) getString(key string) (val string, ok bool, uerr *UserError) {
+	value, _, ok := db.loadRead(key)
+	if !ok {
+		return "", false, nil
+	}
+	val, ok = stringValue(value) // while the map implementation can, and does, hold arbitrary types, get GET command is only for string
+	if !ok {
+		return "", false, ErrWrongType()
+	}
+	return val, true, nil
+}
+
 func (s *Session) doGET(cmds []string) *UserError {
-	value, ok := s.valueDB.Load(cmds[1])
-	if ok {
-		expiry, ok := s.expiryDB.Load(cmds[1])
-		if !ok || expiry.(time.Time).After(time.Now()) {
-			strVal, ok := value.(string) // while the map implementation can, and does, hold arbitrary types, get GET command is only for string
-			if !ok {
-				// s.conn.Write([]byte(
-				// 	"-ERR WRONGTYPE Operation against a key holding the wrong kind of value\r\n",
-				// ))
-				// return
-				return &UserError{"WRONGTYPE Operation against a key holding the wrong kind of value"}
-			}
+	if len(cmds) != 2 {
+		return &UserError{"ERR", "wrong number of arguments for GET command"}
+	}
+	strVal, ok, uerr := s.db.getString(cmds[1])
+	if uerr != nil {
+		return uerr
+	}
+	if !ok {
+		s.writeNull() // key not found
+		return nil
+	}
 
-			encoder := resp3.Encoder{}
-			encoder.WriteBulkStr(strVal)
-			s.conn.Write(encoder.Buf)
-			return nil
-		}
+	encoder := resp3.Encoder{}
+	encoder.WriteBulkStr(strVal)
+	s.conn.Write(encoder.Buf)
+	return nil
+}
+
+// GETRANGE key start end, also known as SUBSTR. Negative offsets count back from the
+// end, and the range is clamped to the string.
+func (s *Session) doGETRANGE(cmds []string) *UserError {
+	if len(cmds) != 4 {
+		return &UserError{"ERR", "wrong number of arguments for " + strings.ToUpper(cmds[0]) + " command"}
+	}
+	start, err1 := strconv.Atoi(cmds[2])
+	end, err2 := strconv.Atoi(cmds[3])
+	if err1 != nil || err2 != nil {
+		return ErrNotInteger()
+	}
+	str, _, uerr := s.db.getString(cmds[1])
+	if uerr != nil {
+		return uerr
 	}
 
-	s.conn.Write([]byte("$-1\r\n")) // key not found
+	encoder := resp3.Encoder{}
+	if start < 0 && end < 0 && start > end {
+		encoder.WriteBulkStr("")
+		s.conn.Write(encoder.Buf)
+		return nil
+	}
+	if start < 0 {
+		start = max(len(str)+start, 0)
+	}
+	if end < 0 {
+		end = max(len(str)+end, 0)
+	}
+	end = min(end, len(str)-1)
+	if start > end || len(str) == 0 {
+		encoder.WriteBulkStr("")
+	} else {
+		encoder.WriteBulkStr(str[start : end+1])
+	}
+	s.conn.Write(encoder.Buf)
 	return nil
 }
 
@@ -270,34 +1044,231 @@ func (s *Session) doSET(cmds []string) *UserError {
 	if len(cmds) < 3 {
 		// s.conn.Write([]byte("-ERR Wrong number of arguments for SET command\r\n"))
 		// return
-		return &UserError{"wrong number of arguments for SET command"}
+		return &UserError{"ERR", "wrong number of arguments for SET command"}
 	}
 
-	// There's a race condition here because the expiry map and
-	// the value map are not synchronized in any way. A reader could read
-	// a new value with an old expiry value and vice versa ¯\_(ツ)_/¯
-	if len(cmds) > 3 && strings.ToLower(cmds[3]) == "px" {
-		if len(cmds) < 4 {
-			// s.conn.Write([]byte("-ERR PX argument found without expiry\r\n"))
-			// return
-			return &UserError{"PX argument found without expiry"}
+	// A plain SET discards any existing TTL
+	var expiry int64
+	for args := newArgScanner(cmds, 3); !args.done(); {
+		var unit time.Duration
+		var absolute bool
+		switch args.acceptToken("ex", "px", "exat", "pxat") {
+		case "ex":
+			unit = time.Second
+		case "px":
+			unit = time.Millisecond
+		case "exat":
+			unit, absolute = time.Second, true
+		case "pxat":
+			unit, absolute = time.Millisecond, true
+		default:
+			return ErrSyntax()
 		}
-		expiryInMs, err := strconv.Atoi(cmds[4])
-		if err != nil {
-			// s.conn.Write([]byte("-ERR Cannot parse given expiry\r\n"))
-			// return
-			return &UserError{"cannot parse given expiry"}
+		if expiry != 0 {
+			return ErrSyntax()
+		}
+		n, uerr := args.readInt()
+		if uerr != nil {
+			return uerr
+		}
+		var ok bool
+		if expiry, ok = expiryMs(n, unit, absolute, s.db.nowMs()); !ok || n <= 0 {
+			return &UserError{"ERR", "invalid expire time in '" + strings.ToLower(cmds[0]) + "' command"}
 		}
-		expiryTime := time.Now().Add(time.Duration(expiryInMs * 1000000)) // ns -> ms
-		s.expiryDB.Store(cmds[1], expiryTime)
 	}
 
-	s.valueDB.Store(cmds[1], cmds[2])
-	s.conn.Write([]byte("+OK\r\n"))
+	lock := s.db.locks.lock(cmds[1])
+	s.db.set(cmds[1], newStringValue(cmds[2]), expiry)
+	lock.Unlock()
+	if expiry != 0 {
+		// Replicas expire the key at the same time as we do, however late they get to it
+		s.propagateAs([]string{"SET", cmds[1], cmds[2], "PXAT", strconv.FormatInt(expiry, 10)})
+	}
+	s.conn.Write(resp3.OK)
+	return nil
+}
+
+// SETEX key seconds value, and PSETEX key milliseconds value: what SET key value EX or
+// PX was before it had options.
+func (s *Session) doSETEX(cmds []string) *UserError {
+	if len(cmds) != 4 {
+		return &UserError{"ERR", "wrong number of arguments for " + strings.ToUpper(cmds[0]) + " command"}
+	}
+	option := "EX"
+	if strings.ToLower(cmds[0]) == "psetex" {
+		option = "PX"
+	}
+	return s.doSET([]string{cmds[0], cmds[1], cmds[3], option, cmds[2]})
+}
+
+// Convert an expire time given in unit (time.Second or time.Millisecond) into a Unix
+// time in milliseconds, counting from nowMs unless it is absolute already. Reports
+// false if that doesn't fit.
+func expiryMs(n int64, unit time.Duration, absolute bool, nowMs int64) (int64, bool) {
+	if unit == time.Second {
+		if n > math.MaxInt64/1000 || n < math.MinInt64/1000 {
+			return 0, false
+		}
+		n *= 1000
+	}
+	if !absolute {
+		if n > math.MaxInt64-nowMs {
+			return 0, false
+		}
+		n += nowMs
+	}
+	return n, true
+}
+
+func (s *Session) doMSET(cmds []string) *UserError {
+	if len(cmds) < 3 || len(cmds)%2 != 1 {
+		return &UserError{"ERR", "wrong number of arguments for MSET command"}
+	}
+
+	keys := make([]string, 0, len(cmds)/2)
+	for i := 1; i < len(cmds); i += 2 {
+		keys = append(keys, cmds[i])
+	}
+	unlock := s.db.locks.lockKeys(keys, true)
+	for i := 1; i < len(cmds); i += 2 {
+		s.db.set(cmds[i], newStringValue(cmds[i+1]), 0)
+	}
+	unlock()
+	s.conn.Write(resp3.OK)
+	return nil
+}
+
+func (s *Session) doMGET(cmds []string) *UserError {
+	if len(cmds) < 2 {
+		return &UserError{"ERR", "wrong number of arguments for MGET command"}
+	}
+
+	unlock := s.db.locks.lockKeys(cmds[1:], false)
+	encoder := s.encoder()
+	encoder.WriteArrHeader(len(cmds) - 1)
+	for _, key := range cmds[1:] {
+		value, _, ok := s.db.loadLocked(key)
+		s.db.countRead(ok)
+		strVal, isStr := stringValue(value)
+		if !ok || !isStr {
+			encoder.WriteNull() // non-strings are reported as missing
+			continue
+		}
+		encoder.WriteBulkStr(strVal)
+	}
+	unlock() // before writing the reply, which may block
+	s.conn.Write(encoder.Buf)
+	return nil
+}
+
+// GETSET key value
+func (s *Session) doGETSET(cmds []string) *UserError {
+	if len(cmds) != 3 {
+		return &UserError{"ERR", "wrong number of arguments for GETSET command"}
+	}
+	var old string
+	var existed bool
+	uerr := s.db.compute(cmds[1], false, func(value any, exists bool) (any, *UserError) {
+		if exists {
+			var ok bool
+			if old, ok = stringValue(value); !ok {
+				return nil, ErrWrongType()
+			}
+		}
+		existed = exists
+		return newStringValue(cmds[2]), nil
+	})
+	if uerr != nil {
+		return uerr
+	}
+	if !existed {
+		s.writeNull()
+		return nil
+	}
+	encoder := s.encoder()
+	encoder.WriteBulkStr(old)
+	s.conn.Write(encoder.Buf)
+	return nil
+}
+
+// INCR key | DECR key | INCRBY key increment | DECRBY key decrement
+func (s *Session) doINCR(cmds []string) *UserError {
+	name := strings.ToLower(cmds[0])
+	by := int64(1)
+	if name == "incrby" || name == "decrby" {
+		if len(cmds) != 3 {
+			return &UserError{"ERR", "wrong number of arguments for " + strings.ToUpper(name) + " command"}
+		}
+		var err error
+		if by, err = strconv.ParseInt(cmds[2], 10, 64); err != nil {
+			return &UserError{"ERR", "value is not an integer or out of range"}
+		}
+	} else if len(cmds) != 2 {
+		return &UserError{"ERR", "wrong number of arguments for " + strings.ToUpper(name) + " command"}
+	}
+	if name == "decr" || name == "decrby" {
+		if by == math.MinInt64 {
+			return &UserError{"ERR", "decrement would overflow"}
+		}
+		by = -by
+	}
+
+	var result int64
+	uerr := s.db.compute(cmds[1], true, func(value any, exists bool) (any, *UserError) {
+		var current int64
+		if exists {
+			str, ok := stringValue(value)
+			if !ok {
+				return nil, ErrWrongType()
+			}
+			var err error
+			current, err = strconv.ParseInt(str, 10, 64)
+			if err != nil || !isCanonicalInt(str) {
+				return nil, &UserError{"ERR", "value is not an integer or out of range"}
+			}
+		}
+		if by > 0 && current > math.MaxInt64-by || by < 0 && current < math.MinInt64-by {
+			return nil, &UserError{"ERR", "increment or decrement would overflow"}
+		}
+		result = current + by
+		return newStringValue(strconv.FormatInt(result, 10)), nil
+	})
+	if uerr != nil {
+		return uerr
+	}
+	s.writeInt(result)
+	return nil
+}
+
+// APPEND key value
+func (s *Session) doAPPEND(cmds []string) *UserError {
+	if len(cmds) != 3 {
+		return &UserError{"ERR", "wrong number of arguments for APPEND command"}
+	}
+	var length int
+	uerr := s.db.compute(cmds[1], true, func(value any, exists bool) (any, *UserError) {
+		var str string
+		if exists {
+			var ok bool
+			if str, ok = stringValue(value); !ok {
+				return nil, ErrWrongType()
+			}
+		}
+		str += cmds[2]
+		length = len(str)
+		return newStringValue(str), nil
+	})
+	if uerr != nil {
+		return uerr
+	}
+	s.writeInt(int64(length))
 	return nil
 }
 
 func (s *Session) doECHO(cmds []string) *UserError {
+	if len(cmds) != 2 {
+		return &UserError{"ERR", "wrong number of arguments for ECHO command"}
+	}
 	payload := cmds[1]
 	payloadLen := len(payload)
 	s.conn.Write([]byte(fmt.Sprintf(
@@ -307,248 +1278,353 @@ func (s *Session) doECHO(cmds []string) *UserError {
 }
 
 func (s *Session) doPING(cmds []string) *UserError {
-	s.conn.Write([]byte("+PONG\r\n"))
+	s.conn.Write(resp3.Pong)
 	return nil
 }
 
-func (s *Session) doXRANGE(cmds []string) *UserError {
-	if len(cmds) < 4 {
-		// s.conn.Write([]byte("-ERR Wrong number of arguments for XRANGE command\r\n"))
-		// return
-		return &UserError{"wrong number of arguments for XRANGE command"}
-	}
-
-	value, ok := s.valueDB.Load(cmds[1])
+// Return the entries of the stream at key from start up to and including end, which may
+// be "-" and "+", or IDs prefixed with "(" to leave them out, last to first if reverse is
+// true. They're looked up as they're iterated over, from a snapshot of the stream, so
+// that stopping early, e.g. after a COUNT, doesn't walk the rest of the range. A missing
+// stream has no entries.
+func (db RedisDB) xrange(key string, start string, end string, reverse bool) (iter.Seq[streams.Entry], *UserError) {
+	value, _, ok := db.loadRead(key)
 	if !ok {
-		s.conn.Write(EmptyRespArr)
-		return nil
+		return func(func(streams.Entry) bool) {}, nil
 	}
 	stream, ok := value.(*streams.Stream)
 	if !ok {
-		// 	s.conn.Write([]byte(
-		// 		"-ERR WRONGTYPE Operation against a key holding the wrong kind of value",
-		// 	))
-		// 	return
-		return &UserError{"WRONTYPE operation against a key holding the wrong kind of value"}
+		return nil, ErrWrongType()
 	}
 
-	fromKey, err := streams.NewKey(cmds[2], stream)
-	if err != nil {
-		// s.conn.Write([]byte("-ERR Bad \"from\" key"))
-		// return
-		return &UserError{"bad \"from\" key"}
+	fromKey, uerr := parseRangeBound(start, true)
+	if uerr != nil {
+		return nil, uerr
 	}
-	toKey, err := streams.NewKey(cmds[3], stream)
-	if err != nil {
-		// s.conn.Write([]byte("-ERR Bad \"to\" key"))
-		// return
-		return &UserError{"bad \"to\" key"}
+	toKey, uerr := parseRangeBound(end, false)
+	if uerr != nil {
+		return nil, uerr
 	}
+	snapshot := stream.Snapshot()
+	return snapshot.Entries(fromKey, toKey, reverse), nil
+}
 
-	encoder := &resp3.Encoder{}
-	err = entriesToRESP(encoder, stream.Range(fromKey, toKey))
+// Parse the start or end of an XRANGE. An ID without a sequence number, e.g. "1", means
+// all of the entries with that timestamp: "1-0" as a start, or the last possible one as
+// an end. An exclusive bound, e.g. "(1-1", becomes the next ID up for a start, or down
+// for an end.
+func parseRangeBound(bound string, start bool) (streams.Key, *UserError) {
+	id, exclusive := strings.CutPrefix(bound, "(")
+	mode := streams.KeyEnd
+	if start {
+		mode = streams.KeyStart
+	}
+	key, err := streams.ParseKey(id, mode)
 	if err != nil {
-		s.conn.Write([]byte("-ERR Something went wrong"))
+		if start {
+			return streams.Key{}, &UserError{"ERR", "bad \"from\" key"}
+		}
+		return streams.Key{}, &UserError{"ERR", "bad \"to\" key"}
 	}
-	s.conn.Write(encoder.Buf)
-	return nil
-}
-
-func (s *Session) doXREAD(cmds []string) *UserError {
-	if len(cmds) < 4 {
-		// s.conn.Write([]byte("-ERR Wrong number of arguments for XREAD command\r\n"))
-		// return
-		return &UserError{"wrong number of arguments for XREAD command"}
+	if !exclusive {
+		return key, nil
 	}
 
-	// Parse commands, find stream name(s) and their respective keys.
-	var streamNames []string
-	var keys []string
-	var i int
-	var blockArg string
-	for i = 0; i < len(cmds)-1; i++ {
-		cmd := strings.ToLower(cmds[i])
-		if cmd == "block" {
-			blockArg = cmds[i+1]
-			i++
-		} else if cmd == "streams" {
-			streamsStartIdx := i + 1
-			remaining := len(cmds) - streamsStartIdx
-			streamsEndIdx := streamsStartIdx + remaining/2
-			streamNames = cmds[i+1 : streamsEndIdx]
-			keys = cmds[streamsEndIdx:]
-			break
+	// There's nothing past the highest ID, nor before the lowest one
+	var overflow bool
+	if start {
+		key, overflow = key.Next()
+	} else {
+		key, overflow = key.Prev()
+	}
+	if overflow || id == "-" || id == "+" {
+		if start {
+			return streams.Key{}, &UserError{"ERR", "invalid start ID for the interval"}
 		}
+		return streams.Key{}, &UserError{"ERR", "invalid end ID for the interval"}
 	}
+	return key, nil
+}
 
-	// // Collect stream pointers & correct "from" keys
-	results := make(map[*streams.Stream][]streams.Entry, len(streamNames))
-	// streamObjs := make([]*streams.Stream, len(streamNames))
-	// keyObjs := make([]streams.Key, len(keys))
-	emptyResult := true
-	// collectCh := make(chan streams.NewEntryMsg)
-	for i, streamName := range streamNames {
-		value, ok := s.valueDB.Load(streamName)
-		if !ok {
-			return &UserError{"stream does not exist: " + streamName}
+// XRANGE key start end [COUNT count], and XREVRANGE key end start [COUNT count] for the
+// same entries, last to first.
+func (s *Session) doXRANGE(cmds []string) *UserError {
+	if len(cmds) != 4 && len(cmds) != 6 {
+		// s.conn.Write([]byte("-ERR Wrong number of arguments for XRANGE command\r\n"))
+		// return
+		return &UserError{"ERR", "wrong number of arguments for " + strings.ToUpper(cmds[0]) + " command"}
+	}
+	count := -1
+	if args := newArgScanner(cmds, 4); !args.done() {
+		if uerr := args.expectToken("count"); uerr != nil {
+			return uerr
 		}
-		stream, ok := value.(*streams.Stream)
-		if !ok {
-			return &UserError{"WRONGTYPE operation against a key holding the wrong kind of value"}
+		n, uerr := args.readInt()
+		if uerr != nil {
+			return uerr
 		}
+		count = int(max(n, 0))
+	}
 
-		var fromKey streams.Key
-		if keys[i] == "$" {
-			fromKey = stream.LastEntry.Key
-		} else {
-			var err error
-			fromKey, err = streams.NewKey(keys[i], stream)
-			if err != nil {
-				return &UserError{"bad key: " + keys[i]}
-			}
+	reverse := strings.ToLower(cmds[0]) == "xrevrange"
+	start, end := cmds[2], cmds[3]
+	if reverse {
+		start, end = end, start
+	}
+	found, uerr := s.db.xrange(cmds[1], start, end, reverse)
+	if uerr != nil {
+		return uerr
+	}
+	// The snapshot doesn't change, so go over the range twice rather than hold on to it:
+	// once to count the entries for the header, and check that they can be written, then
+	// again to write them a part at a time, so that a huge range is never all in memory.
+	n := 0
+	for entry := range found {
+		if n == count {
+			break
 		}
-
-		if stream.LastEntry.Key.GreaterThan(fromKey) {
-			emptyResult = false
-			fromKey, overflow := fromKey.Next()
-			if overflow {
-				continue
-			}
-			results[stream] = stream.Range(fromKey, streams.MaxKey)
-		} else {
-			results[stream] = []streams.Entry{}
+		if _, ok := entry.Val.(StreamFields); !ok {
+			return &UserError{"ERR", "something went wrong"}
 		}
-		// fromKey, overflow := fromKey.Next()
-		// if overflow {
-		// 	continue
-		// 	// this causes the largest valid key to block forever with BLOCK = 0.
-		// 	// Redis does the same, and I think it makes sense. The supplied key is valid,
-		// 	// it will just never have a valid resultset.
-		// }
-		// results[i] = stream.Range(fromKey, streams.MaxKey)
+		n++
 	}
-
-	// Check & handle the BLOCK subcommand
-	if emptyResult && len(blockArg) > 0 {
-		blockMs, err := strconv.Atoi(blockArg)
-		if err != nil {
-			return &UserError{"syntax error: invalid BLOCK value"}
-		} else if blockMs < 0 {
-			return &UserError{"BLOCK must be a positive value"}
-		}
-
-		//todo for each stream i need to subscribe
-		// and then we put the entry in a slice in result[i]
-		ch := make(chan streams.NewEntryMsg)
-		for stream, _ := range results {
-			stream.Subscribe(ch, stream)
+	if s.timedOut() {
+		return errCommandTimeout
+	}
+	encoder := s.streamEncoder()
+	encoder.WriteArrHeader(n)
+	written := 0
+	for entry := range found {
+		if written == n {
+			break
 		}
-		var entryMsg streams.NewEntryMsg
-		if blockMs == 0 {
-			entryMsg = <-ch
-		} else {
-			select {
-			case entryMsg = <-ch:
-			case <-time.After(time.Duration(blockMs) * time.Millisecond):
-				s.conn.Write([]byte("$-1\r\n"))
+		entryToRESP(encoder, entry)
+		if written++; written%xrangeChunkEntries == 0 {
+			encoder.Flush()
+			if !s.flushPart() {
 				return nil
 			}
 		}
-		results[entryMsg.SubscriptionID.(*streams.Stream)] = []streams.Entry{entryMsg.Entry}
 	}
+	encoder.Flush()
+	return nil
+}
 
-	// time.Sleep(time.Duration(blockMs) * time.Millisecond)
-
-	// TODO
-	// just doing sleep is not strictly correct. Only sleep if one of the resultsets
-	// is empty and block is set. Then, wait indefinetly if block == 0 otherwait wait for block ms
-	//
+// How many entries of its reply XRANGE writes before waiting for the client to read them.
+const xrangeChunkEntries = 1000
 
-	// Encode to RESP
-	respEncoder := &resp3.Encoder{}
-	respEncoder.WriteArrHeader(len(results))
-	for i, streamName := range streamNames {
-		if len(results[i]) == 0 {
-			continue
-		}
-		respEncoder.WriteArrHeader(2)
-		respEncoder.WriteBulkStr(streamName)
-		err := entriesToRESP(respEncoder, results[i])
-		if err != nil {
-			return &UserError{"something went wrong"}
-		}
+// XLEN key
+func (s *Session) doXLEN(cmds []string) *UserError {
+	if len(cmds) != 2 {
+		return &UserError{"ERR", "wrong number of arguments for XLEN command"}
+	}
+	stream, ok, uerr := readTyped[*streams.Stream](s, cmds[1])
+	if uerr != nil {
+		return uerr
 	}
 
+	length := 0
+	if ok {
+		length = stream.Len()
+	}
+	s.writeInt(int64(length))
 	return nil
 }
 
-func (s *Session) collectXREAD(streamNames []string, keys []string) *UserError {
-	respEncoder := &resp3.Encoder{}
-	respEncoder.WriteArrHeader(len(streamNames))
+var xinfoHelp = []string{
+	"STREAM <key>",
+	"    Show information about the stream.",
+}
 
-	for i, streamName := range streamNames {
-		value, ok := s.valueDB.Load(streamName)
-		if !ok {
-			continue
+// XINFO STREAM key
+func (s *Session) doXINFO(cmds []string) *UserError {
+	if len(cmds) < 2 {
+		return &UserError{"ERR", "wrong number of arguments for XINFO command"}
+	}
+
+	switch strings.ToLower(cmds[1]) {
+	case "stream":
+		if len(cmds) != 3 {
+			return &UserError{"ERR", "wrong number of arguments for XINFO STREAM command"}
+		}
+		stream, ok, uerr := readTyped[*streams.Stream](s, cmds[2])
+		if uerr != nil {
+			return uerr
 		}
-		stream, ok := value.(*streams.Stream)
 		if !ok {
-			// s.conn.Write([]byte(
-			// 	"-ERR WRONGTYPE Operation against a key holding the wrong kind of value",
-			// ))
-			// return true
-			return &UserError{"WRONGTYPE operation against a key holding the wrong kind of value"}
+			return ErrNoSuchKey()
 		}
 
-		var fromKey streams.Key
-		if keys[i] == "$" {
-			fromKey = stream.LastEntry.Key
+		// A snapshot, so that all of the fields agree with each other
+		snapshot := stream.Snapshot()
+		encoder := s.encoder()
+		encoder.WriteMapHeader(5)
+		encoder.WriteBulkStr("length")
+		encoder.WriteInt(snapshot.Len())
+		encoder.WriteBulkStr("last-generated-id")
+		encoder.WriteBulkStr(snapshot.LastEntry.Key.String())
+		encoder.WriteBulkStr("groups")
+		encoder.WriteInt(0)
+		encoder.WriteBulkStr("first-entry")
+		if snapshot.Len() > 0 {
+			entryToRESP(&encoder, snapshot.FirstEntry)
 		} else {
-			var err error
-			fromKey, err = streams.NewKey(keys[i], stream)
+			encoder.WriteNull()
+		}
+		encoder.WriteBulkStr("last-entry")
+		if entry, ok := snapshot.TopEntry(); ok {
+			entryToRESP(&encoder, entry)
+		} else {
+			encoder.WriteNull()
+		}
+		s.conn.Write(encoder.Buf)
+
+	default:
+		return errUnknownSubcommand(cmds)
+	}
+	return nil
+}
+
+// XREAD [COUNT count] [BLOCK milliseconds] STREAMS key [key ...] id [id ...]
+func (s *Session) doXREAD(cmds []string) *UserError {
+	if len(cmds) < 4 {
+		// s.conn.Write([]byte("-ERR Wrong number of arguments for XREAD command\r\n"))
+		// return
+		return &UserError{"ERR", "wrong number of arguments for XREAD command"}
+	}
+
+	// Parse commands, find stream name(s) and their respective keys.
+	var streamNames []string
+	var keys []string
+	count := 0 // 0 means no limit
+	block := -1
+	for args := newArgScanner(cmds, 1); streamNames == nil; {
+		switch args.acceptToken("count", "block", "streams") {
+		case "count":
+			val, uerr := args.readInt()
+			if uerr != nil {
+				return uerr
+			}
+			count = int(max(val, 0))
+		case "block":
+			arg, uerr := args.read()
+			if uerr != nil {
+				return uerr
+			}
+			val, err := strconv.ParseInt(arg, 10, 64)
 			if err != nil {
-				// s.conn.Write([]byte("-ERR Bad key: " + keys[i]))
-				// return true
-				return &UserError{"bad key: " + keys[i]}
+				return &UserError{"ERR", "timeout is not an integer or out of range"}
+			}
+			if val < 0 {
+				return &UserError{"ERR", "timeout is negative"}
 			}
+			block = int(val)
+		case "streams":
+			remaining := len(args.rest())
+			if remaining == 0 || remaining%2 != 0 {
+				return &UserError{"ERR", "Unbalanced 'xread' list of streams: for each stream key an ID or '$' must be specified."}
+			}
+			streamNames, _ = args.readKeyList(remaining / 2)
+			keys = args.rest()
+		default:
+			return ErrSyntax()
 		}
+	}
 
-		respEncoder.WriteArrHeader(2)
-		respEncoder.WriteBulkStr(streamName)
-
-		fromKey, overflow := fromKey.Next()
-		if overflow {
-			respEncoder.Buf = append(respEncoder.Buf, EmptyRespArr...)
-			continue
+	// Resolve the IDs to read after. "$" means whatever is the last ID right now, so
+	// that a blocking read only gets entries added after it started.
+	fromKeys := make([]streams.Key, len(streamNames))
+	var existing []*streams.Stream
+	for i, streamName := range streamNames {
+		stream, ok, uerr := loadTyped[*streams.Stream](s, streamName)
+		if uerr != nil {
+			return uerr
 		}
-		err := entriesToRESP(respEncoder, stream.Range(fromKey, streams.MaxKey))
-		if err != nil {
-			// s.conn.Write([]byte("-ERR something went wrong"))
-			// return true
-			return &UserError{"something went wrong"}
+		if ok {
+			existing = append(existing, stream)
+		}
+		switch {
+		case keys[i] == "$" && ok:
+			fromKeys[i] = stream.MaxID()
+		case keys[i] == "$":
+			fromKeys[i] = streams.MinKey
+		default:
+			var err error
+			fromKeys[i], err = streams.ParseKey(keys[i], streams.KeyStart)
+			if err != nil {
+				return &UserError{"ERR", "Invalid stream ID specified as stream command argument"}
+			}
+		}
+	}
+
+	results, uerr := s.collectXREAD(streamNames, fromKeys, count)
+	if uerr != nil {
+		return uerr
+	}
+	if results == nil && block >= 0 {
+		served := s.block(streamNames, time.Duration(block)*time.Millisecond, func() bool {
+			// A stream that is deleted (or replaced) while we wait ends the wait, with
+			// nothing to show for it
+			if slices.ContainsFunc(existing, (*streams.Stream).Closed) {
+				results, uerr = nil, nil
+				return true
+			}
+			results, uerr = s.collectXREAD(streamNames, fromKeys, count)
+			return results != nil || uerr != nil
+		})
+		if !served {
+			results = nil
+		} else if uerr != nil {
+			return uerr
 		}
 	}
 
-	s.conn.Write(respEncoder.Buf)
+	if results == nil {
+		s.writeNullArr()
+		return nil
+	}
+	encoder := s.streamEncoder()
+	encoder.WriteArrHeader(len(results))
+	for _, result := range results {
+		encoder.WriteArrHeader(2)
+		encoder.WriteBulkStr(result.stream)
+		if err := entriesToRESP(encoder, result.entries); err != nil {
+			return &UserError{"ERR", "something went wrong"}
+		}
+	}
+	encoder.Flush()
 	return nil
 }
 
-func (s *Session) collectBlockingXREAD(ms int, streamNames []string, keys []string) *UserError {
-	// TODO search for every stream, go func() a closure with waitgroup to call WaitForEntry
-	// after above loop, wait for all streams via wg
-	// Then, send Entry from spawned goroutine to this one
-
-	respEncoder := &resp3.Encoder{}
-	respEncoder.WriteArrHeader(len(streamNames))
+// The entries XREAD found in one stream.
+type xreadResult struct {
+	stream  string
+	entries []streams.Entry
+}
 
+// Return the entries after fromKeys in the given streams, leaving out the streams
+// without any, or nil if there are none at all.
+func (s *Session) collectXREAD(streamNames []string, fromKeys []streams.Key, count int) ([]xreadResult, *UserError) {
+	var results []xreadResult
 	for i, streamName := range streamNames {
-		value, ok := s.valueDB.Load(streamName)
-		if !ok {
-			continue
+		stream, ok, uerr := readTyped[*streams.Stream](s, streamName)
+		if uerr != nil {
+			return nil, uerr
 		}
-		stream, ok := value.(*streams.Stream)
-		if !ok {
-			return &UserError{"WRONGTYPE operation against a key holding the wrong kind of value"}
+		var entries []streams.Entry
+		limit := count
+		if limit == 0 {
+			limit = -1 // all of them
+		}
+		fromKey, overflow := fromKeys[i].Next()
+		if ok && !overflow {
+			// With the highest possible ID, there will never be anything to read
+			snapshot := stream.Snapshot()
+			entries = snapshot.RangeN(fromKey, streams.MaxKey, limit)
+		}
+		if len(entries) > 0 {
+			results = append(results, xreadResult{streamName, entries})
 		}
 	}
+	return results, nil
 }
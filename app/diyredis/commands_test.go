@@ -0,0 +1,1126 @@
+package diyredis
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log/slog"
+	"maps"
+	"math/rand/v2"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestIdleTimeout(t *testing.T) {
+	server := MakeServer()
+	server.IdleTimeout = 50 * time.Millisecond
+	client, conn := net.Pipe()
+	defer client.Close()
+	go server.startSession(conn)
+
+	// Activity resets the timer
+	reader := bufio.NewReader(client)
+	for range 3 {
+		time.Sleep(30 * time.Millisecond)
+		client.Write([]byte("*1\r\n$4\r\nPING\r\n"))
+		if reply, _ := reader.ReadString('\n'); reply != "+PONG\r\n" {
+			t.Fatalf("got %q, want +PONG", reply)
+		}
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	client.SetDeadline(time.Now().Add(time.Second))
+	if _, err := client.Write([]byte("*1\r\n$4\r\nPING\r\n")); err == nil {
+		t.Errorf("idle connection was not closed")
+	}
+}
+
+func TestParseCommandLimits(t *testing.T) {
+	limits := ProtoLimits{MaxBulkLen: 10, MaxMultibulkLen: 3}
+	parse := func(input string) ([]string, error) {
+		return ParseCommand(bufio.NewReader(strings.NewReader(input)), limits)
+	}
+
+	cmd, err := parse("*3\r\n$3\r\nSET\r\n$3\r\nfoo\r\n$10\r\n0123456789\r\n")
+	if err != nil || len(cmd) != 3 || cmd[2] != "0123456789" {
+		t.Errorf("got (%q, %v) for a command within limits", cmd, err)
+	}
+
+	var protoErr *ProtocolError
+	for _, input := range []string{
+		"*4\r\n",                                 // too many arguments
+		"*99999999999\r\n",                       // way too many arguments
+		"*-5\r\n",                                // negative
+		"*1\r\n$11\r\n",                          // too large argument
+		"*1\r\n$9999999999\r\n",                  // way too large argument
+		"*1\r\n$-1\r\n",                          // null bulk string
+		"*" + strings.Repeat("1", 5000) + "\r\n", // header never ends
+		"$3\r\nfoo\r\n",                          // not an array
+		"*1\r\n:1\r\n",                           // not a bulk string
+		"*x\r\n",                                 // not a number
+		"*1\n",                                   // no CR
+		"*1\r\n$4\r\nPINGxx",                     // no CRLF after the argument
+	} {
+		if _, err := parse(input); !errors.As(err, &protoErr) {
+			t.Errorf("got %v for input %q, want a protocol error", err, input)
+		}
+	}
+
+	// Large arguments are not allocated up front, so a missing payload is just an EOF
+	limits.MaxBulkLen = 1 << 30
+	if _, err := parse("*1\r\n$1000000000\r\nabc"); !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("got %v, want an EOF", err)
+	}
+}
+
+// Whatever a client sends, parsing must not panic, and a command that parses must come
+// out as sent.
+func FuzzParseCommand(f *testing.F) {
+	for _, seed := range []string{
+		"*1\r\n$4\r\nPING\r\n",
+		"*3\r\n$3\r\nSET\r\n$3\r\nfoo\r\n$3\r\nbar\r\n",
+		"*0\r\n",
+		"*1\r\n$0\r\n\r\n",
+		"*1\r\n$-1\r\n",
+		"*\r\n",
+		"\n",
+		"$3\r\nfoo\r\n",
+		"*2\r\n$1\r\na",
+	} {
+		f.Add([]byte(seed))
+	}
+	limits := ProtoLimits{MaxBulkLen: 1 << 20, MaxMultibulkLen: 1 << 10}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		cmd, err := ParseCommand(bufio.NewReader(bytes.NewReader(data)), limits)
+		if err != nil {
+			return
+		}
+		if encoded := makeRESPArr(cmd); !bytes.HasPrefix(data, encoded) {
+			// Only headers written differently, e.g. "$03", may differ
+			again, err := ParseCommand(bufio.NewReader(bytes.NewReader(encoded)), limits)
+			if err != nil || !slices.Equal(again, cmd) {
+				t.Errorf("%q parsed into %q, which doesn't parse back the same: %q, %v", data, cmd, again, err)
+			}
+		}
+	})
+}
+
+func TestEmptyCommand(t *testing.T) {
+	server := MakeServer()
+	client, conn := net.Pipe()
+	defer client.Close()
+	go server.startSession(conn)
+
+	// Ignored, as by Redis
+	client.Write([]byte("*0\r\n*1\r\n$4\r\nPING\r\n"))
+	if reply, _ := bufio.NewReader(client).ReadString('\n'); reply != "+PONG\r\n" {
+		t.Errorf("got %q, want +PONG", reply)
+	}
+
+	session, _ := newTestSession(server)
+	if uerr := session.execute(nil); uerr == nil {
+		t.Errorf("executing an empty command: want an error")
+	}
+}
+
+func TestProtocolErrorCloses(t *testing.T) {
+	server := MakeServer()
+	client, conn := net.Pipe()
+	defer client.Close()
+	go server.startSession(conn)
+
+	// What follows can't be told apart from the rest of a broken command
+	go client.Write([]byte("*2\r\n$4\r\nECHO\r\n$3\r\nabcde\r\n*1\r\n$4\r\nPING\r\n"))
+	client.SetDeadline(time.Now().Add(time.Second))
+	got, err := io.ReadAll(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "-ERR Protocol error: bulk string not terminated by CRLF\r\n" {
+		t.Errorf("got %q, want a protocol error and the connection closed", got)
+	}
+}
+
+func TestInlineCommands(t *testing.T) {
+	for _, tc := range []struct {
+		line string
+		want []string
+	}{
+		{"PING\r\n", []string{"PING"}},
+		{"SET  k   v\n", []string{"SET", "k", "v"}},
+		{"\r\n", nil},
+		{`SET k "a b\n\x41\"" 'it\'s' ""` + "\r\n", []string{"SET", "k", "a b\nA\"", "it's", ""}},
+		{`ECHO "\xZZ"` + "\n", []string{"ECHO", "xZZ"}},
+	} {
+		got, err := parseInlineCommand(bufio.NewReader(strings.NewReader(tc.line)))
+		if err != nil || !slices.Equal(got, tc.want) {
+			t.Errorf("%q: got (%q, %v), want %q", tc.line, got, err, tc.want)
+		}
+	}
+
+	var protoErr *ProtocolError
+	for _, line := range []string{
+		`SET k "v` + "\r\n",
+		`SET k 'v'x` + "\r\n",
+		strings.Repeat("a", maxInlineLen+1) + "\n",
+	} {
+		if _, err := parseInlineCommand(bufio.NewReader(strings.NewReader(line))); !errors.As(err, &protoErr) {
+			t.Errorf("got %v for %.20q, want a protocol error", err, line)
+		}
+	}
+
+	// Over a connection, mixed with RESP, until QUIT closes it
+	server := MakeServer()
+	client, conn := net.Pipe()
+	defer client.Close()
+	go server.startSession(conn)
+	go client.Write([]byte("SET k \"v 1\"\r\n\r\n*2\r\n$3\r\nGET\r\n$1\r\nk\r\nQUIT\r\nPING\r\n"))
+	got, _ := io.ReadAll(client)
+	if want := "+OK\r\n$3\r\nv 1\r\n+OK\r\n"; string(got) != want {
+		t.Errorf("got %q, want %q and the connection closed", got, want)
+	}
+}
+
+func TestRenameCommand(t *testing.T) {
+	server := MakeServer()
+	if err := server.RenameCommand("DEL", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.RenameCommand("setex", "secret-setex"); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.RenameCommand("get", "set"); err == nil {
+		t.Errorf("renamed GET to the name of another command")
+	}
+	if err := server.RenameCommand("nosuchcommand", "x"); err == nil {
+		t.Errorf("renamed a command that doesn't exist")
+	}
+	session, conn := newTestSession(server)
+	run := func(cmd ...string) string {
+		conn.buf.Reset()
+		session.dispatch(cmd)
+		return conn.buf.String()
+	}
+
+	for _, cmd := range [][]string{{"DEL", "key"}, {"SETEX", "key", "10", "value"}} {
+		if got := run(cmd...); got != "-ERR Command not known\r\n" {
+			t.Errorf("%v: got %q, want it unknown", cmd, got)
+		}
+	}
+	// Handlers see the original name, e.g. to tell SETEX from PSETEX
+	if got := run("SECRET-SETEX", "key", "10", "value"); got != "+OK\r\n" {
+		t.Errorf("renamed SETEX: got %q", got)
+	}
+	if got := run("TTL", "key"); got != ":10\r\n" {
+		t.Errorf("TTL after renamed SETEX: got %q", got)
+	}
+
+	// Our master uses the original names
+	session.master = true
+	if got := run("DEL", "key"); got != ":1\r\n" {
+		t.Errorf("DEL from the master: got %q", got)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	server := MakeServer()
+	session, conn := newTestSession(server)
+	db := server.dbs[0]
+	run := func(cmd ...string) string {
+		conn.buf.Reset()
+		session.dispatch(cmd)
+		return conn.buf.String()
+	}
+
+	// Expired keys are deleted when accessed
+	db.set("expired", "val", time.Now().Add(-time.Second).UnixMilli())
+	if got := run("GET", "expired"); got != "$-1\r\n" {
+		t.Errorf("got %q for an expired key", got)
+	}
+	if _, ok := db.engine.Get("expired"); ok {
+		t.Errorf("expired key was not deleted")
+	}
+	db.set("expired", "val", time.Now().Add(-time.Second).UnixMilli())
+	if got := run("KEYS", "*"); got != "*0\r\n" {
+		t.Errorf("got %q, want expired keys left out", got)
+	}
+	db.set("expired", "val", time.Now().Add(-time.Second).UnixMilli())
+	if got := run("TYPE", "expired"); got != "+none\r\n" {
+		t.Errorf("got %q", got)
+	}
+
+	// Whatever the command, an expired key doesn't exist, and is gone afterwards
+	for _, tc := range []struct {
+		cmd  []string
+		want string
+	}{
+		{[]string{"EXISTS", "expired", "expired"}, ":0\r\n"},
+		{[]string{"TTL", "expired"}, ":-2\r\n"},
+		{[]string{"PTTL", "expired"}, ":-2\r\n"},
+		{[]string{"OBJECT", "ENCODING", "expired"}, "$-1\r\n"},
+		{[]string{"DUMP", "expired"}, "$-1\r\n"},
+		{[]string{"LLEN", "expired"}, ":0\r\n"},
+		{[]string{"HGET", "expired", "f"}, "$-1\r\n"},
+	} {
+		db.set("expired", "val", time.Now().Add(-time.Second).UnixMilli())
+		if got := run(tc.cmd...); got != tc.want {
+			t.Errorf("%q: got %q, want %q", tc.cmd, got, tc.want)
+		}
+		if _, ok := db.engine.Get("expired"); ok {
+			t.Errorf("%q: expired key was not deleted", tc.cmd)
+		}
+	}
+
+	run("SET", "ttl", "v", "PX", "5000")
+	if got := run("TTL", "ttl"); got != ":5\r\n" {
+		t.Errorf("TTL: got %q", got)
+	}
+	if got := run("PTTL", "ttl"); got < ":4900\r\n" || got > ":5000\r\n" {
+		t.Errorf("PTTL: got %q", got)
+	}
+	if got := run("EXISTS", "ttl", "ttl", "missing"); got != ":2\r\n" {
+		t.Errorf("EXISTS: got %q", got)
+	}
+
+	// A plain SET discards the TTL
+	run("SET", "foo", "bar", "PX", "100000")
+	if _, ok := db.engine.Expiry("foo"); !ok {
+		t.Errorf("SET PX did not set an expiry")
+	}
+	run("SET", "foo", "baz")
+	if _, ok := db.engine.Expiry("foo"); ok {
+		t.Errorf("SET did not discard the expiry")
+	}
+	if got := run("GET", "foo"); got != "$3\r\nbaz\r\n" {
+		t.Errorf("got %q", got)
+	}
+
+	if got := run("SET", "foo", "bar", "PX"); !strings.HasPrefix(got, "-ERR") {
+		t.Errorf("got %q for PX without a value", got)
+	}
+	if got := run("SET", "foo", "bar", "PX", "0"); !strings.HasPrefix(got, "-ERR") {
+		t.Errorf("got %q for a zero expiry", got)
+	}
+}
+
+func TestSetRacingExpiry(t *testing.T) {
+	server := MakeServer()
+	session, _ := newTestSession(server)
+	db := server.dbs[0]
+
+	// A key looked at while SET gives it a past expiry must neither end up without one,
+	// nor be deleted for it with the old value
+	for range 1000 {
+		session.dispatch([]string{"SET", "k", "old"})
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for range 50 {
+				db.peek("k")
+			}
+		}()
+		session.dispatch([]string{"SET", "k", "new", "PXAT", "1"})
+		<-done
+		if value, ok := db.engine.Get("k"); ok {
+			if _, ok := db.engine.Expiry("k"); !ok {
+				t.Fatalf("got %v without an expiry", value)
+			}
+		}
+	}
+}
+
+func TestExpiryOptions(t *testing.T) {
+	server := MakeServer()
+	server.Clock = newFakeClock(time.UnixMilli(1700000000000))
+	session, conn := newTestSession(server)
+	db := server.dbs[0]
+	run := func(cmd ...string) string {
+		conn.buf.Reset()
+		session.dispatch(cmd)
+		return conn.buf.String()
+	}
+	expiry := func(key string) int64 {
+		val, _ := db.engine.Expiry(key)
+		return val
+	}
+
+	for _, tc := range []struct {
+		cmd  []string
+		want int64
+	}{
+		{[]string{"SET", "k", "v", "EX", "10"}, 1700000010000},
+		{[]string{"SET", "k", "v", "px", "10"}, 1700000000010},
+		{[]string{"SET", "k", "v", "EXAT", "1800000000"}, 1800000000000},
+		{[]string{"SET", "k", "v", "PXAT", "1800000000001"}, 1800000000001},
+		{[]string{"SETEX", "k", "20", "v"}, 1700000020000},
+		{[]string{"psetex", "k", "20", "v"}, 1700000000020},
+	} {
+		if got := run(tc.cmd...); got != "+OK\r\n" {
+			t.Errorf("%q: got %q", tc.cmd, got)
+		}
+		if got := expiry("k"); got != tc.want {
+			t.Errorf("%q: got expiry %v, want %v", tc.cmd, got, tc.want)
+		}
+		// Propagated as an absolute time, so that replicas don't count from later on
+		want := []string{"SET", "k", "v", "PXAT", strconv.FormatInt(tc.want, 10)}
+		if len(session.rewrite) != 1 || !slices.Equal(session.rewrite[0], want) {
+			t.Errorf("%q: propagated as %q, want %q", tc.cmd, session.rewrite, want)
+		}
+	}
+	for _, cmd := range [][]string{
+		{"SET", "k", "v", "EX", "9223372036854775807"},
+		{"SET", "k", "v", "PX", "9223372036854775807"},
+		{"SET", "k", "v", "EX", "-1"},
+		{"SET", "k", "v", "EX", "1", "PX", "1"},
+		{"SET", "k", "v", "EX"},
+		{"SET", "k", "v", "FOO"},
+		{"SETEX", "k", "v", "10"},
+		{"SETEX", "k", "10"},
+	} {
+		if got := run(cmd...); !strings.HasPrefix(got, "-ERR") {
+			t.Errorf("%q: got %q", cmd, got)
+		}
+	}
+	if got := run("PSETEX", "k", "0", "v"); got != "-ERR invalid expire time in 'psetex' command\r\n" {
+		t.Errorf("PSETEX 0: got %q", got)
+	}
+
+	run("SET", "k", "v")
+	for _, tc := range []struct {
+		cmd  []string
+		want string
+		exp  int64 // 0 for none
+	}{
+		{[]string{"EXPIREAT", "missing", "1800000000"}, ":0\r\n", 0},
+		{[]string{"EXPIREAT", "k", "1800000000", "XX"}, ":0\r\n", 0},
+		{[]string{"EXPIREAT", "k", "1800000000", "LT"}, ":1\r\n", 1800000000000},
+		{[]string{"EXPIREAT", "k", "1900000000", "NX"}, ":0\r\n", 1800000000000},
+		{[]string{"EXPIREAT", "k", "1700000001", "GT"}, ":0\r\n", 1800000000000},
+		{[]string{"PEXPIREAT", "k", "1800000000500", "GT"}, ":1\r\n", 1800000000500},
+		{[]string{"PEXPIREAT", "k", "1700000000001"}, ":1\r\n", 1700000000001},
+		{[]string{"EXPIREAT", "k", "1", "NX", "XX"}, "-ERR NX and XX, GT or LT options at the same time are not compatible\r\n", 1700000000001},
+		{[]string{"EXPIREAT", "k", "9223372036854775807"}, "-ERR invalid expire time in 'expireat' command\r\n", 1700000000001},
+		// In the past, so the key is deleted
+		{[]string{"PEXPIREAT", "k", "1700000000000"}, ":1\r\n", 0},
+	} {
+		if got := run(tc.cmd...); got != tc.want {
+			t.Errorf("%q: got %q, want %q", tc.cmd, got, tc.want)
+		}
+		if got := expiry("k"); got != tc.exp {
+			t.Errorf("%q: got expiry %v, want %v", tc.cmd, got, tc.exp)
+		}
+	}
+	if got := run("EXISTS", "k"); got != ":0\r\n" {
+		t.Errorf("key expired by EXPIREAT still exists: %q", got)
+	}
+}
+
+func TestGetrange(t *testing.T) {
+	server := MakeServer()
+	session, conn := newTestSession(server)
+	run := func(cmd ...string) string {
+		conn.buf.Reset()
+		session.dispatch(cmd)
+		return conn.buf.String()
+	}
+
+	run("SET", "k", "Hello World")
+	for _, tc := range []struct {
+		cmd  []string
+		want string
+	}{
+		{[]string{"GETRANGE", "k", "0", "4"}, "$5\r\nHello\r\n"},
+		{[]string{"GETRANGE", "k", "-5", "-1"}, "$5\r\nWorld\r\n"},
+		{[]string{"GETRANGE", "k", "6", "100"}, "$5\r\nWorld\r\n"},
+		{[]string{"GETRANGE", "k", "-100", "0"}, "$1\r\nH\r\n"},
+		{[]string{"GETRANGE", "k", "5", "3"}, "$0\r\n\r\n"},
+		{[]string{"GETRANGE", "k", "-1", "-5"}, "$0\r\n\r\n"},
+		{[]string{"GETRANGE", "k", "20", "30"}, "$0\r\n\r\n"},
+		{[]string{"GETRANGE", "missing", "0", "-1"}, "$0\r\n\r\n"},
+		{[]string{"GETRANGE", "k", "a", "1"}, "-ERR value is not an integer or out of range\r\n"},
+		{[]string{"SUBSTR", "k", "0", "-7"}, "$5\r\nHello\r\n"},
+	} {
+		if got := run(tc.cmd...); got != tc.want {
+			t.Errorf("%q: got %q, want %q", tc.cmd, got, tc.want)
+		}
+	}
+}
+
+func TestXaddMaxlen(t *testing.T) {
+	server := MakeServer()
+	session, conn := newTestSession(server)
+	run := func(cmd ...string) string {
+		conn.buf.Reset()
+		session.dispatch(cmd)
+		return conn.buf.String()
+	}
+
+	for i := 1; i <= 5; i++ {
+		id := strconv.Itoa(i) + "-0"
+		if got := run("XADD", "s", "MAXLEN", "~", "3", id, "n", strconv.Itoa(i)); got != "$3\r\n"+id+"\r\n" {
+			t.Errorf("got %q", got)
+		}
+	}
+	if got := run("XRANGE", "s", "-", "+"); !strings.HasPrefix(got, "*3\r\n") || !strings.Contains(got, "3-0") || strings.Contains(got, "2-0") {
+		t.Errorf("got %q, want only the last 3 entries", got)
+	}
+
+	if got := run("XADD", "s", "MAXLEN", "-1", "*", "n", "v"); !strings.HasPrefix(got, "-ERR") {
+		t.Errorf("got %q, want an error", got)
+	}
+	if got := run("XADD", "s", "MAXLEN", "1", "6-0"); !strings.HasPrefix(got, "-ERR wrong number") {
+		t.Errorf("got %q, want an error", got)
+	}
+}
+
+func TestXaddNoMkStream(t *testing.T) {
+	server := MakeServer()
+	session, conn := newTestSession(server)
+	run := func(cmd ...string) string {
+		conn.buf.Reset()
+		session.dispatch(cmd)
+		return conn.buf.String()
+	}
+
+	// A rejected entry doesn't leave an empty stream behind
+	for _, cmd := range [][]string{
+		{"XADD", "s", "0-0", "n", "v"},
+		{"XADD", "s", "1-x", "n", "v"},
+		{"XADD", "s", "NOMKSTREAM", "*", "n", "v"},
+	} {
+		run(cmd...)
+		if got := run("EXISTS", "s"); got != ":0\r\n" {
+			t.Errorf("%q created the stream", cmd)
+		}
+	}
+	if got := run("XADD", "s", "NOMKSTREAM", "*", "n", "v"); got != "$-1\r\n" {
+		t.Errorf("XADD NOMKSTREAM to a missing stream: got %q", got)
+	}
+	if len(session.rewrite) != 0 {
+		t.Errorf("XADD NOMKSTREAM to a missing stream propagated %q", session.rewrite)
+	}
+
+	run("XADD", "s", "1-0", "n", "v")
+	if got := run("XADD", "s", "NOMKSTREAM", "MAXLEN", "1", "2-0", "n", "v"); got != "$3\r\n2-0\r\n" {
+		t.Errorf("XADD NOMKSTREAM MAXLEN: got %q", got)
+	}
+	if got := run("XADD", "s", "MAXLEN", "1", "NOMKSTREAM", "3-0", "n", "v"); got != "$3\r\n3-0\r\n" {
+		t.Errorf("XADD MAXLEN NOMKSTREAM: got %q", got)
+	}
+	if got := run("XRANGE", "s", "-", "+"); !strings.HasPrefix(got, "*1\r\n") || !strings.Contains(got, "3-0") {
+		t.Errorf("got %q, want only the last entry", got)
+	}
+	if got := run("XADD", "s", "NOMKSTREAM", "MAXLEN"); !strings.HasPrefix(got, "-ERR") {
+		t.Errorf("got %q, want an error", got)
+	}
+}
+
+// Concurrent XADDs of generated IDs each get an ID of their own.
+func TestXaddConcurrent(t *testing.T) {
+	server := MakeServer()
+	var wg sync.WaitGroup
+	for range 8 {
+		session, conn := newTestSession(server)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 2000 {
+				conn.buf.Reset()
+				session.dispatch([]string{"XADD", "s", "*", "n", "v"})
+				if got := conn.buf.String(); !strings.HasPrefix(got, "$") {
+					t.Errorf("XADD: got %q", got)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	session, conn := newTestSession(server)
+	session.dispatch([]string{"XLEN", "s"})
+	if got := conn.buf.String(); got != ":16000\r\n" {
+		t.Errorf("XLEN: got %q, want 16000", got)
+	}
+}
+
+func TestXrangeExclusive(t *testing.T) {
+	server := MakeServer()
+	session, conn := newTestSession(server)
+	run := func(cmd ...string) string {
+		conn.buf.Reset()
+		session.dispatch(cmd)
+		return conn.buf.String()
+	}
+	ids := func(reply string) []string {
+		var got []string
+		for _, id := range []string{"0-1", "1-0", "1-18446744073709551615", "2-0"} {
+			if strings.Contains(reply, "\r\n"+id+"\r\n") {
+				got = append(got, id)
+			}
+		}
+		return got
+	}
+
+	for _, id := range []string{"0-1", "1-0", "1-18446744073709551615", "2-0"} {
+		run("XADD", "s", id, "n", "v")
+	}
+	for _, tc := range []struct {
+		cmd  []string
+		want []string
+	}{
+		{[]string{"XRANGE", "s", "(0-1", "+"}, []string{"1-0", "1-18446744073709551615", "2-0"}},
+		{[]string{"XRANGE", "s", "-", "(2-0"}, []string{"0-1", "1-0", "1-18446744073709551615"}},
+		{[]string{"XRANGE", "s", "(1-0", "(2-0"}, []string{"1-18446744073709551615"}},
+		// Carrying over to the next or previous millisecond
+		{[]string{"XRANGE", "s", "(1-18446744073709551615", "+"}, []string{"2-0"}},
+		{[]string{"XRANGE", "s", "-", "(1-0"}, []string{"0-1"}},
+		{[]string{"XRANGE", "s", "(1-0", "(1-0"}, nil},
+		{[]string{"XREVRANGE", "s", "(2-0", "(0-1"}, []string{"1-0", "1-18446744073709551615"}},
+		{[]string{"XRANGE", "s", "-", "+", "COUNT", "2"}, []string{"0-1", "1-0"}},
+		// Without a sequence number: every entry of that millisecond
+		{[]string{"XRANGE", "s", "1", "1"}, []string{"1-0", "1-18446744073709551615"}},
+		{[]string{"XRANGE", "s", "0", "1"}, []string{"0-1", "1-0", "1-18446744073709551615"}},
+		{[]string{"XRANGE", "s", "(1", "2"}, []string{"1-18446744073709551615", "2-0"}},
+		{[]string{"XRANGE", "s", "-", "(1"}, []string{"0-1", "1-0"}},
+		{[]string{"XREVRANGE", "s", "1", "1"}, []string{"1-0", "1-18446744073709551615"}},
+	} {
+		if got := ids(run(tc.cmd...)); !slices.Equal(got, tc.want) {
+			t.Errorf("%q: got %q, want %q", tc.cmd, got, tc.want)
+		}
+	}
+	if got := run("XREVRANGE", "s", "+", "-", "COUNT", "1"); !strings.HasPrefix(got, "*1\r\n*2\r\n$3\r\n2-0\r\n") {
+		t.Errorf("XREVRANGE COUNT: got %q, want the last entry", got)
+	}
+
+	for _, tc := range []struct {
+		cmd  []string
+		want string
+	}{
+		{[]string{"XRANGE", "s", "(18446744073709551615-18446744073709551615", "+"}, "-ERR invalid start ID for the interval\r\n"},
+		{[]string{"XRANGE", "s", "-", "(0-0"}, "-ERR invalid end ID for the interval\r\n"},
+		{[]string{"XRANGE", "s", "(-", "+"}, "-ERR invalid start ID for the interval\r\n"},
+		{[]string{"XRANGE", "s", "-", "(+"}, "-ERR invalid end ID for the interval\r\n"},
+		{[]string{"XRANGE", "s", "-", "+", "LIMIT", "1"}, "-ERR syntax error\r\n"},
+		{[]string{"XRANGE", "s", "*", "+"}, "-ERR bad \"from\" key\r\n"},
+		{[]string{"XRANGE", "s", "-", "1-*"}, "-ERR bad \"to\" key\r\n"},
+	} {
+		if got := run(tc.cmd...); got != tc.want {
+			t.Errorf("%q: got %q, want %q", tc.cmd, got, tc.want)
+		}
+	}
+}
+
+func TestXsetid(t *testing.T) {
+	server := MakeServer()
+	session, conn := newTestSession(server)
+	run := func(cmd ...string) string {
+		conn.buf.Reset()
+		session.dispatch(cmd)
+		return conn.buf.String()
+	}
+
+	run("XADD", "s", "5-0", "a", "1")
+	for _, tc := range []struct {
+		cmd  []string
+		want string
+	}{
+		{[]string{"XSETID", "missing", "1-0"}, "-ERR no such key\r\n"},
+		{[]string{"XSETID", "s", "4-0"}, "-ERR The ID specified in XSETID is smaller than the target stream top item\r\n"},
+		{[]string{"XSETID", "s", "*"}, "-ERR Invalid stream ID specified as stream command argument\r\n"},
+		{[]string{"XSETID", "s", "10-0", "ENTRIESADDED", "0"}, "-ERR The entries_added specified in XSETID is smaller than the target stream length\r\n"},
+		{[]string{"XSETID", "s", "10-0", "ENTRIESADDED", "1", "MAXDELETEDID", "3-0"}, "+OK\r\n"},
+		{[]string{"XADD", "s", "9-0", "a", "1"}, "-ERR the ID specified in XADD is equal or smaller than the target stream top item\r\n"},
+		{[]string{"XADD", "s", "10-*", "a", "1"}, "$4\r\n10-1\r\n"},
+	} {
+		if got := run(tc.cmd...); got != tc.want {
+			t.Errorf("%v: got %q, want %q", tc.cmd, got, tc.want)
+		}
+	}
+}
+
+func TestXlenXinfo(t *testing.T) {
+	server := MakeServer()
+	session, conn := newTestSession(server)
+	run := func(cmd ...string) string {
+		conn.buf.Reset()
+		session.dispatch(cmd)
+		return conn.buf.String()
+	}
+
+	for i := 1; i <= 5; i++ {
+		run("XADD", "s", strconv.Itoa(i)+"-0", "n", strconv.Itoa(i))
+	}
+	run("XADD", "s", "MAXLEN", "3", "6-0", "n", "6")
+	run("XSETID", "s", "10-0")
+	run("SET", "str", "v")
+	for _, tc := range []struct {
+		cmd  []string
+		want string
+	}{
+		{[]string{"XLEN", "s"}, ":3\r\n"},
+		{[]string{"XLEN", "missing"}, ":0\r\n"},
+		{[]string{"XLEN", "str"}, "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"},
+		{[]string{"XINFO", "STREAM", "s"}, "*10\r\n$6\r\nlength\r\n:3\r\n$17\r\nlast-generated-id\r\n$4\r\n10-0\r\n$6\r\ngroups\r\n:0\r\n" +
+			"$11\r\nfirst-entry\r\n*2\r\n$3\r\n4-0\r\n*2\r\n$1\r\nn\r\n$1\r\n4\r\n" +
+			"$10\r\nlast-entry\r\n*2\r\n$3\r\n6-0\r\n*2\r\n$1\r\nn\r\n$1\r\n6\r\n"},
+		{[]string{"XINFO", "STREAM", "missing"}, "-ERR no such key\r\n"},
+	} {
+		if got := run(tc.cmd...); got != tc.want {
+			t.Errorf("%v: got %q, want %q", tc.cmd, got, tc.want)
+		}
+	}
+
+	run("XADD", "s", "MAXLEN", "0", "11-0", "n", "11")
+	if got := run("XINFO", "STREAM", "s"); !strings.HasSuffix(got, "$11\r\nfirst-entry\r\n$-1\r\n$10\r\nlast-entry\r\n$-1\r\n") {
+		t.Errorf("XINFO STREAM of an empty stream: got %q", got)
+	}
+}
+
+func TestErrorReplies(t *testing.T) {
+	server := MakeServer()
+	session, conn := newTestSession(server)
+	run := func(cmd ...string) string {
+		conn.buf.Reset()
+		session.dispatch(cmd)
+		return conn.buf.String()
+	}
+
+	wrongType := "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"
+	run("SET", "str", "v")
+	run("XADD", "s", "1-0", "a", "1")
+	dump := run("DUMP", "str")
+	for _, tc := range []struct {
+		cmd  []string
+		want string
+	}{
+		{[]string{"GET", "s"}, wrongType},
+		{[]string{"XADD", "str", "*", "a", "1"}, wrongType},
+		{[]string{"XRANGE", "str", "-", "+"}, wrongType},
+		{[]string{"XREAD", "STREAMS", "str", "0"}, wrongType},
+		{[]string{"LLEN", "s"}, wrongType},
+		{[]string{"XREAD", "FOO", "s", "0"}, "-ERR syntax error\r\n"},
+		{[]string{"XREAD", "COUNT", "1", "BLOCK"}, "-ERR syntax error\r\n"},
+		{[]string{"XREAD", "COUNT", "x", "STREAMS", "s", "0"}, "-ERR value is not an integer or out of range\r\n"},
+		{[]string{"XREAD", "BLOCK", "x", "STREAMS", "s", "0"}, "-ERR timeout is not an integer or out of range\r\n"},
+		{[]string{"XADD", "s", "NOMKSTREAM", "MAXLEN", "~"}, "-ERR syntax error\r\n"},
+		{[]string{"XRANGE", "s", "-", "+", "LIMIT", "1"}, "-ERR syntax error\r\n"},
+		{[]string{"SET", "k", "v", "ex"}, "-ERR syntax error\r\n"},
+		{[]string{"SET", "k", "v", "EX", "1", "px", "1"}, "-ERR syntax error\r\n"},
+		{[]string{"RESTORE", "str", "0", dump[strings.Index(dump, "\r\n")+2 : len(dump)-2]}, "-BUSYKEY Target key name already exists.\r\n"},
+		{[]string{"XSETID", "missing", "1-0"}, "-ERR no such key\r\n"},
+	} {
+		if got := run(tc.cmd...); got != tc.want {
+			t.Errorf("%v: got %q, want %q", tc.cmd, got, tc.want)
+		}
+	}
+
+	uerr := &UserError{"ERR", "line one\r\nline two"}
+	if got := string(uerr.RESP()); got != "-ERR line one  line two\r\n" {
+		t.Errorf("got %q, want the line breaks replaced", got)
+	}
+	if got := ErrWrongType().Error(); got != "WRONGTYPE Operation against a key holding the wrong kind of value" {
+		t.Errorf("got %q, want the code in front of the message", got)
+	}
+}
+
+func TestReadModifyWrite(t *testing.T) {
+	server := MakeServer()
+	session, conn := newTestSession(server)
+	run := func(cmd ...string) string {
+		conn.buf.Reset()
+		session.dispatch(cmd)
+		return conn.buf.String()
+	}
+
+	for _, tc := range []struct {
+		cmd  []string
+		want string
+	}{
+		{[]string{"GETSET", "k", "a"}, "$-1\r\n"},
+		{[]string{"GETSET", "k", "b"}, "$1\r\na\r\n"},
+		{[]string{"APPEND", "k", "cd"}, ":3\r\n"},
+		{[]string{"APPEND", "new", "xy"}, ":2\r\n"},
+		{[]string{"INCR", "n"}, ":1\r\n"},
+		{[]string{"INCRBY", "n", "41"}, ":42\r\n"},
+		{[]string{"DECR", "n"}, ":41\r\n"},
+		{[]string{"DECRBY", "n", "-9"}, ":50\r\n"},
+		{[]string{"APPEND", "n", "0"}, ":3\r\n"},
+		{[]string{"INCR", "n"}, ":501\r\n"},
+		{[]string{"INCR", "k"}, "-ERR value is not an integer or out of range\r\n"},
+		{[]string{"INCRBY", "n", "x"}, "-ERR value is not an integer or out of range\r\n"},
+		{[]string{"INCRBY", "n", "9223372036854775807"}, "-ERR increment or decrement would overflow\r\n"},
+		{[]string{"DECRBY", "n", "-9223372036854775808"}, "-ERR decrement would overflow\r\n"},
+		{[]string{"GET", "n"}, "$3\r\n501\r\n"},
+	} {
+		if got := run(tc.cmd...); got != tc.want {
+			t.Errorf("%q: got %q, want %q", tc.cmd, got, tc.want)
+		}
+	}
+
+	run("SET", "padded", "007")
+	if got := run("INCR", "padded"); !strings.HasPrefix(got, "-ERR") {
+		t.Errorf("INCR of a non-canonical integer: got %q", got)
+	}
+	run("RPUSH", "list", "a")
+	for _, cmd := range [][]string{{"GETSET", "list", "a"}, {"INCR", "list"}, {"APPEND", "list", "a"}} {
+		if got := run(cmd...); !strings.HasPrefix(got, "-WRONGTYPE") {
+			t.Errorf("%q: got %q", cmd, got)
+		}
+	}
+
+	// INCR keeps the TTL, GETSET discards it like SET does
+	run("SET", "n", "1", "PX", "100000")
+	run("INCR", "n")
+	if got := run("TTL", "n"); got != ":100\r\n" {
+		t.Errorf("TTL after INCR: got %q", got)
+	}
+	run("GETSET", "n", "1")
+	if got := run("TTL", "n"); got != ":-1\r\n" {
+		t.Errorf("TTL after GETSET: got %q", got)
+	}
+}
+
+func TestRandomKey(t *testing.T) {
+	server := MakeServer()
+	clock := newFakeClock(time.Unix(1700000000, 0))
+	server.Clock = clock
+	session, conn := newTestSession(server)
+	run := func(cmd ...string) string {
+		conn.buf.Reset()
+		session.dispatch(cmd)
+		return conn.buf.String()
+	}
+
+	if got := run("RANDOMKEY"); got != "$-1\r\n" {
+		t.Errorf("empty database: got %q", got)
+	}
+	run("SET", "a", "1")
+	run("SET", "b", "2")
+	seen := map[string]bool{}
+	for range 100 {
+		seen[run("RANDOMKEY")] = true
+	}
+	if !seen["$1\r\na\r\n"] || !seen["$1\r\nb\r\n"] || len(seen) != 2 {
+		t.Errorf("got %v, want both keys", seen)
+	}
+
+	// Expired keys are never picked
+	run("DEL", "b")
+	run("SET", "c", "3", "PX", "10")
+	run("SET", "d", "4", "PX", "10")
+	clock.Advance(10 * time.Millisecond)
+	for range 10 {
+		if got := run("RANDOMKEY"); got != "$1\r\na\r\n" {
+			t.Fatalf("got %q, want the one key that didn't expire", got)
+		}
+	}
+	run("DEL", "a")
+	if got := run("RANDOMKEY"); got != "$-1\r\n" {
+		t.Errorf("emptied database: got %q", got)
+	}
+}
+
+func TestKeys(t *testing.T) {
+	server := MakeServer()
+	session, conn := newTestSession(server)
+	run := func(cmd ...string) []string {
+		conn.buf.Reset()
+		session.dispatch(cmd)
+		reply := conn.buf.String()
+		if !strings.HasPrefix(reply, "*") {
+			t.Fatalf("%v: got %q", cmd, reply)
+		}
+		var keys []string
+		lines := strings.Split(reply, "\r\n")
+		for i := 2; i < len(lines); i += 2 {
+			keys = append(keys, lines[i])
+		}
+		slices.Sort(keys)
+		return keys
+	}
+
+	session.dispatch([]string{"MSET", "user:1", "a", "user:2", "b", "item:1", "c"})
+	session.dispatch([]string{"SET", "user:3", "d", "PX", "1"})
+	session.dispatch([]string{"HSET", "user:4", "f", "v"})
+	session.dispatch([]string{"XADD", "events", "*", "f", "v"})
+	time.Sleep(5 * time.Millisecond)
+
+	for _, tc := range []struct {
+		cmd  []string
+		want []string
+	}{
+		{[]string{"KEYS", "*"}, []string{"events", "item:1", "user:1", "user:2", "user:4"}},
+		{[]string{"KEYS", "user:*"}, []string{"user:1", "user:2", "user:4"}},
+		{[]string{"KEYS", "user:[12]"}, []string{"user:1", "user:2"}},
+		{[]string{"KEYS", "user:3"}, nil},
+		{[]string{"KEYS", "item:1"}, []string{"item:1"}},
+		{[]string{"KEYS", "*", "TYPE", "hash"}, []string{"user:4"}},
+		{[]string{"KEYS", "*", "TYPE", "STREAM"}, []string{"events"}},
+		{[]string{"KEYS", "user:1", "TYPE", "hash"}, nil},
+	} {
+		if got := run(tc.cmd...); !slices.Equal(got, tc.want) {
+			t.Errorf("%v: got %q, want %q", tc.cmd, got, tc.want)
+		}
+	}
+
+	conn.buf.Reset()
+	session.dispatch([]string{"KEYS", "*", "SIZE", "1"})
+	if got := conn.buf.String(); got != "-ERR syntax error\r\n" {
+		t.Errorf("got %q, want a syntax error", got)
+	}
+}
+
+func TestConfigLogLevel(t *testing.T) {
+	server := MakeServer()
+	var logged strings.Builder
+	server.Log = slog.New(slog.NewTextHandler(&logged, &slog.HandlerOptions{Level: server.LogLevel}))
+	session, conn := newTestSession(server)
+	run := func(cmd ...string) string {
+		conn.buf.Reset()
+		session.dispatch(cmd)
+		return conn.buf.String()
+	}
+
+	server.Log.Debug("hidden")
+	if got := run("CONFIG", "GET", "loglevel"); got != "*2\r\n$8\r\nloglevel\r\n$4\r\ninfo\r\n" {
+		t.Errorf("CONFIG GET: got %q", got)
+	}
+	if got := run("CONFIG", "SET", "loglevel", "DEBUG"); got != "+OK\r\n" {
+		t.Fatalf("CONFIG SET: got %q", got)
+	}
+	server.Log.Debug("shown")
+	if got := run("CONFIG", "SET", "loglevel", "verbose"); !strings.HasPrefix(got, "-ERR invalid log level") {
+		t.Errorf("CONFIG SET with an unknown level: got %q", got)
+	}
+	if got := server.LogLevel.Level(); got != slog.LevelDebug {
+		t.Errorf("got level %v after a failed CONFIG SET, want debug", got)
+	}
+
+	if strings.Contains(logged.String(), "hidden") || !strings.Contains(logged.String(), "shown") {
+		t.Errorf("got log %q, want only the message logged at debug level", logged.String())
+	}
+}
+
+// Arguments every handler has to cope with, whatever the command: numbers at and past
+// the limits of what they're parsed into, strings that aren't text, keys of every type,
+// and the options and subcommands commands take, so that their arguments get checked too.
+var edgeCaseArgs = []string{
+	"", "0", "1", "-1", "3", "-100", "1000",
+	"9223372036854775807", "-9223372036854775808", "9223372036854775808", "18446744073709551616",
+	"0.5", "1e400", "inf", "-inf", "nan", "0x10",
+	"0-0", "1-1", "0-1", "18446744073709551615-18446744073709551615", "-", "+", "$", "*", ">", "?",
+	"\x00", "\xff\xfe", "a\r\nb", strings.Repeat("x", 1000),
+	"missing", "string", "list", "hash", "set", "stream",
+	"ex", "px", "exat", "pxat", "nx", "xx", "keepttl", "get", "abs", "absttl", "replace",
+	"idletime", "freq", "encoding", "refcount", "count", "block", "streams", "match",
+	"type", "withvalues", "maxlen", "minid", "limit", "full", "keys", "overflow", "wrap",
+	"sat", "fail", "incrby", "u8", "i64", "u63", "#1", "no", "one", "all", "write",
+	"on", "off", "id", "addr", "version", "storage", "histogram", "resetstat", "dir", "loglevel",
+}
+
+// Commands left out, for what they do once they get valid arguments.
+var edgeCaseSkipped = map[string]string{
+	"shutdown":  "stops the server",
+	"replicaof": "connects to a master",
+	"slaveof":   "connects to a master",
+	"failover":  "connects to a replica",
+	"migrate":   "connects to another server",
+	"psync":     "turns the client into a replica",
+}
+
+const edgeCaseVectorCount = 500 // random ones, per command
+
+// Every command, with any arguments, has to reply with well-formed RESP, errors
+// included, rather than panic. Which arguments is random, but seeded by the command, so
+// that failures reproduce.
+func TestCommandArguments(t *testing.T) {
+	for _, name := range slices.Sorted(maps.Keys(commandTable)) {
+		if _, ok := edgeCaseSkipped[name]; ok {
+			continue
+		}
+		t.Run(name, func(t *testing.T) {
+			server, session, conn := newEdgeCaseSession(t)
+			for _, args := range edgeCaseVectors(name, edgeCaseVectorCount) {
+				checkCommand(t, server, session, conn, append([]string{name}, args...))
+			}
+		})
+	}
+}
+
+// Like TestCommandArguments, for whichever arguments the fuzzer comes up with, separated
+// by NULs.
+func FuzzCommandArguments(f *testing.F) {
+	for _, name := range slices.Sorted(maps.Keys(commandTable)) {
+		for _, args := range edgeCaseVectors(name, 5) {
+			f.Add(name, strings.Join(args, "\x00"))
+		}
+	}
+	f.Fuzz(func(t *testing.T, name string, args string) {
+		if _, ok := edgeCaseSkipped[strings.ToLower(name)]; ok {
+			return
+		}
+		server, session, conn := newEdgeCaseSession(t)
+		checkCommand(t, server, session, conn, append([]string{name}, strings.Split(args, "\x00")...))
+	})
+}
+
+// A session on a server with a key of every type, named after it.
+func newEdgeCaseSession(t *testing.T) (*Server, *Session, *recordingConn) {
+	server := MakeServer()
+	server.Log = discardLog
+	server.RdbDir = t.TempDir()
+	t.Cleanup(func() { waitForSaves(server) }) // before the directory is removed
+	session, conn := newTestSession(server)
+	for _, cmd := range [][]string{
+		{"SET", "string", "v"},
+		{"RPUSH", "list", "a", "b"},
+		{"HSET", "hash", "f", "v"},
+		{"SADD", "set", "m"},
+		{"XADD", "stream", "1-1", "f", "v"},
+	} {
+		session.dispatch(cmd)
+	}
+	return server, session, conn
+}
+
+// Arguments for the command: none, each of edgeCaseArgs on its own, and n random
+// vectors of them, half of which start with one of the command's subcommands, so that
+// their arguments get checked too.
+func edgeCaseVectors(name string, n int) [][]string {
+	var subcommands []string
+	for _, line := range commandTable[name].help {
+		if !strings.HasPrefix(line, " ") {
+			subcommands = append(subcommands, strings.Fields(line)[0])
+		}
+	}
+	args := append(slices.Clone(edgeCaseArgs), subcommands...)
+
+	seed := fnv.New64()
+	seed.Write([]byte(name))
+	rng := rand.New(rand.NewPCG(seed.Sum64(), 0))
+	vectors := [][]string{nil}
+	for _, arg := range args {
+		vectors = append(vectors, []string{arg})
+	}
+	for range n {
+		vector := make([]string, rng.IntN(8)+1)
+		for i := range vector {
+			vector[i] = args[rng.IntN(len(args))]
+		}
+		if len(subcommands) > 0 && rng.IntN(2) == 0 {
+			vector[0] = subcommands[rng.IntN(len(subcommands))]
+		}
+		vectors = append(vectors, vector)
+	}
+	return vectors
+}
+
+// Run the command, failing the test if it panics or replies with anything but
+// well-formed RESP.
+func checkCommand(t *testing.T, server *Server, session *Session, conn *recordingConn, cmd []string) {
+	t.Helper()
+	conn.buf.Reset()
+	// Neither XREAD BLOCK nor CLIENT PAUSE hold up what comes next
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	session.connCtx = ctx
+	defer server.pause.unpause()
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				t.Fatalf("%q panicked: %v", cmd, r)
+			}
+		}()
+		session.dispatch(slices.Clone(cmd))
+	}()
+
+	reader := bufio.NewReader(&conn.buf)
+	for {
+		if _, err := reader.Peek(1); errors.Is(err, io.EOF) {
+			return
+		}
+		if err := checkReply(reader); err != nil {
+			t.Fatalf("%q: %v, replying %q", cmd, err, conn.buf.String())
+		}
+	}
+}
+
+// Read a RESP2 or RESP3 reply, checking it's well-formed, and that errors come with a
+// code, like "ERR" or "WRONGTYPE", followed by a message.
+func checkReply(reader *bufio.Reader) error {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	line, ok := strings.CutSuffix(line, "\r\n")
+	if !ok || line == "" || strings.Contains(line, "\r") {
+		return fmt.Errorf("malformed line %q", line)
+	}
+	switch line[0] {
+	case '+', '_':
+		return nil
+	case '-':
+		code, msg, _ := strings.Cut(line[1:], " ")
+		if code == "" || strings.ToUpper(code) != code || msg == "" {
+			return fmt.Errorf("malformed error %q", line)
+		}
+		return nil
+	case ':':
+		_, err := strconv.ParseInt(line[1:], 10, 64)
+		return err
+	case '$':
+		length, err := strconv.Atoi(line[1:])
+		if err != nil || length < -1 {
+			return fmt.Errorf("malformed bulk string length %q", line)
+		}
+		if length == -1 {
+			return nil // null
+		}
+		if _, err := reader.Discard(length); err != nil {
+			return err
+		}
+		if end, err := reader.ReadString('\n'); err != nil || end != "\r\n" {
+			return fmt.Errorf("bulk string of length %d followed by %q", length, end)
+		}
+		return nil
+	case '*', '%', '|', '>':
+		length, err := strconv.Atoi(line[1:])
+		if err != nil || length < -1 {
+			return fmt.Errorf("malformed aggregate length %q", line)
+		}
+		if line[0] == '%' || line[0] == '|' {
+			length *= 2
+		}
+		for range length {
+			if err := checkReply(reader); err != nil {
+				return err
+			}
+		}
+		if line[0] == '|' {
+			return checkReply(reader) // what the attributes are about
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown reply type %q", line)
+}
+
+// Wait for any background save to finish.
+func waitForSaves(server *Server) {
+	for {
+		server.save.mutex.Lock()
+		inProgress := server.save.inProgress
+		server.save.mutex.Unlock()
+		if !inProgress {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
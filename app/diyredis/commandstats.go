@@ -0,0 +1,90 @@
+package diyredis
+
+import (
+	"fmt"
+	"slices"
+	"sync/atomic"
+	"time"
+)
+
+// Counters reported by INFO commandstats, for one command.
+type commandStats struct {
+	calls    atomic.Int64
+	usec     atomic.Int64 // spent running the command, summed over all calls
+	rejected atomic.Int64 // refused before running, e.g. redirected in cluster mode
+	failed   atomic.Int64 // ran, but replied with an error
+
+	latency latencyHistogram // of the calls, for LATENCY HISTOGRAM
+}
+
+// One set of counters for every command there is, so that they can be looked up without
+// locking.
+func newCommandStats() map[string]*commandStats {
+	stats := make(map[string]*commandStats, len(commandTable))
+	for name := range commandTable {
+		stats[name] = &commandStats{}
+	}
+	return stats
+}
+
+// Count a call to the command that took d, and failed if failed is true.
+func (c *commandStats) record(d time.Duration, failed bool) {
+	c.calls.Add(1)
+	c.usec.Add(d.Microseconds())
+	c.latency.record(d)
+	if failed {
+		c.failed.Add(1)
+	}
+}
+
+func (c *commandStats) reset() {
+	c.calls.Store(0)
+	c.usec.Store(0)
+	c.rejected.Store(0)
+	c.failed.Store(0)
+	c.latency.reset()
+}
+
+// One line per command that was called or refused, in alphabetical order.
+func (s *Server) infoCommandStats() []string {
+	names := make([]string, 0, len(s.commandStats))
+	for name := range s.commandStats {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	var lines []string
+	for _, name := range names {
+		stats := s.commandStats[name]
+		calls, usec := stats.calls.Load(), stats.usec.Load()
+		rejected, failed := stats.rejected.Load(), stats.failed.Load()
+		if calls == 0 && rejected == 0 {
+			continue
+		}
+		perCall := 0.0
+		if calls > 0 {
+			perCall = float64(usec) / float64(calls)
+		}
+		lines = append(lines, fmt.Sprintf("cmdstat_%s:calls=%d,usec=%d,usec_per_call=%.2f,rejected_calls=%d,failed_calls=%d",
+			name, calls, usec, perCall, rejected, failed))
+	}
+	return lines
+}
+
+// Zero the counters of INFO stats and INFO commandstats, as CONFIG RESETSTAT does.
+func (s *Server) resetStats() {
+	for _, stats := range s.commandStats {
+		stats.reset()
+	}
+	for i := range s.dbCount() {
+		db := s.db(i)
+		db.stats.hits.Store(0)
+		db.stats.misses.Store(0)
+		db.stats.expired.Store(0)
+		db.stats.evicted.Store(0)
+	}
+	s.accepts.rejected.Store(0)
+	s.repl.fullSyncs.Store(0)
+	s.repl.partialSyncs.Store(0)
+	s.repl.partialSyncErrs.Store(0)
+	s.lazyFree.freed.Store(0)
+}
@@ -0,0 +1,100 @@
+package diyredis
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCommandStats(t *testing.T) {
+	server := MakeServer()
+	session, conn := newTestSession(server)
+	run := func(cmd ...string) string {
+		conn.buf.Reset()
+		session.dispatch(cmd)
+		return conn.buf.String()
+	}
+
+	run("SET", "k", "v")
+	run("GET", "k")
+	run("GET", "k")
+	run("INCR", "k") // not an integer
+	info := run("INFO", "commandstats")
+	for _, want := range []string{
+		"# Commandstats\r\n",
+		"cmdstat_get:calls=2,usec=",
+		"cmdstat_incr:calls=1,usec=",
+		",rejected_calls=0,failed_calls=1\r\n",
+		"cmdstat_set:calls=1,usec=",
+	} {
+		if !strings.Contains(info, want) {
+			t.Errorf("got %q, want it to contain %q", info, want)
+		}
+	}
+	if strings.Contains(info, "cmdstat_del") {
+		t.Errorf("got %q, want only commands that were called", info)
+	}
+	if strings.Index(info, "cmdstat_get") > strings.Index(info, "cmdstat_set") {
+		t.Errorf("got %q, want the commands in alphabetical order", info)
+	}
+
+	// Only reported when asked for
+	if got := run("INFO"); strings.Contains(got, "cmdstat_") {
+		t.Errorf("INFO: got %q, want no commandstats", got)
+	}
+	if got := run("INFO", "everything"); !strings.Contains(got, "cmdstat_get") {
+		t.Errorf("INFO everything: got %q, want the commandstats", got)
+	}
+
+	// Rejected before running
+	run("REPLICAOF", "127.0.0.1", "1") // never connects, but makes us a read-only replica
+	if got := run("SET", "k", "v"); !strings.HasPrefix(got, "-READONLY") {
+		t.Fatalf("SET on a replica: got %q", got)
+	}
+	if got := run("INFO", "commandstats"); !strings.Contains(got, "cmdstat_set:calls=1,") || !strings.Contains(got, ",rejected_calls=1,failed_calls=0\r\n") {
+		t.Errorf("got %q, want SET to be rejected once", got)
+	}
+	run("REPLICAOF", "NO", "ONE")
+
+	if got := run("CONFIG", "RESETSTAT"); got != "+OK\r\n" {
+		t.Fatalf("CONFIG RESETSTAT: got %q", got)
+	}
+	if got := run("INFO", "commandstats"); strings.Contains(got, "cmdstat_get") {
+		t.Errorf("got %q after CONFIG RESETSTAT, want no counts", got)
+	}
+	if got := run("INFO", "stats"); !strings.Contains(got, "keyspace_hits:0\r\n") {
+		t.Errorf("got %q after CONFIG RESETSTAT, want no hits", got)
+	}
+}
+
+func TestLatencyHistogram(t *testing.T) {
+	server := MakeServer()
+	session, conn := newTestSession(server)
+	run := func(cmd ...string) string {
+		conn.buf.Reset()
+		session.dispatch(cmd)
+		return conn.buf.String()
+	}
+
+	run("GET", "k")
+	run("GET", "k")
+	got := run("LATENCY", "HISTOGRAM", "get", "GET", "set", "nosuchcommand")
+	if want := "*2\r\n$3\r\nget\r\n*4\r\n$5\r\ncalls\r\n:2\r\n$14\r\nhistogram_usec\r\n"; !strings.HasPrefix(got, want) || !strings.HasSuffix(got, ":2\r\n") {
+		t.Errorf("LATENCY HISTOGRAM get: got %q", got)
+	}
+
+	// Buckets are powers of two, with cumulative counts, for the buckets that have any
+	server.resetStats()
+	latency := &server.commandStats["echo"].latency
+	for _, d := range []time.Duration{0, time.Microsecond, 3 * time.Microsecond, 4 * time.Microsecond, 1000 * time.Microsecond, time.Hour} {
+		latency.record(d)
+	}
+	want := "*2\r\n$4\r\necho\r\n*4\r\n$5\r\ncalls\r\n:6\r\n$14\r\nhistogram_usec\r\n" +
+		"*8\r\n:1\r\n:2\r\n:4\r\n:4\r\n:1024\r\n:5\r\n:1048576\r\n:6\r\n"
+	if got := run("LATENCY", "HISTOGRAM"); got != want {
+		t.Errorf("LATENCY HISTOGRAM: got %q, want %q", got, want)
+	}
+	if got := run("LATENCY", "HISTORY", "event"); !strings.HasPrefix(got, "-ERR unknown subcommand") {
+		t.Errorf("LATENCY HISTORY: got %q", got)
+	}
+}
@@ -0,0 +1,262 @@
+package diyredis
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// A line of a configuration file, in the same format as redis.conf: the name of the
+// directive, followed by its value.
+type ConfigDirective struct {
+	Name  string
+	Value string
+}
+
+// Read the directives of a configuration file. Blank lines and lines starting with "#"
+// are skipped, and a value may be put between double quotes, e.g. save "".
+func ReadConfigFile(filename string) ([]ConfigDirective, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var directives []ConfigDirective
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, _ := strings.Cut(line, " ")
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+			value = value[1 : len(value)-1]
+		}
+		directives = append(directives, ConfigDirective{strings.ToLower(name), value})
+	}
+	return directives, scanner.Err()
+}
+
+// Change a setting while running, as CONFIG SET does. Only loglevel, logfile,
+// protected-mode, lazyfree-lazy-expire, lazyfree-lazy-user-del, lfu-log-factor,
+// lfu-decay-time, rdb-incremental, rdb-incremental-segments, tiered-threshold and
+// tiered-hot-memory can be; ok is false for anything else.
+func (s *Server) setConfig(name string, value string) (ok bool, uerr *UserError) {
+	apply, ok, uerr := s.parseConfig(name, value)
+	if !ok || uerr != nil {
+		return ok, uerr
+	}
+	return true, apply()
+}
+
+// Check value for the setting name, as setConfig would, and return what changes the
+// setting to it. It can still fail, e.g. if the log file can't be opened by then.
+func (s *Server) parseConfig(name string, value string) (apply func() *UserError, ok bool, uerr *UserError) {
+	switch name {
+	case "loglevel":
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(value)); err != nil {
+			return nil, true, &UserError{"ERR", "invalid log level, must be one of debug, info, warn or error"}
+		}
+		return func() *UserError { s.LogLevel.Set(level); return nil }, true, nil
+	case "logfile":
+		if value != "" {
+			file, err := os.OpenFile(value, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+			if err != nil {
+				return nil, true, &UserError{"ERR", "can't open the log file: " + err.Error()}
+			}
+			file.Close()
+		}
+		return func() *UserError {
+			if err := s.SetLogFile(value); err != nil {
+				return &UserError{"ERR", "can't open the log file: " + err.Error()}
+			}
+			return nil
+		}, true, nil
+	case "protected-mode":
+		return parseYesNo(&s.ProtectedMode, value)
+	case "lazyfree-lazy-expire":
+		return parseYesNo(&s.LazyFreeLazyExpire, value)
+	case "lazyfree-lazy-user-del":
+		return parseYesNo(&s.LazyFreeLazyUserDel, value)
+	case "lfu-log-factor":
+		return parseNonNegative(&s.LFU.LogFactor, value)
+	case "lfu-decay-time":
+		return parseNonNegative(&s.LFU.DecayTime, value)
+	case "rdb-incremental":
+		return parseYesNo(&s.RdbIncremental, value)
+	case "rdb-incremental-segments":
+		return parseNonNegative(&s.RdbIncrementalSegments, value)
+	case "tiered-threshold":
+		return parseNonNegative(&s.Tiered.Threshold, value)
+	case "tiered-hot-memory":
+		return parseNonNegative(&s.Tiered.HotMemory, value)
+	default:
+		return nil, false, nil
+	}
+}
+
+// Parse a boolean setting as CONFIG SET takes it, or as a command-line flag, e.g. "true",
+// since the config file is read as either.
+func parseYesNo(setting *atomic.Bool, value string) (apply func() *UserError, ok bool, uerr *UserError) {
+	var on bool
+	switch strings.ToLower(value) {
+	case "yes":
+		on = true
+	case "no":
+		on = false
+	default:
+		var err error
+		if on, err = strconv.ParseBool(value); err != nil {
+			return nil, true, &UserError{"ERR", "argument must be 'yes' or 'no'"}
+		}
+	}
+	return func() *UserError { setting.Store(on); return nil }, true, nil
+}
+
+// Parse a numeric setting, which can't be negative.
+func parseNonNegative(setting *atomic.Int64, value string) (apply func() *UserError, ok bool, uerr *UserError) {
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return nil, true, &UserError{"ERR", "argument must be a non-negative integer"}
+	}
+	return func() *UserError { setting.Store(n); return nil }, true, nil
+}
+
+// A boolean setting, as CONFIG GET reports it.
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+// Read ConfigFile again, applying the settings that can be changed while running. The
+// others only take effect on a restart, and are left alone, as are the settings in
+// ConfigOverrides, which win over the file as they did at startup. Nothing is applied if
+// any of the settings is invalid.
+func (s *Server) ReloadConfig() error {
+	if s.ConfigFile == "" {
+		return nil
+	}
+	directives, err := ReadConfigFile(s.ConfigFile)
+	if err != nil {
+		return err
+	}
+	var changes []func() *UserError
+	for _, directive := range directives {
+		if s.ConfigOverrides[directive.Name] {
+			continue
+		}
+		apply, ok, uerr := s.parseConfig(directive.Name, directive.Value)
+		if uerr != nil {
+			return fmt.Errorf("%s: %w", directive.Name, uerr)
+		}
+		if ok {
+			changes = append(changes, apply)
+		}
+	}
+	var errs []error
+	for _, apply := range changes {
+		if uerr := apply(); uerr != nil {
+			errs = append(errs, uerr)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Where Log writes to: stderr, or a file that can be reopened once it has been rotated.
+type logOutput struct {
+	mutex    sync.Mutex
+	filename string // "" for stderr
+	file     *os.File
+}
+
+func (l *logOutput) name() string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.filename
+}
+
+func (l *logOutput) Write(p []byte) (int, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.file == nil {
+		return os.Stderr.Write(p)
+	}
+	return l.file.Write(p)
+}
+
+// Switch to filename, or to stderr if it is "". The current output is kept if the file
+// can't be opened.
+func (l *logOutput) open(filename string) error {
+	var file *os.File
+	if filename != "" {
+		var err error
+		file, err = os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+		if err != nil {
+			return err
+		}
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.file != nil {
+		l.file.Close()
+	}
+	l.filename, l.file = filename, file
+	return nil
+}
+
+// Log to filename instead of stderr, or to stderr again if it is "". Only applies to Log
+// as created by MakeServer.
+func (s *Server) SetLogFile(filename string) error {
+	return s.logOutput.open(filename)
+}
+
+// Open the log file again, so that logging continues in a new file once it has been
+// moved away by log rotation.
+func (s *Server) ReopenLogFile() error {
+	return s.logOutput.open(s.logOutput.name())
+}
+
+// Handle SIGHUP and SIGUSR1 until Start returns: SIGHUP reloads the configuration file,
+// and both reopen the log file.
+func (s *Server) handleSignals() (stop func()) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGUSR1)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for sig := range signals {
+			s.handleSignal(sig)
+		}
+	}()
+	return func() {
+		signal.Stop(signals)
+		close(signals)
+		<-done
+	}
+}
+
+func (s *Server) handleSignal(sig os.Signal) {
+	if sig == syscall.SIGHUP {
+		if err := s.ReloadConfig(); err != nil {
+			s.Log.Warn("Can't reload the configuration file", "file", s.ConfigFile, "err", err)
+		} else {
+			s.Log.Info("Configuration reloaded", "file", s.ConfigFile)
+		}
+	}
+	if err := s.ReopenLogFile(); err != nil {
+		s.Log.Warn("Can't reopen the log file", "err", err)
+	}
+}
@@ -0,0 +1,100 @@
+package diyredis
+
+import (
+	"log/slog"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestReadConfigFile(t *testing.T) {
+	fn := t.TempDir() + "/redis.conf"
+	conf := "# a comment\n\nloglevel warn\nSave \"\"\n  dir /tmp/data  \n"
+	if err := os.WriteFile(fn, []byte(conf), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	directives, err := ReadConfigFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ConfigDirective{{"loglevel", "warn"}, {"save", ""}, {"dir", "/tmp/data"}}
+	if !slices.Equal(directives, want) {
+		t.Errorf("got %v, want %v", directives, want)
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	dir := t.TempDir()
+	server := MakeServer()
+	server.ConfigFile = dir + "/redis.conf"
+	if err := os.WriteFile(server.ConfigFile, []byte("dir /elsewhere\nloglevel debug\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	server.handleSignal(syscall.SIGHUP)
+	if got := server.LogLevel.Level(); got != slog.LevelDebug {
+		t.Errorf("got level %v after reloading, want debug", got)
+	}
+	if server.RdbDir != "" {
+		t.Errorf("dir changed to %q, but can't be while running", server.RdbDir)
+	}
+
+	// An invalid setting is reported, and none of the others are applied either
+	os.WriteFile(server.ConfigFile, []byte("lfu-log-factor 3\nloglevel verbose\n"), 0o644)
+	if err := server.ReloadConfig(); err == nil {
+		t.Errorf("want an error for an invalid log level")
+	}
+	if got := server.LFU.LogFactor.Load(); got == 3 {
+		t.Errorf("lfu-log-factor changed to %d along with an invalid log level", got)
+	}
+
+	// Booleans as on the command line, which wins over the file
+	server.ConfigOverrides = map[string]bool{"loglevel": true}
+	os.WriteFile(server.ConfigFile, []byte("lazyfree-lazy-expire true\nloglevel warn\n"), 0o644)
+	if err := server.ReloadConfig(); err != nil {
+		t.Errorf("got %v", err)
+	}
+	if !server.LazyFreeLazyExpire.Load() {
+		t.Errorf("lazyfree-lazy-expire true wasn't applied")
+	}
+	if got := server.LogLevel.Level(); got != slog.LevelDebug {
+		t.Errorf("got level %v, want debug as on the command line", got)
+	}
+}
+
+func TestLogRotation(t *testing.T) {
+	dir := t.TempDir()
+	server := MakeServer()
+	session, conn := newTestSession(server)
+	run := func(cmd ...string) string {
+		conn.buf.Reset()
+		session.dispatch(cmd)
+		return conn.buf.String()
+	}
+
+	if got := run("CONFIG", "SET", "logfile", dir+"/redis.log"); got != "+OK\r\n" {
+		t.Fatalf("CONFIG SET logfile: got %q", got)
+	}
+	defer server.SetLogFile("")
+	server.Log.Info("before rotating")
+	if err := os.Rename(dir+"/redis.log", dir+"/redis.log.1"); err != nil {
+		t.Fatal(err)
+	}
+	server.handleSignal(syscall.SIGUSR1)
+	server.Log.Info("after rotating")
+
+	for fn, want := range map[string]string{"redis.log.1": "before rotating", "redis.log": "after rotating"} {
+		data, err := os.ReadFile(dir + "/" + fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lines := strings.Count(string(data), "\n"); lines != 1 || !strings.Contains(string(data), want) {
+			t.Errorf("%s: got %q, want just %q", fn, data, want)
+		}
+	}
+	if got := run("CONFIG", "GET", "logfile"); got != "*2\r\n$7\r\nlogfile\r\n$"+strconv.Itoa(len(dir+"/redis.log"))+"\r\n"+dir+"/redis.log\r\n" {
+		t.Errorf("CONFIG GET logfile: got %q", got)
+	}
+}
@@ -0,0 +1,222 @@
+package diyredis_test
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// These tests run the same commands against our server and a real Redis, and compare
+// the replies byte for byte. They only run if there is a Redis to compare with: one at
+// the address in DIYREDIS_CONFORMANCE_REDIS, which is flushed before every script, or
+// otherwise a redis-server of our own if there is one on the PATH.
+//
+// A failure here doesn't need to be a bug, but it is a difference clients can see.
+// Scripts should stay away from replies that legitimately differ between runs, such as
+// auto-generated stream IDs or the order of hash fields.
+
+var conformanceScripts = []struct {
+	name string
+	cmds [][]string
+}{
+	{"strings", [][]string{
+		{"SET", "k", "v"},
+		{"GET", "k"},
+		{"GET", "missing"},
+		{"APPEND", "k", "alue"},
+		{"GETRANGE", "k", "1", "-2"},
+		{"SET", "n", "10"},
+		{"INCR", "n"},
+		{"INCRBY", "n", "-20"},
+		{"INCR", "k"},
+		{"MSET", "a", "1", "b", "2"},
+		{"MGET", "a", "missing", "b"},
+		{"GETSET", "a", "3"},
+		{"EXISTS", "a", "b", "missing"},
+		{"DEL", "a", "missing"},
+		{"TYPE", "b"},
+	}},
+	{"expiry", [][]string{
+		{"SET", "k", "v", "EX", "100"},
+		{"TTL", "k"},
+		{"TTL", "missing"},
+		{"SET", "p", "v"},
+		{"PTTL", "p"},
+		{"SET", "k", "v", "EX", "0"},
+	}},
+	{"lists", [][]string{
+		{"RPUSH", "l", "b", "c"},
+		{"LPUSH", "l", "a"},
+		{"LRANGE", "l", "0", "-1"},
+		{"LRANGE", "l", "5", "10"},
+		{"LINDEX", "l", "-1"},
+		{"LLEN", "l"},
+		{"LPOP", "l"},
+		{"RPOP", "l", "5"},
+		{"LPOP", "l"},
+		{"TYPE", "l"},
+	}},
+	{"hashes", [][]string{
+		{"HSET", "h", "a", "1", "b", "2"},
+		{"HGET", "h", "a"},
+		{"HMGET", "h", "a", "missing"},
+		{"HLEN", "h"},
+		{"HEXISTS", "h", "b"},
+		{"HINCRBY", "h", "a", "5"},
+		{"HSETNX", "h", "a", "x"},
+		{"HDEL", "h", "a", "missing"},
+		{"TYPE", "h"},
+	}},
+	{"sets", [][]string{
+		{"SADD", "s", "a", "b", "a"},
+		{"SISMEMBER", "s", "a"},
+		{"SISMEMBER", "s", "c"},
+		{"SCARD", "s"},
+		{"SREM", "s", "a", "c"},
+		{"TYPE", "s"},
+	}},
+	{"streams", [][]string{
+		{"XADD", "x", "1-1", "a", "1"},
+		{"XADD", "x", "1-2", "b", "2"},
+		{"XADD", "x", "1-*", "c", "3"},
+		{"XADD", "x", "1-1", "d", "4"},
+		{"XADD", "x", "0-0", "d", "4"},
+		{"XLEN", "x"},
+		{"XRANGE", "x", "-", "+"},
+		{"XRANGE", "x", "(1-1", "+", "COUNT", "1"},
+		{"XREVRANGE", "x", "+", "-"},
+		{"XREAD", "STREAMS", "x", "1-2"},
+		{"XADD", "x", "MAXLEN", "1", "2-0", "e", "5"},
+		{"XRANGE", "x", "-", "+"},
+		{"TYPE", "x"},
+	}},
+	{"errors", [][]string{
+		{"SET", "k", "v"},
+		{"LPUSH", "k", "a"},
+		{"HGET", "k", "a"},
+		{"XRANGE", "k", "-", "+"},
+		{"GET"},
+		{"SET", "k", "v", "EX", "notanumber"},
+		{"NOSUCHCOMMAND"},
+	}},
+}
+
+func TestConformance(t *testing.T) {
+	redisAddr := os.Getenv("DIYREDIS_CONFORMANCE_REDIS")
+	if redisAddr == "" {
+		redisAddr = startRealRedis(t)
+	}
+
+	for _, script := range conformanceScripts {
+		t.Run(script.name, func(t *testing.T) {
+			ours, theirs := dial(t, startTestServer(t)), dial(t, redisAddr)
+			if _, err := theirs.do("FLUSHALL"); err != nil {
+				t.Fatal(err)
+			}
+			for _, cmd := range script.cmds {
+				got, err := ours.doRaw(cmd...)
+				if err != nil {
+					t.Fatalf("%q: %v", cmd, err)
+				}
+				want, err := theirs.doRaw(cmd...)
+				if err != nil {
+					t.Fatalf("%q against Redis: %v", cmd, err)
+				}
+				if string(got) != string(want) {
+					t.Errorf("%q: got %q, Redis replies %q", cmd, got, want)
+				}
+			}
+		})
+	}
+}
+
+// Start a redis-server from the PATH on a free port, stopped when the test ends, and
+// return its address. Skips the test if there is none.
+func startRealRedis(t *testing.T) string {
+	t.Helper()
+	path, err := exec.LookPath("redis-server")
+	if err != nil {
+		t.Skip("no Redis to compare with: set DIYREDIS_CONFORMANCE_REDIS, or put redis-server on the PATH")
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+	_, port, _ := net.SplitHostPort(addr)
+
+	cmd := exec.Command(path, "--bind", "127.0.0.1", "--port", port, "--save", "", "--appendonly", "no")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			conn.Close()
+			return addr
+		}
+	}
+	t.Fatalf("redis-server didn't start listening on %s", addr)
+	return ""
+}
+
+// Send a command and return its reply exactly as it was sent, e.g. for comparing it with
+// what a real Redis replies.
+func (c *respClient) doRaw(args ...string) ([]byte, error) {
+	if err := c.send(args...); err != nil {
+		return nil, err
+	}
+	return c.readRawReply(nil)
+}
+
+// Append the next reply, as it was sent, to buf.
+func (c *respClient) readRawReply(buf []byte) ([]byte, error) {
+	line, err := c.readLine()
+	if err != nil {
+		return nil, err
+	}
+	buf = append(buf, line+"\r\n"...)
+	switch line[0] {
+	case '+', '-', ':', '_', ',', '#', '(':
+		return buf, nil
+	case '$', '=', '!':
+		length, err := strconv.Atoi(line[1:])
+		if err != nil || length < 0 {
+			return buf, err
+		}
+		data := make([]byte, length+2)
+		if _, err := io.ReadFull(c.reader, data); err != nil {
+			return nil, err
+		}
+		return append(buf, data...), nil
+	case '*', '>', '~', '%', '|':
+		length, err := strconv.Atoi(line[1:])
+		if err != nil || length < 0 {
+			return buf, err
+		}
+		if line[0] == '%' || line[0] == '|' {
+			length *= 2
+		}
+		for range length {
+			if buf, err = c.readRawReply(buf); err != nil {
+				return nil, err
+			}
+		}
+		if line[0] == '|' {
+			return c.readRawReply(buf) // attributes come before the reply they are about
+		}
+		return buf, nil
+	}
+	return nil, fmt.Errorf("unknown reply type %q", line)
+}
@@ -0,0 +1,159 @@
+package diyredis
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Write a crash report to the log for a panic nothing recovered from, while serving
+// cmd for session. Call from a deferred function, so that the stack of the panic is
+// still there, before panicking again:
+//
+//	defer func() {
+//		if r := recover(); r != nil {
+//			s.server.reportCrash(r, s, cmd)
+//			panic(r)
+//		}
+//	}()
+func (s *Server) reportCrash(reason any, session *Session, cmd []string) {
+	s.writeCrashReport(s.logOutput, reason, session, cmd)
+}
+
+// Report a crash of one of the server's own goroutines, e.g. saveCron, as HandleCommands
+// does for the ones serving clients, before panicking again. Defer it first thing in the
+// goroutine:
+//
+//	go func() {
+//		defer s.reportCrashes()
+//		...
+//	}()
+func (s *Server) reportCrashes() {
+	if r := recover(); r != nil {
+		s.reportCrash(r, nil, nil)
+		panic(r)
+	}
+}
+
+// Sections are written one at a time, stack traces first, since getting INFO may hang
+// on a lock that whatever crashed was holding.
+func (s *Server) writeCrashReport(w io.Writer, reason any, session *Session, cmd []string) {
+	fmt.Fprintf(w, "\n=== DIY-REDIS BUG REPORT START: Cut & paste starting from here ===\n")
+	fmt.Fprintf(w, "diy-redis %s crashed: %v\n", s.Version, reason)
+
+	if session != nil {
+		fmt.Fprintf(w, "\n------ CURRENT CLIENT INFO ------\n")
+		fmt.Fprintf(w, "addr=%s db=%d\n", session.conn.RemoteAddr(), session.dbIndex)
+		fmt.Fprintf(w, "argc=%d argv=%s\n", len(cmd), crashArgs(cmd))
+	}
+
+	fmt.Fprintf(w, "\n------ STACK TRACES ------\n")
+	w.Write(allStacks())
+
+	fmt.Fprintf(w, "\n------ RECENT COMMANDS ------\n")
+	for _, recent := range s.recent.all() {
+		fmt.Fprintf(w, "addr=%s db=%d argc=%d argv=%s\n", recent.addr, recent.db, recent.argc, recent.argv)
+	}
+
+	fmt.Fprintf(w, "\n------ INFO OUTPUT ------\n")
+	io.WriteString(w, strings.ReplaceAll(s.infoText(func(infoSection) bool { return true }), "\r\n", "\n"))
+
+	fmt.Fprintf(w, "\n------ CONFIG ------\n")
+	for _, setting := range s.crashConfig() {
+		fmt.Fprintf(w, "%s\n", setting)
+	}
+	fmt.Fprintf(w, "\n=== DIY-REDIS BUG REPORT END. Make sure to include from START to END. ===\n\n")
+}
+
+// The arguments of cmd, quoted, with long ones shortened so that a huge value doesn't
+// drown the rest of the report.
+func crashArgs(cmd []string) string {
+	const maxArgs, maxLen = 16, 128
+	var b strings.Builder
+	for i, arg := range cmd {
+		if i == maxArgs {
+			fmt.Fprintf(&b, " ...(%d more)", len(cmd)-maxArgs)
+			break
+		}
+		if i > 0 {
+			b.WriteString(" ")
+		}
+		if len(arg) > maxLen {
+			arg = arg[:maxLen] + "..."
+		}
+		b.WriteString(strconv.Quote(arg))
+	}
+	return b.String()
+}
+
+// How many of the commands executed last a crash report shows.
+const recentCommandsLen = 16
+
+// The commands executed last by any client, for the crash report, since whatever crashed
+// may have been set up by one of them. Their arguments are kept as crashArgs has them
+// only, so that a huge value isn't kept around.
+type recentCommands struct {
+	next  atomic.Uint64
+	slots [recentCommandsLen]atomic.Pointer[recentCommand]
+}
+
+type recentCommand struct {
+	addr string // of the client
+	db   int
+	argc int
+	argv string
+}
+
+func (r *recentCommands) record(session *Session, cmd []string) {
+	recent := &recentCommand{session.info.addr, session.dbIndex, len(cmd), crashArgs(cmd)}
+	r.slots[(r.next.Add(1)-1)%recentCommandsLen].Store(recent)
+}
+
+// The commands recorded, oldest first. Commands recorded meanwhile may be left out.
+func (r *recentCommands) all() []*recentCommand {
+	next := r.next.Load()
+	var recent []*recentCommand
+	for i := next - min(next, recentCommandsLen); i < next; i++ {
+		if command := r.slots[i%recentCommandsLen].Load(); command != nil {
+			recent = append(recent, command)
+		}
+	}
+	return recent
+}
+
+// The stack traces of all goroutines, as printed by an unrecovered panic with
+// GOTRACEBACK=all.
+func allStacks() []byte {
+	buf := make([]byte, 64<<10)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			return buf[:n]
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
+
+// The settings worth knowing about when looking into a crash, as in the config file.
+func (s *Server) crashConfig() []string {
+	replicaOf := ""
+	if s.MasterHost != "" {
+		replicaOf = s.MasterHost + " " + s.MasterPort
+	}
+	return []string{
+		"configfile " + s.ConfigFile,
+		"dir " + s.RdbDir,
+		"dbfilename " + s.RdbFilename,
+		"databases " + strconv.Itoa(s.dbCount()),
+		"appendonly " + strconv.FormatBool(s.AppendOnly),
+		"cluster-enabled " + strconv.FormatBool(s.ClusterEnabled),
+		"sentinel " + strconv.FormatBool(s.Sentinel),
+		"protected-mode " + strconv.FormatBool(s.ProtectedMode.Load()),
+		"replicaof " + replicaOf,
+		"loglevel " + strings.ToLower(s.LogLevel.Level().String()),
+		"logfile " + s.logOutput.name(),
+	}
+}
@@ -0,0 +1,73 @@
+package diyredis
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func crashForTest() {
+	panic("boom")
+}
+
+func TestCrashReport(t *testing.T) {
+	server := MakeServer()
+	session, _ := newTestSession(server)
+	session.dispatch([]string{"SET", "before", strings.Repeat("v", 1000)})
+	conn, client := net.Pipe()
+	defer conn.Close()
+	defer client.Close()
+	session.conn = conn
+
+	var report bytes.Buffer
+	func() {
+		defer func() {
+			server.writeCrashReport(&report, recover(), session, []string{"SET", "k", strings.Repeat("v", 1000)})
+		}()
+		crashForTest()
+	}()
+
+	for _, want := range []string{
+		"crashed: boom\n",
+		`argv="SET" "k" "` + strings.Repeat("v", 128) + `..."` + "\n",
+		"diyredis.crashForTest(", // where it panicked, in the stack of the crashed goroutine
+		`db=0 argc=3 argv="set" "before" "` + strings.Repeat("v", 128) + `..."` + "\n",
+		"redis_version:",
+		"databases 16\n",
+		"BUG REPORT END",
+	} {
+		if !strings.Contains(report.String(), want) {
+			t.Errorf("report doesn't contain %q:\n%s", want, report.String())
+		}
+	}
+}
+
+func TestCrashArgs(t *testing.T) {
+	cmd := make([]string, 20)
+	for i := range cmd {
+		cmd[i] = "a"
+	}
+	if got, want := crashArgs(cmd), strings.Repeat(`"a" `, 15)+`"a" ...(4 more)`; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestRecentCommands(t *testing.T) {
+	var recent recentCommands
+	session := &Session{}
+	for i := range recentCommandsLen + 3 {
+		recent.record(session, []string{"INCR", strconv.Itoa(i)})
+	}
+	got := recent.all()
+	if len(got) != recentCommandsLen {
+		t.Fatalf("got %d commands, want %d", len(got), recentCommandsLen)
+	}
+	if want := `"INCR" "3"`; got[0].argv != want {
+		t.Errorf("got %s first, want %s", got[0].argv, want)
+	}
+	if want := `"INCR" "` + strconv.Itoa(recentCommandsLen+2) + `"`; got[len(got)-1].argv != want {
+		t.Errorf("got %s last, want %s", got[len(got)-1].argv, want)
+	}
+}
@@ -0,0 +1,11 @@
+package crc16
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCRC16(t *testing.T) {
+	assert.Equal(t, uint16(0x31c3), Checksum([]byte("123456789")))
+}
@@ -0,0 +1,683 @@
+package diyredis
+
+import (
+	"hash/maphash"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	streams "github.com/codecrafters-io/redis-starter-go/app/diyredis/streams"
+)
+
+type RedisDB struct {
+	id        uint
+	engine    Engine     // where the values and expiries of keys are stored
+	keys      *keyIndex  // of the keys, for picking keys at random
+	volatile  *keyIndex  // of the keys with an expiry, for picking those at random
+	ordered   *scanIndex // of the keys, in the order SCAN goes through them
+	snapshot  *dbSnapshot
+	stats     *dbStats
+	locks     *keyLocks
+	now       func() time.Time // what expirations are compared to
+	lfu       *sync.Map        // key -> *atomic.Uint32, its access frequency, see LFUConfig
+	lfuConfig *LFUConfig
+	dirty     *dirtyKeys // the keys changed since the last save, for CheckpointRdb
+
+	// Called as a key that expired is deleted, with the value it held, from within the
+	// change, so that whatever it does is ordered with the changes to the key; nil to do
+	// nothing.
+	expired func(db uint, key string, value any)
+}
+
+func newRedisDB(id uint, engine Engine, now func() time.Time, expired func(db uint, key string, value any), lfuConfig *LFUConfig, dirty *dirtyKeys) RedisDB {
+	return RedisDB{
+		id:        id,
+		engine:    engine,
+		keys:      newKeyIndex(),
+		volatile:  newKeyIndex(),
+		ordered:   newScanIndex(),
+		snapshot:  &dbSnapshot{},
+		stats:     &dbStats{},
+		locks:     &keyLocks{seed: maphash.MakeSeed()},
+		now:       now,
+		lfu:       &sync.Map{},
+		lfuConfig: lfuConfig,
+		dirty:     dirty,
+		expired:   expired,
+	}
+}
+
+// Return the database at index as it is right now. Sessions look their database up
+// again for every command, rather than holding on to it, so that it can be replaced
+// between commands (e.g. swapped with another, or flushed by starting over with an
+// empty one).
+func (s *Server) db(index int) RedisDB {
+	s.dbsMutex.RLock()
+	defer s.dbsMutex.RUnlock()
+	return s.dbs[index]
+}
+
+// The number of databases, which SELECT numbers from 0.
+func (s *Server) dbCount() int {
+	s.dbsMutex.RLock()
+	defer s.dbsMutex.RUnlock()
+	return len(s.dbs)
+}
+
+// Counters reported by INFO stats, summed over all databases.
+type dbStats struct {
+	hits    atomic.Int64 // reads of keys that existed
+	misses  atomic.Int64 // reads of keys that didn't
+	expired atomic.Int64 // keys deleted because they expired
+	evicted atomic.Int64 // keys deleted to free memory; there's no eviction yet, so always 0
+}
+
+func (s *Server) infoStats() []string {
+	var hits, misses, expired, evicted int64
+	for i := range s.dbCount() {
+		db := s.db(i)
+		hits += db.stats.hits.Load()
+		misses += db.stats.misses.Load()
+		expired += db.stats.expired.Load()
+		evicted += db.stats.evicted.Load()
+	}
+	return append([]string{
+		"expired_keys:" + strconv.FormatInt(expired, 10),
+		"evicted_keys:" + strconv.FormatInt(evicted, 10),
+		"keyspace_hits:" + strconv.FormatInt(hits, 10),
+		"keyspace_misses:" + strconv.FormatInt(misses, 10),
+		"rejected_connections:" + strconv.FormatInt(s.accepts.rejected.Load(), 10),
+		"sync_full:" + strconv.FormatInt(s.repl.fullSyncs.Load(), 10),
+		"sync_partial_ok:" + strconv.FormatInt(s.repl.partialSyncs.Load(), 10),
+		"sync_partial_err:" + strconv.FormatInt(s.repl.partialSyncErrs.Load(), 10),
+	}, s.infoLazyFree()...)
+}
+
+func (s *Server) infoKeyspace() []string {
+	var fields []string
+	for i := range s.dbCount() {
+		keys, expires, avgTTL := s.db(i).size()
+		if keys == 0 {
+			continue
+		}
+		fields = append(fields, "db"+strconv.Itoa(i)+":keys="+strconv.Itoa(keys)+
+			",expires="+strconv.Itoa(expires)+",avg_ttl="+strconv.FormatInt(avgTTL, 10))
+	}
+	return fields
+}
+
+// Point-in-time view of a database, for saving it while it keeps changing.
+//
+// Instead of copying the whole database up front, the original state of a key is copied
+// into the shadow map right before the key is first changed. The snapshot then consists
+// of the shadow map, plus whatever is still unchanged in the database itself.
+type dbSnapshot struct {
+	mutex  sync.RWMutex // held for reading while changing a key, for writing while starting or ending a snapshot
+	shadow *sync.Map    // key -> snapshotEntry; nil when no snapshot is being taken
+}
+
+// State of a key at the moment the snapshot was taken.
+type snapshotEntry struct {
+	value  any
+	expiry int64
+	exists bool
+}
+
+// Start a snapshot of every database at once, so that they are consistent with each
+// other too. Only one snapshot can be taken at a time, so this waits for any other to
+// end first.
+//
+// atSnapshot, if not nil, is called at the very moment the snapshot is taken, with no
+// write command running.
+func (s *Server) startSnapshot(atSnapshot func()) {
+	s.snapshotMutex.Lock()
+	s.repl.writes.Lock()
+	defer s.repl.writes.Unlock()
+	for i := range s.dbs {
+		s.dbs[i].snapshot.mutex.Lock()
+	}
+	for i := range s.dbs {
+		s.dbs[i].snapshot.shadow = &sync.Map{}
+	}
+	if atSnapshot != nil {
+		atSnapshot()
+	}
+	for i := range s.dbs {
+		s.dbs[i].snapshot.mutex.Unlock()
+	}
+}
+
+func (s *Server) endSnapshot() {
+	for i := range s.dbs {
+		s.dbs[i].snapshot.mutex.Lock()
+		s.dbs[i].snapshot.shadow = nil
+		s.dbs[i].snapshot.mutex.Unlock()
+	}
+	s.snapshotMutex.Unlock()
+}
+
+// Replace every database with the one at the same index in dbs, e.g. with a dataset
+// loaded from somewhere else. Clients blocked on the old data are woken up.
+func (s *Server) replaceDBs(dbs []RedisDB) {
+	old := make([]RedisDB, len(dbs))
+	func() {
+		s.snapshotMutex.Lock()
+		defer s.snapshotMutex.Unlock()
+		s.dbsMutex.Lock()
+		defer s.dbsMutex.Unlock()
+		for i := range dbs {
+			dbs[i].stats = s.dbs[i].stats // the counters are about the server, not the data
+			old[i] = s.dbs[i]
+			s.dbs[i] = dbs[i]
+		}
+		// What's on disk has nothing to do with the new data
+		s.checkpoint.dirty.swap(false)
+	}()
+
+	for _, db := range old {
+		db.engine.Scan(func(_ string, value any) bool {
+			if stream, ok := value.(*streams.Stream); ok {
+				stream.Close()
+			}
+			return true
+		})
+	}
+	s.signalAllBlocked()
+}
+
+// Every change to the keyspace has to go through here, so that a snapshot in progress
+// gets to see the key the way it was first, and the key indexes know about it.
+func (db RedisDB) modify(key string, change func()) {
+	db.snapshot.mutex.RLock()
+	defer db.snapshot.mutex.RUnlock()
+
+	if shadow := db.snapshot.shadow; shadow != nil {
+		if _, saved := shadow.Load(key); !saved {
+			value, exists := db.engine.Get(key)
+			expiry, _ := db.engine.Expiry(key)
+			// Only the first change gets to save the original state
+			shadow.LoadOrStore(key, snapshotEntry{cloneForSnapshot(value), expiry, exists})
+		}
+	}
+	old, _ := db.engine.Get(key)
+	change()
+	db.keys.update(key, func() bool {
+		_, ok := db.engine.Get(key)
+		return ok
+	})
+	db.volatile.update(key, func() bool {
+		_, ok := db.engine.Expiry(key)
+		return ok
+	})
+	db.ordered.update(key, func() bool {
+		_, ok := db.engine.Get(key)
+		return ok
+	})
+	if _, exists := db.engine.Get(key); !exists {
+		db.lfu.Delete(key) // a key created again starts over
+	}
+	db.dirty.mark(db.id, key)
+
+	// A stream that's no longer there ends its subscriptions
+	if stream, ok := old.(*streams.Stream); ok {
+		if value, _ := db.engine.Get(key); value != old {
+			stream.Close()
+		}
+	}
+}
+
+// Return a copy of value that won't change along with the original.
+func cloneForSnapshot(value any) any {
+	// Strings and integers are immutable. Streams are changed in place, but a
+	// streams.Snapshot of one stays the way it is without copying anything.
+	switch val := value.(type) {
+	case *streams.Stream:
+		snapshot := val.Snapshot()
+		return &snapshot
+	case *hashValue:
+		return val.clone()
+	case *listValue:
+		return val.clone()
+	case *setValue:
+		return val.clone()
+	}
+	return value
+}
+
+// Delete key if it has expired, reporting whether it did (or had already been by the
+// time we got to it). This is the one place expired keys are dealt with: every command
+// that looks at a key gets there through load, so that for all of them an expired key
+// is the same as one that doesn't exist, and it is gone after the first look.
+//
+// An expired key is deleted under its lock, the one set stores a value and its expiry
+// under, so that it's never a new value that gets deleted for the old expiry, or the
+// other way around.
+func (db RedisDB) expireIfNeeded(key string) bool {
+	if expiry, ok := db.engine.Expiry(key); !ok || expiry > db.nowMs() {
+		return false
+	}
+	defer db.locks.lock(key).Unlock()
+	return db.expireLocked(key)
+}
+
+// Like expireIfNeeded, for callers that hold the lock of key, for reading or writing.
+func (db RedisDB) expireLocked(key string) bool {
+	expiry, ok := db.engine.Expiry(key)
+	if !ok || expiry > db.nowMs() {
+		return false
+	}
+	value, ok := db.engine.Get(key)
+	if !ok {
+		return true
+	}
+
+	expired := false
+	db.modify(key, func() {
+		// Unless someone else beat us to it and set a new value
+		if db.engine.CompareAndPersist(key, expiry) && db.engine.CompareAndDelete(key, value) {
+			db.stats.expired.Add(1)
+			expired = true
+			if db.expired != nil {
+				db.expired(db.id, key, value)
+			}
+		}
+	})
+	return expired
+}
+
+// How often the active expire cycle runs, how many keys with an expiry it looks at in a
+// database at a time, and for how long it may keep at it.
+const (
+	activeExpirePeriod = 100 * time.Millisecond
+	activeExpireSample = 20
+	activeExpireBudget = activeExpirePeriod / 4
+)
+
+// Delete expired keys that nobody looks at anymore, which would otherwise stay around
+// forever, for as long as the server runs.
+func (s *Server) expireCron() {
+	defer s.reportCrashes()
+	for range time.Tick(activeExpirePeriod) {
+		s.activeExpire()
+	}
+}
+
+// One round of the active expire cycle, as done by Redis: sample keys with an expiry in
+// every database, deleting those that expired, and keep at it while more than a quarter
+// of them had, since there are probably many more.
+func (s *Server) activeExpire() {
+	if s.repl.link.Load() != nil {
+		return // a replica leaves it to its master, and gets its DELs
+	}
+	deadline := time.Now().Add(activeExpireBudget)
+	for i := range s.dbCount() {
+		db := s.db(i)
+		for time.Now().Before(deadline) {
+			keys := db.volatile.sample(activeExpireSample)
+			expired := 0
+			for _, key := range keys {
+				if db.expireIfNeeded(key) {
+					expired++
+				}
+			}
+			if len(keys) < activeExpireSample || expired <= len(keys)/4 {
+				break
+			}
+		}
+	}
+}
+
+// Called as a key is deleted because it expired, see RedisDB.expired.
+func (s *Server) keyExpired(db uint, key string, value any) {
+	s.propagateExpired(db, key)
+	if journal := s.journal.Load(); journal != nil {
+		journal.recordExpired(s.now(), db, key)
+	}
+	s.freeValue(value, s.LazyFreeLazyExpire.Load())
+	// Wake the clients blocked on it, e.g. XREADs of a stream that's gone now. Not right
+	// here, in the middle of the change.
+	if s.blocking.count.Load() > 0 {
+		go s.signalKeysReady(db, []string{key})
+	}
+}
+
+// Propagate the deletion of a key that expired as a DEL, so that replicas delete it at
+// the same point in the stream of changes as we did, rather than when their own clock
+// says so, and don't have to go looking for expired keys themselves.
+func (s *Server) propagateExpired(db uint, key string) {
+	if s.repl.link.Load() != nil {
+		return // the DEL of our master is what our replicas go by
+	}
+	s.propagate(int(db), []string{"DEL", key})
+}
+
+// Return the value of key, along with its expiry (zero if it has none). Expired keys are
+// reported as missing, and deleted on the spot. This counts as an access of the key, for
+// its access frequency.
+func (db RedisDB) load(key string) (any, int64, bool) {
+	value, expiry, ok := db.peek(key)
+	if ok {
+		db.countAccess(key)
+	}
+	return value, expiry, ok
+}
+
+// Like load, for callers that hold the lock of key, for reading or writing.
+func (db RedisDB) loadLocked(key string) (any, int64, bool) {
+	value, expiry, ok := db.peekLocked(key)
+	if ok {
+		db.countAccess(key)
+	}
+	return value, expiry, ok
+}
+
+// Like load, but without counting as an access of the key, for commands that only look at
+// what's there, e.g. TYPE and KEYS, as with Redis' LOOKUP_NOTOUCH.
+func (db RedisDB) peek(key string) (any, int64, bool) {
+	if db.expireIfNeeded(key) {
+		return nil, 0, false
+	}
+	return db.current(key)
+}
+
+// Like peek, for callers that hold the lock of key, for reading or writing.
+func (db RedisDB) peekLocked(key string) (any, int64, bool) {
+	if db.expireLocked(key) {
+		return nil, 0, false
+	}
+	return db.current(key)
+}
+
+// The value of key and its expiry, once it was deleted if it had expired.
+func (db RedisDB) current(key string) (any, int64, bool) {
+	value, ok := db.engine.Get(key)
+	if !ok {
+		return nil, 0, false
+	}
+	expiry, ok := db.engine.Expiry(key)
+	if !ok {
+		return value, 0, true
+	}
+	if expiry <= db.nowMs() {
+		return nil, 0, false // expired just now, it's deleted by the next look
+	}
+	return value, expiry, true
+}
+
+// The number of keys in the database, of those with an expiry, and their average time
+// to live in milliseconds. Keys that expired are deleted first, going through them all,
+// so that none of these counts a key that every command would say doesn't exist.
+func (db RedisDB) size() (keys, expires int, avgTTL int64) {
+	var ttls int64
+	now := db.nowMs()
+	for _, key := range db.volatile.all() {
+		if db.expireIfNeeded(key) {
+			continue
+		}
+		if expiry, ok := db.engine.Expiry(key); ok {
+			ttls += expiry - now
+			expires++
+		}
+	}
+	if expires > 0 {
+		avgTTL = ttls / int64(expires)
+	}
+	return db.keys.len(), expires, avgTTL
+}
+
+// The current time as a Unix time in milliseconds, which is what expiries are.
+func (db RedisDB) nowMs() int64 {
+	return db.now().UnixMilli()
+}
+
+// Like load, for commands that read the key, counting the read as a keyspace hit or miss.
+func (db RedisDB) loadRead(key string) (any, int64, bool) {
+	value, expiry, ok := db.load(key)
+	db.countRead(ok)
+	return value, expiry, ok
+}
+
+// Count a read of a key as a keyspace hit if it existed, or a miss otherwise.
+func (db RedisDB) countRead(found bool) {
+	if found {
+		db.stats.hits.Add(1)
+	} else {
+		db.stats.misses.Add(1)
+	}
+}
+
+// Return the value of key, storing value if there is none.
+func (db RedisDB) loadOrStore(key string, value any) any {
+	if existing, _, ok := db.load(key); ok {
+		return existing
+	}
+	var actual any
+	db.modify(key, func() { actual, _ = db.engine.SetIfAbsent(key, value) })
+	return actual
+}
+
+// Locks taken by compute, computeInPlace and lockKeys. Keys share a fixed number of
+// them, so that there's no lock to create and clean up for every key.
+type keyLocks struct {
+	seed    maphash.Seed
+	mutexes [256]sync.RWMutex
+}
+
+// The index of the lock of key.
+func (l *keyLocks) index(key string) int {
+	return int(maphash.String(l.seed, key) % uint64(len(l.mutexes)))
+}
+
+func (l *keyLocks) lock(key string) *sync.RWMutex {
+	mutex := &l.mutexes[l.index(key)]
+	mutex.Lock()
+	return mutex
+}
+
+// Lock all of keys up front, for commands that change or read several keys at once
+// (e.g. MSET and MGET), so that they see and leave them consistent: for writing if write
+// is true, and for reading otherwise. The locks are taken in the order of their index,
+// so that commands locking keys in common can't deadlock, and keys sharing a lock take it
+// once. Nothing may compute on one of keys until unlock is called.
+func (l *keyLocks) lockKeys(keys []string, write bool) (unlock func()) {
+	indexes := make([]int, len(keys))
+	for i, key := range keys {
+		indexes[i] = l.index(key)
+	}
+	slices.Sort(indexes)
+	indexes = slices.Compact(indexes)
+	for _, i := range indexes {
+		if write {
+			l.mutexes[i].Lock()
+		} else {
+			l.mutexes[i].RLock()
+		}
+	}
+	return func() {
+		for _, i := range indexes {
+			if write {
+				l.mutexes[i].Unlock()
+			} else {
+				l.mutexes[i].RUnlock()
+			}
+		}
+	}
+}
+
+// Replace the value of key with what fn makes of the current one (nil and false if there
+// is none), atomically: computes on the same key run one at a time, and fn runs again
+// if the key was changed otherwise in the meantime, so that it's never based on an
+// outdated value. The key keeps its expiry if keepTTL is true and it already existed.
+// Nothing changes if fn returns an error, which is returned.
+func (db RedisDB) compute(key string, keepTTL bool, fn func(old any, exists bool) (any, *UserError)) *UserError {
+	defer db.locks.lock(key).Unlock()
+	for {
+		old, _, exists := db.loadLocked(key)
+		value, uerr := fn(old, exists)
+		if uerr != nil {
+			return uerr
+		}
+		swapped := false
+		db.modify(key, func() {
+			if exists {
+				swapped = db.engine.CompareAndSwap(key, old, value)
+			} else {
+				_, loaded := db.engine.SetIfAbsent(key, value)
+				swapped = !loaded
+			}
+			if swapped && (!exists || !keepTTL) {
+				db.engine.Persist(key)
+			}
+		})
+		if swapped {
+			return nil
+		}
+	}
+}
+
+// Like compute, for values that are changed in place, e.g. collections: fn changes the
+// current value of key (nil and false if there is none), or makes a new one, and returns
+// what the key is to hold from then on, nil to delete it. fn runs from within the change,
+// so that a snapshot in progress gets to save the value before it's changed, and only
+// while the key still holds the value fn gets, so that nothing is written to a value no
+// longer stored, e.g. a collection deleted for having been emptied in the meantime. fn
+// may run again, so it mustn't add to what an earlier run left behind.
+func (db RedisDB) computeInPlace(key string, fn func(old any, exists bool) (any, *UserError)) *UserError {
+	defer db.locks.lock(key).Unlock()
+	for {
+		old, _, exists := db.loadLocked(key)
+		var uerr *UserError
+		swapped := false
+		db.modify(key, func() {
+			if current, ok := db.engine.Get(key); ok != exists || ok && current != old {
+				return // changed otherwise since, e.g. expired
+			}
+			var value any
+			if value, uerr = fn(old, exists); uerr != nil {
+				swapped = true
+				return
+			}
+			switch {
+			case value == nil && !exists:
+				swapped = true
+			case value == nil:
+				swapped = db.engine.CompareAndDelete(key, old)
+			case !exists:
+				_, loaded := db.engine.SetIfAbsent(key, value)
+				swapped = !loaded
+			default:
+				swapped = db.engine.CompareAndSwap(key, old, value)
+			}
+			if swapped && (value == nil || !exists) {
+				db.engine.Persist(key)
+			}
+		})
+		if swapped {
+			return uerr
+		}
+	}
+}
+
+// Store value under key, replacing any existing value and expiry. A zero expiry means
+// the key won't expire. Must be called with the lock of key held, unless nobody else can
+// get to the database yet, so that the value and its expiry are stored as one.
+func (db RedisDB) set(key string, value any, expiry int64) {
+	db.modify(key, func() {
+		db.engine.Set(key, value)
+		if expiry == 0 {
+			db.engine.Persist(key)
+		} else {
+			db.engine.Expire(key, expiry)
+		}
+	})
+}
+
+func (db RedisDB) store(key string, value any) {
+	db.modify(key, func() { db.engine.Set(key, value) })
+}
+
+func (db RedisDB) storeExpiry(key string, expiry int64) {
+	db.modify(key, func() { db.engine.Expire(key, expiry) })
+}
+
+func (db RedisDB) deleteExpiry(key string) {
+	db.modify(key, func() { db.engine.Persist(key) })
+}
+
+// Delete the key along with its expiry.
+func (db RedisDB) delete(key string) {
+	db.modify(key, func() {
+		db.engine.Delete(key)
+		db.engine.Persist(key)
+	})
+}
+
+// Must be called before changing the value of key in place, e.g. adding an entry to a
+// stream.
+func (db RedisDB) touch(key string) {
+	db.modify(key, func() {})
+}
+
+// The value and expiry (zero if it has none) of key in the snapshot currently being
+// taken, the same way rangeSnapshot has them.
+func (db RedisDB) snapshotKey(key string) (any, int64, bool) {
+	db.snapshot.mutex.RLock()
+	shadow := db.snapshot.shadow
+	db.snapshot.mutex.RUnlock()
+	if shadow == nil {
+		panic("snapshotKey called without a snapshot in progress")
+	}
+
+	value, exists := db.engine.Get(key)
+	value = cloneForSnapshot(value)
+	expiry, _ := db.engine.Expiry(key)
+	if val, changed := shadow.Load(key); changed {
+		entry := val.(snapshotEntry)
+		return entry.value, entry.expiry, entry.exists
+	}
+	return value, expiry, exists
+}
+
+// Call fn for every key in the snapshot currently being taken, with its value and expiry
+// (zero if it has none) at the time the snapshot was started. Stops when fn returns
+// false.
+func (db RedisDB) rangeSnapshot(fn func(key string, value any, expiry int64) bool) {
+	db.snapshot.mutex.RLock()
+	shadow := db.snapshot.shadow
+	db.snapshot.mutex.RUnlock()
+	if shadow == nil {
+		panic("rangeSnapshot called without a snapshot in progress")
+	}
+
+	// First the keys that haven't changed (yet). Since the original state is saved before
+	// changing a key, a key that isn't in the shadow map *after* copying its value is
+	// unchanged, and so is the copy.
+	visited := make(map[string]struct{})
+	cont := true
+	db.engine.Scan(func(key string, value any) bool {
+		value = cloneForSnapshot(value)
+		expiry, _ := db.engine.Expiry(key)
+		if _, changed := shadow.Load(key); changed {
+			return true
+		}
+		visited[key] = struct{}{}
+		cont = fn(key, value, expiry)
+		return cont
+	})
+	if !cont {
+		return
+	}
+
+	// Then the original state of the keys that did change. Keys that changed after we
+	// visited them above are skipped, as are those that didn't exist yet.
+	shadow.Range(func(k any, val any) bool {
+		key := k.(string)
+		entry := val.(snapshotEntry)
+		if _, ok := visited[key]; ok || !entry.exists {
+			return true
+		}
+		return fn(key, entry.value, entry.expiry)
+	})
+}
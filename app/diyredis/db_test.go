@@ -0,0 +1,437 @@
+package diyredis
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Return the string value stored under key, in its string representation.
+func loadString(db RedisDB, key string) (string, bool) {
+	value, ok := db.engine.Get(key)
+	if !ok {
+		return "", false
+	}
+	return stringValue(value)
+}
+
+func collectSnapshot(db RedisDB) map[string]any {
+	got := map[string]any{}
+	db.rangeSnapshot(func(key string, value any, expiry int64) bool {
+		if _, ok := got[key]; ok {
+			panic("key visited twice: " + key)
+		}
+		got[key] = value
+		return true
+	})
+	return got
+}
+
+func TestSnapshot(t *testing.T) {
+	server := MakeServer()
+	db := server.dbs[0]
+	db.store("unchanged", "1")
+	db.store("changed", "2")
+	db.store("deleted", "3")
+	expiry := time.Now().Add(time.Hour).UnixMilli()
+	db.storeExpiry("changed", expiry)
+
+	server.startSnapshot(nil)
+	db.store("changed", "new")
+	db.store("changed", "newer")
+	db.deleteExpiry("changed")
+	db.delete("deleted")
+	db.store("added", "4")
+
+	got := collectSnapshot(db)
+	want := map[string]any{"unchanged": "1", "changed": "2", "deleted": "3"}
+	if len(got) != len(want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	for key, value := range want {
+		if got[key] != value {
+			t.Errorf("got %v for %q, want %v", got[key], key, value)
+		}
+	}
+	db.rangeSnapshot(func(key string, value any, exp int64) bool {
+		if key == "changed" && exp != expiry {
+			t.Errorf("got expiry %v, want %v", exp, expiry)
+		}
+		return true
+	})
+	server.endSnapshot()
+
+	if value, _ := db.engine.Get("changed"); value != "newer" {
+		t.Errorf("got %v, want the database itself to have changed", value)
+	}
+}
+
+func TestSnapshotConcurrentWrites(t *testing.T) {
+	server := MakeServer()
+	db := server.dbs[0]
+	for i := range 1000 {
+		db.store("key"+strconv.Itoa(i), i)
+	}
+
+	server.startSnapshot(nil)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := range 1000 {
+			key := "key" + strconv.Itoa(i)
+			if i%2 == 0 {
+				db.delete(key)
+			} else {
+				db.store(key, -1)
+			}
+			db.store("new"+key, -1)
+		}
+	}()
+	got := collectSnapshot(db)
+	wg.Wait()
+	server.endSnapshot()
+
+	if len(got) != 1000 {
+		t.Errorf("got %d keys in the snapshot, want 1000", len(got))
+	}
+	for key, value := range got {
+		if value == -1 {
+			t.Errorf("snapshot has the new value for %q", key)
+		}
+	}
+}
+
+func TestCompute(t *testing.T) {
+	server := MakeServer()
+	db := server.dbs[0]
+	increment := func(value any, exists bool) (any, *UserError) {
+		n, _ := value.(int)
+		return n + 1, nil
+	}
+
+	// Increments aren't lost, even with plain stores to other keys going on
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 200 {
+				db.compute("counter", true, increment)
+				db.store("other"+strconv.Itoa(i), i)
+			}
+		}()
+	}
+	wg.Wait()
+	if value, _, _ := db.load("counter"); value != 1600 {
+		t.Errorf("got %v after concurrent increments, want 1600", value)
+	}
+
+	// The expiry is kept unless asked otherwise, and nothing changes on error
+	expiry := time.Now().Add(time.Hour).UnixMilli()
+	db.set("counter", 0, expiry)
+	db.compute("counter", true, increment)
+	if value, exp, _ := db.load("counter"); value != 1 || exp != expiry {
+		t.Errorf("got (%v, %v), want (1, %v)", value, exp, expiry)
+	}
+	uerr := db.compute("counter", true, func(any, bool) (any, *UserError) { return nil, ErrWrongType() })
+	if value, _, _ := db.load("counter"); uerr == nil || value != 1 {
+		t.Errorf("got (%v, %v) after an error", value, uerr)
+	}
+	db.compute("counter", false, increment)
+	if value, exp, _ := db.load("counter"); value != 2 || exp != 0 {
+		t.Errorf("got (%v, %v), want (2, 0)", value, exp)
+	}
+}
+
+func TestLockKeys(t *testing.T) {
+	server := MakeServer()
+	writer, _ := newTestSession(server)
+	reader, conn := newTestSession(server)
+
+	// MGET never sees an MSET half done
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := range 500 {
+			v := strconv.Itoa(i % 10)
+			writer.dispatch([]string{"MSET", "a", v, "b", v, "a", v}) // a twice takes its lock once
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		conn.buf.Reset()
+		reader.dispatch([]string{"MGET", "a", "b"})
+		if lines := strings.Split(conn.buf.String(), "\r\n"); len(lines) == 6 && lines[2] != lines[4] {
+			t.Fatalf("got %q, a and b differ", conn.buf.String())
+		}
+	}
+}
+
+func TestSnapshotCollections(t *testing.T) {
+	server := MakeServer()
+	session, _ := newTestSession(server)
+	session.dispatch([]string{"RPUSH", "list", "a", "b"})
+
+	server.startSnapshot(nil)
+	session.dispatch([]string{"RPUSH", "list", "c"})
+	got := collectSnapshot(session.db)
+	server.endSnapshot()
+
+	list := got["list"].(*listValue)
+	if elems := list.slice(0, list.len()-1); len(elems) != 2 {
+		t.Errorf("got %v, want the list as it was when the snapshot started", elems)
+	}
+}
+
+func TestKeyspaceStats(t *testing.T) {
+	server := MakeServer()
+	session, conn := newTestSession(server)
+	info := func() string {
+		conn.buf.Reset()
+		session.dispatch([]string{"INFO", "stats"})
+		return conn.buf.String()
+	}
+
+	session.dispatch([]string{"SET", "k", "v"})
+	session.dispatch([]string{"SET", "short", "v", "PX", "1"})
+	session.dispatch([]string{"HSET", "h", "f", "v"})
+	time.Sleep(5 * time.Millisecond)
+	session.dispatch([]string{"GET", "k"})          // hit
+	session.dispatch([]string{"GET", "missing"})    // miss
+	session.dispatch([]string{"GET", "short"})      // miss, and expires it
+	session.dispatch([]string{"MGET", "k", "nope"}) // hit and miss
+	session.dispatch([]string{"HGET", "h", "f"})    // hit
+	session.dispatch([]string{"HDEL", "h", "x"})    // a write, not counted
+	session.SwitchDB(1)
+	session.dispatch([]string{"GET", "k"}) // miss, in another database
+
+	got := info()
+	for _, want := range []string{"expired_keys:1\r\n", "evicted_keys:0\r\n", "keyspace_hits:3\r\n", "keyspace_misses:4\r\n"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("got %q, want it to contain %q", got, want)
+		}
+	}
+}
+
+func TestDBSize(t *testing.T) {
+	server := MakeServer()
+	clock := newFakeClock(time.Unix(1700000000, 0))
+	server.Clock = clock
+	session, conn := newTestSession(server)
+	run := func(cmd ...string) string {
+		conn.buf.Reset()
+		session.dispatch(cmd)
+		return conn.buf.String()
+	}
+
+	run("SET", "k", "v")
+	run("SET", "short", "v", "PX", "100")
+	run("SET", "long", "v", "PX", "10000")
+	if got := run("DBSIZE"); got != ":3\r\n" {
+		t.Errorf("DBSIZE: got %q", got)
+	}
+	if got := run("INFO", "keyspace"); !strings.Contains(got, "db0:keys=3,expires=2,avg_ttl=5050\r\n") {
+		t.Errorf("INFO keyspace: got %q", got)
+	}
+
+	// Nobody looked at the key since it expired, and yet it isn't counted anymore
+	clock.Advance(100 * time.Millisecond)
+	if got := run("DBSIZE"); got != ":2\r\n" {
+		t.Errorf("DBSIZE once a key expired: got %q", got)
+	}
+	if got := run("INFO", "keyspace"); !strings.Contains(got, "db0:keys=2,expires=1,avg_ttl=9900\r\n") {
+		t.Errorf("INFO keyspace once a key expired: got %q", got)
+	}
+	if got := run("KEYS", "*"); got != "*2\r\n$1\r\nk\r\n$4\r\nlong\r\n" && got != "*2\r\n$4\r\nlong\r\n$1\r\nk\r\n" {
+		t.Errorf("KEYS: got %q", got)
+	}
+
+	clock.Advance(10 * time.Second)
+	run("DEL", "k")
+	if got := run("DBSIZE"); got != ":0\r\n" {
+		t.Errorf("DBSIZE of an empty database: got %q", got)
+	}
+	if got := run("RANDOMKEY"); got != "$-1\r\n" {
+		t.Errorf("RANDOMKEY of an empty database: got %q", got)
+	}
+	if got := run("INFO", "keyspace"); got != "$12\r\n# Keyspace\r\n\r\n" {
+		t.Errorf("INFO keyspace of empty databases: got %q", got)
+	}
+}
+
+func TestSessionResolvesDB(t *testing.T) {
+	server := MakeServer()
+	session, conn := newTestSession(server)
+	run := func(cmd ...string) string {
+		conn.buf.Reset()
+		session.dispatch(cmd)
+		return conn.buf.String()
+	}
+
+	if got := run("SELECT", "16"); got != "-ERR DB index is out of range\r\n" {
+		t.Errorf("SELECT 16: got %q", got)
+	}
+	run("SELECT", "1")
+	run("SET", "k", "v")
+	if _, ok := loadString(server.dbs[1], "k"); !ok {
+		t.Fatal("SET after SELECT 1 didn't write to db 1")
+	}
+
+	// The session must pick up a database that was replaced after it selected it
+	server.dbsMutex.Lock()
+	server.dbs[1] = server.newDB(1)
+	server.dbsMutex.Unlock()
+	if got := run("GET", "k"); got != "$-1\r\n" {
+		t.Errorf("got %q from the replaced database, want a null", got)
+	}
+}
+
+func TestDatabaseCount(t *testing.T) {
+	server := MakeServer()
+	if err := server.SetDatabases(0); err == nil {
+		t.Errorf("SetDatabases(0): want an error")
+	}
+	if err := server.SetDatabases(2); err != nil {
+		t.Fatal(err)
+	}
+	session, conn := newTestSession(server)
+	run := func(cmd ...string) string {
+		conn.buf.Reset()
+		session.dispatch(cmd)
+		return conn.buf.String()
+	}
+
+	if got := run("SELECT", "1"); got != "+OK\r\n" {
+		t.Errorf("SELECT 1: got %q", got)
+	}
+	if got := run("SELECT", "2"); got != "-ERR DB index is out of range\r\n" {
+		t.Errorf("SELECT 2: got %q", got)
+	}
+	if got := run("CONFIG", "GET", "databases"); got != "*2\r\n$9\r\ndatabases\r\n$1\r\n2\r\n" {
+		t.Errorf("CONFIG GET databases: got %q", got)
+	}
+}
+
+// Compare with BenchmarkGetResolved: looking the database up for every command should
+// cost next to nothing compared to the command itself.
+func BenchmarkServerDB(b *testing.B) {
+	server := MakeServer()
+	for range b.N {
+		server.db(3)
+	}
+}
+
+func BenchmarkGetResolved(b *testing.B) {
+	server := MakeServer()
+	session, conn := newTestSession(server)
+	session.dispatch([]string{"SET", "k", "v"})
+	cmd := []string{"GET", "k"}
+	b.ResetTimer()
+	for range b.N {
+		conn.buf.Reset()
+		session.dispatch(cmd)
+	}
+}
+
+func TestActiveExpire(t *testing.T) {
+	server := MakeServer()
+	clock := newFakeClock(time.Unix(1700000000, 0))
+	server.Clock = clock
+	db := server.db(0)
+	for i := range 1000 {
+		var expiry int64
+		if i%2 == 0 {
+			expiry = clock.Now().Add(time.Second).UnixMilli()
+		}
+		db.set("key"+strconv.Itoa(i), "value", expiry)
+	}
+	if got := db.volatile.len(); got != 500 {
+		t.Fatalf("got %d keys with an expiry, want 500", got)
+	}
+
+	clock.Advance(time.Second)
+	server.activeExpire()
+	// Going by samples, it stops once few enough of them expired
+	if got := db.volatile.len(); got > 50 {
+		t.Errorf("%d keys with an expiry left", got)
+	}
+	if got := db.keys.len(); got > 550 || got < 500 {
+		t.Errorf("%d keys left, want about 500", got)
+	}
+	if got := int(db.stats.expired.Load()); got != 1000-db.keys.len() {
+		t.Errorf("counted %d expired keys, for %d deleted", got, 1000-db.keys.len())
+	}
+}
+
+func TestExpiredKeysPropagated(t *testing.T) {
+	server := MakeServer()
+	clock := newFakeClock(time.Unix(1700000000, 0))
+	server.Clock = clock
+	server.repl.mutex.Lock()
+	server.repl.activate(1 << 20)
+	server.repl.mutex.Unlock()
+	session, _ := newTestSession(server)
+	// What was propagated since the last call
+	offset := server.repl.offset.Load()
+	propagated := func() string {
+		got, _ := server.repl.backlog.since(offset)
+		offset = server.repl.offset.Load()
+		return string(got)
+	}
+
+	session.dispatch([]string{"SELECT", "1"})
+	session.dispatch([]string{"SET", "read", "v", "PX", "100"})
+	session.dispatch([]string{"SET", "unread", "v", "PX", "100"})
+	propagated()
+	clock.Advance(100 * time.Millisecond)
+
+	// Whether by being looked at, or by the active expire cycle
+	session.dispatch([]string{"GET", "read"})
+	if got, want := propagated(), "*2\r\n$3\r\nDEL\r\n$4\r\nread\r\n"; got != want {
+		t.Errorf("expired on GET: propagated %q, want %q", got, want)
+	}
+	server.activeExpire()
+	if got, want := propagated(), "*2\r\n$3\r\nDEL\r\n$6\r\nunread\r\n"; got != want {
+		t.Errorf("expired by the active expire cycle: propagated %q, want %q", got, want)
+	}
+}
+
+func TestWritesPropagatedInOrder(t *testing.T) {
+	server := MakeServer()
+	server.repl.mutex.Lock()
+	server.repl.activate(1 << 24)
+	server.repl.mutex.Unlock()
+
+	// Replicas apply the changes to a key in the order they were propagated in, which
+	// has to be the order they were made in
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			session, _ := newTestSession(server)
+			for j := range 500 {
+				session.dispatch([]string{"APPEND", "k", fmt.Sprintf("%d-%d;", i, j)})
+			}
+		}()
+	}
+	wg.Wait()
+
+	propagated, _ := server.repl.backlog.since(0)
+	var replayed strings.Builder
+	for _, cmd := range bytes.Split(propagated, []byte("append\r\n$1\r\nk\r\n"))[1:] {
+		replayed.WriteString(strings.Split(string(cmd), "\r\n")[1])
+	}
+	if got, _ := loadString(server.dbs[0], "k"); got != replayed.String() {
+		t.Errorf("got %q, but replaying what was propagated gives %q", got, replayed.String())
+	}
+}
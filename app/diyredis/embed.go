@@ -0,0 +1,140 @@
+package diyredis
+
+import (
+	"errors"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	streams "github.com/codecrafters-io/redis-starter-go/app/diyredis/streams"
+)
+
+// Go programs can use the keyspace directly, without going through RESP and the network.
+// A DB runs the same code the commands do, so it can be used alongside clients of the
+// same server: blocked XREADs are woken up, and changes count towards the save points.
+//
+// Errors are *UserErrors, so that e.g. a WRONGTYPE error can be told apart by its Code.
+
+type DB struct {
+	server *Server
+	index  int // resolved through server on every call, like sessions do
+}
+
+// Return database 0 of a new server, which doesn't listen on the network unless it is
+// started.
+func Open() *DB {
+	db, _ := MakeServer().DB(0)
+	return db
+}
+
+// Return the database with the given index.
+func (s *Server) DB(index int) (*DB, error) {
+	if index < 0 || index >= s.dbCount() {
+		return nil, errors.New("DB index is out of range")
+	}
+	return &DB{server: s, index: index}, nil
+}
+
+// Return the server the database belongs to, e.g. to Start it.
+func (d *DB) Server() *Server {
+	return d.server
+}
+
+// Bookkeeping after a successful write, as done by Session.execute for commands.
+func (d *DB) written(key string) {
+	d.server.markDirty(1)
+	d.server.signalKeysReady(uint(d.index), []string{key})
+	d.server.tracking.invalidate(nil, []string{key})
+}
+
+// Set key to the string val. It expires after ttl, or never if ttl is 0.
+func (d *DB) Set(key string, val string, ttl time.Duration) error {
+	if ttl < 0 {
+		return &UserError{"ERR", "invalid expire time"}
+	}
+	db := d.server.db(d.index)
+	var expiry int64
+	cmd := []string{"SET", key, val}
+	if ttl > 0 {
+		var ok bool
+		if expiry, ok = expiryMs(max(ttl.Milliseconds(), 1), time.Millisecond, false, db.nowMs()); !ok {
+			return &UserError{"ERR", "invalid expire time"}
+		}
+		cmd = append(cmd, "PXAT", strconv.FormatInt(expiry, 10))
+	}
+	defer d.server.repl.order.lockKeys([]string{key}, true)()
+	d.server.repl.writes.RLock()
+	defer d.server.repl.writes.RUnlock()
+	defer db.locks.lock(key).Unlock()
+	db.set(key, newStringValue(val), expiry)
+	d.server.propagate(d.index, cmd)
+	d.written(key)
+	return nil
+}
+
+// Return the string at key. ok is false if the key doesn't exist.
+func (d *DB) Get(key string) (val string, ok bool, err error) {
+	val, ok, uerr := d.server.db(d.index).getString(key)
+	if uerr != nil {
+		return "", false, uerr
+	}
+	return val, ok, nil
+}
+
+// Append an entry to the stream at key, creating the stream if needed. id is as in XADD,
+// e.g. "*" to have one generated. The fields are stored in the order of their names.
+// Returns the ID of the new entry.
+func (d *DB) XAdd(key string, id string, fields map[string]string) (string, error) {
+	if len(fields) == 0 {
+		return "", &UserError{"ERR", "a stream entry needs at least one key value pair"}
+	}
+	defer d.server.repl.order.lockKeys([]string{key}, true)()
+	d.server.repl.writes.RLock()
+	defer d.server.repl.writes.RUnlock()
+	entryKey, _, uerr := d.server.db(d.index).xadd(key, id, streamFieldsFromMap(fields), -1, true)
+	if uerr != nil {
+		return "", uerr
+	}
+	cmd := append([]string{"XADD", key, entryKey.String()}, streamFieldsFromMap(fields).pairs()...)
+	d.server.propagate(d.index, cmd)
+	d.written(key)
+	return entryKey.String(), nil
+}
+
+// Return the entries of the stream at key from start up to and including end. Both are
+// IDs as in XRANGE, so "-" and "+" stand for the first and last entry. The Val of each
+// entry is its StreamFields.
+func (d *DB) XRange(key string, start string, end string) ([]streams.Entry, error) {
+	entries, uerr := d.server.db(d.index).xrange(key, start, end, false)
+	if uerr != nil {
+		return nil, uerr
+	}
+	return slices.Collect(entries), nil
+}
+
+// Receive every entry added to the stream at key from now on, creating the stream if
+// needed. Entries are dropped if the channel's buffer is full, so keep up. Call the
+// returned function to unsubscribe. The channel is closed if the key is deleted (or
+// expires, or is overwritten), which ends the subscription.
+func (d *DB) Subscribe(key string, buffer int) (<-chan streams.NewEntryMsg, func(), error) {
+	value := d.server.db(d.index).loadOrStore(key, streams.NewStream())
+	stream, ok := value.(*streams.Stream)
+	if !ok {
+		return nil, nil, ErrWrongType()
+	}
+	ch := make(chan streams.NewEntryMsg, buffer)
+	id := stream.Subscribe(ch)
+	unsubscribed := make(chan struct{})
+	go func() {
+		select {
+		case <-stream.Done():
+			close(ch) // nothing is sent to it anymore once the stream is closed
+		case <-unsubscribed:
+		}
+	}()
+	return ch, sync.OnceFunc(func() {
+		stream.Unsubscribe(id)
+		close(unsubscribed)
+	}), nil
+}
@@ -0,0 +1,97 @@
+package diyredis_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/diyredis"
+)
+
+func TestEmbeddedStrings(t *testing.T) {
+	db := diyredis.Open()
+
+	if _, ok, err := db.Get("k"); ok || err != nil {
+		t.Errorf("got ok=%v err=%v for a missing key", ok, err)
+	}
+	if err := db.Set("k", "v", 0); err != nil {
+		t.Fatal(err)
+	}
+	if val, ok, err := db.Get("k"); val != "v" || !ok || err != nil {
+		t.Errorf("got %q %v %v, want \"v\"", val, ok, err)
+	}
+
+	if err := db.Set("short", "v", 20*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(40 * time.Millisecond)
+	if _, ok, _ := db.Get("short"); ok {
+		t.Error("key didn't expire")
+	}
+	if err := db.Set("k", "v", -time.Second); err == nil {
+		t.Error("got no error for a negative TTL")
+	}
+}
+
+func TestEmbeddedStreams(t *testing.T) {
+	db := diyredis.Open()
+
+	entries, unsubscribe, err := db.Subscribe("s", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unsubscribe()
+
+	id, err := db.XAdd("s", "1-*", map[string]string{"a": "1"})
+	if id != "1-0" || err != nil {
+		t.Fatalf("got %q %v, want 1-0", id, err)
+	}
+	select {
+	case msg := <-entries:
+		if msg.Key.String() != "1-0" {
+			t.Errorf("got entry %s, want 1-0", msg.Key)
+		}
+	case <-time.After(time.Second):
+		t.Error("subscriber didn't get the new entry")
+	}
+
+	db.XAdd("s", "2-0", map[string]string{"b": "2"})
+	got, err := db.XRange("s", "-", "1-0")
+	if err != nil || len(got) != 1 || got[0].Key.String() != "1-0" {
+		t.Errorf("got %v %v, want entry 1-0", got, err)
+	}
+	if _, err := db.XAdd("s", "2-0", map[string]string{"c": "3"}); err == nil {
+		t.Error("got no error for an ID that isn't higher than the last one")
+	}
+
+	// Same error as a client would get
+	_, _, err = db.Get("s")
+	var uerr *diyredis.UserError
+	if !errors.As(err, &uerr) || uerr.Code() != "WRONGTYPE" {
+		t.Errorf("got %v, want a WRONGTYPE error", err)
+	}
+
+	// Overwriting the stream ends the subscription, after the entries already sent
+	db.Set("s", "v", 0)
+	for msg := range entries {
+		if msg.Key.String() != "2-0" {
+			t.Errorf("got entry %s after 1-0, want 2-0", msg.Key)
+		}
+	}
+}
+
+// Changes made through a DB are visible to clients of the same server.
+func TestEmbeddedSharesServer(t *testing.T) {
+	db := diyredis.Open()
+	other, err := db.Server().DB(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other.Set("k", "in db 1", 0)
+	if _, ok, _ := db.Get("k"); ok {
+		t.Error("databases aren't separate")
+	}
+	if _, err := db.Server().DB(16); err == nil {
+		t.Error("got no error for a database that doesn't exist")
+	}
+}
@@ -0,0 +1,128 @@
+package diyredis
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Where a database keeps its keys: their values, and the Unix times in milliseconds they
+// expire at. An engine only stores them; everything else is done by RedisDB on top of
+// any engine, the same way: keys are deleted once they expire, every change goes through
+// modify, which is what snapshots for saving are taken with (consistent across every
+// database, which no single engine could do), the key indexes are kept, and so on.
+//
+// Methods are called from any number of goroutines at once. Values are compared with ==,
+// and must be handed out as they were stored, until they are replaced: collections are
+// changed in place, by whoever got them from Get.
+type Engine interface {
+	Get(key string) (value any, ok bool)
+	Set(key string, value any)
+	// Set key to value unless it already exists, in which case its value is returned
+	// with loaded true.
+	SetIfAbsent(key string, value any) (actual any, loaded bool)
+	// Set key to value provided it still holds old.
+	CompareAndSwap(key string, old, value any) bool
+	// Delete key, but not its expiry.
+	Delete(key string)
+	// Delete key provided it still holds value, but not its expiry.
+	CompareAndDelete(key string, value any) bool
+	// Call fn for every key, until it returns false. A key that exists throughout is
+	// visited exactly once; one that is set or deleted meanwhile may or may not be.
+	Scan(fn func(key string, value any) bool)
+
+	// The time key expires at, if it has an expiry.
+	Expiry(key string) (at int64, ok bool)
+	Expire(key string, at int64)
+	// Remove the expiry of key.
+	Persist(key string)
+	// Remove the expiry of key provided it's still at.
+	CompareAndPersist(key string, at int64) bool
+}
+
+// The engines that can be chosen with SetStorageEngine, by name.
+var storageEngines = map[string]func(s *Server) Engine{
+	"memory": newMemoryEngine,
+	"tiered": newTieredEngine,
+}
+
+// Make an engine available to SetStorageEngine under name, e.g. from an init function.
+// create makes the engine of a new database of s.
+func RegisterStorageEngine(name string, create func(s *Server) Engine) {
+	storageEngines[name] = create
+}
+
+// Store the databases in new engines of the given name from now on, "memory" by
+// default. The databases are replaced with empty ones, as with SetDatabases, so this is
+// for before the dataset is loaded.
+func (s *Server) SetStorageEngine(name string) error {
+	create, ok := storageEngines[name]
+	if !ok {
+		return fmt.Errorf("unknown storage engine %q, must be one of %s", name,
+			strings.Join(slices.Sorted(maps.Keys(storageEngines)), ", "))
+	}
+	s.StorageEngine, s.newEngine = name, create
+	return s.SetDatabases(s.dbCount())
+}
+
+// Keeps everything in memory, in a sync.Map for values and one for expiries.
+type memoryEngine struct {
+	values   sync.Map
+	expiries sync.Map // key -> int64
+}
+
+func newMemoryEngine(*Server) Engine {
+	return &memoryEngine{}
+}
+
+func (e *memoryEngine) Get(key string) (any, bool) {
+	return e.values.Load(key)
+}
+
+func (e *memoryEngine) Set(key string, value any) {
+	e.values.Store(key, value)
+}
+
+func (e *memoryEngine) SetIfAbsent(key string, value any) (any, bool) {
+	return e.values.LoadOrStore(key, value)
+}
+
+func (e *memoryEngine) CompareAndSwap(key string, old, value any) bool {
+	return e.values.CompareAndSwap(key, old, value)
+}
+
+func (e *memoryEngine) Delete(key string) {
+	e.values.Delete(key)
+}
+
+func (e *memoryEngine) CompareAndDelete(key string, value any) bool {
+	return e.values.CompareAndDelete(key, value)
+}
+
+func (e *memoryEngine) Scan(fn func(key string, value any) bool) {
+	e.values.Range(func(key, value any) bool {
+		return fn(key.(string), value)
+	})
+}
+
+func (e *memoryEngine) Expiry(key string) (int64, bool) {
+	at, ok := e.expiries.Load(key)
+	if !ok {
+		return 0, false
+	}
+	return at.(int64), true
+}
+
+func (e *memoryEngine) Expire(key string, at int64) {
+	e.expiries.Store(key, at)
+}
+
+func (e *memoryEngine) Persist(key string) {
+	e.expiries.Delete(key)
+}
+
+func (e *memoryEngine) CompareAndPersist(key string, at int64) bool {
+	return e.expiries.CompareAndDelete(key, at)
+}
@@ -0,0 +1,72 @@
+package diyredis
+
+import (
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// Stores keys in memory, counting how many are stored and given an expiry.
+type countingEngine struct {
+	Engine
+	sets, expires *atomic.Int64
+}
+
+func (e countingEngine) Set(key string, value any) {
+	e.sets.Add(1)
+	e.Engine.Set(key, value)
+}
+
+func (e countingEngine) SetIfAbsent(key string, value any) (any, bool) {
+	actual, loaded := e.Engine.SetIfAbsent(key, value)
+	if !loaded {
+		e.sets.Add(1)
+	}
+	return actual, loaded
+}
+
+func (e countingEngine) Expire(key string, at int64) {
+	e.expires.Add(1)
+	e.Engine.Expire(key, at)
+}
+
+func TestStorageEngine(t *testing.T) {
+	var sets, expires atomic.Int64
+	RegisterStorageEngine("counting", func(s *Server) Engine {
+		return countingEngine{newMemoryEngine(s), &sets, &expires}
+	})
+	t.Cleanup(func() { delete(storageEngines, "counting") })
+
+	server := MakeServer()
+	if err := server.SetStorageEngine("disk"); err == nil || !strings.Contains(err.Error(), "counting, memory, tiered") {
+		t.Errorf("SetStorageEngine of an unknown engine: got %v", err)
+	}
+	if err := server.SetStorageEngine("counting"); err != nil {
+		t.Fatal(err)
+	}
+	if len(server.dbs) != DefaultDatabases {
+		t.Errorf("got %d databases, want %d", len(server.dbs), DefaultDatabases)
+	}
+	session, conn := newTestSession(server)
+	run := func(cmd ...string) string {
+		conn.buf.Reset()
+		session.dispatch(cmd)
+		return conn.buf.String()
+	}
+
+	run("SET", "a", "1")
+	run("SET", "b", "2", "EX", "100")
+	run("RPUSH", "list", "x", "y")
+	if got := run("MGET", "a", "b"); got != "*2\r\n$1\r\n1\r\n$1\r\n2\r\n" {
+		t.Errorf("MGET: got %q", got)
+	}
+	if got := run("KEYS", "*"); !strings.HasPrefix(got, "*3\r\n") {
+		t.Errorf("KEYS: got %q", got)
+	}
+	if sets.Load() != 3 || expires.Load() != 1 {
+		t.Errorf("engine stored %d keys and %d expiries, want 3 and 1", sets.Load(), expires.Load())
+	}
+	if got := run("CONFIG", "GET", "storage-engine"); got != "*2\r\n$14\r\nstorage-engine\r\n$8\r\ncounting\r\n" {
+		t.Errorf("CONFIG GET storage-engine: got %q", got)
+	}
+}
@@ -0,0 +1,255 @@
+package diyredis
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	resp3 "github.com/codecrafters-io/redis-starter-go/app/diyredis/resp3"
+)
+
+// Coordinated switch of roles between a master and one of its replicas, as started by
+// FAILOVER.
+//
+// The master pauses writes, and waits for the replica to have everything propagated so
+// far. It then becomes a replica of that replica, asking it to take over with PSYNC ...
+// FAILOVER. The replica becomes a master without starting a new history of the dataset,
+// so that the old master continues replicating from it right away. Writes are resumed
+// once that's done, and refused by the old master from then on.
+
+type failoverState struct {
+	mutex sync.Mutex
+	state string        // "" while no failover is in progress, or else as in INFO
+	abort chan struct{} // closed by FAILOVER ABORT
+}
+
+// FAILOVER [TO host port [FORCE]] [ABORT] [TIMEOUT milliseconds]
+func (s *Session) doFAILOVER(cmds []string) *UserError {
+	var host, port string
+	var force, abort bool
+	var timeout time.Duration
+	for i := 1; i < len(cmds); i++ {
+		switch strings.ToLower(cmds[i]) {
+		case "to":
+			if i+2 >= len(cmds) {
+				return ErrSyntax()
+			}
+			host, port = cmds[i+1], cmds[i+2]
+			i += 2
+		case "force":
+			force = true
+		case "abort":
+			abort = true
+		case "timeout":
+			if i+1 >= len(cmds) {
+				return ErrSyntax()
+			}
+			ms, err := strconv.ParseInt(cmds[i+1], 10, 64)
+			if err != nil {
+				return &UserError{"ERR", "value is not an integer or out of range"}
+			}
+			if ms <= 0 {
+				return &UserError{"ERR", "FAILOVER timeout must be greater than 0"}
+			}
+			timeout = time.Duration(ms) * time.Millisecond
+			i++
+		default:
+			return ErrSyntax()
+		}
+	}
+
+	f := &s.server.repl.failover
+	if abort {
+		if host != "" || force || timeout != 0 {
+			return &UserError{"ERR", "FAILOVER ABORT can't be combined with other options"}
+		}
+		f.mutex.Lock()
+		defer f.mutex.Unlock()
+		if f.state != "waiting-for-sync" {
+			return &UserError{"ERR", "No failover in progress."}
+		}
+		close(f.abort)
+		f.state = "aborting"
+		s.conn.Write(resp3.OK)
+		return nil
+	}
+
+	if s.server.ClusterEnabled {
+		return &UserError{"ERR", "FAILOVER not allowed in cluster mode."}
+	}
+	if s.server.repl.link.Load() != nil {
+		return &UserError{"ERR", "FAILOVER is not valid when server is a replica."}
+	}
+	if force && (host == "" || timeout == 0) {
+		return &UserError{"ERR", "FAILOVER with force option requires both a timeout and target HOST and IP."}
+	}
+	target, host, port := s.server.repl.failoverTarget(host, port)
+	if target == nil {
+		if host == "" {
+			return &UserError{"ERR", "FAILOVER requires connected replicas."}
+		}
+		return &UserError{"ERR", "FAILOVER target HOST and PORT is not a replica."}
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.state != "" {
+		return &UserError{"ERR", "FAILOVER already in progress."}
+	}
+	f.state = "waiting-for-sync"
+	f.abort = make(chan struct{})
+	// Until the failover is over one way or another
+	s.server.pause.pause(365*24*time.Hour, true)
+	go s.server.runFailover(target, host, port, timeout, force, f.abort)
+	s.conn.Write(resp3.OK)
+	return nil
+}
+
+// Find the online replica listening on host and port, or if host is empty, the one that
+// has received the most. Returns its session and address, or nil if there is none.
+func (r *replState) failoverTarget(host string, port string) (*Session, string, string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	var target *Session
+	var best *replica
+	var targetHost string
+	for session, replica := range r.replicas {
+		if !replica.online {
+			continue
+		}
+		replicaHost, _, _ := net.SplitHostPort(session.conn.RemoteAddr().String())
+		replicaPort := strconv.Itoa(session.replicaPort)
+		if host != "" && (host != replicaHost || port != replicaPort) {
+			continue
+		}
+		if best == nil || replica.ackOffset > best.ackOffset {
+			target, best, targetHost = session, replica, replicaHost
+		}
+	}
+	if target == nil {
+		return nil, host, port
+	}
+	return target, targetHost, strconv.Itoa(target.replicaPort)
+}
+
+// Wait for the replica to catch up, and then hand over to it. Writes are paused until
+// this returns.
+func (s *Server) runFailover(target *Session, host string, port string, timeout time.Duration, force bool, abort chan struct{}) {
+	defer s.reportCrashes()
+	f := &s.repl.failover
+	defer func() {
+		f.mutex.Lock()
+		f.state = ""
+		f.mutex.Unlock()
+		s.pause.unpause()
+	}()
+	log := s.Log.With("target", net.JoinHostPort(host, port))
+	log.Info("FAILOVER requested")
+
+	// Nothing is written anymore, so once the replica has this much it has everything.
+	// It has to have processed it too, which its ACKs every second tell, rather than
+	// GETACK, which is replied to before counting the GETACK itself.
+	offset := s.repl.offset.Load()
+
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		deadline = time.After(timeout)
+	}
+	check := time.NewTicker(10 * time.Millisecond)
+	defer check.Stop()
+	for caughtUp := false; !caughtUp; {
+		select {
+		case <-abort:
+			log.Info("FAILOVER aborted")
+			return
+		case <-deadline:
+			if !force {
+				log.Warn("FAILOVER timed out waiting for the replica to catch up")
+				return
+			}
+			log.Warn("FAILOVER timed out waiting for the replica to catch up, forcing it")
+			caughtUp = true
+		case <-check.C:
+			acked, ok := s.repl.ackedOffset(target)
+			if !ok {
+				log.Warn("FAILOVER aborted, the replica disconnected")
+				return
+			}
+			caughtUp = acked >= offset
+		}
+	}
+
+	f.mutex.Lock()
+	if f.state != "waiting-for-sync" {
+		f.mutex.Unlock()
+		log.Info("FAILOVER aborted")
+		return
+	}
+	f.state = "failover-in-progress"
+	f.mutex.Unlock()
+
+	// Become a replica, asking the target to take over
+	outcome := make(chan error, 1)
+	s.repl.linkMutex.Lock()
+	s.startMasterLink(&masterLink{host: host, port: port, failover: outcome})
+	s.repl.linkMutex.Unlock()
+	if err := <-outcome; err != nil {
+		log.Warn("FAILOVER failed, staying a master", "err", err)
+		s.repl.linkMutex.Lock()
+		s.stopMasterLink()
+		s.repl.linkMutex.Unlock()
+		return
+	}
+	log.Info("FAILOVER complete, now a replica")
+}
+
+// Return the offset the replica of s last acknowledged, or false if it isn't connected.
+func (r *replState) ackedOffset(s *Session) (int64, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	replica, ok := r.replicas[s]
+	if !ok {
+		return 0, false
+	}
+	return replica.ackOffset, true
+}
+
+// Become a master, as asked by our master with PSYNC ... FAILOVER. We must have
+// everything it has, offset being one more than that.
+func (s *Server) takeOver(id string, offset string) *UserError {
+	s.repl.linkMutex.Lock()
+	defer s.repl.linkMutex.Unlock()
+	if s.repl.link.Load() == nil {
+		return &UserError{"ERR", "PSYNC FAILOVER can't be sent to a master."}
+	}
+	s.repl.mutex.Lock()
+	ourID := s.repl.id
+	s.repl.mutex.Unlock()
+	if id != ourID {
+		return &UserError{"ERR", "PSYNC FAILOVER replid must match my replid."}
+	}
+	if offset != strconv.FormatInt(s.repl.offset.Load()+1, 10) {
+		return &UserError{"ERR", "PSYNC FAILOVER offset must match my offset."}
+	}
+
+	s.stopMasterLink()
+	// Same history as the old master, so that it can continue from us
+	s.repl.newHistory(id, s.repl.offset.Load())
+	s.repl.mutex.Lock()
+	s.repl.activate(int(s.ReplBacklogSize))
+	s.repl.mutex.Unlock()
+	s.Log.Info("Taking over as master, as asked by FAILOVER")
+	return nil
+}
+
+// State as reported by INFO.
+func (f *failoverState) String() string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.state == "" {
+		return "no-failover"
+	}
+	return f.state
+}
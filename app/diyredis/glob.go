@@ -0,0 +1,102 @@
+package diyredis
+
+import "strings"
+
+// Glob-style pattern matching as done by KEYS and friends in Redis:
+//
+//   - any number of characters, including none
+//     ?      any single character
+//     [abc]  any one of the characters, [^abc] any but them, [a-z] any in the range
+//     \x     x itself, even if it is one of the special characters above
+//
+// Matching is byte-wise, like in Redis.
+func globMatch(pattern string, str string) bool {
+	p, s := 0, 0
+	starP, starS := -1, 0 // where to resume if what follows the last star doesn't match
+	for s < len(str) {
+		if p < len(pattern) {
+			switch pattern[p] {
+			case '*':
+				starP, starS = p, s
+				p++
+				continue
+			case '?':
+				p++
+				s++
+				continue
+			case '[':
+				if matched, next := matchClass(pattern, p, str[s]); matched {
+					p = next
+					s++
+					continue
+				}
+			case '\\':
+				if p+1 < len(pattern) && pattern[p+1] == str[s] {
+					p += 2
+					s++
+					continue
+				}
+				if p+1 == len(pattern) && str[s] == '\\' {
+					p++
+					s++
+					continue
+				}
+			default:
+				if pattern[p] == str[s] {
+					p++
+					s++
+					continue
+				}
+			}
+		}
+		if starP < 0 {
+			return false
+		}
+		// Let the star swallow one more character, and try again from there
+		starS++
+		p, s = starP+1, starS
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// Match c against the character class starting at pattern[p], which is a '['. Returns
+// whether it matched, and the index right after the class. An unterminated class runs
+// to the end of the pattern.
+func matchClass(pattern string, p int, c byte) (bool, int) {
+	p++
+	negate := p < len(pattern) && pattern[p] == '^'
+	if negate {
+		p++
+	}
+	matched := false
+	for p < len(pattern) && pattern[p] != ']' {
+		switch {
+		case pattern[p] == '\\' && p+1 < len(pattern):
+			p++
+			matched = matched || pattern[p] == c
+		case p+2 < len(pattern) && pattern[p+1] == '-':
+			lo, hi := pattern[p], pattern[p+2]
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+			matched = matched || (c >= lo && c <= hi)
+			p += 2
+		default:
+			matched = matched || pattern[p] == c
+		}
+		p++
+	}
+	if p < len(pattern) {
+		p++ // the ']'
+	}
+	return matched != negate, p
+}
+
+// Return true if pattern matches nothing but itself, so that it can be looked up
+// directly.
+func isLiteralPattern(pattern string) bool {
+	return !strings.ContainsAny(pattern, "*?[\\")
+}
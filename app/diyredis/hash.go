@@ -0,0 +1,542 @@
+package diyredis
+
+import (
+	"math"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+	"sync"
+
+	listpack "github.com/codecrafters-io/redis-starter-go/app/diyredis/listpack"
+	resp3 "github.com/codecrafters-io/redis-starter-go/app/diyredis/resp3"
+)
+
+// A hash is a listpack of alternating fields and values while it's small, and a map once
+// it isn't.
+type hashValue struct {
+	mutex  sync.RWMutex
+	lp     listpack.Listpack // nil once converted to a map
+	fields map[string]string
+}
+
+func newHash() *hashValue {
+	return &hashValue{lp: listpack.New()}
+}
+
+// Return a hash holding the given fields and values, in the encoding that suits it.
+func newHashFrom(pairs []string, limits ListpackLimits) *hashValue {
+	h := newHash()
+	if limits.fits(len(pairs)/2, pairs...) {
+		h.lp = h.lp.Append(pairs...)
+		return h
+	}
+	h.convert()
+	for i := 0; i < len(pairs); i += 2 {
+		h.fields[pairs[i]] = pairs[i+1]
+	}
+	return h
+}
+
+func (h *hashValue) encoding() string {
+	if h.lp != nil {
+		return "listpack"
+	}
+	return "hashtable"
+}
+
+func (h *hashValue) convert() {
+	h.fields = make(map[string]string, h.len())
+	if h.lp != nil {
+		elems := h.lp.Elements()
+		for i := 0; i < len(elems); i += 2 {
+			h.fields[elems[i]] = elems[i+1]
+		}
+	}
+	h.lp = nil
+}
+
+func (h *hashValue) len() int {
+	if h.lp != nil {
+		return h.lp.Len() / 2
+	}
+	return len(h.fields)
+}
+
+func (h *hashValue) get(field string) (string, bool) {
+	if h.lp != nil {
+		i := h.lp.Find(field, 0, 2)
+		if i < 0 {
+			return "", false
+		}
+		return h.lp.Get(i + 1), true
+	}
+	value, ok := h.fields[field]
+	return value, ok
+}
+
+// Set field to value, returning true if the field is new.
+func (h *hashValue) set(field string, value string, limits ListpackLimits) bool {
+	if h.lp != nil {
+		if i := h.lp.Find(field, 0, 2); i >= 0 {
+			if limits.fits(0, value) {
+				h.lp = h.lp.Replace(i+1, value)
+				return false
+			}
+		} else if limits.fits(h.len()+1, field, value) {
+			h.lp = h.lp.Append(field, value)
+			return true
+		}
+		h.convert()
+	}
+	_, exists := h.fields[field]
+	h.fields[field] = value
+	return !exists
+}
+
+// Delete field, returning true if it existed.
+func (h *hashValue) del(field string) bool {
+	if h.lp != nil {
+		i := h.lp.Find(field, 0, 2)
+		if i < 0 {
+			return false
+		}
+		h.lp = h.lp.Delete(i, 2)
+		return true
+	}
+	_, exists := h.fields[field]
+	delete(h.fields, field)
+	return exists
+}
+
+// Call fn for every field and its value, until it returns false.
+func (h *hashValue) rangeFields(fn func(field string, value string) bool) {
+	if h.lp != nil {
+		elems := h.lp.Elements()
+		for i := 0; i < len(elems); i += 2 {
+			if !fn(elems[i], elems[i+1]) {
+				return
+			}
+		}
+		return
+	}
+	for field, value := range h.fields {
+		if !fn(field, value) {
+			return
+		}
+	}
+}
+
+// Return a copy that doesn't change along with h.
+func (h *hashValue) clone() *hashValue {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	if h.lp != nil {
+		return &hashValue{lp: h.lp} // listpacks are never modified in place
+	}
+	fields := make(map[string]string, len(h.fields))
+	for field, value := range h.fields {
+		fields[field] = value
+	}
+	return &hashValue{fields: fields}
+}
+
+// HSET key field value [field value ...]
+func (s *Session) doHSET(cmds []string) *UserError {
+	if len(cmds) < 4 || len(cmds)%2 != 0 {
+		return &UserError{"ERR", "wrong number of arguments for HSET command"}
+	}
+
+	added := 0
+	_, uerr := changeCollection(s, cmds[1], newHash, func(h *hashValue) *UserError {
+		h.mutex.Lock()
+		defer h.mutex.Unlock()
+		added = 0
+		for i := 2; i < len(cmds); i += 2 {
+			if h.set(cmds[i], cmds[i+1], s.server.Encoding.Hash) {
+				added++
+			}
+		}
+		return nil
+	})
+	if uerr != nil {
+		return uerr
+	}
+
+	encoder := resp3.Encoder{}
+	encoder.WriteInt(added)
+	s.conn.Write(encoder.Buf)
+	return nil
+}
+
+// HSETNX key field value
+func (s *Session) doHSETNX(cmds []string) *UserError {
+	if len(cmds) != 4 {
+		return &UserError{"ERR", "wrong number of arguments for HSETNX command"}
+	}
+	added := false
+	_, uerr := changeCollection(s, cmds[1], newHash, func(h *hashValue) *UserError {
+		h.mutex.Lock()
+		defer h.mutex.Unlock()
+		added = false
+		if _, exists := h.get(cmds[2]); !exists {
+			added = h.set(cmds[2], cmds[3], s.server.Encoding.Hash)
+		}
+		return nil
+	})
+	if uerr != nil {
+		return uerr
+	}
+	if !added {
+		s.propagateAs() // nothing changed
+	}
+
+	encoder := resp3.Encoder{}
+	encoder.WriteInt(boolToInt(added))
+	s.conn.Write(encoder.Buf)
+	return nil
+}
+
+// HINCRBY key field increment
+func (s *Session) doHINCRBY(cmds []string) *UserError {
+	if len(cmds) != 4 {
+		return &UserError{"ERR", "wrong number of arguments for HINCRBY command"}
+	}
+	by, err := strconv.ParseInt(cmds[3], 10, 64)
+	if err != nil {
+		return &UserError{"ERR", "value is not an integer or out of range"}
+	}
+	var result int64
+	uerr := s.incrHashField(cmds[1], cmds[2], func(value string, exists bool) (string, *UserError) {
+		var current int64
+		if exists {
+			current, err = strconv.ParseInt(value, 10, 64)
+			if err != nil || !isCanonicalInt(value) {
+				return "", &UserError{"ERR", "hash value is not an integer"}
+			}
+		}
+		if by > 0 && current > math.MaxInt64-by || by < 0 && current < math.MinInt64-by {
+			return "", &UserError{"ERR", "increment or decrement would overflow"}
+		}
+		result = current + by
+		return strconv.FormatInt(result, 10), nil
+	})
+	if uerr != nil {
+		return uerr
+	}
+	s.writeInt(result)
+	return nil
+}
+
+// HINCRBYFLOAT key field increment
+func (s *Session) doHINCRBYFLOAT(cmds []string) *UserError {
+	if len(cmds) != 4 {
+		return &UserError{"ERR", "wrong number of arguments for HINCRBYFLOAT command"}
+	}
+	by, ok := parseFiniteFloat(cmds[3])
+	if !ok {
+		return &UserError{"ERR", "value is not a valid float"}
+	}
+	var result string
+	uerr := s.incrHashField(cmds[1], cmds[2], func(value string, exists bool) (string, *UserError) {
+		var current float64
+		if exists {
+			if current, ok = parseFiniteFloat(value); !ok {
+				return "", &UserError{"ERR", "hash value is not a float"}
+			}
+		}
+		sum := current + by
+		if math.IsNaN(sum) || math.IsInf(sum, 0) {
+			return "", &UserError{"ERR", "increment would produce NaN or Infinity"}
+		}
+		result = strconv.FormatFloat(sum, 'f', -1, 64)
+		return result, nil
+	})
+	if uerr != nil {
+		return uerr
+	}
+	// Replicas could round differently, so they get the result
+	s.propagateAs([]string{"HSET", cmds[1], cmds[2], result})
+	encoder := resp3.Encoder{}
+	encoder.WriteBulkStr(result)
+	s.conn.Write(encoder.Buf)
+	return nil
+}
+
+// Parse a float the way Redis does, refusing NaN, infinities and surrounding spaces.
+func parseFiniteFloat(str string) (float64, bool) {
+	f, err := strconv.ParseFloat(str, 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) || strings.TrimSpace(str) != str {
+		return 0, false
+	}
+	return f, true
+}
+
+// Replace the value of field in the hash at key with what incr makes of it, atomically,
+// through computeInPlace, as INCR does through compute, so that concurrent increments
+// don't get lost. Nothing changes if incr returns an error.
+func (s *Session) incrHashField(key string, field string, incr func(value string, exists bool) (string, *UserError)) *UserError {
+	_, uerr := changeCollection(s, key, newHash, func(h *hashValue) *UserError {
+		h.mutex.Lock()
+		defer h.mutex.Unlock()
+		value, exists := h.get(field)
+		newValue, uerr := incr(value, exists)
+		if uerr == nil {
+			h.set(field, newValue, s.server.Encoding.Hash)
+		}
+		return uerr
+	})
+	return uerr
+}
+
+// HGET key field
+func (s *Session) doHGET(cmds []string) *UserError {
+	if len(cmds) != 3 {
+		return &UserError{"ERR", "wrong number of arguments for HGET command"}
+	}
+	h, ok, uerr := readTyped[*hashValue](s, cmds[1])
+	if uerr != nil {
+		return uerr
+	}
+
+	var value string
+	if ok {
+		h.mutex.RLock()
+		value, ok = h.get(cmds[2])
+		h.mutex.RUnlock()
+	}
+	if !ok {
+		s.writeNull()
+		return nil
+	}
+	encoder := resp3.Encoder{}
+	encoder.WriteBulkStr(value)
+	s.conn.Write(encoder.Buf)
+	return nil
+}
+
+// HMGET key field [field ...]
+func (s *Session) doHMGET(cmds []string) *UserError {
+	if len(cmds) < 3 {
+		return &UserError{"ERR", "wrong number of arguments for HMGET command"}
+	}
+	h, ok, uerr := readTyped[*hashValue](s, cmds[1])
+	if uerr != nil {
+		return uerr
+	}
+
+	encoder := s.encoder()
+	encoder.WriteArrHeader(len(cmds) - 2)
+	if ok {
+		h.mutex.RLock()
+		defer h.mutex.RUnlock()
+	}
+	for _, field := range cmds[2:] {
+		var value string
+		found := false
+		if ok {
+			value, found = h.get(field)
+		}
+		if !found {
+			encoder.WriteNull()
+			continue
+		}
+		encoder.WriteBulkStr(value)
+	}
+	s.conn.Write(encoder.Buf)
+	return nil
+}
+
+// HDEL key field [field ...]
+func (s *Session) doHDEL(cmds []string) *UserError {
+	if len(cmds) < 3 {
+		return &UserError{"ERR", "wrong number of arguments for HDEL command"}
+	}
+	deleted := 0
+	_, uerr := changeCollection(s, cmds[1], nil, func(h *hashValue) *UserError {
+		h.mutex.Lock()
+		defer h.mutex.Unlock()
+		deleted = 0
+		for _, field := range cmds[2:] {
+			if h.del(field) {
+				deleted++
+			}
+		}
+		return nil
+	})
+	if uerr != nil {
+		return uerr
+	}
+
+	encoder := resp3.Encoder{}
+	encoder.WriteInt(deleted)
+	s.conn.Write(encoder.Buf)
+	return nil
+}
+
+// HLEN key
+func (s *Session) doHLEN(cmds []string) *UserError {
+	if len(cmds) != 2 {
+		return &UserError{"ERR", "wrong number of arguments for HLEN command"}
+	}
+	h, ok, uerr := readTyped[*hashValue](s, cmds[1])
+	if uerr != nil {
+		return uerr
+	}
+
+	length := 0
+	if ok {
+		h.mutex.RLock()
+		length = h.len()
+		h.mutex.RUnlock()
+	}
+	encoder := resp3.Encoder{}
+	encoder.WriteInt(length)
+	s.conn.Write(encoder.Buf)
+	return nil
+}
+
+// HEXISTS key field
+func (s *Session) doHEXISTS(cmds []string) *UserError {
+	if len(cmds) != 3 {
+		return &UserError{"ERR", "wrong number of arguments for HEXISTS command"}
+	}
+	h, ok, uerr := readTyped[*hashValue](s, cmds[1])
+	if uerr != nil {
+		return uerr
+	}
+
+	exists := false
+	if ok {
+		h.mutex.RLock()
+		_, exists = h.get(cmds[2])
+		h.mutex.RUnlock()
+	}
+	encoder := resp3.Encoder{}
+	encoder.WriteInt(boolToInt(exists))
+	s.conn.Write(encoder.Buf)
+	return nil
+}
+
+// HGETALL, HKEYS and HVALS key
+func (s *Session) doHGETALL(cmds []string) *UserError {
+	if len(cmds) != 2 {
+		return &UserError{"ERR", "wrong number of arguments for " + cmds[0] + " command"}
+	}
+	h, ok, uerr := readTyped[*hashValue](s, cmds[1])
+	if uerr != nil {
+		return uerr
+	}
+	if !ok {
+		s.conn.Write(EmptyRespArr)
+		return nil
+	}
+
+	name := strings.ToLower(cmds[0])
+	var reply []string
+	h.mutex.RLock()
+	h.rangeFields(func(field string, value string) bool {
+		switch name {
+		case "hgetall":
+			reply = append(reply, field, value)
+		case "hkeys":
+			reply = append(reply, field)
+		case "hvals":
+			reply = append(reply, value)
+		}
+		return true
+	})
+	h.mutex.RUnlock()
+	s.conn.Write(makeRESPArr(reply))
+	return nil
+}
+
+// HRANDFIELD key [count [WITHVALUES]]
+//
+// With a positive count, up to count distinct fields. With a negative one, exactly
+// -count fields, which may repeat.
+func (s *Session) doHRANDFIELD(cmds []string) *UserError {
+	if len(cmds) < 2 || len(cmds) > 4 {
+		return &UserError{"ERR", "wrong number of arguments for HRANDFIELD command"}
+	}
+	withValues := len(cmds) == 4
+	if withValues && strings.ToLower(cmds[3]) != "withvalues" {
+		return ErrSyntax()
+	}
+	h, ok, uerr := readTyped[*hashValue](s, cmds[1])
+	if uerr != nil {
+		return uerr
+	}
+
+	if len(cmds) == 2 {
+		if !ok {
+			s.writeNull()
+			return nil
+		}
+		var field string
+		h.mutex.RLock()
+		i := rand.IntN(h.len())
+		h.rangeFields(func(f string, _ string) bool {
+			field = f
+			i--
+			return i >= 0
+		})
+		h.mutex.RUnlock()
+		encoder := resp3.Encoder{}
+		encoder.WriteBulkStr(field)
+		s.conn.Write(encoder.Buf)
+		return nil
+	}
+
+	count, err := strconv.Atoi(cmds[2])
+	if err != nil {
+		return &UserError{"ERR", "value is not an integer or out of range"}
+	}
+	// As in Redis, where -count values, twice as many WITHVALUES, have to be possible
+	if count == math.MinInt || withValues && count < -math.MaxInt/2 {
+		return &UserError{"ERR", "value is out of range"}
+	}
+	if !ok || count == 0 {
+		s.conn.Write(EmptyRespArr)
+		return nil
+	}
+	var pairs [][2]string
+	h.mutex.RLock()
+	pairs = make([][2]string, 0, h.len())
+	h.rangeFields(func(field string, value string) bool {
+		pairs = append(pairs, [2]string{field, value})
+		return true
+	})
+	h.mutex.RUnlock()
+
+	var picked [][2]string
+	if count > 0 {
+		rand.Shuffle(len(pairs), func(i, j int) { pairs[i], pairs[j] = pairs[j], pairs[i] })
+		picked = pairs[:min(count, len(pairs))]
+	} else {
+		picked = make([][2]string, -count)
+		for i := range picked {
+			picked[i] = pairs[rand.IntN(len(pairs))]
+		}
+	}
+
+	encoder := s.encoder()
+	switch {
+	case !withValues:
+		encoder.WriteArrHeader(len(picked))
+	case encoder.RESP3:
+		encoder.WriteArrHeader(len(picked)) // of field and value pairs
+	default:
+		encoder.WriteArrHeader(len(picked) * 2)
+	}
+	for _, pair := range picked {
+		if withValues && encoder.RESP3 {
+			encoder.WriteArrHeader(2)
+		}
+		encoder.WriteBulkStr(pair[0])
+		if withValues {
+			encoder.WriteBulkStr(pair[1])
+		}
+	}
+	s.conn.Write(encoder.Buf)
+	return nil
+}
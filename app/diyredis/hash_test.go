@@ -0,0 +1,185 @@
+package diyredis
+
+import (
+	"bufio"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestHash(t *testing.T) {
+	server := MakeServer()
+	server.Encoding.Hash = ListpackLimits{MaxEntries: 2, MaxValue: 8}
+	session, conn := newTestSession(server)
+	run := func(cmd ...string) string {
+		conn.buf.Reset()
+		session.dispatch(cmd)
+		return conn.buf.String()
+	}
+
+	for _, tc := range []struct {
+		cmd  []string
+		want string
+	}{
+		{[]string{"HSET", "h", "a", "1", "b", "2"}, ":2\r\n"},
+		{[]string{"HSET", "h", "a", "3"}, ":0\r\n"},
+		{[]string{"HGET", "h", "a"}, "$1\r\n3\r\n"},
+		{[]string{"HGET", "h", "c"}, "$-1\r\n"},
+		{[]string{"HMGET", "h", "b", "c"}, "*2\r\n$1\r\n2\r\n$-1\r\n"},
+		{[]string{"HLEN", "h"}, ":2\r\n"},
+		{[]string{"HEXISTS", "h", "b"}, ":1\r\n"},
+		{[]string{"HGETALL", "h"}, "*4\r\n$1\r\na\r\n$1\r\n3\r\n$1\r\nb\r\n$1\r\n2\r\n"},
+		{[]string{"HKEYS", "h"}, "*2\r\n$1\r\na\r\n$1\r\nb\r\n"},
+		{[]string{"OBJECT", "ENCODING", "h"}, "$8\r\nlistpack\r\n"},
+		{[]string{"TYPE", "h"}, "+hash\r\n"},
+		{[]string{"GET", "h"}, string(ErrWrongType().RESP())},
+		{[]string{"HDEL", "h", "a", "c"}, ":1\r\n"},
+		{[]string{"HDEL", "h", "b"}, ":1\r\n"},
+		{[]string{"TYPE", "h"}, "+none\r\n"},
+	} {
+		if got := run(tc.cmd...); got != tc.want {
+			t.Errorf("%v: got %q, want %q", tc.cmd, got, tc.want)
+		}
+	}
+
+	// Too many fields
+	run("HSET", "many", "a", "1", "b", "2", "c", "3")
+	if got := run("OBJECT", "ENCODING", "many"); got != "$9\r\nhashtable\r\n" {
+		t.Errorf("got %q", got)
+	}
+	if got := run("HGET", "many", "c"); got != "$1\r\n3\r\n" {
+		t.Errorf("got %q", got)
+	}
+
+	// A value that is too long
+	run("HSET", "long", "a", "1")
+	run("HSET", "long", "a", strings.Repeat("x", 9))
+	if got := run("OBJECT", "ENCODING", "long"); got != "$9\r\nhashtable\r\n" {
+		t.Errorf("got %q", got)
+	}
+	if got := run("HLEN", "long"); got != ":1\r\n" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestHashIncrAndRandom(t *testing.T) {
+	server := MakeServer()
+	session, conn := newTestSession(server)
+	run := func(cmd ...string) string {
+		conn.buf.Reset()
+		session.dispatch(cmd)
+		return conn.buf.String()
+	}
+
+	for _, tc := range []struct {
+		cmd  []string
+		want string
+	}{
+		{[]string{"HSETNX", "h", "a", "1"}, ":1\r\n"},
+		{[]string{"HSETNX", "h", "a", "2"}, ":0\r\n"},
+		{[]string{"HINCRBY", "h", "a", "41"}, ":42\r\n"},
+		{[]string{"HINCRBY", "h", "n", "-3"}, ":-3\r\n"},
+		{[]string{"HINCRBY", "h", "a", "x"}, "-ERR value is not an integer or out of range\r\n"},
+		{[]string{"HINCRBY", "h", "a", "9223372036854775807"}, "-ERR increment or decrement would overflow\r\n"},
+		{[]string{"HINCRBYFLOAT", "h", "f", "10.5"}, "$4\r\n10.5\r\n"},
+		{[]string{"HINCRBYFLOAT", "h", "f", "0.1"}, "$4\r\n10.6\r\n"},
+		{[]string{"HINCRBYFLOAT", "h", "a", "5.0e3"}, "$4\r\n5042\r\n"},
+		{[]string{"HINCRBYFLOAT", "h", "a", "inf"}, "-ERR value is not a valid float\r\n"},
+		{[]string{"HINCRBYFLOAT", "h", "a", "1.7e308"}, "$309\r\n" + "17" + strings.Repeat("0", 307) + "\r\n"},
+		{[]string{"HINCRBYFLOAT", "h", "a", "1.7e308"}, "-ERR increment would produce NaN or Infinity\r\n"},
+		{[]string{"HSET", "h", "s", "abc"}, ":1\r\n"},
+		{[]string{"HINCRBY", "h", "s", "1"}, "-ERR hash value is not an integer\r\n"},
+		{[]string{"HINCRBYFLOAT", "h", "s", "1"}, "-ERR hash value is not a float\r\n"},
+		{[]string{"HGET", "h", "f"}, "$4\r\n10.6\r\n"},
+		{[]string{"HRANDFIELD", "missing"}, "$-1\r\n"},
+		{[]string{"HRANDFIELD", "missing", "2"}, "*0\r\n"},
+		{[]string{"HRANDFIELD", "h", "1", "FOO"}, "-ERR syntax error\r\n"},
+	} {
+		if got := run(tc.cmd...); got != tc.want {
+			t.Errorf("%v: got %q, want %q", tc.cmd, got, tc.want)
+		}
+	}
+	// Floats are propagated as their result
+	run("HINCRBYFLOAT", "h", "f", "0")
+	if want := "HSET h f 10.6"; len(session.rewrite) != 1 || strings.Join(session.rewrite[0], " ") != want {
+		t.Errorf("HINCRBYFLOAT propagated as %q, want %q", session.rewrite, want)
+	}
+
+	run("DEL", "h")
+	run("HSET", "h", "a", "1", "b", "2", "c", "3")
+	fields := map[string]string{"a": "1", "b": "2", "c": "3"}
+	if got := run("HRANDFIELD", "h"); got != "$1\r\na\r\n" && got != "$1\r\nb\r\n" && got != "$1\r\nc\r\n" {
+		t.Errorf("HRANDFIELD: got %q", got)
+	}
+	for _, tc := range []struct {
+		count    string
+		n        int
+		distinct bool
+	}{{"2", 2, true}, {"10", 3, true}, {"-5", 5, false}} {
+		got := parseTestArr(t, run("HRANDFIELD", "h", tc.count, "WITHVALUES"))
+		if len(got) != tc.n*2 {
+			t.Fatalf("HRANDFIELD %s WITHVALUES: got %q", tc.count, got)
+		}
+		seen := map[string]bool{}
+		for i := 0; i < len(got); i += 2 {
+			if fields[got[i]] != got[i+1] || tc.distinct && seen[got[i]] {
+				t.Errorf("HRANDFIELD %s WITHVALUES: got %q", tc.count, got)
+			}
+			seen[got[i]] = true
+		}
+	}
+	session.proto = 3
+	if got := run("HRANDFIELD", "h", "-1", "WITHVALUES"); !strings.HasPrefix(got, "*1\r\n*2\r\n$1\r\n") {
+		t.Errorf("HRANDFIELD WITHVALUES in RESP3: got %q", got)
+	}
+}
+
+// Parse a RESP2 array of bulk strings.
+func parseTestArr(t *testing.T, reply string) []string {
+	t.Helper()
+	parsed, err := readReply(bufio.NewReader(strings.NewReader(reply)))
+	arr, ok := parsed.([]any)
+	if err != nil || !ok {
+		t.Fatalf("got %q, want an array", reply)
+	}
+	strs := make([]string, len(arr))
+	for i, elem := range arr {
+		strs[i], _ = elem.(string)
+	}
+	return strs
+}
+
+// A hash emptied and deleted by one client doesn't swallow the fields another one sets
+// or increments at the same time.
+func TestHashConcurrentSetAndDelete(t *testing.T) {
+	server := MakeServer()
+	var wg sync.WaitGroup
+	for _, field := range []string{"a", "b", "c", "d"} {
+		session, conn := newTestSession(server)
+		run := func(cmd ...string) string {
+			conn.buf.Reset()
+			session.dispatch(cmd)
+			return conn.buf.String()
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 20000 {
+				set := []string{"HSET", "h", field, "1"}
+				if i%2 == 1 {
+					set = []string{"HINCRBY", "h", field, "1"}
+				}
+				if got := run(set...); got != ":1\r\n" {
+					t.Errorf("%q: got %q", set, got)
+					return
+				}
+				if got := run("HGET", "h", field); got != "$1\r\n1\r\n" {
+					t.Errorf("HGET of a field just set: got %q", got)
+					return
+				}
+				run("HDEL", "h", field)
+			}
+		}()
+	}
+	wg.Wait()
+}
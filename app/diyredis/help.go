@@ -0,0 +1,33 @@
+package diyredis
+
+import "strings"
+
+// Commands with subcommands answer "<command> HELP" with a summary of them, which
+// redis-cli and other tools use to offer completions. The summary is part of the
+// command's registry entry, and the dispatcher takes care of replying with it, so
+// handlers never see HELP.
+
+// Reply to "<command> HELP", in the format Redis uses.
+func (s *Session) writeHelp(spec *command) {
+	name := strings.ToUpper(spec.name)
+	lines := make([]string, 0, len(spec.help)+3)
+	lines = append(lines, name+" <subcommand> [<arg> [value] [opt] ...]. Subcommands are:")
+	lines = append(lines, spec.help...)
+	lines = append(lines, "HELP", "    Print this help.")
+
+	encoder := s.encoder()
+	encoder.WriteArrHeader(len(lines))
+	for _, line := range lines {
+		encoder.WriteSimpleStr(line)
+	}
+	s.conn.Write(encoder.Buf)
+}
+
+func isHelpRequest(spec *command, cmd []string) bool {
+	return spec.help != nil && len(cmd) == 2 && strings.ToLower(cmd[1]) == "help"
+}
+
+// For a subcommand the handler doesn't know, pointing to HELP.
+func errUnknownSubcommand(cmds []string) *UserError {
+	return &UserError{"ERR", "unknown subcommand '" + cmds[1] + "'. Try " + strings.ToUpper(cmds[0]) + " HELP."}
+}
@@ -0,0 +1,82 @@
+package diyredis
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestHelp(t *testing.T) {
+	server := MakeServer()
+	server.ClusterEnabled = true
+	session, conn := newTestSession(server)
+	run := func(cmd ...string) string {
+		conn.buf.Reset()
+		session.dispatch(cmd)
+		return conn.buf.String()
+	}
+
+	for name, spec := range commandTable {
+		if spec.help == nil {
+			continue
+		}
+		got := run(strings.ToUpper(name), "help")
+		want := "*" + strconv.Itoa(len(spec.help)+3) + "\r\n+" + strings.ToUpper(name) + " <subcommand> "
+		if !strings.HasPrefix(got, want) || !strings.HasSuffix(got, "+HELP\r\n+    Print this help.\r\n") {
+			t.Errorf("%s HELP: got %q", name, got)
+		}
+		if len(spec.help)%2 != 0 {
+			t.Errorf("%s: every subcommand should come with a description", name)
+		}
+	}
+
+	if got := run("OBJECT", "FOO"); got != "-ERR unknown subcommand 'FOO'. Try OBJECT HELP.\r\n" {
+		t.Errorf("got %q for an unknown subcommand", got)
+	}
+	// Only commands with subcommands have HELP
+	if got := run("GET", "help"); got != "$-1\r\n" {
+		t.Errorf("GET help: got %q", got)
+	}
+}
+
+func TestCommandGetKeys(t *testing.T) {
+	server := MakeServer()
+	session, conn := newTestSession(server)
+	run := func(cmd ...string) string {
+		conn.buf.Reset()
+		session.dispatch(cmd)
+		return conn.buf.String()
+	}
+
+	for _, tc := range []struct {
+		cmd  []string
+		want string
+	}{
+		{[]string{"GET", "a"}, "*1\r\n$1\r\na\r\n"},
+		{[]string{"mset", "a", "1", "b", "2"}, "*2\r\n$1\r\na\r\n$1\r\nb\r\n"},
+		{[]string{"DEL", "a", "b", "c"}, "*3\r\n$1\r\na\r\n$1\r\nb\r\n$1\r\nc\r\n"},
+		{[]string{"OBJECT", "FREQ", "a"}, "*1\r\n$1\r\na\r\n"},
+		{[]string{"XREAD", "COUNT", "2", "STREAMS", "a", "b", "0", "0"}, "*2\r\n$1\r\na\r\n$1\r\nb\r\n"},
+		// A key called "streams", and a COUNT of it
+		{[]string{"XREAD", "STREAMS", "streams", "0"}, "*1\r\n$7\r\nstreams\r\n"},
+		{[]string{"XREAD", "BLOCK", "streams", "STREAMS", "a", "0"}, "*1\r\n$1\r\na\r\n"},
+		{[]string{"XREAD", "STREAMS", "a", "b", "0"}, "-ERR Invalid arguments specified for command\r\n"},
+		{[]string{"MIGRATE", "host", "6379", "", "0", "1000", "KEYS", "a", "b"}, "*2\r\n$1\r\na\r\n$1\r\nb\r\n"},
+		{[]string{"GET"}, "-ERR Invalid arguments specified for command\r\n"},
+		{[]string{"PING"}, "-ERR The command has no key arguments\r\n"},
+		{[]string{"NOSUCHCOMMAND", "a"}, "-ERR Invalid command specified\r\n"},
+	} {
+		if got := run(append([]string{"COMMAND", "GETKEYS"}, tc.cmd...)...); got != tc.want {
+			t.Errorf("COMMAND GETKEYS %q: got %q, want %q", tc.cmd, got, tc.want)
+		}
+	}
+
+	// Commands are known by the names clients know them by
+	server.RenameCommand("get", "fetch")
+	if got := run("COMMAND", "GETKEYS", "FETCH", "a"); got != "*1\r\n$1\r\na\r\n" {
+		t.Errorf("GETKEYS of a renamed command: got %q", got)
+	}
+	if got := run("COMMAND", "COUNT"); got != ":"+strconv.Itoa(len(commandTable))+"\r\n" {
+		t.Errorf("COMMAND COUNT: got %q", got)
+	}
+}
@@ -0,0 +1,79 @@
+package diyredis
+
+import (
+	"strings"
+
+	resp3 "github.com/codecrafters-io/redis-starter-go/app/diyredis/resp3"
+)
+
+type infoSection struct {
+	name   string
+	fields func(s *Server) []string
+	extra  bool // only reported when asked for, by name or with INFO all or everything
+}
+
+// The sections of INFO, in the order they are reported in. Each returns its
+// "field:value" lines.
+var infoSections = []infoSection{
+	{"server", (*Server).infoServer, false},
+	{"clients", (*Server).infoClients, false},
+	{"persistence", (*Server).infoPersistence, false},
+	{"stats", (*Server).infoStats, false},
+	{"replication", (*Server).infoReplication, false},
+	{"commandstats", (*Server).infoCommandStats, true},
+	{"storage", (*Server).infoStorage, false},
+	{"keyspace", (*Server).infoKeyspace, false},
+}
+
+// The sections of INFO in sentinel mode.
+var sentinelInfoSections = []infoSection{
+	{"server", (*Server).infoServer, false},
+	{"sentinel", (*Server).infoSentinel, false},
+}
+
+func boolToInfo(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
+
+// INFO [section [section ...]]
+func (s *Session) doINFO(cmds []string) *UserError {
+	wanted := make(map[string]bool, len(cmds))
+	for _, section := range cmds[1:] {
+		wanted[strings.ToLower(section)] = true
+	}
+	all := wanted["all"] || wanted["everything"]
+	byDefault := len(wanted) == 0 || wanted["default"]
+
+	info := s.server.infoText(func(section infoSection) bool {
+		return all || wanted[section.name] || byDefault && !section.extra
+	})
+	encoder := resp3.Encoder{}
+	encoder.WriteBulkStr(info)
+	s.conn.Write(encoder.Buf)
+	return nil
+}
+
+// The text INFO replies with, for the sections that include returns true for.
+func (s *Server) infoText(include func(section infoSection) bool) string {
+	sections := infoSections
+	if s.Sentinel {
+		sections = sentinelInfoSections
+	}
+	var b strings.Builder
+	for _, section := range sections {
+		if !include(section) {
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteString("\r\n")
+		}
+		b.WriteString("# " + strings.ToUpper(section.name[:1]) + section.name[1:] + "\r\n")
+		for _, field := range section.fields(s) {
+			b.WriteString(field + "\r\n")
+		}
+	}
+	return b.String()
+}
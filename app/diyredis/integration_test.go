@@ -0,0 +1,821 @@
+package diyredis_test
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/diyredis"
+)
+
+// These tests talk to a real server over TCP, the way any other client would.
+
+// Start a server on an ephemeral port, shut down when the test ends. Returns its address.
+func startTestServer(t *testing.T) string {
+	t.Helper()
+	return startTestServerWith(t, nil)
+}
+
+// Like startTestServer, calling configure, if not nil, on the server before starting it.
+// configure may set the Listener too.
+func startTestServerWith(t *testing.T, configure func(*diyredis.Server)) string {
+	t.Helper()
+	server := diyredis.MakeServer()
+	server.SavePoints = nil
+	if configure != nil {
+		configure(server)
+	}
+	if server.Listener == nil {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		server.Listener = listener
+	}
+	listener := server.Listener
+
+	stopped := make(chan struct{})
+	go func() {
+		server.Start()
+		close(stopped)
+	}()
+	t.Cleanup(func() {
+		server.Quitch <- syscall.SIGTERM
+		select {
+		case <-stopped:
+		case <-time.After(5 * time.Second):
+			t.Error("server didn't shut down")
+		}
+	})
+	return listener.Addr().String()
+}
+
+// Minimal RESP client. Replies are decoded to a string (simple and bulk strings), an
+// int64, a []any (arrays, push messages, and maps as alternating keys and values), nil,
+// or a respError.
+type respClient struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+type respError string
+
+func (e respError) Error() string { return string(e) }
+
+func dial(t *testing.T, addr string) *respClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &respClient{conn: conn, reader: bufio.NewReader(conn)}
+}
+
+func (c *respClient) send(args ...string) error {
+	buf := []byte("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		buf = append(buf, "$"+strconv.Itoa(len(arg))+"\r\n"+arg+"\r\n"...)
+	}
+	_, err := c.conn.Write(buf)
+	return err
+}
+
+// Send a command and read its reply. A RESP error is returned as the reply, not as err.
+func (c *respClient) do(args ...string) (any, error) {
+	if err := c.send(args...); err != nil {
+		return nil, err
+	}
+	return c.readReply()
+}
+
+// Like do, but failing the test on connection errors.
+func (c *respClient) must(t *testing.T, args ...string) any {
+	t.Helper()
+	reply, err := c.do(args...)
+	if err != nil {
+		t.Fatalf("%v: %v", args, err)
+	}
+	return reply
+}
+
+func (c *respClient) readLine() (string, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return "", fmt.Errorf("malformed line %q", line)
+	}
+	return line[:len(line)-2], nil
+}
+
+func (c *respClient) readReply() (any, error) {
+	line, err := c.readLine()
+	if err != nil {
+		return nil, err
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return respError(line[1:]), nil
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		length, err := strconv.Atoi(line[1:])
+		if err != nil || length < 0 {
+			return nil, err
+		}
+		buf := make([]byte, length+2)
+		if _, err := io.ReadFull(c.reader, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:length]), nil
+	case '_':
+		return nil, nil
+	case '*', '>', '%':
+		length, err := strconv.Atoi(line[1:])
+		if err != nil || length < 0 {
+			return nil, err
+		}
+		if line[0] == '%' {
+			length *= 2
+		}
+		elems := make([]any, length)
+		for i := range elems {
+			if elems[i], err = c.readReply(); err != nil {
+				return nil, err
+			}
+		}
+		return elems, nil
+	}
+	return nil, fmt.Errorf("unknown reply type %q", line)
+}
+
+func TestIntegrationStrings(t *testing.T) {
+	client := dial(t, startTestServer(t))
+
+	for _, tc := range []struct {
+		cmd  []string
+		want any
+	}{
+		{[]string{"PING"}, "PONG"},
+		{[]string{"GET", "missing"}, nil},
+		{[]string{"SET", "k", "v"}, "OK"},
+		{[]string{"GET", "k"}, "v"},
+		{[]string{"SET", "k", "with\r\nnewline"}, "OK"},
+		{[]string{"GET", "k"}, "with\r\nnewline"},
+		{[]string{"MSET", "a", "1", "b", "2"}, "OK"},
+		{[]string{"NOSUCHCOMMAND"}, respError("ERR Command not known")},
+	} {
+		got := client.must(t, tc.cmd...)
+		if fmt.Sprint(got) != fmt.Sprint(tc.want) {
+			t.Errorf("%q: got %#v, want %#v", tc.cmd, got, tc.want)
+		}
+	}
+	if got := client.must(t, "MGET", "a", "missing", "b"); fmt.Sprint(got) != "[1 <nil> 2]" {
+		t.Errorf("MGET: got %#v", got)
+	}
+}
+
+func TestIntegrationExpiry(t *testing.T) {
+	client := dial(t, startTestServer(t))
+
+	client.must(t, "SET", "short", "v", "PX", "50")
+	client.must(t, "SET", "long", "v", "PX", "60000")
+	if got := client.must(t, "GET", "short"); got != "v" {
+		t.Errorf("got %#v before the expiry, want \"v\"", got)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if got := client.must(t, "GET", "short"); got != nil {
+		t.Errorf("got %#v after the expiry, want nil", got)
+	}
+	if got := client.must(t, "GET", "long"); got != "v" {
+		t.Errorf("got %#v for a key that hasn't expired, want \"v\"", got)
+	}
+}
+
+func TestIntegrationStreams(t *testing.T) {
+	client := dial(t, startTestServer(t))
+
+	client.must(t, "XADD", "s", "1-1", "a", "1")
+	client.must(t, "XADD", "s", "1-2", "b", "2")
+	client.must(t, "XADD", "s", "2-0", "c", "3")
+	if got := client.must(t, "XADD", "s", "1-5", "d", "4"); got != respError("ERR the ID specified in XADD is equal or smaller than the target stream top item") {
+		t.Errorf("XADD with a lower ID: got %#v", got)
+	}
+
+	got := client.must(t, "XRANGE", "s", "1-2", "+")
+	if want := "[[1-2 [b 2]] [2-0 [c 3]]]"; fmt.Sprint(got) != want {
+		t.Errorf("XRANGE: got %v, want %v", got, want)
+	}
+	got = client.must(t, "XREAD", "STREAMS", "s", "1-1")
+	if want := "[[s [[1-2 [b 2]] [2-0 [c 3]]]]]"; fmt.Sprint(got) != want {
+		t.Errorf("XREAD: got %v, want %v", got, want)
+	}
+
+	client.must(t, "SET", "str", "v")
+	if got := client.must(t, "XRANGE", "str", "-", "+"); got != respError("WRONGTYPE Operation against a key holding the wrong kind of value") {
+		t.Errorf("XRANGE on a string: got %#v", got)
+	}
+}
+
+func TestIntegrationXreadBlock(t *testing.T) {
+	addr := startTestServer(t)
+	reader, writer := dial(t, addr), dial(t, addr)
+
+	writer.must(t, "XADD", "s", "1-0", "a", "1")
+
+	// Reading after 1-0, rather than $, gets the entry whether the XADD below happens
+	// before or after the reader blocks.
+	replies := make(chan any, 1)
+	go func() {
+		reply, err := reader.do("XREAD", "BLOCK", "0", "STREAMS", "s", "1-0")
+		if err != nil {
+			reply = err
+		}
+		replies <- reply
+	}()
+	time.Sleep(20 * time.Millisecond)
+	writer.must(t, "XADD", "s", "2-0", "b", "2")
+
+	select {
+	case got := <-replies:
+		if want := "[[s [[2-0 [b 2]]]]]"; fmt.Sprint(got) != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("XREAD BLOCK wasn't woken up by XADD")
+	}
+
+	start := time.Now()
+	if got := reader.must(t, "XREAD", "BLOCK", "50", "STREAMS", "s", "$"); got != nil {
+		t.Errorf("got %v after the timeout, want nil", got)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("returned after %v, before the timeout", elapsed)
+	}
+}
+
+func TestIntegrationConcurrentClients(t *testing.T) {
+	addr := startTestServer(t)
+	const clients, perClient = 8, 50
+
+	var wg sync.WaitGroup
+	errs := make(chan error, clients)
+	for i := range clients {
+		client := dial(t, addr)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			key := "key" + strconv.Itoa(i)
+			for j := range perClient {
+				value := strconv.Itoa(j)
+				if reply, err := client.do("SET", key, value); err != nil || reply != "OK" {
+					errs <- fmt.Errorf("SET: %v %v", reply, err)
+					return
+				}
+				if reply, err := client.do("GET", key); err != nil || reply != value {
+					errs <- fmt.Errorf("GET %s: got %v %v, want %s", key, reply, err, value)
+					return
+				}
+				if reply, err := client.do("XADD", "shared", "*", "client", key); err != nil {
+					errs <- err
+					return
+				} else if _, ok := reply.(string); !ok {
+					errs <- fmt.Errorf("XADD: got %#v", reply)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	entries, ok := dial(t, addr).must(t, "XRANGE", "shared", "-", "+").([]any)
+	if !ok || len(entries) != clients*perClient {
+		t.Fatalf("got %d entries, want %d", len(entries), clients*perClient)
+	}
+	var prev string
+	for _, entry := range entries {
+		id := entry.([]any)[0].(string)
+		if prev != "" && !idLess(prev, id) {
+			t.Fatalf("entry %s follows %s", id, prev)
+		}
+		prev = id
+	}
+}
+
+func idLess(a, b string) bool {
+	var aMs, aSeq, bMs, bSeq uint64
+	if _, err := fmt.Sscanf(a, "%d-%d", &aMs, &aSeq); err != nil {
+		panic(errors.New("bad ID " + a))
+	}
+	if _, err := fmt.Sscanf(b, "%d-%d", &bMs, &bSeq); err != nil {
+		panic(errors.New("bad ID " + b))
+	}
+	return aMs < bMs || aMs == bMs && aSeq < bSeq
+}
+
+func TestIntegrationTracking(t *testing.T) {
+	addr := startTestServer(t)
+	tracker, writer := dial(t, addr), dial(t, addr)
+
+	tracker.must(t, "HELLO", "3")
+	if got := tracker.must(t, "CLIENT", "TRACKING", "ON"); got != "OK" {
+		t.Fatalf("CLIENT TRACKING: got %#v", got)
+	}
+	if got := tracker.must(t, "GET", "k"); got != nil {
+		t.Fatalf("GET: got %#v", got)
+	}
+	writer.must(t, "SET", "k", "v")
+
+	tracker.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	push, err := tracker.readReply()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "[invalidate [k]]"; fmt.Sprint(push) != want {
+		t.Errorf("got %v, want %v", push, want)
+	}
+}
+
+// Wait for the reply to cmds on client to become want, failing the test if it doesn't
+// within a few seconds.
+func waitForReply(t *testing.T, client *respClient, want any, cmds ...string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got := client.must(t, cmds...)
+		if fmt.Sprint(got) == fmt.Sprint(want) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%q: got %#v, want %#v", cmds, got, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestIntegrationReplication(t *testing.T) {
+	masterAddr := startTestServer(t)
+	master := dial(t, masterAddr)
+	master.must(t, "SET", "before", "1")
+	master.must(t, "SELECT", "2")
+	master.must(t, "SADD", "set", "a", "b", "c")
+
+	replicaAddr := startTestServerWith(t, func(s *diyredis.Server) {
+		s.MasterHost, s.MasterPort, _ = net.SplitHostPort(masterAddr)
+	})
+	replica := dial(t, replicaAddr)
+	waitForReply(t, replica, "1", "GET", "before")
+
+	// Commands executed after the full sync are propagated, to the right database
+	master.must(t, "SET", "after", "2")
+	popped := master.must(t, "SPOP", "set")
+	id := master.must(t, "XADD", "stream", "*", "f", "v")
+	replica.must(t, "SELECT", "2")
+	waitForReply(t, replica, "2", "GET", "after")
+	if got := replica.must(t, "SISMEMBER", "set", popped.(string)); got != int64(0) {
+		t.Errorf("member popped on the master still in the set on the replica")
+	}
+	if got := replica.must(t, "SCARD", "set"); got != int64(2) {
+		t.Errorf("SCARD: got %#v, want 2", got)
+	}
+	if got := replica.must(t, "XRANGE", "stream", "-", "+"); fmt.Sprint(got) != fmt.Sprintf("[[%s [f v]]]", id) {
+		t.Errorf("XRANGE: got %#v, want the entry with ID %s", got, id)
+	}
+
+	if got := replica.must(t, "SET", "k", "v"); got != respError("READONLY You can't write against a read only replica.") {
+		t.Errorf("SET on the replica: got %#v", got)
+	}
+	if got := replica.must(t, "INFO", "replication"); !strings.Contains(got.(string), "master_link_status:up") {
+		t.Errorf("INFO replication on the replica: got %q", got)
+	}
+
+	// Promoted to a master, it accepts writes again
+	replica.must(t, "REPLICAOF", "NO", "ONE")
+	if got := replica.must(t, "SET", "k", "v"); got != "OK" {
+		t.Errorf("SET after REPLICAOF NO ONE: got %#v", got)
+	}
+}
+
+func TestIntegrationFullSync(t *testing.T) {
+	for _, diskless := range []bool{true, false} {
+		t.Run(fmt.Sprintf("diskless=%v", diskless), func(t *testing.T) {
+			masterAddr := startTestServerWith(t, func(s *diyredis.Server) {
+				s.ReplDisklessSync = diskless
+			})
+			master := dial(t, masterAddr)
+			for i := range 1000 {
+				master.must(t, "SET", "key"+strconv.Itoa(i), strings.Repeat("v", 100))
+			}
+			master.must(t, "SELECT", "3")
+			master.must(t, "RPUSH", "list", "a", "b")
+
+			replica := dial(t, startTestServerWith(t, func(s *diyredis.Server) {
+				s.MasterHost, s.MasterPort, _ = net.SplitHostPort(masterAddr)
+			}))
+			replica.must(t, "SELECT", "3")
+			waitForReply(t, replica, []any{"a", "b"}, "LRANGE", "list", "0", "-1")
+			master.must(t, "RPUSH", "list", "c")
+			waitForReply(t, replica, []any{"a", "b", "c"}, "LRANGE", "list", "0", "-1")
+			replica.must(t, "SELECT", "0")
+			if got := replica.must(t, "GET", "key999"); got != strings.Repeat("v", 100) {
+				t.Errorf("GET key999: got %#v", got)
+			}
+		})
+	}
+}
+
+func TestIntegrationReplicaServeStaleData(t *testing.T) {
+	// Nothing listens on the master's address, so the link never comes up
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	masterAddr := listener.Addr().String()
+	listener.Close()
+
+	replica := dial(t, startTestServerWith(t, func(s *diyredis.Server) {
+		s.MasterHost, s.MasterPort, _ = net.SplitHostPort(masterAddr)
+		s.ReplicaServeStaleData = false
+	}))
+	want := respError("MASTERDOWN Link with MASTER is down and replica-serve-stale-data is set to 'no'.")
+	if got := replica.must(t, "GET", "k"); got != want {
+		t.Errorf("GET: got %#v, want %#v", got, want)
+	}
+	if got := replica.must(t, "PING"); got != "PONG" {
+		t.Errorf("PING: got %#v, want PONG", got)
+	}
+}
+
+// Return the value of field in the INFO section, or "" if it's missing.
+func infoField(t *testing.T, client *respClient, section string, field string) string {
+	t.Helper()
+	info, _ := client.must(t, "INFO", section).(string)
+	for _, line := range strings.Split(info, "\r\n") {
+		if value, ok := strings.CutPrefix(line, field+":"); ok {
+			return value
+		}
+	}
+	return ""
+}
+
+// Wait for field in the INFO section to become want, failing the test if it doesn't
+// within a few seconds.
+func waitForInfo(t *testing.T, client *respClient, section string, field string, want string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got := infoField(t, client, section, field)
+		if got == want {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("INFO %s %s: got %q, want %q", section, field, got, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestIntegrationReplicationOffsets(t *testing.T) {
+	masterAddr := startTestServer(t)
+	master := dial(t, masterAddr)
+	host, port, _ := net.SplitHostPort(masterAddr)
+	replicaAddr := startTestServerWith(t, func(s *diyredis.Server) {
+		s.MasterHost, s.MasterPort = host, port
+	})
+	_, replicaPort, _ := net.SplitHostPort(replicaAddr)
+	replica := dial(t, replicaAddr)
+	waitForInfo(t, replica, "replication", "master_link_status", "up")
+
+	master.must(t, "SELECT", "3")
+	master.must(t, "SET", "k", "1")
+	master.must(t, "XADD", "s", "*", "f", "v")
+	offset := infoField(t, master, "replication", "master_repl_offset")
+	if offset == "0" {
+		t.Fatal("master_repl_offset didn't move")
+	}
+	waitForInfo(t, replica, "replication", "slave_repl_offset", offset)
+	waitForInfo(t, replica, "replication", "master_repl_offset", offset)
+	// Replicas ACK their offset every second
+	waitForInfo(t, master, "replication", "slave0", "ip=127.0.0.1,port="+replicaPort+",state=online,offset="+offset+",lag=0")
+
+	// Reconnecting to the same master, the replica continues where it was
+	replica.must(t, "REPLICAOF", host, port)
+	waitForInfo(t, master, "stats", "sync_partial_ok", "1")
+	if got := infoField(t, master, "stats", "sync_full"); got != "1" {
+		t.Errorf("sync_full: got %q, want 1", got)
+	}
+	master.must(t, "SET", "k", "2") // still in database 3
+	replica.must(t, "SELECT", "3")
+	waitForReply(t, replica, "2", "GET", "k")
+}
+
+// Forward connections to target, until cut is called, which breaks the ones open so far.
+func startProxy(t *testing.T, target string) (addr string, cut func()) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	var mutex sync.Mutex
+	var conns []net.Conn
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			upstream, err := net.Dial("tcp", target)
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			mutex.Lock()
+			conns = append(conns, conn, upstream)
+			mutex.Unlock()
+			go func() { io.Copy(upstream, conn); upstream.Close() }()
+			go func() { io.Copy(conn, upstream); conn.Close() }()
+		}
+	}()
+	t.Cleanup(func() { cut() })
+	return listener.Addr().String(), func() {
+		mutex.Lock()
+		defer mutex.Unlock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+		conns = nil
+	}
+}
+
+func TestIntegrationPartialResync(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		backlogSize diyredis.MemorySize
+		missed      string // value set on the master while the replica is disconnected
+		syncs       string // sync_full and sync_partial_ok on the master
+	}{
+		{"from the backlog", 1 << 20, "missed", "1 1"},
+		{"backlog too small", 64, strings.Repeat("x", 100), "2 0"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			masterAddr := startTestServerWith(t, func(s *diyredis.Server) {
+				s.ReplBacklogSize = tc.backlogSize
+			})
+			master := dial(t, masterAddr)
+			proxyAddr, cut := startProxy(t, masterAddr)
+			replica := dial(t, startTestServerWith(t, func(s *diyredis.Server) {
+				s.MasterHost, s.MasterPort, _ = net.SplitHostPort(proxyAddr)
+			}))
+			master.must(t, "SET", "k", "before")
+			waitForReply(t, replica, "before", "GET", "k")
+
+			cut()
+			master.must(t, "SET", "k", tc.missed)
+			waitForReply(t, replica, tc.missed, "GET", "k")
+			syncs := infoField(t, master, "stats", "sync_full") + " " + infoField(t, master, "stats", "sync_partial_ok")
+			if syncs != tc.syncs {
+				t.Errorf("sync_full sync_partial_ok: got %s, want %s", syncs, tc.syncs)
+			}
+		})
+	}
+}
+
+func TestIntegrationFailover(t *testing.T) {
+	masterAddr := startTestServer(t)
+	master := dial(t, masterAddr)
+	host, port, _ := net.SplitHostPort(masterAddr)
+	replicaAddr := startTestServerWith(t, func(s *diyredis.Server) {
+		s.MasterHost, s.MasterPort = host, port
+	})
+	_, replicaPort, _ := net.SplitHostPort(replicaAddr)
+	replica := dial(t, replicaAddr)
+	waitForInfo(t, replica, "replication", "master_link_status", "up")
+	master.must(t, "SET", "k", "1")
+
+	for _, tc := range []struct {
+		client *respClient
+		cmd    []string
+		want   any
+	}{
+		{master, []string{"FAILOVER", "ABORT"}, respError("ERR No failover in progress.")},
+		{master, []string{"FAILOVER", "TO", "127.0.0.1", "1"}, respError("ERR FAILOVER target HOST and PORT is not a replica.")},
+		{master, []string{"FAILOVER", "FORCE"}, respError("ERR FAILOVER with force option requires both a timeout and target HOST and IP.")},
+		{master, []string{"FAILOVER", "TIMEOUT", "0"}, respError("ERR FAILOVER timeout must be greater than 0")},
+		{replica, []string{"FAILOVER"}, respError("ERR FAILOVER is not valid when server is a replica.")},
+	} {
+		if got := tc.client.must(t, tc.cmd...); got != tc.want {
+			t.Errorf("%q: got %#v, want %#v", tc.cmd, got, tc.want)
+		}
+	}
+
+	if got := master.must(t, "FAILOVER", "TO", "127.0.0.1", replicaPort, "TIMEOUT", "5000"); got != "OK" {
+		t.Fatalf("FAILOVER: got %#v", got)
+	}
+	waitForInfo(t, master, "replication", "master_link_status", "up")
+	waitForInfo(t, master, "replication", "master_failover_state", "no-failover")
+	if got := infoField(t, replica, "replication", "role"); got != "master" {
+		t.Errorf("role of the replica: got %q, want master", got)
+	}
+	// The old master continued from the new one, with the same history
+	if got := infoField(t, replica, "stats", "sync_partial_ok"); got != "1" {
+		t.Errorf("sync_partial_ok on the new master: got %q, want 1", got)
+	}
+
+	if got := master.must(t, "SET", "k", "2"); got != respError("READONLY You can't write against a read only replica.") {
+		t.Errorf("SET on the old master: got %#v", got)
+	}
+	replica.must(t, "SET", "k", "3")
+	waitForReply(t, master, "3", "GET", "k")
+}
+
+func TestIntegrationSentinel(t *testing.T) {
+	var masterServer *diyredis.Server
+	masterAddr := startTestServerWith(t, func(s *diyredis.Server) { masterServer = s })
+	host, port, _ := net.SplitHostPort(masterAddr)
+	var replicas []*respClient
+	for range 2 {
+		replica := dial(t, startTestServerWith(t, func(s *diyredis.Server) {
+			s.MasterHost, s.MasterPort = host, port
+		}))
+		waitForInfo(t, replica, "replication", "master_link_status", "up")
+		replicas = append(replicas, replica)
+	}
+
+	// The sentinels have to know each other's addresses before they start
+	var listeners []net.Listener
+	for range 3 {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		listeners = append(listeners, listener)
+	}
+	var sentinels []*respClient
+	for i, listener := range listeners {
+		var others []string
+		for j, other := range listeners {
+			if j != i {
+				others = append(others, other.Addr().String())
+			}
+		}
+		sentinels = append(sentinels, dial(t, startTestServerWith(t, func(s *diyredis.Server) {
+			s.Listener = listener
+			s.Sentinel = true
+			s.SentinelDownAfter = 200 * time.Millisecond
+			s.SentinelMasters = []diyredis.SentinelMaster{{Name: "mymaster", Host: host, Port: port, Quorum: 2, Sentinels: others}}
+		})))
+	}
+
+	sentinel := sentinels[0]
+	if got := sentinel.must(t, "GET", "k"); got != respError("ERR Command not known") {
+		t.Errorf("GET on a sentinel: got %#v", got)
+	}
+	if got := sentinel.must(t, "SENTINEL", "GET-MASTER-ADDR-BY-NAME", "mymaster"); fmt.Sprint(got) != fmt.Sprintf("[%s %s]", host, port) {
+		t.Errorf("GET-MASTER-ADDR-BY-NAME: got %#v", got)
+	}
+	if got := sentinel.must(t, "SENTINEL", "MASTER", "nosuchmaster"); got != respError("ERR No such master with that name") {
+		t.Errorf("SENTINEL MASTER of an unknown master: got %#v", got)
+	}
+	for _, sentinel := range sentinels {
+		waitForInfo(t, sentinel, "sentinel", "master0", "name=mymaster,status=ok,address="+masterAddr+",slaves=2,sentinels=3")
+	}
+
+	masterServer.Quitch <- syscall.SIGTERM
+	// Every sentinel ends up with one of the replicas as the master
+	var newMaster string
+	deadline := time.Now().Add(10 * time.Second)
+	for _, sentinel := range sentinels {
+		for {
+			addr, _ := sentinel.must(t, "SENTINEL", "GET-MASTER-ADDR-BY-NAME", "mymaster").([]any)
+			if len(addr) == 2 && addr[1] != port && (newMaster == "" || addr[1] == newMaster) {
+				newMaster = addr[1].(string)
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("no failover, or not to the same replica: got %v", addr)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+
+	// The other replica replicates the new master
+	for _, replica := range replicas {
+		role := infoField(t, replica, "replication", "role")
+		if role == "master" {
+			continue
+		}
+		waitForInfo(t, replica, "replication", "master_port", newMaster)
+		waitForInfo(t, replica, "replication", "master_link_status", "up")
+	}
+}
+
+func TestIntegrationListeners(t *testing.T) {
+	// Short enough a path for a Unix socket, which t.TempDir may not be
+	dir, err := os.MkdirTemp("", "diyredis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	socket := filepath.Join(dir, "redis.sock")
+	extra, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsAddr := freeAddr(t)
+	cert := selfSignedCert(t)
+
+	addr := startTestServerWith(t, func(server *diyredis.Server) {
+		server.Listeners = []net.Listener{extra}
+		server.UnixSocket = socket
+		server.UnixSocketPerm = 0o700
+		server.TLSAddr = tlsAddr
+		server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	})
+	tcp := dial(t, addr)
+	if _, err := tcp.do("SET", "k", "v"); err != nil {
+		t.Fatal(err)
+	}
+
+	clients := map[string]func() (net.Conn, error){
+		"extra listener": func() (net.Conn, error) { return net.Dial("tcp", extra.Addr().String()) },
+		"unix socket":    func() (net.Conn, error) { return net.Dial("unix", socket) },
+		"tls": func() (net.Conn, error) {
+			return tls.Dial("tcp", tlsAddr, &tls.Config{InsecureSkipVerify: true})
+		},
+	}
+	for name, connect := range clients {
+		var conn net.Conn
+		for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+			if conn, err = connect(); err == nil || time.Now().After(deadline) {
+				break
+			}
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		client := &respClient{conn: conn, reader: bufio.NewReader(conn)}
+		if got, err := client.do("GET", "k"); got != "v" || err != nil {
+			t.Errorf("%s: GET got %v, %v", name, got, err)
+		}
+	}
+	if info, err := os.Stat(socket); err != nil || info.Mode().Perm() != 0o700 {
+		t.Errorf("socket: got %v, %v", info.Mode(), err)
+	}
+}
+
+// Return an address on this host nobody listens on right now.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+func selfSignedCert(t *testing.T) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
@@ -0,0 +1,192 @@
+package diyredis
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A record of every command executed while it is on, for tests: replaying it against a
+// fresh server should bring back the same keyspace, one command at a time. Where it
+// doesn't, commands that ran concurrently didn't have the same effect as they would
+// have had one after the other, in the order they finished in.
+//
+// Every command is replayed at the time it originally ran, so that keys expire the same
+// way.
+//
+// Only one journal can be kept at a time, see StartJournal.
+type Journal struct {
+	mutex   sync.Mutex
+	entries []JournalEntry
+}
+
+// A command, as executed by a client.
+type JournalEntry struct {
+	Time time.Time // when it started, according to the server's clock
+	DB   int       // the database it was executed in
+	Cmd  []string  // with the original name of the command, should it have been renamed
+	Err  string    // the error it replied with, if any
+	Keys []KeyVersion
+
+	// What it changed the keyspace by, as propagated to replicas and the AOF; nil if it
+	// didn't, e.g. because it only reads. A key that expired is recorded as a DEL, of its
+	// own.
+	Changes [][]string
+}
+
+// The versions of a key around a command, which are the same if and only if the key
+// holds the same value, with the same expiry. A key that doesn't exist is at version 0.
+type KeyVersion struct {
+	Key  string
+	Pre  uint64 // right before the command ran
+	Post uint64 // right after
+}
+
+// Start recording every command executed into a new journal, replacing the one being
+// kept, if any.
+func (s *Server) StartJournal() *Journal {
+	journal := &Journal{}
+	s.journal.Store(journal)
+	return journal
+}
+
+// Stop recording commands into the journal.
+func (s *Server) StopJournal() {
+	s.journal.Store(nil)
+}
+
+// The commands recorded so far, in the order they finished in.
+func (j *Journal) Entries() []JournalEntry {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	return slices.Clone(j.entries)
+}
+
+func (j *Journal) record(entry JournalEntry) {
+	j.mutex.Lock()
+	j.entries = append(j.entries, entry)
+	j.mutex.Unlock()
+}
+
+// Record that key expired, and was deleted.
+func (j *Journal) recordExpired(now time.Time, db uint, key string) {
+	del := []string{"DEL", key}
+	j.record(JournalEntry{Time: now, DB: int(db), Cmd: del, Changes: [][]string{del}})
+}
+
+// Start the entry of a command about to run on keys in db.
+func (j *Journal) before(db RedisDB, keys []string) *JournalEntry {
+	entry := &JournalEntry{Time: db.now(), DB: int(db.id), Keys: make([]KeyVersion, len(keys))}
+	for i, key := range keys {
+		entry.Keys[i] = KeyVersion{Key: key, Pre: db.keyVersion(key)}
+	}
+	return entry
+}
+
+// Record the command that entry, as returned by before, was started for.
+func (j *Journal) after(db RedisDB, entry *JournalEntry, cmd []string, changes [][]string, uerr *UserError) {
+	entry.Cmd, entry.Changes = slices.Clone(cmd), changes
+	if uerr != nil {
+		entry.Err = uerr.Error()
+	}
+	for i := range entry.Keys {
+		entry.Keys[i].Post = db.keyVersion(entry.Keys[i].Key)
+	}
+	j.record(*entry)
+}
+
+// Execute the changes recorded in the journal on server, checking along the way that
+// every key goes through the same versions. Returns an error for the first command that
+// doesn't bring it to the version the journal has.
+//
+// Meant for a server nobody else uses, as its clock is set back to the time of each
+// command while replaying it.
+func (j *Journal) Replay(server *Server) error {
+	clock := &replayClock{Clock: server.Clock}
+	server.Clock = clock
+	defer func() { server.Clock = clock.Clock }()
+
+	session := &Session{server: server, conn: discardConn{}, db: server.db(0), log: server.Log}
+	for i, entry := range j.Entries() {
+		if entry.Changes == nil {
+			continue
+		}
+		clock.now.Store(&entry.Time)
+		session.SwitchDB(entry.DB)
+		if err := checkVersions(session.db, entry, func(v KeyVersion) uint64 { return v.Pre }); err != nil {
+			return fmt.Errorf("before command %d, %q: %w", i, entry.Cmd, err)
+		}
+		for _, cmd := range entry.Changes {
+			if err := session.replay(cmd); err != nil {
+				return fmt.Errorf("command %d, %q: %w", i, entry.Cmd, err)
+			}
+		}
+		if err := checkVersions(session.db, entry, func(v KeyVersion) uint64 { return v.Post }); err != nil {
+			return fmt.Errorf("after command %d, %q: %w", i, entry.Cmd, err)
+		}
+	}
+	return nil
+}
+
+func checkVersions(db RedisDB, entry JournalEntry, want func(v KeyVersion) uint64) error {
+	for _, v := range entry.Keys {
+		if got := db.keyVersion(v.Key); got != want(v) {
+			return fmt.Errorf("key %q is at version %x, want %x", v.Key, got, want(v))
+		}
+	}
+	return nil
+}
+
+// Tells the time a journal entry was recorded at, while it is replayed.
+type replayClock struct {
+	Clock
+	now atomic.Pointer[time.Time]
+}
+
+func (c *replayClock) Now() time.Time {
+	return *c.now.Load()
+}
+
+// Write the changes recorded in the journal as an AOF, which loading should bring back
+// the same keyspace from.
+func (j *Journal) WriteAof(w io.Writer) error {
+	lastDB := -1
+	for _, entry := range j.Entries() {
+		if entry.Changes == nil {
+			continue
+		}
+		var buf []byte
+		if entry.DB != lastDB {
+			buf = makeRESPArr([]string{"SELECT", strconv.Itoa(entry.DB)})
+			lastDB = entry.DB
+		}
+		for _, cmd := range entry.Changes {
+			buf = append(buf, makeRESPArr(cmd)...)
+		}
+		if _, err := w.Write(buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The version of key, see KeyVersion. Unlike load, this doesn't delete the key if it
+// has expired, only reports it missing.
+func (db RedisDB) keyVersion(key string) uint64 {
+	value, ok := db.engine.Get(key)
+	if !ok {
+		return 0
+	}
+	expiry, ok := db.engine.Expiry(key)
+	if ok && expiry <= db.nowMs() {
+		return 0
+	}
+	hash := fnv.New64a()
+	fmt.Fprintf(hash, "%s %d %v", typeName(value), expiry, plainValue(value))
+	return hash.Sum64() | 1 // never 0, which is for keys that don't exist
+}
@@ -0,0 +1,103 @@
+package diyredis
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestJournal(t *testing.T) {
+	clock := newFakeClock(time.Unix(1700000000, 0))
+	server := MakeServer()
+	server.Clock = clock
+	journal := server.StartJournal()
+
+	var wg sync.WaitGroup
+	for i := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			session, _ := newTestSession(server)
+			key := "key" + strconv.Itoa(i)
+			for j := range 50 {
+				session.dispatch([]string{"RPUSH", key, strconv.Itoa(j)})
+				session.dispatch([]string{"INCR", "counter"})
+			}
+		}()
+	}
+	wg.Wait()
+
+	session, _ := newTestSession(server)
+	for _, cmd := range [][]string{
+		{"SET", "short-lived", "v", "PX", "100"},
+		{"XADD", "stream", "*", "f", "v"},
+		{"HSET", "hash", "f", "v"},
+		{"SELECT", "3"},
+		{"SADD", "set", "a", "b"},
+		{"INCR", "set"},
+	} {
+		session.dispatch(cmd)
+	}
+	clock.Advance(100 * time.Millisecond)
+	session.dispatch([]string{"SELECT", "0"})
+	session.dispatch([]string{"GET", "short-lived"})
+	server.StopJournal()
+	session.dispatch([]string{"SET", "unrecorded", "v"})
+
+	entries := journal.Entries()
+	if got, want := len(entries), 4*100+9; got != want {
+		t.Fatalf("got %d entries, want %d", got, want)
+	}
+	last := entries[len(entries)-1]
+	if last.Cmd[0] != "get" || last.Changes != nil || last.Keys[0] != (KeyVersion{"short-lived", 0, 0}) {
+		t.Errorf("last entry: got %+v", last)
+	}
+	if expired := entries[len(entries)-2]; strings.Join(expired.Cmd, " ") != "DEL short-lived" {
+		t.Errorf("expected the expiry to be recorded, got %+v", expired)
+	}
+	if failed := entries[len(entries)-4]; failed.Err == "" || failed.Changes != nil || failed.DB != 3 {
+		t.Errorf("failed INCR: got %+v", failed)
+	}
+	session.dispatch([]string{"DEL", "unrecorded"})
+	want := server.SnapshotState()
+
+	replayed := MakeServer()
+	replayed.Clock = clock
+	if err := journal.Replay(replayed); err != nil {
+		t.Fatal(err)
+	}
+	if err := want.Diff(replayed.SnapshotState()); err != nil {
+		t.Errorf("replayed: %v", err)
+	}
+
+	// Loading the changes as an AOF gets to the same keyspace
+	loaded := MakeServer()
+	loaded.Clock = clock
+	loaded.RdbDir = t.TempDir()
+	file, err := os.Create(filepath.Join(loaded.RdbDir, loaded.AppendFilename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := journal.WriteAof(file); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	if ok, err := loaded.LoadAof(); !ok || err != nil {
+		t.Fatalf("LoadAof: got %v, %v", ok, err)
+	}
+	if err := want.Diff(loaded.SnapshotState()); err != nil {
+		t.Errorf("loaded from the AOF: %v", err)
+	}
+
+	// Replaying where a key isn't what it was tells which command it diverged at
+	diverged := MakeServer()
+	diverged.Clock = clock
+	diverged.db(3).set("set", "not a set", 0)
+	if err := journal.Replay(diverged); err == nil || !strings.Contains(err.Error(), `before command 404, ["sadd" "set" "a" "b"]: key "set"`) {
+		t.Errorf("got %v", err)
+	}
+}
@@ -0,0 +1,107 @@
+package diyredis
+
+import (
+	"math/bits"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// How long the calls to a command took, counted in buckets that are a power of two
+// microseconds wide, the way Redis reports its HDR histograms: bucket i holds the calls
+// that took more than 2^(i-1) and at most 2^i microseconds. Calls that took less than a
+// microsecond are counted in the first, those that took longer than the last (about a
+// second, like Redis tracks at most) in the last.
+type latencyHistogram struct {
+	buckets [latencyBuckets]atomic.Int64
+}
+
+const latencyBuckets = 21 // up to 2^20 microseconds
+
+func (h *latencyHistogram) record(d time.Duration) {
+	usec := max(d.Microseconds(), 1)
+	h.buckets[min(bits.Len64(uint64(usec-1)), latencyBuckets-1)].Add(1)
+}
+
+func (h *latencyHistogram) reset() {
+	for i := range h.buckets {
+		h.buckets[i].Store(0)
+	}
+}
+
+var latencyHelp = []string{
+	"HISTOGRAM [<command> ...]",
+	"    Return the cumulative distribution of latencies of the given commands, or all, in usec.",
+}
+
+// LATENCY HISTOGRAM [command ...]
+func (s *Session) doLATENCY(cmds []string) *UserError {
+	if len(cmds) < 2 {
+		return &UserError{"ERR", "wrong number of arguments for LATENCY command"}
+	}
+	if strings.ToLower(cmds[1]) != "histogram" {
+		return errUnknownSubcommand(cmds)
+	}
+
+	// Commands never called, or not known, are left out
+	var names []string
+	if len(cmds) == 2 {
+		for name := range s.server.commandStats {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+	} else {
+		for _, name := range cmds[2:] {
+			name = strings.ToLower(name)
+			if _, ok := s.server.commandStats[name]; ok && !slices.Contains(names, name) {
+				names = append(names, name)
+			}
+		}
+	}
+	type histogram struct {
+		name    string
+		buckets [latencyBuckets]int64
+		calls   int64
+	}
+	var histograms []histogram
+	for _, name := range names {
+		h := histogram{name: name}
+		for i := range h.buckets {
+			h.buckets[i] = s.server.commandStats[name].latency.buckets[i].Load()
+			h.calls += h.buckets[i]
+		}
+		if h.calls > 0 {
+			histograms = append(histograms, h)
+		}
+	}
+
+	encoder := s.encoder()
+	encoder.WriteMapHeader(len(histograms))
+	for _, h := range histograms {
+		encoder.WriteBulkStr(h.name)
+		encoder.WriteMapHeader(2)
+		encoder.WriteBulkStr("calls")
+		encoder.WriteIntFast(h.calls)
+		encoder.WriteBulkStr("histogram_usec")
+		// Cumulative, for the buckets that add any calls
+		var used int
+		for _, count := range h.buckets {
+			if count > 0 {
+				used++
+			}
+		}
+		encoder.WriteMapHeader(used)
+		var cumulative int64
+		for i, count := range h.buckets {
+			if count == 0 {
+				continue
+			}
+			cumulative += count
+			encoder.WriteIntFast(1 << i)
+			encoder.WriteIntFast(cumulative)
+		}
+	}
+	s.conn.Write(encoder.Buf)
+	return nil
+}
@@ -0,0 +1,119 @@
+package diyredis
+
+import (
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	listpack "github.com/codecrafters-io/redis-starter-go/app/diyredis/listpack"
+	streams "github.com/codecrafters-io/redis-starter-go/app/diyredis/streams"
+)
+
+// Freeing the values of deleted keys in the background, as Redis does with
+// lazyfree-lazy-expire and lazyfree-lazy-user-del.
+//
+// The memory itself is reclaimed by the garbage collector, concurrently with everything
+// else, once nothing refers to a value anymore. Freeing a value here means emptying it,
+// so that whoever may still hold on to it, e.g. a command that loaded it right before it
+// was deleted, doesn't keep all its elements alive. For a stream that means taking its
+// tree apart node by node, which for millions of entries is too long to do while the
+// client that deleted it waits.
+
+// Values with at most this many elements are freed right away, as handing them off would
+// cost about as much.
+const lazyFreeThreshold = 64
+
+// How many values can wait to be freed; past that, they are freed right away.
+const lazyFreeQueueLen = 1024
+
+// How many entries of a stream are deleted at a time, letting others at the stream (and
+// the CPU) in between.
+const lazyFreeStreamChunk = 1024
+
+type lazyFreeState struct {
+	start   sync.Once
+	queue   chan any
+	pending atomic.Int64 // values queued to be freed
+	freed   atomic.Int64 // values freed in the background
+}
+
+// Free value, which was just deleted: in the background if lazy, unless it is small, or
+// else right away.
+func (s *Server) freeValue(value any, lazy bool) {
+	if !lazy || freeEffort(value) <= lazyFreeThreshold {
+		freeNow(value)
+		return
+	}
+	s.lazyFree.start.Do(func() {
+		s.lazyFree.queue = make(chan any, lazyFreeQueueLen)
+		go s.lazyFreeLoop()
+	})
+	s.lazyFree.pending.Add(1)
+	select {
+	case s.lazyFree.queue <- value:
+	default:
+		s.lazyFree.pending.Add(-1)
+		freeNow(value)
+	}
+}
+
+func (s *Server) lazyFreeLoop() {
+	defer s.reportCrashes()
+	for value := range s.lazyFree.queue {
+		freeNow(value)
+		s.lazyFree.freed.Add(1)
+		s.lazyFree.pending.Add(-1)
+	}
+}
+
+// Roughly how long freeing value takes: the number of elements it holds.
+func freeEffort(value any) int {
+	switch val := value.(type) {
+	case *hashValue:
+		val.mutex.RLock()
+		defer val.mutex.RUnlock()
+		return val.len()
+	case *listValue:
+		val.mutex.RLock()
+		defer val.mutex.RUnlock()
+		return val.len()
+	case *setValue:
+		val.mutex.RLock()
+		defer val.mutex.RUnlock()
+		return val.len()
+	case *streams.Stream:
+		return val.Len()
+	}
+	return 1
+}
+
+// Empty value, keeping it usable in case someone still holds on to it.
+func freeNow(value any) {
+	switch val := value.(type) {
+	case *hashValue:
+		val.mutex.Lock()
+		val.lp, val.fields = listpack.New(), nil
+		val.mutex.Unlock()
+	case *listValue:
+		val.mutex.Lock()
+		val.lp, val.items = listpack.New(), deque{}
+		val.mutex.Unlock()
+	case *setValue:
+		val.mutex.Lock()
+		val.lp, val.members, val.order = listpack.New(), nil, nil
+		val.mutex.Unlock()
+	case *streams.Stream:
+		for val.Trim(val.Len()-lazyFreeStreamChunk) > 0 {
+			runtime.Gosched()
+		}
+	}
+}
+
+// The lines INFO stats reports about freeing values.
+func (s *Server) infoLazyFree() []string {
+	return []string{
+		"lazyfree_pending_objects:" + strconv.FormatInt(s.lazyFree.pending.Load(), 10),
+		"lazyfreed_objects:" + strconv.FormatInt(s.lazyFree.freed.Load(), 10),
+	}
+}
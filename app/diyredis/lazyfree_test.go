@@ -0,0 +1,92 @@
+package diyredis
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	streams "github.com/codecrafters-io/redis-starter-go/app/diyredis/streams"
+)
+
+func TestLazyFree(t *testing.T) {
+	server := MakeServer()
+	clock := newFakeClock(time.Unix(1700000000, 0))
+	server.Clock = clock
+	session, conn := newTestSession(server)
+	run := func(cmd ...string) string {
+		conn.buf.Reset()
+		session.dispatch(cmd)
+		return conn.buf.String()
+	}
+	// Wait for the background frees to be done, and return how many there were
+	lazyFreed := func() int64 {
+		for deadline := time.Now().Add(5 * time.Second); server.lazyFree.pending.Load() > 0; time.Sleep(time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatal("values still pending to be freed")
+			}
+		}
+		return server.lazyFree.freed.Load()
+	}
+	bigHash := func(key string) *hashValue {
+		args := []string{"HSET", key}
+		for i := range 1000 {
+			args = append(args, "f"+strconv.Itoa(i), "v")
+		}
+		run(args...)
+		value, _, _ := session.db.load(key)
+		return value.(*hashValue)
+	}
+
+	// DEL frees right away by default, UNLINK in the background
+	hash := bigHash("h")
+	if got := run("DEL", "h"); got != ":1\r\n" {
+		t.Fatalf("DEL: got %q", got)
+	}
+	if hash.len() != 0 || lazyFreed() != 0 {
+		t.Errorf("DEL: %d fields left, %d freed in the background", hash.len(), lazyFreed())
+	}
+	hash = bigHash("h")
+	if got := run("UNLINK", "h", "missing"); got != ":1\r\n" {
+		t.Fatalf("UNLINK: got %q", got)
+	}
+	if got := lazyFreed(); got != 1 || hash.len() != 0 {
+		t.Errorf("UNLINK: %d fields left, %d freed in the background", hash.len(), got)
+	}
+	// Not worth the handoff
+	run("RPUSH", "small", "a", "b")
+	run("UNLINK", "small")
+	if got := lazyFreed(); got != 1 {
+		t.Errorf("UNLINK of a small list: %d freed in the background, want 1", got)
+	}
+
+	run("CONFIG", "SET", "lazyfree-lazy-user-del", "yes")
+	hash = bigHash("h")
+	run("DEL", "h")
+	if got := lazyFreed(); got != 2 || hash.len() != 0 {
+		t.Errorf("lazy DEL: %d fields left, %d freed in the background", hash.len(), got)
+	}
+
+	run("CONFIG", "SET", "lazyfree-lazy-expire", "yes")
+	if got := run("CONFIG", "GET", "lazyfree-lazy-expire"); got != "*2\r\n$20\r\nlazyfree-lazy-expire\r\n$3\r\nyes\r\n" {
+		t.Errorf("CONFIG GET: got %q", got)
+	}
+	for i := range 3000 {
+		run("XADD", "x", "1-"+strconv.Itoa(i+1), "f", "v")
+	}
+	value, _, _ := session.db.load("x")
+	stream := value.(*streams.Stream)
+	run("PEXPIREAT", "x", strconv.FormatInt(clock.Now().Add(100*time.Millisecond).UnixMilli(), 10))
+	clock.Advance(100 * time.Millisecond)
+	if got := run("EXISTS", "x"); got != ":0\r\n" {
+		t.Fatalf("EXISTS once expired: got %q", got)
+	}
+	if got := lazyFreed(); got != 3 || stream.Len() != 0 {
+		t.Errorf("expired stream: %d entries left, %d freed in the background", stream.Len(), got)
+	}
+
+	info := run("INFO", "stats")
+	if !strings.Contains(info, "lazyfree_pending_objects:0\r\n") || !strings.Contains(info, "lazyfreed_objects:3\r\n") {
+		t.Errorf("INFO stats: got %q", info)
+	}
+}
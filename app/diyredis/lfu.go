@@ -0,0 +1,96 @@
+package diyredis
+
+import (
+	"math/rand/v2"
+	"sync/atomic"
+	"time"
+)
+
+// How often keys are accessed, kept like Redis does for its LFU eviction policies: a
+// counter of 8 bits per key, incremented on access with a probability that gets lower
+// the higher it is, so that it takes about a million accesses to saturate it with the
+// default log factor, and decremented as time passes without any, so that keys that
+// were popular once don't stay that way. There's no eviction yet, so OBJECT FREQ is all
+// that reports it.
+//
+// The counter of a key is packed with the time it was last decremented, in minutes, into
+// the lower 24 bits of a uint32: the time in the upper 16 of those, the counter in the
+// lower 8.
+type LFUConfig struct {
+	LogFactor atomic.Int64 // the higher, the more accesses it takes to increment a counter
+	DecayTime atomic.Int64 // in minutes, after which a counter is decremented by one; 0 for never
+}
+
+const (
+	DefaultLFULogFactor = 10
+	DefaultLFUDecayTime = 1
+
+	// The counter of a key that was just created, so that it has some time to be
+	// accessed before it'd be evicted
+	lfuInitVal = 5
+)
+
+// The current time in minutes, as much of it as fits into 16 bits.
+func lfuMinutes(now time.Time) uint32 {
+	return uint32(now.Unix()/60) & 0xffff
+}
+
+// Minutes since then, as returned by lfuMinutes, which may have wrapped around since.
+func lfuElapsed(now, then uint32) uint32 {
+	if now >= then {
+		return now - then
+	}
+	return 0xffff - then + now
+}
+
+// The counter of packed, decremented for every decay time that passed since it last was.
+func (c *LFUConfig) decayed(packed uint32, now time.Time) uint32 {
+	counter := packed & 0xff
+	decayTime := c.DecayTime.Load()
+	if decayTime <= 0 {
+		return counter
+	}
+	periods := int64(lfuElapsed(lfuMinutes(now), packed>>8)) / decayTime
+	return uint32(max(int64(counter)-periods, 0))
+}
+
+// Increment counter, logarithmically.
+func (c *LFUConfig) increment(counter uint32) uint32 {
+	if counter == 0xff {
+		return counter
+	}
+	base := max(float64(counter)-lfuInitVal, 0)
+	if rand.Float64() < 1/(base*float64(c.LogFactor.Load())+1) {
+		counter++
+	}
+	return counter
+}
+
+// Count an access of key, which exists.
+func (db RedisDB) countAccess(key string) {
+	now := db.now()
+	val, ok := db.lfu.Load(key)
+	if !ok {
+		initial := &atomic.Uint32{}
+		initial.Store(lfuMinutes(now)<<8 | lfuInitVal)
+		val, _ = db.lfu.LoadOrStore(key, initial)
+	}
+	packed := val.(*atomic.Uint32)
+	for {
+		old := packed.Load()
+		counter := db.lfuConfig.increment(db.lfuConfig.decayed(old, now))
+		if packed.CompareAndSwap(old, lfuMinutes(now)<<8|counter) {
+			return
+		}
+	}
+}
+
+// The access frequency of key, as reported by OBJECT FREQ. Reading it doesn't count as
+// an access, nor decrement it, as only an access does that.
+func (db RedisDB) frequency(key string) int {
+	val, ok := db.lfu.Load(key)
+	if !ok {
+		return lfuInitVal // never accessed since it was created
+	}
+	return int(db.lfuConfig.decayed(val.(*atomic.Uint32).Load(), db.now()))
+}
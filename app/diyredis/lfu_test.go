@@ -0,0 +1,90 @@
+package diyredis
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLFU(t *testing.T) {
+	server := MakeServer()
+	clock := newFakeClock(time.Unix(1700000000, 0))
+	server.Clock = clock
+	session, conn := newTestSession(server)
+	run := func(cmd ...string) string {
+		conn.buf.Reset()
+		session.dispatch(cmd)
+		return conn.buf.String()
+	}
+	freq := func(key string) string { return run("OBJECT", "FREQ", key) }
+
+	run("SET", "k", "v")
+	if got := freq("k"); got != ":5\r\n" {
+		t.Errorf("a new key: got %q", got)
+	}
+	if got := freq("missing"); got != "$-1\r\n" {
+		t.Errorf("a missing key: got %q", got)
+	}
+
+	// Every access counts with a log factor of 0, and only commands that use the value
+	run("CONFIG", "SET", "lfu-log-factor", "0")
+	for range 100 {
+		run("GET", "k")
+	}
+	run("TYPE", "k")
+	run("EXISTS", "k")
+	run("TTL", "k")
+	run("KEYS", "*")
+	if got := freq("k"); got != ":105\r\n" {
+		t.Errorf("after 100 GETs: got %q", got)
+	}
+	for range 200 {
+		run("APPEND", "k", "v")
+	}
+	if got := freq("k"); got != ":255\r\n" {
+		t.Errorf("saturated: got %q", got)
+	}
+
+	// Decremented once every decay time without an access
+	clock.Advance(10 * time.Minute)
+	if got := freq("k"); got != ":245\r\n" {
+		t.Errorf("10 minutes later: got %q", got)
+	}
+	run("CONFIG", "SET", "lfu-decay-time", "5")
+	clock.Advance(10 * time.Minute)
+	if got := freq("k"); got != ":251\r\n" {
+		t.Errorf("20 minutes later, with a decay time of 5: got %q", got)
+	}
+	run("GET", "k") // decremented for good, and incremented
+	clock.Advance(time.Minute)
+	if got := freq("k"); got != ":252\r\n" {
+		t.Errorf("after another GET: got %q", got)
+	}
+	run("CONFIG", "SET", "lfu-decay-time", "0")
+	clock.Advance(time.Hour)
+	if got := freq("k"); got != ":252\r\n" {
+		t.Errorf("without decay: got %q", got)
+	}
+
+	run("DEL", "k")
+	run("SET", "k", "v")
+	if got := freq("k"); got != ":5\r\n" {
+		t.Errorf("deleted and created again: got %q", got)
+	}
+
+	// Gets hard to increment, with the default log factor
+	run("CONFIG", "SET", "lfu-log-factor", "10")
+	for range 1000 {
+		run("GET", "k")
+	}
+	if got, _ := strconv.Atoi(strings.TrimSpace(freq("k")[1:])); got <= 5 || got > 100 {
+		t.Errorf("after 1000 GETs with the default log factor: got %d", got)
+	}
+	if got := run("CONFIG", "GET", "lfu-log-factor"); got != "*2\r\n$14\r\nlfu-log-factor\r\n$2\r\n10\r\n" {
+		t.Errorf("CONFIG GET: got %q", got)
+	}
+	if got := run("CONFIG", "SET", "lfu-decay-time", "-1"); got[0] != '-' {
+		t.Errorf("CONFIG SET of a negative decay time: got %q", got)
+	}
+}
@@ -0,0 +1,359 @@
+package diyredis
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+
+	listpack "github.com/codecrafters-io/redis-starter-go/app/diyredis/listpack"
+	resp3 "github.com/codecrafters-io/redis-starter-go/app/diyredis/resp3"
+)
+
+// A list is a listpack while it's small, and a deque once it isn't. Redis calls the
+// latter a quicklist, which is what we report it as.
+type listValue struct {
+	mutex sync.RWMutex
+	lp    listpack.Listpack // nil once converted to a deque
+	items deque
+}
+
+func newList() *listValue {
+	return &listValue{lp: listpack.New()}
+}
+
+// Return a list holding elems, in the encoding that suits it.
+func newListFrom(elems []string, limits ListpackLimits) *listValue {
+	l := newList()
+	l.push(false, elems, limits)
+	return l
+}
+
+func (l *listValue) encoding() string {
+	if l.lp != nil {
+		return "listpack"
+	}
+	return "quicklist"
+}
+
+func (l *listValue) convert() {
+	elems := l.lp.Elements()
+	l.items = deque{items: make([]string, max(len(elems), 8))}
+	for _, elem := range elems {
+		l.items.pushBack(elem)
+	}
+	l.lp = nil
+}
+
+func (l *listValue) len() int {
+	if l.lp != nil {
+		return l.lp.Len()
+	}
+	return l.items.size
+}
+
+// Return the element at index, which must be in range.
+func (l *listValue) get(index int) string {
+	if l.lp != nil {
+		return l.lp.Get(index)
+	}
+	return l.items.get(index)
+}
+
+// Add elems to the head of the list, one after the other, or to the tail.
+func (l *listValue) push(head bool, elems []string, limits ListpackLimits) {
+	if l.lp != nil && !limits.fits(l.len()+len(elems), elems...) {
+		l.convert()
+	}
+	for _, elem := range elems {
+		switch {
+		case l.lp != nil && head:
+			l.lp = l.lp.Insert(0, elem)
+		case l.lp != nil:
+			l.lp = l.lp.Append(elem)
+		case head:
+			l.items.pushFront(elem)
+		default:
+			l.items.pushBack(elem)
+		}
+	}
+}
+
+// Remove and return up to count elements from the head of the list, or the tail.
+func (l *listValue) pop(head bool, count int) []string {
+	count = min(count, l.len())
+	popped := make([]string, 0, count)
+	for range count {
+		switch {
+		case l.lp != nil && head:
+			popped = append(popped, l.lp.Get(0))
+			l.lp = l.lp.Delete(0, 1)
+		case l.lp != nil:
+			last := l.lp.Len() - 1
+			popped = append(popped, l.lp.Get(last))
+			l.lp = l.lp.Delete(last, 1)
+		case head:
+			popped = append(popped, l.items.popFront())
+		default:
+			popped = append(popped, l.items.popBack())
+		}
+	}
+	return popped
+}
+
+// Return the elements from index `from` up to and including `to`.
+func (l *listValue) slice(from int, to int) []string {
+	if l.lp != nil {
+		var elems []string
+		l.lp.Range(func(index int, elem string) bool {
+			if index >= from {
+				elems = append(elems, elem)
+			}
+			return index < to
+		})
+		return elems
+	}
+	elems := make([]string, 0, to-from+1)
+	for i := from; i <= to; i++ {
+		elems = append(elems, l.items.get(i))
+	}
+	return elems
+}
+
+// Return a copy that doesn't change along with l.
+func (l *listValue) clone() *listValue {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	if l.lp != nil {
+		return &listValue{lp: l.lp} // listpacks are never modified in place
+	}
+	return &listValue{items: l.items.clone()}
+}
+
+// Ring buffer that can grow at either end.
+type deque struct {
+	items []string
+	head  int // index of the first element in items
+	size  int
+}
+
+func (d *deque) grow() {
+	items := make([]string, max(len(d.items)*2, 8))
+	for i := range d.size {
+		items[i] = d.get(i)
+	}
+	d.items = items
+	d.head = 0
+}
+
+func (d *deque) get(index int) string {
+	return d.items[(d.head+index)%len(d.items)]
+}
+
+func (d *deque) pushFront(elem string) {
+	if d.size == len(d.items) {
+		d.grow()
+	}
+	d.head = (d.head - 1 + len(d.items)) % len(d.items)
+	d.items[d.head] = elem
+	d.size++
+}
+
+func (d *deque) pushBack(elem string) {
+	if d.size == len(d.items) {
+		d.grow()
+	}
+	d.items[(d.head+d.size)%len(d.items)] = elem
+	d.size++
+}
+
+func (d *deque) popFront() string {
+	elem := d.items[d.head]
+	d.items[d.head] = "" // don't keep it alive
+	d.head = (d.head + 1) % len(d.items)
+	d.size--
+	return elem
+}
+
+func (d *deque) popBack() string {
+	i := (d.head + d.size - 1) % len(d.items)
+	elem := d.items[i]
+	d.items[i] = ""
+	d.size--
+	return elem
+}
+
+func (d *deque) clone() deque {
+	items := make([]string, max(d.size, 8))
+	for i := range d.size {
+		items[i] = d.get(i)
+	}
+	return deque{items: items, size: d.size}
+}
+
+// Turn a (possibly negative) index from a command into one into a list of the given
+// length. The result may be out of range.
+func listIndex(index int, length int) int {
+	if index < 0 {
+		return length + index
+	}
+	return index
+}
+
+// LPUSH and RPUSH key element [element ...]
+func (s *Session) doPUSH(cmds []string) *UserError {
+	if len(cmds) < 3 {
+		return &UserError{"ERR", "wrong number of arguments for " + cmds[0] + " command"}
+	}
+
+	length := 0
+	_, uerr := changeCollection(s, cmds[1], newList, func(l *listValue) *UserError {
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+		l.push(strings.ToLower(cmds[0]) == "lpush", cmds[2:], s.server.Encoding.List)
+		length = l.len()
+		return nil
+	})
+	if uerr != nil {
+		return uerr
+	}
+
+	encoder := resp3.Encoder{}
+	encoder.WriteInt(length)
+	s.conn.Write(encoder.Buf)
+	return nil
+}
+
+// LPOP and RPOP key [count]
+func (s *Session) doPOP(cmds []string) *UserError {
+	if len(cmds) < 2 || len(cmds) > 3 {
+		return &UserError{"ERR", "wrong number of arguments for " + cmds[0] + " command"}
+	}
+	count := 1
+	if len(cmds) == 3 {
+		var err error
+		count, err = strconv.Atoi(cmds[2])
+		if err != nil || count < 0 {
+			return &UserError{"ERR", "value is out of range, must be positive"}
+		}
+	}
+
+	var popped []string
+	ok, uerr := changeCollection(s, cmds[1], nil, func(l *listValue) *UserError {
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+		popped = l.pop(strings.ToLower(cmds[0]) == "lpop", count)
+		return nil
+	})
+	if uerr != nil {
+		return uerr
+	}
+	if !ok {
+		if len(cmds) == 3 {
+			s.writeNullArr()
+		} else {
+			s.writeNull()
+		}
+		return nil
+	}
+
+	if len(cmds) == 3 {
+		s.conn.Write(makeRESPArr(popped))
+		return nil
+	}
+	if len(popped) == 0 {
+		s.writeNull() // emptied by someone else in the meantime
+		return nil
+	}
+	encoder := resp3.Encoder{}
+	encoder.WriteBulkStr(popped[0])
+	s.conn.Write(encoder.Buf)
+	return nil
+}
+
+// LLEN key
+func (s *Session) doLLEN(cmds []string) *UserError {
+	if len(cmds) != 2 {
+		return &UserError{"ERR", "wrong number of arguments for LLEN command"}
+	}
+	l, ok, uerr := readTyped[*listValue](s, cmds[1])
+	if uerr != nil {
+		return uerr
+	}
+
+	length := 0
+	if ok {
+		l.mutex.RLock()
+		length = l.len()
+		l.mutex.RUnlock()
+	}
+	encoder := resp3.Encoder{}
+	encoder.WriteInt(length)
+	s.conn.Write(encoder.Buf)
+	return nil
+}
+
+// LRANGE key start stop
+func (s *Session) doLRANGE(cmds []string) *UserError {
+	if len(cmds) != 4 {
+		return &UserError{"ERR", "wrong number of arguments for LRANGE command"}
+	}
+	start, err1 := strconv.Atoi(cmds[2])
+	stop, err2 := strconv.Atoi(cmds[3])
+	if err1 != nil || err2 != nil {
+		return &UserError{"ERR", "value is not an integer or out of range"}
+	}
+	l, ok, uerr := readTyped[*listValue](s, cmds[1])
+	if uerr != nil {
+		return uerr
+	}
+	if !ok {
+		s.conn.Write(EmptyRespArr)
+		return nil
+	}
+
+	l.mutex.RLock()
+	length := l.len()
+	start = max(listIndex(start, length), 0)
+	stop = min(listIndex(stop, length), length-1)
+	var elems []string
+	if start <= stop {
+		elems = l.slice(start, stop)
+	}
+	l.mutex.RUnlock()
+	s.conn.Write(makeRESPArr(elems))
+	return nil
+}
+
+// LINDEX key index
+func (s *Session) doLINDEX(cmds []string) *UserError {
+	if len(cmds) != 3 {
+		return &UserError{"ERR", "wrong number of arguments for LINDEX command"}
+	}
+	index, err := strconv.Atoi(cmds[2])
+	if err != nil {
+		return &UserError{"ERR", "value is not an integer or out of range"}
+	}
+	l, ok, uerr := readTyped[*listValue](s, cmds[1])
+	if uerr != nil {
+		return uerr
+	}
+
+	var elem string
+	if ok {
+		l.mutex.RLock()
+		index = listIndex(index, l.len())
+		ok = index >= 0 && index < l.len()
+		if ok {
+			elem = l.get(index)
+		}
+		l.mutex.RUnlock()
+	}
+	if !ok {
+		s.writeNull()
+		return nil
+	}
+	encoder := resp3.Encoder{}
+	encoder.WriteBulkStr(elem)
+	s.conn.Write(encoder.Buf)
+	return nil
+}
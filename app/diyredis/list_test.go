@@ -0,0 +1,67 @@
+package diyredis
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestList(t *testing.T) {
+	server := MakeServer()
+	server.Encoding.List = ListpackLimits{MaxEntries: 4, MaxValue: 8}
+	session, conn := newTestSession(server)
+	run := func(cmd ...string) string {
+		conn.buf.Reset()
+		session.dispatch(cmd)
+		return conn.buf.String()
+	}
+
+	for _, tc := range []struct {
+		cmd  []string
+		want string
+	}{
+		{[]string{"RPUSH", "l", "b", "c"}, ":2\r\n"},
+		{[]string{"LPUSH", "l", "a"}, ":3\r\n"},
+		{[]string{"LRANGE", "l", "0", "-1"}, "*3\r\n$1\r\na\r\n$1\r\nb\r\n$1\r\nc\r\n"},
+		{[]string{"LRANGE", "l", "-2", "10"}, "*2\r\n$1\r\nb\r\n$1\r\nc\r\n"},
+		{[]string{"LRANGE", "l", "2", "1"}, "*0\r\n"},
+		{[]string{"LINDEX", "l", "-1"}, "$1\r\nc\r\n"},
+		{[]string{"LINDEX", "l", "3"}, "$-1\r\n"},
+		{[]string{"OBJECT", "ENCODING", "l"}, "$8\r\nlistpack\r\n"},
+		{[]string{"TYPE", "l"}, "+list\r\n"},
+		{[]string{"LPOP", "l"}, "$1\r\na\r\n"},
+		{[]string{"RPOP", "l", "5"}, "*2\r\n$1\r\nc\r\n$1\r\nb\r\n"},
+		{[]string{"LLEN", "l"}, ":0\r\n"},
+		{[]string{"LPOP", "l"}, "$-1\r\n"},
+		{[]string{"LPOP", "l", "1"}, "*-1\r\n"},
+		{[]string{"TYPE", "l"}, "+none\r\n"},
+	} {
+		if got := run(tc.cmd...); got != tc.want {
+			t.Errorf("%v: got %q, want %q", tc.cmd, got, tc.want)
+		}
+	}
+
+	// Past the limit, pushing at both ends to make the ring buffer wrap around
+	var want []string
+	for i := range 20 {
+		elem := strconv.Itoa(i)
+		if i%2 == 0 {
+			run("LPUSH", "big", elem)
+			want = append([]string{elem}, want...)
+		} else {
+			run("RPUSH", "big", elem)
+			want = append(want, elem)
+		}
+	}
+	if got := run("OBJECT", "ENCODING", "big"); got != "$9\r\nquicklist\r\n" {
+		t.Errorf("got %q", got)
+	}
+	if got := run("LRANGE", "big", "0", "-1"); got != string(makeRESPArr(want)) {
+		t.Errorf("got %q, want %q", got, makeRESPArr(want))
+	}
+	if got := run("LPOP", "big", "2"); got != string(makeRESPArr(want[:2])) {
+		t.Errorf("got %q, want %q", got, makeRESPArr(want[:2]))
+	}
+	if got := run("LINDEX", "big", "-1"); got != "$2\r\n19\r\n" {
+		t.Errorf("got %q", got)
+	}
+}
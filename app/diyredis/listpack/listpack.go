@@ -0,0 +1,323 @@
+// The listpack package implements Redis' listpack: a list of strings serialized into a
+// single byte slice, for collections too small to be worth the overhead of a map or
+// linked list. The format is the same as Redis', so that listpacks found in RDB files
+// can be used as-is.
+//
+// Layout:
+//
+//	[total bytes, uint32][element count, uint16][entry]...[0xFF]
+//
+// and every entry is:
+//
+//	[encoding + data][size of encoding + data, "backlen"]
+//
+// Strings that hold an integer are stored as such, which is why Get returns strings
+// that may have been formatted on the spot.
+//
+// Every modification returns a new listpack, leaving the original untouched, so it is
+// safe to keep using an older version of a listpack (e.g. for a snapshot).
+package listpack
+
+import (
+	"encoding/binary"
+	"errors"
+	"strconv"
+)
+
+const (
+	headerSize   = 6
+	eof          = 0xFF
+	unknownCount = 65535 // the element count doesn't fit the header, we'll have to count
+)
+
+type Listpack []byte
+
+// Return an empty listpack.
+func New() Listpack {
+	lp := make(Listpack, headerSize+1)
+	binary.LittleEndian.PutUint32(lp, headerSize+1)
+	lp[headerSize] = eof
+	return lp
+}
+
+var ErrCorrupt = errors.New("listpack is corrupt")
+
+// Validate a serialized listpack, e.g. one read from an RDB file.
+func FromBytes(b []byte) (Listpack, error) {
+	if len(b) < headerSize+1 || int(binary.LittleEndian.Uint32(b)) != len(b) || b[len(b)-1] != eof {
+		return nil, ErrCorrupt
+	}
+	count := 0
+	pos := headerSize
+	for b[pos] != eof {
+		size, ok := entrySize(b, pos)
+		if !ok || pos+size >= len(b) {
+			return nil, ErrCorrupt
+		}
+		pos += size
+		count++
+	}
+	if pos != len(b)-1 {
+		return nil, ErrCorrupt
+	}
+	if header := binary.LittleEndian.Uint16(b[4:]); header != unknownCount && int(header) != count {
+		return nil, ErrCorrupt
+	}
+	return Listpack(b), nil
+}
+
+// Return the number of elements.
+func (lp Listpack) Len() int {
+	if count := binary.LittleEndian.Uint16(lp[4:]); count != unknownCount {
+		return int(count)
+	}
+	count := 0
+	for pos := headerSize; lp[pos] != eof; pos = lp.next(pos) {
+		count++
+	}
+	return count
+}
+
+// Return the element at index, which must be in range.
+func (lp Listpack) Get(index int) string {
+	return lp.element(lp.offset(index))
+}
+
+// Call fn for every element in order, until it returns false.
+func (lp Listpack) Range(fn func(index int, elem string) bool) {
+	index := 0
+	for pos := headerSize; lp[pos] != eof; pos = lp.next(pos) {
+		if !fn(index, lp.element(pos)) {
+			return
+		}
+		index++
+	}
+}
+
+// Return the index of the first element equal to elem at or after index `from`, stepping
+// over `step` elements at a time, or -1 if there is none. A step of 2 finds hash fields,
+// for example.
+func (lp Listpack) Find(elem string, from int, step int) int {
+	index := 0
+	for pos := headerSize; lp[pos] != eof; pos = lp.next(pos) {
+		if index >= from && (index-from)%step == 0 && lp.element(pos) == elem {
+			return index
+		}
+		index++
+	}
+	return -1
+}
+
+// Return the elements, in order.
+func (lp Listpack) Elements() []string {
+	elems := make([]string, 0, lp.Len())
+	lp.Range(func(_ int, elem string) bool {
+		elems = append(elems, elem)
+		return true
+	})
+	return elems
+}
+
+func (lp Listpack) Append(elems ...string) Listpack {
+	return lp.Insert(lp.Len(), elems...)
+}
+
+// Insert elems before the element at index, or at the end if index equals Len().
+func (lp Listpack) Insert(index int, elems ...string) Listpack {
+	var encoded []byte
+	for _, elem := range elems {
+		encoded = appendEntry(encoded, elem)
+	}
+	pos := lp.offset(index)
+	return lp.splice(pos, pos, encoded, len(elems))
+}
+
+// Delete count elements starting at index.
+func (lp Listpack) Delete(index int, count int) Listpack {
+	from := lp.offset(index)
+	to := from
+	for range count {
+		to = lp.next(to)
+	}
+	return lp.splice(from, to, nil, -count)
+}
+
+// Replace the element at index.
+func (lp Listpack) Replace(index int, elem string) Listpack {
+	pos := lp.offset(index)
+	return lp.splice(pos, lp.next(pos), appendEntry(nil, elem), 0)
+}
+
+// Return a new listpack where the bytes between from and to are replaced by entries,
+// changing the element count by countDelta.
+func (lp Listpack) splice(from int, to int, entries []byte, countDelta int) Listpack {
+	size := len(lp) - (to - from) + len(entries)
+	result := make(Listpack, 0, size)
+	result = append(result, lp[:from]...)
+	result = append(result, entries...)
+	result = append(result, lp[to:]...)
+
+	binary.LittleEndian.PutUint32(result, uint32(size))
+	count := binary.LittleEndian.Uint16(lp[4:])
+	if count != unknownCount {
+		newCount := int(count) + countDelta
+		if newCount >= unknownCount {
+			newCount = unknownCount
+		}
+		binary.LittleEndian.PutUint16(result[4:], uint16(newCount))
+	} else if newCount := result.Len(); newCount < unknownCount {
+		binary.LittleEndian.PutUint16(result[4:], uint16(newCount))
+	}
+	return result
+}
+
+// Return the position of the element at index, or of the EOF byte if index is Len().
+func (lp Listpack) offset(index int) int {
+	pos := headerSize
+	for range index {
+		pos = lp.next(pos)
+	}
+	return pos
+}
+
+// Return the position of the entry after the one at pos.
+func (lp Listpack) next(pos int) int {
+	size, _ := entrySize(lp, pos)
+	return pos + size
+}
+
+// Return the total size of the entry at pos, including its backlen, or false if it
+// doesn't fit in b.
+func entrySize(b []byte, pos int) (int, bool) {
+	first := b[pos]
+	var size int
+	switch {
+	case first&0x80 == 0: // 7 bit uint
+		size = 1
+	case first&0xC0 == 0x80: // 6 bit string length
+		size = 1 + int(first&0x3F)
+	case first&0xE0 == 0xC0: // 13 bit int
+		size = 2
+	case first&0xF0 == 0xE0: // 12 bit string length
+		if pos+1 >= len(b) {
+			return 0, false
+		}
+		size = 2 + (int(first&0x0F)<<8 | int(b[pos+1]))
+	case first == 0xF0: // 32 bit string length
+		if pos+5 > len(b) {
+			return 0, false
+		}
+		size = 5 + int(binary.LittleEndian.Uint32(b[pos+1:]))
+	case first == 0xF1:
+		size = 3
+	case first == 0xF2:
+		size = 4
+	case first == 0xF3:
+		size = 5
+	case first == 0xF4:
+		size = 9
+	default:
+		return 0, false
+	}
+	size += backlenSize(size)
+	return size, pos+size <= len(b)
+}
+
+// Return the element at pos, formatting integers as strings.
+func (lp Listpack) element(pos int) string {
+	first := lp[pos]
+	switch {
+	case first&0x80 == 0:
+		return strconv.Itoa(int(first))
+	case first&0xC0 == 0x80:
+		return string(lp[pos+1 : pos+1+int(first&0x3F)])
+	case first&0xE0 == 0xC0:
+		val := int(first&0x1F)<<8 | int(lp[pos+1])
+		if val >= 1<<12 {
+			val -= 1 << 13
+		}
+		return strconv.Itoa(val)
+	case first&0xF0 == 0xE0:
+		length := int(first&0x0F)<<8 | int(lp[pos+1])
+		return string(lp[pos+2 : pos+2+length])
+	case first == 0xF0:
+		length := int(binary.LittleEndian.Uint32(lp[pos+1:]))
+		return string(lp[pos+5 : pos+5+length])
+	case first == 0xF1:
+		return strconv.FormatInt(int64(int16(binary.LittleEndian.Uint16(lp[pos+1:]))), 10)
+	case first == 0xF2:
+		val := int32(uint32(lp[pos+1]) | uint32(lp[pos+2])<<8 | uint32(lp[pos+3])<<16)
+		return strconv.FormatInt(int64(val<<8>>8), 10) // sign extend from 24 bits
+	case first == 0xF3:
+		return strconv.FormatInt(int64(int32(binary.LittleEndian.Uint32(lp[pos+1:]))), 10)
+	default: // 0xF4
+		return strconv.FormatInt(int64(binary.LittleEndian.Uint64(lp[pos+1:])), 10)
+	}
+}
+
+// Append elem as an entry to buf, as an integer if it is one.
+func appendEntry(buf []byte, elem string) []byte {
+	start := len(buf)
+	if val, err := strconv.ParseInt(elem, 10, 64); err == nil && strconv.FormatInt(val, 10) == elem {
+		switch {
+		case val >= 0 && val <= 127:
+			buf = append(buf, byte(val))
+		case val >= -4096 && val <= 4095:
+			uval := uint16(val) & 0x1FFF
+			buf = append(buf, 0xC0|byte(uval>>8), byte(uval))
+		case val >= -1<<15 && val < 1<<15:
+			buf = append(buf, 0xF1)
+			buf = binary.LittleEndian.AppendUint16(buf, uint16(val))
+		case val >= -1<<23 && val < 1<<23:
+			buf = append(buf, 0xF2, byte(val), byte(val>>8), byte(val>>16))
+		case val >= -1<<31 && val < 1<<31:
+			buf = append(buf, 0xF3)
+			buf = binary.LittleEndian.AppendUint32(buf, uint32(val))
+		default:
+			buf = append(buf, 0xF4)
+			buf = binary.LittleEndian.AppendUint64(buf, uint64(val))
+		}
+	} else {
+		switch length := len(elem); {
+		case length < 1<<6:
+			buf = append(buf, 0x80|byte(length))
+		case length < 1<<12:
+			buf = append(buf, 0xE0|byte(length>>8), byte(length))
+		default:
+			buf = append(buf, 0xF0)
+			buf = binary.LittleEndian.AppendUint32(buf, uint32(length))
+		}
+		buf = append(buf, elem...)
+	}
+	return appendBacklen(buf, len(buf)-start)
+}
+
+// The backlen stores the size of the entry before it 7 bits per byte, so that the
+// listpack can be walked backwards too. Every byte but the leftmost has its high bit set.
+func appendBacklen(buf []byte, size int) []byte {
+	n := backlenSize(size)
+	for i := n - 1; i >= 0; i-- {
+		b := byte(size>>(7*i)) & 0x7F
+		if i != n-1 {
+			b |= 0x80
+		}
+		buf = append(buf, b)
+	}
+	return buf
+}
+
+func backlenSize(size int) int {
+	// Same thresholds as Redis, which are one off from what would fit
+	switch {
+	case size < 1<<7:
+		return 1
+	case size < 1<<14-1:
+		return 2
+	case size < 1<<21-1:
+		return 3
+	case size < 1<<28-1:
+		return 4
+	default:
+		return 5
+	}
+}
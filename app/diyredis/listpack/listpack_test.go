@@ -0,0 +1,78 @@
+package listpack
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncoding(t *testing.T) {
+	lp := New().Append("a", "5")
+	// Byte for byte what Redis produces
+	assert.Equal(t, Listpack{12, 0, 0, 0, 2, 0, 0x81, 'a', 2, 0x05, 1, 0xFF}, lp)
+}
+
+func TestElements(t *testing.T) {
+	elems := []string{
+		"", "a", "0", "127", "128", "-1", "4095", "-4096", "4096", "-32768", "32767",
+		"8388607", "-8388608", "2147483647", "-2147483648", "9223372036854775807",
+		"-9223372036854775808", "9223372036854775808", "007", "+1",
+		strings.Repeat("x", 63), strings.Repeat("x", 64), strings.Repeat("x", 4095),
+		strings.Repeat("x", 4096), strings.Repeat("x", 20000),
+	}
+	lp := New().Append(elems...)
+	assert.Equal(t, len(elems), lp.Len())
+	assert.Equal(t, elems, lp.Elements())
+	for i, elem := range elems {
+		assert.Equal(t, elem, lp.Get(i))
+	}
+
+	parsed, err := FromBytes([]byte(lp))
+	assert.NoError(t, err)
+	assert.Equal(t, elems, parsed.Elements())
+}
+
+func TestModify(t *testing.T) {
+	lp := New().Append("b", "d")
+	lp = lp.Insert(0, "a")
+	lp = lp.Insert(2, "c")
+	assert.Equal(t, []string{"a", "b", "c", "d"}, lp.Elements())
+
+	modified := lp.Replace(1, "B").Delete(2, 2)
+	assert.Equal(t, []string{"a", "B"}, modified.Elements())
+	assert.Equal(t, 2, modified.Len())
+	assert.Equal(t, []string{"a", "b", "c", "d"}, lp.Elements(), "original was modified")
+
+	assert.Equal(t, 2, lp.Find("c", 0, 1))
+	assert.Equal(t, -1, lp.Find("b", 0, 2))
+	assert.Equal(t, 1, lp.Find("b", 1, 2))
+}
+
+func TestUnknownCount(t *testing.T) {
+	elems := make([]string, unknownCount+10)
+	for i := range elems {
+		elems[i] = strconv.Itoa(i)
+	}
+	lp := New().Append(elems...)
+	assert.Equal(t, len(elems), lp.Len())
+
+	lp = lp.Delete(0, 20)
+	assert.Equal(t, len(elems)-20, lp.Len())
+	assert.Equal(t, "20", lp.Get(0))
+}
+
+func TestFromBytesCorrupt(t *testing.T) {
+	valid := []byte(New().Append("hello", "1234"))
+	for name, b := range map[string][]byte{
+		"empty":          {},
+		"wrong size":     append(append([]byte{}, valid...), 0xFF),
+		"no terminator":  append(append([]byte{}, valid[:len(valid)-1]...), 0),
+		"wrong count":    append(append([]byte{}, valid[:4]...), append([]byte{3, 0}, valid[6:]...)...),
+		"bad string len": append(append([]byte{}, valid[:6]...), append([]byte{0xBF}, valid[7:]...)...),
+	} {
+		_, err := FromBytes(b)
+		assert.ErrorIs(t, err, ErrCorrupt, name)
+	}
+}
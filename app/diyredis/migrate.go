@@ -0,0 +1,301 @@
+package diyredis
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	crc64 "github.com/codecrafters-io/redis-starter-go/app/diyredis/crc64"
+	resp3 "github.com/codecrafters-io/redis-starter-go/app/diyredis/resp3"
+)
+
+// The RDB version we write, and the highest we claim to understand in DUMP payloads.
+const rdbVersion = 11
+
+// Serialize a value in the format used by DUMP and RESTORE:
+//
+//	[value type][value, RDB-encoded][RDB version, 2 bytes][CRC64 checksum, 8 bytes]
+//
+// Both trailing numbers are little endian. The checksum covers everything before it.
+func dumpValue(value any) ([]byte, error) {
+	buf, err := appendValue(nil, value)
+	if err != nil {
+		return nil, err
+	}
+	buf = binary.LittleEndian.AppendUint16(buf, rdbVersion)
+	return binary.LittleEndian.AppendUint64(buf, crc64.Digest(buf)), nil
+}
+
+// Deserialize a value serialized by dumpValue, after checking its version and checksum.
+func restoreValue(payload []byte, limits EncodingLimits) (any, error) {
+	if len(payload) < 10 {
+		return nil, errors.New("payload too short")
+	}
+	footer := payload[len(payload)-10:]
+	version := binary.LittleEndian.Uint16(footer[:2])
+	if version > rdbVersion {
+		return nil, errors.New("payload version too new")
+	}
+	checksum := binary.LittleEndian.Uint64(footer[2:])
+	if checksum != crc64.Digest(payload[:len(payload)-8]) {
+		return nil, errors.New("checksum mismatch")
+	}
+
+	r := newRdbReader(bytes.NewReader(payload[:len(payload)-10]))
+	valueType, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	value, err := readValue(r, valueType, limits)
+	if err != nil {
+		return nil, err
+	}
+	if r.offset != int64(len(payload)-10) {
+		return nil, errors.New("trailing data after value")
+	}
+	return value, nil
+}
+
+func (s *Session) doDUMP(cmds []string) *UserError {
+	if len(cmds) != 2 {
+		return &UserError{"ERR", "wrong number of arguments for DUMP command"}
+	}
+
+	value, _, ok := s.db.load(cmds[1])
+	if !ok {
+		s.writeNull()
+		return nil
+	}
+	payload, err := dumpValue(value)
+	if err != nil {
+		return &UserError{"ERR", err.Error()}
+	}
+
+	encoder := resp3.Encoder{}
+	encoder.WriteBulkStr(string(payload))
+	s.conn.Write(encoder.Buf)
+	return nil
+}
+
+// RESTORE key ttl serialized-value [REPLACE] [ABSTTL]
+func (s *Session) doRESTORE(cmds []string) *UserError {
+	if len(cmds) < 4 {
+		return &UserError{"ERR", "wrong number of arguments for RESTORE command"}
+	}
+	key := cmds[1]
+
+	var replace, absTTL bool
+	for _, arg := range cmds[4:] {
+		switch strings.ToLower(arg) {
+		case "replace":
+			replace = true
+		case "absttl":
+			absTTL = true
+		default:
+			return ErrSyntax()
+		}
+	}
+
+	ttl, err := strconv.ParseInt(cmds[2], 10, 64)
+	if err != nil || ttl < 0 {
+		return &UserError{"ERR", "Invalid TTL value, must be >= 0"}
+	}
+	var expiry int64
+	if ttl > 0 {
+		var ok bool
+		if expiry, ok = expiryMs(ttl, time.Millisecond, absTTL, s.db.nowMs()); !ok {
+			return &UserError{"ERR", "Invalid TTL value, must be >= 0"}
+		}
+	}
+
+	lock := s.db.locks.lock(key)
+	if _, _, exists := s.db.loadLocked(key); exists && !replace {
+		lock.Unlock()
+		return &UserError{"BUSYKEY", "Target key name already exists."}
+	}
+
+	value, err := restoreValue([]byte(cmds[3]), s.server.Encoding)
+	if err != nil {
+		lock.Unlock()
+		return &UserError{"ERR", "DUMP payload version or checksum are wrong"}
+	}
+
+	if expiry != 0 && expiry <= s.db.nowMs() {
+		// Already expired; nothing to restore
+		s.db.delete(key)
+	} else {
+		s.db.set(key, value, expiry)
+	}
+	lock.Unlock()
+	s.conn.Write(resp3.OK)
+	return nil
+}
+
+// MIGRATE host port key|"" destination-db timeout [COPY] [REPLACE] [AUTH password]
+// [AUTH2 username password] [KEYS key [key ...]]
+//
+// Transfers keys to another instance by RESTOREing their DUMP payload over there. The
+// keys the target accepted are then deleted locally, unless COPY is given.
+//
+// It takes the write lock itself (see flagOwnLock), only to delete those keys, so that
+// other writes go on while it waits for the target.
+func (s *Session) doMIGRATE(cmds []string) *UserError {
+	if len(cmds) < 6 {
+		return &UserError{"ERR", "wrong number of arguments for MIGRATE command"}
+	}
+	s.propagateAs()
+
+	address := net.JoinHostPort(cmds[1], cmds[2])
+	keys := []string{cmds[3]}
+	db, err := strconv.Atoi(cmds[4])
+	if err != nil || db < 0 {
+		return &UserError{"ERR", "value is not an integer or out of range"}
+	}
+	timeoutMs, err := strconv.Atoi(cmds[5])
+	if err != nil || timeoutMs < 0 {
+		return &UserError{"ERR", "value is not an integer or out of range"}
+	}
+	if timeoutMs == 0 {
+		timeoutMs = 1000
+	}
+	timeout := time.Duration(timeoutMs) * time.Millisecond
+
+	var copyKeys, replace bool
+	var auth []string
+	for i := 6; i < len(cmds); i++ {
+		switch strings.ToLower(cmds[i]) {
+		case "copy":
+			copyKeys = true
+		case "replace":
+			replace = true
+		case "auth":
+			if i+1 >= len(cmds) {
+				return ErrSyntax()
+			}
+			auth = []string{"AUTH", cmds[i+1]}
+			i++
+		case "auth2":
+			if i+2 >= len(cmds) {
+				return ErrSyntax()
+			}
+			auth = []string{"AUTH", cmds[i+1], cmds[i+2]}
+			i += 2
+		case "keys":
+			if cmds[3] != "" {
+				return &UserError{
+					"ERR", "When using MIGRATE KEYS option, the key argument must be set to the empty string",
+				}
+			}
+			keys = cmds[i+1:]
+			i = len(cmds)
+		default:
+			return ErrSyntax()
+		}
+	}
+
+	// Serialize everything up front, skipping keys that don't exist
+	var restoreCmds [][]string
+	var migratedKeys []string
+	for _, key := range keys {
+		value, expiry, ok := s.db.load(key)
+		if !ok {
+			continue
+		}
+		payload, err := dumpValue(value)
+		if err != nil {
+			return &UserError{"ERR", err.Error()}
+		}
+		var ttl int64
+		if expiry != 0 {
+			ttl = max(expiry-s.db.nowMs(), 1)
+		}
+		restoreCmd := []string{"RESTORE", key, strconv.FormatInt(ttl, 10), string(payload)}
+		if replace {
+			restoreCmd = append(restoreCmd, "REPLACE")
+		}
+		restoreCmds = append(restoreCmds, restoreCmd)
+		migratedKeys = append(migratedKeys, key)
+	}
+	if len(restoreCmds) == 0 {
+		s.conn.Write([]byte("+NOKEY\r\n"))
+		return nil
+	}
+
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return &UserError{"IOERR", "error or timeout connecting to the client"}
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	// Pipeline everything, then read all replies
+	var preamble [][]string
+	if auth != nil {
+		preamble = append(preamble, auth)
+	}
+	if db != 0 {
+		preamble = append(preamble, []string{"SELECT", strconv.Itoa(db)})
+	}
+	encoder := resp3.Encoder{}
+	for _, cmd := range append(preamble, restoreCmds...) {
+		encoder.WriteArrHeader(len(cmd))
+		for _, arg := range cmd {
+			encoder.WriteBulkStr(arg)
+		}
+	}
+	if _, err := conn.Write(encoder.Buf); err != nil {
+		return &UserError{"IOERR", "error or timeout writing to target instance"}
+	}
+
+	// Keys accepted by the target are no longer ours, even if reading a later reply fails
+	var accepted []string
+	defer func() {
+		if len(accepted) > 0 {
+			s.deleteMigrated(accepted)
+		}
+	}()
+	reader := bufio.NewReader(conn)
+	var targetErr *UserError
+	for i := range len(preamble) + len(restoreCmds) {
+		reply, err := reader.ReadString('\n')
+		if err != nil {
+			return &UserError{"IOERR", "error or timeout reading to target instance"}
+		}
+		if strings.HasPrefix(reply, "-") {
+			if targetErr == nil {
+				targetErr = &UserError{
+					"ERR", "Target instance replied with error: " + strings.TrimSpace(reply[1:]),
+				}
+			}
+			continue
+		}
+		if i >= len(preamble) && !copyKeys {
+			accepted = append(accepted, migratedKeys[i-len(preamble)])
+		}
+	}
+	if targetErr != nil {
+		return targetErr
+	}
+
+	s.conn.Write(resp3.OK)
+	return nil
+}
+
+// Delete the keys MIGRATE moved to another instance, under the write lock, and have
+// replicas delete them too rather than migrate them all over again.
+func (s *Session) deleteMigrated(keys []string) {
+	defer s.server.repl.order.lockKeys(keys, true)()
+	s.server.repl.writes.RLock()
+	defer s.server.repl.writes.RUnlock()
+	for _, key := range keys {
+		s.db.delete(key)
+	}
+	deleted := append([]string{"DEL"}, keys...)
+	s.server.propagate(s.dbIndex, deleted)
+	s.propagateAs(deleted) // for the journal; dispatch leaves propagating it to us
+}
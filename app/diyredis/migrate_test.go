@@ -0,0 +1,160 @@
+package diyredis
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A net.Conn that collects everything written to it. Reading is not supported.
+type recordingConn struct {
+	net.Conn
+	buf bytes.Buffer
+}
+
+func (c *recordingConn) Write(b []byte) (int, error) { return c.buf.Write(b) }
+
+func newTestSession(server *Server) (*Session, *recordingConn) {
+	conn := &recordingConn{}
+	return &Session{
+		server: server,
+		conn:   conn,
+		db:     server.db(0),
+		log:    server.Log.With("client", "test"),
+	}, conn
+}
+
+func TestDumpRestoreValue(t *testing.T) {
+	long := strings.Repeat("ab", 1024)
+	for _, val := range []string{"", "hello", "12", "-129", "70000", "2147483648", "007", long} {
+		payload, err := dumpValue(val)
+		if err != nil {
+			t.Fatalf("got error while dumping %q: %v", val, err)
+		}
+		got, err := restoreValue(payload, DefaultEncodingLimits)
+		if err != nil {
+			t.Fatalf("got error while restoring %q: %v", val, err)
+		}
+		if got, _ := stringValue(got); got != val {
+			t.Errorf("got %q, want %q", got, val)
+		}
+	}
+
+	payload, _ := dumpValue("hello")
+	payload[1] ^= 0xff
+	if _, err := restoreValue(payload, DefaultEncodingLimits); err == nil {
+		t.Errorf("corrupted payload was restored without error")
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	target := MakeServer()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go target.startSession(conn)
+		}
+	}()
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	source := MakeServer()
+	session, conn := newTestSession(source)
+	session.db.engine.Set("a", "1")
+	session.db.engine.Set("b", "2")
+	session.db.engine.Expire("b", time.Now().Add(time.Hour).UnixMilli())
+	session.db.engine.Set("c", "3")
+
+	uerr := session.doMIGRATE([]string{"MIGRATE", host, port, "", "0", "1000", "KEYS", "a", "b", "nope"})
+	if uerr != nil {
+		t.Fatalf("got error: %v", uerr)
+	}
+	if conn.buf.String() != "+OK\r\n" {
+		t.Errorf("got reply %q, want +OK", conn.buf.String())
+	}
+
+	for key, want := range map[string]string{"a": "1", "b": "2"} {
+		if _, ok := source.dbs[0].engine.Get(key); ok {
+			t.Errorf("key %s still exists on the source after MIGRATE", key)
+		}
+		got, ok := loadString(target.dbs[0], key)
+		if !ok || got != want {
+			t.Errorf("got %v for key %s on the target, want %v", got, key, want)
+		}
+	}
+	if _, ok := target.dbs[0].engine.Expiry("b"); !ok {
+		t.Errorf("expiry was not migrated")
+	}
+
+	// The keys exist on the target now, so this fails without REPLACE
+	source.dbs[0].engine.Set("a", "new")
+	uerr = session.doMIGRATE([]string{"MIGRATE", host, port, "a", "0", "1000", "COPY"})
+	if uerr == nil {
+		t.Errorf("MIGRATE without REPLACE overwrote an existing key")
+	}
+	conn.buf.Reset()
+	uerr = session.doMIGRATE([]string{"MIGRATE", host, port, "a", "0", "1000", "COPY", "REPLACE"})
+	if uerr != nil {
+		t.Fatalf("got error: %v", uerr)
+	}
+	if got, _ := target.dbs[0].engine.Get("a"); got != "new" {
+		t.Errorf("got %v, want %v", got, "new")
+	}
+	if _, ok := source.dbs[0].engine.Get("a"); !ok {
+		t.Errorf("key was deleted from the source despite COPY")
+	}
+
+	conn.buf.Reset()
+	session.doMIGRATE([]string{"MIGRATE", host, port, "nope", "0", "1000"})
+	if conn.buf.String() != "+NOKEY\r\n" {
+		t.Errorf("got reply %q, want +NOKEY", conn.buf.String())
+	}
+}
+
+func TestMigrateWaitsWithoutTheWriteLock(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	accepted := make(chan net.Conn)
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			accepted <- conn // and never reply
+		}
+	}()
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	server := MakeServer()
+	session, conn := newTestSession(server)
+	session.dispatch([]string{"SET", "a", "1"})
+	conn.buf.Reset()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		session.dispatch([]string{"MIGRATE", host, port, "a", "0", "5000"})
+	}()
+	target := <-accepted
+	if !server.repl.writes.TryLock() {
+		t.Error("MIGRATE holds the write lock while waiting for the target")
+	} else {
+		server.repl.writes.Unlock()
+	}
+	target.Close()
+	<-done
+	if got := conn.buf.String(); !strings.HasPrefix(got, "-IOERR") {
+		t.Errorf("got %q, want an IOERR", got)
+	}
+	if _, ok := server.dbs[0].engine.Get("a"); !ok {
+		t.Error("deleted a key the target didn't accept")
+	}
+}
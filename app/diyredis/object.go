@@ -0,0 +1,275 @@
+package diyredis
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	resp3 "github.com/codecrafters-io/redis-starter-go/app/diyredis/resp3"
+)
+
+// String values are stored as a string, unless they hold an integer, in which case they
+// are stored as an int64. That takes less memory than the string representation, and
+// counters are the main reason to store integers in the first place.
+//
+// On top of that, small integers are shared: storing one does not allocate at all. And
+// short strings that were seen before are interned, so that e.g. a million keys holding
+// "active" all point to the same bytes.
+
+const sharedIntegerCount = 10000
+
+// Pre-boxed integers, since boxing an int64 into an `any` allocates (beyond 255).
+var sharedIntegers = func() (ints [sharedIntegerCount]any) {
+	for i := range ints {
+		ints[i] = int64(i)
+	}
+	return ints
+}()
+
+const (
+	internMaxLen  = 16   // longer strings are unlikely to repeat
+	internMaxSize = 8192 // the table is never emptied, so don't let it grow unbounded
+)
+
+var internTable struct {
+	strings sync.Map // string -> the same string, but the first copy of it we saw
+	size    atomic.Int64
+}
+
+func intern(str string) string {
+	if len(str) > internMaxLen {
+		return str
+	}
+	if canonical, ok := internTable.strings.Load(str); ok {
+		return canonical.(string)
+	}
+	if internTable.size.Load() >= internMaxSize {
+		return str
+	}
+	str = strings.Clone(str) // don't keep the buffer str might be part of alive
+	canonical, loaded := internTable.strings.LoadOrStore(str, str)
+	if !loaded {
+		internTable.size.Add(1)
+	}
+	return canonical.(string)
+}
+
+// Return str in the representation it should be stored in.
+func newStringValue(str string) any {
+	if isCanonicalInt(str) {
+		if val, err := strconv.ParseInt(str, 10, 64); err == nil {
+			if val >= 0 && val < sharedIntegerCount {
+				return sharedIntegers[val]
+			}
+			return val
+		}
+	}
+	return intern(str)
+}
+
+// Return true if str looks like an integer that formats back to exactly the same string,
+// so that e.g. "007" and "+1" remain strings.
+func isCanonicalInt(str string) bool {
+	digits := strings.TrimPrefix(str, "-")
+	if len(digits) == 0 || len(digits) > 19 || (digits[0] == '0' && len(str) > 1) {
+		return false
+	}
+	for i := range len(digits) {
+		if digits[i] < '0' || digits[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// Return value as a string, or false if value isn't a string value.
+func stringValue(value any) (string, bool) {
+	switch val := value.(type) {
+	case string:
+		return val, true
+	case int64:
+		return strconv.FormatInt(val, 10), true
+	}
+	return "", false
+}
+
+// Hashes, lists and sets are stored as a listpack for as long as they have at most
+// MaxEntries elements (field value pairs, for hashes), none of which is longer than
+// MaxValue bytes. Past that they are converted to their general encoding, and never
+// converted back.
+type ListpackLimits struct {
+	MaxEntries int
+	MaxValue   int
+}
+
+var DefaultListpackLimits = ListpackLimits{MaxEntries: 128, MaxValue: 64}
+
+// Return true if a collection of `entries` elements, with the given new elements added
+// to it, may (still) be a listpack.
+func (l ListpackLimits) fits(entries int, added ...string) bool {
+	if entries > l.MaxEntries {
+		return false
+	}
+	for _, val := range added {
+		if len(val) > l.MaxValue {
+			return false
+		}
+	}
+	return true
+}
+
+type EncodingLimits struct {
+	Hash ListpackLimits
+	List ListpackLimits
+	Set  ListpackLimits
+}
+
+var DefaultEncodingLimits = EncodingLimits{
+	Hash: DefaultListpackLimits,
+	List: DefaultListpackLimits,
+	Set:  DefaultListpackLimits,
+}
+
+// Return the value of key as a T. ok is false if the key doesn't exist, and ErrWrongType
+// is returned if it holds another type.
+func loadTyped[T any](s *Session, key string) (val T, ok bool, uerr *UserError) {
+	value, _, ok := s.db.load(key)
+	return asType[T](value, ok)
+}
+
+// Like loadTyped, for commands that only read the key, counting the read as a keyspace
+// hit or miss.
+func readTyped[T any](s *Session, key string) (val T, ok bool, uerr *UserError) {
+	value, _, ok := s.db.loadRead(key)
+	return asType[T](value, ok)
+}
+
+func asType[T any](value any, ok bool) (val T, _ bool, uerr *UserError) {
+	if !ok {
+		return val, false, nil
+	}
+	val, ok = value.(T)
+	if !ok {
+		return val, false, ErrWrongType()
+	}
+	return val, true, nil
+}
+
+// A hash, list or set, which is changed in place.
+type collection interface {
+	comparable
+	len() int
+}
+
+// Change the collection of type T at key in place with change, through computeInPlace,
+// deleting the key if that leaves it empty. If the key doesn't exist, the collection
+// create makes is changed and then stored, so that nobody gets to see it empty, or
+// nothing is done if create is nil, and ok is false. Nothing is stored if change returns
+// an error, which is returned.
+func changeCollection[T collection](s *Session, key string, create func() T, change func(val T) *UserError) (ok bool, uerr *UserError) {
+	if create == nil {
+		if _, ok, uerr = loadTyped[T](s, key); !ok {
+			return false, uerr
+		}
+	}
+	uerr = s.db.computeInPlace(key, func(old any, exists bool) (any, *UserError) {
+		var val T
+		var uerr *UserError
+		if val, ok, uerr = asType[T](old, exists); uerr != nil {
+			return nil, uerr
+		}
+		if !ok {
+			if create == nil {
+				return nil, nil // deleted since
+			}
+			val, ok = create(), true
+		}
+		if uerr := change(val); uerr != nil {
+			return nil, uerr
+		}
+		if val.len() == 0 {
+			return nil, nil
+		}
+		return val, nil
+	})
+	return ok, uerr
+}
+
+// Return the name of the data type of value, as reported by TYPE.
+func typeName(value any) string {
+	switch value.(type) {
+	case string, int64:
+		return "string"
+	case *hashValue:
+		return "hash"
+	case *listValue:
+		return "list"
+	case *setValue:
+		return "set"
+	}
+	return "stream"
+}
+
+// Return the name of the internal encoding of value, as reported by OBJECT ENCODING.
+func objectEncoding(value any) string {
+	switch val := value.(type) {
+	case int64:
+		return "int"
+	case string:
+		if len(val) <= 44 { // the limit for embedded strings in Redis
+			return "embstr"
+		}
+		return "raw"
+	case *hashValue:
+		return val.encoding()
+	case *listValue:
+		return val.encoding()
+	case *setValue:
+		return val.encoding()
+	}
+	return "stream"
+}
+
+var objectHelp = []string{
+	"ENCODING <key>",
+	"    Return the kind of internal representation used to store the value of <key>.",
+	"FREQ <key>",
+	"    Return the access frequency of <key>, a logarithmic counter.",
+}
+
+// OBJECT ENCODING key | OBJECT FREQ key
+func (s *Session) doOBJECT(cmds []string) *UserError {
+	if len(cmds) < 2 {
+		return &UserError{"ERR", "wrong number of arguments for OBJECT command"}
+	}
+
+	switch strings.ToLower(cmds[1]) {
+	case "encoding":
+		if len(cmds) != 3 {
+			return &UserError{"ERR", "wrong number of arguments for OBJECT ENCODING command"}
+		}
+		value, _, ok := s.db.peek(cmds[2])
+		if !ok {
+			s.writeNull()
+			return nil
+		}
+		encoder := resp3.Encoder{}
+		encoder.WriteBulkStr(objectEncoding(value))
+		s.conn.Write(encoder.Buf)
+
+	case "freq":
+		if len(cmds) != 3 {
+			return &UserError{"ERR", "wrong number of arguments for OBJECT FREQ command"}
+		}
+		if _, _, ok := s.db.peek(cmds[2]); !ok {
+			s.writeNull()
+			return nil
+		}
+		s.writeInt(int64(s.db.frequency(cmds[2])))
+
+	default:
+		return errUnknownSubcommand(cmds)
+	}
+	return nil
+}
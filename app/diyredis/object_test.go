@@ -0,0 +1,71 @@
+package diyredis
+
+import (
+	"strings"
+	"testing"
+	"unsafe"
+)
+
+func TestStringValueEncoding(t *testing.T) {
+	for _, tc := range []struct {
+		str      string
+		encoding string
+	}{
+		{"0", "int"},
+		{"12", "int"},
+		{"-5", "int"},
+		{"9223372036854775807", "int"},
+		{"9223372036854775808", "embstr"}, // doesn't fit an int64
+		{"007", "embstr"},
+		{"+1", "embstr"},
+		{"hello", "embstr"},
+		{strings.Repeat("x", 45), "raw"},
+	} {
+		value := newStringValue(tc.str)
+		if got := objectEncoding(value); got != tc.encoding {
+			t.Errorf("got encoding %q for %q, want %q", got, tc.str, tc.encoding)
+		}
+		if got, ok := stringValue(value); !ok || got != tc.str {
+			t.Errorf("got %q back for %q", got, tc.str)
+		}
+	}
+
+	var value any
+	if allocs := testing.AllocsPerRun(100, func() { value = newStringValue("1234") }); allocs != 0 {
+		t.Errorf("storing a small integer allocated %v times", allocs)
+	}
+	_ = value
+
+	a := newStringValue(strings.Clone("active")).(string)
+	b := newStringValue(strings.Clone("active")).(string)
+	if unsafe.StringData(a) != unsafe.StringData(b) {
+		t.Errorf("short string was not interned")
+	}
+}
+
+func TestObjectEncoding(t *testing.T) {
+	server := MakeServer()
+	session, conn := newTestSession(server)
+	run := func(cmd ...string) string {
+		conn.buf.Reset()
+		session.dispatch(cmd)
+		return conn.buf.String()
+	}
+
+	run("MSET", "counter", "100", "name", "diy-redis")
+	if got := run("OBJECT", "ENCODING", "counter"); got != "$3\r\nint\r\n" {
+		t.Errorf("got %q", got)
+	}
+	if got := run("OBJECT", "ENCODING", "name"); got != "$6\r\nembstr\r\n" {
+		t.Errorf("got %q", got)
+	}
+	if got := run("OBJECT", "ENCODING", "missing"); got != "$-1\r\n" {
+		t.Errorf("got %q", got)
+	}
+	if got := run("GET", "counter"); got != "$3\r\n100\r\n" {
+		t.Errorf("got %q, want integers to be returned as strings", got)
+	}
+	if got := run("TYPE", "counter"); got != "+string\r\n" {
+		t.Errorf("got %q", got)
+	}
+}
@@ -0,0 +1,414 @@
+package diyredis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Everything sent to a client goes through a queue, which a goroutine of the client's
+// own writes to the connection. That way, messages pushed by other clients (e.g.
+// tracking invalidations) are never written in the middle of a reply, and writing to a
+// client that doesn't read what we send doesn't hold up whoever pushed to it.
+//
+// A client that doesn't keep up would make the queue grow without bound, so it is
+// disconnected once the queue exceeds the hard limit, or stays above the soft limit for
+// too long. A client that doesn't read at all would block the write, and with it the
+// goroutine, forever; with a write timeout, it is disconnected once a write takes longer.
+
+type OutputBufferLimit struct {
+	Hard        int // bytes, 0 for no limit
+	Soft        int // bytes, 0 for no limit
+	SoftSeconds int // how long the queue may stay above the soft limit
+}
+
+// The limits of each class of clients, as in Redis. Replicas get all the writes, and
+// may be sent a whole snapshot, so they get more room than other clients. Pubsub is for
+// clients subscribed to channels; as there is no pub/sub, it's only there to take the
+// configuration files of Redis as they are.
+type OutputBufferLimits struct {
+	Normal  OutputBufferLimit
+	Replica OutputBufferLimit
+	Pubsub  OutputBufferLimit
+}
+
+// The same as in Redis: normal clients have no limits.
+var DefaultOutputBufferLimits = OutputBufferLimits{
+	Replica: OutputBufferLimit{256 << 20, 64 << 20, 60},
+	Pubsub:  OutputBufferLimit{32 << 20, 8 << 20, 60},
+}
+
+func (l *OutputBufferLimits) String() string {
+	if l == nil {
+		return ""
+	}
+	return "normal " + l.Normal.String() + " replica " + l.Replica.String() + " pubsub " + l.Pubsub.String()
+}
+
+// Set the limit of a class of clients from "<class> <hard limit> <soft limit> <soft
+// seconds>", as in the Redis config, or that of normal clients if the class is left out.
+// Every class can be set at once, one after the other.
+func (l *OutputBufferLimits) Set(val string) error {
+	fields := strings.Fields(val)
+	if len(fields) == 3 {
+		return l.Normal.Set(val)
+	}
+	if len(fields) == 0 || len(fields)%4 != 0 {
+		return errors.New("must be a class, a hard limit, a soft limit and soft seconds")
+	}
+	for i := 0; i < len(fields); i += 4 {
+		var limit *OutputBufferLimit
+		switch strings.ToLower(fields[i]) {
+		case "normal":
+			limit = &l.Normal
+		case "replica", "slave":
+			limit = &l.Replica
+		case "pubsub":
+			limit = &l.Pubsub
+		default:
+			return fmt.Errorf("invalid client class: %q", fields[i])
+		}
+		if err := limit.Set(strings.Join(fields[i+1:i+4], " ")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *OutputBufferLimit) String() string {
+	if l == nil {
+		return ""
+	}
+	return fmt.Sprintf("%d %d %d", l.Hard, l.Soft, l.SoftSeconds)
+}
+
+// Parse "<hard limit> <soft limit> <soft seconds>", where the limits may have a unit
+// such as "mb", as in the Redis config.
+func (l *OutputBufferLimit) Set(val string) error {
+	fields := strings.Fields(val)
+	if len(fields) != 3 {
+		return errors.New("must be a hard limit, a soft limit and soft seconds")
+	}
+	hard, err := parseMemory(fields[0])
+	if err != nil {
+		return err
+	}
+	soft, err := parseMemory(fields[1])
+	if err != nil {
+		return err
+	}
+	seconds, err := strconv.Atoi(fields[2])
+	if err != nil || seconds < 0 {
+		return fmt.Errorf("invalid number of seconds: %q", fields[2])
+	}
+	*l = OutputBufferLimit{hard, soft, seconds}
+	return nil
+}
+
+// Parse an amount of memory like Redis does: "1k" is 1000 bytes, "1kb" is 1024.
+func parseMemory(val string) (int, error) {
+	units := []struct {
+		suffix string
+		bytes  int
+	}{
+		{"gb", 1 << 30}, {"mb", 1 << 20}, {"kb", 1 << 10},
+		{"g", 1000 * 1000 * 1000}, {"m", 1000 * 1000}, {"k", 1000}, {"b", 1},
+	}
+	multiplier := 1
+	number := strings.ToLower(val)
+	for _, unit := range units {
+		if strings.HasSuffix(number, unit.suffix) {
+			number = strings.TrimSuffix(number, unit.suffix)
+			multiplier = unit.bytes
+			break
+		}
+	}
+	n, err := strconv.Atoi(number)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid amount of memory: %q", val)
+	}
+	return n * multiplier, nil
+}
+
+// An amount of memory in bytes, set from a string like "64mb" as in the Redis config.
+type MemorySize int
+
+func (m *MemorySize) Set(val string) error {
+	n, err := parseMemory(val)
+	if err != nil {
+		return err
+	}
+	*m = MemorySize(n)
+	return nil
+}
+
+func (m *MemorySize) String() string {
+	if m == nil {
+		return ""
+	}
+	return strconv.Itoa(int(*m))
+}
+
+type clientOutput struct {
+	conn         net.Conn
+	writeTimeout time.Duration       // 0 for none
+	onLimit      func(reason string) // called once a limit is exceeded, to disconnect the client
+
+	reply []byte // of the command being executed, only touched by the client's goroutine
+
+	mutex         sync.Mutex
+	wake          *sync.Cond // signaled when there's something to write, or on stop
+	drained       *sync.Cond // broadcast when some of the queue was written, or on stop
+	class         string     // of the client, for the limit
+	limit         OutputBufferLimit
+	queue         [][]byte
+	queued        int       // bytes in queue, held, and being written
+	replying      bool      // part of a reply is queued, and the rest is to follow
+	held          [][]byte  // messages queued while replying, to go after the reply
+	overSoftSince time.Time // zero while under the soft limit
+	noEvict       bool      // exempt from the limit, with CLIENT NO-EVICT
+	stopped       bool      // no more messages are accepted
+	done          chan struct{}
+}
+
+// Start writing to conn, the connection of a normal client.
+func newClientOutput(conn net.Conn, limit OutputBufferLimit, writeTimeout time.Duration, onLimit func(reason string)) *clientOutput {
+	o := &clientOutput{
+		conn:         conn,
+		writeTimeout: writeTimeout,
+		onLimit:      onLimit,
+		class:        "normal",
+		limit:        limit,
+		done:         make(chan struct{}),
+	}
+	o.wake = sync.NewCond(&o.mutex)
+	o.drained = sync.NewCond(&o.mutex)
+	go o.run()
+	return o
+}
+
+// Queue msg to be written. It must not be modified afterwards. While a reply is being
+// queued a part at a time, msg waits for the end of it.
+func (o *clientOutput) enqueue(msg []byte) {
+	o.add(msg, false)
+}
+
+// Queue msg, which is (part of) the reply to the command being executed if reply.
+func (o *clientOutput) add(msg []byte, reply bool) {
+	o.mutex.Lock()
+	if o.stopped {
+		o.mutex.Unlock()
+		return
+	}
+	if o.replying && !reply {
+		o.held = append(o.held, msg)
+	} else {
+		o.queue = append(o.queue, msg)
+	}
+	o.queued += len(msg)
+	if !o.exceeded() {
+		o.wake.Signal()
+		o.mutex.Unlock()
+		return
+	}
+
+	// Drop whatever's queued; the client is about to be disconnected anyway
+	o.stopped = true
+	o.queue, o.held = nil, nil
+	o.wake.Signal()
+	o.drained.Broadcast()
+	class := o.class
+	o.mutex.Unlock()
+	o.onLimit("exceeded the output buffer limit of " + class + " clients")
+}
+
+// Move the client to another class, with the given limit.
+func (o *clientOutput) setLimit(class string, limit OutputBufferLimit) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.class, o.limit = class, limit
+}
+
+// Exempt the client from the limit, or not.
+func (o *clientOutput) setNoEvict(noEvict bool) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.noEvict = noEvict
+}
+
+func (o *clientOutput) exceeded() bool {
+	if o.noEvict {
+		return false
+	}
+	if o.limit.Hard > 0 && o.queued > o.limit.Hard {
+		return true
+	}
+	if o.limit.Soft == 0 || o.queued <= o.limit.Soft {
+		o.overSoftSince = time.Time{}
+		return false
+	}
+	if o.overSoftSince.IsZero() {
+		o.overSoftSince = time.Now()
+	}
+	return time.Since(o.overSoftSince) >= time.Duration(o.limit.SoftSeconds)*time.Second
+}
+
+// Queue the reply written so far.
+func (o *clientOutput) flushReply() {
+	if len(o.reply) > 0 {
+		o.add(o.reply, true)
+		o.reply = nil
+	}
+	o.mutex.Lock()
+	if o.replying {
+		o.replying = false
+		o.queue = append(o.queue, o.held...)
+		o.held = nil
+		o.wake.Signal()
+	}
+	o.mutex.Unlock()
+}
+
+// How much of a reply queued a part at a time may wait to be written before the command
+// writing it waits too.
+const partialReplyBacklog = 1024 * 1024
+
+// Queue the reply written so far, though there's more to come, and wait for the client
+// to read enough of what's queued, so that a long reply is held in memory a part at a
+// time rather than all at once. Returns false if it's no use writing the rest: the
+// client is gone, or ctx is done.
+func (o *clientOutput) flushPartialReply(ctx context.Context) bool {
+	o.mutex.Lock()
+	o.replying = true
+	o.mutex.Unlock()
+	if len(o.reply) > 0 {
+		o.add(o.reply, true)
+		o.reply = nil
+	}
+
+	stop := context.AfterFunc(ctx, func() {
+		o.mutex.Lock()
+		o.drained.Broadcast()
+		o.mutex.Unlock()
+	})
+	defer stop()
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	for o.queued > partialReplyBacklog && !o.stopped && ctx.Err() == nil {
+		o.drained.Wait()
+	}
+	return !o.stopped && ctx.Err() == nil
+}
+
+// Write what's queued, then stop accepting messages.
+func (o *clientOutput) stop() {
+	o.mutex.Lock()
+	o.stopped = true
+	o.wake.Signal()
+	o.drained.Broadcast()
+	o.mutex.Unlock()
+	<-o.done
+}
+
+func (o *clientOutput) run() {
+	defer close(o.done)
+	for {
+		o.mutex.Lock()
+		for len(o.queue) == 0 && !o.stopped {
+			o.wake.Wait()
+		}
+		batch := o.queue
+		o.queue = nil
+		o.mutex.Unlock()
+		if len(batch) == 0 {
+			return // stopped, and everything is written
+		}
+
+		written := 0
+		for _, msg := range batch {
+			if o.writeTimeout > 0 {
+				o.conn.SetWriteDeadline(time.Now().Add(o.writeTimeout))
+			}
+			if _, err := o.conn.Write(msg); err != nil {
+				o.mutex.Lock()
+				o.stopped = true // the connection is broken, don't bother queueing any more
+				o.queue, o.held = nil, nil
+				o.drained.Broadcast()
+				o.mutex.Unlock()
+				if errors.Is(err, os.ErrDeadlineExceeded) {
+					o.onLimit("didn't read its replies for " + o.writeTimeout.String())
+				}
+				return
+			}
+			written += len(msg)
+		}
+
+		o.mutex.Lock()
+		o.queued -= written
+		if o.queued <= o.limit.Soft {
+			o.overSoftSince = time.Time{}
+		}
+		o.drained.Broadcast()
+		o.mutex.Unlock()
+	}
+}
+
+// What handlers write to as their Session.conn. Replies are collected until the command
+// is done, and then queued in one go.
+type outputConn struct {
+	net.Conn
+	out *clientOutput
+}
+
+func (c *outputConn) Write(b []byte) (int, error) {
+	c.out.reply = append(c.out.reply, b...)
+	return len(b), nil
+}
+
+// Queue the reply written so far.
+func (s *Session) flush() {
+	if s.out != nil {
+		s.out.flushReply()
+	}
+}
+
+// Queue the part of the reply written so far, for a command writing a long one in parts,
+// and wait for the client to catch up on it. Returns false if the rest of the reply
+// shouldn't be written, in which case the command should return without an error: the
+// client is gone, or the command ran out of time, and having started the reply, the
+// connection is closed instead of replying with errCommandTimeout.
+func (s *Session) flushPart() bool {
+	ctx := s.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if s.out != nil && !s.out.flushPartialReply(ctx) || ctx.Err() != nil {
+		s.log.Debug("Closing client in the middle of a reply")
+		s.close()
+		return false
+	}
+	return true
+}
+
+// Apply the output buffer limit of replicas to the client from now on.
+func (s *Session) becomeReplicaOutput() {
+	if s.out != nil {
+		s.out.setLimit("replica", s.server.OutputLimits.Replica)
+	}
+}
+
+// Send a message that isn't a reply to a command of this client. May be called from
+// any goroutine. msg must not be modified afterwards.
+func (s *Session) push(msg []byte) {
+	if s.out == nil {
+		s.conn.Write(msg)
+		return
+	}
+	s.out.enqueue(msg)
+}
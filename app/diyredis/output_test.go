@@ -0,0 +1,239 @@
+package diyredis
+
+import (
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClientOutputOrder(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	out := newClientOutput(server, OutputBufferLimit{}, 0, func(string) { t.Error("limit exceeded") })
+
+	out.reply = append(out.reply, "+reply\r\n"...)
+	out.enqueue([]byte(">push\r\n"))
+	out.flushReply()
+	go func() {
+		out.stop()
+		server.Close()
+	}()
+
+	got, err := io.ReadAll(client)
+	if err != nil && err != io.ErrClosedPipe {
+		t.Fatal(err)
+	}
+	if string(got) != ">push\r\n+reply\r\n" {
+		t.Errorf("got %q, want the push and then the reply", got)
+	}
+}
+
+func TestClientOutputPartialReply(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	out := newClientOutput(server, OutputBufferLimit{}, 0, func(string) { t.Error("limit exceeded") })
+
+	part := strings.Repeat("x", 2*partialReplyBacklog)
+	out.reply = append(out.reply, part...)
+	flushed := make(chan bool)
+	go func() { flushed <- out.flushPartialReply(context.Background()) }()
+	select {
+	case <-flushed:
+		t.Fatal("didn't wait for the client to read the part of the reply")
+	case <-time.After(50 * time.Millisecond):
+	}
+	out.enqueue([]byte(">push\r\n")) // from another client, in the middle of the reply
+
+	buf := make([]byte, len(part))
+	if _, err := io.ReadFull(client, buf); err != nil || string(buf) != part {
+		t.Fatalf("got %v reading the part of the reply", err)
+	}
+	if ok := <-flushed; !ok {
+		t.Fatal("flushPartialReply: got false for a client that read the reply")
+	}
+	out.reply = append(out.reply, "end\r\n"...)
+	out.flushReply()
+	go func() {
+		out.stop()
+		server.Close()
+	}()
+	got, err := io.ReadAll(client)
+	if err != nil && err != io.ErrClosedPipe {
+		t.Fatal(err)
+	}
+	if string(got) != "end\r\n>push\r\n" {
+		t.Errorf("got %q, want the end of the reply and then the push", got)
+	}
+
+	// Once the command is out of time, it doesn't wait anymore
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	server, client = net.Pipe() // never read from
+	defer client.Close()
+	out = newClientOutput(server, OutputBufferLimit{}, 0, func(string) {})
+	out.reply = append(out.reply, part...)
+	if out.flushPartialReply(ctx) {
+		t.Error("flushPartialReply: got true once the command timed out")
+	}
+	server.Close()
+	out.stop()
+}
+
+func TestXRANGEInParts(t *testing.T) {
+	server := MakeServer()
+	session, conn := newTestSession(server)
+	for i := range 2*xrangeChunkEntries + 10 {
+		session.dispatch([]string{"XADD", "s", "1-" + strconv.Itoa(i+1), "field", strings.Repeat("v", 1000)})
+	}
+	conn.buf.Reset()
+	session.dispatch([]string{"XRANGE", "s", "-", "+"})
+	want := conn.buf.String()
+
+	client, serverConn := net.Pipe()
+	defer client.Close()
+	go server.startSession(serverConn)
+	go client.Write([]byte(respCommand("XRANGE", "s", "-", "+")))
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(client, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("the reply written in parts differs from the one written at once")
+	}
+}
+
+func TestClientOutputLimit(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		limit OutputBufferLimit
+	}{
+		{"hard", OutputBufferLimit{Hard: 100}},
+		{"soft", OutputBufferLimit{Soft: 100, SoftSeconds: 0}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			server, client := net.Pipe() // never read from, so every write blocks
+			defer client.Close()
+			exceeded := make(chan struct{})
+			out := newClientOutput(server, tc.limit, 0, func(string) {
+				close(exceeded)
+				server.Close()
+			})
+			defer out.stop()
+
+			out.enqueue(make([]byte, 60)) // counts until it's written
+			select {
+			case <-exceeded:
+				t.Fatal("exceeded the limit while under it")
+			case <-time.After(10 * time.Millisecond):
+			}
+			out.enqueue(make([]byte, 60))
+			select {
+			case <-exceeded:
+			case <-time.After(time.Second):
+				t.Fatal("didn't exceed the limit")
+			}
+			out.enqueue([]byte("ignored"))
+		})
+	}
+}
+
+func TestClientOutputNoEvict(t *testing.T) {
+	server, client := net.Pipe() // never read from, so every write blocks
+	defer client.Close()
+	out := newClientOutput(server, OutputBufferLimit{Hard: 100}, 0, func(string) {
+		t.Error("exceeded the limit with CLIENT NO-EVICT on")
+	})
+	defer out.stop()
+	defer server.Close() // unblocks the write, so that stop returns
+
+	out.setNoEvict(true)
+	out.enqueue(make([]byte, 60))
+	out.enqueue(make([]byte, 60))
+	time.Sleep(10 * time.Millisecond)
+}
+
+func TestClientOutputWriteTimeout(t *testing.T) {
+	server, client := net.Pipe() // never read from, so every write blocks
+	defer client.Close()
+	reasons := make(chan string, 1)
+	out := newClientOutput(server, OutputBufferLimit{}, 10*time.Millisecond, func(reason string) {
+		reasons <- reason
+	})
+
+	out.enqueue([]byte("+OK\r\n"))
+	select {
+	case reason := <-reasons:
+		if reason != "didn't read its replies for 10ms" {
+			t.Errorf("got reason %q", reason)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("not disconnected")
+	}
+	out.stop() // doesn't wait for the write anymore
+}
+
+func TestOutputBufferLimitsSet(t *testing.T) {
+	limits := DefaultOutputBufferLimits
+	if err := limits.Set("replica 1mb 0 0 pubsub 1 2 3"); err != nil {
+		t.Fatal(err)
+	}
+	want := OutputBufferLimits{Replica: OutputBufferLimit{Hard: 1 << 20}, Pubsub: OutputBufferLimit{1, 2, 3}}
+	if limits != want {
+		t.Errorf("got %+v, want %+v", limits, want)
+	}
+	// Without a class, as redis.conf has it for older versions
+	if err := limits.Set("1k 0 0"); err != nil || limits.Normal.Hard != 1000 {
+		t.Errorf("got %+v %v, want a hard limit of 1000 for normal clients", limits, err)
+	}
+	if err := limits.Set("slave 5 0 0"); err != nil || limits.Replica.Hard != 5 {
+		t.Errorf("got %+v %v, want a hard limit of 5 for replicas", limits, err)
+	}
+	if got := limits.String(); got != "normal 1000 0 0 replica 5 0 0 pubsub 1 2 3" {
+		t.Errorf("got %q", got)
+	}
+	for _, bad := range []string{"", "master 1 2 3", "normal 1 2", "normal 1 2 3 replica"} {
+		if err := limits.Set(bad); err == nil {
+			t.Errorf("%q: got no error", bad)
+		}
+	}
+}
+
+func TestOutputBufferLimitSet(t *testing.T) {
+	var limit OutputBufferLimit
+	if err := limit.Set("1mb 512kb 10"); err != nil {
+		t.Fatal(err)
+	}
+	if want := (OutputBufferLimit{1 << 20, 512 << 10, 10}); limit != want {
+		t.Errorf("got %+v, want %+v", limit, want)
+	}
+	if err := limit.Set("2k 0 0"); err != nil || limit.Hard != 2000 {
+		t.Errorf("got %+v %v, want a hard limit of 2000", limit, err)
+	}
+	for _, bad := range []string{"", "1 2", "1x 0 0", "-1 0 0", "0 0 -5"} {
+		if err := limit.Set(bad); err == nil {
+			t.Errorf("%q: got no error", bad)
+		}
+	}
+}
+
+func TestReplicaOutputLimit(t *testing.T) {
+	server := MakeServer()
+	session, _ := newTestSession(server)
+	conn, client := net.Pipe()
+	defer client.Close()
+	session.out = newClientOutput(conn, server.OutputLimits.Normal, 0, func(string) {})
+	defer session.out.stop()
+	defer conn.Close()
+
+	server.repl.addReplica(session)
+	defer server.repl.removeReplica(session)
+	session.out.mutex.Lock()
+	defer session.out.mutex.Unlock()
+	if session.out.class != "replica" || session.out.limit != server.OutputLimits.Replica {
+		t.Errorf("got class %q with limit %+v", session.out.class, session.out.limit)
+	}
+}
@@ -6,26 +6,32 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"math"
 	"os"
+	"slices"
 	"strconv"
-	"time"
 
 	crc64 "github.com/codecrafters-io/redis-starter-go/app/diyredis/crc64"
+	listpack "github.com/codecrafters-io/redis-starter-go/app/diyredis/listpack"
+	streams "github.com/codecrafters-io/redis-starter-go/app/diyredis/streams"
 
 	lzf "github.com/zhuyie/golzf"
 )
 
 const (
-	opCodeModuleAux    byte = 247 // Module auxiliary data
-	opCodeIdle         byte = 248 // LRU idle time
-	opCodeFreq         byte = 249 // LFU frequency
-	opCodeAux          byte = 250 // Auxiliary field
-	opCodeResizeDB     byte = 251 // Hash table resize hint
-	opCodeExpireTimeMs byte = 252 // Expire time in milliseconds
-	opCodeExpireTimeS  byte = 253 // Expiry time in seconds
-	opCodeSelectDB     byte = 254 // DB number of the following keys
-	opCodeEOF          byte = 255 // EOF
+	opCodeSlotInfo      byte = 244 // Cluster slot info (Redis 7.4+)
+	opCodeFunction      byte = 245 // Function library (Redis 7.0+)
+	opCodeFunctionPreGA byte = 246 // Function library, pre-GA format
+	opCodeModuleAux     byte = 247 // Module auxiliary data
+	opCodeIdle          byte = 248 // LRU idle time
+	opCodeFreq          byte = 249 // LFU frequency
+	opCodeAux           byte = 250 // Auxiliary field
+	opCodeResizeDB      byte = 251 // Hash table resize hint
+	opCodeExpireTimeMs  byte = 252 // Expire time in milliseconds
+	opCodeExpireTimeS   byte = 253 // Expiry time in seconds
+	opCodeSelectDB      byte = 254 // DB number of the following keys
+	opCodeEOF           byte = 255 // EOF
 )
 
 const (
@@ -34,12 +40,33 @@ const (
 	setEnc                byte = 2  // Set encoding
 	sortedSetEnc          byte = 3  // Sorted set encoding
 	hashEnc               byte = 4  // Hash encoding
+	sortedSet2Enc         byte = 5  // Sorted set encoding, with binary scores
+	moduleEnc             byte = 7  // Module value
 	zipmapEnc             byte = 9  // Zipmap encoding
 	ziplistEnc            byte = 10 // Ziplist encoding
 	intsetEnc             byte = 11 // Intset encoding
 	sortedSetInZiplistEnc byte = 12 // Sorted set in ziplist encoding
 	hashmapInZiplistEnc   byte = 13 // Hashmap in ziplist encoding
 	listInQuicklistEnc    byte = 14 // List in quicklist encoding
+	streamListpacksEnc    byte = 15 // Stream in listpacks encoding
+	hashListpackEnc       byte = 16 // Hash in listpack encoding
+	sortedSetListpackEnc  byte = 17 // Sorted set in listpack encoding
+	listInQuicklist2Enc   byte = 18 // List in quicklist (of listpacks) encoding
+	streamListpacks2Enc   byte = 19 // Stream in listpacks encoding, v2 (Redis 7.0+)
+	setListpackEnc        byte = 20 // Set in listpack encoding
+	streamListpacks3Enc   byte = 21 // Stream in listpacks encoding, v3 (Redis 7.2+)
+	hashMetadataEnc       byte = 24 // Hash with field expiries (Redis 7.4+)
+	hashListpackExEnc     byte = 25 // Hash in listpack encoding with field expiries (Redis 7.4+)
+)
+
+// Opcodes within serialized module data
+const (
+	moduleOpCodeEOF    int = 0
+	moduleOpCodeSInt   int = 1
+	moduleOpCodeUInt   int = 2
+	moduleOpCodeFloat  int = 3
+	moduleOpCodeDouble int = 4
+	moduleOpCodeString int = 5
 )
 
 // Special Format Object
@@ -50,22 +77,145 @@ const (
 	redisCompressedStr int = 3
 )
 
+// What to do when the RDB file turns out to be truncated or corrupt halfway through.
+type RdbLoadPolicy int
+
+const (
+	RdbLoadStrict  RdbLoadPolicy = iota // refuse to start; the error is returned as is
+	RdbLoadPartial                      // keep every key read before the corruption, and carry on
+)
+
+func (p *RdbLoadPolicy) String() string {
+	if p != nil && *p == RdbLoadPartial {
+		return "partial"
+	}
+	return "strict"
+}
+
+// Implements flag.Value, so the policy can be passed as a command line flag.
+func (p *RdbLoadPolicy) Set(val string) error {
+	switch val {
+	case "strict":
+		*p = RdbLoadStrict
+	case "partial":
+		*p = RdbLoadPartial
+	default:
+		return fmt.Errorf("invalid rdb load policy %q; must be \"strict\" or \"partial\"", val)
+	}
+	return nil
+}
+
+// An error encountered while parsing an RDB file, along with the offset (in bytes, from
+// the start of the file) at which it happened.
+type RdbError struct {
+	Offset int64
+	Err    error
+}
+
+func (e *RdbError) Error() string {
+	return fmt.Sprintf("rdb: at offset %d: %s", e.Offset, e.Err.Error())
+}
+
+func (e *RdbError) Unwrap() error {
+	return e.Err
+}
+
+// Wraps a buffered reader to keep track of how many bytes were consumed, so that any
+// parse error can point to the exact spot in the file where things went wrong.
+type rdbReader struct {
+	r      *bufio.Reader
+	offset int64
+	aux    map[string]string // the aux fields read so far
+}
+
+func newRdbReader(r io.Reader) *rdbReader {
+	return &rdbReader{r: bufio.NewReader(r)}
+}
+
+func (r *rdbReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.offset += int64(n)
+	return n, err
+}
+
+// Reading a single byte and hitting EOF is always unexpected; a well-formed file ends
+// with an EOF opcode (and a checksum), which we stop at.
+func (r *rdbReader) ReadByte() (byte, error) {
+	b, err := r.r.ReadByte()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, r.wrap(err)
+	}
+	r.offset++
+	return b, nil
+}
+
+func (r *rdbReader) UnreadByte() error {
+	if err := r.r.UnreadByte(); err != nil {
+		return r.wrap(err)
+	}
+	r.offset--
+	return nil
+}
+
+// Read exactly n bytes. A short read results in io.ErrUnexpectedEOF.
+func (r *rdbReader) readFull(n int) ([]byte, error) {
+	if n > 1<<16 {
+		// Don't trust large lengths; a corrupt length should not make us allocate
+		// gigabytes up front. Let the buffer grow as the data actually comes in.
+		buf, err := io.ReadAll(io.LimitReader(r, int64(n)))
+		if err != nil {
+			return nil, r.wrap(err)
+		}
+		if len(buf) < n {
+			return nil, r.wrap(io.ErrUnexpectedEOF)
+		}
+		return buf, nil
+	}
+
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, r.wrap(err)
+	}
+	return buf, nil
+}
+
+// Wrap err in an *RdbError pointing at the current offset, unless it already is one.
+func (r *rdbReader) wrap(err error) error {
+	var rdbErr *RdbError
+	if errors.As(err, &rdbErr) {
+		return err
+	}
+	return &RdbError{Offset: r.offset, Err: err}
+}
+
+func (r *rdbReader) errorf(format string, args ...any) error {
+	return r.wrap(fmt.Errorf(format, args...))
+}
+
 func (s *Server) LoadRdb() error {
 	if s.RdbDir == "" || s.RdbFilename == "" {
 		return nil
 	}
-	log.Println("Loading RDB file ", s.RdbDir, "/", s.RdbFilename, "...")
-
 	filename := s.RdbDir + "/" + s.RdbFilename
-	err := rdbPreFlight(filename)
+	s.Log.Info("Loading RDB file...", "file", filename)
+
+	err := rdbPreFlight(filename, s.RdbChecksum, s.Log)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return nil // if not exist; do nothing
 		}
-		return err
+		if !errors.Is(err, errRdbChecksum) || s.RdbLoadPolicy != RdbLoadPartial {
+			return err
+		}
+		s.Log.Warn("RDB file has an incorrect checksum, loading it anyway")
 	}
 
-	// Create buffered reader
 	file, err := os.Open(filename)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -74,118 +224,140 @@ func (s *Server) LoadRdb() error {
 		return err
 	}
 	defer file.Close()
-	reader := bufio.NewReader(file)
-	reader.Discard(5) // already checked by rdbPreFlight()
 
-	// Check RDB version number
-	versionNr := make([]byte, 4)
-	reader.Read(versionNr)
+	r := newRdbReader(file)
+	err = s.loadRdb(r, s.dbs)
+	if err != nil {
+		if s.RdbLoadPolicy == RdbLoadPartial {
+			s.Log.Warn("RDB file is corrupt, continuing with what could be loaded", "err", err)
+			return nil
+		}
+		return err
+	}
+	return s.loadCheckpoints(r.aux)
+}
+
+// Parse an entire RDB file, loading all key value pairs into the appropriate one of dbs.
+func (s *Server) loadRdb(r *rdbReader, dbs []RedisDB) error {
+	_, err := s.readRdb(r, len(dbs), func(db int, key string, valueType byte, value any, expiry int64) {
+		if value == nil {
+			s.Log.Warn("Skipping key found in RDB file: value type not supported", "key", key, "type", valueType)
+			return
+		}
+		dbs[db].set(key, value, expiry)
+	})
+	return err
+}
 
-	// Parse auxiliary fields
-	parseAuxFields(reader)
+// Called for every key value pair read from an RDB file, with the index of its database.
+// value is nil if it is of a type that we do not support, and was skipped over.
+type rdbVisitor func(db int, key string, valueType byte, value any, expiry int64)
 
-	// Load all key value pairs into the appropriate db
-	err = s.loadDatabases(reader)
+// Parse an RDB file up to and including its EOF opcode, passing every key value pair to
+// visit, for a server with numDBs databases. Returns the version of the file.
+func (s *Server) readRdb(r *rdbReader, numDBs int, visit rdbVisitor) (int, error) {
+	magic, err := r.readFull(5)
 	if err != nil {
-		return err
+		return 0, err
+	}
+	if string(magic) != "REDIS" {
+		return 0, r.errorf("not a Redis RDB file")
 	}
 
-	return nil
+	// Check RDB version number
+	versionNr, err := r.readFull(4)
+	if err != nil {
+		return 0, err
+	}
+	version, err := strconv.Atoi(string(versionNr))
+	if err != nil {
+		return 0, r.errorf("invalid RDB version number %q", versionNr)
+	}
+
+	return version, s.readDatabases(r, numDBs, visit)
 }
 
-// Sanity check magic bytes and CRC checksum
-func rdbPreFlight(fn string) error {
+var errRdbChecksum = errors.New("CRC checksum incorrect")
+
+// Sanity check magic bytes and CRC checksum.
+//
+// The checksum covers the entire file, except for the checksum itself in the last 8
+// bytes. It was introduced in RDB version 5, so older files are not validated at all.
+// Files written with "rdbchecksum no" have a checksum of 0, which we skip as well.
+func rdbPreFlight(fn string, validateChecksum bool, log *slog.Logger) error {
 	f, err := os.Open(fn)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
 
-	buf := make([]byte, 4096)
-	lastBytesRead, err := f.Read(buf)
+	header := make([]byte, 9) // "REDIS" + 4 digit version number
+	_, err = io.ReadFull(f, header)
 	if err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return errors.New("not a Redis RDB file")
+		}
 		return err
 	}
 
 	// Sanity check; is RDB file?
-	for i, r := range []byte("REDIS") {
-		if buf[i] != r {
-			return errors.New("not a Redis RDB file")
-		}
+	if string(header[:5]) != "REDIS" {
+		return errors.New("not a Redis RDB file")
 	}
 
-	// TODO remove after cc tests
-	return nil
+	if !validateChecksum {
+		return nil
+	}
+	version, err := strconv.Atoi(string(header[5:]))
+	if err != nil {
+		return fmt.Errorf("invalid RDB version number %q", header[5:])
+	}
+	if version < 5 {
+		return nil
+	}
 
 	// Sanity check; CRC OK?
-	hash := crc64.New()
-	_, err = hash.Write(buf[:lastBytesRead-8])
+	info, err := f.Stat()
 	if err != nil {
 		return err
 	}
-	for {
-		bytesRead, err := f.Read(buf)
-		if err != nil {
-			if errors.Is(err, io.EOF) {
-				break
-			} else {
-				return err
-			}
-		}
-		_, err = hash.Write(buf[:bytesRead])
-		if err != nil {
-			return err
-		}
-		lastBytesRead = bytesRead
+	if info.Size() < int64(len(header))+8 {
+		return errors.New("RDB file too short to contain a checksum")
+	}
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
 	}
 
-	// TODO pre v5 or something crc did not exist in the rdb format so there won't be any zeroes there either
-	reportedCRC := binary.LittleEndian.Uint64(buf[lastBytesRead-8 : lastBytesRead])
-
-	hashy := crc64.New()
-	_, _ = hashy.Write([]byte("123456789"))
+	hash := crc64.New()
+	_, err = io.CopyN(hash, f, info.Size()-8)
+	if err != nil {
+		return err
+	}
+	checksum := make([]byte, 8)
+	_, err = io.ReadFull(f, checksum)
+	if err != nil {
+		return err
+	}
+	reportedCRC := binary.LittleEndian.Uint64(checksum)
 
 	if reportedCRC == 0 {
-		log.Println("skipping CRC validation: checksum not in RDB file")
+		log.Info("Skipping CRC validation: checksum not in RDB file")
 		return nil
 	}
 
 	if hash.Sum64() != reportedCRC {
-		return errors.New("CRC checksum incorrect")
-	}
-	return nil
-}
-
-// Parse all auxiliary fields found in succession of one another
-func parseAuxFields(r *bufio.Reader) error {
-	for {
-		opCode, err := r.ReadByte()
-		if err != nil {
-			return err
-		}
-
-		if opCode == opCodeAux {
-			key, _, _ := readStringEnc(r) // aux should always be string keys & vals
-			fmt.Println(key)
-			value, _, _ := readStringEnc(r)
-			fmt.Println(value)
-		} else {
-			err := r.UnreadByte()
-			if err != nil {
-				return err
-			}
-			break
-		}
+		return errRdbChecksum
 	}
 	return nil
 }
 
-func (s *Server) loadDatabases(r *bufio.Reader) error {
-	var currentDB RedisDB
+func (s *Server) readDatabases(r *rdbReader, numDBs int, visit rdbVisitor) error {
+	currentDB := 0   // keys before any SELECTDB opcode belong to db 0
+	var expiry int64 // expiry of the upcoming key value pair, if any
 
 	for {
 		opCode, err := r.ReadByte()
-		fmt.Println(opCode, err)
 		if err != nil {
 			return err
 		}
@@ -199,209 +371,1105 @@ func (s *Server) loadDatabases(r *bufio.Reader) error {
 				return err
 			}
 			if specialfmt {
-				return errors.New("wrong select db encoding found")
+				return r.errorf("wrong select db encoding found")
 			}
-			if dbid > len(s.dbs) {
-				return errors.New("rdb file contains a database id too large")
+			if dbid >= numDBs {
+				return r.errorf("rdb file contains database %d, but there are only %d databases", dbid, numDBs)
 			}
-			currentDB = s.dbs[dbid]
-			fmt.Println("db selected")
+			currentDB = dbid
 
 		case opCodeResizeDB:
-			tableSize, specialfmt, err := readLengthEnc(r)
+			for range 2 { // hash table size, followed by the expiry hash table size
+				_, specialfmt, err := readLengthEnc(r)
+				if err != nil {
+					return err
+				}
+				if specialfmt {
+					return r.errorf("wrong resize db encoding found")
+				}
+			}
+			// TODO use these numbers to resize the hashtables of the current db
+
+		case opCodeAux:
+			// Aux fields are mostly found at the start of the file, but Redis 7 also
+			// emits some after the keyspace (e.g. "lua" scripts). Either way they're
+			// always string keys & vals, and mostly of no use to us.
+			key, err := readStringEnc(r)
 			if err != nil {
 				return err
 			}
-			if specialfmt {
-				return errors.New("wrong resize db encoding found")
+			value, err := readStringEnc(r)
+			if err != nil {
+				return err
+			}
+			if r.aux == nil {
+				r.aux = make(map[string]string)
 			}
+			r.aux[key] = value
 
-			expiryTableSize, specialfmt, err := readLengthEnc(r)
-			if err != nil {
+		case opCodeSlotInfo:
+			// slot id, slot size, expires slot size
+			for range 3 {
+				if _, _, err := readLengthEnc(r); err != nil {
+					return err
+				}
+			}
+
+		case opCodeFunction:
+			if _, err := readStringEnc(r); err != nil { // library source code
 				return err
 			}
-			if specialfmt {
-				return errors.New("wrong resize db encoding found")
+			s.Log.Warn("Skipping function library found in RDB file: functions are not supported")
+
+		case opCodeFunctionPreGA:
+			return r.errorf("pre-GA function format (Redis 7.0 release candidates) not supported")
+
+		case opCodeModuleAux:
+			if _, _, err := readLengthEnc(r); err != nil { // module id
+				return err
+			}
+			if _, _, err := readLengthEnc(r); err != nil { // "when" opcode
+				return err
+			}
+			if _, _, err := readLengthEnc(r); err != nil { // "when"
+				return err
+			}
+			if err := skipModuleData(r); err != nil {
+				return err
+			}
+
+		case opCodeIdle:
+			// LRU idle time of the upcoming key, which we don't track
+			if _, _, err := readLengthEnc(r); err != nil {
+				return err
+			}
+
+		case opCodeFreq:
+			// LFU frequency of the upcoming key, which we don't track
+			if _, err := r.ReadByte(); err != nil {
+				return err
 			}
-			fmt.Println("resizedb: ")
-			fmt.Println(tableSize, expiryTableSize)
-			// TODO use these numbers to resize the hashtables of the current db
 
 		case opCodeExpireTimeS:
-			buf := make([]byte, 4)
-			_, err := r.Read(buf)
+			buf, err := r.readFull(4)
 			if err != nil {
 				return err
 			}
-			expiry := time.Unix(int64(binary.LittleEndian.Uint32(buf)), 0)
-			loadKeyVal(r, currentDB, expiry)
+			expiry = int64(binary.LittleEndian.Uint32(buf)) * 1000
 
 		case opCodeExpireTimeMs:
-			buf := make([]byte, 8)
-			_, err := r.Read(buf)
+			buf, err := r.readFull(8)
 			if err != nil {
 				return err
 			}
-			expiry := time.UnixMilli(int64(binary.LittleEndian.Uint64(buf)))
-			loadKeyVal(r, currentDB, expiry)
+			expiry = int64(binary.LittleEndian.Uint64(buf))
 
 		default:
 			// no op code -> normal key-value pair
 			if err := r.UnreadByte(); err != nil {
 				return err
 			}
-			loadKeyVal(r, currentDB, time.Time{})
+			if err := s.readKeyVal(r, currentDB, expiry, visit); err != nil {
+				return err
+			}
+			expiry = 0
 		}
 	}
 }
 
-func loadKeyVal(r *bufio.Reader, db RedisDB, expiry time.Time) error {
+// Read a single key value pair of db and pass it to visit. It is only passed on once it
+// was read in its entirety.
+//
+// Values of a type that we do not support are skipped over, so that they don't prevent
+// the rest of the file from loading.
+func (s *Server) readKeyVal(r *rdbReader, db int, expiry int64, visit rdbVisitor) error {
 	valueType, err := r.ReadByte()
 	if err != nil {
 		return err
 	}
 
-	fmt.Println("loading key value pair")
-
-	keyStr, keyInt, err := readStringEnc(r) // key is always string-encoded
+	key, err := readStringEnc(r) // key is always string-encoded
 	if err != nil {
 		return err
 	}
-	var key any
-	if keyStr == "" {
-		key = keyInt
-	} else {
-		key = keyStr
-	}
 
 	var value any
 	switch valueType {
-	case stringEnc:
-		valueStr, valueInt, err := readStringEnc(r)
+	case stringEnc, listEnc, setEnc, hashEnc, hashListpackEnc, listInQuicklist2Enc, setListpackEnc,
+		streamListpacksEnc, streamListpacks2Enc, streamListpacks3Enc:
+		value, err = readValue(r, valueType, s.Encoding)
 		if err != nil {
 			return err
 		}
-		if valueStr == "" {
-			value = strconv.Itoa(int(valueInt))
-		} else {
-			value = valueStr
-		}
 	default:
-		return errors.New("value type encoding not yet implemented")
+		if err := skipValue(r, valueType); err != nil {
+			return err
+		}
 	}
 
-	if !expiry.IsZero() {
-		db.expiryDB.Store(key, expiry)
-	}
-	db.valueDB.Store(key, value)
+	visit(db, key, valueType, value, expiry)
 	return nil
 }
 
-// Returns either string or uint, the other return value being its natural null value.
-func readStringEnc(r *bufio.Reader) (string, uint, error) {
-	length, specialfmt, err := readLengthEnc(r)
-	if err != nil {
-		return "", 0, err
+// Consume a value of the given type, without interpreting it.
+func skipValue(r *rdbReader, valueType byte) error {
+	// Many encodings are just a single string blob (a ziplist, listpack, intset, ...)
+	skipStrings := func(n int) error {
+		for range n {
+			if _, err := readStringEnc(r); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	readLength := func() (int, error) {
+		length, specialfmt, err := readLengthEnc(r)
+		if err == nil && specialfmt {
+			err = r.errorf("unexpected special format where a length was expected")
+		}
+		return length, err
 	}
 
-	if specialfmt {
-		switch length {
-		case redisInt8:
-			val, err := r.ReadByte()
+	switch valueType {
+	case zipmapEnc, ziplistEnc, intsetEnc, sortedSetInZiplistEnc, hashmapInZiplistEnc,
+		hashListpackEnc, sortedSetListpackEnc, setListpackEnc:
+		return skipStrings(1)
+
+	case listEnc, setEnc, listInQuicklistEnc:
+		n, err := readLength()
+		if err != nil {
+			return err
+		}
+		return skipStrings(n)
+
+	case hashEnc:
+		n, err := readLength()
+		if err != nil {
+			return err
+		}
+		return skipStrings(2 * n)
+
+	case sortedSetEnc:
+		n, err := readLength()
+		if err != nil {
+			return err
+		}
+		for range n {
+			if err := skipStrings(1); err != nil {
+				return err
+			}
+			// Score as a string, prefixed by a 1 byte length. 253, 254 and 255 are
+			// reserved for NaN, +inf and -inf respectively, and have no string after them.
+			scoreLen, err := r.ReadByte()
 			if err != nil {
-				return "", 0, err
+				return err
 			}
-			return "", uint(val), nil
+			if scoreLen < 253 {
+				if _, err := r.readFull(int(scoreLen)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
 
-		case redisInt16:
-			buf := make([]byte, 2)
-			_, err := r.Read(buf)
-			if err != nil {
-				return "", 0, err
+	case sortedSet2Enc:
+		n, err := readLength()
+		if err != nil {
+			return err
+		}
+		for range n {
+			if err := skipStrings(1); err != nil {
+				return err
+			}
+			if _, err := r.readFull(8); err != nil { // binary double
+				return err
 			}
-			return "", uint(binary.LittleEndian.Uint16(buf)), nil
+		}
+		return nil
 
-		case redisInt32:
-			buf := make([]byte, 4)
-			_, err := r.Read(buf)
-			if err != nil {
-				return "", 0, err
+	case listInQuicklist2Enc:
+		n, err := readLength()
+		if err != nil {
+			return err
+		}
+		for range n {
+			if _, err := readLength(); err != nil { // container type
+				return err
+			}
+			if err := skipStrings(1); err != nil {
+				return err
 			}
-			return "", uint(binary.LittleEndian.Uint32(buf)), nil
+		}
+		return nil
 
-		case redisCompressedStr:
-			res, err := readCompressedStr(r)
-			if err != nil {
-				return "", 0, err
+	case hashMetadataEnc:
+		if _, err := r.readFull(8); err != nil { // min expire time
+			return err
+		}
+		n, err := readLength()
+		if err != nil {
+			return err
+		}
+		for range n {
+			if _, err := readLength(); err != nil { // field ttl
+				return err
+			}
+			if err := skipStrings(2); err != nil {
+				return err
 			}
-			return res, 0, nil
 		}
-	}
+		return nil
 
-	buf := make([]byte, length)
-	_, err = r.Read(buf)
-	if err != nil {
-		return "", 0, err
+	case hashListpackExEnc:
+		if _, err := r.readFull(8); err != nil { // min expire time
+			return err
+		}
+		return skipStrings(1)
+
+	case streamListpacksEnc, streamListpacks2Enc, streamListpacks3Enc:
+		return skipStream(r, valueType)
+
+	case moduleEnc:
+		if _, err := readLength(); err != nil { // module id
+			return err
+		}
+		return skipModuleData(r)
 	}
-	return string(buf), 0, nil
 
+	return r.errorf("unknown value type encoding %d", valueType)
 }
 
-func readCompressedStr(r *bufio.Reader) (string, error) {
-	compressedLen, specialfmt, err := readLengthEnc(r)
-	if specialfmt || err != nil {
-		return "", errors.New("invalid compressed string encoding")
+// Consume a stream, including its consumer groups, without interpreting it.
+func skipStream(r *rdbReader, valueType byte) error {
+	readLength := func() (int, error) {
+		length, specialfmt, err := readLengthEnc(r)
+		if err == nil && specialfmt {
+			err = r.errorf("unexpected special format where a length was expected")
+		}
+		return length, err
 	}
-	uncompressedLen, specialfmt, err := readLengthEnc(r)
-	if specialfmt || err != nil {
-		return "", errors.New("invalid compressed string encoding")
+	skipLengths := func(n int) error {
+		for range n {
+			if _, err := readLength(); err != nil {
+				return err
+			}
+		}
+		return nil
 	}
 
-	buf := make([]byte, compressedLen)
-	_, err = r.Read(buf)
+	// Listpacks, each prefixed by the ID of their master entry
+	n, err := readLength()
 	if err != nil {
-		return "", err
+		return err
+	}
+	for range 2 * n {
+		if _, err := readStringEnc(r); err != nil {
+			return err
+		}
 	}
 
-	outputBuf := make([]byte, uncompressedLen)
-	lzf.Decompress(buf, outputBuf)
-	return string(outputBuf), nil
+	// Entry count & last ID, then first ID, max deleted ID & entries added for v2+
+	metadataLen := 3
+	if valueType != streamListpacksEnc {
+		metadataLen += 5
+	}
+	if err := skipLengths(metadataLen); err != nil {
+		return err
+	}
+	return skipStreamGroups(r, valueType)
 }
 
-// Parse Redis' length encoding, returning either the length or the 'special format'
-// of the next object in case the returning boolean is true.
-func readLengthEnc(r *bufio.Reader) (int, bool, error) {
-	firstByte, err := r.ReadByte()
-	if err != nil {
-		return 0, false, err
+// Consume the consumer groups of a stream, which come after its entries and metadata.
+func skipStreamGroups(r *rdbReader, valueType byte) error {
+	readLength := func() (int, error) {
+		length, specialfmt, err := readLengthEnc(r)
+		if err == nil && specialfmt {
+			err = r.errorf("unexpected special format where a length was expected")
+		}
+		return length, err
 	}
-
-	switch msb := firstByte >> 6; msb {
-	case 0: // 6 bits in this byje
-		return int(firstByte & 63), false, nil
-
-	case 1: // 6 bits in this byte + next byte
+	skipLengths := func(n int) error {
+		for range n {
+			if _, err := readLength(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	groups, err := readLength()
+	if err != nil {
+		return err
+	}
+	for range groups {
+		if _, err := readStringEnc(r); err != nil { // name
+			return err
+		}
+		lastIDLen := 2
+		if valueType != streamListpacksEnc {
+			lastIDLen++ // entries read
+		}
+		if err := skipLengths(lastIDLen); err != nil {
+			return err
+		}
+
+		// Pending entries list: 128 bit ID, delivery time in ms, delivery count
+		pending, err := readLength()
+		if err != nil {
+			return err
+		}
+		for range pending {
+			if _, err := r.readFull(16 + 8); err != nil {
+				return err
+			}
+			if _, err := readLength(); err != nil {
+				return err
+			}
+		}
+
+		consumers, err := readLength()
+		if err != nil {
+			return err
+		}
+		for range consumers {
+			if _, err := readStringEnc(r); err != nil { // name
+				return err
+			}
+			timestamps := 8 // seen time
+			if valueType == streamListpacks3Enc {
+				timestamps += 8 // active time
+			}
+			if _, err := r.readFull(timestamps); err != nil {
+				return err
+			}
+			pending, err := readLength()
+			if err != nil {
+				return err
+			}
+			if _, err := r.readFull(16 * pending); err != nil { // IDs into the group's PEL
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Consume module data, which is a series of opcodes each followed by a value, ending
+// with an EOF opcode.
+func skipModuleData(r *rdbReader) error {
+	for {
+		opCode, _, err := readLengthEnc(r)
+		if err != nil {
+			return err
+		}
+
+		switch opCode {
+		case moduleOpCodeEOF:
+			return nil
+		case moduleOpCodeSInt, moduleOpCodeUInt:
+			_, _, err = readLengthEnc(r)
+		case moduleOpCodeFloat:
+			_, err = r.readFull(4)
+		case moduleOpCodeDouble:
+			_, err = r.readFull(8)
+		case moduleOpCodeString:
+			_, err = readStringEnc(r)
+		default:
+			return r.errorf("unknown module data opcode %d", opCode)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Read a string, which may be encoded as a length-prefixed string, an integer, or an
+// LZF-compressed string. Integers are returned in their base 10 string form.
+func readStringEnc(r *rdbReader) (string, error) {
+	length, specialfmt, err := readLengthEnc(r)
+	if err != nil {
+		return "", err
+	}
+
+	if specialfmt {
+		switch length {
+		case redisInt8:
+			val, err := r.ReadByte()
+			if err != nil {
+				return "", err
+			}
+			return strconv.Itoa(int(int8(val))), nil
+
+		case redisInt16:
+			buf, err := r.readFull(2)
+			if err != nil {
+				return "", err
+			}
+			return strconv.Itoa(int(int16(binary.LittleEndian.Uint16(buf)))), nil
+
+		case redisInt32:
+			buf, err := r.readFull(4)
+			if err != nil {
+				return "", err
+			}
+			return strconv.Itoa(int(int32(binary.LittleEndian.Uint32(buf)))), nil
+
+		case redisCompressedStr:
+			return readCompressedStr(r)
+
+		default:
+			return "", r.errorf("invalid special string encoding %d", length)
+		}
+	}
+
+	buf, err := r.readFull(length)
+	if err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+func readCompressedStr(r *rdbReader) (string, error) {
+	compressedLen, specialfmt, err := readLengthEnc(r)
+	if err != nil {
+		return "", err
+	}
+	if specialfmt {
+		return "", r.errorf("invalid compressed string encoding")
+	}
+	uncompressedLen, specialfmt, err := readLengthEnc(r)
+	if err != nil {
+		return "", err
+	}
+	if specialfmt {
+		return "", r.errorf("invalid compressed string encoding")
+	}
+
+	buf, err := r.readFull(compressedLen)
+	if err != nil {
+		return "", err
+	}
+
+	outputBuf := make([]byte, uncompressedLen)
+	n, err := lzf.Decompress(buf, outputBuf)
+	if err != nil {
+		return "", r.errorf("could not decompress string: %w", err)
+	}
+	if n != uncompressedLen {
+		return "", r.errorf(
+			"compressed string decompressed to %d bytes, expected %d", n, uncompressedLen,
+		)
+	}
+	return string(outputBuf), nil
+}
+
+// Parse Redis' length encoding, returning either the length or the 'special format'
+// of the next object in case the returning boolean is true.
+func readLengthEnc(r *rdbReader) (int, bool, error) {
+	length, specialfmt, err := readLengthEnc64(r)
+	if err == nil && length > uint64(math.MaxInt) {
+		return 0, false, r.errorf("length %d out of range", length)
+	}
+	return int(length), specialfmt, err
+}
+
+// Like readLengthEnc, for numbers that can take up all 64 bits, like the halves of a
+// stream ID.
+func readLengthEnc64(r *rdbReader) (uint64, bool, error) {
+	firstByte, err := r.ReadByte()
+	if err != nil {
+		return 0, false, err
+	}
+
+	switch msb := firstByte >> 6; msb {
+	case 0: // 6 bits in this byte
+		return uint64(firstByte & 63), false, nil
+
+	case 1: // 6 bits in this byte + next byte, big endian
 		nextByte, err := r.ReadByte()
 		if err != nil {
 			return 0, false, err
 		}
+		return uint64(firstByte&63)<<8 | uint64(nextByte), false, nil
+
+	case 2: // discard this byte, read the next 4 or 8 bytes (big endian)
+		switch firstByte {
+		case 0x80:
+			lenbuf, err := r.readFull(4)
+			if err != nil {
+				return 0, false, err
+			}
+			return uint64(binary.BigEndian.Uint32(lenbuf)), false, nil
+		case 0x81:
+			lenbuf, err := r.readFull(8)
+			if err != nil {
+				return 0, false, err
+			}
+			return binary.BigEndian.Uint64(lenbuf), false, nil
+		}
+		return 0, false, r.errorf("invalid length encoding 0x%x", firstByte)
+	}
+
+	// special format
+	return uint64(firstByte & 63), true, nil
+}
+
+// Serialize every database into w as an RDB file, including the trailing checksum. Must
+// be called with a snapshot in progress, which is what gets written.
+func (s *Server) writeRdb(w io.Writer) error {
+	checksum := crc64.New()
+	bw := bufio.NewWriter(io.MultiWriter(w, checksum))
+
+	buf := fmt.Appendf(nil, "REDIS%04d", rdbVersion)
+	for _, aux := range [][2]string{
+		{"redis-ver", "7.2.0"},
+		{"redis-bits", "64"},
+		{"ctime", strconv.FormatInt(s.now().Unix(), 10)},
+		{"aof-base", "0"},
+		{rdbAuxCheckpoint, strconv.FormatInt(s.checkpoint.seq.Load(), 10)},
+	} {
+		buf = append(buf, opCodeAux)
+		buf = appendStringEnc(buf, aux[0])
+		buf = appendStringEnc(buf, aux[1])
+	}
+	if _, err := bw.Write(buf); err != nil {
+		return err
+	}
+
+	for _, db := range s.dbs {
+		if err := writeRdbDB(bw, db, s.Log); err != nil {
+			return err
+		}
+	}
 
-		length := binary.LittleEndian.Uint16([]byte{firstByte & 192, nextByte})
-		return int(length), false, nil
+	if err := bw.WriteByte(opCodeEOF); err != nil {
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	_, err := w.Write(binary.LittleEndian.AppendUint64(nil, checksum.Sum64()))
+	return err
+}
 
-	case 2: // discard this byte, read next 4 bytes
-		lenbuf := make([]byte, 4)
-		_, err := r.Read(lenbuf)
+// Write a single database, preceded by its SELECTDB and RESIZEDB opcodes. Empty
+// databases are left out entirely.
+func writeRdbDB(w io.Writer, db RedisDB, log *slog.Logger) error {
+	var keyVals []byte
+	keyCount, expiryCount := 0, 0
+	db.rangeSnapshot(func(key string, value any, expiry int64) bool {
+		if expiry != 0 && expiry <= db.nowMs() {
+			return true
+		}
+
+		encoded, err := appendValue(nil, value)
 		if err != nil {
-			return 0, false, err
+			log.Warn("Not saving key to RDB file", "key", key, "err", err)
+			return true
+		}
+
+		if expiry != 0 {
+			keyVals = append(keyVals, opCodeExpireTimeMs)
+			keyVals = binary.LittleEndian.AppendUint64(keyVals, uint64(expiry))
+			expiryCount++
+		}
+		// The value type goes before the key, the value itself after it
+		keyVals = append(keyVals, encoded[0])
+		keyVals = appendStringEnc(keyVals, key)
+		keyVals = append(keyVals, encoded[1:]...)
+		keyCount++
+		return true
+	})
+	if keyCount == 0 {
+		return nil
+	}
+
+	buf := append([]byte{opCodeSelectDB}, appendLengthEnc(nil, uint64(db.id))...)
+	buf = append(buf, opCodeResizeDB)
+	buf = appendLengthEnc(buf, uint64(keyCount))
+	buf = appendLengthEnc(buf, uint64(expiryCount))
+	if _, err := w.Write(buf); err != nil {
+		return err
+	}
+	_, err := w.Write(keyVals)
+	return err
+}
+
+// Append `length` in Redis' length encoding to buf.
+func appendLengthEnc(buf []byte, length uint64) []byte {
+	switch {
+	case length < 1<<6:
+		return append(buf, byte(length))
+	case length < 1<<14:
+		return append(buf, byte(length>>8)|0x40, byte(length))
+	case length <= math.MaxUint32:
+		buf = append(buf, 0x80)
+		return binary.BigEndian.AppendUint32(buf, uint32(length))
+	default:
+		buf = append(buf, 0x81)
+		return binary.BigEndian.AppendUint64(buf, length)
+	}
+}
+
+// Append `str` as a length-prefixed string to buf. Strings that represent a small enough
+// integer are stored as such, like Redis does.
+func appendStringEnc(buf []byte, str string) []byte {
+	if len(str) <= 11 {
+		val, err := strconv.ParseInt(str, 10, 32)
+		if err == nil && strconv.FormatInt(val, 10) == str { // no "+1" or "01"
+			switch {
+			case val >= math.MinInt8 && val <= math.MaxInt8:
+				return append(buf, 0xc0|byte(redisInt8), byte(int8(val)))
+			case val >= math.MinInt16 && val <= math.MaxInt16:
+				buf = append(buf, 0xc0|byte(redisInt16))
+				return binary.LittleEndian.AppendUint16(buf, uint16(int16(val)))
+			default:
+				buf = append(buf, 0xc0|byte(redisInt32))
+				return binary.LittleEndian.AppendUint32(buf, uint32(int32(val)))
+			}
+		}
+	}
+
+	buf = appendLengthEnc(buf, uint64(len(str)))
+	return append(buf, str...)
+}
+
+// Append the value type followed by the value itself to buf, exactly like it would
+// appear in an RDB file.
+func appendValue(buf []byte, value any) ([]byte, error) {
+	switch val := value.(type) {
+	case string:
+		buf = append(buf, stringEnc)
+		return appendStringEnc(buf, val), nil
+	case int64:
+		buf = append(buf, stringEnc)
+		return appendStringEnc(buf, strconv.FormatInt(val, 10)), nil
+
+	case *hashValue:
+		val.mutex.RLock()
+		defer val.mutex.RUnlock()
+		if val.lp != nil {
+			buf = append(buf, hashListpackEnc)
+			return appendStringEnc(buf, string(val.lp)), nil
+		}
+		buf = append(buf, hashEnc)
+		buf = appendLengthEnc(buf, uint64(len(val.fields)))
+		for field, value := range val.fields {
+			buf = appendStringEnc(buf, field)
+			buf = appendStringEnc(buf, value)
+		}
+		return buf, nil
+
+	case *listValue:
+		val.mutex.RLock()
+		defer val.mutex.RUnlock()
+		if val.lp != nil {
+			// A quicklist with a single node, just like Redis writes small lists
+			buf = append(buf, listInQuicklist2Enc)
+			buf = appendLengthEnc(buf, 1)
+			buf = appendLengthEnc(buf, quicklistNodePacked)
+			return appendStringEnc(buf, string(val.lp)), nil
+		}
+		buf = append(buf, listEnc)
+		buf = appendLengthEnc(buf, uint64(val.len()))
+		for i := range val.len() {
+			buf = appendStringEnc(buf, val.get(i))
+		}
+		return buf, nil
+
+	case *setValue:
+		val.mutex.RLock()
+		defer val.mutex.RUnlock()
+		if val.lp != nil {
+			buf = append(buf, setListpackEnc)
+			return appendStringEnc(buf, string(val.lp)), nil
+		}
+		buf = append(buf, setEnc)
+		buf = appendLengthEnc(buf, uint64(len(val.order)))
+		for _, member := range val.order {
+			buf = appendStringEnc(buf, member)
+		}
+		return buf, nil
+
+	case *streams.Stream:
+		snapshot := val.Snapshot()
+		return appendStream(buf, &snapshot)
+	case *streams.Snapshot: // see cloneForSnapshot
+		return appendStream(buf, val)
+	}
+	return nil, fmt.Errorf("serializing values of type %T is not supported", value)
+}
+
+// Flags of a stream entry in a listpack
+const (
+	streamItemDeleted    = 1 // deleted by XDEL; we never write those
+	streamItemSameFields = 2 // has the same fields as the master entry, so only its values are stored
+)
+
+// The most entries Redis puts in the listpack of a single node of a stream, by default.
+const streamNodeMaxEntries = 100
+
+// Append a stream the way Redis 7.2 writes it: its entries in listpacks of up to
+// streamNodeMaxEntries, each keyed by the ID of its first entry, followed by its
+// metadata. We don't keep track of deleted entries or how many were ever added, so the
+// max deleted ID is left zero and the length stands in for the entries added.
+func appendStream(buf []byte, stream *streams.Snapshot) ([]byte, error) {
+	var nodes []byte
+	nodeCount := 0
+	node := make([]streams.Entry, 0, streamNodeMaxEntries)
+	appendNode := func() {
+		master := node[0].Key
+		masterNames := node[0].Val.(StreamFields).fieldNames()
+
+		// The master entry: entry count, deleted entry count & the master fields
+		elems := []string{strconv.Itoa(len(node)), "0", strconv.Itoa(len(masterNames))}
+		elems = append(elems, masterNames...)
+		elems = append(elems, "0")
+
+		// Then every entry, with its ID relative to the master entry's, ending with the
+		// number of elements before it, to walk the listpack backwards
+		for _, entry := range node {
+			fields := entry.Val.(StreamFields)
+			msDiff := strconv.FormatInt(int64(entry.Key.LeftNr-master.LeftNr), 10)
+			seqDiff := strconv.FormatInt(int64(entry.Key.RightNr-master.RightNr), 10)
+			if slices.Equal(fields.fieldNames(), masterNames) {
+				elems = append(elems, strconv.Itoa(streamItemSameFields), msDiff, seqDiff)
+				elems = append(elems, fields.values...)
+				elems = append(elems, strconv.Itoa(3+fields.Len()))
+			} else {
+				elems = append(elems, "0", msDiff, seqDiff, strconv.Itoa(fields.Len()))
+				elems = append(elems, fields.pairs()...)
+				elems = append(elems, strconv.Itoa(4+2*fields.Len()))
+			}
+		}
+
+		var masterID [16]byte
+		binary.BigEndian.PutUint64(masterID[:8], master.LeftNr)
+		binary.BigEndian.PutUint64(masterID[8:], master.RightNr)
+		nodes = appendStringEnc(nodes, string(masterID[:]))
+		nodes = appendStringEnc(nodes, string(listpack.New().Append(elems...)))
+		nodeCount++
+		node = node[:0]
+	}
+	for entry := range stream.Entries(streams.MinKey, streams.MaxKey, false) {
+		if _, ok := entry.Val.(StreamFields); !ok {
+			return nil, fmt.Errorf("stream entry %s has a value of type %T", entry.Key, entry.Val)
+		}
+		node = append(node, entry)
+		if len(node) == streamNodeMaxEntries {
+			appendNode()
+		}
+	}
+	if len(node) > 0 {
+		appendNode()
+	}
+
+	buf = append(buf, streamListpacks3Enc)
+	buf = appendLengthEnc(buf, uint64(nodeCount))
+	buf = append(buf, nodes...)
+	buf = appendLengthEnc(buf, uint64(stream.Len()))
+	for _, id := range []streams.Key{stream.LastEntry.Key, stream.FirstEntry.Key, streams.MinKey} {
+		buf = appendLengthEnc(buf, id.LeftNr)
+		buf = appendLengthEnc(buf, id.RightNr)
+	}
+	buf = appendLengthEnc(buf, uint64(stream.Len())) // entries added
+	return appendLengthEnc(buf, 0), nil              // consumer groups
+}
+
+// Container types of the nodes of a quicklist
+const (
+	quicklistNodePlain  = 1 // a single element, too large for a listpack
+	quicklistNodePacked = 2 // a listpack
+)
+
+// Read a value of the given type, as written by appendValue. Collections get the
+// encoding that suits them under limits, regardless of how they were encoded in the file.
+func readValue(r *rdbReader, valueType byte, limits EncodingLimits) (any, error) {
+	readLength := func() (int, error) {
+		length, specialfmt, err := readLengthEnc(r)
+		if err == nil && specialfmt {
+			err = r.errorf("unexpected special format where a length was expected")
+		}
+		return length, err
+	}
+	readStrings := func(n int) ([]string, error) {
+		strs := make([]string, 0, min(n, 1024)) // don't trust n with a huge allocation
+		for range n {
+			str, err := readStringEnc(r)
+			if err != nil {
+				return nil, err
+			}
+			strs = append(strs, str)
+		}
+		return strs, nil
+	}
+	readListpack := func() ([]string, error) {
+		str, err := readStringEnc(r)
+		if err != nil {
+			return nil, err
+		}
+		lp, err := listpack.FromBytes([]byte(str))
+		if err != nil {
+			return nil, r.wrap(err)
+		}
+		return lp.Elements(), nil
+	}
+
+	switch valueType {
+	case stringEnc:
+		str, err := readStringEnc(r)
+		if err != nil {
+			return nil, err
+		}
+		return newStringValue(str), nil
+
+	case listEnc, setEnc, hashEnc:
+		n, err := readLength()
+		if err != nil {
+			return nil, err
+		}
+		if valueType == hashEnc {
+			n *= 2
+		}
+		strs, err := readStrings(n)
+		if err != nil {
+			return nil, err
+		}
+		switch valueType {
+		case listEnc:
+			return newListFrom(strs, limits.List), nil
+		case setEnc:
+			return newSetFrom(strs, limits.Set), nil
+		}
+		return newHashFrom(strs, limits.Hash), nil
+
+	case hashListpackEnc:
+		elems, err := readListpack()
+		if err != nil {
+			return nil, err
+		}
+		if len(elems)%2 != 0 {
+			return nil, r.errorf("hash listpack with an odd number of elements")
 		}
+		return newHashFrom(elems, limits.Hash), nil
 
-		length := binary.LittleEndian.Uint32(lenbuf)
-		return int(length), false, nil
+	case setListpackEnc:
+		elems, err := readListpack()
+		if err != nil {
+			return nil, err
+		}
+		return newSetFrom(elems, limits.Set), nil
+
+	case listInQuicklist2Enc:
+		nodes, err := readLength()
+		if err != nil {
+			return nil, err
+		}
+		var elems []string
+		for range nodes {
+			container, err := readLength()
+			if err != nil {
+				return nil, err
+			}
+			switch container {
+			case quicklistNodePlain:
+				elem, err := readStringEnc(r)
+				if err != nil {
+					return nil, err
+				}
+				elems = append(elems, elem)
+			case quicklistNodePacked:
+				nodeElems, err := readListpack()
+				if err != nil {
+					return nil, err
+				}
+				elems = append(elems, nodeElems...)
+			default:
+				return nil, r.errorf("unknown quicklist container type %d", container)
+			}
+		}
+		return newListFrom(elems, limits.List), nil
+
+	case streamListpacksEnc, streamListpacks2Enc, streamListpacks3Enc:
+		return readStream(r, valueType)
+	}
+	return nil, r.errorf("value type encoding %d not yet implemented", valueType)
+}
 
-	case 3: // special format
-		return int(firstByte & 63), true, nil
+// Read a stream, as written by appendStream or by Redis. Entries flagged as deleted are
+// left out, and so are consumer groups, which we don't support.
+func readStream(r *rdbReader, valueType byte) (*streams.Stream, error) {
+	readLength := func() (int, error) {
+		length, specialfmt, err := readLengthEnc(r)
+		if err == nil && specialfmt {
+			err = r.errorf("unexpected special format where a length was expected")
+		}
+		return length, err
+	}
+	readID := func() (streams.Key, error) {
+		var halves [2]uint64
+		for i := range halves {
+			half, specialfmt, err := readLengthEnc64(r)
+			if err == nil && specialfmt {
+				err = r.errorf("unexpected special format where a stream ID was expected")
+			}
+			if err != nil {
+				return streams.Key{}, err
+			}
+			halves[i] = half
+		}
+		return streams.Key{LeftNr: halves[0], RightNr: halves[1]}, nil
 	}
 
-	return 0, false, errors.New("invalid string encoding found")
+	stream := streams.NewStream()
+	nodes, err := readLength()
+	if err != nil {
+		return nil, err
+	}
+	var prev any
+	for range nodes {
+		masterID, err := readStringEnc(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(masterID) != 16 {
+			return nil, r.errorf("stream node ID of %d bytes, want 16", len(masterID))
+		}
+		master := streams.Key{
+			LeftNr:  binary.BigEndian.Uint64([]byte(masterID[:8])),
+			RightNr: binary.BigEndian.Uint64([]byte(masterID[8:])),
+		}
+		str, err := readStringEnc(r)
+		if err != nil {
+			return nil, err
+		}
+		lp, err := listpack.FromBytes([]byte(str))
+		if err != nil {
+			return nil, r.wrap(err)
+		}
+		entries, err := parseStreamNode(master, lp.Elements())
+		if err != nil {
+			return nil, r.errorf("stream node %s: %v", master, err)
+		}
+		for _, entry := range entries {
+			fields := entry.Val.(StreamFields).sharingNames(prev)
+			if err := stream.Put(entry.Key, fields); err != nil {
+				return nil, r.errorf("stream entry %s: %v", entry.Key, err)
+			}
+			prev = fields
+		}
+	}
+
+	length, err := readLength()
+	if err != nil {
+		return nil, err
+	}
+	if length != stream.Len() {
+		return nil, r.errorf("stream of length %d has %d entries", length, stream.Len())
+	}
+	lastID, err := readID()
+	if err != nil {
+		return nil, err
+	}
+	if err := stream.SetLastID(lastID); err != nil {
+		return nil, r.errorf("stream last ID %s: %v", lastID, err)
+	}
+	if valueType != streamListpacksEnc {
+		// First ID & max deleted ID, then the entries added
+		for range 2 {
+			if _, err := readID(); err != nil {
+				return nil, err
+			}
+		}
+		if _, err := readLength(); err != nil {
+			return nil, err
+		}
+	}
+	if err := skipStreamGroups(r, valueType); err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+// Parse the elements of a listpack holding entries of a stream, whose master entry has
+// the ID master, as laid out by appendStream. The Val of each entry is a StreamFields.
+func parseStreamNode(master streams.Key, elems []string) ([]streams.Entry, error) {
+	pos := 0
+	next := func(n int) ([]string, error) {
+		if n < 0 || n > len(elems)-pos {
+			return nil, errors.New("listpack ends in the middle of an entry")
+		}
+		pos += n
+		return elems[pos-n : pos], nil
+	}
+	nextInt := func() (int64, error) {
+		elem, err := next(1)
+		if err != nil {
+			return 0, err
+		}
+		n, err := strconv.ParseInt(elem[0], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("%q where an integer was expected", elem[0])
+		}
+		return n, nil
+	}
+
+	// The master entry: entry count, deleted entry count & the master fields
+	if _, err := next(2); err != nil {
+		return nil, err
+	}
+	numNames, err := nextInt()
+	if err != nil {
+		return nil, err
+	}
+	masterNames, err := next(int(numNames))
+	if err != nil {
+		return nil, err
+	}
+	if terminator, err := nextInt(); err != nil || terminator != 0 {
+		return nil, errors.New("master entry not terminated")
+	}
+
+	var entries []streams.Entry
+	for pos < len(elems) {
+		var header [3]int64 // flags, ms & seq relative to the master entry
+		for i := range header {
+			if header[i], err = nextInt(); err != nil {
+				return nil, err
+			}
+		}
+		var fields StreamFields
+		if header[0]&streamItemSameFields != 0 {
+			values, err := next(len(masterNames))
+			if err != nil {
+				return nil, err
+			}
+			fields = StreamFields{&masterNames, values}
+		} else {
+			numFields, err := nextInt()
+			if err != nil {
+				return nil, err
+			}
+			if numFields < 0 || numFields > int64(len(elems)) {
+				return nil, fmt.Errorf("entry with %d fields", numFields)
+			}
+			pairs, err := next(2 * int(numFields))
+			if err != nil {
+				return nil, err
+			}
+			fields = newStreamFields(pairs)
+		}
+		if _, err := nextInt(); err != nil { // the number of elements of the entry
+			return nil, err
+		}
+		if header[0]&streamItemDeleted != 0 {
+			continue
+		}
+		key := streams.Key{
+			LeftNr:  master.LeftNr + uint64(header[1]),
+			RightNr: master.RightNr + uint64(header[2]),
+		}
+		entries = append(entries, streams.Entry{Key: key, Val: fields})
+	}
+	return entries, nil
 }
@@ -2,11 +2,26 @@ package diyredis
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
+	"log/slog"
+	"math"
 	"os"
+	"slices"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
+
+	crc64 "github.com/codecrafters-io/redis-starter-go/app/diyredis/crc64"
 )
 
+// For code under test that logs, without cluttering the test output.
+var discardLog = slog.New(slog.DiscardHandler)
+
 func BenchmarkReadEntireFile(b *testing.B) {
 	for range b.N {
 		f, _ := os.ReadFile("/home/flo/dev/build-your-own-x/diy-redis/dump.rdb")
@@ -102,3 +117,486 @@ func BenchmarkBufioReader(b *testing.B) {
 		f.Close()
 	}
 }
+
+// dump.rdb at the root of the repo, as written by Redis 7.2.5
+const testRdbFile = "../../dump.rdb"
+
+func loadTestRdb(t *testing.T, data []byte) (*Server, error) {
+	t.Helper()
+	server := MakeServer()
+	err := server.loadRdb(newRdbReader(bytes.NewReader(data)), server.dbs)
+	return server, err
+}
+
+func TestLoadRdb(t *testing.T) {
+	data, err := os.ReadFile(testRdbFile)
+	if err != nil {
+		t.Fatalf("could not read test rdb file: %v", err)
+	}
+
+	server, err := loadTestRdb(t, data)
+	if err != nil {
+		t.Fatalf("got error while loading rdb file: %v", err)
+	}
+
+	val, ok := server.dbs[0].engine.Get("mykey")
+	if !ok || val != "myval" {
+		t.Errorf("got %v, want %v", val, "myval")
+	}
+	strVal, ok := loadString(server.dbs[0], "myekey")
+	if !ok || strVal != "12" {
+		t.Errorf("got %v, want %v (integer encoded value)", strVal, "12")
+	}
+}
+
+func TestLoadRdbTruncated(t *testing.T) {
+	data, err := os.ReadFile(testRdbFile)
+	if err != nil {
+		t.Fatalf("could not read test rdb file: %v", err)
+	}
+
+	// Cut the file off in the middle of the last key value pair ("mykey" -> "myval")
+	cutoff := bytes.LastIndex(data, []byte("myval")) + 2
+	server, err := loadTestRdb(t, data[:cutoff])
+
+	var rdbErr *RdbError
+	if !errors.As(err, &rdbErr) {
+		t.Fatalf("got %v, want an *RdbError", err)
+	}
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("got %v, want io.ErrUnexpectedEOF", err)
+	}
+	if rdbErr.Offset != int64(cutoff) {
+		t.Errorf("got error at offset %d, want %d", rdbErr.Offset, cutoff)
+	}
+
+	// Everything before the corruption is loaded, the half-read pair is not
+	if _, ok := server.dbs[0].engine.Get("myekey"); !ok {
+		t.Errorf("key before the truncation was not loaded")
+	}
+	if _, ok := server.dbs[0].engine.Get("mykey"); ok {
+		t.Errorf("truncated key was loaded")
+	}
+}
+
+func TestLoadRdbPolicy(t *testing.T) {
+	data, err := os.ReadFile(testRdbFile)
+	if err != nil {
+		t.Fatalf("could not read test rdb file: %v", err)
+	}
+	dir := t.TempDir()
+	err = os.WriteFile(dir+"/dump.rdb", data[:len(data)-20], 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := MakeServer()
+	server.RdbDir, server.RdbFilename = dir, "dump.rdb"
+	if err := server.LoadRdb(); err == nil {
+		t.Errorf("strict policy did not return an error for a truncated file")
+	}
+
+	server = MakeServer()
+	server.RdbDir, server.RdbFilename = dir, "dump.rdb"
+	server.RdbLoadPolicy = RdbLoadPartial
+	if err := server.LoadRdb(); err != nil {
+		t.Errorf("partial policy returned an error: %v", err)
+	}
+	if _, ok := server.dbs[0].engine.Get("myekey"); !ok {
+		t.Errorf("partial policy did not load the keys before the truncation")
+	}
+}
+
+func TestReadLengthEnc(t *testing.T) {
+	cases := []struct {
+		input      []byte
+		length     int
+		specialfmt bool
+	}{
+		{[]byte{0x0a}, 10, false},
+		{[]byte{0x42, 0xbc}, 700, false},
+		{[]byte{0x80, 0x00, 0x00, 0x42, 0x68}, 17000, false},
+		{[]byte{0x81, 0, 0, 0, 0, 0, 0x01, 0x00, 0x00}, 65536, false},
+		{[]byte{0xc3}, redisCompressedStr, true},
+	}
+
+	for _, c := range cases {
+		r := newRdbReader(bytes.NewReader(c.input))
+		length, specialfmt, err := readLengthEnc(r)
+		if err != nil {
+			t.Errorf("got error for input %x: %v", c.input, err)
+			continue
+		}
+		if length != c.length || specialfmt != c.specialfmt {
+			t.Errorf("got (%d, %v), want (%d, %v) for input %x",
+				length, specialfmt, c.length, c.specialfmt, c.input)
+		}
+	}
+
+	// Short reads must not go unnoticed
+	r := newRdbReader(bytes.NewReader([]byte{0x80, 0x00, 0x01}))
+	if _, _, err := readLengthEnc(r); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("got %v, want io.ErrUnexpectedEOF", err)
+	}
+}
+
+// Build a minimal RDB file holding a single string key value pair. The checksum is left
+// zeroed out.
+func makeTestRdb(version string, key string, val string) []byte {
+	data := []byte("REDIS" + version)
+	data = append(data, opCodeSelectDB, 0, stringEnc)
+	data = append(data, byte(len(key)))
+	data = append(data, key...)
+	data = append(data, 0x80, byte(len(val)>>24), byte(len(val)>>16), byte(len(val)>>8), byte(len(val)))
+	data = append(data, val...)
+	data = append(data, opCodeEOF)
+	return append(data, make([]byte, 8)...)
+}
+
+func TestLoadRdbDatabaseCount(t *testing.T) {
+	data := []byte("REDIS0012")
+	data = append(data, opCodeSelectDB, 15, stringEnc, 1, 'k', 1, 'v')
+	data = append(data, opCodeEOF)
+	server, err := loadTestRdb(t, data)
+	if err != nil {
+		t.Fatalf("got error while loading rdb file: %v", err)
+	}
+	if _, ok := loadString(server.dbs[15], "k"); !ok {
+		t.Errorf("key wasn't loaded into the last database")
+	}
+
+	// One past the last database
+	data[10] = 16
+	if _, err := loadTestRdb(t, data); err == nil || !strings.Contains(err.Error(), "only 16 databases") {
+		t.Errorf("got %v, want an error about the database count", err)
+	}
+}
+
+func FuzzReadLengthEnc(f *testing.F) {
+	for _, seed := range [][]byte{
+		{0x0a}, {0x4a, 0xbc}, {0x80, 0, 0, 0x10, 0}, {0x81, 0xff, 0, 0, 0, 0, 0, 0, 0}, {0xc0}, {0x82}, {0x80, 1},
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		n, _, err := readLengthEnc(newRdbReader(bytes.NewReader(data)))
+		if err == nil && n < 0 {
+			t.Errorf("%x: got negative length %d", data, n)
+		}
+	})
+}
+
+// Loading a corrupt RDB file must fail with an error rather than panic, or allocate
+// more than the file could possibly hold.
+func FuzzLoadRdb(f *testing.F) {
+	if data, err := os.ReadFile(testRdbFile); err == nil {
+		f.Add(data)
+	}
+	f.Add(makeTestRdb("0011", "key", "val"))
+	f.Add([]byte("REDIS0012\xfe\x01\xfb\x03\x01\x00\x03key\x03val\xff"))
+	f.Add([]byte("REDIS0012\x0e\x01l\x01\x0f\x0f\x00\x00\x00\x0b\x00\x00\x00\x01\x00\x01a\x02\xff\xff"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		server := MakeServer()
+		server.loadRdb(newRdbReader(bytes.NewReader(data)), server.dbs)
+	})
+}
+
+func writeTestFile(t *testing.T, data []byte) string {
+	t.Helper()
+	fn := t.TempDir() + "/dump.rdb"
+	if err := os.WriteFile(fn, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return fn
+}
+
+func withChecksum(data []byte) []byte {
+	data = data[:len(data)-8]
+	return binary.LittleEndian.AppendUint64(data, crc64.Digest(data))
+}
+
+func TestRdbChecksum(t *testing.T) {
+	if err := rdbPreFlight(testRdbFile, true, discardLog); err != nil {
+		t.Errorf("got error for valid rdb file: %v", err)
+	}
+
+	// Larger than any single read buffer, to make sure the whole file is hashed
+	data := withChecksum(makeTestRdb("0011", "key", strings.Repeat("abc", 10000)))
+	if err := rdbPreFlight(writeTestFile(t, data), true, discardLog); err != nil {
+		t.Errorf("got error for valid large rdb file: %v", err)
+	}
+
+	corrupted := bytes.Clone(data)
+	corrupted[20] ^= 0xff
+	if err := rdbPreFlight(writeTestFile(t, corrupted), true, discardLog); !errors.Is(err, errRdbChecksum) {
+		t.Errorf("got %v, want %v", err, errRdbChecksum)
+	}
+	if err := rdbPreFlight(writeTestFile(t, corrupted), false, discardLog); err != nil {
+		t.Errorf("got error with checksum validation turned off: %v", err)
+	}
+
+	// A zero checksum means it was never computed
+	noChecksum := makeTestRdb("0011", "key", "val")
+	if err := rdbPreFlight(writeTestFile(t, noChecksum), true, discardLog); err != nil {
+		t.Errorf("got error for rdb file without checksum: %v", err)
+	}
+
+	// Versions before 5 have no checksum; the last 8 bytes are just data
+	old := makeTestRdb("0004", "key", "val")
+	old = old[:len(old)-8]
+	if err := rdbPreFlight(writeTestFile(t, old), true, discardLog); err != nil {
+		t.Errorf("got error for rdb file predating checksums: %v", err)
+	}
+}
+
+func TestLoadRdbModernOpcodes(t *testing.T) {
+	data := []byte("REDIS0012")
+	data = append(data, opCodeAux, 3, 'l', 'u', 'a', 1, 'x')
+	data = append(data, opCodeFunction, 4, 'c', 'o', 'd', 'e')
+	data = append(data, opCodeModuleAux, 0x05, 2, 2, byte(moduleOpCodeUInt), 7, byte(moduleOpCodeEOF))
+	data = append(data, opCodeSelectDB, 1, opCodeResizeDB, 3, 1)
+	data = append(data, opCodeSlotInfo, 0x42, 0x00, 3, 1)
+
+	// A sorted set, which is not supported; it should just be skipped
+	data = append(data, sortedSet2Enc, 4, 'z', 's', 'e', 't', 1, 1, 'a')
+	data = binary.LittleEndian.AppendUint64(data, math.Float64bits(1.5))
+
+	// Expiry, followed by LRU/LFU info, followed by the key value pair it belongs to
+	expiry := time.Now().Add(time.Hour).UnixMilli()
+	data = append(data, opCodeExpireTimeMs)
+	data = binary.LittleEndian.AppendUint64(data, uint64(expiry))
+	data = append(data, opCodeFreq, 5, opCodeIdle, 10)
+	data = append(data, stringEnc, 3, 'k', 'e', 'y', 3, 'v', 'a', 'l')
+
+	data = append(data, stringEnc, 2, 'n', 'x', 0xc0, 0xff) // no expiry, int8 value
+	data = append(data, opCodeEOF)
+
+	server, err := loadTestRdb(t, data)
+	if err != nil {
+		t.Fatalf("got error while loading rdb file: %v", err)
+	}
+
+	db := server.dbs[1]
+	if _, ok := db.engine.Get("zset"); ok {
+		t.Errorf("unsupported value type was loaded")
+	}
+	if val, ok := db.engine.Get("key"); !ok || val != "val" {
+		t.Errorf("got %v, want %v", val, "val")
+	}
+	if got, ok := db.engine.Expiry("key"); !ok || got != expiry {
+		t.Errorf("got expiry %v, want %v", got, expiry)
+	}
+	if val, ok := loadString(db, "nx"); !ok || val != "-1" {
+		t.Errorf("got %v, want %v", val, "-1")
+	}
+	if _, ok := db.engine.Expiry("nx"); ok {
+		t.Errorf("expiry leaked to the next key")
+	}
+}
+
+// Return the RDB file that server would save right now.
+func writeTestRdb(t *testing.T, server *Server) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	server.startSnapshot(nil)
+	defer server.endSnapshot()
+	if err := server.writeRdb(&buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestWriteRdb(t *testing.T) {
+	server := MakeServer()
+	expiry := time.Now().Add(time.Hour).UnixMilli()
+	server.dbs[0].engine.Set("foo", "bar")
+	server.dbs[0].engine.Set("num", "12345")
+	server.dbs[0].engine.Expire("num", expiry)
+	server.dbs[3].engine.Set("other", "db")
+	server.dbs[3].engine.Set("expired", "gone")
+	server.dbs[3].engine.Expire("expired", time.Now().Add(-time.Second).UnixMilli())
+
+	data := writeTestRdb(t, server)
+	if err := rdbPreFlight(writeTestFile(t, data), true, discardLog); err != nil {
+		t.Fatalf("written RDB file fails preflight: %v", err)
+	}
+
+	loaded, err := loadTestRdb(t, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []struct {
+		db    int
+		key   string
+		value string
+	}{{0, "foo", "bar"}, {0, "num", "12345"}, {3, "other", "db"}} {
+		value, ok := loadString(loaded.dbs[want.db], want.key)
+		if !ok || value != want.value {
+			t.Errorf("db %d: got (%v, %v) for %q, want %q", want.db, value, ok, want.key, want.value)
+		}
+	}
+	if got, ok := loaded.dbs[0].engine.Expiry("num"); !ok || got != expiry {
+		t.Errorf("got expiry %v, want %v", got, expiry)
+	}
+	if _, ok := loaded.dbs[3].engine.Get("expired"); ok {
+		t.Errorf("expired key was saved")
+	}
+}
+
+func TestWriteRdbCollections(t *testing.T) {
+	server := MakeServer()
+	session, _ := newTestSession(server)
+	var many []string
+	for i := range 200 {
+		many = append(many, strconv.Itoa(i))
+	}
+	session.dispatch([]string{"HSET", "small-hash", "a", "1", "b", "2"})
+	session.dispatch(append([]string{"HSET", "big-hash"}, many...))
+	session.dispatch([]string{"RPUSH", "small-list", "a", "b", "3"})
+	session.dispatch(append([]string{"RPUSH", "big-list"}, many...))
+	session.dispatch([]string{"SADD", "small-set", "a", "b"})
+	session.dispatch(append([]string{"SADD", "big-set"}, many...))
+
+	loaded, err := loadTestRdb(t, writeTestRdb(t, server))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"small-hash", "big-hash", "small-list", "big-list", "small-set", "big-set"} {
+		want, _ := server.dbs[0].engine.Get(key)
+		got, ok := loaded.dbs[0].engine.Get(key)
+		if !ok {
+			t.Errorf("%q was not loaded", key)
+			continue
+		}
+		if objectEncoding(got) != objectEncoding(want) {
+			t.Errorf("%q: got encoding %s, want %s", key, objectEncoding(got), objectEncoding(want))
+		}
+		wantDump, _ := dumpValue(want)
+		gotDump, _ := dumpValue(got)
+		if strings.HasPrefix(key, "small") && !bytes.Equal(gotDump, wantDump) {
+			t.Errorf("%q: got %v, want %v", key, gotDump, wantDump)
+		}
+	}
+
+	list, _ := loaded.dbs[0].engine.Get("big-list")
+	if elems := list.(*listValue).slice(0, 199); !slices.Equal(elems, many) {
+		t.Errorf("got %v, want %v", elems, many)
+	}
+	hash, _ := loaded.dbs[0].engine.Get("big-hash")
+	if value, _ := hash.(*hashValue).get("198"); value != "199" {
+		t.Errorf("got %q, want %q", value, "199")
+	}
+}
+
+func TestWriteRdbStreams(t *testing.T) {
+	server := MakeServer()
+	session, conn := newTestSession(server)
+	run := func(session *Session, conn *recordingConn, cmd ...string) string {
+		conn.buf.Reset()
+		session.dispatch(cmd)
+		return conn.buf.String()
+	}
+
+	// Enough entries for several listpacks, most of them with the same fields
+	for i := range 250 {
+		fields := []string{"a", strconv.Itoa(i), "b", "x"}
+		if i%7 == 0 {
+			fields = []string{"other", strconv.Itoa(-i)}
+		}
+		id := fmt.Sprintf("%d-%d", 1000+i/3, i%3)
+		run(session, conn, append([]string{"XADD", "big", "MAXLEN", "240", id}, fields...)...)
+	}
+	run(session, conn, "XADD", "trimmed", "5-1", "f", "v")
+	run(session, conn, "XADD", "trimmed", "MAXLEN", "0", "6-1", "f", "v")
+	run(session, conn, "XSETID", "trimmed", "9-9")
+	run(session, conn, "XADD", "huge-ids", "18446744073709551614-5", "f", "v")
+	run(session, conn, "XADD", "huge-ids", "18446744073709551615-0", "f", "v")
+
+	keys := []string{"big", "trimmed", "huge-ids"}
+	want := map[string]string{}
+	for _, key := range keys {
+		want[key] = run(session, conn, "XRANGE", key, "-", "+") + run(session, conn, "XINFO", "STREAM", key)
+	}
+
+	// Entries added once the snapshot started aren't part of it
+	var buf bytes.Buffer
+	server.startSnapshot(nil)
+	run(session, conn, "XADD", "big", "MAXLEN", "240", "*", "after", "snapshot")
+	if err := server.writeRdb(&buf); err != nil {
+		t.Fatal(err)
+	}
+	server.endSnapshot()
+	if err := rdbPreFlight(writeTestFile(t, buf.Bytes()), true, discardLog); err != nil {
+		t.Fatalf("written RDB file fails preflight: %v", err)
+	}
+
+	loaded, err := loadTestRdb(t, buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	loadedSession, loadedConn := newTestSession(loaded)
+	for _, key := range keys {
+		got := run(loadedSession, loadedConn, "XRANGE", key, "-", "+") + run(loadedSession, loadedConn, "XINFO", "STREAM", key)
+		if got != want[key] {
+			t.Errorf("%q: got %q, want %q", key, got, want[key])
+		}
+	}
+}
+
+func TestCheckRdb(t *testing.T) {
+	server := MakeServer()
+	clock := newFakeClock(time.Unix(1700000000, 0))
+	server.Clock = clock
+	session, _ := newTestSession(server)
+	for _, cmd := range [][]string{
+		{"SET", "foo", "bar"},
+		{"SET", "short", "v", "PX", "100"},
+		{"SET", "long", "v", "EX", "100"},
+		{"HSET", "hash", "f", "v"},
+		{"SELECT", "2"},
+		{"RPUSH", "list", "a", "b"},
+	} {
+		session.dispatch(cmd)
+	}
+	data := writeTestRdb(t, server)
+	clock.Advance(time.Second)
+
+	var out strings.Builder
+	if err := server.CheckRdb(writeTestFile(t, data), &out); err != nil {
+		t.Fatalf("%v: %s", err, out.String())
+	}
+	for _, want := range []string{
+		"Checksum: OK\n",
+		"db0: 4 keys, 2 with an expiry, 1 already expired (hash 1, string 3)\n",
+		"db2: 1 keys, 0 with an expiry, 0 already expired (list 1)\n",
+		fmt.Sprintf("OK, %d bytes\n", len(data)),
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("got %q, want it to contain %q", out.String(), want)
+		}
+	}
+
+	// The checksum still matches, but a length doesn't
+	truncated := withChecksum(slices.Concat(data[:len(data)-12], data[len(data)-9:]))
+	out.Reset()
+	var rdbErr *RdbError
+	if err := server.CheckRdb(writeTestFile(t, truncated), &out); !errors.As(err, &rdbErr) {
+		t.Fatalf("got %v, want an RdbError", err)
+	}
+	if want := fmt.Sprintf("Corrupt: rdb: at offset %d", rdbErr.Offset); !strings.Contains(out.String(), "Checksum: OK\n") || !strings.Contains(out.String(), want) {
+		t.Errorf("got %q, want it to contain %q", out.String(), want)
+	}
+
+	corrupted := bytes.Clone(data)
+	corrupted[len(corrupted)-10] ^= 0xff
+	out.Reset()
+	if err := server.CheckRdb(writeTestFile(t, corrupted), &out); err == nil || !strings.Contains(out.String(), "Checksum: incorrect\n") {
+		t.Errorf("got %v, %q, want the checksum to be incorrect", err, out.String())
+	}
+
+	trailing := withChecksum(slices.Concat(data[:len(data)-8], []byte("garbage"), make([]byte, 8)))
+	out.Reset()
+	if err := server.CheckRdb(writeTestFile(t, trailing), &out); err == nil || !strings.Contains(out.String(), "15 bytes after the EOF opcode, want 8") {
+		t.Errorf("got %v, %q, want trailing bytes to be reported", err, out.String())
+	}
+}
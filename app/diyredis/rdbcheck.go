@@ -0,0 +1,111 @@
+package diyredis
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// What an RDB file holds in one of its databases.
+type rdbCheckDB struct {
+	keys    int
+	expires int            // keys with an expiry
+	expired int            // keys with an expiry in the past, which loading drops
+	types   map[string]int // number of keys of each type
+}
+
+// Check the RDB file filename thoroughly, without loading it, like redis-check-rdb: its
+// checksum, and that every key value pair in it is encoded the way it should be, from
+// their lengths to the listpacks within. A summary of every database in it is written to
+// w, followed by the offset of the first corruption found, if any, which is then returned
+// as an error too.
+func (s *Server) CheckRdb(filename string, w io.Writer) error {
+	fmt.Fprintf(w, "Checking RDB file %s\n", filename)
+	err := rdbPreFlight(filename, true, s.Log)
+	switch {
+	case errors.Is(err, errRdbChecksum):
+		fmt.Fprintln(w, "Checksum: incorrect")
+	case err != nil:
+		return err
+	default:
+		fmt.Fprintln(w, "Checksum: OK")
+	}
+	checksumErr := err
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	now := s.now().UnixMilli()
+	dbs := map[int]*rdbCheckDB{}
+	r := newRdbReader(file)
+	version, err := s.readRdb(r, s.dbCount(), func(db int, key string, valueType byte, value any, expiry int64) {
+		stats := dbs[db]
+		if stats == nil {
+			stats = &rdbCheckDB{types: map[string]int{}}
+			dbs[db] = stats
+		}
+		stats.keys++
+		if expiry != 0 {
+			stats.expires++
+			if expiry <= now {
+				stats.expired++
+			}
+		}
+		if value == nil {
+			stats.types["unsupported type "+strconv.Itoa(int(valueType))]++
+		} else {
+			stats.types[typeName(value)]++
+		}
+	})
+	if err == nil {
+		err = checkRdbEnd(r, version)
+	}
+
+	if version > 0 {
+		fmt.Fprintf(w, "Version: %d\n", version)
+	}
+	for _, db := range slices.Sorted(maps.Keys(dbs)) {
+		stats := dbs[db]
+		types := make([]string, 0, len(stats.types))
+		for _, name := range slices.Sorted(maps.Keys(stats.types)) {
+			types = append(types, name+" "+strconv.Itoa(stats.types[name]))
+		}
+		fmt.Fprintf(w, "db%d: %d keys, %d with an expiry, %d already expired (%s)\n",
+			db, stats.keys, stats.expires, stats.expired, strings.Join(types, ", "))
+	}
+	if err != nil {
+		fmt.Fprintf(w, "Corrupt: %v\n", err)
+		return err
+	}
+	if checksumErr != nil {
+		return checksumErr
+	}
+	fmt.Fprintf(w, "OK, %d bytes\n", r.offset)
+	return nil
+}
+
+// Check that after the EOF opcode, the file only has its checksum left, which versions
+// before 5 don't have.
+func checkRdbEnd(r *rdbReader, version int) error {
+	end := r.offset
+	rest, err := io.ReadAll(r)
+	if err != nil {
+		return r.wrap(err)
+	}
+	want := 0
+	if version >= 5 {
+		want = 8
+	}
+	if len(rest) != want {
+		return &RdbError{Offset: end, Err: fmt.Errorf("%d bytes after the EOF opcode, want %d", len(rest), want)}
+	}
+	return nil
+}
@@ -0,0 +1,262 @@
+package diyredis
+
+import (
+	"errors"
+	"strings"
+)
+
+// Static information about a command, used by the dispatcher.
+//
+// Key positions follow the same convention as Redis' COMMAND INFO: `firstKey` is the
+// index of the first key in the command (0 means the command has no keys), `lastKey` the
+// index of the last one, where negative values count back from the end, and `keyStep`
+// the distance between two keys.
+type command struct {
+	name     string
+	handler  func(s *Session, cmds []string) *UserError
+	flags    commandFlag
+	firstKey int
+	lastKey  int
+	keyStep  int
+
+	// For commands whose keys can't be described by the positions above. Takes
+	// precedence over them.
+	getKeys func(cmds []string) []string
+
+	// For commands with subcommands: what they are, replied to "<command> HELP". Each
+	// subcommand's usage, followed by indented lines describing it.
+	help []string
+}
+
+type commandFlag uint
+
+const (
+	flagWrite    commandFlag = 1 << iota // may modify the keyspace
+	flagBlocking                         // may block on purpose, e.g. XREAD BLOCK
+	flagNoPause                          // keeps running while clients are paused
+	flagReadonly                         // reads the keyspace, without modifying it
+	flagSentinel                         // available in sentinel mode too
+	flagOwnLock                          // a write taking the write lock itself, see dispatch
+)
+
+var commandTable = map[string]*command{}
+
+func registerCommands(cmds ...*command) {
+	for _, cmd := range cmds {
+		commandTable[cmd.name] = cmd
+	}
+}
+
+func init() {
+	registerCommands(
+		&command{name: "ping", handler: (*Session).doPING, flags: flagSentinel},
+		&command{name: "echo", handler: (*Session).doECHO},
+		&command{name: "quit", handler: (*Session).doQUIT, flags: flagSentinel | flagNoPause},
+		&command{name: "hello", handler: (*Session).doHELLO, flags: flagSentinel},
+		&command{name: "select", handler: (*Session).doSELECT},
+		&command{name: "set", handler: (*Session).doSET, flags: flagWrite, firstKey: 1, lastKey: 1, keyStep: 1},
+		&command{name: "get", handler: (*Session).doGET, flags: flagReadonly, firstKey: 1, lastKey: 1, keyStep: 1},
+		&command{name: "mset", handler: (*Session).doMSET, flags: flagWrite, firstKey: 1, lastKey: -1, keyStep: 2},
+		&command{name: "mget", handler: (*Session).doMGET, flags: flagReadonly, firstKey: 1, lastKey: -1, keyStep: 1},
+		&command{name: "setex", handler: (*Session).doSETEX, flags: flagWrite, firstKey: 1, lastKey: 1, keyStep: 1},
+		&command{name: "psetex", handler: (*Session).doSETEX, flags: flagWrite, firstKey: 1, lastKey: 1, keyStep: 1},
+		&command{name: "getrange", handler: (*Session).doGETRANGE, flags: flagReadonly, firstKey: 1, lastKey: 1, keyStep: 1},
+		&command{name: "substr", handler: (*Session).doGETRANGE, flags: flagReadonly, firstKey: 1, lastKey: 1, keyStep: 1},
+		&command{name: "getset", handler: (*Session).doGETSET, flags: flagWrite, firstKey: 1, lastKey: 1, keyStep: 1},
+		&command{name: "incr", handler: (*Session).doINCR, flags: flagWrite, firstKey: 1, lastKey: 1, keyStep: 1},
+		&command{name: "decr", handler: (*Session).doINCR, flags: flagWrite, firstKey: 1, lastKey: 1, keyStep: 1},
+		&command{name: "incrby", handler: (*Session).doINCR, flags: flagWrite, firstKey: 1, lastKey: 1, keyStep: 1},
+		&command{name: "decrby", handler: (*Session).doINCR, flags: flagWrite, firstKey: 1, lastKey: 1, keyStep: 1},
+		&command{name: "append", handler: (*Session).doAPPEND, flags: flagWrite, firstKey: 1, lastKey: 1, keyStep: 1},
+		&command{name: "bitfield", handler: (*Session).doBITFIELD, flags: flagWrite, firstKey: 1, lastKey: 1, keyStep: 1},
+		&command{name: "config", handler: (*Session).doCONFIG, help: configHelp},
+		&command{name: "keys", handler: (*Session).doKEYS, flags: flagReadonly},
+		&command{name: "type", handler: (*Session).doTYPE, flags: flagReadonly, firstKey: 1, lastKey: 1, keyStep: 1},
+		&command{name: "scan", handler: (*Session).doSCAN, flags: flagReadonly},
+		&command{name: "randomkey", handler: (*Session).doRANDOMKEY, flags: flagReadonly},
+		&command{name: "dbsize", handler: (*Session).doDBSIZE, flags: flagReadonly},
+		&command{name: "del", handler: (*Session).doDEL, flags: flagWrite, firstKey: 1, lastKey: -1, keyStep: 1},
+		&command{name: "unlink", handler: (*Session).doUNLINK, flags: flagWrite, firstKey: 1, lastKey: -1, keyStep: 1},
+		&command{name: "exists", handler: (*Session).doEXISTS, flags: flagReadonly, firstKey: 1, lastKey: -1, keyStep: 1},
+		&command{name: "ttl", handler: (*Session).doTTL, flags: flagReadonly, firstKey: 1, lastKey: 1, keyStep: 1},
+		&command{name: "pttl", handler: (*Session).doPTTL, flags: flagReadonly, firstKey: 1, lastKey: 1, keyStep: 1},
+		&command{name: "expireat", handler: (*Session).doEXPIREAT, flags: flagWrite, firstKey: 1, lastKey: 1, keyStep: 1},
+		&command{name: "pexpireat", handler: (*Session).doEXPIREAT, flags: flagWrite, firstKey: 1, lastKey: 1, keyStep: 1},
+		&command{name: "object", handler: (*Session).doOBJECT, flags: flagReadonly, help: objectHelp, firstKey: 2, lastKey: 2, keyStep: 1},
+		&command{name: "xadd", handler: (*Session).doXADD, flags: flagWrite, firstKey: 1, lastKey: 1, keyStep: 1},
+		&command{name: "xsetid", handler: (*Session).doXSETID, flags: flagWrite, firstKey: 1, lastKey: 1, keyStep: 1},
+		&command{name: "xrange", handler: (*Session).doXRANGE, flags: flagReadonly, firstKey: 1, lastKey: 1, keyStep: 1},
+		&command{name: "xrevrange", handler: (*Session).doXRANGE, flags: flagReadonly, firstKey: 1, lastKey: 1, keyStep: 1},
+		&command{name: "xlen", handler: (*Session).doXLEN, flags: flagReadonly, firstKey: 1, lastKey: 1, keyStep: 1},
+		&command{name: "xinfo", handler: (*Session).doXINFO, flags: flagReadonly, help: xinfoHelp, firstKey: 2, lastKey: 2, keyStep: 1},
+		&command{name: "xread", handler: (*Session).doXREAD, flags: flagReadonly | flagBlocking, getKeys: xreadKeys},
+		&command{name: "hset", handler: (*Session).doHSET, flags: flagWrite, firstKey: 1, lastKey: 1, keyStep: 1},
+		&command{name: "hsetnx", handler: (*Session).doHSETNX, flags: flagWrite, firstKey: 1, lastKey: 1, keyStep: 1},
+		&command{name: "hincrby", handler: (*Session).doHINCRBY, flags: flagWrite, firstKey: 1, lastKey: 1, keyStep: 1},
+		&command{name: "hincrbyfloat", handler: (*Session).doHINCRBYFLOAT, flags: flagWrite, firstKey: 1, lastKey: 1, keyStep: 1},
+		&command{name: "hrandfield", handler: (*Session).doHRANDFIELD, flags: flagReadonly, firstKey: 1, lastKey: 1, keyStep: 1},
+		&command{name: "hget", handler: (*Session).doHGET, flags: flagReadonly, firstKey: 1, lastKey: 1, keyStep: 1},
+		&command{name: "hmget", handler: (*Session).doHMGET, flags: flagReadonly, firstKey: 1, lastKey: 1, keyStep: 1},
+		&command{name: "hdel", handler: (*Session).doHDEL, flags: flagWrite, firstKey: 1, lastKey: 1, keyStep: 1},
+		&command{name: "hlen", handler: (*Session).doHLEN, flags: flagReadonly, firstKey: 1, lastKey: 1, keyStep: 1},
+		&command{name: "hexists", handler: (*Session).doHEXISTS, flags: flagReadonly, firstKey: 1, lastKey: 1, keyStep: 1},
+		&command{name: "hgetall", handler: (*Session).doHGETALL, flags: flagReadonly, firstKey: 1, lastKey: 1, keyStep: 1},
+		&command{name: "hkeys", handler: (*Session).doHGETALL, flags: flagReadonly, firstKey: 1, lastKey: 1, keyStep: 1},
+		&command{name: "hvals", handler: (*Session).doHGETALL, flags: flagReadonly, firstKey: 1, lastKey: 1, keyStep: 1},
+		&command{name: "lpush", handler: (*Session).doPUSH, flags: flagWrite, firstKey: 1, lastKey: 1, keyStep: 1},
+		&command{name: "rpush", handler: (*Session).doPUSH, flags: flagWrite, firstKey: 1, lastKey: 1, keyStep: 1},
+		&command{name: "lpop", handler: (*Session).doPOP, flags: flagWrite, firstKey: 1, lastKey: 1, keyStep: 1},
+		&command{name: "rpop", handler: (*Session).doPOP, flags: flagWrite, firstKey: 1, lastKey: 1, keyStep: 1},
+		&command{name: "llen", handler: (*Session).doLLEN, flags: flagReadonly, firstKey: 1, lastKey: 1, keyStep: 1},
+		&command{name: "lrange", handler: (*Session).doLRANGE, flags: flagReadonly, firstKey: 1, lastKey: 1, keyStep: 1},
+		&command{name: "lindex", handler: (*Session).doLINDEX, flags: flagReadonly, firstKey: 1, lastKey: 1, keyStep: 1},
+		&command{name: "sadd", handler: (*Session).doSADD, flags: flagWrite, firstKey: 1, lastKey: 1, keyStep: 1},
+		&command{name: "srem", handler: (*Session).doSREM, flags: flagWrite, firstKey: 1, lastKey: 1, keyStep: 1},
+		&command{name: "sismember", handler: (*Session).doSISMEMBER, flags: flagReadonly, firstKey: 1, lastKey: 1, keyStep: 1},
+		&command{name: "smembers", handler: (*Session).doSMEMBERS, flags: flagReadonly, firstKey: 1, lastKey: 1, keyStep: 1},
+		&command{name: "scard", handler: (*Session).doSCARD, flags: flagReadonly, firstKey: 1, lastKey: 1, keyStep: 1},
+		&command{name: "srandmember", handler: (*Session).doSRANDMEMBER, flags: flagReadonly, firstKey: 1, lastKey: 1, keyStep: 1},
+		&command{name: "spop", handler: (*Session).doSPOP, flags: flagWrite, firstKey: 1, lastKey: 1, keyStep: 1},
+		&command{name: "dump", handler: (*Session).doDUMP, flags: flagReadonly, firstKey: 1, lastKey: 1, keyStep: 1},
+		&command{name: "restore", handler: (*Session).doRESTORE, flags: flagWrite, firstKey: 1, lastKey: 1, keyStep: 1},
+		&command{name: "migrate", handler: (*Session).doMIGRATE, flags: flagWrite | flagOwnLock, getKeys: migrateKeys},
+		&command{name: "cluster", handler: (*Session).doCLUSTER, help: clusterHelp},
+		&command{name: "client", handler: (*Session).doCLIENT, flags: flagNoPause, help: clientHelp},
+		&command{name: "save", handler: (*Session).doSAVE},
+		&command{name: "bgsave", handler: (*Session).doBGSAVE},
+		&command{name: "lastsave", handler: (*Session).doLASTSAVE},
+		&command{name: "time", handler: (*Session).doTIME},
+		&command{name: "info", handler: (*Session).doINFO, flags: flagSentinel},
+		&command{name: "latency", handler: (*Session).doLATENCY, help: latencyHelp},
+		&command{name: "command", handler: (*Session).doCOMMAND, help: commandHelp},
+		&command{name: "lolwut", handler: (*Session).doLOLWUT},
+		&command{name: "replicaof", handler: (*Session).doREPLICAOF, flags: flagNoPause},
+		&command{name: "slaveof", handler: (*Session).doREPLICAOF, flags: flagNoPause},
+		&command{name: "failover", handler: (*Session).doFAILOVER},
+		&command{name: "replconf", handler: (*Session).doREPLCONF, flags: flagNoPause},
+		&command{name: "psync", handler: (*Session).doPSYNC, flags: flagNoPause},
+		&command{name: "sentinel", handler: (*Session).doSENTINEL, flags: flagSentinel | flagNoPause, help: sentinelHelp},
+		&command{name: "shutdown", handler: (*Session).doSHUTDOWN, flags: flagNoPause | flagSentinel},
+	)
+}
+
+// Make the command clients call name known to them as newName instead, as the
+// rename-command directive does, or unknown altogether if newName is "", e.g. to keep
+// CONFIG away from anyone who can connect. Our master and the AOF still use the
+// original names.
+func (s *Server) RenameCommand(name string, newName string) error {
+	name, newName = strings.ToLower(name), strings.ToLower(newName)
+	spec, ok := s.commands[name]
+	if !ok {
+		return errors.New("no such command: " + name)
+	}
+	if _, taken := s.commands[newName]; taken && newName != name {
+		return errors.New("there is a command called " + newName + " already")
+	}
+	delete(s.commands, name)
+	if newName != "" {
+		s.commands[newName] = spec
+	}
+	return nil
+}
+
+// Return the arguments of cmds that are keys.
+func (c *command) keys(cmds []string) []string {
+	if c.getKeys != nil {
+		return c.getKeys(cmds)
+	}
+	if c.firstKey == 0 || c.firstKey >= len(cmds) {
+		return nil
+	}
+
+	lastKey := c.lastKey
+	if lastKey < 0 {
+		lastKey += len(cmds)
+	}
+	lastKey = min(lastKey, len(cmds)-1)
+
+	keys := make([]string, 0, (lastKey-c.firstKey)/c.keyStep+1)
+	for i := c.firstKey; i <= lastKey; i += c.keyStep {
+		keys = append(keys, cmds[i])
+	}
+	return keys
+}
+
+// XREAD [COUNT count] [BLOCK milliseconds] STREAMS key [key ...] id [id ...]
+func xreadKeys(cmds []string) []string {
+	for i := 1; i < len(cmds); i++ {
+		switch strings.ToLower(cmds[i]) {
+		case "count", "block":
+			i++ // so that a value can't be taken for STREAMS
+		case "streams":
+			remaining := cmds[i+1:]
+			if len(remaining) == 0 || len(remaining)%2 != 0 {
+				return nil // every key needs an ID
+			}
+			return remaining[:len(remaining)/2]
+		}
+	}
+	return nil
+}
+
+// MIGRATE host port key|"" destination-db timeout [...] [KEYS key [key ...]]
+func migrateKeys(cmds []string) []string {
+	if len(cmds) < 6 {
+		return nil
+	}
+	if cmds[3] != "" {
+		return cmds[3:4]
+	}
+	for i := 6; i < len(cmds); i++ {
+		if strings.ToLower(cmds[i]) == "keys" {
+			return cmds[i+1:]
+		}
+	}
+	return nil
+}
+
+// Whether the command has any keys, in some calls at least.
+func (c *command) hasKeys() bool {
+	return c.firstKey != 0 || c.getKeys != nil
+}
+
+var commandHelp = []string{
+	"COUNT",
+	"    Return the total number of commands in this server.",
+	"GETKEYS <full-command>",
+	"    Return the keys from a full command.",
+}
+
+// COMMAND COUNT | GETKEYS command [arg ...]
+func (s *Session) doCOMMAND(cmds []string) *UserError {
+	if len(cmds) < 2 {
+		return &UserError{"ERR", "wrong number of arguments for COMMAND command"}
+	}
+	switch strings.ToLower(cmds[1]) {
+	case "count":
+		if len(cmds) != 2 {
+			return &UserError{"ERR", "wrong number of arguments for COMMAND COUNT command"}
+		}
+		s.writeInt(int64(len(s.server.commands)))
+		return nil
+	case "getkeys":
+		if len(cmds) < 3 {
+			return &UserError{"ERR", "wrong number of arguments for COMMAND GETKEYS command"}
+		}
+		// By the names clients know commands by, like the dispatcher
+		spec, ok := s.server.commands[strings.ToLower(cmds[2])]
+		if !ok {
+			return &UserError{"ERR", "Invalid command specified"}
+		}
+		if !spec.hasKeys() {
+			return &UserError{"ERR", "The command has no key arguments"}
+		}
+		keys := spec.keys(cmds[2:])
+		if len(keys) == 0 {
+			return &UserError{"ERR", "Invalid arguments specified for command"}
+		}
+		s.conn.Write(makeRESPArr(keys))
+		return nil
+	}
+	return errUnknownSubcommand(cmds)
+}
@@ -0,0 +1,728 @@
+package diyredis
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	resp3 "github.com/codecrafters-io/redis-starter-go/app/diyredis/resp3"
+)
+
+// Replication: a replica keeps a copy of its master's dataset, by loading a snapshot of
+// it and then executing every write command the master executes, as the master
+// propagates them.
+//
+// A replica connects to its master like any other client, and asks for the dataset with
+// PSYNC. The master takes a snapshot, sends it as an RDB file, and then sends the
+// commands executed since the snapshot was taken. A replica that loses the connection
+// tries to continue where it left off, by telling the master its offset: how many bytes
+// of commands it has received. If the master still has everything propagated since in
+// its backlog, it sends just that, or else the replica starts over.
+
+type replState struct {
+	mutex    sync.Mutex
+	id       string // replication ID of our dataset, our master's while a replica; guarded by mutex
+	replicas map[*Session]*replica
+	active   atomic.Bool  // a replica has connected once, so commands have to be propagated
+	offset   atomic.Int64 // bytes propagated under id, or received from the master while a replica
+	backlog  *replBacklog // what was propagated last, up to offset; nil until a replica connects
+	lastDB   int          // database of the last propagated command, -1 if the next one needs a SELECT
+
+	fullSyncs       atomic.Int64 // PSYNCs answered with a snapshot
+	partialSyncs    atomic.Int64 // PSYNCs answered with CONTINUE
+	partialSyncErrs atomic.Int64 // PSYNCs asking to continue that got a snapshot instead
+
+	link      atomic.Pointer[masterLink] // to our master; nil when we are a master ourselves
+	linkMutex sync.Mutex                 // held while changing link
+	masterDB  int                        // database the master's commands are for, kept when continuing after a reconnect
+	failover  failoverState
+
+	// Held for reading by write commands from the moment they change the keyspace until
+	// they are propagated, and for writing while taking the snapshot for a new replica.
+	// That way a new replica gets every change exactly once: as part of the snapshot, or
+	// propagated after it.
+	writes sync.RWMutex
+
+	// Locked by write commands for their keys before writes, and let go of once they are
+	// propagated, so that replicas get the changes to a key in the order they were made
+	// in. The locks of the database itself only last as long as the change does.
+	order keyLocks
+}
+
+type replica struct {
+	online    bool     // the snapshot has been sent, commands are sent right away
+	pending   [][]byte // commands propagated while the snapshot was being sent
+	ackOffset int64    // offset the replica last said it has received, with REPLCONF ACK
+	ackTime   time.Time
+}
+
+type masterLink struct {
+	host string
+	port string
+	up   atomic.Bool // in sync with the master
+	stop context.CancelFunc
+	done chan struct{}
+
+	// For a master handing over to its replica with FAILOVER: receives the outcome of
+	// asking it to take over, on the first attempt to connect.
+	failover chan error
+}
+
+func newReplicationID() string {
+	id := make([]byte, 20)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// Send cmds, which changed database db, to the replicas.
+//
+// Nothing is propagated until the first replica connects. From then on the offset keeps
+// counting even without replicas, so that a replica reconnecting later can tell whether
+// it missed anything.
+func (s *Server) propagate(db int, cmds ...[]string) {
+	if !s.repl.active.Load() || len(cmds) == 0 {
+		return
+	}
+	s.repl.mutex.Lock()
+	defer s.repl.mutex.Unlock()
+
+	var buf []byte
+	if db != s.repl.lastDB {
+		buf = makeRESPArr([]string{"SELECT", strconv.Itoa(db)})
+		s.repl.lastDB = db
+	}
+	for _, cmd := range cmds {
+		buf = append(buf, makeRESPArr(cmd)...)
+	}
+	s.repl.feed(buf)
+}
+
+// Send buf to every replica. Must be called with mutex held.
+func (r *replState) feed(buf []byte) {
+	if r.link.Load() == nil {
+		// A replica's offset is about what it received from its master instead
+		r.offset.Add(int64(len(buf)))
+		r.backlog.write(buf)
+	}
+	for session, replica := range r.replicas {
+		if replica.online {
+			session.push(buf)
+		} else {
+			replica.pending = append(replica.pending, buf)
+		}
+	}
+}
+
+// Have the command being executed propagated to replicas as cmds instead, e.g. because
+// executing it again wouldn't have the same effect. Without cmds, nothing is propagated.
+func (s *Session) propagateAs(cmds ...[]string) {
+	s.rewritten = true
+	s.rewrite = cmds
+}
+
+func (r *replState) addReplica(s *Session) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.activate(int(s.server.ReplBacklogSize))
+	r.replicas[s] = &replica{}
+	s.becomeReplicaOutput()
+	r.lastDB = -1 // the new replica doesn't know which database we're in
+}
+
+// Start keeping a backlog of backlogSize, and propagating commands, if not done yet.
+// Must be called with mutex held.
+func (r *replState) activate(backlogSize int) {
+	if r.replicas == nil {
+		r.replicas = make(map[*Session]*replica)
+	}
+	if r.backlog == nil {
+		r.backlog = newReplBacklog(backlogSize, r.offset.Load())
+	}
+	r.active.Store(true)
+}
+
+func (r *replState) removeReplica(s *Session) {
+	if !r.active.Load() {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.replicas, s)
+}
+
+// Start a new history of the dataset, e.g. because it was just loaded from the master,
+// or it stops following the master's. Offsets of the old history don't mean anything
+// in the new one.
+func (r *replState) newHistory(id string, offset int64) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.id = id
+	r.offset.Store(offset)
+	if r.backlog != nil {
+		r.backlog = newReplBacklog(len(r.backlog.buf), offset)
+	}
+}
+
+// Continue replicating to a replica that reconnected, sending what it missed from the
+// backlog. offset is that of the first byte it needs. Returns false if that isn't in the
+// backlog, so it needs a full resync instead.
+func (r *replState) continueReplica(s *Session, id string, offset int64) bool {
+	if r.link.Load() != nil {
+		return false // our replicas' offsets don't line up with the master's
+	}
+	r.writes.Lock() // so that nothing is propagated before the replica is added
+	defer r.writes.Unlock()
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if id != r.id || r.backlog == nil {
+		return false
+	}
+	missed, ok := r.backlog.since(offset - 1)
+	if !ok {
+		return false
+	}
+	r.replicas[s] = &replica{online: true, ackOffset: offset - 1, ackTime: time.Now()}
+	s.becomeReplicaOutput()
+	s.push([]byte("+CONTINUE " + r.id + "\r\n"))
+	if len(missed) > 0 {
+		s.push(missed)
+	}
+	return true
+}
+
+// Record the offset a replica says it has received.
+func (r *replState) ack(s *Session, offset int64) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if replica, ok := r.replicas[s]; ok {
+		replica.ackOffset = offset
+		replica.ackTime = time.Now()
+	}
+}
+
+// Send the snapshot, taken at offset, to a replica, followed by whatever was propagated
+// in the meantime.
+func (r *replState) sendSnapshot(s *Session, rdb []byte, offset int64) {
+	if r.startFullSync(s, offset, fmt.Sprintf("$%d\r\n", len(rdb))) {
+		r.finishFullSync(s, rdb)
+	}
+}
+
+// Start sending the replica of s a snapshot, taken at offset: FULLRESYNC, followed by
+// header, which says where the snapshot ends. Returns false if the replica is gone.
+func (r *replState) startFullSync(s *Session, offset int64, header string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	replica, ok := r.replicas[s]
+	if !ok {
+		return false
+	}
+	replica.ackOffset = offset
+	replica.ackTime = time.Now()
+	s.push(fmt.Appendf(nil, "+FULLRESYNC %s %d\r\n%s", r.id, offset, header))
+	return true
+}
+
+// Send the replica of s the rest of its snapshot, and then the commands propagated in
+// the meantime, from here on sending them as they are propagated.
+func (r *replState) finishFullSync(s *Session, rest []byte) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	replica, ok := r.replicas[s]
+	if !ok {
+		return
+	}
+	s.push(rest)
+	for _, buf := range replica.pending {
+		s.push(buf)
+	}
+	replica.pending = nil
+	replica.online = true
+}
+
+// Send the replica of s a snapshot as it is written, rather than once all of it is: a
+// replica doesn't have to wait for the whole dataset to be serialized before it can
+// start loading it, and the master doesn't have to hold all of it at once. Since its
+// size isn't known up front, it's sent as "$EOF:<mark>\r\n", the RDB file, and then the
+// mark again, the mark being 40 random characters.
+func (s *Session) sendSnapshotDiskless() *UserError {
+	var offset int64
+	s.server.startSnapshot(func() {
+		s.server.repl.addReplica(s)
+		offset = s.server.repl.offset.Load()
+	})
+	mark := newReplicationID()
+	if !s.server.repl.startFullSync(s, offset, "$EOF:"+mark+"\r\n") {
+		s.server.endSnapshot()
+		return nil
+	}
+	stream := bufio.NewWriterSize(pushWriter{s}, 64<<10)
+	err := s.server.writeRdb(stream)
+	if err == nil {
+		err = stream.Flush()
+	}
+	s.server.endSnapshot()
+	if err != nil {
+		// The replica got part of a snapshot, which it can't tell from a whole one
+		s.server.repl.removeReplica(s)
+		s.log.Error("Can't write the snapshot for replica", "err", err)
+		s.close()
+		return nil
+	}
+	s.server.repl.fullSyncs.Add(1)
+	s.replica = true
+	s.log.Info("Starting diskless full resync with replica", "listening_port", s.replicaPort)
+	s.server.repl.finishFullSync(s, []byte(mark))
+	return nil
+}
+
+// Pushes whatever is written to it to a client, which keeps it until it's sent.
+type pushWriter struct {
+	s *Session
+}
+
+func (w pushWriter) Write(p []byte) (int, error) {
+	w.s.push(bytes.Clone(p))
+	return len(p), nil
+}
+
+// PSYNC replicationid offset
+//
+// offset is that of the first byte the replica wants, i.e. one more than it has.
+//
+// # PSYNC replicationid offset FAILOVER
+//
+// Sent to a replica by its master, handing over with FAILOVER. The replica becomes the
+// master, and the old master its replica.
+func (s *Session) doPSYNC(cmds []string) *UserError {
+	if len(cmds) == 4 && strings.ToLower(cmds[3]) == "failover" {
+		if uerr := s.server.takeOver(cmds[1], cmds[2]); uerr != nil {
+			return uerr
+		}
+		cmds = cmds[:3]
+	}
+	if len(cmds) != 3 {
+		return &UserError{"ERR", "wrong number of arguments for PSYNC command"}
+	}
+	if offset, err := strconv.ParseInt(cmds[2], 10, 64); err == nil && cmds[1] != "?" {
+		if s.server.repl.continueReplica(s, cmds[1], offset) {
+			s.server.repl.partialSyncs.Add(1)
+			s.replica = true
+			s.log.Info("Continuing replication with replica", "listening_port", s.replicaPort, "offset", offset)
+			return nil
+		}
+		s.server.repl.partialSyncErrs.Add(1)
+	}
+	if s.server.ReplDisklessSync && s.replicaEOF {
+		return s.sendSnapshotDiskless()
+	}
+
+	var rdb bytes.Buffer
+	var offset int64
+	s.server.startSnapshot(func() {
+		s.server.repl.addReplica(s)
+		offset = s.server.repl.offset.Load()
+	})
+	err := s.server.writeRdb(&rdb)
+	s.server.endSnapshot()
+	if err != nil {
+		s.server.repl.removeReplica(s)
+		return &UserError{"ERR", "can't write the snapshot: " + err.Error()}
+	}
+	s.server.repl.fullSyncs.Add(1)
+	s.replica = true
+	s.log.Info("Starting full resync with replica", "listening_port", s.replicaPort)
+	s.server.repl.sendSnapshot(s, rdb.Bytes(), offset)
+	return nil
+}
+
+// REPLCONF option value [option value ...]
+func (s *Session) doREPLCONF(cmds []string) *UserError {
+	if len(cmds) < 3 || len(cmds)%2 != 1 {
+		return ErrSyntax()
+	}
+	for i := 1; i < len(cmds); i += 2 {
+		switch strings.ToLower(cmds[i]) {
+		case "listening-port":
+			port, err := strconv.Atoi(cmds[i+1])
+			if err != nil {
+				return &UserError{"ERR", "value is not an integer or out of range"}
+			}
+			s.replicaPort = port
+		case "ack":
+			offset, err := strconv.ParseInt(cmds[i+1], 10, 64)
+			if err != nil {
+				return &UserError{"ERR", "value is not an integer or out of range"}
+			}
+			s.server.repl.ack(s, offset)
+			return nil // not replied to
+		case "getack":
+			return nil // only sent by a master, and handled by the replica's link
+		case "capa":
+			if strings.ToLower(cmds[i+1]) == "eof" {
+				s.replicaEOF = true
+			}
+		case "ip-address":
+		default:
+			return &UserError{"ERR", "Unrecognized REPLCONF option: " + cmds[i]}
+		}
+	}
+	s.conn.Write(resp3.OK)
+	return nil
+}
+
+// REPLICAOF host port | REPLICAOF NO ONE
+func (s *Session) doREPLICAOF(cmds []string) *UserError {
+	if len(cmds) != 3 {
+		return &UserError{"ERR", "wrong number of arguments for REPLICAOF command"}
+	}
+	if s.server.ClusterEnabled {
+		return &UserError{"ERR", "REPLICAOF not allowed in cluster mode."}
+	}
+	if strings.ToLower(cmds[1]) == "no" && strings.ToLower(cmds[2]) == "one" {
+		s.server.ReplicaOf("", "")
+		s.conn.Write(resp3.OK)
+		return nil
+	}
+	if port, err := strconv.Atoi(cmds[2]); err != nil || port <= 0 || port > 65535 {
+		return &UserError{"ERR", "Invalid master port"}
+	}
+	s.server.ReplicaOf(cmds[1], cmds[2])
+	s.conn.Write(resp3.OK)
+	return nil
+}
+
+// Start replicating the master at host and port, or become a master if host is empty.
+func (s *Server) ReplicaOf(host string, port string) {
+	s.repl.linkMutex.Lock()
+	defer s.repl.linkMutex.Unlock()
+	if s.stopMasterLink() && host == "" {
+		// Our dataset takes a different turn than the master's from here on
+		s.repl.newHistory(newReplicationID(), s.repl.offset.Load())
+		s.Log.Info("Now a master")
+	}
+	if host != "" {
+		s.startMasterLink(&masterLink{host: host, port: port})
+	}
+}
+
+// Start replicating the master link is about. Must be called with linkMutex held, and
+// no link.
+func (s *Server) startMasterLink(link *masterLink) {
+	ctx, cancel := context.WithCancel(context.Background())
+	link.stop = cancel
+	link.done = make(chan struct{})
+	s.repl.link.Store(link)
+	s.Log.Info("Now a replica", "master", net.JoinHostPort(link.host, link.port))
+	go s.runMasterLink(ctx, link)
+}
+
+// Disconnect from the master, if any, returning whether there was one. Must be called
+// with linkMutex held.
+func (s *Server) stopMasterLink() bool {
+	link := s.repl.link.Swap(nil)
+	if link == nil {
+		return false
+	}
+	link.stop()
+	<-link.done
+	return true
+}
+
+func (s *Server) runMasterLink(ctx context.Context, link *masterLink) {
+	defer s.reportCrashes()
+	defer close(link.done)
+	for {
+		err := s.syncWithMaster(ctx, link)
+		link.up.Store(false)
+		if ctx.Err() != nil {
+			return
+		}
+		s.Log.Warn("Connection with master lost, reconnecting", "err", err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// Connect to the master, load its dataset and then execute the commands it sends, until
+// the connection breaks or ctx is canceled.
+func (s *Server) syncWithMaster(ctx context.Context, link *masterLink) (err error) {
+	failover := link.failover
+	link.failover = nil
+	defer func() {
+		if failover != nil {
+			failover <- err
+		}
+	}()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(link.host, link.port))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	defer context.AfterFunc(ctx, func() { conn.Close() })()
+	reader := bufio.NewReader(conn)
+
+	port := 0
+	if s.Listener != nil {
+		if addr, ok := s.Listener.Addr().(*net.TCPAddr); ok {
+			port = addr.Port
+		}
+	}
+	for _, cmd := range [][]string{
+		{"PING"},
+		{"REPLCONF", "listening-port", strconv.Itoa(port)},
+		{"REPLCONF", "capa", "eof", "capa", "psync2"},
+	} {
+		if _, err := masterRequest(conn, reader, cmd...); err != nil {
+			return fmt.Errorf("%s: %w", cmd[0], err)
+		}
+	}
+
+	// Ask to continue from where we are. Only the master whose dataset we have will
+	// recognize the replication ID.
+	s.repl.mutex.Lock()
+	id := s.repl.id
+	s.repl.mutex.Unlock()
+	psync := []string{"PSYNC", id, strconv.FormatInt(s.repl.offset.Load()+1, 10)}
+	if failover != nil {
+		psync = append(psync, "FAILOVER") // and it takes over
+	}
+	reply, err := masterRequest(conn, reader, psync...)
+	if err != nil {
+		return fmt.Errorf("PSYNC: %w", err)
+	}
+	if strings.HasPrefix(reply, "CONTINUE") {
+		s.Log.Info("Continuing replication with master", "master", net.JoinHostPort(link.host, link.port), "offset", s.repl.offset.Load())
+	} else if failover != nil {
+		return fmt.Errorf("PSYNC FAILOVER: unexpected reply %q", reply)
+	} else if err := s.fullSyncWithMaster(reader, reply); err != nil {
+		return err
+	}
+	link.up.Store(true)
+	if failover != nil {
+		failover <- nil
+		failover = nil
+	}
+
+	// Tell the master our offset every second, and whenever it asks
+	var connMutex sync.Mutex
+	ack := func() error {
+		connMutex.Lock()
+		defer connMutex.Unlock()
+		_, err := conn.Write(makeRESPArr([]string{"REPLCONF", "ACK", strconv.FormatInt(s.repl.offset.Load(), 10)}))
+		return err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		acks := time.NewTicker(time.Second)
+		defer acks.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-acks.C:
+				if ack() != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	session := &Session{server: s, conn: discardConn{}, log: s.Log.With("client", "master"), master: true}
+	session.dbIndex = s.repl.masterDB
+	for {
+		cmd, err := ParseCommand(reader, s.ProtoLimits)
+		if err != nil {
+			return err
+		}
+		if len(cmd) == 3 && strings.ToLower(cmd[0]) == "replconf" && strings.ToLower(cmd[1]) == "getack" {
+			// The reply doesn't count this very command yet
+			if err := ack(); err != nil {
+				return err
+			}
+		} else if uerr := session.execute(cmd); uerr != nil {
+			session.log.Warn("Command from master failed", "command", cmd[0], "err", uerr)
+		}
+		s.repl.masterDB = session.dbIndex
+		s.repl.offset.Add(int64(len(makeRESPArr(cmd))))
+	}
+}
+
+// Load the dataset the master sends after replying reply (FULLRESYNC replid offset) to
+// PSYNC.
+func (s *Server) fullSyncWithMaster(reader *bufio.Reader, reply string) error {
+	fields := strings.Fields(reply)
+	if len(fields) != 3 || fields[0] != "FULLRESYNC" {
+		return fmt.Errorf("PSYNC: unexpected reply %q", reply)
+	}
+	offset, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return fmt.Errorf("PSYNC: unexpected reply %q", reply)
+	}
+
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	dbs := make([]RedisDB, s.dbCount())
+	for i := range dbs {
+		dbs[i] = s.newDB(i)
+	}
+	if mark, ok := strings.CutPrefix(strings.TrimSuffix(line, "\r\n"), "$EOF:"); ok {
+		err = s.loadSnapshotUntilMark(reader, dbs, mark)
+	} else {
+		size, parseErr := strconv.ParseInt(strings.TrimSuffix(line, "\r\n")[1:], 10, 64)
+		if parseErr != nil || line[0] != '$' {
+			return fmt.Errorf("invalid snapshot size %q", line)
+		}
+		snapshot := io.LimitReader(reader, size)
+		err = s.loadRdb(newRdbReader(snapshot), dbs)
+		io.Copy(io.Discard, snapshot) // the checksum
+	}
+	if err != nil {
+		return fmt.Errorf("loading the snapshot: %w", err)
+	}
+	s.replaceDBs(dbs)
+
+	s.repl.newHistory(fields[1], offset)
+	s.repl.masterDB = 0
+	s.Log.Info("Synchronized with master", "replid", fields[1], "offset", offset)
+	return nil
+}
+
+// Load a snapshot sent without its size, which is followed by mark instead.
+func (s *Server) loadSnapshotUntilMark(reader *bufio.Reader, dbs []RedisDB, mark string) error {
+	if len(mark) != 40 {
+		return fmt.Errorf("invalid snapshot end mark %q", mark)
+	}
+	// Having a bufio.Reader of the default size already, newRdbReader uses it as is, and
+	// doesn't read ahead into what comes after the snapshot
+	if err := s.loadRdb(newRdbReader(reader), dbs); err != nil {
+		return err
+	}
+	tail := make([]byte, 8+len(mark)) // the checksum, and the mark
+	if _, err := io.ReadFull(reader, tail); err != nil {
+		return err
+	}
+	if string(tail[8:]) != mark {
+		return fmt.Errorf("snapshot ends with %q, not with the mark %q", tail[8:], mark)
+	}
+	return nil
+}
+
+// Send a command to the master during the handshake, and return its (single line)
+// reply.
+func masterRequest(conn net.Conn, reader *bufio.Reader, cmd ...string) (string, error) {
+	if _, err := conn.Write(makeRESPArr(cmd)); err != nil {
+		return "", err
+	}
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return "", errors.New("empty reply")
+	}
+	if line[0] == '-' {
+		return "", errors.New(line[1:])
+	}
+	return line[1:], nil
+}
+
+// Refuse commands that a replica can't run right now: writes, unless they come from the
+// master or the replica was made writable, and any access to the keyspace while out of
+// sync with the master, unless stale data is fine.
+func (s *Session) replicaRefuses(spec *command) *UserError {
+	link := s.server.repl.link.Load()
+	if link == nil || s.master {
+		return nil
+	}
+	if spec.flags&flagWrite != 0 && s.server.ReplicaReadOnly {
+		return &UserError{"READONLY", "You can't write against a read only replica."}
+	}
+	if spec.flags&(flagWrite|flagReadonly) != 0 && !s.server.ReplicaServeStaleData && !link.up.Load() {
+		return &UserError{"MASTERDOWN", "Link with MASTER is down and replica-serve-stale-data is set to 'no'."}
+	}
+	return nil
+}
+
+func (s *Server) role() string {
+	if s.repl.link.Load() != nil {
+		return "replica"
+	}
+	return "master"
+}
+
+func (s *Server) infoReplication() []string {
+	var info []string
+	if link := s.repl.link.Load(); link != nil {
+		status := "down"
+		if link.up.Load() {
+			status = "up"
+		}
+		info = []string{
+			"role:slave",
+			"master_host:" + link.host,
+			"master_port:" + link.port,
+			"master_link_status:" + status,
+			"slave_repl_offset:" + strconv.FormatInt(s.repl.offset.Load(), 10),
+			"replica_read_only:" + boolToInfo(s.ReplicaReadOnly),
+		}
+	} else {
+		info = []string{"role:master"}
+	}
+
+	s.repl.mutex.Lock()
+	var replicas []string
+	for session, replica := range s.repl.replicas {
+		host, _, _ := net.SplitHostPort(session.conn.RemoteAddr().String())
+		state := "wait_bgsave"
+		if replica.online {
+			state = "online"
+		}
+		replicas = append(replicas, fmt.Sprintf("ip=%s,port=%d,state=%s,offset=%d,lag=%d",
+			host, session.replicaPort, state, replica.ackOffset, int(time.Since(replica.ackTime).Seconds())))
+	}
+	id := s.repl.id
+	backlog := []string{"repl_backlog_active:0"}
+	if b := s.repl.backlog; b != nil {
+		backlog = []string{
+			"repl_backlog_active:1",
+			"repl_backlog_size:" + strconv.Itoa(len(b.buf)),
+			"repl_backlog_first_byte_offset:" + strconv.FormatInt(b.start()+1, 10),
+			"repl_backlog_histlen:" + strconv.Itoa(b.length),
+		}
+	}
+	s.repl.mutex.Unlock()
+	slices.Sort(replicas)
+
+	info = append(info, "connected_slaves:"+strconv.Itoa(len(replicas)))
+	for i, replica := range replicas {
+		info = append(info, "slave"+strconv.Itoa(i)+":"+replica)
+	}
+	info = append(info,
+		"master_failover_state:"+s.repl.failover.String(),
+		"master_replid:"+id,
+		"master_repl_offset:"+strconv.FormatInt(s.repl.offset.Load(), 10),
+	)
+	return append(info, backlog...)
+}
@@ -12,39 +12,127 @@ const (
 	bulkStrPrefix   = '$'
 	arrPrefix       = '*'
 	mapPrefix       = '%'
+	pushPrefix      = '>'
+	attributePrefix = '|'
 	setPrefix       = '~'
 	nullType        = '_'
 	CRLF            = "\r\n"
 )
 
-var nullSlice []byte = []byte("_\r\n")
+var (
+	nullSlice        []byte = []byte("_\r\n")
+	nullBulkStrSlice []byte = []byte("$-1\r\n")
+	nullArrSlice     []byte = []byte("*-1\r\n")
+)
+
+// The most common replies, ready to be written without building them every time. They
+// are shared, so never modify them.
+var (
+	OK          = []byte("+OK\r\n")
+	Pong        = []byte("+PONG\r\n")
+	Zero        = []byte(":0\r\n")
+	One         = []byte(":1\r\n")
+	Null        = nullSlice        // RESP3
+	NullBulkStr = nullBulkStrSlice // RESP2
+)
 
 // Big boy struct; the buffer is an exported field to mutate as you like. This exists mainly
 // to attach a bunch of convenience methods that may aid in encoding some object into a
 // respectable RESP3 counterpart.
 type Encoder struct {
 	Buf []byte
+
+	// Write the RESP3 types that RESP2 lacks (nulls, maps) as is, rather than as their
+	// closest RESP2 counterpart. For clients that switched to RESP3 using HELLO.
+	RESP3 bool
 }
 
 func (e *Encoder) Reset() { e.Buf = nil }
 
-// Write a RESP null.
+// Write a RESP null, which is a null bulk string in RESP2.
 func (e *Encoder) WriteNull() {
-	e.Buf = append(e.Buf, nullSlice...)
+	if e.RESP3 {
+		e.Buf = append(e.Buf, nullSlice...)
+		return
+	}
+	e.Buf = append(e.Buf, nullBulkStrSlice...)
+}
+
+// Write a RESP null where an array is expected, which is a null array in RESP2.
+func (e *Encoder) WriteNullArr() {
+	if e.RESP3 {
+		e.Buf = append(e.Buf, nullSlice...)
+		return
+	}
+	e.Buf = append(e.Buf, nullArrSlice...)
+}
+
+// val must not contain CR or LF.
+func (e *Encoder) WriteSimpleStr(val string) {
+	e.Buf = append(e.Buf, simpleStrPrefix)
+	e.Buf = append(e.Buf, val...)
+	e.Buf = append(e.Buf, CRLF...)
 }
 
 func (e *Encoder) WriteBulkStr(val string) {
 	e.Buf = append(e.Buf, bulkStrPrefix)
-	e.Buf = append(e.Buf, strconv.Itoa(len(val))...)
+	e.Buf = strconv.AppendInt(e.Buf, int64(len(val)), 10)
 	e.Buf = append(e.Buf, CRLF...)
 	e.Buf = append(e.Buf, val...)
 	e.Buf = append(e.Buf, CRLF...)
 }
 
+func (e *Encoder) WriteInt(val int) {
+	e.WriteIntFast(int64(val))
+}
+
+// Like WriteInt, formatting val straight into the buffer, without allocating.
+func (e *Encoder) WriteIntFast(val int64) {
+	e.Buf = append(e.Buf, numberPrefix)
+	e.Buf = strconv.AppendInt(e.Buf, val, 10)
+	e.Buf = append(e.Buf, CRLF...)
+}
+
 // Don't forget to write the items, too.
 func (e *Encoder) WriteArrHeader(arrLen int) {
 	e.Buf = append(e.Buf, arrPrefix)
-	e.Buf = append(e.Buf, strconv.Itoa(arrLen)...)
+	e.Buf = strconv.AppendInt(e.Buf, int64(arrLen), 10)
+	e.Buf = append(e.Buf, CRLF...)
+}
+
+// Don't forget to write the keys and values, too. In RESP2, maps are flat arrays of
+// alternating keys and values.
+func (e *Encoder) WriteMapHeader(mapLen int) {
+	if e.RESP3 {
+		e.Buf = append(e.Buf, mapPrefix)
+		e.Buf = strconv.AppendInt(e.Buf, int64(mapLen), 10)
+	} else {
+		e.Buf = append(e.Buf, arrPrefix)
+		e.Buf = strconv.AppendInt(e.Buf, int64(mapLen*2), 10)
+	}
+	e.Buf = append(e.Buf, CRLF...)
+}
+
+// Write the header of an out-of-band push message, followed by its elements. RESP3 only.
+func (e *Encoder) WritePushHeader(pushLen int) {
+	e.Buf = append(e.Buf, pushPrefix)
+	e.Buf = strconv.AppendInt(e.Buf, int64(pushLen), 10)
+	e.Buf = append(e.Buf, CRLF...)
+}
+
+// Write a push message of the given kind, e.g. "invalidate", followed by argLen more
+// elements. RESP3 only.
+func (e *Encoder) WritePush(kind string, argLen int) {
+	e.WritePushHeader(argLen + 1)
+	e.WriteBulkStr(kind)
+}
+
+// Write the header of an attribute, followed by attrLen names and values: metadata about
+// the reply that comes right after it, which clients may ignore. RESP3 only; RESP2 has
+// no way to tell it apart from the reply.
+func (e *Encoder) WriteAttributeHeader(attrLen int) {
+	e.Buf = append(e.Buf, attributePrefix)
+	e.Buf = strconv.AppendInt(e.Buf, int64(attrLen), 10)
 	e.Buf = append(e.Buf, CRLF...)
 }
 
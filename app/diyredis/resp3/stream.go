@@ -0,0 +1,128 @@
+package resp3
+
+import (
+	"io"
+	"strconv"
+)
+
+// What both Encoder and StreamEncoder write, for code that works with either.
+type Writer interface {
+	WriteNull()
+	WriteNullArr()
+	WriteSimpleStr(val string)
+	WriteBulkStr(val string)
+	WriteInt(val int)
+	WriteArrHeader(arrLen int)
+	WriteMapHeader(mapLen int)
+	WritePushHeader(pushLen int)
+	WritePush(kind string, argLen int)
+	WriteAttributeHeader(attrLen int)
+}
+
+var (
+	_ Writer = &Encoder{}
+	_ Writer = &StreamEncoder{}
+)
+
+// How much StreamEncoder collects before writing it out.
+const streamChunkSize = 16 * 1024
+
+// Like Encoder, but writing to an io.Writer as it goes, a chunk at a time, rather than
+// holding everything in memory until the end. For large replies, e.g. long ranges of
+// stream entries.
+//
+// Errors from the io.Writer are kept, and returned by Flush; nothing more is written
+// after one.
+type StreamEncoder struct {
+	w   io.Writer
+	enc Encoder // the chunk being collected
+	err error
+}
+
+// resp3 is as for Encoder.RESP3.
+func NewStreamEncoder(w io.Writer, resp3 bool) *StreamEncoder {
+	return &StreamEncoder{w: w, enc: Encoder{RESP3: resp3}}
+}
+
+// Write out what's been collected so far, returning the first error writing ran into.
+func (e *StreamEncoder) Flush() error {
+	if e.err == nil && len(e.enc.Buf) > 0 {
+		_, e.err = e.w.Write(e.enc.Buf)
+	}
+	e.enc.Buf = e.enc.Buf[:0]
+	return e.err
+}
+
+func (e *StreamEncoder) flushFull() {
+	if len(e.enc.Buf) >= streamChunkSize {
+		e.Flush()
+	}
+}
+
+func (e *StreamEncoder) WriteNull() {
+	e.enc.WriteNull()
+	e.flushFull()
+}
+
+func (e *StreamEncoder) WriteNullArr() {
+	e.enc.WriteNullArr()
+	e.flushFull()
+}
+
+// val must not contain CR or LF.
+func (e *StreamEncoder) WriteSimpleStr(val string) {
+	e.enc.WriteSimpleStr(val)
+	e.flushFull()
+}
+
+// A value bigger than a chunk is written straight through, without copying it.
+func (e *StreamEncoder) WriteBulkStr(val string) {
+	if len(val) < streamChunkSize {
+		e.enc.WriteBulkStr(val)
+		e.flushFull()
+		return
+	}
+	e.enc.Buf = append(e.enc.Buf, bulkStrPrefix)
+	e.enc.Buf = strconv.AppendInt(e.enc.Buf, int64(len(val)), 10)
+	e.enc.Buf = append(e.enc.Buf, CRLF...)
+	e.Flush()
+	if e.err == nil {
+		_, e.err = io.WriteString(e.w, val)
+	}
+	e.enc.Buf = append(e.enc.Buf, CRLF...)
+}
+
+func (e *StreamEncoder) WriteInt(val int) {
+	e.enc.WriteInt(val)
+	e.flushFull()
+}
+
+// Don't forget to write the items, too.
+func (e *StreamEncoder) WriteArrHeader(arrLen int) {
+	e.enc.WriteArrHeader(arrLen)
+	e.flushFull()
+}
+
+// As for Encoder.WriteMapHeader.
+func (e *StreamEncoder) WriteMapHeader(mapLen int) {
+	e.enc.WriteMapHeader(mapLen)
+	e.flushFull()
+}
+
+// As for Encoder.WritePushHeader.
+func (e *StreamEncoder) WritePushHeader(pushLen int) {
+	e.enc.WritePushHeader(pushLen)
+	e.flushFull()
+}
+
+// As for Encoder.WritePush.
+func (e *StreamEncoder) WritePush(kind string, argLen int) {
+	e.enc.WritePush(kind, argLen)
+	e.flushFull()
+}
+
+// As for Encoder.WriteAttributeHeader.
+func (e *StreamEncoder) WriteAttributeHeader(attrLen int) {
+	e.enc.WriteAttributeHeader(attrLen)
+	e.flushFull()
+}
@@ -0,0 +1,69 @@
+package resp3
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// A writer that records how it was written to.
+type chunkWriter struct {
+	bytes.Buffer
+	writes int
+	err    error
+}
+
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	w.writes++
+	return w.Buffer.Write(p)
+}
+
+func TestStreamEncoder(t *testing.T) {
+	for _, resp3 := range []bool{false, true} {
+		encode := func(e Writer) {
+			e.WriteArrHeader(3)
+			for i := range 5000 {
+				e.WriteBulkStr(strings.Repeat("x", i%10))
+			}
+			e.WriteBulkStr(strings.Repeat("big", streamChunkSize))
+			e.WriteMapHeader(1)
+			e.WriteSimpleStr("OK")
+			e.WriteInt(-42)
+			e.WriteNull()
+			e.WriteNullArr()
+			e.WritePushHeader(0)
+		}
+		want := &Encoder{RESP3: resp3}
+		encode(want)
+
+		var w chunkWriter
+		e := NewStreamEncoder(&w, resp3)
+		encode(e)
+		if err := e.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(w.Bytes(), want.Buf) {
+			t.Errorf("RESP3 %v: streamed output differs from Encoder's", resp3)
+		}
+		if w.writes < 3 {
+			t.Errorf("RESP3 %v: written in %d writes, want it in chunks", resp3, w.writes)
+		}
+	}
+}
+
+func TestStreamEncoderError(t *testing.T) {
+	broken := errors.New("broken pipe")
+	w := chunkWriter{err: broken}
+	e := NewStreamEncoder(&w, false)
+	for range streamChunkSize {
+		e.WriteInt(1)
+	}
+	e.WriteBulkStr("after the error")
+	if err := e.Flush(); !errors.Is(err, broken) {
+		t.Errorf("got %v, want the error writing ran into", err)
+	}
+}
@@ -0,0 +1,77 @@
+package diyredis
+
+import (
+	"math/rand/v2"
+	"slices"
+	"sync"
+)
+
+// Some of the keys of a database, kept in a slice too, so that some can be picked at
+// random without going over all of them: an engine has no way to get at a random key,
+// and the memory one always scans its keys in the same order, so stopping a Scan early
+// would keep coming up with the same ones.
+type keyIndex struct {
+	mutex sync.Mutex
+	keys  []string
+	pos   map[string]int // of each key in keys
+}
+
+func newKeyIndex() *keyIndex {
+	return &keyIndex{pos: map[string]int{}}
+}
+
+// Bring the index up to date after key was changed, exists telling whether it's there
+// now. That is checked under the lock, so that whichever update comes last sees the
+// latest change.
+func (x *keyIndex) update(key string, exists func() bool) {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	present := exists()
+	i, indexed := x.pos[key]
+	switch {
+	case present && !indexed:
+		x.pos[key] = len(x.keys)
+		x.keys = append(x.keys, key)
+	case !present && indexed:
+		// Fill the hole with the last key, rather than shifting all that come after
+		last := len(x.keys) - 1
+		x.keys[i] = x.keys[last]
+		x.pos[x.keys[i]] = i
+		x.keys = x.keys[:last]
+		delete(x.pos, key)
+	}
+}
+
+// Up to n distinct keys, picked at random, every key being as likely to be picked.
+func (x *keyIndex) sample(n int) []string {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	if n >= len(x.keys) {
+		return slices.Clone(x.keys)
+	}
+	// Robert Floyd's algorithm: n random picks, without having to shuffle all keys
+	picked := make(map[int]bool, n)
+	sample := make([]string, 0, n)
+	for j := len(x.keys) - n; j < len(x.keys); j++ {
+		i := rand.IntN(j + 1)
+		if picked[i] {
+			i = j
+		}
+		picked[i] = true
+		sample = append(sample, x.keys[i])
+	}
+	return sample
+}
+
+// Every key, at the moment of the call.
+func (x *keyIndex) all() []string {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	return slices.Clone(x.keys)
+}
+
+func (x *keyIndex) len() int {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	return len(x.keys)
+}
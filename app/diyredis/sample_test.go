@@ -0,0 +1,59 @@
+package diyredis
+
+import (
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestKeyIndex(t *testing.T) {
+	var m sync.Map
+	x := newKeyIndex()
+	update := func(key string) {
+		x.update(key, func() bool {
+			_, ok := m.Load(key)
+			return ok
+		})
+	}
+	for i := range 10 {
+		key := strconv.Itoa(i)
+		m.Store(key, i)
+		update(key)
+	}
+	update("0") // already there
+	m.Delete("3")
+	update("3")
+	update("missing")
+	if x.len() != 9 {
+		t.Fatalf("got %d keys, want 9", x.len())
+	}
+
+	counts := map[string]int{}
+	for range 9000 {
+		sample := x.sample(3)
+		if len(sample) != 3 {
+			t.Fatalf("got %v, want 3 keys", sample)
+		}
+		slices.Sort(sample)
+		if len(slices.Compact(sample)) != 3 {
+			t.Fatalf("got %v, want distinct keys", sample)
+		}
+		for _, key := range sample {
+			counts[key]++
+		}
+	}
+	if _, ok := counts["3"]; ok {
+		t.Errorf("sampled a deleted key")
+	}
+	for key, count := range counts {
+		// Each is picked 3000 times on average
+		if count < 2500 || count > 3500 {
+			t.Errorf("key %s picked %d times out of 9000", key, count)
+		}
+	}
+
+	if all := x.sample(100); len(all) != 9 {
+		t.Errorf("sampling more keys than there are: got %v", all)
+	}
+}
@@ -0,0 +1,276 @@
+package diyredis
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	resp3 "github.com/codecrafters-io/redis-starter-go/app/diyredis/resp3"
+)
+
+// Save the RDB file once at least `Changes` writes happened within `Seconds` seconds.
+type SavePoint struct {
+	Seconds int
+	Changes int
+}
+
+// Implements flag.Value, in the same format as Redis' "save" config: pairs of seconds
+// and changes, e.g. "3600 1 300 100 60 10000". An empty string disables saving.
+type SavePoints []SavePoint
+
+var DefaultSavePoints = SavePoints{{3600, 1}, {300, 100}, {60, 10000}}
+
+func (p *SavePoints) String() string {
+	if p == nil {
+		return ""
+	}
+	fields := make([]string, 0, len(*p)*2)
+	for _, point := range *p {
+		fields = append(fields, strconv.Itoa(point.Seconds), strconv.Itoa(point.Changes))
+	}
+	return strings.Join(fields, " ")
+}
+
+func (p *SavePoints) Set(val string) error {
+	fields := strings.Fields(val)
+	if len(fields)%2 != 0 {
+		return errors.New("must be pairs of seconds and changes")
+	}
+
+	points := make(SavePoints, 0, len(fields)/2)
+	for i := 0; i < len(fields); i += 2 {
+		seconds, err := strconv.Atoi(fields[i])
+		if err != nil || seconds < 1 {
+			return fmt.Errorf("invalid number of seconds: %q", fields[i])
+		}
+		changes, err := strconv.Atoi(fields[i+1])
+		if err != nil || changes < 0 {
+			return fmt.Errorf("invalid number of changes: %q", fields[i+1])
+		}
+		points = append(points, SavePoint{seconds, changes})
+	}
+	*p = points
+	return nil
+}
+
+// How long to wait before retrying a background save that failed, so that e.g. a full
+// disk doesn't make us retry continuously.
+const bgsaveRetryDelay = 5 * time.Second
+
+// Bookkeeping around saving the RDB file.
+type saveState struct {
+	dirty atomic.Int64 // changes to the keyspace since the last successful save
+
+	mutex          sync.Mutex
+	inProgress     bool
+	lastSave       time.Time // last successful save, or the server start
+	lastAttempt    time.Time
+	lastStatusOK   bool
+	lastBgDuration time.Duration
+}
+
+// Record `n` changes to the keyspace.
+func (s *Server) markDirty(n int) {
+	s.save.dirty.Add(int64(n))
+}
+
+var errSaveInProgress = errors.New("Background save already in progress")
+
+// Save the RDB file, blocking until it has been written.
+func (s *Server) SaveRdb() error {
+	if err := s.startSave(); err != nil {
+		return err
+	}
+	err := s.saveRdb()
+	s.finishSave(err, 0)
+	return err
+}
+
+// Start saving the RDB file in the background.
+func (s *Server) BgsaveRdb() error {
+	return s.bgsave(s.saveRdb)
+}
+
+// Start a save in the background, with save writing the file.
+func (s *Server) bgsave(save func() error) error {
+	if err := s.startSave(); err != nil {
+		return err
+	}
+	go func() {
+		defer s.reportCrashes()
+		start := time.Now()
+		err := save()
+		if err != nil {
+			s.Log.Error("Background saving error", "err", err)
+		} else {
+			s.Log.Info("Background saving terminated with success")
+		}
+		s.finishSave(err, time.Since(start))
+	}()
+	return nil
+}
+
+func (s *Server) startSave() error {
+	if s.RdbDir == "" || s.RdbFilename == "" {
+		return errors.New("no RDB file configured")
+	}
+	s.save.mutex.Lock()
+	defer s.save.mutex.Unlock()
+	if s.save.inProgress {
+		return errSaveInProgress
+	}
+	s.save.inProgress = true
+	s.save.lastAttempt = s.now()
+	return nil
+}
+
+func (s *Server) finishSave(err error, bgDuration time.Duration) {
+	s.save.mutex.Lock()
+	defer s.save.mutex.Unlock()
+	s.save.inProgress = false
+	s.save.lastStatusOK = err == nil
+	if bgDuration > 0 {
+		s.save.lastBgDuration = bgDuration
+	}
+	if err == nil {
+		s.save.lastSave = s.save.lastAttempt
+	}
+}
+
+// Write the RDB file to a temporary file first, and then move it into place, so that
+// the existing file is never left half-written. The delta files of checkpoints are
+// removed then, as the RDB file includes them.
+func (s *Server) saveRdb() (err error) {
+	dirty := s.save.dirty.Load()
+	var keys *sync.Map
+	s.startSnapshot(func() { keys = s.checkpoint.dirty.swap(s.RdbIncremental.Load()) })
+	defer s.endSnapshot()
+	defer func() {
+		if err != nil {
+			s.checkpoint.dirty.putBack(keys)
+		}
+	}()
+
+	tmp := filepath.Join(s.RdbDir, fmt.Sprintf("temp-%d.rdb", os.Getpid()))
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp) // no-op once renamed
+
+	err = s.writeRdb(file)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(s.RdbDir, s.RdbFilename)); err != nil {
+		return err
+	}
+	s.removeDeltaFiles()
+
+	// Changes made while saving didn't make it into the file, those made right before
+	// the snapshot did but are counted as unsaved anyway, to be on the safe side
+	s.save.dirty.Add(-dirty)
+	return nil
+}
+
+// Return the save point that has been reached, if any.
+func (s *Server) savePointReached(now time.Time) (SavePoint, bool) {
+	s.save.mutex.Lock()
+	defer s.save.mutex.Unlock()
+	if s.save.inProgress {
+		return SavePoint{}, false
+	}
+	if !s.save.lastStatusOK && now.Sub(s.save.lastAttempt) < bgsaveRetryDelay {
+		return SavePoint{}, false
+	}
+
+	dirty := s.save.dirty.Load()
+	for _, point := range s.SavePoints {
+		if dirty >= int64(point.Changes) && now.Sub(s.save.lastSave) >= time.Duration(point.Seconds)*time.Second {
+			return point, true
+		}
+	}
+	return SavePoint{}, false
+}
+
+// Check the save points every second, starting a background save when one is reached.
+func (s *Server) saveCron() {
+	defer s.reportCrashes()
+	if s.RdbDir == "" || s.RdbFilename == "" {
+		return
+	}
+	for now := range time.Tick(time.Second) {
+		point, ok := s.savePointReached(now)
+		if !ok {
+			continue
+		}
+		s.Log.Info("Saving...", "changes", point.Changes, "seconds", point.Seconds)
+		save := s.BgsaveRdb
+		if s.checkpointDue() {
+			save = s.BgCheckpointRdb
+		}
+		if err := save(); err != nil && !errors.Is(err, errSaveInProgress) {
+			s.Log.Error("Can't start background save", "err", err)
+		}
+	}
+}
+
+func (s *Session) doSAVE(cmds []string) *UserError {
+	if err := s.server.SaveRdb(); err != nil {
+		return &UserError{"ERR", err.Error()}
+	}
+	s.conn.Write(resp3.OK)
+	return nil
+}
+
+func (s *Session) doBGSAVE(cmds []string) *UserError {
+	if err := s.server.BgsaveRdb(); err != nil {
+		return &UserError{"ERR", err.Error()}
+	}
+	s.conn.Write([]byte("+Background saving started\r\n"))
+	return nil
+}
+
+func (s *Session) doLASTSAVE(cmds []string) *UserError {
+	s.server.save.mutex.Lock()
+	lastSave := s.server.save.lastSave
+	s.server.save.mutex.Unlock()
+	s.writeInt(lastSave.Unix())
+	return nil
+}
+
+func (s *Server) infoPersistence() []string {
+	s.save.mutex.Lock()
+	defer s.save.mutex.Unlock()
+
+	bgsaveStatus := "ok"
+	if !s.save.lastStatusOK {
+		bgsaveStatus = "err"
+	}
+	lastBgDuration := -1
+	if s.save.lastBgDuration > 0 {
+		lastBgDuration = int(s.save.lastBgDuration.Seconds())
+	}
+	return []string{
+		"loading:0",
+		"rdb_changes_since_last_save:" + strconv.FormatInt(s.save.dirty.Load(), 10),
+		"rdb_bgsave_in_progress:" + boolToInfo(s.save.inProgress),
+		"rdb_last_save_time:" + strconv.FormatInt(s.save.lastSave.Unix(), 10),
+		"rdb_last_bgsave_status:" + bgsaveStatus,
+		"rdb_last_bgsave_time_sec:" + strconv.Itoa(lastBgDuration),
+		"rdb_incremental:" + boolToInfo(s.RdbIncremental.Load()),
+		"rdb_delta_files:" + strconv.FormatInt(s.checkpoint.segments.Load(), 10),
+	}
+}
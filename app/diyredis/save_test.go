@@ -0,0 +1,97 @@
+package diyredis
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSavePointsFlag(t *testing.T) {
+	var points SavePoints
+	if err := points.Set("3600 1 300 100"); err != nil {
+		t.Fatal(err)
+	}
+	if len(points) != 2 || points[1] != (SavePoint{300, 100}) {
+		t.Errorf("got %v", points)
+	}
+	if got := points.String(); got != "3600 1 300 100" {
+		t.Errorf("got %q", got)
+	}
+	if err := points.Set(""); err != nil || len(points) != 0 {
+		t.Errorf("got (%v, %v) for an empty value, want no save points", points, err)
+	}
+	for _, bad := range []string{"3600", "x 1", "0 1", "60 -1"} {
+		if err := points.Set(bad); err == nil {
+			t.Errorf("no error for %q", bad)
+		}
+	}
+}
+
+func TestSavePointReached(t *testing.T) {
+	server := MakeServer()
+	server.SavePoints = SavePoints{{60, 3}}
+	now := server.save.lastSave
+
+	server.markDirty(3)
+	if _, ok := server.savePointReached(now.Add(59 * time.Second)); ok {
+		t.Errorf("save point reached too early")
+	}
+	server.save.dirty.Store(2)
+	if _, ok := server.savePointReached(now.Add(61 * time.Second)); ok {
+		t.Errorf("save point reached with too few changes")
+	}
+	server.markDirty(1)
+	if _, ok := server.savePointReached(now.Add(61 * time.Second)); !ok {
+		t.Errorf("save point not reached")
+	}
+
+	// Back off after a failed save
+	server.save.lastStatusOK = false
+	server.save.lastAttempt = now.Add(60 * time.Second)
+	if _, ok := server.savePointReached(now.Add(61 * time.Second)); ok {
+		t.Errorf("retried a failed save immediately")
+	}
+}
+
+func TestSave(t *testing.T) {
+	server := MakeServer()
+	server.RdbDir = t.TempDir()
+	server.RdbFilename = "dump.rdb"
+	session, conn := newTestSession(server)
+
+	session.dispatch([]string{"SET", "foo", "bar"})
+	session.dispatch([]string{"MSET", "a", "1", "b", "2"})
+	if got := server.save.dirty.Load(); got != 3 {
+		t.Errorf("got %d changes, want 3", got)
+	}
+
+	conn.buf.Reset()
+	session.dispatch([]string{"SAVE"})
+	if got := conn.buf.String(); got != "+OK\r\n" {
+		t.Fatalf("got %q", got)
+	}
+	if got := server.save.dirty.Load(); got != 0 {
+		t.Errorf("got %d changes after saving, want 0", got)
+	}
+	if _, err := os.Stat(filepath.Join(server.RdbDir, "dump.rdb")); err != nil {
+		t.Error(err)
+	}
+
+	loaded := MakeServer()
+	loaded.RdbDir, loaded.RdbFilename = server.RdbDir, server.RdbFilename
+	if err := loaded.LoadRdb(); err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := loadString(loaded.dbs[0], "b"); value != "2" {
+		t.Errorf("got %v for b, want 2", value)
+	}
+
+	conn.buf.Reset()
+	session.dispatch([]string{"INFO", "persistence"})
+	if got := conn.buf.String(); !strings.Contains(got, "rdb_changes_since_last_save:0\r\n") ||
+		!strings.Contains(got, "rdb_last_bgsave_status:ok\r\n") {
+		t.Errorf("got %q", got)
+	}
+}
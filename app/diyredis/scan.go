@@ -0,0 +1,156 @@
+package diyredis
+
+import (
+	"cmp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	crc64 "github.com/codecrafters-io/redis-starter-go/app/diyredis/crc64"
+)
+
+// The default COUNT of SCAN.
+const scanDefaultCount = 10
+
+// SCAN cursor [MATCH pattern] [COUNT count] [TYPE type]
+//
+// Keys are visited in the order of their scanHash, the cursor being the hash to carry on
+// from, so that every key that exists throughout is returned, and only once, however the
+// keyspace changes in between: a sync.Map has nothing like the buckets of Redis' hash
+// tables to walk through instead, so the database keeps a scanIndex of its keys in that
+// order. As with Redis, COUNT is how many keys are looked at, MATCH and TYPE then
+// filtering those, so that a call may return none even if there are more to come.
+func (s *Session) doSCAN(cmds []string) *UserError {
+	if len(cmds) < 2 {
+		return &UserError{"ERR", "wrong number of arguments for SCAN command"}
+	}
+	cursor, err := strconv.ParseUint(cmds[1], 10, 64)
+	if err != nil {
+		return &UserError{"ERR", "invalid cursor"}
+	}
+	pattern, wantType, count := "*", "", int64(scanDefaultCount)
+	args := newArgScanner(cmds, 2)
+	for !args.done() {
+		var uerr *UserError
+		switch args.acceptToken("match", "count", "type") {
+		case "match":
+			pattern, uerr = args.read()
+		case "count":
+			if count, uerr = args.readInt(); uerr == nil && count < 1 {
+				uerr = ErrSyntax()
+			}
+		case "type":
+			wantType, uerr = args.read()
+			wantType = strings.ToLower(wantType)
+		default:
+			uerr = ErrSyntax()
+		}
+		if uerr != nil {
+			return uerr
+		}
+	}
+
+	candidates, next := s.db.ordered.from(cursor, int(count))
+	keys := make([]string, 0, len(candidates))
+	for _, key := range candidates {
+		if !globMatch(pattern, key) {
+			continue
+		}
+		if value, _, ok := s.db.peek(key); ok && (wantType == "" || typeName(value) == wantType) {
+			keys = append(keys, key)
+		}
+	}
+	encoder := s.encoder()
+	encoder.WriteArrHeader(2)
+	encoder.WriteBulkStr(strconv.FormatUint(next, 10))
+	encoder.WriteArrHeader(len(keys))
+	for _, key := range keys {
+		encoder.WriteBulkStr(key)
+	}
+	s.conn.Write(encoder.Buf)
+	return nil
+}
+
+// The hash SCAN orders keys by, which its cursors are made of. It's the same for the same
+// key on any server, as the cluster's key slots are, so that a cursor carries on where it
+// left off even if the database was replaced in between, e.g. by a full resync.
+func scanHash(key string) uint64 {
+	return crc64.Digest([]byte(key))
+}
+
+// How many buckets, by the top bits of their scanHash, a scanIndex spreads keys over.
+const scanIndexBits = 12
+
+// The keys of a database, ordered by their scanHash for SCAN to go through. They're
+// spread over buckets by the top bits of their hash, each bucket kept sorted, so that
+// adding or removing a key only shifts the keys of its bucket, and carrying on from a
+// cursor only looks at the keys returned.
+type scanIndex struct {
+	mutex   sync.RWMutex
+	buckets [][]scanKey // made as the first key is added
+}
+
+type scanKey struct {
+	hash uint64
+	key  string
+}
+
+func compareScanKeys(a, b scanKey) int {
+	return cmp.Or(cmp.Compare(a.hash, b.hash), strings.Compare(a.key, b.key))
+}
+
+func newScanIndex() *scanIndex {
+	return &scanIndex{}
+}
+
+// Bring the index up to date after key was changed, exists telling whether it's there
+// now, as keyIndex.update does.
+func (x *scanIndex) update(key string, exists func() bool) {
+	entry := scanKey{scanHash(key), key}
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	present := exists()
+	if x.buckets == nil {
+		if !present {
+			return
+		}
+		x.buckets = make([][]scanKey, 1<<scanIndexBits)
+	}
+	bucket := &x.buckets[entry.hash>>(64-scanIndexBits)]
+	i, indexed := slices.BinarySearchFunc(*bucket, entry, compareScanKeys)
+	switch {
+	case present && !indexed:
+		*bucket = slices.Insert(*bucket, i, entry)
+	case !present && indexed:
+		*bucket = slices.Delete(*bucket, i, i+1)
+	}
+}
+
+// The first count keys with a hash of cursor or higher, along with the hash to carry on
+// from next time, or 0 if there are no more. Keys sharing a hash go together, so that
+// the cursor doesn't have to tell them apart: there may be more than count.
+func (x *scanIndex) from(cursor uint64, count int) ([]string, uint64) {
+	x.mutex.RLock()
+	defer x.mutex.RUnlock()
+	var keys []string
+	var last uint64
+	first := int(cursor >> (64 - scanIndexBits))
+	for b := first; b < len(x.buckets); b++ {
+		bucket := x.buckets[b]
+		if b == first {
+			i, _ := slices.BinarySearchFunc(bucket, cursor, func(k scanKey, cursor uint64) int {
+				return cmp.Compare(k.hash, cursor)
+			})
+			bucket = bucket[i:]
+		}
+		for _, k := range bucket {
+			if len(keys) >= count && k.hash != last {
+				return keys, k.hash
+			}
+			keys = append(keys, k.key)
+			last = k.hash
+		}
+	}
+	return keys, 0 // done
+}
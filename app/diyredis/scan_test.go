@@ -0,0 +1,155 @@
+package diyredis
+
+import (
+	"bufio"
+	"cmp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestScan(t *testing.T) {
+	server := MakeServer()
+	session, conn := newTestSession(server)
+	run := func(cmd ...string) string {
+		conn.buf.Reset()
+		session.dispatch(cmd)
+		return conn.buf.String()
+	}
+	// Iterate over the keys in as many calls as it takes, calling between in between,
+	// and count how many times each key was returned
+	scan := func(between func(), args ...string) map[string]int {
+		t.Helper()
+		seen := map[string]int{}
+		cursor := "0"
+		for calls := 0; ; calls++ {
+			reply := run(append([]string{"SCAN", cursor}, args...)...)
+			parsed, err := readReply(bufio.NewReader(strings.NewReader(reply)))
+			arr, ok := parsed.([]any)
+			if err != nil || !ok || len(arr) != 2 || calls > 1000 {
+				t.Fatalf("got %q", reply)
+			}
+			cursor = arr[0].(string)
+			for _, key := range arr[1].([]any) {
+				seen[key.(string)]++
+			}
+			if cursor == "0" {
+				return seen
+			}
+			between()
+		}
+	}
+
+	for i := range 100 {
+		run("SET", "str:"+strconv.Itoa(i), "value")
+		run("RPUSH", "list:"+strconv.Itoa(i), "elem")
+	}
+	run("XADD", "stream", "*", "field", "value")
+
+	seen := scan(func() {}, "COUNT", "7")
+	if len(seen) != 201 {
+		t.Errorf("got %d keys, want 201", len(seen))
+	}
+	for key, times := range seen {
+		if times != 1 {
+			t.Errorf("got %s %d times", key, times)
+		}
+	}
+
+	// A cursor is down to the keys alone, not to the server, e.g. to carry on after a full
+	// resync
+	cursor := strconv.FormatUint(scanHash("str:5"), 10)
+	if got := run("SCAN", cursor, "COUNT", "1"); !strings.HasSuffix(got, "*1\r\n$5\r\nstr:5\r\n") {
+		t.Errorf("SCAN %s: got %q, want str:5 first", cursor, got)
+	}
+
+	if seen := scan(func() {}, "TYPE", "stream"); len(seen) != 1 || seen["stream"] != 1 {
+		t.Errorf("TYPE stream: got %v", seen)
+	}
+	if seen := scan(func() {}, "MATCH", "list:1?", "TYPE", "LIST", "COUNT", "1000"); len(seen) != 10 {
+		t.Errorf("MATCH list:1? TYPE list: got %v", seen)
+	}
+	if seen := scan(func() {}, "MATCH", "list:1?", "TYPE", "string"); len(seen) != 0 {
+		t.Errorf("MATCH list:1? TYPE string: got %v", seen)
+	}
+
+	// Keys that exist throughout are returned anyway, once, whatever else changes
+	added := 0
+	seen = scan(func() {
+		run("DEL", "str:"+strconv.Itoa(added))
+		run("SET", "new:"+strconv.Itoa(added), "value")
+		added++
+	}, "COUNT", "3")
+	for i := range 100 {
+		key := "list:" + strconv.Itoa(i)
+		if seen[key] != 1 {
+			t.Errorf("got %s %d times", key, seen[key])
+		}
+	}
+	for key, times := range seen {
+		if times != 1 {
+			t.Errorf("got %s %d times", key, times)
+		}
+	}
+
+	for _, tc := range []struct {
+		cmd  []string
+		want string
+	}{
+		{[]string{"SCAN", "x"}, "-ERR invalid cursor\r\n"},
+		{[]string{"SCAN", "0", "COUNT", "0"}, "-ERR syntax error\r\n"},
+		{[]string{"SCAN", "0", "COUNT"}, "-ERR syntax error\r\n"},
+		{[]string{"SCAN", "0", "FILTER", "x"}, "-ERR syntax error\r\n"},
+	} {
+		if got := run(tc.cmd...); got != tc.want {
+			t.Errorf("%q: got %q, want %q", tc.cmd, got, tc.want)
+		}
+	}
+}
+
+func TestScanIndex(t *testing.T) {
+	var m sync.Map
+	x := newScanIndex()
+	update := func(key string) {
+		x.update(key, func() bool {
+			_, ok := m.Load(key)
+			return ok
+		})
+	}
+	if keys, next := x.from(0, 10); len(keys) != 0 || next != 0 {
+		t.Errorf("empty: got %v, %d", keys, next)
+	}
+	var want []string
+	for i := range 1000 {
+		key := strconv.Itoa(i)
+		m.Store(key, i)
+		update(key)
+		if i%3 != 0 {
+			want = append(want, key)
+		}
+	}
+	update("1") // already there
+	for i := 0; i < 1000; i += 3 {
+		m.Delete(strconv.Itoa(i))
+		update(strconv.Itoa(i))
+	}
+	update("missing")
+	slices.SortFunc(want, func(a, b string) int { return cmp.Compare(scanHash(a), scanHash(b)) })
+
+	var got []string
+	for cursor, calls := uint64(0), 0; ; calls++ {
+		keys, next := x.from(cursor, 7)
+		if len(keys) < 7 && next != 0 || calls > 1000 {
+			t.Fatalf("got %v, %d from %d", keys, next, cursor)
+		}
+		got = append(got, keys...)
+		if cursor = next; cursor == 0 {
+			break
+		}
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
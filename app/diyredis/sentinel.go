@@ -0,0 +1,695 @@
+package diyredis
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	resp3 "github.com/codecrafters-io/redis-starter-go/app/diyredis/resp3"
+)
+
+// Sentinel mode: instead of serving a dataset, watch over masters and their replicas,
+// and fail over to a replica when a master is down.
+//
+// A master is subjectively down (sdown) once it hasn't replied to PING for
+// SentinelDownAfter, and objectively down (odown) once at least its quorum of sentinels,
+// this one included, say so. The sentinel that sees it objectively down then asks the
+// others for their vote in a new epoch, and if it gets a majority, promotes the replica
+// with the largest offset and points the other replicas at it.
+//
+// This is a much simplified version of Redis Sentinel. There is no Pub/Sub, so
+// sentinels don't discover each other: the ones watching a master are configured
+// along with it. Other sentinels learn about a failover by seeing one of the replicas
+// of a master that is down become a master.
+
+// A master to watch over, as configured.
+type SentinelMaster struct {
+	Name      string
+	Host      string
+	Port      string
+	Quorum    int      // sentinels that have to agree the master is down
+	Sentinels []string // addresses of the other sentinels watching it
+}
+
+type sentinelState struct {
+	mutex   sync.Mutex
+	id      string // run ID, for voting
+	epoch   int64  // highest epoch seen
+	masters map[string]*watchedMaster
+	ctx     context.Context // canceled to stop watching
+	stop    context.CancelFunc
+	wg      sync.WaitGroup
+}
+
+type watchedMaster struct {
+	SentinelMaster // Host and Port change on failover
+	lastReply      time.Time
+	replicas       map[string]*watchedReplica // by address
+	checks         int                        // of the replicas, so far
+	sdown          bool
+	odown          bool
+	leader         string // who we voted for to do the failover, in leaderEpoch
+	leaderEpoch    int64
+	nextFailover   time.Time // don't try to fail over again before this
+	failovers      int
+}
+
+type watchedReplica struct {
+	host      string
+	port      string
+	lastReply time.Time
+	lastCheck int    // the check of the replicas it last replied to, see watchedMaster.checks
+	role      string // "master" or "slave", as the replica says
+	master    string // address of its master, as the replica says
+	linkUp    bool
+	offset    int64
+}
+
+// Start watching over the configured masters.
+func (s *Server) startSentinel() {
+	ctx, cancel := context.WithCancel(context.Background())
+	st := &s.sentinel
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	st.id = newReplicationID() // the same kind of random ID
+	st.ctx, st.stop = ctx, cancel
+	st.masters = make(map[string]*watchedMaster)
+	for _, config := range s.SentinelMasters {
+		s.watchMaster(config)
+	}
+}
+
+// Start watching over a master. Must be called with the sentinel mutex held.
+func (s *Server) watchMaster(config SentinelMaster) {
+	m := &watchedMaster{
+		SentinelMaster: config,
+		lastReply:      time.Now(), // give it a chance
+		replicas:       make(map[string]*watchedReplica),
+	}
+	s.sentinel.masters[config.Name] = m
+	s.sentinel.wg.Add(1)
+	go func() {
+		defer s.reportCrashes()
+		defer s.sentinel.wg.Done()
+		s.sentinelLoop(s.sentinel.ctx, m)
+	}()
+}
+
+func (s *Server) stopSentinel() {
+	if s.sentinel.stop != nil {
+		s.sentinel.stop()
+		s.sentinel.wg.Wait()
+	}
+}
+
+// How often masters and replicas are checked on.
+func (s *Server) sentinelPeriod() time.Duration {
+	return min(time.Second, s.SentinelDownAfter/4)
+}
+
+// How long masters, replicas and other sentinels get to reply, however often they are
+// checked on, so that one that's slow to reply isn't taken for one that's gone.
+const sentinelTimeout = time.Second
+
+// The number of checks of the replicas a replica may have missed the last of and still
+// be promoted: what it said about itself before that is too old to go by.
+const sentinelReplicaValidChecks = 3
+
+func (s *Server) sentinelLoop(ctx context.Context, m *watchedMaster) {
+	log := s.Log.With("master", m.Name)
+	ticker := time.NewTicker(s.sentinelPeriod())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		up := s.checkMaster(m)
+		s.checkReplicas(m, up, log)
+		if s.masterObjectivelyDown(m, log) {
+			s.tryFailover(m, log)
+		}
+	}
+}
+
+// PING the master, and learn about its replicas from INFO. Returns whether it replied,
+// as a master.
+func (s *Server) checkMaster(m *watchedMaster) bool {
+	s.sentinel.mutex.Lock()
+	addr := net.JoinHostPort(m.Host, m.Port)
+	s.sentinel.mutex.Unlock()
+
+	replies, err := sentinelRequest(addr, sentinelTimeout, []string{"PING"}, []string{"INFO", "replication"})
+	s.sentinel.mutex.Lock()
+	defer s.sentinel.mutex.Unlock()
+	if err != nil || replies[0] != "PONG" {
+		return false
+	}
+	m.lastReply = time.Now()
+	info, _ := replies[1].(string)
+	fields := parseInfo(info)
+	if fields["role"] != "master" {
+		return false
+	}
+	for key, value := range fields {
+		if !strings.HasPrefix(key, "slave") || !strings.Contains(value, "ip=") {
+			continue
+		}
+		replica := parseInfoList(value)
+		replicaAddr := net.JoinHostPort(replica["ip"], replica["port"])
+		if _, ok := m.replicas[replicaAddr]; !ok {
+			m.replicas[replicaAddr] = &watchedReplica{host: replica["ip"], port: replica["port"]}
+		}
+	}
+	return true
+}
+
+// Check on the replicas of m, reconfiguring any that doesn't replicate m, e.g. an old
+// master coming back after a failover, as long as m is up. If m is down and one of its
+// replicas has become a master, another sentinel failed over to it, so watch over that
+// one instead.
+func (s *Server) checkReplicas(m *watchedMaster, masterUp bool, log *slog.Logger) {
+	s.sentinel.mutex.Lock()
+	replicas := make([]*watchedReplica, 0, len(m.replicas))
+	for _, replica := range m.replicas {
+		replicas = append(replicas, replica)
+	}
+	m.checks++
+	check := m.checks
+	s.sentinel.mutex.Unlock()
+
+	for _, replica := range replicas {
+		replies, err := sentinelRequest(net.JoinHostPort(replica.host, replica.port), sentinelTimeout, []string{"INFO", "replication"})
+		if err != nil {
+			continue
+		}
+		info, _ := replies[0].(string)
+		fields := parseInfo(info)
+		offset, _ := strconv.ParseInt(fields["slave_repl_offset"], 10, 64)
+
+		s.sentinel.mutex.Lock()
+		replica.lastReply = time.Now()
+		replica.lastCheck = check
+		replica.role = fields["role"]
+		replica.master = net.JoinHostPort(fields["master_host"], fields["master_port"])
+		replica.linkUp = fields["master_link_status"] == "up"
+		replica.offset = offset
+		masterHost, masterPort := m.Host, m.Port
+		masterAddr := net.JoinHostPort(masterHost, masterPort)
+		promoted := replica.role == "master" && m.sdown
+		if promoted {
+			log.Info("Replica became the master", "addr", net.JoinHostPort(replica.host, replica.port))
+			m.switchTo(replica)
+		}
+		wrongMaster := masterUp && (replica.role == "master" || replica.master != masterAddr)
+		s.sentinel.mutex.Unlock()
+
+		if wrongMaster {
+			log.Info("Reconfiguring replica", "addr", net.JoinHostPort(replica.host, replica.port))
+			sentinelRequest(net.JoinHostPort(replica.host, replica.port), sentinelTimeout, []string{"REPLICAOF", masterHost, masterPort})
+		}
+		if promoted {
+			return // the others are checked against the new master next time
+		}
+	}
+}
+
+// Watch over replica as the master from now on, with the old master as one of its
+// replicas, to be reconfigured once it's back. Must be called with the sentinel mutex
+// held.
+func (m *watchedMaster) switchTo(replica *watchedReplica) {
+	old := &watchedReplica{host: m.Host, port: m.Port}
+	delete(m.replicas, net.JoinHostPort(replica.host, replica.port))
+	m.replicas[net.JoinHostPort(old.host, old.port)] = old
+	m.Host, m.Port = replica.host, replica.port
+	m.lastReply = time.Now()
+	m.sdown, m.odown = false, false
+	m.failovers++
+}
+
+// Update whether m is subjectively and objectively down, asking the other sentinels for
+// the latter.
+func (s *Server) masterObjectivelyDown(m *watchedMaster, log *slog.Logger) bool {
+	s.sentinel.mutex.Lock()
+	sdown := time.Since(m.lastReply) > s.SentinelDownAfter
+	if sdown != m.sdown {
+		log.Info("Master subjectively down changed", "sdown", sdown)
+	}
+	m.sdown = sdown
+	if !sdown {
+		m.odown = false
+		s.sentinel.mutex.Unlock()
+		return false
+	}
+	host, port, quorum, peers := m.Host, m.Port, m.Quorum, slices.Clone(m.Sentinels)
+	epoch := s.sentinel.epoch
+	s.sentinel.mutex.Unlock()
+
+	down := 1 // ourselves
+	for _, peer := range peers {
+		reply, err := s.askSentinel(peer, host, port, epoch, "*")
+		if err == nil && reply.down {
+			down++
+		}
+	}
+
+	s.sentinel.mutex.Lock()
+	defer s.sentinel.mutex.Unlock()
+	odown := down >= quorum
+	if odown != m.odown {
+		log.Info("Master objectively down changed", "odown", odown, "sentinels", down)
+	}
+	m.odown = odown
+	return odown
+}
+
+type sentinelReply struct {
+	down        bool
+	leader      string
+	leaderEpoch int64
+}
+
+// SENTINEL IS-MASTER-DOWN-BY-ADDR, asking for the sentinel's vote too unless runID is "*".
+func (s *Server) askSentinel(addr string, host string, port string, epoch int64, runID string) (sentinelReply, error) {
+	replies, err := sentinelRequest(addr, sentinelTimeout, []string{
+		"SENTINEL", "IS-MASTER-DOWN-BY-ADDR", host, port, strconv.FormatInt(epoch, 10), runID,
+	})
+	if err != nil {
+		return sentinelReply{}, err
+	}
+	arr, ok := replies[0].([]any)
+	if !ok || len(arr) != 3 {
+		return sentinelReply{}, fmt.Errorf("unexpected reply %v", replies[0])
+	}
+	down, _ := arr[0].(int64)
+	leader, _ := arr[1].(string)
+	leaderEpoch, _ := arr[2].(int64)
+	return sentinelReply{down == 1, leader, leaderEpoch}, nil
+}
+
+// Get elected by the other sentinels in a new epoch, and if that works out, promote the
+// best replica of m.
+func (s *Server) tryFailover(m *watchedMaster, log *slog.Logger) {
+	s.sentinel.mutex.Lock()
+	if time.Now().Before(m.nextFailover) {
+		s.sentinel.mutex.Unlock()
+		return
+	}
+	// Spread out the attempts of different sentinels, so that one of them gets elected
+	wait := s.SentinelDownAfter + rand.N(s.SentinelDownAfter)
+	m.nextFailover = time.Now().Add(wait)
+	// Getting elected without a replica to promote would only hold up a sentinel that has
+	// one
+	if m.bestReplica() == nil {
+		s.sentinel.mutex.Unlock()
+		log.Warn("No replica to fail over to")
+		return
+	}
+	s.sentinel.epoch++
+	epoch := s.sentinel.epoch
+	m.leader, m.leaderEpoch = s.sentinel.id, epoch
+	host, port, peers := m.Host, m.Port, slices.Clone(m.Sentinels)
+	needed := max(m.Quorum, (len(peers)+1)/2+1)
+	s.sentinel.mutex.Unlock()
+
+	votes := 1 // our own
+	for _, peer := range peers {
+		reply, err := s.askSentinel(peer, host, port, epoch, s.sentinel.id)
+		if err == nil && reply.leader == s.sentinel.id && reply.leaderEpoch == epoch {
+			votes++
+		}
+	}
+	if votes < needed {
+		log.Info("Not elected to fail over", "epoch", epoch, "votes", votes, "needed", needed)
+		return
+	}
+	log.Info("Elected to fail over", "epoch", epoch, "votes", votes)
+
+	s.sentinel.mutex.Lock()
+	best := m.bestReplica()
+	s.sentinel.mutex.Unlock()
+	if best == nil {
+		log.Warn("No replica to fail over to")
+		return
+	}
+
+	bestAddr := net.JoinHostPort(best.host, best.port)
+	replies, err := sentinelRequest(bestAddr, sentinelTimeout, []string{"REPLICAOF", "NO", "ONE"})
+	if err != nil || replies[0] != "OK" {
+		log.Warn("Failed to promote replica", "addr", bestAddr, "err", err, "reply", replies)
+		return
+	}
+	log.Info("Promoted replica to master", "addr", bestAddr)
+
+	s.sentinel.mutex.Lock()
+	m.switchTo(best)
+	var others []string
+	for addr, replica := range m.replicas {
+		if replica.host != host || replica.port != port { // the old master is down
+			others = append(others, addr)
+		}
+	}
+	s.sentinel.mutex.Unlock()
+	for _, addr := range others {
+		sentinelRequest(addr, sentinelTimeout, []string{"REPLICAOF", best.host, best.port})
+	}
+}
+
+// The replica of m to promote: the one furthest along among those that replied to one of
+// the last few checks, as a replica. nil if there is none. Must be called with the
+// sentinel mutex held.
+func (m *watchedMaster) bestReplica() *watchedReplica {
+	var best *watchedReplica
+	for addr, replica := range m.replicas {
+		if replica.role != "slave" || m.checks-replica.lastCheck >= sentinelReplicaValidChecks {
+			continue
+		}
+		// Ties go to the lowest address, so that sentinels agree when offsets do
+		bestAddr := ""
+		if best != nil {
+			bestAddr = net.JoinHostPort(best.host, best.port)
+		}
+		if best == nil || replica.offset > best.offset || replica.offset == best.offset && addr < bestAddr {
+			best = replica
+		}
+	}
+	return best
+}
+
+// Send cmds to the server at addr on a new connection, and return its replies. Error
+// replies are returned as error values among the replies.
+func sentinelRequest(addr string, timeout time.Duration, cmds ...[]string) ([]any, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	var buf []byte
+	for _, cmd := range cmds {
+		buf = append(buf, makeRESPArr(cmd)...)
+	}
+	if _, err := conn.Write(buf); err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	replies := make([]any, len(cmds))
+	for i := range replies {
+		if replies[i], err = readReply(reader); err != nil {
+			return nil, err
+		}
+	}
+	return replies, nil
+}
+
+// Read a RESP2 reply: a string (simple or bulk), an int64, an error, a []any, or nil.
+func readReply(reader *bufio.Reader) (any, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("malformed reply %q", line)
+	}
+	line = line[:len(line)-2]
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return errors.New(line[1:]), nil
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		length, err := strconv.Atoi(line[1:])
+		if err != nil || length < 0 {
+			return nil, err
+		}
+		buf := make([]byte, length+2)
+		if _, err := io.ReadFull(reader, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:length]), nil
+	case '*':
+		length, err := strconv.Atoi(line[1:])
+		if err != nil || length < 0 {
+			return nil, err
+		}
+		arr := make([]any, length)
+		for i := range arr {
+			if arr[i], err = readReply(reader); err != nil {
+				return nil, err
+			}
+		}
+		return arr, nil
+	}
+	return nil, fmt.Errorf("unknown reply type %q", line)
+}
+
+// Parse the "field:value" lines of INFO.
+func parseInfo(info string) map[string]string {
+	fields := make(map[string]string)
+	for _, line := range strings.Split(info, "\r\n") {
+		if field, value, ok := strings.Cut(line, ":"); ok && !strings.HasPrefix(line, "#") {
+			fields[field] = value
+		}
+	}
+	return fields
+}
+
+// Parse an INFO value like "ip=127.0.0.1,port=6380,state=online".
+func parseInfoList(value string) map[string]string {
+	fields := make(map[string]string)
+	for _, pair := range strings.Split(value, ",") {
+		if k, v, ok := strings.Cut(pair, "="); ok {
+			fields[k] = v
+		}
+	}
+	return fields
+}
+
+var sentinelHelp = []string{
+	"GET-MASTER-ADDR-BY-NAME <master-name>",
+	"    Return the ip and port number of the master with that name.",
+	"IS-MASTER-DOWN-BY-ADDR <ip> <port> <current-epoch> <runid>",
+	"    Check if the master at ip:port is down, voting for <runid> to fail it over.",
+	"MASTER <master-name>",
+	"    Show the state and info of the specified master.",
+	"MASTERS",
+	"    Show a list of monitored masters and their state.",
+	"MONITOR <name> <ip> <port> <quorum>",
+	"    Start monitoring a new master with the specified name, ip, port and quorum.",
+	"MYID",
+	"    Return the ID of the Sentinel instance.",
+	"REPLICAS <master-name>",
+	"    Show a list of replicas for this master and their state.",
+	"SENTINELS <master-name>",
+	"    Show a list of Sentinel instances for this master and their state.",
+}
+
+func (s *Session) doSENTINEL(cmds []string) *UserError {
+	if !s.server.Sentinel {
+		return &UserError{"ERR", "Command not known"}
+	}
+	if len(cmds) < 2 {
+		return &UserError{"ERR", "wrong number of arguments for SENTINEL command"}
+	}
+	st := &s.server.sentinel
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	wantArgs := map[string]int{
+		"masters": 2, "myid": 2, "master": 3, "replicas": 3, "slaves": 3, "sentinels": 3,
+		"get-master-addr-by-name": 3, "is-master-down-by-addr": 6, "monitor": 6,
+	}
+	subcommand := strings.ToLower(cmds[1])
+	if n, ok := wantArgs[subcommand]; ok && len(cmds) != n {
+		return &UserError{"ERR", "wrong number of arguments for SENTINEL " + strings.ToUpper(subcommand) + " command"}
+	}
+	var m *watchedMaster
+	switch subcommand {
+	case "master", "replicas", "slaves", "sentinels", "get-master-addr-by-name":
+		m = st.masters[cmds[2]]
+		if m == nil && subcommand != "get-master-addr-by-name" {
+			return &UserError{"ERR", "No such master with that name"}
+		}
+	}
+
+	encoder := s.encoder()
+	switch subcommand {
+	case "masters":
+		names := make([]string, 0, len(st.masters))
+		for name := range st.masters {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		encoder.WriteArrHeader(len(names))
+		for _, name := range names {
+			writeSentinelFields(&encoder, st.masters[name].fields())
+		}
+
+	case "master":
+		writeSentinelFields(&encoder, m.fields())
+
+	case "replicas", "slaves":
+		addrs := make([]string, 0, len(m.replicas))
+		for addr := range m.replicas {
+			addrs = append(addrs, addr)
+		}
+		slices.Sort(addrs)
+		encoder.WriteArrHeader(len(addrs))
+		for _, addr := range addrs {
+			writeSentinelFields(&encoder, m.replicas[addr].fields(s.server.SentinelDownAfter))
+		}
+
+	case "sentinels":
+		encoder.WriteArrHeader(len(m.Sentinels))
+		for _, addr := range m.Sentinels {
+			host, port, _ := net.SplitHostPort(addr)
+			writeSentinelFields(&encoder, [][2]string{{"name", addr}, {"ip", host}, {"port", port}})
+		}
+
+	case "get-master-addr-by-name":
+		if m == nil {
+			encoder.WriteNullArr()
+			break
+		}
+		encoder.WriteArrHeader(2)
+		encoder.WriteBulkStr(m.Host)
+		encoder.WriteBulkStr(m.Port)
+
+	case "is-master-down-by-addr":
+		epoch, err := strconv.ParseInt(cmds[4], 10, 64)
+		if err != nil {
+			return &UserError{"ERR", "value is not an integer or out of range"}
+		}
+		down := 0
+		leader, leaderEpoch := "*", int64(0)
+		for _, m := range st.masters {
+			if m.Host != cmds[2] || m.Port != cmds[3] {
+				continue
+			}
+			if m.sdown {
+				down = 1
+			}
+			if runID := cmds[5]; runID != "*" {
+				// The first to ask in an epoch gets our vote, and time to fail over
+				// before we try ourselves
+				if epoch > m.leaderEpoch {
+					m.leader, m.leaderEpoch = runID, epoch
+					st.epoch = max(st.epoch, epoch)
+					m.nextFailover = time.Now().Add(2 * s.server.SentinelDownAfter)
+				}
+				leader, leaderEpoch = m.leader, m.leaderEpoch
+			}
+		}
+		encoder.WriteArrHeader(3)
+		encoder.WriteInt(down)
+		encoder.WriteBulkStr(leader)
+		encoder.WriteInt(int(leaderEpoch))
+
+	case "monitor":
+		quorum, err := strconv.Atoi(cmds[5])
+		if err != nil || quorum <= 0 {
+			return &UserError{"ERR", "Quorum must be 1 or greater."}
+		}
+		if _, ok := st.masters[cmds[2]]; ok {
+			return &UserError{"ERR", "Duplicated master name"}
+		}
+		s.server.watchMaster(SentinelMaster{Name: cmds[2], Host: cmds[3], Port: cmds[4], Quorum: quorum})
+		encoder.WriteSimpleStr("OK")
+
+	case "myid":
+		encoder.WriteBulkStr(st.id)
+
+	default:
+		return errUnknownSubcommand(cmds)
+	}
+	s.conn.Write(encoder.Buf)
+	return nil
+}
+
+func writeSentinelFields(encoder *resp3.Encoder, fields [][2]string) {
+	encoder.WriteMapHeader(len(fields))
+	for _, field := range fields {
+		encoder.WriteBulkStr(field[0])
+		encoder.WriteBulkStr(field[1])
+	}
+}
+
+// Must be called with the sentinel mutex held.
+func (m *watchedMaster) fields() [][2]string {
+	flags := "master"
+	if m.sdown {
+		flags += ",s_down"
+	}
+	if m.odown {
+		flags += ",o_down"
+	}
+	return [][2]string{
+		{"name", m.Name},
+		{"ip", m.Host},
+		{"port", m.Port},
+		{"flags", flags},
+		{"num-slaves", strconv.Itoa(len(m.replicas))},
+		{"num-other-sentinels", strconv.Itoa(len(m.Sentinels))},
+		{"quorum", strconv.Itoa(m.Quorum)},
+		{"failovers", strconv.Itoa(m.failovers)},
+	}
+}
+
+// Must be called with the sentinel mutex held.
+func (r *watchedReplica) fields(downAfter time.Duration) [][2]string {
+	flags := "slave"
+	if time.Since(r.lastReply) > downAfter {
+		flags += ",s_down"
+	}
+	status := "err"
+	if r.linkUp {
+		status = "ok"
+	}
+	masterHost, masterPort, _ := net.SplitHostPort(r.master)
+	return [][2]string{
+		{"name", net.JoinHostPort(r.host, r.port)},
+		{"ip", r.host},
+		{"port", r.port},
+		{"flags", flags},
+		{"master-link-status", status},
+		{"master-host", masterHost},
+		{"master-port", masterPort},
+		{"slave-repl-offset", strconv.FormatInt(r.offset, 10)},
+	}
+}
+
+func (s *Server) infoSentinel() []string {
+	s.sentinel.mutex.Lock()
+	defer s.sentinel.mutex.Unlock()
+	names := make([]string, 0, len(s.sentinel.masters))
+	for name := range s.sentinel.masters {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	info := []string{"sentinel_masters:" + strconv.Itoa(len(names))}
+	for i, name := range names {
+		m := s.sentinel.masters[name]
+		status := "ok"
+		if m.odown {
+			status = "odown"
+		} else if m.sdown {
+			status = "sdown"
+		}
+		info = append(info, fmt.Sprintf("master%d:name=%s,status=%s,address=%s,slaves=%d,sentinels=%d",
+			i, name, status, net.JoinHostPort(m.Host, m.Port), len(m.replicas), len(m.Sentinels)+1))
+	}
+	return info
+}
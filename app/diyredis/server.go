@@ -1,87 +1,487 @@
 package diyredis
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
-	"log"
+	"hash/maphash"
+	"log/slog"
+	"maps"
+	"math"
 	"net"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 )
 
 type Server struct {
-	Listener    net.Listener
-	Quitch      chan os.Signal
-	wg          *sync.WaitGroup
-	dbs         []RedisDB
-	RdbDir      string
-	RdbFilename string
-}
+	Version         string // reported to clients, Version unless changed
+	build           buildInfo
+	startTime       time.Time
+	Clock           Clock // the time of day, as far as the dataset is concerned
+	Log             *slog.Logger
+	LogLevel        *slog.LevelVar  // of Log, unless Log is replaced
+	logOutput       *logOutput      // of Log, unless Log is replaced
+	ConfigFile      string          // reloaded on SIGHUP, if set
+	ConfigOverrides map[string]bool // settings given on the command line, which win over ConfigFile
+	PidFile         string          // written by Start and removed on shutdown, if set
+	Addr            string          // address to listen on, unless Listener is set before Start
+	ProtectedMode   atomic.Bool     // only accept clients from this host while listening on every interface
+	Listener        net.Listener
+	Listeners       []net.Listener // to serve clients on as well, e.g. of a transport of their own
+
+	UnixSocket     string      // also listen on this Unix socket, if set
+	UnixSocketPerm os.FileMode // of UnixSocket, 0 to leave it as the umask has it
+	TLSAddr        string      // also listen for clients using TLS on this address, if set
+	TLSConfig      *tls.Config // for TLSAddr, with the server's certificate
+
+	Quitch        chan os.Signal
+	wg            *sync.WaitGroup
+	dbs           []RedisDB // guarded by dbsMutex, since a database may be replaced as a whole
+	dbsMutex      sync.RWMutex
+	StorageEngine string                 // name of the engine the databases are stored in, see SetStorageEngine
+	newEngine     func(s *Server) Engine // makes the engine of a new database
+	Tiered        TieredConfig           // for the "tiered" storage engine
+	tiered        tieredStore
+	snapshotMutex sync.Mutex // held while a snapshot is taken, or the databases are replaced
+	RdbDir        string
+	RdbFilename   string
+	RdbLoadPolicy RdbLoadPolicy
+	RdbChecksum   bool
+	SavePoints    SavePoints
+	save          saveState
+
+	RdbIncremental         atomic.Bool  // save points write checkpoints, see CheckpointRdb
+	RdbIncrementalSegments atomic.Int64 // checkpoints on top of the RDB file before it's written in full again
+	checkpoint             checkpointState
+
+	LazyFreeLazyExpire  atomic.Bool // free the values of keys that expire in the background
+	LazyFreeLazyUserDel atomic.Bool // free the values DEL deletes in the background, as UNLINK does
+
+	LFU LFUConfig // how the access frequency of keys is counted
 
-type RedisDB struct {
-	id       uint
-	valueDB  *sync.Map
-	expiryDB *sync.Map
+	AppendOnly     bool
+	AppendDirname  string // directory, within RdbDir, holding the AOF files
+	AppendFilename string // base name of the AOF files
+
+	ClusterEnabled bool
+	cluster        *clusterState
+
+	MasterHost            string // replicate this master from the start, if set
+	MasterPort            string
+	ReplicaReadOnly       bool       // refuse writes from clients while a replica
+	ReplicaServeStaleData bool       // reply to clients while the link with the master is down
+	ReplBacklogSize       MemorySize // of propagated commands kept for replicas that reconnect
+	ReplDisklessSync      bool       // stream snapshots to replicas as they are written
+	repl                  replState
+
+	Sentinel          bool // watch over SentinelMasters, instead of serving a dataset
+	SentinelMasters   []SentinelMaster
+	SentinelDownAfter time.Duration // a master that hasn't replied for this long is down
+	sentinel          sentinelState
+
+	CommandTimeout time.Duration // 0 means no timeout
+	IdleTimeout    time.Duration // close clients that haven't sent a command in this time, 0 to never
+	ProtoLimits    ProtoLimits
+	OutputLimits   OutputBufferLimits
+	WriteTimeout   time.Duration // close clients that don't read what we write for this long, 0 to never
+	ConnLimits     ConnLimits
+	accepts        acceptGuard
+	Encoding       EncodingLimits
+	pause          clientPause
+	clients        sync.Map // *Session -> struct{}, for every connected client
+	nextClientID   atomic.Int64
+	blocking       blockingState
+	tracking       trackingState
+	lazyFree       lazyFreeState
+	journal        atomic.Pointer[Journal]  // of the commands executed, for tests; nil unless started
+	commands       map[string]*command      // by the name clients call them, see RenameCommand
+	commandStats   map[string]*commandStats // by command name, for INFO commandstats
+	recent         recentCommands           // for the crash report
 }
 
 func MakeServer() *Server {
 	var wg sync.WaitGroup
-	dbCount := 16 // 16 databases by default, just like Redis
+	logLevel := new(slog.LevelVar) // info by default
+	logOutput := &logOutput{}      // stderr by default
 	server := Server{
-		Quitch: make(chan os.Signal, 1),
-		dbs:    make([]RedisDB, dbCount),
-		wg:     &wg,
-	}
-	for i := range dbCount {
-		server.dbs[i].id = uint(i)
-		server.dbs[i].valueDB = &sync.Map{}
-		server.dbs[i].expiryDB = &sync.Map{}
+		Version:   Version,
+		build:     readBuildInfo(),
+		startTime: time.Now(),
+		Clock:     systemClock{},
+		Log:       slog.New(slog.NewTextHandler(logOutput, &slog.HandlerOptions{Level: logLevel})),
+		LogLevel:  logLevel,
+		logOutput: logOutput,
+		Addr:      "0.0.0.0:6379",
+		Quitch:    make(chan os.Signal, 1),
+		wg:        &wg,
+
+		RdbChecksum: true,
+		SavePoints:  DefaultSavePoints,
+
+		AppendDirname:  "appendonlydir",
+		AppendFilename: "appendonly.aof",
+
+		ReplicaReadOnly:       true,
+		ReplicaServeStaleData: true,
+		ReplBacklogSize:       1 << 20,
+		ReplDisklessSync:      true,
+		SentinelDownAfter:     30 * time.Second,
+
+		cluster:      newClusterState(),
+		ProtoLimits:  DefaultProtoLimits,
+		OutputLimits: DefaultOutputBufferLimits,
+		Encoding:     DefaultEncodingLimits,
+		commands:     maps.Clone(commandTable),
+		commandStats: newCommandStats(),
+
+		StorageEngine: "memory",
+		newEngine:     newMemoryEngine,
 	}
+	server.RdbIncrementalSegments.Store(DefaultRdbIncrementalSegments)
+	server.Tiered.Threshold.Store(DefaultTieredThreshold)
+	server.Tiered.HotMemory.Store(DefaultTieredHotMemory)
+	server.save.lastSave = server.now()
+	server.save.lastStatusOK = true
+	server.repl.id = newReplicationID()
+	server.repl.lastDB = -1
+	server.repl.order.seed = maphash.MakeSeed()
+	server.SetDatabases(DefaultDatabases)
+	server.ProtectedMode.Store(true)
+	server.LFU.LogFactor.Store(DefaultLFULogFactor)
+	server.LFU.DecayTime.Store(DefaultLFUDecayTime)
 	return &server
 }
 
+// A new, empty database numbered i, stored in the engine the server was set to.
+func (s *Server) newDB(i int) RedisDB {
+	return newRedisDB(uint(i), s.newEngine(s), s.now, s.keyExpired, &s.LFU, &s.checkpoint.dirty)
+}
+
+// As many as Redis has by default.
+const DefaultDatabases = 16
+
+// Set the number of databases, which SELECT numbers from 0 to n-1. They are replaced with
+// empty ones, so this is for before the dataset is loaded.
+func (s *Server) SetDatabases(n int) error {
+	if n < 1 {
+		return errors.New("there must be at least one database")
+	}
+	dbs := make([]RedisDB, n)
+	for i := range dbs {
+		dbs[i] = s.newDB(i)
+	}
+	s.dbsMutex.Lock()
+	s.dbs = dbs
+	s.dbsMutex.Unlock()
+	s.checkpoint.dirty.swap(false)
+	return nil
+}
+
+// Serve clients until the server is shut down: on Listener if it is set, or else on Addr,
+// and on Listeners, UnixSocket and TLSAddr alike.
 func (s *Server) Start() {
-	listener, err := net.Listen("tcp", "0.0.0.0:6379")
+	listeners, err := s.listen()
 	if err != nil {
-		fmt.Printf("Failed to bind to port 6379: %s", err)
+		s.Log.Error("Failed to bind", "err", err)
 		os.Exit(1)
 	}
-	defer listener.Close()
-	s.Listener = listener
+	closeListeners := func() {
+		for _, listener := range listeners {
+			listener.Close()
+		}
+	}
+	defer closeListeners()
+	for _, listener := range listeners {
+		if !s.ProtectedMode.Load() && listensEverywhere(listener) {
+			s.Log.Warn("Protected mode is disabled while listening on every interface; as there are no passwords, anyone who can reach this host can connect")
+			break
+		}
+	}
+	if s.PidFile != "" {
+		if err := os.WriteFile(s.PidFile, []byte(strconv.Itoa(os.Getpid())+"\n"), 0o644); err != nil {
+			s.Log.Warn("Failed to write the pid file", "file", s.PidFile, "err", err)
+		}
+	}
 
-	go s.serve()
+	for _, listener := range listeners {
+		go s.serve(listener)
+	}
+	go s.saveCron()
+	go s.expireCron()
+	if s.MasterHost != "" {
+		s.ReplicaOf(s.MasterHost, s.MasterPort)
+	}
+	if s.Sentinel {
+		s.startSentinel()
+	}
 	signal.Notify(s.Quitch, syscall.SIGINT, syscall.SIGTERM)
+	stopSignals := s.handleSignals()
+	defer stopSignals()
 
-	<-s.Quitch // this is blocking until it receives any message on the channel...
-	fmt.Println("Shutting Down...")
+	sig := <-s.Quitch // this is blocking until it receives any message on the channel...
+	s.Log.Info("Shutting down...")
+	if _, requested := sig.(shutdownRequest); !requested && len(s.SavePoints) > 0 {
+		// SHUTDOWN saved already, if it had to
+		if err := s.saveOnShutdown(); err != nil {
+			s.Log.Error("Error trying to save the DB on shutdown", "err", err)
+		}
+	}
+	closeListeners()
+	s.repl.linkMutex.Lock()
+	s.stopMasterLink()
+	s.repl.linkMutex.Unlock()
+	s.stopSentinel()
+	s.clients.Range(func(session any, _ any) bool {
+		session.(*Session).close()
+		return true
+	})
 	s.wg.Wait()
-	fmt.Println("Shutdown Complete")
+	s.tiered.removeDir()
+	if s.PidFile != "" {
+		os.Remove(s.PidFile)
+	}
+	s.Log.Info("Shutdown complete")
 }
 
-func (s *Server) serve() {
+// Sent on Quitch by the SHUTDOWN command.
+type shutdownRequest struct{}
+
+func (shutdownRequest) String() string { return "SHUTDOWN" }
+func (shutdownRequest) Signal()        {}
+
+// Save the RDB file one last time, waiting for any background save to finish first.
+func (s *Server) saveOnShutdown() error {
+	if s.RdbDir == "" || s.RdbFilename == "" {
+		return nil
+	}
 	for {
-		conn, err := s.Listener.Accept()
+		err := s.SaveRdb()
+		if !errors.Is(err, errSaveInProgress) {
+			return err
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Open the listeners configured that aren't open yet, returning every one to serve
+// clients on.
+func (s *Server) listen() ([]net.Listener, error) {
+	if s.Listener == nil {
+		listener, err := net.Listen("tcp", s.Addr)
 		if err != nil {
-			log.Println("Error accepting connection: ", err.Error())
+			return nil, err
+		}
+		s.Listener = listener
+	}
+	listeners := append([]net.Listener{s.Listener}, s.Listeners...)
+	if s.UnixSocket != "" {
+		// Left behind by a server that didn't get to shut down
+		if info, err := os.Lstat(s.UnixSocket); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(s.UnixSocket)
+		}
+		listener, err := net.Listen("unix", s.UnixSocket)
+		if err != nil {
+			return nil, err
+		}
+		listeners = append(listeners, listener)
+		if s.UnixSocketPerm != 0 {
+			if err := os.Chmod(s.UnixSocket, s.UnixSocketPerm); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if s.TLSAddr != "" {
+		if s.TLSConfig == nil {
+			return nil, fmt.Errorf("listening on %s for TLS without a certificate", s.TLSAddr)
+		}
+		listener, err := tls.Listen("tcp", s.TLSAddr, s.TLSConfig)
+		if err != nil {
+			return nil, err
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
+
+// Accept clients on listener until it is closed.
+func (s *Server) serve(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return // shutting down
+			}
+			s.Log.Error("Error accepting connection", "err", err)
 			os.Exit(1)
 		}
-		go s.startSession(conn)
+		if s.protectedModeRefuses(listener, conn) {
+			s.Log.Warn("Refused a client from another host in protected mode", "client", conn.RemoteAddr().String())
+			conn.Write(errProtectedMode.RESP())
+			conn.Close()
+			continue
+		}
+		ip := clientIP(conn)
+		if uerr, first := s.accepts.admit(ip, s.ConnLimits, time.Now()); uerr != nil {
+			if first {
+				s.Log.Warn("Refusing connections", "client", conn.RemoteAddr().String(), "reason", uerr.msg)
+			}
+			conn.Write(uerr.RESP())
+			conn.Close()
+			continue
+		}
+		go func() {
+			defer s.accepts.release(ip)
+			s.startSession(conn)
+		}()
 	}
 }
 
+var errProtectedMode = &UserError{"DENIED", "diy-redis is running in protected mode because protected mode " +
+	"is enabled and it is listening on every interface, while there are no passwords. In this mode connections " +
+	"are only accepted from the loopback interface. If you want to connect from external computers, you may " +
+	"adopt one of the following solutions: " +
+	"1) Just disable protected mode sending the command 'CONFIG SET protected-mode no' from the loopback " +
+	"interface by connecting from the same host the server is running, however MAKE SURE the server is not " +
+	"publicly accessible from internet if you do so. " +
+	"2) Alternatively you can disable protected mode by setting 'protected-mode no' in the configuration file, " +
+	"and then restarting the server. " +
+	"3) If you started the server manually just for testing, restart it with the '-protected-mode=false' option. " +
+	"4) Listen on a specific interface only, with the '-bind' option or the 'bind' directive. " +
+	"NOTE: You only need to do one of the above things in order for the server to start accepting " +
+	"connections from the outside."}
+
+// Whether conn, accepted on listener, is to be refused, as protected mode is on, we
+// listen on every interface, and the client isn't on this host. Anyone who can reach us
+// could do anything, otherwise, since there are no passwords.
+func (s *Server) protectedModeRefuses(listener net.Listener, conn net.Conn) bool {
+	if !s.ProtectedMode.Load() || !listensEverywhere(listener) {
+		return false
+	}
+	remote, ok := conn.RemoteAddr().(*net.TCPAddr)
+	return ok && !remote.IP.IsLoopback()
+}
+
+func listensEverywhere(listener net.Listener) bool {
+	addr, ok := listener.Addr().(*net.TCPAddr)
+	return ok && (addr.IP == nil || addr.IP.IsUnspecified())
+}
+
 func (s *Server) startSession(conn net.Conn) {
 	defer conn.Close()
-	connLog := log.New(os.Stderr, conn.RemoteAddr().String(), log.LstdFlags)
+	connLog := s.Log.With("client", conn.RemoteAddr().String())
 	s.wg.Add(1)
 	defer s.wg.Done()
 
 	session := &Session{
-		server:   s,
-		conn:     conn,
-		valueDB:  s.dbs[0].valueDB, // db 0 as default
-		expiryDB: s.dbs[0].expiryDB,
-		log:      connLog,
+		server: s,
+		conn:   conn,
+		db:     s.db(0), // db 0 as default
+		log:    connLog,
 	}
+	session.info.id = s.nextClientID.Add(1)
+	session.info.addr, session.info.laddr = conn.RemoteAddr().String(), conn.LocalAddr().String()
+	session.info.created = time.Now()
+	session.info.lastAt = session.info.created
+	session.connCtx, session.closeConn = context.WithCancel(context.Background())
+	defer session.closeConn()
+	session.out = newClientOutput(conn, s.OutputLimits.Normal, s.WriteTimeout, func(reason string) {
+		connLog.Warn("Closing client", "reason", reason)
+		session.close()
+	})
+	session.conn = &outputConn{conn, session.out}
+	s.clients.Store(session, struct{}{})
+	defer s.clients.Delete(session)
+	defer s.tracking.disable(session)
+	defer s.repl.removeReplica(session)
 	session.HandleCommands()
+	session.flush()
+	session.out.stop()
+}
+
+// How long SHUTDOWN waits for lagging replicas, like Redis's shutdown-timeout.
+const shutdownTimeout = 10 * time.Second
+
+// Pause writes and wait, for up to timeout, until every online replica has
+// acknowledged all we have propagated. Without online replicas there is nothing to
+// wait for; otherwise writes stay paused until lifted, and true is returned.
+func (s *Server) waitForReplicas(timeout time.Duration) bool {
+	lagging := func(offset int64) int {
+		s.repl.mutex.Lock()
+		defer s.repl.mutex.Unlock()
+		count := 0
+		for _, replica := range s.repl.replicas {
+			if replica.online && replica.ackOffset < offset {
+				count++
+			}
+		}
+		return count
+	}
+	if lagging(math.MaxInt64) == 0 {
+		return false
+	}
+
+	s.pause.pause(365*24*time.Hour, true)
+	offset := s.repl.offset.Load()
+	deadline := time.Now().Add(timeout)
+	for {
+		count := lagging(offset)
+		if count == 0 {
+			return true
+		}
+		if time.Now().After(deadline) {
+			s.Log.Warn("Replicas still lagging on shutdown", "count", count)
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// SHUTDOWN [NOSAVE | SAVE] [NOW] [FORCE] [ABORT]
+func (s *Session) doSHUTDOWN(cmds []string) *UserError {
+	save := len(s.server.SavePoints) > 0
+	force, now := false, false
+	for _, arg := range cmds[1:] {
+		switch strings.ToLower(arg) {
+		case "nosave":
+			save = false
+		case "save":
+			save = true
+		case "now":
+			now = true
+		case "force":
+			force = true
+		case "abort":
+			return &UserError{"ERR", "No shutdown in progress."}
+		default:
+			return ErrSyntax()
+		}
+	}
+
+	// Writes stay paused from here on, so the replicas miss nothing
+	paused := !now && s.server.waitForReplicas(shutdownTimeout)
+	if save {
+		if err := s.server.saveOnShutdown(); err != nil {
+			s.log.Error("Error trying to save the DB on shutdown", "err", err)
+			if !force {
+				if paused {
+					s.server.pause.unpause()
+				}
+				return &UserError{"ERR", "Errors trying to SHUTDOWN. Check logs."}
+			}
+		}
+	}
+
+	// Like Redis, don't reply; the connection is closed as part of the shutdown
+	select {
+	case s.server.Quitch <- shutdownRequest{}:
+	default: // already shutting down
+	}
+	return nil
 }
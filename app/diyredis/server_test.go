@@ -0,0 +1,168 @@
+package diyredis
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestShutdown(t *testing.T) {
+	server := MakeServer()
+	server.RdbDir = t.TempDir()
+	server.RdbFilename = "dump.rdb"
+	session, conn := newTestSession(server)
+
+	session.dispatch([]string{"SHUTDOWN", "NOSAVE"})
+	if sig := <-server.Quitch; sig != (shutdownRequest{}) {
+		t.Errorf("got signal %v", sig)
+	}
+	if _, err := os.Stat(filepath.Join(server.RdbDir, "dump.rdb")); !os.IsNotExist(err) {
+		t.Errorf("saved despite NOSAVE")
+	}
+
+	session.dispatch([]string{"SET", "foo", "bar"})
+	session.dispatch([]string{"SHUTDOWN"}) // saves, since there are save points
+	<-server.Quitch
+	if _, err := os.Stat(filepath.Join(server.RdbDir, "dump.rdb")); err != nil {
+		t.Error(err)
+	}
+
+	// Refuse to shut down when saving fails, unless forced to
+	server.RdbDir = filepath.Join(server.RdbDir, "does-not-exist")
+	conn.buf.Reset()
+	session.dispatch([]string{"SHUTDOWN", "SAVE"})
+	if got := conn.buf.String(); got != "-ERR Errors trying to SHUTDOWN. Check logs.\r\n" {
+		t.Errorf("got %q", got)
+	}
+	if len(server.Quitch) != 0 {
+		t.Errorf("shut down anyway")
+	}
+	session.dispatch([]string{"SHUTDOWN", "SAVE", "FORCE"})
+	if len(server.Quitch) != 1 {
+		t.Errorf("did not shut down")
+	}
+}
+
+func TestShutdownWaitsForReplicas(t *testing.T) {
+	server := MakeServer()
+	server.SavePoints = nil
+	session, _ := newTestSession(server)
+	replicaSession, _ := newTestSession(server)
+	server.repl.mutex.Lock()
+	server.repl.activate(1024)
+	server.repl.replicas[replicaSession] = &replica{online: true}
+	server.repl.mutex.Unlock()
+	server.repl.offset.Store(100)
+
+	session.dispatch([]string{"SHUTDOWN", "NOW"})
+	if len(server.Quitch) != 1 {
+		t.Fatalf("NOW waited for the replica")
+	}
+	<-server.Quitch
+
+	go session.dispatch([]string{"SHUTDOWN"})
+	select {
+	case <-server.Quitch:
+		t.Fatalf("shut down before the replica caught up")
+	case <-time.After(50 * time.Millisecond):
+	}
+	server.repl.ack(replicaSession, 100)
+	select {
+	case <-server.Quitch:
+	case <-time.After(time.Second):
+		t.Fatalf("did not shut down once the replica caught up")
+	}
+	server.pause.unpause()
+}
+
+func TestPidFile(t *testing.T) {
+	server := MakeServer()
+	server.SavePoints = nil
+	server.PidFile = filepath.Join(t.TempDir(), "redis.pid")
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Listener = listener
+	stopped := make(chan struct{})
+	go func() {
+		server.Start()
+		close(stopped)
+	}()
+
+	want := strconv.Itoa(os.Getpid()) + "\n"
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		data, _ := os.ReadFile(server.PidFile)
+		if string(data) == want {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("pid file holds %q, want %q", data, want)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	server.Quitch <- syscall.SIGTERM
+	<-stopped
+	if _, err := os.Stat(server.PidFile); !os.IsNotExist(err) {
+		t.Errorf("pid file left behind after shutting down: %v", err)
+	}
+}
+
+// A connection from somewhere else.
+type remoteConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c remoteConn) RemoteAddr() net.Addr { return c.addr }
+
+func TestProtectedMode(t *testing.T) {
+	everywhere, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer everywhere.Close()
+	loopback, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer loopback.Close()
+
+	local := remoteConn{addr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 50000}}
+	remote := remoteConn{addr: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 50000}}
+	for _, tc := range []struct {
+		listener  net.Listener
+		protected bool
+		conn      net.Conn
+		refused   bool
+	}{
+		{everywhere, true, remote, true},
+		{everywhere, true, local, false},
+		{everywhere, false, remote, false},
+		{loopback, true, remote, false},
+	} {
+		server := MakeServer()
+		server.ProtectedMode.Store(tc.protected)
+		if got := server.protectedModeRefuses(tc.listener, tc.conn); got != tc.refused {
+			t.Errorf("listening on %v, protected mode %v, from %v: got refused %v",
+				tc.listener.Addr(), tc.protected, tc.conn.RemoteAddr(), got)
+		}
+	}
+
+	server := MakeServer()
+	session, conn := newTestSession(server)
+	session.dispatch([]string{"CONFIG", "SET", "protected-mode", "no"})
+	session.dispatch([]string{"CONFIG", "GET", "protected-mode"})
+	if got := conn.buf.String(); got != "+OK\r\n*2\r\n$14\r\nprotected-mode\r\n$2\r\nno\r\n" {
+		t.Errorf("got %q", got)
+	}
+	if server.ProtectedMode.Load() {
+		t.Errorf("still in protected mode")
+	}
+}
@@ -0,0 +1,395 @@
+package diyredis
+
+import (
+	"maps"
+	"math"
+	"math/rand/v2"
+	"slices"
+	"strconv"
+	"sync"
+
+	listpack "github.com/codecrafters-io/redis-starter-go/app/diyredis/listpack"
+	resp3 "github.com/codecrafters-io/redis-starter-go/app/diyredis/resp3"
+)
+
+// A set is a listpack of its members while it's small, and a map once it isn't. The map
+// holds the index of each member in a slice of them, so that SRANDMEMBER and SPOP can
+// pick members at random without going through the entire map.
+type setValue struct {
+	mutex   sync.RWMutex
+	lp      listpack.Listpack // nil once converted to a map
+	members map[string]int    // member -> its index in order
+	order   []string          // the members, in no particular order
+}
+
+func newSet() *setValue {
+	return &setValue{lp: listpack.New()}
+}
+
+// Return a set holding members, in the encoding that suits it.
+func newSetFrom(members []string, limits ListpackLimits) *setValue {
+	s := newSet()
+	for _, member := range members {
+		s.add(member, limits)
+	}
+	return s
+}
+
+func (s *setValue) encoding() string {
+	if s.lp != nil {
+		return "listpack"
+	}
+	return "hashtable"
+}
+
+func (s *setValue) convert() {
+	s.members = make(map[string]int, s.len())
+	s.order = make([]string, 0, s.len())
+	if s.lp != nil {
+		s.lp.Range(func(i int, member string) bool {
+			s.members[member] = i
+			s.order = append(s.order, member)
+			return true
+		})
+	}
+	s.lp = nil
+}
+
+func (s *setValue) len() int {
+	if s.lp != nil {
+		return s.lp.Len()
+	}
+	return len(s.members)
+}
+
+func (s *setValue) has(member string) bool {
+	if s.lp != nil {
+		return s.lp.Find(member, 0, 1) >= 0
+	}
+	_, ok := s.members[member]
+	return ok
+}
+
+// Add member, returning true if it is new.
+func (s *setValue) add(member string, limits ListpackLimits) bool {
+	if s.has(member) {
+		return false
+	}
+	if s.lp != nil {
+		if limits.fits(s.len()+1, member) {
+			s.lp = s.lp.Append(member)
+			return true
+		}
+		s.convert()
+	}
+	s.members[member] = len(s.order)
+	s.order = append(s.order, member)
+	return true
+}
+
+// Remove member, returning true if it existed.
+func (s *setValue) remove(member string) bool {
+	if s.lp != nil {
+		i := s.lp.Find(member, 0, 1)
+		if i < 0 {
+			return false
+		}
+		s.lp = s.lp.Delete(i, 1)
+		return true
+	}
+	i, exists := s.members[member]
+	if !exists {
+		return false
+	}
+	// Move the last member into the gap
+	last := s.order[len(s.order)-1]
+	s.order[i] = last
+	s.members[last] = i
+	s.order = s.order[:len(s.order)-1]
+	delete(s.members, member)
+	return true
+}
+
+// Return the member at index i, in whatever order the encoding keeps them in.
+func (s *setValue) at(i int) string {
+	if s.lp != nil {
+		return s.lp.Get(i)
+	}
+	return s.order[i]
+}
+
+// Return count distinct members picked at random, or all of them if there are fewer.
+func (s *setValue) random(count int) []string {
+	n := s.len()
+	if count >= n {
+		return s.list()
+	}
+	picked := make([]string, 0, count)
+	if count*2 < n {
+		// Few enough that picking one we already have is unlikely
+		seen := make(map[int]struct{}, count)
+		for len(picked) < count {
+			i := rand.IntN(n)
+			if _, ok := seen[i]; !ok {
+				seen[i] = struct{}{}
+				picked = append(picked, s.at(i))
+			}
+		}
+		return picked
+	}
+	for _, i := range rand.Perm(n)[:count] {
+		picked = append(picked, s.at(i))
+	}
+	return picked
+}
+
+// Return the members, in no particular order.
+func (s *setValue) list() []string {
+	if s.lp != nil {
+		return s.lp.Elements()
+	}
+	return slices.Clone(s.order)
+}
+
+// Return a copy that doesn't change along with s.
+func (s *setValue) clone() *setValue {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if s.lp != nil {
+		return &setValue{lp: s.lp} // listpacks are never modified in place
+	}
+	return &setValue{members: maps.Clone(s.members), order: slices.Clone(s.order)}
+}
+
+// SADD key member [member ...]
+func (s *Session) doSADD(cmds []string) *UserError {
+	if len(cmds) < 3 {
+		return &UserError{"ERR", "wrong number of arguments for SADD command"}
+	}
+
+	added := 0
+	_, uerr := changeCollection(s, cmds[1], newSet, func(set *setValue) *UserError {
+		set.mutex.Lock()
+		defer set.mutex.Unlock()
+		added = 0
+		for _, member := range cmds[2:] {
+			if set.add(member, s.server.Encoding.Set) {
+				added++
+			}
+		}
+		return nil
+	})
+	if uerr != nil {
+		return uerr
+	}
+
+	encoder := resp3.Encoder{}
+	encoder.WriteInt(added)
+	s.conn.Write(encoder.Buf)
+	return nil
+}
+
+// SREM key member [member ...]
+func (s *Session) doSREM(cmds []string) *UserError {
+	if len(cmds) < 3 {
+		return &UserError{"ERR", "wrong number of arguments for SREM command"}
+	}
+	removed := 0
+	_, uerr := changeCollection(s, cmds[1], nil, func(set *setValue) *UserError {
+		set.mutex.Lock()
+		defer set.mutex.Unlock()
+		removed = 0
+		for _, member := range cmds[2:] {
+			if set.remove(member) {
+				removed++
+			}
+		}
+		return nil
+	})
+	if uerr != nil {
+		return uerr
+	}
+
+	encoder := resp3.Encoder{}
+	encoder.WriteInt(removed)
+	s.conn.Write(encoder.Buf)
+	return nil
+}
+
+// SISMEMBER key member
+func (s *Session) doSISMEMBER(cmds []string) *UserError {
+	if len(cmds) != 3 {
+		return &UserError{"ERR", "wrong number of arguments for SISMEMBER command"}
+	}
+	set, ok, uerr := readTyped[*setValue](s, cmds[1])
+	if uerr != nil {
+		return uerr
+	}
+
+	isMember := false
+	if ok {
+		set.mutex.RLock()
+		isMember = set.has(cmds[2])
+		set.mutex.RUnlock()
+	}
+	encoder := resp3.Encoder{}
+	encoder.WriteInt(boolToInt(isMember))
+	s.conn.Write(encoder.Buf)
+	return nil
+}
+
+// SMEMBERS key
+func (s *Session) doSMEMBERS(cmds []string) *UserError {
+	if len(cmds) != 2 {
+		return &UserError{"ERR", "wrong number of arguments for SMEMBERS command"}
+	}
+	set, ok, uerr := readTyped[*setValue](s, cmds[1])
+	if uerr != nil {
+		return uerr
+	}
+	if !ok {
+		s.conn.Write(EmptyRespArr)
+		return nil
+	}
+
+	set.mutex.RLock()
+	members := set.list()
+	set.mutex.RUnlock()
+	s.conn.Write(makeRESPArr(members))
+	return nil
+}
+
+// SCARD key
+func (s *Session) doSCARD(cmds []string) *UserError {
+	if len(cmds) != 2 {
+		return &UserError{"ERR", "wrong number of arguments for SCARD command"}
+	}
+	set, ok, uerr := readTyped[*setValue](s, cmds[1])
+	if uerr != nil {
+		return uerr
+	}
+
+	length := 0
+	if ok {
+		set.mutex.RLock()
+		length = set.len()
+		set.mutex.RUnlock()
+	}
+	encoder := resp3.Encoder{}
+	encoder.WriteInt(length)
+	s.conn.Write(encoder.Buf)
+	return nil
+}
+
+// Parse the count of SRANDMEMBER and SPOP.
+func parseSetCount(arg string) (int, *UserError) {
+	count, err := strconv.Atoi(arg)
+	if err != nil {
+		return 0, &UserError{"ERR", "value is not an integer or out of range"}
+	}
+	if count == math.MinInt {
+		return 0, &UserError{"ERR", "value is out of range"} // there's no -count
+	}
+	return count, nil
+}
+
+// SRANDMEMBER key [count]
+//
+// With a positive count, up to count distinct members. With a negative one, exactly
+// -count members, which may repeat.
+func (s *Session) doSRANDMEMBER(cmds []string) *UserError {
+	if len(cmds) != 2 && len(cmds) != 3 {
+		return &UserError{"ERR", "wrong number of arguments for SRANDMEMBER command"}
+	}
+	set, ok, uerr := readTyped[*setValue](s, cmds[1])
+	if uerr != nil {
+		return uerr
+	}
+
+	if len(cmds) == 2 {
+		if !ok {
+			s.writeNull()
+			return nil
+		}
+		set.mutex.RLock()
+		member := set.at(rand.IntN(set.len()))
+		set.mutex.RUnlock()
+		encoder := resp3.Encoder{}
+		encoder.WriteBulkStr(member)
+		s.conn.Write(encoder.Buf)
+		return nil
+	}
+
+	count, uerr := parseSetCount(cmds[2])
+	if uerr != nil {
+		return uerr
+	}
+	if !ok || count == 0 {
+		s.conn.Write(EmptyRespArr)
+		return nil
+	}
+	var members []string
+	set.mutex.RLock()
+	if count > 0 {
+		members = set.random(count)
+	} else {
+		members = make([]string, -count)
+		for i := range members {
+			members[i] = set.at(rand.IntN(set.len()))
+		}
+	}
+	set.mutex.RUnlock()
+	s.conn.Write(makeRESPArr(members))
+	return nil
+}
+
+// SPOP key [count]
+func (s *Session) doSPOP(cmds []string) *UserError {
+	if len(cmds) != 2 && len(cmds) != 3 {
+		return &UserError{"ERR", "wrong number of arguments for SPOP command"}
+	}
+	count := 1
+	if len(cmds) == 3 {
+		var uerr *UserError
+		if count, uerr = parseSetCount(cmds[2]); uerr != nil {
+			return uerr
+		}
+		if count < 0 {
+			return &UserError{"ERR", "value is out of range, must be positive"}
+		}
+	}
+
+	key := cmds[1]
+	var popped []string
+	_, uerr := changeCollection(s, key, nil, func(set *setValue) *UserError {
+		set.mutex.Lock()
+		defer set.mutex.Unlock()
+		popped = set.random(count)
+		for _, member := range popped {
+			set.remove(member)
+		}
+		return nil
+	})
+	if uerr != nil {
+		return uerr
+	}
+	// Replicas have to remove the same members, not ones picked at random again
+	if len(popped) > 0 {
+		s.propagateAs(append([]string{"SREM", key}, popped...))
+	} else {
+		s.propagateAs()
+	}
+
+	if len(cmds) == 3 {
+		s.conn.Write(makeRESPArr(popped))
+		return nil
+	}
+	if len(popped) == 0 {
+		s.writeNull()
+		return nil
+	}
+	encoder := resp3.Encoder{}
+	encoder.WriteBulkStr(popped[0])
+	s.conn.Write(encoder.Buf)
+	return nil
+}
@@ -0,0 +1,139 @@
+package diyredis
+
+import (
+	"bufio"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestSet(t *testing.T) {
+	server := MakeServer()
+	server.Encoding.Set = ListpackLimits{MaxEntries: 4, MaxValue: 8}
+	session, conn := newTestSession(server)
+	run := func(cmd ...string) string {
+		conn.buf.Reset()
+		session.dispatch(cmd)
+		return conn.buf.String()
+	}
+
+	for _, tc := range []struct {
+		cmd  []string
+		want string
+	}{
+		{[]string{"SADD", "s", "a", "b", "a"}, ":2\r\n"},
+		{[]string{"SADD", "s", "b", "c"}, ":1\r\n"},
+		{[]string{"SCARD", "s"}, ":3\r\n"},
+		{[]string{"SISMEMBER", "s", "c"}, ":1\r\n"},
+		{[]string{"SISMEMBER", "s", "d"}, ":0\r\n"},
+		{[]string{"SMEMBERS", "s"}, "*3\r\n$1\r\na\r\n$1\r\nb\r\n$1\r\nc\r\n"},
+		{[]string{"OBJECT", "ENCODING", "s"}, "$8\r\nlistpack\r\n"},
+		{[]string{"TYPE", "s"}, "+set\r\n"},
+		{[]string{"SREM", "s", "a", "d"}, ":1\r\n"},
+		{[]string{"SREM", "s", "b", "c"}, ":2\r\n"},
+		{[]string{"TYPE", "s"}, "+none\r\n"},
+	} {
+		if got := run(tc.cmd...); got != tc.want {
+			t.Errorf("%v: got %q, want %q", tc.cmd, got, tc.want)
+		}
+	}
+
+	var members []string
+	for i := range 10 {
+		members = append(members, strconv.Itoa(i))
+	}
+	run(append([]string{"SADD", "big"}, members...)...)
+	if got := run("OBJECT", "ENCODING", "big"); got != "$9\r\nhashtable\r\n" {
+		t.Errorf("got %q", got)
+	}
+	set, _, _ := loadTyped[*setValue](session, "big")
+	got := set.list()
+	slices.Sort(got)
+	if !slices.Equal(got, members) {
+		t.Errorf("got %v, want %v", got, members)
+	}
+}
+
+func TestSetRandom(t *testing.T) {
+	server := MakeServer()
+	server.Encoding.Set = ListpackLimits{MaxEntries: 4, MaxValue: 8}
+	session, conn := newTestSession(server)
+	run := func(cmd ...string) []string {
+		conn.buf.Reset()
+		session.dispatch(cmd)
+		return parseTestArr(t, conn.buf.String())
+	}
+	// Without a count, SRANDMEMBER and SPOP reply with a single member instead
+	runOne := func(cmd ...string) []string {
+		conn.buf.Reset()
+		session.dispatch(cmd)
+		reply := conn.buf.String()
+		parsed, err := readReply(bufio.NewReader(strings.NewReader(reply)))
+		member, ok := parsed.(string)
+		if err != nil || !ok {
+			t.Fatalf("%v: got %q, want a bulk string", cmd, reply)
+		}
+		return []string{member}
+	}
+
+	for _, tc := range []struct {
+		name    string
+		members []string
+	}{
+		{"listpack", []string{"a", "b", "c"}},
+		{"hashtable", []string{"0", "1", "2", "3", "4", "5", "6", "7", "8", "9"}},
+	} {
+		session.dispatch(append([]string{"SADD", tc.name}, tc.members...))
+		n := len(tc.members)
+
+		for _, count := range []int{1, 2, n, n + 5} {
+			got := run("SRANDMEMBER", tc.name, strconv.Itoa(count))
+			if len(got) != min(count, n) {
+				t.Errorf("%s: SRANDMEMBER %d: got %v", tc.name, count, got)
+			}
+			slices.Sort(got)
+			if len(slices.Compact(got)) != len(got) || !isSubset(got, tc.members) {
+				t.Errorf("%s: SRANDMEMBER %d: got %v, want distinct members", tc.name, count, got)
+			}
+		}
+		if got := run("SRANDMEMBER", tc.name, "-20"); len(got) != 20 || !isSubset(got, tc.members) {
+			t.Errorf("%s: SRANDMEMBER -20: got %v", tc.name, got)
+		}
+		if got := runOne("SRANDMEMBER", tc.name); len(got) != 1 || !isSubset(got, tc.members) {
+			t.Errorf("%s: SRANDMEMBER: got %v", tc.name, got)
+		}
+
+		// Popping everything, one at a time and then in bulk, returns every member once
+		popped := runOne("SPOP", tc.name)
+		popped = append(popped, run("SPOP", tc.name, "2")...)
+		popped = append(popped, run("SPOP", tc.name, strconv.Itoa(n))...)
+		slices.Sort(popped)
+		if !slices.Equal(popped, tc.members) {
+			t.Errorf("%s: popped %v, want %v", tc.name, popped, tc.members)
+		}
+		if _, ok := server.dbs[0].engine.Get(tc.name); ok {
+			t.Errorf("%s: empty set was not deleted", tc.name)
+		}
+	}
+
+	conn.buf.Reset()
+	session.dispatch([]string{"SPOP", "missing"})
+	if got := conn.buf.String(); got != "$-1\r\n" {
+		t.Errorf("SPOP on a missing key: got %q", got)
+	}
+	conn.buf.Reset()
+	session.dispatch([]string{"SPOP", "missing", "-1"})
+	if got := conn.buf.String(); got != "-ERR value is out of range, must be positive\r\n" {
+		t.Errorf("SPOP with a negative count: got %q", got)
+	}
+}
+
+func isSubset(sub []string, of []string) bool {
+	for _, elem := range sub {
+		if !slices.Contains(of, elem) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,137 @@
+package diyredis
+
+import (
+	"fmt"
+	"reflect"
+	"slices"
+
+	streams "github.com/codecrafters-io/redis-starter-go/app/diyredis/streams"
+)
+
+// A copy of the whole keyspace, for checking that e.g. saving and loading the RDB file
+// brings back every value and TTL exactly, and for going back to a known state.
+//
+// Unlike the snapshots taken for saving, taking one doesn't stop the world: keys that
+// change while it is taken may end up in either their old or new state.
+type State struct {
+	dbs []map[string]stateEntry
+}
+
+type stateEntry struct {
+	value  any
+	expiry int64 // as a Unix time in milliseconds, zero if the key doesn't expire
+}
+
+// Copy every database.
+func (s *Server) SnapshotState() *State {
+	state := &State{dbs: make([]map[string]stateEntry, s.dbCount())}
+	for i := range state.dbs {
+		db := s.db(i)
+		keys := make(map[string]stateEntry)
+		db.engine.Scan(func(key string, _ any) bool {
+			if value, expiry, ok := db.peek(key); ok {
+				keys[key] = stateEntry{cloneValue(value), expiry}
+			}
+			return true
+		})
+		state.dbs[i] = keys
+	}
+	return state
+}
+
+// Replace every database with its copy in state, which can be restored again later.
+// Clients blocked on a stream that was replaced (XREAD BLOCK) get a nil reply, as if it
+// was deleted.
+func (s *Server) RestoreState(state *State) error {
+	if len(state.dbs) != s.dbCount() {
+		return fmt.Errorf("state has %d databases, the server %d", len(state.dbs), s.dbCount())
+	}
+	dbs := make([]RedisDB, len(state.dbs))
+	for i, keys := range state.dbs {
+		dbs[i] = s.newDB(i)
+		for key, entry := range keys {
+			dbs[i].set(key, cloneValue(entry.value), entry.expiry)
+		}
+	}
+
+	s.replaceDBs(dbs)
+	return nil
+}
+
+// Return nil if state and other hold the same keys, with the same values and expiries,
+// or else an error describing the first difference found.
+func (state *State) Diff(other *State) error {
+	if len(state.dbs) != len(other.dbs) {
+		return fmt.Errorf("%d databases vs %d", len(state.dbs), len(other.dbs))
+	}
+	for i, keys := range state.dbs {
+		otherKeys := other.dbs[i]
+		for key, entry := range keys {
+			otherEntry, ok := otherKeys[key]
+			if !ok {
+				return fmt.Errorf("db %d: key %q is missing", i, key)
+			}
+			if entry.expiry != otherEntry.expiry {
+				return fmt.Errorf("db %d: key %q expires at %d vs %d", i, key, entry.expiry, otherEntry.expiry)
+			}
+			if a, b := plainValue(entry.value), plainValue(otherEntry.value); !reflect.DeepEqual(a, b) {
+				return fmt.Errorf("db %d: key %q holds %v vs %v", i, key, a, b)
+			}
+		}
+		for key := range otherKeys {
+			if _, ok := keys[key]; !ok {
+				return fmt.Errorf("db %d: key %q is extra", i, key)
+			}
+		}
+	}
+	return nil
+}
+
+// Return a copy of value that doesn't change along with it.
+func cloneValue(value any) any {
+	if stream, ok := value.(*streams.Stream); ok {
+		return stream.Clone()
+	}
+	return cloneForSnapshot(value)
+}
+
+// Return the contents of value as plain Go values, so that two values can be compared
+// regardless of their encoding.
+func plainValue(value any) any {
+	switch val := value.(type) {
+	case *hashValue:
+		fields := make(map[string]string)
+		val.mutex.RLock()
+		val.rangeFields(func(field string, value string) bool {
+			fields[field] = value
+			return true
+		})
+		val.mutex.RUnlock()
+		return fields
+	case *listValue:
+		val.mutex.RLock()
+		defer val.mutex.RUnlock()
+		return val.slice(0, val.len()-1)
+	case *setValue:
+		val.mutex.RLock()
+		members := val.list()
+		val.mutex.RUnlock()
+		slices.Sort(members)
+		return members
+	case *streams.Stream:
+		entries := val.Range(streams.MinKey, streams.MaxKey)
+		for i, entry := range entries {
+			if fields, ok := entry.Val.(StreamFields); ok {
+				entries[i].Val = fields.pairs() // not the names they share
+			}
+		}
+		return struct {
+			entries []streams.Entry
+			lastID  streams.Key
+		}{entries, val.MaxID()}
+	}
+	if str, ok := stringValue(value); ok {
+		return str
+	}
+	return value
+}
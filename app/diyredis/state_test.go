@@ -0,0 +1,146 @@
+package diyredis
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestStateRoundTrip(t *testing.T) {
+	server := MakeServer()
+	server.RdbDir = t.TempDir()
+	server.RdbFilename = "dump.rdb"
+	server.Encoding.Hash = ListpackLimits{MaxEntries: 2, MaxValue: 8}
+	session, _ := newTestSession(server)
+	for _, cmd := range [][]string{
+		{"SET", "str", "v"},
+		{"SET", "int", "12345", "PX", "100000"},
+		{"HSET", "small-hash", "f", "v"},
+		{"HSET", "big-hash", "a", "1", "b", "2", "c", "3"},
+		{"RPUSH", "list", "a", "b", "c"},
+		{"SADD", "set", "x", "y"},
+		{"SELECT", "2"},
+		{"SET", "other-db", "v", "PX", "5000"},
+	} {
+		session.dispatch(cmd)
+	}
+
+	state := server.SnapshotState()
+	if err := state.Diff(state); err != nil {
+		t.Errorf("state differs from itself: %v", err)
+	}
+	if err := server.SaveRdb(); err != nil {
+		t.Fatal(err)
+	}
+	loaded := MakeServer()
+	loaded.RdbDir, loaded.RdbFilename = server.RdbDir, server.RdbFilename
+	if err := loaded.LoadRdb(); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.Diff(loaded.SnapshotState()); err != nil {
+		t.Errorf("RDB round trip: %v", err)
+	}
+
+	session.dispatch([]string{"SET", "other-db", "changed"})
+	if err := state.Diff(server.SnapshotState()); err == nil || !strings.Contains(err.Error(), `"other-db"`) {
+		t.Errorf("got %v, want other-db to differ", err)
+	}
+}
+
+func TestRestoreState(t *testing.T) {
+	server := MakeServer()
+	session, conn := newTestSession(server)
+	run := func(cmd ...string) string {
+		conn.buf.Reset()
+		session.dispatch(cmd)
+		return conn.buf.String()
+	}
+
+	run("XADD", "s", "1-0", "a", "1")
+	run("SADD", "set", "x")
+	state := server.SnapshotState()
+
+	run("XADD", "s", "2-0", "b", "2")
+	run("SADD", "set", "y")
+	run("SET", "new", "v")
+	if err := server.RestoreState(state); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.Diff(server.SnapshotState()); err != nil {
+		t.Error(err)
+	}
+	if got := run("XRANGE", "s", "-", "+"); got != "*1\r\n*2\r\n$3\r\n1-0\r\n*2\r\n$1\r\na\r\n$1\r\n1\r\n" {
+		t.Errorf("XRANGE after restoring: got %q", got)
+	}
+
+	// Changes after restoring don't make it into the state
+	run("XADD", "s", "3-0", "c", "3")
+	if err := state.Diff(server.SnapshotState()); err == nil {
+		t.Error("state changed along with the restored stream")
+	}
+	if err := server.RestoreState(state); err != nil {
+		t.Fatal(err)
+	}
+	if got := run("EXISTS", "new"); got != ":0\r\n" {
+		t.Errorf("EXISTS new: got %q", got)
+	}
+}
+
+func TestCloneValue(t *testing.T) {
+	server := MakeServer()
+	server.Encoding.Hash = ListpackLimits{MaxEntries: 2, MaxValue: 8}
+	session, _ := newTestSession(server)
+	for _, cmd := range [][]string{
+		{"SET", "str", "v"},
+		{"HSET", "small-hash", "f", "v"},
+		{"HSET", "big-hash", "a", "1", "b", "2", "c", "3"},
+		{"RPUSH", "list", "a", "b", "c"},
+		{"SADD", "set", "x", "y"},
+		{"XADD", "stream", "1-0", "a", "1"},
+		{"XADD", "stream", "2-0", "b", "2"},
+	} {
+		session.dispatch(cmd)
+	}
+
+	db := server.db(0)
+	keys := []string{"str", "small-hash", "big-hash", "list", "set", "stream"}
+	want := make(map[string]any)
+	for _, key := range keys {
+		value, _, _ := db.load(key)
+		want[key] = plainValue(value)
+		db.set(key+"-copy", cloneValue(value), 0)
+	}
+
+	// Changing the originals leaves the copies alone, and the other way around
+	for _, cmd := range [][]string{
+		{"APPEND", "str", "x"},
+		{"HSET", "small-hash", "f", "changed"},
+		{"HDEL", "big-hash", "a"},
+		{"LPOP", "list"},
+		{"RPUSH", "list", "d"},
+		{"SREM", "set", "x"},
+		{"XADD", "stream", "3-0", "c", "3"},
+		{"XSETID", "stream", "5-0"},
+		{"HSET", "big-hash-copy", "d", "4"},
+		{"RPUSH", "list-copy", "e"},
+	} {
+		session.dispatch(cmd)
+	}
+	want["big-hash"] = map[string]string{"a": "1", "b": "2", "c": "3", "d": "4"}
+	want["list"] = []string{"a", "b", "c", "e"}
+	for _, key := range keys {
+		copied, _, _ := db.load(key + "-copy")
+		if got := plainValue(copied); !reflect.DeepEqual(got, want[key]) {
+			t.Errorf("%s-copy: got %v, want %v", key, got, want[key])
+		}
+	}
+	for key, want := range map[string]any{
+		"big-hash": map[string]string{"b": "2", "c": "3"},
+		"list":     []string{"b", "c", "d"},
+	} {
+		value, _, _ := db.load(key)
+		if got := plainValue(value); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %v, want %v", key, got, want)
+		}
+	}
+}
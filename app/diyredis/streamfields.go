@@ -0,0 +1,91 @@
+package diyredis
+
+import (
+	"iter"
+	"maps"
+	"slices"
+)
+
+// The fields and values of a stream entry, which is what the Val of its streams.Entry
+// holds: in the order XADD was given them, duplicates included, like Redis keeps them.
+// Slices cost a fraction of what a map would for the few small fields entries tend to
+// have; Map makes one when needed.
+//
+// The names of the fields are shared by consecutive entries that have the same ones,
+// which most streams' entries do, so that a run of them only stores them once, like
+// Redis only stores them in the master entry of a listpack.
+type StreamFields struct {
+	names  *[]string // shared, see sharingNames
+	values []string
+}
+
+// Make the fields of an entry from pairs of fields and values.
+func newStreamFields(pairs []string) StreamFields {
+	names := make([]string, 0, len(pairs)/2)
+	values := make([]string, 0, len(pairs)/2)
+	for i := 0; i < len(pairs); i += 2 {
+		names = append(names, pairs[i])
+		values = append(values, pairs[i+1])
+	}
+	return StreamFields{&names, values}
+}
+
+// Make the fields of an entry from m, in the order of their names.
+func streamFieldsFromMap(m map[string]string) StreamFields {
+	pairs := make([]string, 0, len(m)*2)
+	for _, field := range slices.Sorted(maps.Keys(m)) {
+		pairs = append(pairs, field, m[field])
+	}
+	return newStreamFields(pairs)
+}
+
+// Return f with the names of the fields of prev, the Val of the entry before it, if they
+// are the same.
+func (f StreamFields) sharingNames(prev any) StreamFields {
+	if prev, ok := prev.(StreamFields); ok && prev.names != nil && f.names != nil && slices.Equal(*prev.names, *f.names) {
+		f.names = prev.names
+	}
+	return f
+}
+
+// The number of fields.
+func (f StreamFields) Len() int {
+	return len(f.values)
+}
+
+// Every field with its value, in order.
+func (f StreamFields) All() iter.Seq2[string, string] {
+	return func(yield func(string, string) bool) {
+		for i, value := range f.values {
+			if !yield((*f.names)[i], value) {
+				return
+			}
+		}
+	}
+}
+
+// The fields and their values, alternating.
+func (f StreamFields) pairs() []string {
+	pairs := make([]string, 0, f.Len()*2)
+	for field, value := range f.All() {
+		pairs = append(pairs, field, value)
+	}
+	return pairs
+}
+
+// The fields as a map, where the last of duplicate fields wins.
+func (f StreamFields) Map() map[string]string {
+	m := make(map[string]string, f.Len())
+	for field, value := range f.All() {
+		m[field] = value
+	}
+	return m
+}
+
+// The names of the fields, in order. Must not be modified, since they may be shared.
+func (f StreamFields) fieldNames() []string {
+	if f.names == nil {
+		return nil
+	}
+	return *f.names
+}
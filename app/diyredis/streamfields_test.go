@@ -0,0 +1,86 @@
+package diyredis
+
+import (
+	"maps"
+	"testing"
+)
+
+func TestStreamFields(t *testing.T) {
+	server := MakeServer()
+	session, conn := newTestSession(server)
+	run := func(cmd ...string) string {
+		conn.buf.Reset()
+		session.dispatch(cmd)
+		return conn.buf.String()
+	}
+
+	// In the order they were given, duplicates included, as Redis has them
+	run("XADD", "s", "1-0", "z", "1", "a", "2", "z", "3")
+	want := "*1\r\n*2\r\n$3\r\n1-0\r\n*6\r\n$1\r\nz\r\n$1\r\n1\r\n$1\r\na\r\n$1\r\n2\r\n$1\r\nz\r\n$1\r\n3\r\n"
+	if got := run("XRANGE", "s", "-", "+"); got != want {
+		t.Errorf("XRANGE: got %q, want %q", got, want)
+	}
+
+	db, _ := server.DB(0)
+	entries, err := db.XRange("s", "-", "+")
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("got %v %v, want one entry", entries, err)
+	}
+	fields := entries[0].Val.(StreamFields)
+	if fields.Len() != 3 {
+		t.Errorf("got %d fields, want 3", fields.Len())
+	}
+	if got := fields.Map(); !maps.Equal(got, map[string]string{"a": "2", "z": "3"}) {
+		t.Errorf("Map: got %v, want the last of the duplicates", got)
+	}
+
+	db.XAdd("s", "2-0", map[string]string{"b": "1", "a": "2"})
+	want = "*1\r\n*2\r\n$3\r\n2-0\r\n*4\r\n$1\r\na\r\n$1\r\n2\r\n$1\r\nb\r\n$1\r\n1\r\n"
+	if got := run("XRANGE", "s", "2", "+"); got != want {
+		t.Errorf("XRANGE of an entry added from a map: got %q, want %q", got, want)
+	}
+}
+
+func TestStreamFieldsShareNames(t *testing.T) {
+	server := MakeServer()
+	session, conn := newTestSession(server)
+	run := func(cmd ...string) string {
+		conn.buf.Reset()
+		session.dispatch(cmd)
+		return conn.buf.String()
+	}
+
+	run("XADD", "s", "1-0", "temp", "20", "unit", "C")
+	run("XADD", "s", "2-0", "temp", "21", "unit", "C")
+	run("XADD", "s", "3-0", "temp", "22", "unit", "F")
+	run("XADD", "s", "4-0", "unit", "C", "temp", "23") // in another order
+	run("XADD", "s", "5-0", "unit", "C", "temp", "24")
+	run("XADD", "s", "6-0", "temp", "25")
+
+	db, _ := server.DB(0)
+	entries, _ := db.XRange("s", "-", "+")
+	if len(entries) != 6 {
+		t.Fatalf("got %d entries, want 6", len(entries))
+	}
+	names := func(i int) *[]string {
+		return entries[i].Val.(StreamFields).names
+	}
+	for _, pair := range [][2]int{{0, 1}, {1, 2}, {3, 4}} {
+		if names(pair[0]) != names(pair[1]) {
+			t.Errorf("entries %d and %d don't share their field names", pair[0], pair[1])
+		}
+	}
+	for _, pair := range [][2]int{{2, 3}, {4, 5}} {
+		if names(pair[0]) == names(pair[1]) {
+			t.Errorf("entries %d and %d share field names that aren't the same", pair[0], pair[1])
+		}
+	}
+
+	want := "*3\r\n" +
+		"*2\r\n$3\r\n2-0\r\n*4\r\n$4\r\ntemp\r\n$2\r\n21\r\n$4\r\nunit\r\n$1\r\nC\r\n" +
+		"*2\r\n$3\r\n3-0\r\n*4\r\n$4\r\ntemp\r\n$2\r\n22\r\n$4\r\nunit\r\n$1\r\nF\r\n" +
+		"*2\r\n$3\r\n4-0\r\n*4\r\n$4\r\nunit\r\n$1\r\nC\r\n$4\r\ntemp\r\n$2\r\n23\r\n"
+	if got := run("XRANGE", "s", "2", "4"); got != want {
+		t.Errorf("XRANGE: got %q, want %q", got, want)
+	}
+}
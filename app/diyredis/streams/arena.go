@@ -0,0 +1,92 @@
+package streams
+
+// Inserting into the tree allocates a new `children` slice on almost every insert (the
+// slices grow by 2 at a time), and a fresh `extraChars` slice and Entry for every new
+// leaf. That's a lot of small allocations for the GC to keep track of.
+//
+// A nodeArena hands those out of larger chunks instead. Chunks are never reused as a
+// whole; a chunk is left to the GC once nothing points into it anymore. Within a chunk,
+// memory becomes garbage when:
+//   - a `children` slice is outgrown. It is kept in a free list per capacity, and handed
+//     out again by allocNodes.
+//   - the lowest entry is trimmed (see RxNode.deleteLowest). Its leaf's slot at the front
+//     of the parent's `children`, its `extraChars` and its Entry are dropped, not reused;
+//     they are reclaimed with their chunk, once everything else in it has been trimmed
+//     too. Trimming goes from the lowest entry up, so older chunks go first.
+//   - a node is copied on write (see RxNode.own). The originals may still be used by a
+//     snapshot, so they aren't freed, and are reclaimed with their chunk once the
+//     snapshots are done with them and the tree no longer uses the rest of the chunk.
+//
+// The arena is not safe for concurrent use; it is only used while holding the write
+// lock of its stream. A nil *nodeArena is valid and simply allocates from the heap.
+
+const (
+	nodeChunkSize  = 512
+	charChunkSize  = 4096
+	entryChunkSize = 256
+)
+
+type nodeArena struct {
+	nodes   []RxNode
+	chars   []uint8
+	entries []Entry
+	free    [65][][]RxNode // outgrown children slices, by capacity. There are at most 64 children.
+}
+
+// Return a slice of `length` empty nodes, with room for `capacity`.
+func (a *nodeArena) allocNodes(length int, capacity int) []RxNode {
+	if a == nil || capacity >= len(a.free) {
+		return make([]RxNode, length, capacity)
+	}
+	if free := a.free[capacity]; len(free) > 0 {
+		nodes := free[len(free)-1]
+		a.free[capacity] = free[:len(free)-1]
+		return nodes[:length]
+	}
+
+	if capacity > len(a.nodes) {
+		a.nodes = make([]RxNode, nodeChunkSize)
+	}
+	nodes := a.nodes[:length:capacity] // limit the capacity, so that appends never spill into the rest of the chunk
+	a.nodes = a.nodes[capacity:]
+	return nodes
+}
+
+// Give back a children slice that is no longer in use.
+func (a *nodeArena) freeNodes(nodes []RxNode) {
+	if a == nil || cap(nodes) >= len(a.free) {
+		return
+	}
+	nodes = nodes[:cap(nodes)]
+	clear(nodes) // don't keep whatever they point to alive
+	a.free[cap(nodes)] = append(a.free[cap(nodes)], nodes[:0])
+}
+
+// Return a copy of `chars`. It must never be modified, since it shares its backing array
+// with other nodes.
+func (a *nodeArena) allocChars(chars []uint8) []uint8 {
+	if a == nil {
+		return append([]uint8(nil), chars...)
+	}
+
+	if len(chars) > len(a.chars) {
+		a.chars = make([]uint8, charChunkSize)
+	}
+	result := a.chars[:len(chars):len(chars)]
+	copy(result, chars)
+	a.chars = a.chars[len(chars):]
+	return result
+}
+
+func (a *nodeArena) allocEntry() *Entry {
+	if a == nil {
+		return &Entry{}
+	}
+
+	if len(a.entries) == 0 {
+		a.entries = make([]Entry, entryChunkSize)
+	}
+	entry := &a.entries[0]
+	a.entries = a.entries[1:]
+	return entry
+}
@@ -3,6 +3,7 @@ package streams
 import (
 	"errors"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -14,11 +15,40 @@ type Key struct {
 type rxChar = uint8
 type internalKey = []rxChar // internal representation of a stream entry key
 
+const internalKeyLen = 22 // two uint64s of 11 base64 digits each
+
 var MaxKey = Key{MaxUint64, MaxUint64}
 var MinKey = Key{0, 0}
 
+// How a key without a sequence number, e.g. "123", is completed.
+type KeyMode int
+
+const (
+	KeyExact KeyMode = iota // it isn't: the sequence number is required
+	KeyStart                // with the lowest one, e.g. for the start of a range: "123-0"
+	KeyEnd                  // with the highest one, for the end of a range
+)
+
 func NewKey(key string, targetStream *Stream) (Key, error) {
-	part1, part2, err := parseEntryKey(key, targetStream.LastEntry.Key)
+	return NewKeyAt(key, targetStream, time.Now())
+}
+
+// Like NewKey, with now as the current time when the key is auto-generated.
+func NewKeyAt(key string, targetStream *Stream, now time.Time) (Key, error) {
+	part1, part2, err := parseEntryKey(key, targetStream.MaxID(), now, KeyExact)
+	if err != nil {
+		return Key{}, err
+	}
+	return Key{part1, part2}, nil
+}
+
+// Parse a key that doesn't depend on the keys already in a stream, i.e. one without
+// wildcards. The sequence number may be left out unless mode is KeyExact.
+func ParseKey(key string, mode KeyMode) (Key, error) {
+	if strings.Contains(key, "*") {
+		return Key{}, errors.New("invalid stream entry key: wildcards not allowed")
+	}
+	part1, part2, err := parseEntryKey(key, MinKey, time.Time{}, mode)
 	if err != nil {
 		return Key{}, err
 	}
@@ -52,7 +82,7 @@ func (k Key) Next() (key Key, overflow bool) {
 func (k Key) Prev() (key Key, underflow bool) {
 	leftNr, rightNr := k.LeftNr, k.RightNr-1
 
-	if k.RightNr == MaxUint64 { // underflow
+	if k.RightNr == 0 { // underflow
 		leftNr--
 
 		if leftNr == MaxUint64 {
@@ -113,7 +143,8 @@ func (k Key) IsMax() bool {
 //   - "-1" is valid and identical to "0-1", idem for "1-".
 //   - "-" represents the lowest possible key, and "+" the highest.
 //   - Accepts full wildcards (e.g. "*"), and partial wildcards (e.g. "123-*").
-func parseEntryKey(key string, lastKeyUsed Key) (uint64, uint64, error) {
+//   - Without a hyphen, e.g. "123", the sequence number is completed as mode says.
+func parseEntryKey(key string, lastKeyUsed Key, now time.Time, mode KeyMode) (uint64, uint64, error) {
 	if key == "-" {
 		// special case: lowest key
 		return 0, 0, nil
@@ -126,7 +157,7 @@ func parseEntryKey(key string, lastKeyUsed Key) (uint64, uint64, error) {
 
 	if key == "*" {
 		// special case: auto-generate
-		timestamp := uint64(time.Now().UnixMilli())
+		timestamp := uint64(now.UnixMilli())
 		var seq uint64
 		if timestamp == lastKeyUsed.LeftNr {
 			seq = lastKeyUsed.RightNr + 1
@@ -171,6 +202,13 @@ func parseEntryKey(key string, lastKeyUsed Key) (uint64, uint64, error) {
 		}
 	}
 	// If we _naturally_ exit the loop, we're missing a hyphen
+	switch {
+	case key == "":
+	case mode == KeyStart:
+		return result1, 0, nil
+	case mode == KeyEnd:
+		return result1, MaxUint64, nil
+	}
 	return 0, 0, errors.New("invalid stream entry key: no hyphen")
 
 secondLoop:
@@ -194,12 +232,12 @@ secondLoop:
 	return result1, result2, nil
 }
 
-// Return the internal representation of `k`, for use in radix.go.
-func (k Key) internalRepr() internalKey {
-	buf := make([]uint8, 22)
-	toBase64(buf[:11], k.LeftNr)
-	toBase64(buf[11:], k.RightNr)
-	return buf
+// Return the internal representation of `k`, for use in radix.go. It's an array rather
+// than a slice so that it can live on the stack: slice it where an internalKey is needed.
+func (k Key) internalRepr() (repr [internalKeyLen]rxChar) {
+	toBase64(repr[:11], k.LeftNr)
+	toBase64(repr[11:], k.RightNr)
+	return repr
 }
 
 // Represent `val` as a base64 number in `buf`. Each value in `buf` is one digit
@@ -55,6 +55,7 @@ type RxNode struct {
 	bitmap     uint64
 	extraChars []uint8 // extra characters (internal key symbols) for compressed single-child nodes. Any children of the node belongs to the last symbol in this field.
 	children   []RxNode
+	gen        uint64 // the generation `children` and `entry` belong to, see own
 }
 
 // A key-value pair.
@@ -108,8 +109,58 @@ func (n *RxNode) longestCommonPrefix(key internalKey) (
 	}
 }
 
-// Return a node satisfying `key`, starting from `n`, creating any nodes necessary.
-func (n *RxNode) create(key internalKey) *RxNode {
+// Snapshots of the tree (see Stream.Snapshot) share its nodes rather than copying them,
+// so nodes are copied on write instead. Every snapshot ends a generation of the tree: a
+// node may only be changed in the generation its `children` and `entry` were made in,
+// as they may be seen by a snapshot otherwise. Changing one that is older takes copies
+// of them first, leaving the originals as they are for the snapshots.
+//
+// Make `n` safe to change in generation `gen`. `n` itself must be safe to change already,
+// i.e. its parent must have been made safe to change first, unless it's the root.
+func (n *RxNode) own(gen uint64, arena *nodeArena) {
+	if n.gen == gen {
+		return
+	}
+	if n.children != nil {
+		children := arena.allocNodes(len(n.children), cap(n.children))
+		copy(children, n.children)
+		n.children = children
+	}
+	if n.entry != nil {
+		entry := arena.allocEntry()
+		*entry = *n.entry
+		n.entry = entry
+	}
+	n.gen = gen
+}
+
+// Make the nodes on the way from `n` to `key` safe to change in generation `gen`, as far
+// as they exist. Follows the same path as longestCommonPrefix.
+func (n *RxNode) ownPath(key internalKey, gen uint64, arena *nodeArena) {
+	var currentNode = n
+	for depth := 0; ; depth++ {
+		currentNode.own(gen, arena)
+		for i, char := range currentNode.extraChars {
+			if char != key[depth+i] {
+				return
+			}
+		}
+		depth += len(currentNode.extraChars)
+		if depth == len(key) {
+			return
+		}
+		bitmapOffset := key[depth]
+		if currentNode.bitmap&uint64(1<<bitmapOffset) == 0 {
+			return
+		}
+		currentNode = &currentNode.children[getChildIdx(currentNode.bitmap, bitmapOffset)]
+	}
+}
+
+// Return a node satisfying `key`, starting from `n`, creating any nodes necessary out of
+// `arena`. The nodes on the way are made safe to change in generation `gen`.
+func (n *RxNode) create(key internalKey, gen uint64, arena *nodeArena) *RxNode {
+	n.ownPath(key, gen, arena)
 	node, failIdx, extraFailIdx := n.longestCommonPrefix(key)
 	if failIdx == -1 {
 		return node // node already exists!
@@ -122,7 +173,7 @@ func (n *RxNode) create(key internalKey) *RxNode {
 		bitmask := uint64(1 << bitmapOffset)
 		node.bitmap |= bitmask
 		childIdx := getChildIdx(node.bitmap, bitmapOffset)
-		node.appendChild(childIdx)
+		node.appendChild(childIdx, arena)
 		newNode = &node.children[childIdx]
 	} else {
 		// Search failed while walking `extraPrefixes` -> Split the current compressed
@@ -134,20 +185,20 @@ func (n *RxNode) create(key internalKey) *RxNode {
 		// This is not a problem because this is an append-only data structure and,
 		// as a result, we never mutate the `extraChars` field. We only ever
 		// create it, or split it.
-		// We would not be able to do this if, for example, a Remove() method existed.
-		// Then, we would have to append to an existing `extraChars` when re-compressing
-		// after a deletion.
+		// Trimming (see deleteLowest) doesn't change that, because it never
+		// re-compresses the nodes it leaves behind.
 
 		// Fix current node by setting `extraChars` to only those before the split,
 		// as well as setting its two new children: the split node and a new node
 		// for the remaining digits in `key`
 		splitNodeOffset := node.extraChars[extraFailIdx]
 		newNodeOffset := key[failIdx]
+		node.children = arena.allocNodes(2, 2)
 		if newNodeOffset > splitNodeOffset {
-			node.children = []RxNode{splitNode, {}}
+			node.children[0] = splitNode
 			newNode = &node.children[1]
 		} else {
-			node.children = []RxNode{{}, splitNode}
+			node.children[1] = splitNode
 			newNode = &node.children[0]
 		}
 		node.extraChars = node.extraChars[:extraFailIdx]
@@ -161,17 +212,17 @@ func (n *RxNode) create(key internalKey) *RxNode {
 	// value into the tree so no branches are possible from here to leaf
 	lastPartOfKey := key[failIdx+1:]
 	if len(lastPartOfKey) > 0 {
-		newNode.extraChars = make([]uint8, len(lastPartOfKey))
-		copy(newNode.extraChars, lastPartOfKey)
+		newNode.extraChars = arena.allocChars(lastPartOfKey)
 	}
+	newNode.gen = gen
 
 	return newNode
 }
 
 // Make sure `childIdx` is a valid index in `children` of `n`. Will be an empty node.
-func (n *RxNode) appendChild(childIdx int) {
+func (n *RxNode) appendChild(childIdx int, arena *nodeArena) {
 	if n.children == nil {
-		n.children = []RxNode{{}}
+		n.children = arena.allocNodes(1, 1)
 		return
 	}
 	// Custom growth factor. This is something that can be tuned: a larger factor will
@@ -179,9 +230,10 @@ func (n *RxNode) appendChild(childIdx int) {
 	// allocations but be more memory efficient.
 	// The default is +2, which leans very heavily toward memory efficiency
 	if len(n.children)+1 > cap(n.children) {
-		newChildren := make([]RxNode, len(n.children)+1, cap(n.children)+2)
+		newChildren := arena.allocNodes(len(n.children)+1, cap(n.children)+2)
 		copy(newChildren, n.children[:childIdx])
 		copy(newChildren[childIdx+1:], n.children[childIdx:])
+		arena.freeNodes(n.children)
 		n.children = newChildren
 		return
 	}
@@ -192,6 +244,75 @@ func (n *RxNode) appendChild(childIdx int) {
 	n.children[childIdx] = RxNode{}
 }
 
+// Return a copy of the tree under `n`, node by node, with nodes and entries of its own
+// out of `arena`, all in generation 0. Only `extraChars` is shared with the original,
+// since it is never modified (see create).
+func (n *RxNode) clone(arena *nodeArena) RxNode {
+	clone := RxNode{bitmap: n.bitmap, extraChars: n.extraChars}
+	if n.entry != nil {
+		clone.entry = arena.allocEntry()
+		*clone.entry = *n.entry
+	}
+	if n.children != nil {
+		clone.children = arena.allocNodes(len(n.children), cap(n.children))
+		for i := range n.children {
+			clone.children[i] = n.children[i].clone(arena)
+		}
+	}
+	return clone
+}
+
+// Delete the leaf with the lowest key under `n`, along with any nodes that are left
+// without children because of it, in generation `gen`. Returns false if there are no
+// leaves to delete.
+//
+// Nodes that are left with a single child are not re-compressed. Nothing depends on
+// them being compressed, and entries are only ever deleted from the left, so they would
+// be deleted soon enough anyway.
+func (n *RxNode) deleteLowest(gen uint64, arena *nodeArena) bool {
+	var pathArr [internalKeyLen + 1]*RxNode // one node per symbol of the key, plus the root
+	path := append(pathArr[:0], n)
+	node := n
+	node.own(gen, arena)
+	for node.entry == nil {
+		if len(node.children) == 0 {
+			return false
+		}
+		node = &node.children[0] // children are ordered from lowest to highest
+		node.own(gen, arena)
+		path = append(path, node)
+	}
+	*node.entry = Entry{} // don't keep the value alive
+
+	for i := len(path) - 2; i >= 0; i-- {
+		parent := path[i]
+		parent.children[0] = RxNode{}
+		parent.children = parent.children[1:]
+		parent.bitmap &= parent.bitmap - 1 // clear the lowest bit, which belongs to children[0]
+		if len(parent.children) > 0 {
+			break
+		}
+	}
+	return true
+}
+
+// Return the entry with the lowest key under `n`, or the highest, or nil if there are no
+// entries at all.
+func (n *RxNode) edgeEntry(lowest bool) *Entry {
+	node := n
+	for node.entry == nil {
+		if len(node.children) == 0 {
+			return nil
+		}
+		if lowest {
+			node = &node.children[0]
+		} else {
+			node = &node.children[len(node.children)-1]
+		}
+	}
+	return node.entry
+}
+
 // Return entries under `n` with a key between `fromKey` and `toKey`, inclusively.
 // Ordered from lowest to highest key.
 func (n *RxNode) rangeEntries(fromKey internalKey, toKey internalKey) []Entry {
@@ -287,6 +408,57 @@ func (n *RxNode) rangeEntries(fromKey internalKey, toKey internalKey) []Entry {
 	}
 }
 
+// Call yield for every entry under `n` from `fromKey` up to and including `toKey`, from
+// lowest to highest key, or from highest to lowest if `reverse` is true, until it
+// returns false. Returns false if it stopped early: having gone past the range counts.
+//
+// Unlike rangeEntries, nothing is collected, and only the nodes leading to the entries
+// yielded are visited. `depth` is that of `n` in the tree; `low` and `high` tell whether
+// the key of `n` so far is that of `fromKey` or `toKey` respectively, so that the range
+// still bounds the entries under it.
+func (n *RxNode) walkRange(fromKey internalKey, toKey internalKey, depth int, low bool, high bool, reverse bool, yield func(Entry) bool) bool {
+	for i, char := range n.extraChars {
+		if low && char < fromKey[depth+i] {
+			return !reverse // all of them too low: skip, or done if going down
+		}
+		if high && char > toKey[depth+i] {
+			return reverse // all of them too high: done, or skip if going down
+		}
+		low = low && char == fromKey[depth+i]
+		high = high && char == toKey[depth+i]
+	}
+	depth += len(n.extraChars)
+
+	if depth == len(fromKey) {
+		return n.entry == nil || yield(*n.entry)
+	}
+
+	for i := range n.children {
+		if reverse {
+			i = len(n.children) - 1 - i
+		}
+		child := &n.children[i]
+		char := nthSetBit(n.bitmap, i)
+		if low && char < fromKey[depth] {
+			if reverse {
+				return false
+			}
+			continue
+		}
+		if high && char > toKey[depth] {
+			if !reverse {
+				return false
+			}
+			continue
+		}
+		childLow, childHigh := low && char == fromKey[depth], high && char == toKey[depth]
+		if !child.walkRange(fromKey, toKey, depth+1, childLow, childHigh, reverse, yield) {
+			return false
+		}
+	}
+	return true
+}
+
 // Return entries under `n` with a key higher than or equal to `key`, ordered from
 // lowest to highest key.
 func (n *RxNode) higherEntries(key internalKey) []Entry {
@@ -377,8 +549,8 @@ func (n *RxNode) higherSiblingsDFS(key internalKey) []*RxNode {
 // Return a set of nodes whose children all have a key that is lower or equal to `key`.
 // They are ordered by key; lowest to highest.
 //
-// Note that this does not return *all* higher nodes -- it just does a DFS for `key`,
-// grabbing any sibling nodes with a higher key at every level.
+// Note that this does not return *all* lower nodes -- it just does a DFS for `key`,
+// grabbing any sibling nodes with a lower key at every level.
 func (n *RxNode) lowerSiblingsDFS(key internalKey) []*RxNode {
 	result := []*RxNode{}
 	var currentNode = n
@@ -407,12 +579,14 @@ func (n *RxNode) lowerSiblingsDFS(key internalKey) []*RxNode {
 		childIdx := getChildIdx(currentNode.bitmap, bitmapOffset)
 
 		if currentNode.bitmap&bitmask == 0 {
-			// child does not exist: take all children lower than the hypothetical child, and return
-			return appendPtrs(result, currentNode.children[:childIdx-1])
+			// child does not exist: take all children lower than the hypothetical child, and return.
+			// childIdx is where the child would be, so that's all children before it.
+			return appendPtrs(result, currentNode.children[:childIdx])
 		}
 
-		// child exists: take all lower children and continue
-		result = appendPtrs(result, currentNode.children[:childIdx]) // todo: should this not also be appendPtrsReverse?
+		// child exists: take all lower children and continue. Siblings found further down
+		// are higher than these, so the result stays ordered lowest to highest.
+		result = appendPtrs(result, currentNode.children[:childIdx])
 		// Note: children slices are always ordered from lowest to highest
 		currentNode = &currentNode.children[childIdx]
 	}
@@ -421,8 +595,8 @@ func (n *RxNode) lowerSiblingsDFS(key internalKey) []*RxNode {
 // Does the unfortunate job of appending a pointer to each element of `slice`, to
 // `ptrSlice`.
 func appendPtrs(ptrSlice []*RxNode, slice []RxNode) []*RxNode {
-	for _, elem := range slice {
-		ptrSlice = append(ptrSlice, &elem)
+	for i := range slice {
+		ptrSlice = append(ptrSlice, &slice[i]) // not &elem, which would point to a copy
 	}
 	return ptrSlice
 }
@@ -441,6 +615,15 @@ func pop(s []*RxNode) ([]*RxNode, *RxNode) {
 	return s[:len(s)-1], val
 }
 
+// Return the offset of the `i`th high bit in `bitmap`, counting from the lowest: the
+// symbol of the `i`th child of a node.
+func nthSetBit(bitmap uint64, i int) rxChar {
+	for range i {
+		bitmap &= bitmap - 1 // clear the lowest
+	}
+	return rxChar(bits.TrailingZeros64(bitmap))
+}
+
 // Check `bitmap` against `bitmapOffset` and return what the index of the corresponding
 // child node *would* be. Does not check if the child actually exists.
 func getChildIdx(bitmap uint64, bitmapOffset uint8) int {
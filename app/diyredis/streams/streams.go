@@ -3,78 +3,192 @@
 package streams
 
 import (
+	"context"
 	"errors"
+	"iter"
 	"sync"
+	"sync/atomic"
 )
 
 const MaxUint64 = ^uint64(0)
 
 type Stream struct {
-	root      RxNode // root node
-	LastEntry Entry
-	// subscribers map[any]chan NewEntryMsg
-	// subscribers []chan NewEntryMsg
-	subscribers []subscription
-	mutex       sync.RWMutex
+	root       RxNode // root node
+	FirstEntry Entry  // the oldest entry still in the stream, zero if it is empty
+	LastEntry  Entry  // stays around even if the entry itself is trimmed. Only has a key after SetLastID.
+	length     int    // the number of entries, kept up to date by Put and Trim
+	mutex      sync.RWMutex
+	arena      nodeArena   // guarded by mutex
+	gen        uint64      // the generation of the tree changes are made in, see RxNode.own
+	shared     atomic.Bool // whether a snapshot was taken of the current generation
+
+	subscribers map[uint64]chan<- NewEntryMsg // guarded by mutex
+	nextSubID   atomic.Uint64
+	done        chan struct{} // closed by Close
+	closed      bool          // guarded by mutex
 }
 
 func NewStream() *Stream {
 	return &Stream{
-		// subscribers: make(map[any]chan NewEntryMsg),
-		subscribers: make([]subscription),
+		subscribers: make(map[uint64]chan<- NewEntryMsg),
+		done:        make(chan struct{}),
 	}
 }
 
-type subscription struct {
-	id any
-	ch chan NewEntryMsg
+var ErrStreamClosed = errors.New("the stream was closed")
+
+// Close the stream, e.g. because its key was deleted: it drops its subscribers, and Done
+// is closed so they can tell. Entries can still be read and added, but nobody will be
+// told about them anymore.
+func (s *Stream) Close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	clear(s.subscribers)
+	close(s.done)
+}
+
+// Return a channel that's closed once the stream is closed.
+func (s *Stream) Done() <-chan struct{} {
+	return s.done
 }
 
+// Return true if the stream was closed.
+func (s *Stream) Closed() bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.closed
+}
+
+// Sent to subscribers for every entry appended to the stream.
 type NewEntryMsg struct {
 	Entry
-	SubscriptionID any
+	SubscriptionID uint64
 }
 
 // Append an entry to the stream.
 func (s *Stream) Put(key Key, val any) error {
-	if key.IsMin() || !key.GreaterThan(s.LastEntry.Key) {
-		return errors.New("key too low")
-	}
-
 	internalKey := key.internalRepr()
 
 	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if key.IsMin() || !key.GreaterThan(s.LastEntry.Key) {
+		return errors.New("key too low")
+	}
 
-	newNode := s.root.create(internalKey)
+	newNode := s.root.create(internalKey[:], s.writeGen(), &s.arena)
 	if newNode.entry == nil {
-		newNode.entry = &Entry{Key: key, Val: val}
+		newNode.entry = s.arena.allocEntry()
+		*newNode.entry = Entry{Key: key, Val: val}
+		s.length++
+		if s.length == 1 {
+			s.FirstEntry = *newNode.entry
+		}
 	} else {
 		newNode.entry.Key = key
 		newNode.entry.Val = val
 	}
 	s.LastEntry = *newNode.entry
 
-	s.mutex.Unlock()
+	// Send the new entry to all subscribers. Sends don't block: a subscriber that isn't
+	// ready to receive misses out, which is why they should use a buffered channel.
+	for id, ch := range s.subscribers {
+		select {
+		case ch <- NewEntryMsg{SubscriptionID: id, Entry: s.LastEntry}:
+		default:
+		}
+	}
 
-	// Send new entry to all subscribers (non-blocking, if we can't send we ignore the subscription)
-	go func() {
-		for id, ch := range s.subscribers {
-			select {
-			case ch <- NewEntryMsg{SubscriptionID: id, Entry: *newNode.entry}:
-			default:
-			}
+	return nil
+}
+
+// Delete the oldest entries until at most maxLen are left. Returns the number of entries
+// deleted.
+func (s *Stream) Trim(maxLen int) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	deleted := 0
+	for s.length > max(maxLen, 0) && s.root.deleteLowest(s.writeGen(), &s.arena) {
+		s.length--
+		deleted++
+	}
+	if deleted > 0 {
+		s.FirstEntry = Entry{}
+		if entry := s.root.edgeEntry(true); entry != nil {
+			s.FirstEntry = *entry
 		}
-	}()
+	}
+	return deleted
+}
+
+// The generation to change the tree in: a new one if a snapshot was taken of the current
+// one, whose nodes must stay the way they are from now on. Must hold the write lock.
+func (s *Stream) writeGen() uint64 {
+	if s.shared.Swap(false) {
+		s.gen++
+	}
+	return s.gen
+}
+
+// Return the key of the oldest entry in the stream, or MinKey if it is empty.
+func (s *Stream) MinID() Key {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.FirstEntry.Key
+}
+
+// Return the key of the last entry added to the stream, which may have been trimmed
+// since, or the key set by SetLastID. New entries must have a higher key than this.
+func (s *Stream) MaxID() Key {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.LastEntry.Key
+}
+
+// Return the last entry added to the stream, which stays around even if it was trimmed,
+// without its value if SetLastID was called since.
+func (s *Stream) Last() Entry {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.LastEntry
+}
+
+var ErrLastIDTooLow = errors.New("the ID specified is smaller than the top item in the stream")
+
+// Set the key that new entries must be higher than. It can't be lower than the key of
+// the newest entry in the stream, but it can be lower than the previous last ID.
+func (s *Stream) SetLastID(key Key) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 
+	if top := s.root.edgeEntry(false); top != nil && key.LesserThan(top.Key) {
+		return ErrLastIDTooLow
+	}
+	if key != s.LastEntry.Key {
+		s.LastEntry = Entry{Key: key}
+	}
 	return nil
 }
 
+// Return the number of entries in the stream.
+func (s *Stream) Len() int {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.length
+}
+
 // Get the value for a given key, and whether it was found.
 func (s *Stream) Search(key Key) (any, bool) {
 	s.mutex.RLock()
 	defer s.mutex.RUnlock()
 
-	node, failIdx, _ := s.root.longestCommonPrefix(key.internalRepr())
+	internalKey := key.internalRepr()
+	node, failIdx, _ := s.root.longestCommonPrefix(internalKey[:])
 	if failIdx == -1 {
 		return node.entry.Val, true
 	} else {
@@ -86,87 +200,146 @@ func (s *Stream) Search(key Key) (any, bool) {
 // Results are ordered from lowest to highest key.
 //
 // If fromKey > toKey; the resultset will be empty.
+//
+// The entries are collected from a snapshot, so that entries can be added (and trimmed)
+// in the meantime, however long that takes.
 func (s *Stream) Range(fromKey Key, toKey Key) []Entry {
-	if !fromKey.LesserThan(toKey) {
-		return []Entry{}
-	}
+	snapshot := s.Snapshot()
+	return snapshot.Range(fromKey, toKey)
+}
 
+// The stream as it was at some point, which stays that way however the stream changes
+// afterwards. It's safe to read from without any locking.
+type Snapshot struct {
+	root       RxNode
+	FirstEntry Entry
+	LastEntry  Entry
+	length     int
+}
+
+// Take a snapshot of the stream as it is now. That doesn't copy anything: the snapshot
+// shares the nodes of the stream, and the stream copies the nodes it changes instead,
+// the first time it changes them after the snapshot (see RxNode.own).
+func (s *Stream) Snapshot() Snapshot {
 	s.mutex.RLock()
 	defer s.mutex.RUnlock()
+	s.shared.Store(true)
+	return Snapshot{root: s.root, FirstEntry: s.FirstEntry, LastEntry: s.LastEntry, length: s.length}
+}
+
+// Return the number of entries in the snapshot.
+func (s *Snapshot) Len() int {
+	return s.length
+}
+
+// Return the entry with the highest key in the snapshot, and whether there is one at all.
+// Unlike LastEntry, that's never an entry that was trimmed, or a key set by SetLastID.
+func (s *Snapshot) TopEntry() (Entry, bool) {
+	if entry := s.root.edgeEntry(false); entry != nil {
+		return *entry, true
+	}
+	return Entry{}, false
+}
+
+// Get all entries between the two given keys, inclusively, as Stream.Range does.
+func (s *Snapshot) Range(fromKey Key, toKey Key) []Entry {
+	if toKey.LesserThan(fromKey) {
+		return []Entry{}
+	}
+
+	fromInternal, toInternal := fromKey.internalRepr(), toKey.internalRepr()
 
 	// Optimized case: "since"-like query
 	if toKey.IsMax() {
-		return s.root.higherEntries(fromKey.internalRepr())
+		return s.root.higherEntries(fromInternal[:])
 	}
 
-	return s.root.rangeEntries(fromKey.internalRepr(), toKey.internalRepr())
+	return s.root.rangeEntries(fromInternal[:], toInternal[:])
 }
 
-// Subscribe to this stream, receiving any newly added entries over the channel ch
-// as they come in. The caller MUST unsubcribe sometime later using Unsubscribe().
-func (s *Stream) Subscribe(ch chan NewEntryMsg, id any) {
-	sub := subscription{id: id, ch: ch}
-
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
-
-	// Add channel to subscribers
-	for i, sub := range s.subscribers {
-		if sub.ch == nil {
-			s.subscribers[i] = sub
+// The entries between the two given keys, inclusively, from lowest to highest key, or
+// from highest to lowest if reverse is true. Unlike Range, they're only looked up as
+// they're iterated over, so that stopping after a few, e.g. for a COUNT, only costs as
+// much as those few.
+func (s *Snapshot) Entries(fromKey Key, toKey Key, reverse bool) iter.Seq[Entry] {
+	return func(yield func(Entry) bool) {
+		if toKey.LesserThan(fromKey) {
 			return
 		}
+		fromInternal, toInternal := fromKey.internalRepr(), toKey.internalRepr()
+		s.root.walkRange(fromInternal[:], toInternal[:], 0, true, true, reverse, yield)
 	}
-	s.subscribers = append(s.subscribers, sub)
+}
 
-	// // Create unsubscribe function
-	// unsub = func() {
-	// 	s.mutex.Lock()
-	// 	defer s.mutex.Unlock()
+// Like Range, but only up to the first n entries, or all of them if n is negative.
+func (s *Snapshot) RangeN(fromKey Key, toKey Key, n int) []Entry {
+	entries := []Entry{}
+	if n == 0 {
+		return entries
+	}
+	for entry := range s.Entries(fromKey, toKey, false) {
+		entries = append(entries, entry)
+		if len(entries) == n {
+			break
+		}
+	}
+	return entries
+}
 
-	// 	for id, ch := range s.subscribers {
-	// 		if sub == ch {
-	// 			s.subscribers[i] = nil
-	// 			return
-	// 		}
-	// 	}
-	// }
+// Return a copy of the stream, without its subscribers. The tree is copied as it is,
+// rather than built again by adding every entry, and values are shared with the original
+// rather than copied, since entries don't change once they are added.
+func (s *Stream) Clone() *Stream {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
 
-	// return unsub
+	clone := NewStream()
+	clone.root = s.root.clone(&clone.arena)
+	clone.FirstEntry = s.FirstEntry
+	clone.LastEntry = s.LastEntry
+	clone.length = s.length
+	return clone
 }
 
-func (s *Stream) Unsubscribe(ch chan NewEntryMsg) {
-	if ch == nil {
-		return
-	}
+// Subscribe to this stream, receiving any newly added entries over the channel ch
+// as they come in. Returns the ID of the subscription, which is also included in every
+// message. The caller MUST unsubscribe sometime later using Unsubscribe(), unless the
+// stream is closed first (see Done), which ends every subscription.
+//
+// The same channel may be subscribed to several streams, to wait for whichever of them
+// gets a new entry first.
+func (s *Stream) Subscribe(ch chan<- NewEntryMsg) uint64 {
+	id := s.nextSubID.Add(1)
 
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
-
-	for i, sub := range s.subscribers {
-		if sub.ch == ch {
-			s.subscribers[i] = subscription{}
-		}
+	if !s.closed {
+		s.subscribers[id] = ch
 	}
+	return id
 }
 
-// func (s *Stream) Unsubscribe(subscriptionID uint) {
-// 	if subscriptionID > uint(len(s.subscribers)) {
-// 		return
-// 	}
-
-// 	s.mutex.Lock()
-// 	s.subscribers[subscriptionID] = nil
-// 	s.mutex.Unlock()
-// }
-
-// Block the goroutine until a new entry is appended to the stream, and return it.
-func (s *Stream) WaitForEntry() Entry {
-	// TODO: this is an awfully shallow abstraction, despite its clean semantics. Perhaps don't bother.
-	ch := make(chan NewEntryMsg)
-	subID := s.Subscribe(ch, a)
-	defer s.Unsubscribe(subID)
+// Stop sending new entries to the subscription with the given ID. Once this returns, no
+// more messages will be sent for it.
+func (s *Stream) Unsubscribe(id uint64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.subscribers, id)
+}
 
-	res := <-ch
-	return res.Entry
+// Block the goroutine until a new entry is appended to the stream, and return it. Returns
+// ctx.Err() if ctx is done before then, or ErrStreamClosed if the stream is closed.
+func (s *Stream) WaitForEntry(ctx context.Context) (Entry, error) {
+	ch := make(chan NewEntryMsg, 1)
+	id := s.Subscribe(ch)
+	defer s.Unsubscribe(id)
+
+	select {
+	case msg := <-ch:
+		return msg.Entry, nil
+	case <-ctx.Done():
+		return Entry{}, ctx.Err()
+	case <-s.done:
+		return Entry{}, ErrStreamClosed
+	}
 }
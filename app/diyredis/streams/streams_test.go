@@ -1,10 +1,16 @@
 package streams
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"math/rand"
+	"reflect"
+	"slices"
 	"sort"
+	"sync"
 	"testing"
+	"time"
 
 	radix "github.com/armon/go-radix"
 	anothertrie "github.com/dghubble/trie"
@@ -41,22 +47,14 @@ func genRandStreamKeys(seed int64, count int) []Key {
 }
 
 func TestKeyGenBasic(t *testing.T) {
-	internalReprDiff := func(val1 []uint8, val2 []uint8) bool {
-		if len(val1) != len(val2) {
-			return true
-		}
-		for i, v := range val1 {
-			if v != val2[i] {
-				return true
-			}
-		}
-		return false
+	internalReprDiff := func(val1 [internalKeyLen]uint8, val2 [internalKeyLen]uint8) bool {
+		return val1 != val2
 	}
 
 	stream := NewStream()
 	key1 := Key{0, 0}
 	key1internalRepr := key1.internalRepr()
-	if len(key1internalRepr) != 22 || key1.LeftNr != 0 || key1.RightNr != 0 || internalReprDiff(key1internalRepr, []uint8{21: 0}) {
+	if key1.LeftNr != 0 || key1.RightNr != 0 || internalReprDiff(key1internalRepr, [internalKeyLen]uint8{21: 0}) {
 		t.Errorf("wrong key generated for number 0, 0")
 	}
 
@@ -84,16 +82,16 @@ func TestKeyGenBasic(t *testing.T) {
 	}
 
 	// Check the base64 internal representation
-	if internalReprDiff(Key{0, 63}.internalRepr(), []uint8{21: 63}) {
+	if internalReprDiff(Key{0, 63}.internalRepr(), [internalKeyLen]uint8{21: 63}) {
 		t.Errorf("wrong internal representation of key (%v,%v)", 0, 63)
 	}
-	if internalReprDiff(Key{0, 64}.internalRepr(), []uint8{20: 1, 21: 0}) {
+	if internalReprDiff(Key{0, 64}.internalRepr(), [internalKeyLen]uint8{20: 1, 21: 0}) {
 		t.Errorf("wrong internal representation of key (%v, %v)", 0, 64)
 	}
-	if internalReprDiff(Key{0, 127}.internalRepr(), []uint8{20: 1, 21: 63}) {
+	if internalReprDiff(Key{0, 127}.internalRepr(), [internalKeyLen]uint8{20: 1, 21: 63}) {
 		t.Errorf("wrong internal representation of key (%v, %v)", 0, 127)
 	}
-	if internalReprDiff(Key{0, 128}.internalRepr(), []uint8{20: 2, 21: 0}) {
+	if internalReprDiff(Key{0, 128}.internalRepr(), [internalKeyLen]uint8{20: 2, 21: 0}) {
 		t.Errorf("wrong internal representation of key (%v, %v)", 0, 128)
 	}
 }
@@ -142,6 +140,31 @@ func TestKeyGenWildcard(t *testing.T) {
 	}
 }
 
+func TestParseKeyModes(t *testing.T) {
+	for _, tc := range []struct {
+		key  string
+		mode KeyMode
+		want Key
+		ok   bool
+	}{
+		{"5-3", KeyExact, Key{5, 3}, true},
+		{"5", KeyExact, Key{}, false},
+		{"5", KeyStart, Key{5, 0}, true},
+		{"5", KeyEnd, Key{5, MaxUint64}, true},
+		{"5-3", KeyEnd, Key{5, 3}, true},
+		{"-", KeyEnd, MinKey, true},
+		{"+", KeyStart, MaxKey, true},
+		{"", KeyStart, Key{}, false},
+		{"5x", KeyStart, Key{}, false},
+		{"5-*", KeyStart, Key{}, false},
+	} {
+		got, err := ParseKey(tc.key, tc.mode)
+		if (err == nil) != tc.ok || got != tc.want {
+			t.Errorf("ParseKey(%q, %v) = %v, %v; want %v, ok: %v", tc.key, tc.mode, got, err, tc.want, tc.ok)
+		}
+	}
+}
+
 func TestStreamSetAndTest(t *testing.T) {
 	stream := NewStream()
 
@@ -292,6 +315,345 @@ func TestRangeComplex(t *testing.T) {
 	}
 }
 
+// Return a random number for a key. Most are drawn from a small range, so that keys share
+// long prefixes and the tree ends up with plenty of splits and compressed nodes; the
+// rest can be anything.
+func genClusteredNr(randgen *rand.Rand) uint64 {
+	switch randgen.Intn(4) {
+	case 0:
+		return randgen.Uint64()
+	case 1:
+		return uint64(randgen.Intn(1 << 20))
+	default:
+		return uint64(randgen.Intn(300))
+	}
+}
+
+// Generate a sorted set of up to `count` unique keys, clustered like genClusteredNr.
+func genClusteredKeys(randgen *rand.Rand, count int) []Key {
+	unique := map[Key]struct{}{}
+	for range count {
+		key := Key{genClusteredNr(randgen), genClusteredNr(randgen)}
+		if !key.IsMin() { // can't be inserted
+			unique[key] = struct{}{}
+		}
+	}
+	keys := make([]Key, 0, len(unique))
+	for key := range unique {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].LesserThan(keys[j]) })
+	return keys
+}
+
+// Pick a key to query with: often one in the stream or right next to one, since that's
+// where off-by-one errors hide.
+func genQueryKey(randgen *rand.Rand, keys []Key) Key {
+	if len(keys) == 0 || randgen.Intn(4) == 0 {
+		return Key{genClusteredNr(randgen), genClusteredNr(randgen)}
+	}
+	key := keys[randgen.Intn(len(keys))]
+	switch randgen.Intn(3) {
+	case 0:
+		if prev, underflow := key.Prev(); !underflow {
+			return prev
+		}
+	case 1:
+		if next, overflow := key.Next(); !overflow {
+			return next
+		}
+	}
+	return key
+}
+
+// Cross-check Range(), higherEntries() and lowerEntries() against a plain sorted slice,
+// over many random streams.
+func TestRangeProperties(t *testing.T) {
+	randgen := rand.New(rand.NewSource(seed))
+	for range 2000 {
+		keys := genClusteredKeys(randgen, randgen.Intn(64))
+		stream := NewStream()
+		want := make([]Entry, len(keys))
+		for i, key := range keys {
+			want[i] = Entry{key, i}
+			if err := stream.Put(key, i); err != nil {
+				t.Fatalf("got error while inserting key %s: %s", key, err)
+			}
+		}
+
+		// Reference results, straight from the sorted slice
+		between := func(from Key, to Key) []Entry {
+			result := []Entry{}
+			for _, entry := range want {
+				if !entry.Key.LesserThan(from) && !entry.Key.GreaterThan(to) {
+					result = append(result, entry)
+				}
+			}
+			return result
+		}
+
+		// Sometimes trim some of the oldest entries first
+		if len(want) > 0 && randgen.Intn(4) == 0 {
+			maxLen := randgen.Intn(len(want))
+			if deleted := stream.Trim(maxLen); deleted != len(want)-maxLen {
+				t.Fatalf("Trim(%d) on %v: deleted %d entries", maxLen, keys, deleted)
+			}
+			want = want[len(want)-maxLen:]
+		}
+		if stream.Len() != len(want) {
+			t.Fatalf("got length %d, want %d", stream.Len(), len(want))
+		}
+
+		for range 20 {
+			from, to := genQueryKey(randgen, keys), genQueryKey(randgen, keys)
+			if got, want := stream.Range(from, to), between(from, to); !isEqual(got, want) {
+				t.Fatalf("Range(%s, %s) on %v: got %v, want %v", from, to, keys, got, want)
+			}
+			if got, want := stream.Range(from, MaxKey), between(from, MaxKey); !isEqual(got, want) {
+				t.Fatalf("Range(%s, max) on %v: got %v, want %v", from, keys, got, want)
+			}
+			snapshot := stream.Snapshot()
+			for _, reverse := range []bool{false, true} {
+				want := between(from, to)
+				if reverse {
+					slices.Reverse(want)
+				}
+				if got := slices.Collect(snapshot.Entries(from, to, reverse)); !isEqual(got, want) {
+					t.Fatalf("Entries(%s, %s, %v) on %v: got %v, want %v", from, to, reverse, keys, got, want)
+				}
+			}
+			n, wantN := randgen.Intn(len(keys)+2)-1, between(from, to)
+			if n >= 0 && n < len(wantN) {
+				wantN = wantN[:n]
+			}
+			if got := snapshot.RangeN(from, to, n); !isEqual(got, wantN) {
+				t.Fatalf("RangeN(%s, %s, %d) on %v: got %v, want %v", from, to, n, keys, got, wantN)
+			}
+			fromInternal, toInternal := from.internalRepr(), to.internalRepr()
+			if got, want := stream.root.higherEntries(fromInternal[:]), between(from, MaxKey); !isEqual(got, want) {
+				t.Fatalf("higherEntries(%s) on %v: got %v, want %v", from, keys, got, want)
+			}
+			if got, want := stream.root.lowerEntries(toInternal[:]), between(MinKey, to); !isEqual(got, want) {
+				t.Fatalf("lowerEntries(%s) on %v: got %v, want %v", to, keys, got, want)
+			}
+		}
+	}
+}
+
+func TestTrim(t *testing.T) {
+	stream := NewStream()
+	for i, key := range testStreamKeys[:1000] {
+		stream.Put(key, i)
+	}
+
+	if deleted := stream.Trim(10); deleted != 990 {
+		t.Errorf("deleted %d entries, want 990", deleted)
+	}
+	got := stream.Range(MinKey, MaxKey)
+	if len(got) != 10 || got[0].Key != testStreamKeys[990] {
+		t.Errorf("got %v, want the last 10 entries", got)
+	}
+	if _, ok := stream.Search(testStreamKeys[0]); ok {
+		t.Errorf("trimmed entry can still be found")
+	}
+
+	// Trimming everything leaves an empty stream that can still be added to
+	stream.Trim(0)
+	if stream.Len() != 0 || len(stream.Range(MinKey, MaxKey)) != 0 {
+		t.Errorf("stream is not empty")
+	}
+	if stream.LastEntry.Key != testStreamKeys[999] {
+		t.Errorf("got last entry %v, want it to survive trimming", stream.LastEntry)
+	}
+	if err := stream.Put(testStreamKeys[999], 0); err == nil {
+		t.Errorf("a key no higher than the last trimmed one was inserted")
+	}
+	next, _ := testStreamKeys[999].Next()
+	if err := stream.Put(next, "new"); err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := stream.Search(next); !ok || got != "new" {
+		t.Errorf("got (%v, %v), want the new entry", got, ok)
+	}
+}
+
+func TestMinMaxID(t *testing.T) {
+	stream := NewStream()
+	if stream.MinID() != MinKey || stream.MaxID() != MinKey {
+		t.Errorf("got %v and %v for an empty stream", stream.MinID(), stream.MaxID())
+	}
+	for i := range 5 {
+		stream.Put(Key{uint64(i + 1), 0}, i)
+	}
+	if stream.MinID() != (Key{1, 0}) || stream.MaxID() != (Key{5, 0}) {
+		t.Errorf("got %v and %v, want 1-0 and 5-0", stream.MinID(), stream.MaxID())
+	}
+	stream.Trim(2)
+	if stream.MinID() != (Key{4, 0}) || stream.FirstEntry.Val != 3 {
+		t.Errorf("got first entry %v, want 4-0", stream.FirstEntry)
+	}
+
+	if err := stream.SetLastID(Key{4, 5}); err != ErrLastIDTooLow {
+		t.Errorf("got %v, want %v", err, ErrLastIDTooLow)
+	}
+	if err := stream.SetLastID(Key{10, 0}); err != nil {
+		t.Fatal(err)
+	}
+	if stream.MaxID() != (Key{10, 0}) {
+		t.Errorf("got %v, want 10-0", stream.MaxID())
+	}
+	if err := stream.Put(Key{9, 0}, "x"); err == nil {
+		t.Errorf("a key lower than the last ID was inserted")
+	}
+	// Lowering it again is fine, as long as it's not below the top entry
+	if err := stream.SetLastID(Key{5, 0}); err != nil {
+		t.Errorf("got %v", err)
+	}
+
+	stream.Trim(0)
+	if stream.MinID() != MinKey {
+		t.Errorf("got %v for an empty stream", stream.MinID())
+	}
+	if err := stream.SetLastID(Key{1, 0}); err != nil {
+		t.Errorf("got %v, want any ID to be allowed on an empty stream", err)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	stream := NewStream()
+	ch := make(chan NewEntryMsg, 1)
+	id := stream.Subscribe(ch)
+
+	stream.Put(Key{1, 1}, "a")
+	msg := <-ch
+	if msg.SubscriptionID != id || msg.Key != (Key{1, 1}) || msg.Val != "a" {
+		t.Errorf("got %v, want entry 1-1 for subscription %d", msg, id)
+	}
+
+	// Sends don't block on a full channel
+	stream.Put(Key{1, 2}, "b")
+	stream.Put(Key{1, 3}, "c")
+	if msg := <-ch; msg.Key != (Key{1, 2}) {
+		t.Errorf("got %v, want entry 1-2", msg)
+	}
+
+	stream.Unsubscribe(id)
+	stream.Put(Key{1, 4}, "d")
+	select {
+	case msg := <-ch:
+		t.Errorf("got %v after unsubscribing", msg)
+	default:
+	}
+
+	// One channel, several streams
+	other := NewStream()
+	id1, id2 := stream.Subscribe(ch), other.Subscribe(ch)
+	if id1 == id2 {
+		t.Errorf("subscriptions share ID %d", id1)
+	}
+	other.Put(Key{5, 5}, "e")
+	if msg := <-ch; msg.SubscriptionID != id2 {
+		t.Errorf("got subscription %d, want %d", msg.SubscriptionID, id2)
+	}
+}
+
+func TestSubscribeConcurrent(t *testing.T) {
+	stream := NewStream()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := range 1000 {
+			stream.Put(Key{uint64(i + 1), 0}, i)
+		}
+	}()
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 100 {
+				ch := make(chan NewEntryMsg, 1)
+				id := stream.Subscribe(ch)
+				stream.Unsubscribe(id)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestWaitForEntry(t *testing.T) {
+	stream := NewStream()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		// Keep adding entries until one arrives after WaitForEntry subscribed
+		for i := 1; ; i++ {
+			select {
+			case <-done:
+				return
+			case <-time.After(time.Millisecond):
+				stream.Put(Key{uint64(i), 0}, i)
+			}
+		}
+	}()
+	entry, err := stream.WaitForEntry(context.Background())
+	if err != nil || entry.Val == nil {
+		t.Errorf("got (%v, %v), want an entry", entry, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := NewStream().WaitForEntry(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestClose(t *testing.T) {
+	stream := NewStream()
+	ch := make(chan NewEntryMsg, 1)
+	stream.Subscribe(ch)
+	waitErr := make(chan error)
+	go func() {
+		_, err := stream.WaitForEntry(context.Background())
+		waitErr <- err
+	}()
+	for stream.subscriberCount() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	stream.Close()
+	stream.Close() // closing again is fine
+	if err := <-waitErr; !errors.Is(err, ErrStreamClosed) {
+		t.Errorf("WaitForEntry: got %v, want %v", err, ErrStreamClosed)
+	}
+	select {
+	case <-stream.Done():
+	default:
+		t.Errorf("Done isn't closed")
+	}
+	if !stream.Closed() {
+		t.Errorf("Closed: got false")
+	}
+
+	// Subscriptions ended, and no new ones are made
+	stream.Subscribe(ch)
+	stream.Put(Key{1, 1}, "a")
+	select {
+	case msg := <-ch:
+		t.Errorf("got %v after closing", msg)
+	default:
+	}
+	if n := stream.subscriberCount(); n != 0 {
+		t.Errorf("%d subscribers left", n)
+	}
+}
+
+func (s *Stream) subscriberCount() int {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return len(s.subscribers)
+}
+
 func isEqual(first []Entry, second []Entry) bool {
 	if len(first) != len(second) {
 		return false
@@ -307,6 +669,7 @@ func isEqual(first []Entry, second []Entry) bool {
 }
 
 func BenchmarkTrieInsert(b *testing.B) {
+	b.ReportAllocs()
 	stream := NewStream()
 	b.ResetTimer()
 	for i := range b.N {
@@ -315,7 +678,41 @@ func BenchmarkTrieInsert(b *testing.B) {
 	}
 }
 
+// Inserts straight into the tree, bypassing Put, to compare allocations with and without
+// a nodeArena.
+func BenchmarkTreeInsert(b *testing.B) {
+	for _, bc := range []struct {
+		name     string
+		newArena func() *nodeArena
+	}{
+		{"heap", func() *nodeArena { return nil }},
+		{"arena", func() *nodeArena { return &nodeArena{} }},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			b.ReportAllocs()
+			keys := make([]internalKey, len(testStreamKeys))
+			for i, key := range testStreamKeys {
+				repr := key.internalRepr()
+				keys[i] = repr[:]
+			}
+			var root RxNode
+			arena := bc.newArena()
+			b.ResetTimer()
+			for i := range b.N {
+				if i%len(keys) == 0 {
+					root, arena = RxNode{}, bc.newArena() // start over, instead of only finding existing keys
+				}
+				node := root.create(keys[i%len(keys)], 0, arena)
+				if node.entry == nil {
+					node.entry = arena.allocEntry()
+				}
+			}
+		})
+	}
+}
+
 func BenchmarkTrieSearch(b *testing.B) {
+	b.ReportAllocs()
 	stream := NewStream()
 	for i := range b.N {
 		key := testStreamKeys[i%len(testStreamKeys)]
@@ -428,3 +825,140 @@ func BenchmarkAnotherRadixSearch(b *testing.B) {
 // 		hm.Get(string(testStreamKeys[i%len(testStreamKeys)]))
 // 	}
 // }
+
+func TestClone(t *testing.T) {
+	stream := NewStream()
+	for i, key := range testStreamKeys[:100] {
+		stream.Put(key, i)
+	}
+	stream.Trim(50)
+
+	clone := stream.Clone()
+	stream.Put(testStreamKeys[100], 100)
+	if clone.Len() != 50 || clone.FirstEntry.Key != testStreamKeys[50] || clone.LastEntry.Key != testStreamKeys[99] {
+		t.Errorf("got %d entries from %v to %v, want the 50 entries from before the Put", clone.Len(), clone.FirstEntry.Key, clone.LastEntry.Key)
+	}
+	got := clone.Range(MinKey, MaxKey)
+	for i, entry := range got {
+		if entry.Key != testStreamKeys[50+i] || entry.Val != 50+i {
+			t.Fatalf("entry %d: got %v", i, entry)
+		}
+	}
+	// The last ID survives, even if it's not an entry's
+	if err := clone.Put(testStreamKeys[99], 0); err == nil {
+		t.Errorf("a key no higher than the last one was inserted")
+	}
+
+	// Changing either one doesn't change the other
+	clone.Put(testStreamKeys[100], -100)
+	clone.Put(testStreamKeys[101], 101)
+	stream.Trim(10)
+	if got, ok := stream.Search(testStreamKeys[100]); !ok || got != 100 {
+		t.Errorf("got %v after putting the same key in the clone, want 100", got)
+	}
+	if stream.Len() != 10 || clone.Len() != 52 {
+		t.Errorf("got %d and %d entries, want 10 and 52", stream.Len(), clone.Len())
+	}
+	clone.Trim(1)
+	got = stream.Range(MinKey, MaxKey)
+	if len(got) != 10 || got[0].Key != testStreamKeys[91] || got[0].Val != 91 {
+		t.Errorf("got %v after trimming the clone, want the 10 entries from %v", got, testStreamKeys[91])
+	}
+}
+
+func BenchmarkClone(b *testing.B) {
+	stream := NewStream()
+	for i, key := range testStreamKeys {
+		stream.Put(key, i)
+	}
+	b.ResetTimer()
+
+	for range b.N {
+		stream.Clone()
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	stream := NewStream()
+	for i, key := range testStreamKeys[:1000] {
+		stream.Put(key, i)
+	}
+	snapshot := stream.Snapshot()
+	want := stream.Range(MinKey, MaxKey)
+
+	// Neither adding nor trimming entries changes what the snapshot has
+	for i, key := range testStreamKeys[1000:2000] {
+		stream.Put(key, 1000+i)
+	}
+	stream.Trim(500)
+	if got := snapshot.Range(MinKey, MaxKey); snapshot.Len() != 1000 || !reflect.DeepEqual(got, want) {
+		t.Errorf("got %d entries from the snapshot, want the %d from before", len(got), len(want))
+	}
+	if got := stream.Range(MinKey, MaxKey); len(got) != 500 || got[0].Key != testStreamKeys[1500] {
+		t.Errorf("got %d entries from the stream, want 500", len(got))
+	}
+
+	// Snapshots are read while the stream keeps changing
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i, key := range testStreamKeys[2000:5000] {
+			stream.Put(key, 2000+i)
+			if i%100 == 0 {
+				stream.Trim(1000)
+			}
+		}
+	}()
+	for range 50 {
+		snapshot := stream.Snapshot()
+		got := snapshot.Range(MinKey, MaxKey)
+		if len(got) != snapshot.Len() {
+			t.Fatalf("got %d entries from a snapshot of %d", len(got), snapshot.Len())
+		}
+		for i := 1; i < len(got); i++ {
+			if !got[i].Key.GreaterThan(got[i-1].Key) || got[i].Val != got[i-1].Val.(int)+1 {
+				t.Fatalf("got %v after %v", got[i], got[i-1])
+			}
+		}
+	}
+	wg.Wait()
+}
+
+// Adding entries while others read long ranges, which used to hold up every Put until
+// they were done.
+func BenchmarkPutWhileRanging(b *testing.B) {
+	stream := NewStream()
+	for i, key := range testStreamKeys[:len(testStreamKeys)/2] {
+		stream.Put(key, i)
+	}
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					stream.Range(MinKey, MaxKey)
+				}
+			}
+		}()
+	}
+	b.ResetTimer()
+
+	for i := range b.N {
+		key := testStreamKeys[len(testStreamKeys)/2+i%(len(testStreamKeys)/2)]
+		if err := stream.Put(key, i); err != nil {
+			stream.Trim(0)
+			stream.SetLastID(MinKey)
+			stream.Put(key, i)
+		}
+	}
+	b.StopTimer()
+	close(stop)
+	wg.Wait()
+}
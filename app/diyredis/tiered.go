@@ -0,0 +1,320 @@
+package diyredis
+
+import (
+	"container/list"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// For datasets larger than memory: the "tiered" storage engine spills strings of at
+// least Threshold bytes to a file of their own, in a new directory made within RdbDir (or
+// the temporary directory if RdbDir isn't set) when the first value is spilled, and
+// deleted again on shutdown. The ones read or written most recently stay in memory too,
+// up to HotMemory bytes of them; the others are cold, only on disk, and read back
+// whenever they're accessed. Other types of values are changed in place, so they always
+// stay in memory.
+type TieredConfig struct {
+	Threshold atomic.Int64 // strings at least this long are spilled to disk
+	HotMemory atomic.Int64 // bytes of spilled strings to keep in memory as well
+}
+
+const (
+	DefaultTieredThreshold = 16 * 1024
+	DefaultTieredHotMemory = 64 * 1024 * 1024
+)
+
+// A string spilled to disk.
+type spilledValue struct {
+	path  string
+	size  int64
+	hot   atomic.Pointer[string] // the value, while it's in memory too
+	elem  *list.Element          // in tieredStore.lru while hot; guarded by its mutex
+	freed atomic.Bool            // once its key no longer holds it, and its file is removed
+}
+
+// The spilled values of every database of a server.
+type tieredStore struct {
+	once   sync.Once
+	dir    string
+	dirErr error
+	seq    atomic.Uint64 // numbers the files
+
+	mutex    sync.Mutex
+	lru      list.List // of *spilledValue that are hot, most recently used first
+	hotBytes int64
+	values   int64
+	bytes    int64
+
+	diskReads  atomic.Int64
+	memoryHits atomic.Int64
+}
+
+// Stores keys in memory like memoryEngine, except for spilled values, which it stores
+// the *spilledValue of.
+type tieredEngine struct {
+	memoryEngine
+	server *Server
+}
+
+func newTieredEngine(s *Server) Engine {
+	return &tieredEngine{server: s}
+}
+
+// What to store for value: a *spilledValue if it's to be spilled, else value itself. A
+// value that can't be spilled is kept in memory.
+func (e *tieredEngine) stored(value any) any {
+	str, ok := value.(string)
+	if !ok || int64(len(str)) < e.server.Tiered.Threshold.Load() {
+		return value
+	}
+	spilled, err := e.server.tiered.spill(e.server.RdbDir, str, e.server.Tiered.HotMemory.Load())
+	if err != nil {
+		e.server.Log.Warn("Keeping a large value in memory, since it can't be spilled to disk", "err", err)
+		return value
+	}
+	return spilled
+}
+
+// The value of what was stored for a key, read back from disk if it's cold, and false if
+// it was replaced meanwhile.
+func (e *tieredEngine) value(stored any) (any, bool) {
+	spilled, ok := stored.(*spilledValue)
+	if !ok {
+		return stored, true
+	}
+	return e.server.tiered.read(spilled, e.server.Tiered.HotMemory.Load())
+}
+
+// Spilled values are only freed once their key no longer holds them, so a read that
+// comes up empty is retried with the value that replaced them.
+func (e *tieredEngine) Get(key string) (any, bool) {
+	for {
+		stored, ok := e.values.Load(key)
+		if !ok {
+			return nil, false
+		}
+		if value, ok := e.value(stored); ok {
+			return value, true
+		}
+	}
+}
+
+func (e *tieredEngine) Set(key string, value any) {
+	if old, loaded := e.values.Swap(key, e.stored(value)); loaded {
+		e.server.tiered.free(old)
+	}
+}
+
+func (e *tieredEngine) SetIfAbsent(key string, value any) (any, bool) {
+	stored := e.stored(value)
+	for {
+		actual, loaded := e.values.LoadOrStore(key, stored)
+		if !loaded {
+			return value, false
+		}
+		if value, ok := e.value(actual); ok {
+			e.server.tiered.free(stored)
+			return value, true
+		}
+	}
+}
+
+func (e *tieredEngine) CompareAndSwap(key string, old, value any) bool {
+	var stored any
+	for {
+		current, ok := e.values.Load(key)
+		if !ok {
+			break
+		}
+		currentValue, ok := e.value(current)
+		if !ok {
+			continue
+		}
+		if currentValue != old {
+			break
+		}
+		if stored == nil {
+			stored = e.stored(value)
+		}
+		if e.values.CompareAndSwap(key, current, stored) {
+			e.server.tiered.free(current)
+			return true
+		}
+	}
+	e.server.tiered.free(stored)
+	return false
+}
+
+func (e *tieredEngine) Delete(key string) {
+	if old, loaded := e.values.LoadAndDelete(key); loaded {
+		e.server.tiered.free(old)
+	}
+}
+
+func (e *tieredEngine) CompareAndDelete(key string, value any) bool {
+	for {
+		current, ok := e.values.Load(key)
+		if !ok {
+			return false
+		}
+		currentValue, ok := e.value(current)
+		if !ok {
+			continue
+		}
+		if currentValue != value {
+			return false
+		}
+		if e.values.CompareAndDelete(key, current) {
+			e.server.tiered.free(current)
+			return true
+		}
+	}
+}
+
+// Cold values are read back from disk for fn, which is slow with many of them.
+func (e *tieredEngine) Scan(fn func(key string, value any) bool) {
+	e.values.Range(func(key, stored any) bool {
+		value, ok := e.value(stored)
+		if !ok {
+			// Replaced meanwhile, which may or may not be visited
+			value, ok = e.Get(key.(string))
+			if !ok {
+				return true
+			}
+		}
+		return fn(key.(string), value)
+	})
+}
+
+// Write str to a file of its own, keeping it hot for now.
+func (t *tieredStore) spill(rdbDir, str string, hotMemory int64) (*spilledValue, error) {
+	t.once.Do(func() {
+		// One of our own, so that deleting it can't take anything else with it
+		t.dir, t.dirErr = os.MkdirTemp(rdbDir, "tiered-")
+	})
+	if t.dirErr != nil {
+		return nil, t.dirErr
+	}
+	spilled := &spilledValue{
+		path: filepath.Join(t.dir, strconv.FormatUint(t.seq.Add(1), 10)),
+		size: int64(len(str)),
+	}
+	if err := os.WriteFile(spilled.path, []byte(str), 0o644); err != nil {
+		os.Remove(spilled.path)
+		return nil, err
+	}
+	t.mutex.Lock()
+	t.values++
+	t.bytes += spilled.size
+	t.mutex.Unlock()
+	t.used(spilled, str, hotMemory)
+	return spilled, nil
+}
+
+// Delete the directory values were spilled to, with every value in it, once nothing is
+// going to read them anymore.
+func (t *tieredStore) removeDir() {
+	t.once.Do(func() {}) // for t.dir, if another goroutine made it
+	if t.dir != "" {
+		os.RemoveAll(t.dir)
+	}
+}
+
+// The string spilled holds, and false if it was freed meanwhile. Its file can only be
+// missing then, as anything else is lost data, which is a reason to crash.
+func (t *tieredStore) read(spilled *spilledValue, hotMemory int64) (string, bool) {
+	if str := spilled.hot.Load(); str != nil {
+		t.memoryHits.Add(1)
+		t.used(spilled, *str, hotMemory)
+		return *str, true
+	}
+	data, err := os.ReadFile(spilled.path)
+	if err != nil {
+		if spilled.freed.Load() {
+			return "", false
+		}
+		panic(fmt.Sprintf("can't read back a value spilled to disk: %v", err))
+	}
+	t.diskReads.Add(1)
+	str := string(data)
+	t.used(spilled, str, hotMemory)
+	return str, true
+}
+
+// Mark spilled as the most recently used, keeping it in memory, and let the least
+// recently used values go cold until no more than hotMemory bytes of them are hot.
+func (t *tieredStore) used(spilled *spilledValue, str string, hotMemory int64) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if spilled.freed.Load() {
+		return
+	}
+	if spilled.elem != nil {
+		t.lru.MoveToFront(spilled.elem)
+	} else {
+		spilled.hot.Store(&str)
+		spilled.elem = t.lru.PushFront(spilled)
+		t.hotBytes += spilled.size
+	}
+	for t.hotBytes > hotMemory {
+		t.cool(t.lru.Back().Value.(*spilledValue))
+	}
+}
+
+// Keep spilled on disk only. The caller holds the mutex.
+func (t *tieredStore) cool(spilled *spilledValue) {
+	t.lru.Remove(spilled.elem)
+	spilled.elem = nil
+	spilled.hot.Store(nil)
+	t.hotBytes -= spilled.size
+}
+
+// Remove the file of what an engine stored, if it was spilled, as it's no longer there.
+func (t *tieredStore) free(stored any) {
+	spilled, ok := stored.(*spilledValue)
+	if !ok {
+		return
+	}
+	t.mutex.Lock()
+	spilled.freed.Store(true)
+	if spilled.elem != nil {
+		t.cool(spilled)
+	}
+	t.values--
+	t.bytes -= spilled.size
+	t.mutex.Unlock()
+	os.Remove(spilled.path)
+}
+
+func (s *Server) infoStorage() []string {
+	t := &s.tiered
+	t.mutex.Lock()
+	values, bytes, hot, hotBytes := t.values, t.bytes, int64(t.lru.Len()), t.hotBytes
+	t.mutex.Unlock()
+	reads, hits := t.diskReads.Load(), t.memoryHits.Load()
+	hotRatio := 0.0
+	if values > 0 {
+		hotRatio = float64(hot) / float64(values)
+	}
+	hitRatio := 0.0
+	if reads+hits > 0 {
+		hitRatio = float64(hits) / float64(reads+hits)
+	}
+	return []string{
+		"storage_engine:" + s.StorageEngine,
+		"tiered_values:" + strconv.FormatInt(values, 10),
+		"tiered_bytes:" + strconv.FormatInt(bytes, 10),
+		"tiered_hot_values:" + strconv.FormatInt(hot, 10),
+		"tiered_hot_bytes:" + strconv.FormatInt(hotBytes, 10),
+		"tiered_cold_values:" + strconv.FormatInt(values-hot, 10),
+		"tiered_cold_bytes:" + strconv.FormatInt(bytes-hotBytes, 10),
+		"tiered_hot_ratio:" + strconv.FormatFloat(hotRatio, 'f', 2, 64),
+		"tiered_memory_hits:" + strconv.FormatInt(hits, 10),
+		"tiered_disk_reads:" + strconv.FormatInt(reads, 10),
+		"tiered_memory_hit_ratio:" + strconv.FormatFloat(hitRatio, 'f', 2, 64),
+	}
+}
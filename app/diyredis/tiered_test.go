@@ -0,0 +1,104 @@
+package diyredis
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTieredEngine(t *testing.T) {
+	server := MakeServer()
+	server.RdbDir = t.TempDir()
+	if err := server.SetStorageEngine("tiered"); err != nil {
+		t.Fatal(err)
+	}
+	server.Tiered.Threshold.Store(10)
+	server.Tiered.HotMemory.Store(25) // room for one spilled value
+	// Left alone, however it's named
+	if err := os.Mkdir(filepath.Join(server.RdbDir, "tiered"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(server.RdbDir, "tiered", "mine"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	session, conn := newTestSession(server)
+	run := func(cmd ...string) string {
+		conn.buf.Reset()
+		session.dispatch(cmd)
+		return conn.buf.String()
+	}
+	files := func() int {
+		entries, _ := os.ReadDir(server.tiered.dir)
+		return len(entries)
+	}
+	info := func(field string) string {
+		for _, line := range strings.Split(run("INFO", "storage"), "\r\n") {
+			if value, ok := strings.CutPrefix(line, field+":"); ok {
+				return value
+			}
+		}
+		return ""
+	}
+
+	a, b := strings.Repeat("a", 20), strings.Repeat("b", 20)
+	run("SET", "small", "short")
+	run("SET", "a", a)
+	run("SET", "b", b)
+	if files() != 2 {
+		t.Errorf("got %d files, want 2", files())
+	}
+	if got := info("tiered_values"); got != "2" {
+		t.Errorf("tiered_values: got %q", got)
+	}
+	if got := info("tiered_hot_values") + " " + info("tiered_cold_values"); got != "1 1" {
+		t.Errorf("hot and cold values: got %q", got)
+	}
+	if got := info("tiered_hot_ratio"); got != "0.50" {
+		t.Errorf("tiered_hot_ratio: got %q", got)
+	}
+
+	// a went cold when b was written, and is read back from disk, making b cold
+	if got := run("GET", "a"); got != "$20\r\n"+a+"\r\n" {
+		t.Errorf("GET a: got %q", got)
+	}
+	if got := run("GET", "a"); got != "$20\r\n"+a+"\r\n" {
+		t.Errorf("GET a again: got %q", got)
+	}
+	if got := info("tiered_disk_reads"); got != "1" {
+		t.Errorf("tiered_disk_reads: got %q, want only the first GET", got)
+	}
+	if got := run("APPEND", "b", "!"); got != ":21\r\n" {
+		t.Errorf("APPEND b: got %q", got)
+	}
+	if got := run("MGET", "small", "b"); got != "*2\r\n$5\r\nshort\r\n$21\r\n"+b+"!\r\n" {
+		t.Errorf("MGET: got %q", got)
+	}
+	if files() != 2 {
+		t.Errorf("got %d files after replacing a value, want 2", files())
+	}
+
+	// Shrunk below the threshold, and deleted
+	run("SET", "a", "tiny")
+	run("DEL", "b")
+	if files() != 0 {
+		t.Errorf("got %d files after the values went away, want 0", files())
+	}
+	if got := info("tiered_values") + " " + info("tiered_bytes") + " " + info("tiered_hot_bytes"); got != "0 0 0" {
+		t.Errorf("values, bytes and hot bytes: got %q", got)
+	}
+	if got := run("GET", "a"); got != "$4\r\ntiny\r\n" {
+		t.Errorf("GET a: got %q", got)
+	}
+
+	if filepath.Dir(server.tiered.dir) != server.RdbDir {
+		t.Errorf("values spilled to %s, want a directory within %s", server.tiered.dir, server.RdbDir)
+	}
+	server.tiered.removeDir()
+	if _, err := os.Stat(server.tiered.dir); !os.IsNotExist(err) {
+		t.Errorf("directory of spilled values left behind: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(server.RdbDir, "tiered", "mine")); err != nil {
+		t.Errorf("a file that wasn't ours is gone: %v", err)
+	}
+}
@@ -0,0 +1,185 @@
+package diyredis
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	resp3 "github.com/codecrafters-io/redis-starter-go/app/diyredis/resp3"
+)
+
+// Client-side caching: clients that turned on CLIENT TRACKING are sent an invalidation
+// message when a key they may have cached is modified.
+//
+// In the default mode the server remembers which client read which key, and forgets
+// again once it told them about a change, since they're expected to drop the key from
+// their cache. In broadcast mode (BCAST) clients instead hear about every key starting
+// with one of their prefixes, without the server remembering any keys.
+//
+// Like Redis, keys are tracked by name only, regardless of the database they're in.
+// Invalidations are sent as RESP3 push messages; there's no Pub/Sub to redirect them to
+// the __redis__:invalidate channel for RESP2 clients.
+
+type trackingClient struct {
+	bcast    bool
+	prefixes []string // in broadcast mode, no prefixes means all keys
+	noLoop   bool     // don't tell the client about its own changes
+}
+
+type trackingState struct {
+	mutex   sync.Mutex
+	clients map[*Session]*trackingClient
+	keys    map[string]map[*Session]struct{} // default mode clients that read a key
+	count   atomic.Int64                     // number of tracking clients, to skip the lookup when there are none
+}
+
+func (t *trackingState) enable(s *Session, client *trackingClient) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.clients == nil {
+		t.clients = make(map[*Session]*trackingClient)
+		t.keys = make(map[string]map[*Session]struct{})
+	}
+	if _, ok := t.clients[s]; !ok {
+		t.count.Add(1)
+	}
+	t.clients[s] = client
+}
+
+// Turn tracking off for s, forgetting the keys it read.
+func (t *trackingState) disable(s *Session) {
+	if t.count.Load() == 0 {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if _, ok := t.clients[s]; !ok {
+		return
+	}
+	delete(t.clients, s)
+	t.count.Add(-1)
+	for key, readers := range t.keys {
+		delete(readers, s)
+		if len(readers) == 0 {
+			delete(t.keys, key)
+		}
+	}
+}
+
+// Remember that s read keys, if it tracks them.
+func (t *trackingState) read(s *Session, keys []string) {
+	if t.count.Load() == 0 || len(keys) == 0 {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	client, ok := t.clients[s]
+	if !ok || client.bcast {
+		return
+	}
+	for _, key := range keys {
+		readers := t.keys[key]
+		if readers == nil {
+			readers = make(map[*Session]struct{})
+			t.keys[key] = readers
+		}
+		readers[s] = struct{}{}
+	}
+}
+
+// Tell the clients tracking any of keys that they were modified by `by`, which is nil
+// for changes that weren't made by a client.
+func (t *trackingState) invalidate(by *Session, keys []string) {
+	if t.count.Load() == 0 || len(keys) == 0 {
+		return
+	}
+
+	invalidated := make(map[*Session][]string)
+	t.mutex.Lock()
+	for _, key := range keys {
+		for s := range t.keys[key] {
+			if s != by || !t.clients[s].noLoop {
+				invalidated[s] = append(invalidated[s], key)
+			}
+		}
+		delete(t.keys, key)
+		for s, client := range t.clients {
+			if client.bcast && (s != by || !client.noLoop) && hasAnyPrefix(key, client.prefixes) {
+				invalidated[s] = append(invalidated[s], key)
+			}
+		}
+	}
+	t.mutex.Unlock()
+
+	for s, keys := range invalidated {
+		encoder := resp3.Encoder{RESP3: true}
+		encoder.WritePush("invalidate", 1)
+		encoder.WriteArrHeader(len(keys))
+		for _, key := range keys {
+			encoder.WriteBulkStr(key)
+		}
+		if s == by {
+			s.conn.Write(encoder.Buf) // after the reply to the command that made the change
+		} else {
+			s.push(encoder.Buf)
+		}
+	}
+}
+
+func hasAnyPrefix(key string, prefixes []string) bool {
+	if len(prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// CLIENT TRACKING <ON | OFF> [BCAST] [PREFIX prefix [PREFIX prefix ...]] [NOLOOP]
+func (s *Session) clientTracking(cmds []string) *UserError {
+	if len(cmds) < 3 {
+		return &UserError{"ERR", "wrong number of arguments for CLIENT TRACKING command"}
+	}
+
+	client := &trackingClient{}
+	for i := 3; i < len(cmds); i++ {
+		switch strings.ToLower(cmds[i]) {
+		case "bcast":
+			client.bcast = true
+		case "prefix":
+			if i+1 == len(cmds) {
+				return ErrSyntax()
+			}
+			i++
+			client.prefixes = append(client.prefixes, cmds[i])
+		case "noloop":
+			client.noLoop = true
+		case "redirect":
+			return &UserError{"ERR", "REDIRECT is not supported, invalidations are only sent as RESP3 push messages"}
+		case "optin", "optout":
+			return &UserError{"ERR", "OPTIN and OPTOUT are not supported"}
+		default:
+			return ErrSyntax()
+		}
+	}
+
+	switch strings.ToLower(cmds[2]) {
+	case "on":
+		if s.proto != 3 {
+			return &UserError{"ERR", "Client tracking requires RESP3, switch to it with HELLO 3"}
+		}
+		if len(client.prefixes) > 0 && !client.bcast {
+			return &UserError{"ERR", "PREFIX option requires BCAST mode to be enabled"}
+		}
+		s.server.tracking.enable(s, client)
+	case "off":
+		s.server.tracking.disable(s)
+	default:
+		return ErrSyntax()
+	}
+	s.conn.Write(resp3.OK)
+	return nil
+}
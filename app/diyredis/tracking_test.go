@@ -0,0 +1,85 @@
+package diyredis
+
+import (
+	"testing"
+)
+
+func TestClientTracking(t *testing.T) {
+	server := MakeServer()
+	tracker, trackerConn := newTestSession(server)
+	writer, _ := newTestSession(server)
+	run := func(s *Session, cmd ...string) {
+		s.dispatch(cmd)
+	}
+	invalidation := func(keys ...string) string {
+		return ">2\r\n$10\r\ninvalidate\r\n" + string(makeRESPArr(keys))
+	}
+
+	run(tracker, "CLIENT", "TRACKING", "ON")
+	if got := trackerConn.buf.String(); got != "-ERR Client tracking requires RESP3, switch to it with HELLO 3\r\n" {
+		t.Errorf("got %q, want an error for a RESP2 client", got)
+	}
+	run(tracker, "HELLO", "3")
+	run(tracker, "CLIENT", "TRACKING", "ON")
+	run(tracker, "GET", "k")
+	run(tracker, "GET", "other")
+
+	trackerConn.buf.Reset()
+	run(writer, "SET", "k", "1")
+	if got, want := trackerConn.buf.String(), invalidation("k"); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// Told once, until the key is read again
+	trackerConn.buf.Reset()
+	run(writer, "SET", "k", "2")
+	if got := trackerConn.buf.String(); got != "" {
+		t.Errorf("got %q for a key that wasn't read again", got)
+	}
+	run(tracker, "GET", "k")
+	trackerConn.buf.Reset()
+	run(tracker, "SET", "k", "3")
+	if got, want := trackerConn.buf.String(), "+OK\r\n"+invalidation("k"); got != want {
+		t.Errorf("got %q, want %q for its own change, after the reply", got, want)
+	}
+
+	run(tracker, "CLIENT", "TRACKING", "OFF")
+	trackerConn.buf.Reset()
+	run(writer, "SET", "other", "1")
+	if got := trackerConn.buf.String(); got != "" {
+		t.Errorf("got %q after turning tracking off", got)
+	}
+}
+
+func TestClientTrackingBcast(t *testing.T) {
+	server := MakeServer()
+	tracker, trackerConn := newTestSession(server)
+	writer, _ := newTestSession(server)
+
+	tracker.dispatch([]string{"HELLO", "3"})
+	tracker.dispatch([]string{"CLIENT", "TRACKING", "ON", "PREFIX", "user:"})
+	if got := trackerConn.buf.String(); got[len(got)-len("BCAST mode to be enabled\r\n"):] != "BCAST mode to be enabled\r\n" {
+		t.Errorf("got %q, want an error for PREFIX without BCAST", got)
+	}
+	tracker.dispatch([]string{"CLIENT", "TRACKING", "ON", "BCAST", "PREFIX", "user:", "NOLOOP"})
+
+	trackerConn.buf.Reset()
+	writer.dispatch([]string{"MSET", "user:1", "a", "item:1", "b"})
+	if got, want := trackerConn.buf.String(), ">2\r\n$10\r\ninvalidate\r\n*1\r\n$6\r\nuser:1\r\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	trackerConn.buf.Reset()
+	tracker.dispatch([]string{"SET", "user:2", "c"})
+	if got := trackerConn.buf.String(); got != "+OK\r\n" {
+		t.Errorf("got %q, want no invalidation with NOLOOP", got)
+	}
+
+	// Switching back to RESP2 turns tracking off, there's no way to send invalidations
+	tracker.dispatch([]string{"HELLO", "2"})
+	trackerConn.buf.Reset()
+	writer.dispatch([]string{"SET", "user:3", "d"})
+	if got := trackerConn.buf.String(); got != "" {
+		t.Errorf("got %q after switching to RESP2", got)
+	}
+}
@@ -2,53 +2,147 @@ package diyredis
 
 import (
 	"errors"
+	"strings"
 	"unicode"
 
 	resp3 "github.com/codecrafters-io/redis-starter-go/app/diyredis/resp3"
 	streams "github.com/codecrafters-io/redis-starter-go/app/diyredis/streams"
 )
 
+// An error to reply to the client with. code is the first word of the reply, by which
+// clients tell errors apart: "ERR" for most, or something more specific like "WRONGTYPE".
 type UserError struct {
-	msg string
+	code string
+	msg  string
+}
+
+func ErrWrongType() *UserError {
+	return &UserError{"WRONGTYPE", "Operation against a key holding the wrong kind of value"}
+}
+
+func ErrSyntax() *UserError {
+	return &UserError{"ERR", "syntax error"}
+}
+
+func ErrNotInteger() *UserError {
+	return &UserError{"ERR", "value is not an integer or out of range"}
+}
+
+func ErrNoSuchKey() *UserError {
+	return &UserError{"ERR", "no such key"}
+}
+
+// Return the error code, e.g. "ERR" or "WRONGTYPE".
+func (e *UserError) Code() string {
+	return e.code
 }
 
 func (e *UserError) Error() string {
-	return e.msg
+	return e.code + " " + e.msg
 }
 
+// Encode the error as a RESP simple error. Line breaks would end the reply early, so
+// they're replaced by spaces.
 func (e *UserError) RESP() []byte {
-	return []byte("-ERR " + e.msg + "\r\n")
+	msg := strings.NewReplacer("\r", " ", "\n", " ").Replace(e.msg)
+	return []byte("-" + e.code + " " + msg + "\r\n")
 }
 
 var EmptyRespArr []byte = []byte("*0\r\n")
 
 // Encode a slice of entries into RESP. Only supports entries whose value is of type
-// map[string]string.
+// StreamFields, which is checked before anything is written, so that a streaming
+// encoder isn't left with half a reply.
 //
-// Will encode said map as a (RESP) array of key and values in order, just like in RESP2,
-// even though RESP3 has support for maps.
-func entriesToRESP(encoder *resp3.Encoder, entries []streams.Entry) error {
+// Will encode said fields as a (RESP) array of key and values in order, just like in
+// RESP2, even though RESP3 has support for maps.
+func entriesToRESP(encoder resp3.Writer, entries []streams.Entry) error {
+	if err := checkEntries(entries); err != nil {
+		return err
+	}
 	encoder.WriteArrHeader(len(entries))
 
 	for _, entry := range entries {
-		encoder.WriteArrHeader(2)
-		encoder.WriteBulkStr(entry.Key.String())
-		valMap, ok := entry.Val.(map[string]string)
-		if !ok {
+		entryToRESP(encoder, entry)
+	}
+
+	return nil
+}
+
+// Check that entries can be written with entryToRESP.
+func checkEntries(entries []streams.Entry) error {
+	for _, entry := range entries {
+		if _, ok := entry.Val.(StreamFields); !ok {
 			return errors.New(
-				"entry with wrong Val type; must be map[string]string",
+				"entry with wrong Val type; must be StreamFields",
 			)
 		}
-		encoder.WriteArrHeader(len(valMap) * 2)
-		for k, v := range valMap {
-			encoder.WriteBulkStr(k)
-			encoder.WriteBulkStr(v)
-		}
 	}
-
 	return nil
 }
 
+// Write a single entry, as an ID followed by its fields and values. Its Val must be
+// StreamFields.
+func entryToRESP(encoder resp3.Writer, entry streams.Entry) {
+	encoder.WriteArrHeader(2)
+	encoder.WriteBulkStr(entry.Key.String())
+	fields := entry.Val.(StreamFields)
+	encoder.WriteArrHeader(fields.Len() * 2)
+	for k, v := range fields.All() {
+		encoder.WriteBulkStr(k)
+		encoder.WriteBulkStr(v)
+	}
+}
+
+// Return an encoder for replies to this client, in the protocol version it asked for.
+func (s *Session) encoder() resp3.Encoder {
+	return resp3.Encoder{RESP3: s.proto == 3}
+}
+
+// Send attrs, alternating names and values, as metadata about the reply written next,
+// e.g. how popular the keys it's about are. Only RESP3 can carry that, so RESP2 clients
+// get the reply alone.
+func (s *Session) writeAttributes(attrs ...string) {
+	if s.proto != 3 || len(attrs) == 0 {
+		return
+	}
+	encoder := s.encoder()
+	encoder.WriteAttributeHeader(len(attrs) / 2)
+	for _, attr := range attrs {
+		encoder.WriteBulkStr(attr)
+	}
+	s.conn.Write(encoder.Buf)
+}
+
+// Like encoder, for replies big enough that they are better written to the client as
+// they are encoded. Flush it once done.
+func (s *Session) streamEncoder() *resp3.StreamEncoder {
+	return resp3.NewStreamEncoder(s.conn, s.proto == 3)
+}
+
+// Reply with an integer, formatted into scratch space of the session's own so that the
+// most common replies don't allocate. Writers don't keep what they are given.
+func (s *Session) writeInt(n int64) {
+	encoder := resp3.Encoder{Buf: s.scratch[:0]}
+	encoder.WriteIntFast(n)
+	s.conn.Write(encoder.Buf)
+	s.scratch = encoder.Buf
+}
+
+func (s *Session) writeNull() {
+	if s.proto == 3 {
+		s.conn.Write(resp3.Null)
+	} else {
+		s.conn.Write(resp3.NullBulkStr)
+	}
+}
+
+func (s *Session) writeNullArr() {
+	encoder := s.encoder()
+	encoder.WriteNullArr()
+	s.conn.Write(encoder.Buf)
+}
+
 func makeRESPArr(arr []string) []byte {
 	encoder := resp3.Encoder{}
 	encoder.WriteArrHeader(len(arr))
@@ -58,6 +152,13 @@ func makeRESPArr(arr []string) []byte {
 	return encoder.Buf
 }
 
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
 func isAlpha(str string) bool {
 	for _, char := range str {
 		if !unicode.IsLetter(char) {
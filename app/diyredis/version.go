@@ -0,0 +1,111 @@
+package diyredis
+
+import (
+	"net"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+
+	resp3 "github.com/codecrafters-io/redis-starter-go/app/diyredis/resp3"
+)
+
+// The Redis version we claim to be compatible with. Client libraries look at it to
+// decide which commands they can use.
+const Version = "7.4.0"
+
+// Build metadata, injected at compile time with e.g.
+//
+//	go build -ldflags "-X github.com/codecrafters-io/redis-starter-go/app/diyredis.GitSHA1=$(git rev-parse --short HEAD)"
+//
+// When they're left empty, whatever the Go toolchain recorded about the build is used.
+var (
+	GitSHA1  string
+	GitDirty string // "1" if built from a modified checkout
+	BuildID  string
+)
+
+type buildInfo struct {
+	gitSHA1  string
+	gitDirty string
+	buildID  string
+}
+
+func readBuildInfo() buildInfo {
+	info := buildInfo{gitSHA1: GitSHA1, gitDirty: GitDirty, buildID: BuildID}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range bi.Settings {
+			switch {
+			case setting.Key == "vcs.revision" && info.gitSHA1 == "":
+				info.gitSHA1 = setting.Value[:min(len(setting.Value), 8)]
+			case setting.Key == "vcs.modified" && info.gitDirty == "":
+				info.gitDirty = boolToInfo(setting.Value == "true")
+			}
+		}
+	}
+	if info.gitSHA1 == "" {
+		info.gitSHA1 = "00000000" // like Redis when built outside of git
+	}
+	if info.gitDirty == "" {
+		info.gitDirty = "0"
+	}
+	if info.buildID == "" {
+		info.buildID = "0"
+	}
+	return info
+}
+
+func (s *Server) infoServer() []string {
+	mode := "standalone"
+	if s.ClusterEnabled {
+		mode = "cluster"
+	}
+	port := 0
+	if s.Listener != nil {
+		if addr, ok := s.Listener.Addr().(*net.TCPAddr); ok {
+			port = addr.Port
+		}
+	}
+	uptime := time.Since(s.startTime)
+	return []string{
+		"redis_version:" + s.Version,
+		"redis_git_sha1:" + s.build.gitSHA1,
+		"redis_git_dirty:" + s.build.gitDirty,
+		"redis_build_id:" + s.build.buildID,
+		"redis_mode:" + mode,
+		"os:" + runtime.GOOS,
+		"arch_bits:" + strconv.Itoa(strconv.IntSize),
+		"go_version:" + runtime.Version(),
+		"process_id:" + strconv.Itoa(os.Getpid()),
+		"tcp_port:" + strconv.Itoa(port),
+		"uptime_in_seconds:" + strconv.Itoa(int(uptime.Seconds())),
+		"uptime_in_days:" + strconv.Itoa(int(uptime.Hours()/24)),
+	}
+}
+
+// LOLWUT [VERSION version]
+//
+// Redis draws some computer art here. We draw a small box, whatever version is asked for.
+func (s *Session) doLOLWUT(cmds []string) *UserError {
+	if len(cmds) != 1 && len(cmds) != 3 {
+		return ErrSyntax()
+	}
+	if len(cmds) == 3 {
+		if strings.ToLower(cmds[1]) != "version" {
+			return ErrSyntax()
+		}
+		if _, err := strconv.Atoi(cmds[2]); err != nil {
+			return &UserError{"ERR", "value is not an integer or out of range"}
+		}
+	}
+
+	art := "+-----------+\n" +
+		"| diy-redis |\n" +
+		"+-----------+\n"
+	encoder := resp3.Encoder{}
+	encoder.WriteBulkStr(art + "Redis ver. " + s.server.Version + "\n")
+	s.conn.Write(encoder.Buf)
+	return nil
+}
@@ -0,0 +1,46 @@
+package diyredis
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestVersionReporting(t *testing.T) {
+	server := MakeServer()
+	server.Version = "7.2.4"
+	session, conn := newTestSession(server)
+	run := func(cmd ...string) string {
+		conn.buf.Reset()
+		session.dispatch(cmd)
+		return conn.buf.String()
+	}
+
+	for _, tc := range []struct {
+		cmd  []string
+		want string
+	}{
+		{[]string{"INFO", "server"}, "redis_version:7.2.4\r\n"},
+		{[]string{"INFO"}, "# Server\r\n"},
+		{[]string{"HELLO"}, "$7\r\nversion\r\n$5\r\n7.2.4\r\n"},
+		{[]string{"LOLWUT"}, "Redis ver. 7.2.4\n"},
+		{[]string{"LOLWUT", "VERSION", "5"}, "Redis ver. 7.2.4\n"},
+		{[]string{"LOLWUT", "VERSION", "five"}, "-ERR value is not an integer or out of range\r\n"},
+	} {
+		if got := run(tc.cmd...); !strings.Contains(got, tc.want) {
+			t.Errorf("%v: got %q, want it to contain %q", tc.cmd, got, tc.want)
+		}
+	}
+	if got := run("INFO", "persistence"); strings.Contains(got, "redis_version") {
+		t.Errorf("got %q, want only the persistence section", got)
+	}
+}
+
+func TestBuildInfo(t *testing.T) {
+	defer func(sha1, dirty string) { GitSHA1, GitDirty = sha1, dirty }(GitSHA1, GitDirty)
+	GitSHA1, GitDirty = "abcdef12", "1"
+
+	info := readBuildInfo()
+	if info.gitSHA1 != "abcdef12" || info.gitDirty != "1" || info.buildID != "0" {
+		t.Errorf("got %+v, want the injected values", info)
+	}
+}
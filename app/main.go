@@ -1,9 +1,17 @@
 package main
 
 import (
+	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
+	"net"
 	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/codecrafters-io/redis-starter-go/app/diyredis"
 )
@@ -12,15 +20,283 @@ func main() {
 	server := diyredis.MakeServer()
 	flag.StringVar(&server.RdbDir, "dir", "", "the directory in which the rdb file resides")
 	flag.StringVar(&server.RdbFilename, "dbfilename", "", "the name of the RDB file")
+	flag.Var(&server.RdbLoadPolicy, "rdb-load-policy", "on a corrupt RDB file, either refuse to start (\"strict\") or load what we can (\"partial\")")
+	flag.Var(&server.SavePoints, "save", "save the RDB file after N changes in M seconds, as \"M N [M N ...]\", or \"\" to disable")
+	flag.BoolVar(&server.RdbChecksum, "rdb-checksum", true, "validate the CRC64 checksum of the RDB file before loading it")
+	flag.BoolVar(&server.AppendOnly, "appendonly", false, "load the dataset from the append only file, if there is one, instead of the RDB file")
+	flag.StringVar(&server.AppendDirname, "appenddirname", server.AppendDirname, "the directory, within -dir, holding the append only files")
+	flag.StringVar(&server.AppendFilename, "appendfilename", server.AppendFilename, "the base name of the append only files")
+	flag.BoolVar(&server.ClusterEnabled, "cluster-enabled", false, "run in cluster mode, serving hash slots instead of the entire keyspace")
+	flag.DurationVar(&server.CommandTimeout, "command-timeout", 0, "abort commands that take longer than this (e.g. \"500ms\"), 0 to disable")
+	flag.Func("timeout", "close the connection after a client is idle for N seconds, 0 to disable", func(val string) error {
+		secs, err := strconv.Atoi(val)
+		if err != nil || secs < 0 {
+			return errors.New("must be a positive number of seconds")
+		}
+		server.IdleTimeout = time.Duration(secs) * time.Second
+		return nil
+	})
+	flag.IntVar(&server.ProtoLimits.MaxBulkLen, "proto-max-bulk-len", diyredis.DefaultProtoLimits.MaxBulkLen, "the largest single argument a client may send, in bytes")
+	flag.IntVar(&server.ProtoLimits.MaxMultibulkLen, "proto-max-multibulk-len", diyredis.DefaultProtoLimits.MaxMultibulkLen, "the largest number of arguments a client may send in one command")
+	flag.Var(&server.OutputLimits, "client-output-buffer-limit", "disconnect clients of a class whose unsent replies exceed \"<class> <hard> <soft> <soft seconds>\", e.g. \"replica 256mb 64mb 60\"; 0 means no limit; may be repeated")
+	flag.DurationVar(&server.WriteTimeout, "client-write-timeout", 0, "disconnect clients that don't read what is written to them for this long (e.g. \"30s\"), 0 to disable")
+	flag.IntVar(&server.ConnLimits.MaxPerIP, "maxclients-per-ip", 0, "refuse new clients from an address with this many connected already, 0 for no limit")
+	flag.IntVar(&server.ConnLimits.MaxPerSecond, "max-connections-per-second", 0, "refuse new clients once this many were accepted in the last second, 0 for no limit")
+	flag.IntVar(&server.Encoding.Hash.MaxEntries, "hash-max-listpack-entries", diyredis.DefaultListpackLimits.MaxEntries, "hashes with more fields than this are stored as a hash table")
+	flag.IntVar(&server.Encoding.Hash.MaxValue, "hash-max-listpack-value", diyredis.DefaultListpackLimits.MaxValue, "hashes with a field or value longer than this are stored as a hash table")
+	flag.IntVar(&server.Encoding.List.MaxEntries, "list-max-listpack-entries", diyredis.DefaultListpackLimits.MaxEntries, "lists with more elements than this are stored as a quicklist")
+	flag.IntVar(&server.Encoding.List.MaxValue, "list-max-listpack-value", diyredis.DefaultListpackLimits.MaxValue, "lists with an element longer than this are stored as a quicklist")
+	flag.IntVar(&server.Encoding.Set.MaxEntries, "set-max-listpack-entries", diyredis.DefaultListpackLimits.MaxEntries, "sets with more members than this are stored as a hash table")
+	flag.IntVar(&server.Encoding.Set.MaxValue, "set-max-listpack-value", diyredis.DefaultListpackLimits.MaxValue, "sets with a member longer than this are stored as a hash table")
+	flag.Func("replicaof", "replicate the master at \"<host> <port>\"", func(val string) error {
+		host, port, ok := strings.Cut(val, " ")
+		if !ok || host == "" || port == "" {
+			return errors.New("must be \"<host> <port>\"")
+		}
+		server.MasterHost, server.MasterPort = host, port
+		return nil
+	})
+	flag.BoolVar(&server.ReplicaReadOnly, "replica-read-only", true, "refuse writes from clients while a replica")
+	flag.Var(&server.ReplBacklogSize, "repl-backlog-size", "keep this much of the commands sent to replicas (e.g. \"1mb\"), so that one reconnecting can be sent what it missed")
+	flag.BoolVar(&server.ReplDisklessSync, "repl-diskless-sync", true, "send snapshots to replicas as they are written, rather than once all of it is")
+	flag.BoolVar(&server.ReplicaServeStaleData, "replica-serve-stale-data", true, "reply to clients with possibly stale data while the link with the master is down")
+	flag.BoolVar(&server.Sentinel, "sentinel", false, "run as a sentinel, watching over the masters given with -sentinel-monitor")
+	flag.Func("sentinel-monitor", "watch over the master \"<name> <host> <port> <quorum>\"; may be repeated", func(val string) error {
+		fields := strings.Fields(val)
+		if len(fields) != 4 {
+			return errors.New("must be \"<name> <host> <port> <quorum>\"")
+		}
+		quorum, err := strconv.Atoi(fields[3])
+		if err != nil || quorum <= 0 {
+			return errors.New("the quorum must be 1 or greater")
+		}
+		server.SentinelMasters = append(server.SentinelMasters, diyredis.SentinelMaster{
+			Name: fields[0], Host: fields[1], Port: fields[2], Quorum: quorum,
+		})
+		return nil
+	})
+	flag.Func("sentinel-known-sentinel", "another sentinel watching a master, as \"<name> <host> <port>\"; may be repeated, after -sentinel-monitor", func(val string) error {
+		fields := strings.Fields(val)
+		if len(fields) != 3 {
+			return errors.New("must be \"<name> <host> <port>\"")
+		}
+		for i := range server.SentinelMasters {
+			if master := &server.SentinelMasters[i]; master.Name == fields[0] {
+				master.Sentinels = append(master.Sentinels, net.JoinHostPort(fields[1], fields[2]))
+				return nil
+			}
+		}
+		return errors.New("no such master: " + fields[0])
+	})
+	flag.DurationVar(&server.SentinelDownAfter, "sentinel-down-after", server.SentinelDownAfter, "consider a master down after it hasn't replied for this long")
+	flag.Func("databases", "the number of databases, which SELECT numbers from 0", func(val string) error {
+		n, err := strconv.Atoi(val)
+		if err != nil {
+			return errors.New("must be a number")
+		}
+		return server.SetDatabases(n)
+	})
+	flag.Func("storage-engine", "the engine to store the databases in (default memory)", server.SetStorageEngine)
+	flag.Func("rename-command", "rename a command, as \"<command> <new name>\", or disable it by leaving out the new name; may be repeated", func(val string) error {
+		name, newName, _ := strings.Cut(strings.TrimSpace(val), " ")
+		newName = strings.Trim(strings.TrimSpace(newName), `"`)
+		return server.RenameCommand(name, newName)
+	})
+	host, port, _ := net.SplitHostPort(server.Addr)
+	flag.StringVar(&host, "bind", host, "listen on this address only, instead of every interface")
+	flag.StringVar(&port, "port", port, "the port to listen on")
+	flag.StringVar(&server.UnixSocket, "unixsocket", "", "listen on this Unix socket too")
+	flag.Func("unixsocketperm", "the permissions of the Unix socket, in octal, e.g. 700", func(val string) error {
+		perm, err := strconv.ParseUint(val, 8, 32)
+		if err != nil || perm > 0o777 {
+			return errors.New("must be permission bits in octal")
+		}
+		server.UnixSocketPerm = os.FileMode(perm)
+		return nil
+	})
+	var tlsPort, tlsCertFile, tlsKeyFile string
+	flag.StringVar(&tlsPort, "tls-port", "", "listen for clients using TLS on this port too")
+	flag.StringVar(&tlsCertFile, "tls-cert-file", "", "the server's certificate for TLS, in PEM format")
+	flag.StringVar(&tlsKeyFile, "tls-key-file", "", "the private key of the certificate, in PEM format")
+	flag.BoolFunc("protected-mode", "while listening on every interface, refuse clients from other hosts (default true)", func(val string) error {
+		on, err := strconv.ParseBool(val)
+		server.ProtectedMode.Store(on)
+		return err
+	})
+	flag.BoolFunc("lazyfree-lazy-expire", "free the values of keys that expire in the background", func(val string) error {
+		on, err := strconv.ParseBool(val)
+		server.LazyFreeLazyExpire.Store(on)
+		return err
+	})
+	flag.BoolFunc("lazyfree-lazy-user-del", "free the values of keys deleted with DEL in the background, as UNLINK does", func(val string) error {
+		on, err := strconv.ParseBool(val)
+		server.LazyFreeLazyUserDel.Store(on)
+		return err
+	})
+	flag.Func("lfu-log-factor", "how slowly the access frequency of keys grows: the higher, the more accesses it takes (default 10)", func(val string) error {
+		n, err := strconv.ParseInt(val, 10, 64)
+		if err != nil || n < 0 {
+			return errors.New("must be a non-negative number")
+		}
+		server.LFU.LogFactor.Store(n)
+		return nil
+	})
+	flag.Func("lfu-decay-time", "decrement the access frequency of keys every N minutes without any, 0 to never (default 1)", func(val string) error {
+		n, err := strconv.ParseInt(val, 10, 64)
+		if err != nil || n < 0 {
+			return errors.New("must be a non-negative number of minutes")
+		}
+		server.LFU.DecayTime.Store(n)
+		return nil
+	})
+	flag.BoolFunc("rdb-incremental", "experimental: at save points, write only the keys changed since the last save, to delta files next to the RDB file", func(val string) error {
+		on, err := strconv.ParseBool(val)
+		server.RdbIncremental.Store(on)
+		return err
+	})
+	flag.Func("rdb-incremental-segments", "with -rdb-incremental, write the RDB file in full again after this many delta files (default 8)", func(val string) error {
+		n, err := strconv.ParseInt(val, 10, 64)
+		if err != nil || n < 0 {
+			return errors.New("must be a non-negative number")
+		}
+		server.RdbIncrementalSegments.Store(n)
+		return nil
+	})
+	flag.Func("tiered-threshold", "with -storage-engine tiered, spill strings of at least this many bytes to disk (default 16384)", func(val string) error {
+		n, err := strconv.ParseInt(val, 10, 64)
+		if err != nil || n < 0 {
+			return errors.New("must be a non-negative number of bytes")
+		}
+		server.Tiered.Threshold.Store(n)
+		return nil
+	})
+	flag.Func("tiered-hot-memory", "with -storage-engine tiered, keep up to this many bytes of the strings spilled to disk in memory too (default 67108864)", func(val string) error {
+		n, err := strconv.ParseInt(val, 10, 64)
+		if err != nil || n < 0 {
+			return errors.New("must be a non-negative number of bytes")
+		}
+		server.Tiered.HotMemory.Store(n)
+		return nil
+	})
+	var checkRdb string
+	flag.StringVar(&checkRdb, "check-rdb", "", "check this RDB file thoroughly without loading it, print a summary of what it holds and exit, like redis-check-rdb")
+	var checkAof string
+	var fixAof bool
+	flag.StringVar(&checkAof, "check-aof", "", "check this AOF, either its manifest or a single file, without loading it and exit, like redis-check-aof")
+	flag.BoolVar(&fixAof, "fix-aof", false, "with -check-aof, truncate the AOF to the last valid command")
+	var daemonize bool
+	flag.BoolVar(&daemonize, "daemonize", false, "run in the background, detached from the terminal; logs are lost unless -logfile is set")
+	flag.StringVar(&server.PidFile, "pidfile", "", "write the process ID to this file while running; "+defaultPidFile+" if daemonized")
+	flag.Func("logfile", "log to this file instead of stderr; it is reopened on SIGHUP or SIGUSR1, for log rotation", server.SetLogFile)
+	flag.TextVar(server.LogLevel, "loglevel", server.LogLevel, "log messages of at least this level: debug, info, warn or error")
 	flag.Parse()
-	err := server.LoadRdb()
-	if err != nil {
-		fmt.Println(err)
+	if flag.NArg() > 0 {
+		// Like redis-server, a config file can be given after the options, which win
+		// over it
+		server.ConfigFile = flag.Arg(0)
+		server.ConfigOverrides = map[string]bool{}
+		flag.Visit(func(f *flag.Flag) { server.ConfigOverrides[f.Name] = true })
+		if err := applyConfigFile(server.ConfigFile, server.ConfigOverrides); err != nil {
+			server.Log.Error("Can't read the config file", "file", server.ConfigFile, "err", err)
+			os.Exit(1)
+		}
+	}
+	if checkRdb != "" {
+		if err := server.CheckRdb(checkRdb, os.Stdout); err != nil {
+			server.Log.Error("The RDB file is not OK", "file", checkRdb, "err", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if checkAof != "" {
+		if err := server.CheckAof(checkAof, fixAof, os.Stdout); err != nil {
+			server.Log.Error("The AOF is not OK", "file", checkAof, "err", err)
+			os.Exit(1)
+		}
+		return
+	}
+	server.Addr = net.JoinHostPort(host, port)
+	if tlsPort != "" {
+		cert, err := tls.LoadX509KeyPair(tlsCertFile, tlsKeyFile)
+		if err != nil {
+			server.Log.Error("Can't load the TLS certificate", "err", err)
+			os.Exit(1)
+		}
+		server.TLSAddr = net.JoinHostPort(host, tlsPort)
+		server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+	if daemonize {
+		if os.Getenv(daemonizedEnv) == "" {
+			if err := runDaemon(); err != nil {
+				server.Log.Error("Can't daemonize", "err", err)
+				os.Exit(1)
+			}
+			return
+		}
+		if server.PidFile == "" {
+			server.PidFile = defaultPidFile
+		}
+	}
+	if server.Sentinel {
+		server.SavePoints = nil // there's no dataset
+	} else if err := server.LoadData(); err != nil {
+		server.Log.Error("Can't load the dataset", "err", err)
 		os.Exit(1)
 	}
 	server.Start()
 }
 
+// Apply the directives of a config file, each being the option of the same name, except
+// for the options given on the command line.
+func applyConfigFile(filename string, given map[string]bool) error {
+	directives, err := diyredis.ReadConfigFile(filename)
+	if err != nil {
+		return err
+	}
+	for _, directive := range directives {
+		if given[directive.Name] {
+			continue
+		}
+		value := directive.Value
+		if f := flag.Lookup(directive.Name); f != nil && isBoolFlag(f) {
+			// As in redis.conf
+			switch strings.ToLower(value) {
+			case "yes":
+				value = "true"
+			case "no":
+				value = "false"
+			}
+		}
+		if err := flag.Set(directive.Name, value); err != nil {
+			return fmt.Errorf("%s: %w", directive.Name, err)
+		}
+	}
+	return nil
+}
+
+func isBoolFlag(f *flag.Flag) bool {
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+const (
+	defaultPidFile = "/var/run/diy-redis.pid"
+	daemonizedEnv  = "DIY_REDIS_DAEMONIZED" // set for the process running in the background
+)
+
+// Run ourselves again with the same arguments, in the background: in a session of its
+// own and without a terminal, so that it outlives whatever started us.
+func runDaemon() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), daemonizedEnv+"=1")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	return cmd.Start() // stdin, stdout and stderr are /dev/null
+}
+
 // TODO list
 // - intialize a pool of goroutine workers that consume connections from a channel
 // - use recover() to catch all panics that happen inside a connection and not crash the